@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+func adapter(args []string) {
+	if len(args) != 2 || args[0] != "remove" {
+		fmt.Println("Usage: gocli adapter remove <adapter_name>")
+		os.Exit(1)
+	}
+	if err := vpn.RemoveAdapter(args[1]); err != nil {
+		fmt.Printf("Adapter remove error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Adapter %q removed\n", args[1])
+}
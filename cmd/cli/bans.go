@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// bans lists the addresses the server has seen fail to authenticate, or
+// lifts the lockout of one of them.
+func bans(args []string) {
+	fs := flag.NewFlagSet("bans", flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	asJSON := fs.Bool("json", false, "print machine-readable JSON")
+	fs.Parse(args)
+
+	switch fs.Arg(0) {
+	case "":
+	case "unban":
+		if fs.NArg() != 2 {
+			fmt.Println("Usage: gocli bans [-mgmt addr] unban <address>")
+			os.Exit(1)
+		}
+		if err := mgmtCall(*addr, http.MethodPost, "/unban", vpn.UnbanRequest{Address: fs.Arg(1)}, nil); err != nil {
+			fmt.Printf("Unban error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Unbanned %s.\n", fs.Arg(1))
+		return
+	default:
+		fmt.Println("Usage: gocli bans [-mgmt addr] [--json] [unban <address>]")
+		os.Exit(1)
+	}
+
+	var list vpn.BanList
+	if err := mgmtCall(*addr, http.MethodGet, "/bans", nil, &list); err != nil {
+		fmt.Printf("Bans error: %v\n", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(list)
+		return
+	}
+	if len(list.Bans) == 0 {
+		fmt.Println("No failed handshakes on record.")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tFAILURES\tLOCKOUTS\tLAST FAILURE\tLOCKED FOR")
+	for _, b := range list.Bans {
+		locked := "-"
+		if !b.LockedUntil.IsZero() {
+			locked = time.Until(b.LockedUntil).Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s ago\t%s\n",
+			b.Address, b.Failures, b.Lockouts,
+			time.Since(b.LastFailure).Round(time.Second), locked)
+	}
+	tw.Flush()
+	fmt.Printf("%d handshakes refused from locked out addresses.\n", list.Refused)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// bench runs a soak test through a local client and server pair and prints
+// throughput, latency percentiles, and the drop rate.
+func bench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	duration := fs.Duration("duration", 10*time.Second, "how long to generate traffic")
+	pps := fs.Int("pps", 10000, "target packets per second")
+	size := fs.Int("size", 1400, "inner packet size in bytes")
+	fastPath := fs.String("fast-path", "", "the server's fast_path, such as af_packet (Linux, as root)")
+	offload := fs.Bool("udp-offload", false, "send and receive in runs with UDP GSO and GRO (Linux)")
+	fs.Parse(args)
+
+	fmt.Printf("Benchmarking for %s at %d pps, %d byte packets...\n", *duration, *pps, *size)
+	res, err := vpn.Bench(vpn.BenchOptions{Duration: *duration, PPS: *pps, Size: *size, FastPath: *fastPath, UDPOffload: *offload})
+	if err != nil {
+		fmt.Printf("Bench error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Sent:        %d packets (%d not queued)\n", res.Sent, res.QueueDrops)
+	fmt.Printf("Received:    %d packets\n", res.Received)
+	fmt.Printf("Drop rate:   %.2f%%\n", res.DropRate()*100)
+	fmt.Printf("Throughput:  %.0f pps, %.1f Mbit/s\n", res.AchievedPPS, res.Mbps)
+	fmt.Printf("Latency:     p50 %s  p90 %s  p99 %s  max %s\n",
+		roundLatency(res.P50), roundLatency(res.P90), roundLatency(res.P99), roundLatency(res.Max))
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
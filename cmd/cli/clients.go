@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// clients lists the server's sessions once, named by provisioned name or
+// by the label the client sent.
+func clients(args []string) {
+	fs := flag.NewFlagSet("clients", flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	asJSON := fs.Bool("json", false, "print machine-readable JSON")
+	fs.Parse(args)
+
+	var list vpn.ClientList
+	if err := mgmtCall(*addr, http.MethodGet, "/clients", nil, &list); err != nil {
+		fmt.Printf("Clients error: %v\n", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(list)
+		return
+	}
+
+	sort.Slice(list.Clients, func(i, j int) bool {
+		return clientName(list.Clients[i]) < clientName(list.Clients[j])
+	})
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tENDPOINT\tADDRESS\tSESSION\tVERSION\tCONNECTED\tIDLE")
+	for _, c := range list.Clients {
+		address := c.Address
+		for _, a := range []string{c.Address6, c.Prefix} {
+			if a != "" {
+				address += " " + a
+			}
+		}
+		software := c.Software
+		if software == "" {
+			software = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			clientName(c), c.Endpoint, strings.TrimSpace(address), c.Session, software,
+			time.Since(c.ConnectedAt).Round(time.Second),
+			time.Since(c.LastSeen).Round(time.Second))
+	}
+	tw.Flush()
+}
+
+// clientName is the provisioned name of c, else the label it sent, marked
+// with a ~ since the client chose it.
+func clientName(c vpn.ClientInfo) string {
+	switch {
+	case c.Name != "":
+		return c.Name
+	case c.Label != "":
+		return "~" + c.Label
+	}
+	return "-"
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gedons/go_VPN/internal/sealedconfig"
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+func configCmd(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: gocli config encrypt|decrypt [-o out.yaml] <config.yaml>")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "encrypt":
+		encryptConfig(args[1:])
+	case "decrypt":
+		decryptConfig(args[1:])
+	default:
+		fmt.Println("Usage: gocli config encrypt|decrypt [-o out.yaml] <config.yaml>")
+		os.Exit(1)
+	}
+}
+
+// encryptConfig seals a config under a passphrase, or with -keystore to
+// this machine.
+func encryptConfig(args []string) {
+	fs := flag.NewFlagSet("config encrypt", flag.ExitOnError)
+	out := fs.String("o", "", "write the encrypted config here instead of stdout")
+	useKeyStore := fs.Bool("keystore", false, "seal to this machine with DPAPI instead of a passphrase (Windows)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: gocli config encrypt [-keystore] [-o out.yaml] <config.yaml>")
+		os.Exit(1)
+	}
+
+	plain, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Config error: %v\n", err)
+		os.Exit(1)
+	}
+	if sealedconfig.IsSealed(plain) {
+		fmt.Printf("Config error: %s is already encrypted\n", fs.Arg(0))
+		os.Exit(1)
+	}
+	if _, err := vpn.ParseConfig(plain); err != nil {
+		fmt.Printf("Config error: %v\n", err)
+		os.Exit(1)
+	}
+
+	method, passphrase := sealedconfig.Passphrase, ""
+	if *useKeyStore {
+		method = sealedconfig.KeyStore
+	} else {
+		passphrase = readPassphrase()
+	}
+	data, err := sealedconfig.Seal(plain, method, passphrase)
+	if err != nil {
+		fmt.Printf("Encrypt error: %v\n", err)
+		os.Exit(1)
+	}
+	writeConfigOut(*out, data)
+}
+
+// decryptConfig writes a sealed config back out as plain YAML.
+func decryptConfig(args []string) {
+	fs := flag.NewFlagSet("config decrypt", flag.ExitOnError)
+	out := fs.String("o", "", "write the decrypted config here instead of stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: gocli config decrypt [-o out.yaml] <config.yaml>")
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Config error: %v\n", err)
+		os.Exit(1)
+	}
+	if !sealedconfig.IsSealed(data) {
+		fmt.Printf("Config error: %s is not encrypted\n", fs.Arg(0))
+		os.Exit(1)
+	}
+	var passphrase string
+	if sealedconfig.Method(data) == sealedconfig.Passphrase {
+		passphrase = readPassphrase()
+	}
+	plain, err := sealedconfig.Open(data, passphrase)
+	if err != nil {
+		fmt.Printf("Decrypt error: %v\n", err)
+		os.Exit(1)
+	}
+	writeConfigOut(*out, plain)
+}
+
+// readPassphrase takes the passphrase from GOVPN_CONFIG_PASSPHRASE, or
+// else from the first line of stdin.
+func readPassphrase() string {
+	if p := os.Getenv(vpn.ConfigPassphraseEnv); p != "" {
+		return p
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Printf("Read passphrase: %v\n", err)
+		os.Exit(1)
+	}
+	p := strings.TrimRight(line, "\r\n")
+	if p == "" {
+		fmt.Println("Passphrase cannot be empty.")
+		os.Exit(1)
+	}
+	return p
+}
+
+// writeConfigOut writes data to path, readable only by its owner, or to
+// stdout when path is empty.
+func writeConfigOut(path string, data []byte) {
+	if path == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		fmt.Printf("Write error: %v\n", err)
+		os.Exit(1)
+	}
+}
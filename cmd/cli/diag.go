@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/gedons/go_VPN/internal/sealedconfig"
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// diagCommandTimeout bounds each system command diag runs.
+const diagCommandTimeout = 15 * time.Second
+
+// secretKeys are the config keys whose values diag leaves out.
+var secretKeys = []string{"psk", "previous_psks", "protected_psk", "password", "bind_password", "secret"}
+
+// diag gathers what is needed to debug a tunnel into a zip to attach to an
+// issue: the system, its adapters and routes, the firewall rules and other
+// changes GoVPN made, the running client's or server's logs and status,
+// the config without its secrets, and a test of reaching the server.
+func diag(args []string) {
+	fs := flag.NewFlagSet("diag", flag.ExitOnError)
+	addr := fs.String("mgmt", "", "management API address; the config's, or the default, if unset")
+	out := fs.String("o", "", "zip file to write; govpn-diag-<time>.zip if unset")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fmt.Println("Usage: gocli diag [-mgmt addr] [-o file.zip] [config.yaml]")
+		os.Exit(1)
+	}
+	if *out == "" {
+		*out = "govpn-diag-" + time.Now().Format("20060102-150405") + ".zip"
+	}
+
+	var cfg *vpn.Config
+	var cfgErr error
+	files := make(map[string]string)
+	if fs.NArg() == 1 {
+		files["config.yaml"] = redactedConfig(fs.Arg(0))
+		var c vpn.Config
+		if c, cfgErr = vpn.LoadConfig(fs.Arg(0)); cfgErr == nil {
+			cfg = &c
+		}
+	}
+	if *addr == "" {
+		*addr = vpn.DefaultManagementAddress
+		if cfg != nil && cfg.ManagementAddress != "" {
+			*addr = cfg.ManagementAddress
+		}
+	}
+
+	files["system.txt"] = diagSystem()
+	files["adapters.txt"] = runCommands(adapterCommands())
+	files["routes.txt"] = runCommands(routeCommands())
+	files["firewall.txt"] = diagFirewall(cfg)
+	for name, text := range diagManagement(*addr, cfg) {
+		files[name] = text
+	}
+	files["connectivity.txt"] = diagConnectivity(cfg, cfgErr)
+
+	if err := writeZip(*out, files); err != nil {
+		fmt.Printf("Diag error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %s. Look it over before attaching it to an issue; it holds addresses and log lines.\n", *out)
+}
+
+func diagSystem() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Build: %s\n", vpn.Build())
+	fmt.Fprintf(&b, "Platform: %s/%s, %d CPUs\n", runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+	fmt.Fprintf(&b, "Collected: %s\n\n", time.Now().Format(time.RFC3339))
+	switch runtime.GOOS {
+	case "windows":
+		b.WriteString(runCommands([][]string{{"cmd", "/c", "ver"}}))
+	case "darwin":
+		b.WriteString(runCommands([][]string{{"sw_vers"}, {"uname", "-a"}}))
+	default:
+		b.WriteString(runCommands([][]string{{"uname", "-a"}, {"cat", "/etc/os-release"}}))
+	}
+	return b.String()
+}
+
+func adapterCommands() [][]string {
+	switch runtime.GOOS {
+	case "windows":
+		return [][]string{
+			{"powershell", "-NoProfile", "-Command", "Get-NetAdapter | Format-List Name,InterfaceDescription,ifIndex,Status,MacAddress,LinkSpeed,MtuSize"},
+			{"powershell", "-NoProfile", "-Command", "Get-NetIPAddress | Format-Table -AutoSize InterfaceAlias,IPAddress,PrefixLength,AddressFamily"},
+			{"powershell", "-NoProfile", "-Command", "Get-DnsClientServerAddress | Format-Table -AutoSize"},
+		}
+	case "darwin":
+		return [][]string{{"ifconfig", "-a"}, {"scutil", "--dns"}}
+	default:
+		return [][]string{{"ip", "addr"}, {"cat", "/etc/resolv.conf"}}
+	}
+}
+
+func routeCommands() [][]string {
+	switch runtime.GOOS {
+	case "windows":
+		return [][]string{{"route", "print"}}
+	case "darwin":
+		return [][]string{{"netstat", "-rn"}}
+	default:
+		return [][]string{{"ip", "route"}, {"ip", "-6", "route"}, {"ip", "rule"}}
+	}
+}
+
+// diagFirewall lists the firewall rules and NAT GoVPN adds, and the host
+// changes in cfg's journal.
+func diagFirewall(cfg *vpn.Config) string {
+	var b strings.Builder
+	if runtime.GOOS == "windows" {
+		b.WriteString(runCommands([][]string{
+			{"powershell", "-NoProfile", "-Command", "Get-NetFirewallRule -DisplayName 'GoVPN*' | Format-List DisplayName,Group,Enabled,Direction,Action,Profile"},
+			{"powershell", "-NoProfile", "-Command", "Get-NetNat | Format-List"},
+		}))
+	} else if runtime.GOOS == "linux" {
+		b.WriteString(runCommands([][]string{{"nft", "list", "ruleset"}, {"sysctl", "net.ipv4.ip_forward"}}))
+	} else {
+		b.WriteString("GoVPN adds no firewall rules on this platform.\n\n")
+	}
+	if cfg == nil {
+		b.WriteString("Host changes: pass a config to list them.\n")
+		return b.String()
+	}
+	changes, err := vpn.HostChanges(*cfg)
+	switch {
+	case err != nil:
+		fmt.Fprintf(&b, "Host changes: %v\n", err)
+	case len(changes) == 0:
+		b.WriteString("Host changes: none recorded.\n")
+	default:
+		b.WriteString("Host changes:\n")
+		for _, c := range changes {
+			fmt.Fprintf(&b, "  %s\n", c)
+		}
+	}
+	return b.String()
+}
+
+// diagManagement fetches the version, status, and recent logs of the
+// client or server running at addr.
+func diagManagement(addr string, cfg *vpn.Config) map[string]string {
+	paths := map[string]string{"version.json": "/version", "status.json": "/status", "clients.json": "/clients"}
+	if cfg != nil && cfg.TunnelConfigs() != nil {
+		paths["status.json"] = "/tunnels"
+	}
+	if cfg != nil && cfg.Mode == "server" {
+		delete(paths, "status.json")
+	} else if cfg != nil {
+		delete(paths, "clients.json")
+	}
+
+	files := make(map[string]string)
+	for name, path := range paths {
+		var raw json.RawMessage
+		if err := mgmtCall(addr, http.MethodGet, path, nil, &raw); err != nil {
+			files[name] = fmt.Sprintf("%s %s: %v\n", addr, path, err)
+			continue
+		}
+		var b bytes.Buffer
+		if json.Indent(&b, raw, "", "  ") != nil {
+			b.Reset()
+			b.Write(raw)
+		}
+		files[name] = b.String() + "\n"
+	}
+
+	var resp vpn.LogsResponse
+	if err := mgmtCall(addr, http.MethodGet, fmt.Sprintf("/logs?n=%d", vpn.DefaultLogLines*5), nil, &resp); err != nil {
+		files["logs.txt"] = fmt.Sprintf("%s /logs: %v\n", addr, err)
+		return files
+	}
+	var b strings.Builder
+	for _, l := range resp.Lines {
+		b.WriteString(l.Text + "\n")
+	}
+	files["logs.txt"] = b.String()
+	return files
+}
+
+// diagConnectivity resolves a client's servers and asks each whether it
+// would accept a handshake.
+func diagConnectivity(cfg *vpn.Config, cfgErr error) string {
+	switch {
+	case cfgErr != nil:
+		return fmt.Sprintf("Config error: %v\n", cfgErr)
+	case cfg == nil:
+		return "Pass a client config to test reaching its servers.\n"
+	case cfg.Mode == "server":
+		return "Server config: nothing to test; run diag with a client's config on the client.\n"
+	}
+	tunnels := cfg.TunnelConfigs()
+	if tunnels == nil {
+		tunnels = map[string]vpn.Config{"": *cfg}
+	}
+	names := make([]string, 0, len(tunnels))
+	for name := range tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		t := tunnels[name]
+		if name != "" {
+			fmt.Fprintf(&b, "Tunnel %s:\n", name)
+		}
+		client := vpn.NewClient(t)
+		for _, address := range append([]string{t.ServerAddress}, t.FallbackAddresses...) {
+			fmt.Fprintf(&b, "  %s\n", address)
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				fmt.Fprintf(&b, "    address: %v\n", err)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+			cancel()
+			if err != nil {
+				fmt.Fprintf(&b, "    resolve: FAIL: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(&b, "    resolve: %s\n", strings.Join(addrs, ", "))
+			rtt, err := client.CheckServer(address)
+			if err != nil {
+				fmt.Fprintf(&b, "    handshake: FAIL: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(&b, "    handshake: PASS in %v\n", rtt.Round(time.Microsecond))
+		}
+		client.Stop()
+	}
+	return b.String()
+}
+
+// redactedConfig returns the config at path with its secrets replaced. An
+// encrypted one is opened with the passphrase in the environment or this
+// machine's key store.
+func redactedConfig(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Sprintf("# %v\n", err)
+	}
+	if sealedconfig.IsSealed(data) {
+		if data, err = sealedconfig.Open(data, os.Getenv(vpn.ConfigPassphraseEnv)); err != nil {
+			return fmt.Sprintf("# encrypted config left out: %v\n", err)
+		}
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Sprintf("# config left out, since it does not parse: %v\n", err)
+	}
+	out, err := yaml.Marshal(redact(doc))
+	if err != nil {
+		return fmt.Sprintf("# %v\n", err)
+	}
+	return "# " + path + ", secrets replaced by REDACTED\n" + string(out)
+}
+
+// redact replaces the values of secretKeys in v, and the credentials and
+// query in URLs, such as a webhook's token.
+func redact(v any) any {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			key, _ := item.Key.(string)
+			switch {
+			case slices.Contains(secretKeys, key) && item.Value != nil:
+				v[i].Value = "REDACTED"
+			case key == "url":
+				if s, ok := item.Value.(string); ok {
+					v[i].Value = redactURL(s)
+				}
+			default:
+				v[i].Value = redact(item.Value)
+			}
+		}
+		return v
+	case []any:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+		return v
+	}
+	return v
+}
+
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "REDACTED"
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	return u.String()
+}
+
+// runCommands runs each command and returns what they print, each under
+// its command line.
+func runCommands(cmds [][]string) string {
+	var b strings.Builder
+	for _, c := range cmds {
+		fmt.Fprintf(&b, "$ %s\n", strings.Join(c, " "))
+		ctx, cancel := context.WithTimeout(context.Background(), diagCommandTimeout)
+		out, err := exec.CommandContext(ctx, c[0], c[1:]...).CombinedOutput()
+		cancel()
+		b.Write(out)
+		if err != nil {
+			fmt.Fprintf(&b, "(%v)\n", err)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func writeZip(path string, files map[string]string) error {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, name := range names {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(files[name])); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o600)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/ssdp"
+)
+
+var serverAddressLine = regexp.MustCompile(`(?m)^server_address:.*$`)
+
+// discover lists GoVPN servers on the local network that have discovery
+// enabled and can write one of them into a client config.
+func discover(args []string) {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 3*time.Second, "how long to wait for answers")
+	config := fs.String("config", "", "client config whose server_address is set to the server found")
+	pick := fs.Int("pick", 1, "which server to write to -config when several answer")
+	fs.Parse(args)
+
+	servers, err := ssdp.Discover(context.Background(), *timeout)
+	if err != nil {
+		fmt.Printf("Discover error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(servers) == 0 {
+		fmt.Println("No servers found. Is discovery: true set in the server config?")
+		os.Exit(1)
+	}
+	for i, srv := range servers {
+		transport := srv.Transport
+		if srv.Encapsulation != "" {
+			transport += "+" + srv.Encapsulation
+		}
+		fmt.Printf("%d. %-24s %-22s %s\n", i+1, srv.Name, srv.Endpoint, transport)
+	}
+	if *config == "" {
+		return
+	}
+
+	if *pick < 1 || *pick > len(servers) {
+		fmt.Printf("gocli discover: -pick must be between 1 and %d\n", len(servers))
+		os.Exit(1)
+	}
+	srv := servers[*pick-1]
+	data, err := os.ReadFile(*config)
+	if err != nil {
+		fmt.Printf("gocli discover: %v\n", err)
+		os.Exit(1)
+	}
+	line := "server_address: " + srv.Endpoint.String()
+	if serverAddressLine.Match(data) {
+		data = serverAddressLine.ReplaceAllLiteral(data, []byte(line))
+	} else {
+		data = append([]byte(line+"\n"), data...)
+	}
+	if err := os.WriteFile(*config, data, 0o600); err != nil {
+		fmt.Printf("gocli discover: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Set server_address to %s in %s\n", srv.Endpoint, *config)
+	if srv.Transport != "udp" || srv.Encapsulation != "" {
+		fmt.Printf("The server uses %s; set transport and encapsulation to match.\n", srv.Transport)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+	"gopkg.in/yaml.v2"
+)
+
+// exportClient provisions a client on the running server and prints its
+// config as text and as a QR code, and writes it to a file.
+func exportClient(args []string) {
+	fs := flag.NewFlagSet("export-client", flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	name := fs.String("name", "", "client name, such as laptop")
+	endpoint := fs.String("endpoint", "", "public host:port of the server")
+	routes := fs.String("routes", "0.0.0.0/0", "comma-separated prefixes the client sends through the tunnel")
+	allowedIPs := fs.String("allowed-ips", "", "comma-separated prefixes behind the client, routed only to it")
+	out := fs.String("o", "", "config file to write (default <name>.yaml)")
+	fs.Parse(args)
+
+	if *name == "" || *endpoint == "" {
+		fmt.Println("Usage: gocli export-client -name <name> -endpoint <host:port> [-routes 0.0.0.0/0] [-allowed-ips prefixes] [-o file]")
+		os.Exit(1)
+	}
+	if _, _, err := net.SplitHostPort(*endpoint); err != nil {
+		fmt.Printf("gocli export-client: invalid -endpoint: %v\n", err)
+		os.Exit(1)
+	}
+	var req vpn.ExportClientRequest
+	req.Name = *name
+	for _, r := range strings.Split(*routes, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			req.Routes = append(req.Routes, r)
+		}
+	}
+	for _, p := range strings.Split(*allowedIPs, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			req.AllowedIPs = append(req.AllowedIPs, p)
+		}
+	}
+
+	var entry vpn.ClientEntry
+	if err := mgmtCall(*addr, http.MethodPost, "/clients", req, &entry); err != nil {
+		fmt.Printf("gocli export-client: %v\n", err)
+		os.Exit(1)
+	}
+	profile, err := yaml.Marshal(clientProfile{
+		Mode:          "client",
+		ServerAddress: *endpoint,
+		PSK:           entry.PSK,
+		AdapterName:   "GoVPN-Client",
+		AdapterIPCIDR: entry.Address,
+		Routes:        entry.Routes,
+	})
+	if err != nil {
+		fmt.Printf("gocli export-client: %v\n", err)
+		os.Exit(1)
+	}
+	if *out == "" {
+		*out = entry.Name + ".yaml"
+	}
+	fmt.Printf("Provisioned %q at %s\n\n", entry.Name, entry.Address)
+	printProfile(profile, *out)
+}
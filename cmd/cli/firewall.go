@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// firewall removes the Windows Firewall rules GoVPN added, such as after
+// uninstalling or a crash the journal could not undo.
+func firewall(args []string) {
+	if len(args) != 1 || args[0] != "clean" {
+		fmt.Println("Usage: gocli firewall clean")
+		os.Exit(1)
+	}
+	n, err := vpn.RemoveFirewallRules()
+	if err != nil {
+		fmt.Printf("Firewall clean error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Removed %d firewall rules.\n", n)
+}
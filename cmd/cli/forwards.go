@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// forwards lists the port forwards of a client or server, or enables or
+// disables one of them.
+func forwards(args []string) {
+	fs := flag.NewFlagSet("forwards", flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	asJSON := fs.Bool("json", false, "print machine-readable JSON")
+	fs.Parse(args)
+
+	switch fs.Arg(0) {
+	case "":
+	case "enable", "disable":
+		if fs.NArg() != 2 {
+			fmt.Println("Usage: gocli forwards [-mgmt addr] enable|disable <name>")
+			os.Exit(1)
+		}
+		path := "/forwards/" + url.PathEscape(fs.Arg(1)) + "/" + fs.Arg(0)
+		if err := mgmtCall(*addr, http.MethodPost, path, nil, nil); err != nil {
+			fmt.Printf("Forwards error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Port forward %s %sd.\n", fs.Arg(1), fs.Arg(0))
+		return
+	default:
+		fmt.Println("Usage: gocli forwards [-mgmt addr] [--json] [enable|disable <name>]")
+		os.Exit(1)
+	}
+
+	var list []vpn.PortForwardStatus
+	if err := mgmtCall(*addr, http.MethodGet, "/forwards", nil, &list); err != nil {
+		fmt.Printf("Forwards error: %v\n", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(list)
+		return
+	}
+	if len(list) == 0 {
+		fmt.Println("No port forwards configured.")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPROTO\tLISTEN\tTARGET\tSTATE\tACTIVE\tTOTAL")
+	for _, f := range list {
+		state := "enabled"
+		switch {
+		case f.Error != "":
+			state = "error: " + f.Error
+		case !f.Enabled:
+			state = "disabled"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+			f.Name, f.Protocol, f.Listen, f.Target, state, f.Active, f.Connections)
+	}
+	tw.Flush()
+}
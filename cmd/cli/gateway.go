@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/stun"
+	"github.com/gedons/go_VPN/pkg/vpn"
+	"gopkg.in/yaml.v2"
+)
+
+// gateway runs a server set up as a home gateway: an address pool, NAT,
+// pushed DNS, and a port mapping, and prints a client config to scan.
+func gateway(args []string) {
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	listen := fs.String("listen", "0.0.0.0:51820", "UDP address to listen on")
+	endpoint := fs.String("endpoint", "", "public host:port clients connect to (discovered over STUN if empty)")
+	subnet := fs.String("subnet", "10.0.0.0/24", "tunnel subnet; the gateway takes the first address and leases the rest")
+	dns := fs.String("dns", "1.1.1.1,1.0.0.1", "comma-separated DNS servers pushed to clients")
+	psk := fs.String("psk", "", "pre-shared key (random if empty)")
+	adapter := fs.String("adapter", "GoVPN-Gateway", "adapter name")
+	mgmt := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	upnp := fs.Bool("upnp", true, "ask the router to forward the UDP port")
+	stunServer := fs.String("stun", "stun.l.google.com:19302", "STUN server used to discover the public address")
+	out := fs.String("o", "", "also write the client config to this file")
+	fs.Parse(args)
+
+	prefix, err := netip.ParsePrefix(*subnet)
+	if err != nil || !prefix.Addr().Is4() {
+		fmt.Printf("gocli gateway: invalid -subnet %q\n", *subnet)
+		os.Exit(1)
+	}
+	prefix = prefix.Masked()
+	var resolvers []string
+	for _, d := range strings.Split(*dns, ",") {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(d); err != nil {
+			fmt.Printf("gocli gateway: invalid -dns: %v\n", err)
+			os.Exit(1)
+		}
+		resolvers = append(resolvers, d)
+	}
+	if *psk == "" {
+		b, err := crypto.RandomBytes(24)
+		if err != nil {
+			fmt.Printf("gocli gateway: %v\n", err)
+			os.Exit(1)
+		}
+		*psk = base64.RawURLEncoding.EncodeToString(b)
+	}
+	_, port, err := net.SplitHostPort(*listen)
+	if err != nil {
+		fmt.Printf("gocli gateway: invalid -listen: %v\n", err)
+		os.Exit(1)
+	}
+	if *endpoint == "" {
+		res, err := stun.Probe([]string{*stunServer}, 3*time.Second)
+		if err != nil {
+			fmt.Printf("gocli gateway: could not discover the public address (%v); pass -endpoint\n", err)
+			os.Exit(1)
+		}
+		*endpoint = net.JoinHostPort(res.Public.Addr().String(), port)
+	}
+
+	cfg := vpn.Config{
+		Mode:              "server",
+		ServerAddress:     *listen,
+		PSK:               *psk,
+		AdapterName:       *adapter,
+		AdapterIPCIDR:     netip.PrefixFrom(prefix.Addr().Next(), prefix.Bits()).String(),
+		ManagementAddress: *mgmt,
+		Pool:              prefix.String(),
+		DNS:               resolvers,
+		NAT:               true,
+		UPnP:              *upnp,
+	}
+	profile, err := yaml.Marshal(clientProfile{
+		Mode:          "client",
+		ServerAddress: *endpoint,
+		PSK:           *psk,
+		AdapterName:   "GoVPN-Client",
+		AdapterIPCIDR: vpn.AutoAddress,
+	})
+	if err != nil {
+		fmt.Printf("gocli gateway: %v\n", err)
+		os.Exit(1)
+	}
+
+	server := vpn.NewServer(cfg)
+	if err := server.Start(); err != nil {
+		fmt.Printf("Server start error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Gateway %s listening on %s, leasing %s, DNS %s\n\n",
+		cfg.AdapterIPCIDR, *listen, cfg.Pool, strings.Join(resolvers, ", "))
+	printProfile(profile, *out)
+	waitForQuit(nil)
+	server.Stop()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+	"gopkg.in/yaml.v2"
+)
+
+// importConfig translates another VPN's client config into a GoVPN one.
+func importConfig(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	out := fs.String("o", "", "config file to write (default <name>.yaml)")
+	psk := fs.String("psk", "", "GoVPN psk to use (default a WireGuard peer's PresharedKey, else a new one)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: gocli import [-psk key] [-o out.yaml] <wg0.conf|profile.ovpn>")
+		os.Exit(1)
+	}
+	path := fs.Arg(0)
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	var profile clientProfile
+	var notes []string
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".conf":
+		profile, notes, err = importWireGuard(path, name, *psk)
+	case ".ovpn":
+		profile, notes, err = importOpenVPN(path, name, *psk)
+	default:
+		err = fmt.Errorf("%s: unsupported; import reads WireGuard .conf and OpenVPN .ovpn files", path)
+	}
+	if err != nil {
+		fmt.Printf("Import error: %v\n", err)
+		os.Exit(1)
+	}
+
+	data, err := yaml.Marshal(profile)
+	if err != nil {
+		fmt.Printf("Import error: %v\n", err)
+		os.Exit(1)
+	}
+	if _, err := vpn.ParseConfig(data); err != nil {
+		fmt.Printf("Import error: the translated config is invalid: %v\n", err)
+		os.Exit(1)
+	}
+	if *out == "" {
+		*out = name + ".yaml"
+	}
+	if _, err := os.Stat(*out); err == nil {
+		fmt.Printf("Import error: %s already exists; choose another with -o\n", *out)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*out, data, 0o600); err != nil {
+		fmt.Printf("Import error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %s from %s\n", *out, path)
+	for _, n := range notes {
+		fmt.Printf("  - %s\n", n)
+	}
+}
+
+// newPSKNote tells the user what to do with a psk from newPSK.
+const newPSKNote = "psk is new; add it to the server, or provision the client with gocli export-client and use its psk"
+
+// newPSK returns a random psk for an imported config, like the ones gocli
+// export-client provisions.
+func newPSK() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gedons/go_VPN/internal/logbuf"
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// logs prints the client's or server's recent log lines, and with -f keeps
+// printing new ones as they are logged.
+func logs(args []string) {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	n := fs.Int("n", vpn.DefaultLogLines, "number of recent lines to show")
+	follow := fs.Bool("f", false, "keep printing new lines until interrupted")
+	fs.Parse(args)
+
+	path := fmt.Sprintf("/logs?n=%d", *n)
+	if !*follow {
+		var resp vpn.LogsResponse
+		if err := mgmtCall(*addr, http.MethodGet, path, nil, &resp); err != nil {
+			fmt.Printf("Logs error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, l := range resp.Lines {
+			fmt.Println(l.Text)
+		}
+		return
+	}
+
+	// The stream lasts as long as the tunnel, so it gets no timeout.
+	resp, err := http.Get("http://" + *addr + path + "&follow=true")
+	if err != nil {
+		fmt.Printf("Logs error: management API unreachable: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Logs error: management API returned %s\n", resp.Status)
+		os.Exit(1)
+	}
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		var l logbuf.Entry
+		if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+			fmt.Printf("Logs error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(l.Text)
+	}
+	fmt.Println("Logs ended: the client or server stopped.")
+}
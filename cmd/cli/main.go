@@ -1,50 +1,255 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/gedons/go_VPN/pkg/vpn"
 )
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: gocli <config.yaml>")
-		os.Exit(1)
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "rotate-key":
+		rotateKey(os.Args[2:])
+	case "status":
+		status(os.Args[2:])
+	case "top":
+		top(os.Args[2:])
+	case "clients":
+		clients(os.Args[2:])
+	case "bans":
+		bans(os.Args[2:])
+	case "probes":
+		probes(os.Args[2:])
+	case "adapter":
+		adapter(os.Args[2:])
+	case "selftest":
+		selftest(os.Args[2:])
+	case "bench":
+		bench(os.Args[2:])
+	case "speedtest":
+		speedtest(os.Args[2:])
+	case "vectors":
+		vectors(os.Args[2:])
+	case "gateway":
+		gateway(os.Args[2:])
+	case "export-client":
+		exportClient(os.Args[2:])
+	case "import":
+		importConfig(os.Args[2:])
+	case "export-wg":
+		exportWireGuard(os.Args[2:])
+	case "revoke":
+		revoke(os.Args[2:])
+	case "discover":
+		discover(os.Args[2:])
+	case "forwards":
+		forwards(os.Args[2:])
+	case "protect-psk":
+		protectPSK(os.Args[2:])
+	case "cleanup":
+		cleanup(os.Args[2:])
+	case "firewall":
+		firewall(os.Args[2:])
+	case "service":
+		service(os.Args[2:])
+	case "version":
+		version(os.Args[2:])
+	case "tunnels":
+		tunnels(os.Args[2:])
+	case "up":
+		tunnelUpDown("up", os.Args[2:])
+	case "down":
+		tunnelUpDown("down", os.Args[2:])
+	case "logs":
+		logs(os.Args[2:])
+	case "config":
+		configCmd(os.Args[2:])
+	case "diag":
+		diag(os.Args[2:])
+	case "-h", "--help", "help":
+		usage()
+	default:
+		runCmd(os.Args[1:])
+	}
+}
+
+func usage() {
+	fmt.Println("Usage:")
+	fmt.Println("  gocli <config.yaml>                     run the client, server, p2p peer or relay")
+	fmt.Println("  gocli --userspace <config.yaml>         run the client without an adapter, behind a SOCKS proxy")
+	fmt.Println("  gocli --env [--one-shot-route]          run from GOVPN_* environment variables, as a pod sidecar")
+	fmt.Println("  gocli rotate-key [-mgmt addr] <psk|->   rotate the server PSK")
+	fmt.Println("  gocli status [-mgmt addr] [--json]      show client connection status")
+	fmt.Println("  gocli top [-mgmt addr] [-interval 1s]   live per-client throughput on the server")
+	fmt.Println("  gocli clients [-mgmt addr] [--json]     list the server's clients by name")
+	fmt.Println("  gocli bans [-mgmt addr] [unban <ip>]    list addresses locked out after failed handshakes, or unlock one")
+	fmt.Println("  gocli probes [-mgmt addr] [--json]      list addresses probing the server, flagged ones with *")
+	fmt.Println("  gocli tunnels [-mgmt addr] [--json]     list the tunnels of a multi-tunnel client")
+	fmt.Println("  gocli up|down [-mgmt addr] <tunnel>     bring one tunnel of a multi-tunnel client up or down")
+	fmt.Println("  gocli adapter remove <adapter_name>     delete the adapter and its network profiles")
+	fmt.Println("  gocli selftest [-clients 3]             run the loopback end-to-end harness")
+	fmt.Println("  gocli bench [-duration 10s] [-pps n] [-fast-path af_packet] [-udp-offload]   soak-test a local client and server pair")
+	fmt.Println("  gocli speedtest [-duration 5s]          measure throughput and latency through the tunnel")
+	fmt.Println("  gocli vectors [-markdown] [-check file] print or verify protocol test vectors")
+	fmt.Println("  gocli gateway [-endpoint host:port]     run a NAT gateway and print a client config")
+	fmt.Println("  gocli export-client -name n -endpoint e provision a client and print its config")
+	fmt.Println("  gocli import [-psk key] <wg0.conf|.ovpn> translate a WireGuard or OpenVPN client config")
+	fmt.Println("  gocli export-wg -peer-key k <cfg.yaml>  write a client config as a WireGuard one")
+	fmt.Println("  gocli revoke [-mgmt addr] <client>      revoke a provisioned client and disconnect it")
+	fmt.Println("  gocli discover [-config client.yaml]    find servers on the local network")
+	fmt.Println("  gocli forwards [-mgmt addr] [enable|disable <name>] list or toggle port forwards")
+	fmt.Println("  gocli version [-mgmt addr] [--json]     show build, features, and protocol versions")
+	fmt.Println("  gocli logs [-mgmt addr] [-n 100] [-f]   show recent log lines, -f to keep following")
+	fmt.Println("  gocli diag [-o file.zip] [config.yaml]  gather diagnostics into a zip for an issue")
+	fmt.Println("  gocli cleanup <config.yaml>             undo network changes left by a crashed run")
+	fmt.Println("  gocli firewall clean                    remove every firewall rule GoVPN added")
+	fmt.Println("  gocli service install|uninstall <cfg>   run a config at boot with launchd (macOS)")
+	fmt.Println("  gocli protect-psk <psk|->               seal a client PSK to this machine (Windows)")
+	fmt.Println("  gocli config encrypt|decrypt <file>     encrypt a config at rest, or decrypt it again")
+	os.Exit(1)
+}
+
+// runCmd runs the client or server, from a config file or with --env
+// from GOVPN_* environment variables. The other flags override the config.
+func runCmd(args []string) {
+	fs := flag.NewFlagSet("gocli", flag.ExitOnError)
+	fs.Usage = usage
+	fromEnv := fs.Bool("env", false, "read the config from GOVPN_* environment variables")
+	userspace := fs.Bool("userspace", false, "run the client without an adapter, behind a SOCKS proxy")
+	oneShotRoute := fs.Bool("one-shot-route", false, "route the client's routes into the adapter once it is up (Linux)")
+	fs.Parse(args)
+	if *fromEnv == (fs.NArg() == 1) || fs.NArg() > 1 {
+		usage()
 	}
-	path := os.Args[1]
 
-	cfg, err := vpn.LoadConfig(path)
+	var cfg vpn.Config
+	var err error
+	if *fromEnv {
+		cfg, err = vpn.ConfigFromEnv(os.Environ())
+	} else {
+		cfg, err = vpn.LoadConfig(fs.Arg(0))
+	}
 	if err != nil {
 		fmt.Printf("Config error: %v\n", err)
 		os.Exit(1)
 	}
+	if *userspace || *oneShotRoute {
+		if cfg.Mode != "client" || cfg.TunnelConfigs() != nil {
+			fmt.Println("Config error: --userspace and --one-shot-route need a single client tunnel; set them in each of several tunnels")
+			os.Exit(1)
+		}
+		cfg.Userspace = cfg.Userspace || *userspace
+		cfg.OneShotRoute = cfg.OneShotRoute || *oneShotRoute
+	}
+	run(cfg)
+}
+
+// run runs the tunnel cfg describes until it is told to quit.
+func run(cfg vpn.Config) {
+	// A panic while starting or stopping must not leave the host routing
+	// into a dead adapter; the tunnel's goroutines guard themselves.
+	defer func() {
+		if r := recover(); r != nil {
+			if _, err := vpn.RollbackHostChanges(cfg); err != nil {
+				fmt.Printf("Undo network changes: %v\n", err)
+			}
+			panic(r)
+		}
+	}()
 
-	switch cfg.Mode {
-	case "client":
+	switch {
+	case cfg.TunnelConfigs() != nil:
+		tunnels := vpn.NewTunnels(cfg)
+		if err := tunnels.Start(); err != nil {
+			fmt.Printf("Tunnels start error: %v\n", err)
+			os.Exit(1)
+		}
+		waitForQuit(nil)
+		tunnels.Stop()
+
+	case cfg.Mode == "client":
 		client := vpn.NewClient(cfg)
 		if err := client.Start(); err != nil {
 			fmt.Printf("Client start error: %v\n", err)
 			os.Exit(1)
 		}
-		waitForQuit()
+		if waitForQuit(client.Done()) == syscall.SIGTERM && cfg.ShutdownDelay > 0 {
+			drain(client, cfg.ShutdownDelay)
+		}
 		client.Stop()
 
-	case "server":
+	case cfg.Mode == "server", cfg.Mode == "p2p":
 		server := vpn.NewServer(cfg)
 		if err := server.Start(); err != nil {
 			fmt.Printf("Server start error: %v\n", err)
 			os.Exit(1)
 		}
-		waitForQuit()
+		waitForQuit(nil)
 		server.Stop()
+
+	case cfg.Mode == "relay":
+		relay := vpn.NewRelay(cfg)
+		if err := relay.Start(); err != nil {
+			fmt.Printf("Relay start error: %v\n", err)
+			os.Exit(1)
+		}
+		waitForQuit(nil)
+		relay.Stop()
+	}
+}
+
+func cleanup(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: gocli cleanup <config.yaml>")
+		os.Exit(1)
+	}
+	cfg, err := vpn.LoadConfig(args[0])
+	if err != nil {
+		fmt.Printf("Config error: %v\n", err)
+		os.Exit(1)
+	}
+	n, err := vpn.RollbackHostChanges(cfg)
+	if err != nil {
+		fmt.Printf("Cleanup error: %v\n", err)
+		os.Exit(1)
 	}
+	fmt.Printf("Undid %d network changes.\n", n)
 }
 
-func waitForQuit() {
+// waitForQuit returns the signal on Ctrl+C or SIGTERM, or nil when done is
+// closed.
+func waitForQuit(done <-chan struct{}) os.Signal {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	<-ch
+	defer signal.Stop(ch)
+	select {
+	case sig := <-ch:
+		return sig
+	case <-done:
+		return nil
+	}
+}
+
+// drain keeps a client's tunnel up for delay after SIGTERM, failing its
+// readiness probe, so the pod's other containers can finish their work
+// through it. Another signal cuts the wait short.
+func drain(client *vpn.Client, delay time.Duration) {
+	client.Drain()
+	fmt.Printf("Keeping the tunnel up for %s before stopping\n", delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	go func() {
+		<-timer.C
+		client.Stop()
+	}()
+	waitForQuit(client.Done())
 }
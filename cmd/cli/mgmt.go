@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+var mgmtClient = &http.Client{Timeout: 5 * time.Second}
+
+// mgmtCall sends a JSON request to the management API at addr and decodes
+// the response into out when it is non-nil.
+func mgmtCall(addr, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://"+addr+path, body)
+	if err != nil {
+		return err
+	}
+	if method != http.MethodGet {
+		// The API refuses other requests that change state.
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := mgmtClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("management API unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var e vpn.ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return fmt.Errorf("%s", e.Error)
+		}
+		return fmt.Errorf("management API returned %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func rotateKey(args []string) {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	fs.Parse(args)
+
+	psk := fs.Arg(0)
+	if psk == "" || psk == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Printf("Read PSK: %v\n", err)
+			os.Exit(1)
+		}
+		psk = strings.TrimSpace(line)
+	}
+
+	if err := mgmtCall(*addr, http.MethodPost, "/rotate-key", vpn.RotateKeyRequest{PSK: psk}, nil); err != nil {
+		fmt.Printf("Rotate key error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("PSK rotated. Update psk/previous_psks in the server config to persist it.")
+}
+
+func revoke(args []string) {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: gocli revoke [-mgmt addr] <client>")
+		os.Exit(1)
+	}
+
+	var resp vpn.RevokeResponse
+	if err := mgmtCall(*addr, http.MethodPost, "/revoke", vpn.RevokeRequest{Name: fs.Arg(0)}, &resp); err != nil {
+		fmt.Printf("Revoke error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Revoked %s; disconnected %d sessions.\n", fs.Arg(0), resp.Disconnected)
+}
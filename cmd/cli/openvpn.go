@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gedons/go_VPN/internal/ovpn"
+)
+
+// ovpnNoise are directives nearly every profile has that mean nothing
+// for GoVPN, left out of the import notes.
+var ovpnNoise = map[string]bool{
+	"client": true, "dev": true, "nobind": true, "persist-key": true,
+	"persist-tun": true, "resolv-retry": true, "verb": true, "mute": true,
+}
+
+// importOpenVPN translates what it can of an OpenVPN client profile: the
+// servers, routes, and address. OpenVPN's certificates and logins have no
+// GoVPN equivalent, so the config gets psk, and notes say what else was
+// left behind.
+func importOpenVPN(path, name, psk string) (clientProfile, []string, error) {
+	p := clientProfile{Mode: "client", AdapterName: name}
+	r, err := os.Open(path)
+	if err != nil {
+		return p, nil, err
+	}
+	defer r.Close()
+	prof, err := ovpn.Parse(r)
+	if err != nil {
+		return p, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(prof.Remotes) == 0 {
+		return p, nil, fmt.Errorf("%s has no remote; it names no server", path)
+	}
+
+	var notes []string
+	for i, rem := range prof.Remotes {
+		addr := net.JoinHostPort(rem.Host, strconv.Itoa(rem.Port))
+		if i == 0 {
+			p.ServerAddress = addr
+		} else {
+			p.Fallbacks = append(p.Fallbacks, addr)
+		}
+		if rem.Proto == "tcp" {
+			notes = append(notes, fmt.Sprintf("remote %s uses TCP; GoVPN connects over UDP, so the server must listen on UDP port %d", rem.Host, rem.Port))
+		}
+	}
+
+	if prof.RedirectGateway {
+		p.Routes = append(p.Routes, "0.0.0.0/0")
+	}
+	if prof.RedirectIPv6 {
+		p.Routes = append(p.Routes, "::/0")
+	}
+	for _, r := range prof.Routes {
+		p.Routes = append(p.Routes, r.String())
+	}
+	if len(p.Routes) == 0 {
+		p.Routes = []string{"0.0.0.0/0"}
+		notes = append(notes, "The profile has no routes, so the OpenVPN server pushes them; routes is 0.0.0.0/0, so set it to the networks behind the server for a split tunnel")
+	} else if prof.RouteNoPull {
+		notes = append(notes, "The profile ignores pushed routes; routes holds only its own")
+	}
+
+	if prof.Address.IsValid() {
+		p.AdapterIPCIDR = prof.Address.String()
+	} else {
+		p.AdapterIPCIDR = "auto"
+		notes = append(notes, "The OpenVPN server assigns addresses; adapter_ip_cidr is auto, so the GoVPN server must have a pool")
+	}
+
+	if psk != "" {
+		p.PSK = psk
+	} else {
+		p.PSK = newPSK()
+		notes = append(notes, newPSKNote)
+	}
+	notes = append(notes, "Certificates, keys, and logins were not used; GoVPN authenticates with the psk")
+	if len(prof.DNS) > 0 {
+		var dns []string
+		for _, d := range prof.DNS {
+			dns = append(dns, d.String())
+		}
+		notes = append(notes, fmt.Sprintf("DNS is pushed by a GoVPN server; set dns: [%s] in its config", strings.Join(dns, ", ")))
+	}
+	if len(prof.Domains) > 0 {
+		notes = append(notes, fmt.Sprintf("Search domains are pushed by a GoVPN server; set search_domains: [%s] in its config", strings.Join(prof.Domains, ", ")))
+	}
+	var skipped []string
+	for _, d := range prof.Skipped {
+		if !ovpnNoise[d] {
+			skipped = append(skipped, d)
+		}
+	}
+	if len(skipped) > 0 {
+		notes = append(notes, "Not imported: "+strings.Join(skipped, ", "))
+	}
+	return p, notes, nil
+}
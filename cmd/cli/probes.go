@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// probes lists the addresses that sent the server probes lately, flagged
+// ones marked with a *.
+func probes(args []string) {
+	fs := flag.NewFlagSet("probes", flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	asJSON := fs.Bool("json", false, "print machine-readable JSON")
+	fs.Parse(args)
+
+	var list vpn.ProbeList
+	if err := mgmtCall(*addr, http.MethodGet, "/probes", nil, &list); err != nil {
+		fmt.Printf("Probes error: %v\n", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(list)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tPROBES\tFIRST\tLAST\tREASON\tFROM")
+	for _, p := range list.Probes {
+		address := p.Address
+		if p.Flagged {
+			address = "*" + address
+		}
+		var from []string
+		if p.Country != "" {
+			from = append(from, p.Country)
+		}
+		if p.ASN != 0 {
+			from = append(from, fmt.Sprintf("AS%d", p.ASN))
+		}
+		if len(from) == 0 {
+			from = []string{"-"}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s ago\t%s ago\t%s\t%s\n",
+			address, p.Probes,
+			time.Since(p.First).Round(time.Second),
+			time.Since(p.Last).Round(time.Second),
+			p.Reason, strings.Join(from, " "))
+	}
+	tw.Flush()
+}
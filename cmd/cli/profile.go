@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gedons/go_VPN/internal/qr"
+)
+
+// clientProfile is the minimal client config handed to a new device.
+type clientProfile struct {
+	Mode          string   `yaml:"mode"`
+	ServerAddress string   `yaml:"server_address"`
+	PSK           string   `yaml:"psk"`
+	AdapterName   string   `yaml:"adapter_name"`
+	AdapterIPCIDR string   `yaml:"adapter_ip_cidr"`
+	Routes        []string `yaml:"routes,omitempty"`
+	Keepalive     string   `yaml:"keepalive_interval,omitempty"`
+	Fallbacks     []string `yaml:"fallback_addresses,omitempty"`
+}
+
+// printProfile shows a client config as text and as a QR code, and writes it
+// to path when set.
+func printProfile(profile []byte, path string) {
+	fmt.Println("Client config:")
+	fmt.Println()
+	fmt.Print(string(profile))
+	fmt.Println()
+	if code, err := qr.Encode(profile); err == nil {
+		fmt.Print(code.Terminal())
+	} else {
+		fmt.Printf("(no QR code: %v)\n", err)
+	}
+	if path != "" {
+		if err := os.WriteFile(path, profile, 0o600); err != nil {
+			fmt.Printf("Write %s: %v\n", path, err)
+		} else {
+			fmt.Printf("Wrote %s\n", path)
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gedons/go_VPN/internal/keystore"
+)
+
+func protectPSK(args []string) {
+	fs := flag.NewFlagSet("protect-psk", flag.ExitOnError)
+	fs.Parse(args)
+
+	psk := fs.Arg(0)
+	if psk == "" || psk == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Printf("Read PSK: %v\n", err)
+			os.Exit(1)
+		}
+		psk = strings.TrimSpace(line)
+	}
+	if psk == "" {
+		fmt.Println("Usage: gocli protect-psk <psk|->")
+		os.Exit(1)
+	}
+
+	sealed, err := keystore.Protect([]byte(psk))
+	if err != nil {
+		fmt.Printf("Protect PSK error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("# Replace psk with this line; it only works on this machine.")
+	fmt.Printf("protected_psk: %q\n", sealed)
+}
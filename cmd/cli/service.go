@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// launchd keeps system daemons' plists and GoVPN's logs here.
+const (
+	launchDaemons = "/Library/LaunchDaemons"
+	launchLogs    = "/Library/Logs/GoVPN"
+)
+
+// service installs or removes a launchd daemon that runs a config at boot
+// and restarts it when it exits, on macOS.
+func service(args []string) {
+	if len(args) != 2 || args[0] != "install" && args[0] != "uninstall" {
+		fmt.Println("Usage: gocli service install|uninstall <config.yaml>")
+		os.Exit(1)
+	}
+	if runtime.GOOS != "darwin" {
+		fmt.Printf("Service error: launchd services are only available on macOS, not %s\n", runtime.GOOS)
+		os.Exit(1)
+	}
+	path, err := filepath.Abs(args[1])
+	if err != nil {
+		fmt.Printf("Service error: %v\n", err)
+		os.Exit(1)
+	}
+	cfg, err := vpn.LoadConfig(path)
+	if err != nil {
+		fmt.Printf("Config error: %v\n", err)
+		os.Exit(1)
+	}
+	label := "com.govpn." + cfg.AdapterName
+	plist := filepath.Join(launchDaemons, label+".plist")
+	if args[0] == "uninstall" {
+		// bootout fails when the daemon is not loaded, which is fine.
+		exec.Command("launchctl", "bootout", "system/"+label).Run()
+		if err := os.Remove(plist); err != nil {
+			fmt.Printf("Service error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed %s.\n", label)
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Service error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(launchLogs, 0o755); err != nil {
+		fmt.Printf("Service error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(plist, launchdPlist(label, exe, path), 0o644); err != nil {
+		fmt.Printf("Service error: %v\n", err)
+		os.Exit(1)
+	}
+	if out, err := exec.Command("launchctl", "bootstrap", "system", plist).CombinedOutput(); err != nil {
+		fmt.Printf("Service error: launchctl bootstrap: %v: %s\n", err, strings.TrimSpace(string(out)))
+		os.Exit(1)
+	}
+	fmt.Printf("Installed %s; it runs %s at boot. Logs are in %s.\n", label, path, launchLogs)
+}
+
+// launchdPlist is the daemon definition running exe on config, kept alive
+// and logging under launchLogs.
+func launchdPlist(label, exe, config string) []byte {
+	esc := func(s string) string {
+		var b bytes.Buffer
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	log := filepath.Join(launchLogs, label+".log")
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%s</string>
+		<string>%s</string>
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`, esc(label), esc(exe), esc(config), esc(log), esc(log)))
+}
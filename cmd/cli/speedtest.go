@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// speedtest asks the running client to measure the tunnel against the
+// server's speed test sink.
+func speedtest(args []string) {
+	fs := flag.NewFlagSet("speedtest", flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	duration := fs.Duration("duration", vpn.DefaultSpeedtestDuration, "how long to test each direction")
+	asJSON := fs.Bool("json", false, "print machine-readable JSON")
+	fs.Parse(args)
+
+	// Both directions run before the API answers.
+	mgmtClient.Timeout = 2**duration + 30*time.Second
+	if !*asJSON {
+		fmt.Printf("Testing for %s each way...\n", *duration)
+	}
+	var res vpn.SpeedtestResult
+	req := vpn.SpeedtestRequest{Seconds: int(duration.Seconds())}
+	if err := mgmtCall(*addr, http.MethodPost, "/speedtest", req, &res); err != nil {
+		fmt.Printf("Speed test error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(res)
+		return
+	}
+	fmt.Printf("Server:    %s\n", res.Server)
+	fmt.Printf("Latency:   %.1f ms in the tunnel, %.1f ms outside it\n", res.LatencyMillis, res.PathRTTMillis)
+	fmt.Printf("Download:  %.1f Mbps\n", res.DownloadMbps)
+	fmt.Printf("Upload:    %.1f Mbps\n", res.UploadMbps)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+func status(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	asJSON := fs.Bool("json", false, "print machine-readable JSON")
+	fs.Parse(args)
+
+	var st vpn.ClientStatus
+	if err := mgmtCall(*addr, http.MethodGet, "/status", nil, &st); err != nil {
+		fmt.Printf("Status error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(st)
+		return
+	}
+
+	state := "disconnected"
+	if st.Connected {
+		state = "connected"
+	} else if st.CaptivePortal != "" {
+		state = "sign in to Wi-Fi at " + st.CaptivePortal
+	}
+	fmt.Printf("State:          %s\n", state)
+	if st.Fallback {
+		fmt.Printf("Endpoint:       %s (fallback)\n", st.Endpoint)
+	} else {
+		fmt.Printf("Endpoint:       %s\n", st.Endpoint)
+	}
+	if st.LowBandwidth {
+		fmt.Printf("Transport:      %s (low bandwidth: fit for messaging, not streaming or downloads)\n", st.Transport)
+	} else if st.Migrated {
+		fmt.Printf("Transport:      %s (migrated)\n", st.Transport)
+	} else if st.Transport != "" {
+		fmt.Printf("Transport:      %s\n", st.Transport)
+	}
+	fmt.Printf("Tunnel IP:      %s\n", st.TunnelIP)
+	if st.TunnelIP6 != "" {
+		fmt.Printf("Tunnel IPv6:    %s\n", st.TunnelIP6)
+	}
+	if st.Prefix != "" {
+		fmt.Printf("Prefix:         %s (delegated)\n", st.Prefix)
+	}
+	if len(st.SearchDomains) > 0 {
+		fmt.Printf("Search domains: %s\n", strings.Join(st.SearchDomains, ", "))
+	}
+	if st.MTU != 0 {
+		fmt.Printf("MTU:            %d\n", st.MTU)
+	}
+	if len(st.NTPServers) > 0 {
+		fmt.Printf("NTP servers:    %s\n", strings.Join(st.NTPServers, ", "))
+	}
+	if st.PublicAddress != "" {
+		fmt.Printf("Public address: %s (NAT: %s)\n", st.PublicAddress, st.NATType)
+	}
+	fmt.Printf("Protocol:       v%d\n", st.ProtocolVersion)
+	if st.ServerVersion != "" {
+		fmt.Printf("Server version: %s\n", st.ServerVersion)
+	}
+	if st.FIPS {
+		fmt.Printf("FIPS mode:      on\n")
+	}
+	if st.FEC != "" {
+		fmt.Printf("FEC:            %s (%d packets recovered)\n", st.FEC, st.FECRecovered)
+	}
+	for _, f := range st.Forwards {
+		if f.Error != "" {
+			fmt.Printf("Forward:        server %s/%d refused: %s\n", f.Protocol, f.Port, f.Error)
+		} else {
+			fmt.Printf("Forward:        server %s/%d -> port %d here\n", f.Protocol, f.Port, f.To)
+		}
+	}
+	fmt.Printf("Received:       %s (%d packets)\n", formatBytes(st.BytesIn), st.PacketsIn)
+	fmt.Printf("Sent:           %s (%d packets)\n", formatBytes(st.BytesOut), st.PacketsOut)
+	if !st.LastHandshake.IsZero() {
+		fmt.Printf("Last handshake: %s ago\n", time.Since(st.LastHandshake).Round(time.Second))
+	}
+	fmt.Printf("RTT:            %.1f ms\n", st.RTTMillis)
+	if st.KeepaliveProbing {
+		fmt.Printf("Keepalive:      %ds (adaptive, probing the NAT)\n", st.Keepalive)
+	} else if st.Keepalive != 0 {
+		fmt.Printf("Keepalive:      %ds (adaptive)\n", st.Keepalive)
+	}
+	if cc := st.ConnectCheck; cc != nil {
+		fmt.Printf("Connect check:  %s\n", formatConnectCheck(cc))
+	}
+	for _, rc := range st.RouteConflicts {
+		fmt.Printf("Route conflict: %s\n", rc)
+	}
+	if len(st.Drops) > 0 {
+		fmt.Printf("Dropped:        %s\n", formatDrops(st.Drops))
+	}
+}
+
+// formatConnectCheck renders a connect check as "PASS (echo 1.2 ms, http
+// pass)".
+func formatConnectCheck(cc *vpn.ConnectCheckStatus) string {
+	result := "PASS"
+	switch {
+	case cc.Echo == vpn.CheckRunning:
+		return "running"
+	case !cc.Passed():
+		result = "FAIL"
+	}
+	parts := []string{"echo " + cc.Echo}
+	if cc.Echo == vpn.CheckPass {
+		parts[0] = fmt.Sprintf("echo %.1f ms", cc.EchoMillis)
+	}
+	if cc.HTTP != "" {
+		parts = append(parts, "http "+cc.HTTP)
+	}
+	if cc.Error != "" {
+		parts = append(parts, cc.Error)
+	}
+	return fmt.Sprintf("%s (%s), %s ago", result, strings.Join(parts, ", "), time.Since(cc.Time).Round(time.Second))
+}
+
+// formatDrops renders drop counters as "decrypt 3, replay 1", largest
+// first.
+func formatDrops(drops map[string]uint64) string {
+	reasons := make([]string, 0, len(drops))
+	for r := range drops {
+		reasons = append(reasons, r)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if drops[reasons[i]] != drops[reasons[j]] {
+			return drops[reasons[i]] > drops[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	parts := make([]string, len(reasons))
+	for i, r := range reasons {
+		parts[i] = fmt.Sprintf("%s %d", r, drops[r])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatBytes renders n using binary units.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
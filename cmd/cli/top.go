@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// clientRate is one row of the top table.
+type clientRate struct {
+	vpn.ClientInfo
+	rxRate float64
+	txRate float64
+}
+
+func top(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	interval := fs.Duration("interval", time.Second, "refresh interval")
+	fs.Parse(args)
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	prev := map[string]vpn.ClientInfo{}
+	prevAt := time.Time{}
+	for {
+		var list vpn.ClientList
+		err := mgmtCall(*addr, http.MethodGet, "/clients", nil, &list)
+		now := time.Now()
+
+		fmt.Print("\033[H\033[2J")
+		if err != nil {
+			fmt.Printf("gocli top: %v\n", err)
+		} else {
+			rows := rates(list.Clients, prev, now.Sub(prevAt))
+			renderTop(rows, list, *interval)
+			prev = make(map[string]vpn.ClientInfo, len(list.Clients))
+			for _, c := range list.Clients {
+				prev[c.Session] = c
+			}
+			prevAt = now
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rates computes per-client throughput against the previous sample and
+// sorts clients busiest first.
+func rates(clients []vpn.ClientInfo, prev map[string]vpn.ClientInfo, elapsed time.Duration) []clientRate {
+	rows := make([]clientRate, 0, len(clients))
+	for _, c := range clients {
+		row := clientRate{ClientInfo: c}
+		if p, ok := prev[c.Session]; ok && elapsed > 0 {
+			secs := elapsed.Seconds()
+			row.rxRate = float64(c.BytesIn-p.BytesIn) / secs
+			row.txRate = float64(c.BytesOut-p.BytesOut) / secs
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		ri, rj := rows[i].rxRate+rows[i].txRate, rows[j].rxRate+rows[j].txRate
+		if ri != rj {
+			return ri > rj
+		}
+		return rows[i].BytesIn+rows[i].BytesOut > rows[j].BytesIn+rows[j].BytesOut
+	})
+	return rows
+}
+
+func renderTop(rows []clientRate, list vpn.ClientList, interval time.Duration) {
+	fmt.Printf("gocli top - %d clients - %s (every %s, Ctrl+C to quit)\n\n",
+		len(rows), time.Now().Format("15:04:05"), interval)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "SESSION\tNAME\tENDPOINT\tADDRESS\tRX/s\tTX/s\tRX TOTAL\tTX TOTAL\tDROPS\tIDLE\t")
+	var rxRate, txRate float64
+	var rxTotal, txTotal, drops uint64
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t\n",
+			r.Session, clientName(r.ClientInfo), r.Endpoint, r.Address,
+			formatRate(r.rxRate), formatRate(r.txRate),
+			formatBytes(r.BytesIn), formatBytes(r.BytesOut),
+			r.Drops, time.Since(r.LastSeen).Round(time.Second))
+		rxRate += r.rxRate
+		txRate += r.txRate
+		rxTotal += r.BytesIn
+		txTotal += r.BytesOut
+		drops += r.Drops
+	}
+	fmt.Fprintf(tw, "TOTAL\t\t\t\t%s\t%s\t%s\t%s\t%d\t\t\n",
+		formatRate(rxRate), formatRate(txRate),
+		formatBytes(rxTotal), formatBytes(txTotal), drops)
+	tw.Flush()
+	fmt.Printf("\nUnattributed drops: %d\n", list.Drops)
+	if len(list.DropReasons) > 0 {
+		fmt.Printf("Drops by reason:    %s\n", formatDrops(list.DropReasons))
+	}
+}
+
+func formatRate(bytesPerSec float64) string {
+	return formatBytes(uint64(bytesPerSec)) + "/s"
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// tunnels lists the tunnels of a multi-tunnel client.
+func tunnels(args []string) {
+	fs := flag.NewFlagSet("tunnels", flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	asJSON := fs.Bool("json", false, "print machine-readable JSON")
+	fs.Parse(args)
+
+	var list vpn.TunnelList
+	if err := mgmtCall(*addr, http.MethodGet, "/tunnels", nil, &list); err != nil {
+		fmt.Printf("Tunnels error: %v\n", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(list)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tENDPOINT\tTUNNEL IP\tRECEIVED\tSENT")
+	for _, t := range list.Tunnels {
+		switch {
+		case t.Status != nil:
+			state := "up"
+			if !t.Status.Connected {
+				state = "up, not connected"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", t.Name, state, t.Status.Endpoint,
+				t.Status.TunnelIP, formatBytes(t.Status.BytesIn), formatBytes(t.Status.BytesOut))
+		case t.Error != "":
+			fmt.Fprintf(tw, "%s\tdown: %s\t\t\t\t\n", t.Name, t.Error)
+		default:
+			fmt.Fprintf(tw, "%s\tdown\t\t\t\t\n", t.Name)
+		}
+	}
+	tw.Flush()
+}
+
+// tunnelUpDown brings one tunnel of a multi-tunnel client up or down.
+func tunnelUpDown(action string, args []string) {
+	fs := flag.NewFlagSet(action, flag.ExitOnError)
+	addr := fs.String("mgmt", vpn.DefaultManagementAddress, "management API address")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Printf("Usage: gocli %s [-mgmt addr] <tunnel>\n", action)
+		os.Exit(1)
+	}
+
+	// Bringing a tunnel up waits for its handshake, retries included.
+	mgmtClient = &http.Client{Timeout: time.Minute}
+	name := fs.Arg(0)
+	if err := mgmtCall(*addr, http.MethodPost, "/tunnels/"+url.PathEscape(name)+"/"+action, nil, nil); err != nil {
+		fmt.Printf("Tunnel %s error: %v\n", name, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Tunnel %s is %s.\n", name, action)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// vectors prints the reference protocol vectors, renders the protocol
+// document, or checks a vector file produced by another implementation.
+func vectors(args []string) {
+	fs := flag.NewFlagSet("vectors", flag.ExitOnError)
+	markdown := fs.Bool("markdown", false, "print the protocol document instead of JSON")
+	check := fs.String("check", "", "verify a vector file instead of printing")
+	fs.Parse(args)
+
+	if *check != "" {
+		data, err := os.ReadFile(*check)
+		if err != nil {
+			fmt.Printf("Vectors error: %v\n", err)
+			os.Exit(1)
+		}
+		var set protocol.VectorSet
+		if err := json.Unmarshal(data, &set); err != nil {
+			fmt.Printf("Vectors error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := protocol.CheckVectors(&set); err != nil {
+			fmt.Printf("Vectors FAILED: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Vectors OK: %d packets\n", len(set.Vectors))
+		return
+	}
+
+	set, err := protocol.GenerateVectors()
+	if err != nil {
+		fmt.Printf("Vectors error: %v\n", err)
+		os.Exit(1)
+	}
+	if *markdown {
+		err = set.WriteMarkdown(os.Stdout)
+	} else {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(set)
+	}
+	if err != nil {
+		fmt.Printf("Vectors error: %v\n", err)
+		os.Exit(1)
+	}
+}
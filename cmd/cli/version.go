@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// version prints this binary's build, or with -mgmt that of a running
+// client or server.
+func version(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	addr := fs.String("mgmt", "", "management API address of a running client or server")
+	asJSON := fs.Bool("json", false, "print machine-readable JSON")
+	fs.Parse(args)
+
+	info := vpn.Build()
+	if *addr != "" {
+		if err := mgmtCall(*addr, http.MethodGet, "/version", nil, &info); err != nil {
+			fmt.Printf("Version error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(info)
+		return
+	}
+
+	fmt.Println(info)
+	fmt.Printf("Transports: %s\n", strings.Join(info.Transports, ", "))
+	fmt.Printf("Ciphers:    %s\n", strings.Join(info.Ciphers, ", "))
+	fmt.Printf("Backends:   %s\n", strings.Join(info.Backends, ", "))
+	if info.FIPS {
+		fmt.Println("FIPS 140-3: enabled")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/gedons/go_VPN/internal/wgconf"
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// importWireGuard translates a wg-quick client config. WireGuard's keys
+// have no GoVPN equivalent, so the config gets psk, and notes say what
+// else was left behind.
+func importWireGuard(path, name, psk string) (clientProfile, []string, error) {
+	p := clientProfile{Mode: "client", AdapterName: name}
+	r, err := os.Open(path)
+	if err != nil {
+		return p, nil, err
+	}
+	defer r.Close()
+	wg, err := wgconf.Parse(r)
+	if err != nil {
+		return p, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var peer *wgconf.Peer
+	var notes []string
+	for i := range wg.Peers {
+		switch {
+		case wg.Peers[i].Endpoint == "":
+		case peer == nil:
+			peer = &wg.Peers[i]
+		default:
+			notes = append(notes, fmt.Sprintf("Only the first peer with an Endpoint was imported; %s was skipped", wg.Peers[i].Endpoint))
+		}
+	}
+	if peer == nil {
+		return p, nil, fmt.Errorf("%s has no [Peer] with an Endpoint; only client configs can be imported", path)
+	}
+	if _, _, err := net.SplitHostPort(peer.Endpoint); err != nil {
+		return p, nil, fmt.Errorf("Endpoint %q: %w", peer.Endpoint, err)
+	}
+	p.ServerAddress = peer.Endpoint
+	p.Routes = peer.AllowedIPs
+	if peer.PersistentKeepalive > 0 {
+		p.Keepalive = fmt.Sprintf("%ds", peer.PersistentKeepalive)
+	}
+
+	for _, a := range wg.Interface.Addresses {
+		prefix, err := netip.ParsePrefix(a)
+		switch {
+		case err != nil:
+			return p, nil, fmt.Errorf("Address %q: %w", a, err)
+		case prefix.Addr().Is4() && p.AdapterIPCIDR == "":
+			p.AdapterIPCIDR = prefix.String()
+		default:
+			notes = append(notes, fmt.Sprintf("Address %s was left out; the server leases IPv6 addresses from its pool6, and a client has one IPv4 address", a))
+		}
+	}
+	if p.AdapterIPCIDR == "" {
+		p.AdapterIPCIDR = "auto"
+		notes = append(notes, "No IPv4 Address; adapter_ip_cidr is auto, so the server must have a pool")
+	}
+
+	switch {
+	case psk != "":
+		p.PSK = psk
+	case peer.PresharedKey != "":
+		p.PSK = peer.PresharedKey
+		notes = append(notes, "psk is the peer's PresharedKey; give the server the same psk, or provision the client with gocli export-client")
+	default:
+		p.PSK = newPSK()
+		notes = append(notes, newPSKNote)
+	}
+	notes = append(notes, "WireGuard's PrivateKey and PublicKey were not used; GoVPN authenticates with the psk")
+	if len(wg.Interface.DNS) > 0 {
+		notes = append(notes, fmt.Sprintf("DNS %s is pushed by a GoVPN server; set dns and search_domains in its config", strings.Join(wg.Interface.DNS, ", ")))
+	}
+	if wg.Interface.MTU > 0 {
+		notes = append(notes, fmt.Sprintf("MTU %d is pushed by a GoVPN server; set mtu in its config", wg.Interface.MTU))
+	}
+	if len(wg.Ignored) > 0 {
+		notes = append(notes, "Not imported: "+strings.Join(wg.Ignored, ", "))
+	}
+	return p, notes, nil
+}
+
+// exportWireGuard writes a GoVPN client config as a wg-quick one, with a
+// new key pair, for moving the client to a WireGuard server.
+func exportWireGuard(args []string) {
+	fs := flag.NewFlagSet("export-wg", flag.ExitOnError)
+	peerKey := fs.String("peer-key", "", "public key of the WireGuard server")
+	out := fs.String("o", "", "wg-quick config to write (default <adapter_name>.conf)")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *peerKey == "" {
+		fmt.Println("Usage: gocli export-wg -peer-key <key> [-o wg0.conf] <config.yaml>")
+		os.Exit(1)
+	}
+	cfg, err := vpn.LoadConfig(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Export error: %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.Mode != "client" || len(cfg.Tunnels) > 0 {
+		fmt.Println("Export error: only single-tunnel client configs can be exported")
+		os.Exit(1)
+	}
+	if cfg.AdapterIPCIDR == "auto" {
+		fmt.Println("Export error: WireGuard needs a fixed address; set adapter_ip_cidr")
+		os.Exit(1)
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Printf("Export error: %v\n", err)
+		os.Exit(1)
+	}
+	routes := cfg.Routes
+	if len(routes) == 0 {
+		routes = []string{"0.0.0.0/0"}
+	}
+	wg := wgconf.File{
+		Interface: wgconf.Interface{
+			PrivateKey: base64.StdEncoding.EncodeToString(key.Bytes()),
+			Addresses:  []string{cfg.AdapterIPCIDR},
+		},
+		Peers: []wgconf.Peer{{
+			PublicKey:           *peerKey,
+			Endpoint:            cfg.ServerAddress,
+			AllowedIPs:          routes,
+			PersistentKeepalive: int(cfg.KeepaliveInterval.Seconds()),
+		}},
+	}
+	if *out == "" {
+		*out = cfg.AdapterName + ".conf"
+	}
+	if _, err := os.Stat(*out); err == nil {
+		fmt.Printf("Export error: %s already exists; choose another with -o\n", *out)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*out, wg.Format(), 0o600); err != nil {
+		fmt.Printf("Export error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %s\n", *out)
+	fmt.Println("Add this client to the WireGuard server as:")
+	fmt.Println()
+	fmt.Println("[Peer]")
+	fmt.Printf("PublicKey = %s\n", base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()))
+	fmt.Printf("AllowedIPs = %s\n", hostPrefix(cfg.AdapterIPCIDR))
+}
+
+// hostPrefix is the single address of a CIDR such as 10.0.0.2/24, as
+// 10.0.0.2/32.
+func hostPrefix(cidr string) string {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return cidr
+	}
+	return netip.PrefixFrom(prefix.Addr(), prefix.Addr().BitLen()).String()
+}
@@ -5,7 +5,7 @@ go 1.24.2
 require golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2
 
 require (
-	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
 	golang.zx2c4.com/wireguard/windows v0.5.3
 	gopkg.in/yaml.v2 v2.4.0
 	gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,10 @@
+// Package afpacket receives the UDP datagrams for one local port through a
+// memory-mapped AF_PACKET ring on Linux. The kernel fills whole blocks of
+// datagrams before waking the reader, so a busy port costs one wakeup per
+// block instead of one recvfrom per datagram.
+package afpacket
+
+import "errors"
+
+// ErrClosed is returned by reads on a closed Conn.
+var ErrClosed = errors.New("afpacket: use of closed conn")
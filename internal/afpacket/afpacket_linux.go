@@ -0,0 +1,271 @@
+package afpacket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// The ring is ringBlocks blocks of blockSize bytes. A block is handed
+	// to the reader once full, or blockTimeout milliseconds after its
+	// first datagram, which bounds the latency added when traffic is
+	// light.
+	blockSize    = 1 << 20
+	ringBlocks   = 32
+	frameSize    = 1 << 11
+	blockTimeout = 1
+
+	// pollTimeout is how often a blocked read checks whether the Conn was
+	// closed.
+	pollTimeout = 100 * time.Millisecond
+
+	// localRefresh is how often the host's addresses are looked up again
+	// for a Conn on an unspecified address.
+	localRefresh = 5 * time.Second
+
+	// hdrLen is TPACKET_ALIGN(sizeof(struct tpacket3_hdr)), where the
+	// sockaddr_ll of each datagram starts.
+	hdrLen = 48
+)
+
+// Conn reads the UDP datagrams sent to a local port from an AF_PACKET
+// ring. It only receives; replies go out through the port's own socket.
+type Conn struct {
+	fd     int
+	ring   []byte
+	addr   netip.AddrPort
+	closed atomic.Bool
+
+	mu    sync.Mutex // serializes reads
+	block int        // the block being read
+	pkt   int        // offset of the next datagram in it, zero before the first
+	left  int        // datagrams left in it
+
+	local     map[netip.Addr]bool // the host's addresses, for an unspecified addr
+	localTime time.Time
+}
+
+// Listen opens a ring receiving the UDP datagrams to addr, IPv4 and IPv6,
+// on every interface. An unspecified address matches any address of the
+// host. Fragmented datagrams are not received. It needs CAP_NET_RAW.
+func Listen(addr netip.AddrPort) (*Conn, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("afpacket: socket: %w", err)
+	}
+	c := &Conn{fd: fd, addr: addr}
+	if err := c.setup(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) setup() error {
+	prog := filter(c.addr.Port())
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	if err := unix.SetsockoptSockFprog(c.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &fprog); err != nil {
+		return fmt.Errorf("afpacket: filter: %w", err)
+	}
+	if err := unix.SetsockoptInt(c.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return fmt.Errorf("afpacket: TPACKET_V3: %w", err)
+	}
+	req := unix.TpacketReq3{
+		Block_size:     blockSize,
+		Block_nr:       ringBlocks,
+		Frame_size:     frameSize,
+		Frame_nr:       blockSize / frameSize * ringBlocks,
+		Retire_blk_tov: blockTimeout,
+	}
+	if err := unix.SetsockoptTpacketReq3(c.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		return fmt.Errorf("afpacket: ring: %w", err)
+	}
+	ring, err := unix.Mmap(c.fd, 0, blockSize*ringBlocks, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("afpacket: mmap: %w", err)
+	}
+	c.ring = ring
+	return nil
+}
+
+// filter is a classic BPF program passing unfragmented IPv4 and IPv6 UDP
+// datagrams to port. A SOCK_DGRAM packet socket sees them from the IP
+// header on.
+func filter(port uint16) []unix.SockFilter {
+	const (
+		ldb  = unix.BPF_LD | unix.BPF_B | unix.BPF_ABS
+		ldh  = unix.BPF_LD | unix.BPF_H | unix.BPF_ABS
+		ldhx = unix.BPF_LD | unix.BPF_H | unix.BPF_IND
+		ldxb = unix.BPF_LDX | unix.BPF_B | unix.BPF_MSH
+		rsh  = unix.BPF_ALU | unix.BPF_RSH | unix.BPF_K
+		jeq  = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jset = unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K
+		ret  = unix.BPF_RET | unix.BPF_K
+	)
+	p := uint32(port)
+	return []unix.SockFilter{
+		{Code: ldb, K: 0},                        // 0: IP version
+		{Code: rsh, K: 4},                        // 1
+		{Code: jeq, K: 4, Jf: 7},                 // 2: IPv4, else 10
+		{Code: ldb, K: 9},                        // 3: protocol
+		{Code: jeq, K: unix.IPPROTO_UDP, Jf: 10}, // 4
+		{Code: ldh, K: 6},                        // 5: flags and fragment offset
+		{Code: jset, K: 0x3fff, Jt: 8},           // 6: MF or an offset: a fragment
+		{Code: ldxb, K: 0},                       // 7: x = header length
+		{Code: ldhx, K: 2},                       // 8: destination port
+		{Code: jeq, K: p, Jt: 6, Jf: 5},          // 9
+		{Code: jeq, K: 6, Jf: 4},                 // 10: IPv6
+		{Code: ldb, K: 6},                        // 11: next header
+		{Code: jeq, K: unix.IPPROTO_UDP, Jf: 2},  // 12
+		{Code: ldh, K: 42},                       // 13: destination port
+		{Code: jeq, K: p, Jt: 1},                 // 14
+		{Code: ret, K: 0},                        // 15: drop
+		{Code: ret, K: 0xffff},                   // 16: accept
+	}
+}
+
+// ReadFrom copies the payload of the next datagram into b and returns its
+// length and sender. A payload longer than b is truncated.
+func (c *Conn) ReadFrom(b []byte) (int, netip.AddrPort, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closed.Load() {
+			return 0, netip.AddrPort{}, ErrClosed
+		}
+		if c.left == 0 {
+			if err := c.next(); err != nil {
+				return 0, netip.AddrPort{}, err
+			}
+			continue
+		}
+		base := c.block*blockSize + c.pkt
+		h := (*unix.Tpacket3Hdr)(unsafe.Pointer(&c.ring[base]))
+		ll := (*unix.RawSockaddrLinklayer)(unsafe.Pointer(&c.ring[base+hdrLen]))
+		data := c.ring[base+int(h.Net) : base+int(h.Net)+int(h.Snaplen)]
+		c.pkt += int(h.Next_offset)
+		c.left--
+		// Loopback shows each datagram going out as well as coming in.
+		if ll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		from, to, payload, ok := parse(data)
+		if !ok || !c.isLocal(to) {
+			continue
+		}
+		return copy(b, payload), from, nil
+	}
+}
+
+// next hands the block just read back to the kernel, if any, and waits
+// for the following one to fill.
+func (c *Conn) next() error {
+	hdr := c.blockHeader()
+	if c.pkt != 0 {
+		atomic.StoreUint32(&hdr.Block_status, unix.TP_STATUS_KERNEL)
+		c.block = (c.block + 1) % ringBlocks
+		c.pkt = 0
+		hdr = c.blockHeader()
+	}
+	for atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+		if c.closed.Load() {
+			return ErrClosed
+		}
+		fds := []unix.PollFd{{Fd: int32(c.fd), Events: unix.POLLIN | unix.POLLERR}}
+		if _, err := unix.Poll(fds, int(pollTimeout/time.Millisecond)); err != nil && err != unix.EINTR {
+			return fmt.Errorf("afpacket: poll: %w", err)
+		}
+	}
+	c.pkt = int(hdr.Offset_to_first_pkt)
+	c.left = int(hdr.Num_pkts)
+	return nil
+}
+
+func (c *Conn) blockHeader() *unix.TpacketHdrV1 {
+	desc := (*unix.TpacketBlockDesc)(unsafe.Pointer(&c.ring[c.block*blockSize]))
+	return (*unix.TpacketHdrV1)(unsafe.Pointer(&desc.Hdr[0]))
+}
+
+// parse splits an IPv4 or IPv6 UDP datagram into its sender, destination
+// address and payload.
+func parse(pkt []byte) (from netip.AddrPort, to netip.Addr, payload []byte, ok bool) {
+	var src, dst netip.Addr
+	var udp []byte
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl+8 {
+			return
+		}
+		src, dst = netip.AddrFrom4([4]byte(pkt[12:16])), netip.AddrFrom4([4]byte(pkt[16:20]))
+		udp = pkt[ihl:]
+	case len(pkt) >= 48 && pkt[0]>>4 == 6:
+		src, dst = netip.AddrFrom16([16]byte(pkt[8:24])), netip.AddrFrom16([16]byte(pkt[24:40]))
+		udp = pkt[40:]
+	default:
+		return
+	}
+	n := int(binary.BigEndian.Uint16(udp[4:6]))
+	if n < 8 || n > len(udp) {
+		return
+	}
+	return netip.AddrPortFrom(src, binary.BigEndian.Uint16(udp[0:2])), dst, udp[8:n], true
+}
+
+// isLocal reports whether a datagram to addr is for this Conn, rather than
+// one the host forwards.
+func (c *Conn) isLocal(addr netip.Addr) bool {
+	if a := c.addr.Addr().Unmap(); !a.IsUnspecified() {
+		return addr == a
+	}
+	if time.Since(c.localTime) > localRefresh {
+		c.localTime = time.Now()
+		c.local = make(map[netip.Addr]bool)
+		addrs, _ := net.InterfaceAddrs()
+		for _, a := range addrs {
+			if p, err := netip.ParsePrefix(a.String()); err == nil {
+				c.local[p.Addr().Unmap()] = true
+			}
+		}
+	}
+	return c.local[addr]
+}
+
+// Close stops the ring. A read in progress returns ErrClosed.
+func (c *Conn) Close() error {
+	c.closed.Store(true)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ring != nil {
+		unix.Munmap(c.ring)
+		c.ring = nil
+	}
+	return unix.Close(c.fd)
+}
+
+// DropAll makes the socket behind rc drop everything it receives, in the
+// kernel, once a Conn receives its datagrams instead.
+func DropAll(rc syscall.RawConn) error {
+	prog := []unix.SockFilter{{Code: unix.BPF_RET | unix.BPF_K, K: 0}}
+	fprog := unix.SockFprog{Len: 1, Filter: &prog[0]}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &fprog)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+
+package afpacket
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"runtime"
+	"syscall"
+)
+
+// Conn is only available on Linux.
+type Conn struct{}
+
+// Listen is only available on Linux.
+func Listen(netip.AddrPort) (*Conn, error) {
+	return nil, fmt.Errorf("afpacket on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
+
+// ReadFrom is only available on Linux.
+func (*Conn) ReadFrom([]byte) (int, netip.AddrPort, error) {
+	return 0, netip.AddrPort{}, errors.ErrUnsupported
+}
+
+// Close is only available on Linux.
+func (*Conn) Close() error {
+	return nil
+}
+
+// DropAll is only available on Linux.
+func DropAll(syscall.RawConn) error {
+	return errors.ErrUnsupported
+}
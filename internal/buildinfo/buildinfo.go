@@ -0,0 +1,106 @@
+// Package buildinfo reports the version and source of the running binary.
+// Release builds stamp Version, Commit and Date with
+//
+//	-ldflags "-X github.com/gedons/go_VPN/internal/buildinfo.Version=v1.4.0 ..."
+//
+// and anything left unset is taken from the module and VCS information the
+// go command embeds.
+package buildinfo
+
+import (
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Set with -ldflags -X.
+var (
+	Version string
+	Commit  string
+	Date    string
+)
+
+// Info describes the build.
+type Info struct {
+	Version  string
+	Commit   string
+	Date     string
+	Modified bool // built from a tree with uncommitted changes
+}
+
+// Read returns the stamped values, filled in from the embedded build
+// information. Version is "devel" for a build from a source tree.
+func Read() Info {
+	info := Info{Version: Version, Commit: Commit, Date: Date}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		if info.Version == "" {
+			info.Version = "devel"
+		}
+		return info
+	}
+	if info.Version == "" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = s.Value
+			}
+		case "vcs.time":
+			if info.Date == "" {
+				info.Date = s.Value
+			}
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	if info.Version == "" {
+		info.Version = "devel"
+	}
+	if len(info.Commit) > 12 {
+		info.Commit = info.Commit[:12]
+	}
+	return info
+}
+
+// Compare orders two versions such as "v1.4.0" or "1.4", by their
+// numeric major, minor and patch parts; pre-release and build suffixes are
+// ignored. ok is false if either is not a release version.
+func Compare(a, b string) (cmp int, ok bool) {
+	x, okA := parse(a)
+	y, okB := parse(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			if x[i] < y[i] {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+func parse(v string) ([3]int, bool) {
+	var out [3]int
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 {
+		return out, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return out, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
@@ -3,41 +3,101 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
 	"io"
+	"slices"
 )
 
+// KeySize is the length of keys produced by DeriveKey (AES-256).
+const KeySize = 32
+
 type Cipher struct {
-	gcm cipher.AEAD
-	key []byte
+	gcm  cipher.AEAD
+	key  []byte
+	rand io.Reader // nil when gcm makes its own nonces
 }
 
+// NewCipher lets the GCM implementation draw its own nonces, which is the
+// only way Go's FIPS 140-3 module counts random-nonce GCM as approved. The
+// wire format is the same nonce||ciphertext either way.
 func NewCipher(key []byte) (*Cipher, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := cipher.NewGCMWithRandomNonce(block)
 	if err != nil {
 		return nil, err
 	}
 	return &Cipher{gcm: gcm, key: key}, nil
 }
 
-func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
-	nonce := make([]byte, c.gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+// NewCipherWithRand is NewCipher drawing nonces from r. It exists so test
+// vectors can be reproduced byte for byte; never use it for live traffic.
+func NewCipherWithRand(key []byte, r io.Reader) (*Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
 		return nil, err
 	}
-	ciphertext := c.gcm.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+	return &Cipher{gcm: gcm, key: key, rand: r}, nil
+}
+
+func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
+	return c.EncryptAppend(nil, plaintext)
 }
 
 func (c *Cipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	return c.DecryptAppend(nil, ciphertext)
+}
+
+// EncryptAppend appends nonce||ciphertext for plaintext to dst and returns
+// the extended slice. dst must not overlap plaintext.
+func (c *Cipher) EncryptAppend(dst, plaintext []byte) ([]byte, error) {
+	if c.rand == nil {
+		return c.gcm.Seal(dst, nil, plaintext, nil), nil
+	}
+	nonceSize := c.gcm.NonceSize()
+	dst = slices.Grow(dst, nonceSize+len(plaintext)+c.gcm.Overhead())
+	start := len(dst)
+	dst = dst[:start+nonceSize]
+	nonce := dst[start:]
+	if _, err := io.ReadFull(c.rand, nonce); err != nil {
+		return nil, err
+	}
+	return c.gcm.Seal(dst, nonce, plaintext, nil), nil
+}
+
+// DecryptAppend appends the plaintext of ciphertext to dst and returns the
+// extended slice. dst must not overlap ciphertext.
+func (c *Cipher) DecryptAppend(dst, ciphertext []byte) ([]byte, error) {
+	if c.rand == nil {
+		return c.gcm.Open(dst, nil, ciphertext, nil)
+	}
 	nonceSize := c.gcm.NonceSize()
 	if len(ciphertext) < nonceSize {
 		return nil, io.ErrUnexpectedEOF
 	}
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	return c.gcm.Open(nil, nonce, ciphertext, nil)
+	return c.gcm.Open(dst, nonce, ciphertext, nil)
+}
+
+// DeriveKey expands secret into a KeySize-byte key bound to salt and info
+// using HKDF-SHA256.
+func DeriveKey(secret, salt []byte, info string) ([]byte, error) {
+	return hkdf.Key(sha256.New, secret, salt, info, KeySize)
+}
+
+// RandomBytes returns n bytes from the system CSPRNG.
+func RandomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
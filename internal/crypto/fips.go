@@ -0,0 +1,9 @@
+package crypto
+
+import "crypto/fips140"
+
+// FIPSEnabled reports whether Go's FIPS 140-3 module is in FIPS mode, as
+// with GODEBUG=fips140=on or a binary built with GOFIPS140.
+func FIPSEnabled() bool {
+	return fips140.Enabled()
+}
@@ -0,0 +1,185 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// SeqSize is the length of the sequence number prefixed to session packets.
+const SeqSize = 8
+
+// ReplayWindowSize is how far behind the newest sequence number a packet
+// may arrive and still be accepted.
+const ReplayWindowSize = (replayBlocks - 1) * 64
+
+const replayBlocks = 32
+
+var (
+	ErrReplay          = errors.New("crypto: replayed or too old packet")
+	ErrCounterExceeded = errors.New("crypto: nonce counter exhausted, rekey required")
+)
+
+// SessionCipher is an AES-GCM cipher for one direction of a session. Nonces
+// come from an atomic counter rather than the CSPRNG, so any number of
+// workers can seal concurrently without a lock. The counter is sent in front
+// of the ciphertext and doubles as a sequence number for replay protection.
+type SessionCipher struct {
+	gcm     cipher.AEAD
+	counter atomic.Uint64
+	replay  ReplayWindow
+}
+
+// NewSessionCipher returns a SessionCipher for a key that is used by
+// exactly one sender.
+func NewSessionCipher(key []byte) (*SessionCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionCipher{gcm: gcm}, nil
+}
+
+// Overhead is how many bytes Encrypt adds to a plaintext.
+func (c *SessionCipher) Overhead() int {
+	return SeqSize + c.gcm.Overhead()
+}
+
+// Encrypt seals plaintext under the next sequence number.
+func (c *SessionCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	return c.EncryptAppend(nil, plaintext)
+}
+
+// Decrypt opens a packet produced by Encrypt, rejecting replays. It returns
+// the plaintext and its sequence number.
+func (c *SessionCipher) Decrypt(ciphertext []byte) ([]byte, uint64, error) {
+	return c.DecryptAppend(nil, ciphertext)
+}
+
+// EncryptAppend appends seq||ciphertext for plaintext to dst and returns the
+// extended slice. dst must not overlap plaintext.
+func (c *SessionCipher) EncryptAppend(dst, plaintext []byte) ([]byte, error) {
+	seq := c.counter.Add(1)
+	if seq == math.MaxUint64 {
+		return nil, ErrCounterExceeded
+	}
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	dst = slices.Grow(dst, c.Overhead()+len(plaintext))
+	dst = binary.BigEndian.AppendUint64(dst, seq)
+	return c.gcm.Seal(dst, nonce[:], plaintext, nil), nil
+}
+
+// DecryptAppend appends the plaintext of a packet produced by Encrypt to dst,
+// rejecting replays. dst must not overlap ciphertext.
+func (c *SessionCipher) DecryptAppend(dst, ciphertext []byte) ([]byte, uint64, error) {
+	if len(ciphertext) < c.Overhead() {
+		return nil, 0, errors.New("crypto: ciphertext too short")
+	}
+	seq := binary.BigEndian.Uint64(ciphertext)
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	plaintext, err := c.gcm.Open(dst, nonce[:], ciphertext[SeqSize:], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !c.replay.Accept(seq) {
+		return nil, 0, ErrReplay
+	}
+	return plaintext, seq, nil
+}
+
+// Authentic reports whether a packet produced by Encrypt opens under this
+// cipher, without consuming its sequence number.
+func (c *SessionCipher) Authentic(ciphertext []byte) bool {
+	if len(ciphertext) < c.Overhead() {
+		return false
+	}
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], binary.BigEndian.Uint64(ciphertext))
+	_, err := c.gcm.Open(nil, nonce[:], ciphertext[SeqSize:], nil)
+	return err == nil
+}
+
+// Counters returns the last sequence number sent and the highest one
+// accepted, for handing the session to another process.
+func (c *SessionCipher) Counters() (sent, received uint64) {
+	c.replay.mu.Lock()
+	defer c.replay.mu.Unlock()
+	return c.counter.Load(), c.replay.top
+}
+
+// Resume continues a session exported with Counters: the next packet is
+// sent with sequence number sent+1 and anything older than the replay window
+// behind received is rejected. Packets inside that window that were already
+// delivered to the previous holder are not remembered.
+func (c *SessionCipher) Resume(sent, received uint64) {
+	c.counter.Store(sent)
+	c.replay.mu.Lock()
+	defer c.replay.mu.Unlock()
+	c.replay.top = received
+	c.replay.bitmap = [replayBlocks]uint64{}
+}
+
+// ResumeAbove is Resume for a holder that cannot know which packets the
+// previous one delivered: every sequence number up to floor is rejected, as
+// if already seen.
+func (c *SessionCipher) ResumeAbove(sent, floor uint64) {
+	c.counter.Store(sent)
+	c.replay.mu.Lock()
+	defer c.replay.mu.Unlock()
+	c.replay.top = floor
+	for i := range c.replay.bitmap {
+		c.replay.bitmap[i] = ^uint64(0)
+	}
+	// Numbers above floor in its own block are still to come.
+	c.replay.bitmap[(floor/64)%replayBlocks] = ^uint64(0) >> (63 - floor%64)
+}
+
+// ReplayWindow is a sliding bitmap of recently seen sequence numbers
+// (RFC 6479). Each session direction owns its own window, so there is no
+// lock shared between sessions.
+type ReplayWindow struct {
+	mu     sync.Mutex
+	top    uint64
+	bitmap [replayBlocks]uint64
+}
+
+// Accept reports whether seq is new and marks it as seen.
+func (w *ReplayWindow) Accept(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if seq > w.top {
+		cur, next := w.top/64, seq/64
+		diff := next - cur
+		if diff > replayBlocks {
+			diff = replayBlocks
+		}
+		for i := uint64(1); i <= diff; i++ {
+			w.bitmap[(cur+i)%replayBlocks] = 0
+		}
+		w.top = seq
+	} else if w.top-seq >= ReplayWindowSize {
+		return false
+	}
+
+	block, bit := (seq/64)%replayBlocks, uint64(1)<<(seq%64)
+	if w.bitmap[block]&bit != 0 {
+		return false
+	}
+	w.bitmap[block] |= bit
+	return true
+}
@@ -0,0 +1,239 @@
+package crypto
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestSessionCipher(tb testing.TB) *SessionCipher {
+	c, err := NewSessionCipher(make([]byte, 32))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+func TestSessionCipherRoundTrip(t *testing.T) {
+	send, recv := newTestSessionCipher(t), newTestSessionCipher(t)
+	for i := uint64(1); i <= 3; i++ {
+		pkt, err := send.Encrypt([]byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !recv.Authentic(pkt) {
+			t.Fatalf("packet %d not authentic", i)
+		}
+		plain, seq, err := recv.Decrypt(pkt)
+		if err != nil || seq != i || string(plain) != "payload" {
+			t.Fatalf("packet %d: %q, seq %d, %v", i, plain, seq, err)
+		}
+		// Authentic does not consume the sequence number, Decrypt does.
+		if !recv.Authentic(pkt) {
+			t.Fatalf("packet %d not authentic after Decrypt", i)
+		}
+		if _, _, err := recv.Decrypt(pkt); !errors.Is(err, ErrReplay) {
+			t.Fatalf("packet %d replayed: %v", i, err)
+		}
+	}
+	pkt, _ := send.Encrypt([]byte("payload"))
+	pkt[len(pkt)-1] ^= 1
+	if recv.Authentic(pkt) {
+		t.Fatal("tampered packet authentic")
+	}
+	if _, _, err := recv.Decrypt(pkt); err == nil {
+		t.Fatal("tampered packet opened")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w ReplayWindow
+	if w.Accept(0) {
+		t.Error("accepted sequence number 0")
+	}
+	for _, step := range []struct {
+		seq  uint64
+		want bool
+	}{
+		{1, true},
+		{1, false}, // duplicate
+		{3, true},
+		{2, true}, // late, inside the window
+		{2, false},
+		{ReplayWindowSize + 3, true},
+		{4, true},  // exactly at the window's far edge
+		{3, false}, // just past it, though never seen
+		{ReplayWindowSize*10 + 5, true},
+		{ReplayWindowSize + 4, false}, // the jump left it behind
+		{ReplayWindowSize*9 + 6, true},
+		{ReplayWindowSize*9 + 6, false},
+		{ReplayWindowSize*9 + 5, false},
+	} {
+		if got := w.Accept(step.seq); got != step.want {
+			t.Errorf("Accept(%d) = %v, want %v", step.seq, got, step.want)
+		}
+	}
+	// After a jump larger than the window, every number inside the new
+	// window but the top is still accepted once.
+	var j ReplayWindow
+	j.Accept(5)
+	top := uint64(5 + 3*ReplayWindowSize)
+	j.Accept(top)
+	for seq := top - ReplayWindowSize + 1; seq < top; seq++ {
+		if !j.Accept(seq) {
+			t.Fatalf("after jump: refused %d", seq)
+		}
+	}
+}
+
+// TestReplayWindowConcurrent accepts overlapping runs of sequence numbers
+// from many goroutines, as the receive workers do, and checks each is
+// accepted exactly once.
+func TestReplayWindowConcurrent(t *testing.T) {
+	const workers, per = 8, 20000
+	var w ReplayWindow
+	var next, accepted atomic.Uint64
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range per {
+				// Every number is offered twice, once a little late.
+				seq := next.Add(1)
+				if w.Accept(seq) {
+					accepted.Add(1)
+				}
+				if seq > 8 && w.Accept(seq-8) {
+					accepted.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := accepted.Load(), uint64(workers*per); got != want {
+		t.Fatalf("accepted %d, want %d", got, want)
+	}
+}
+
+// TestSessionCipherConcurrent seals and opens from many goroutines at
+// once, checking Authentic and Decrypt agree and no number opens twice.
+func TestSessionCipherConcurrent(t *testing.T) {
+	const workers, per = 8, 2000
+	send, recv := newTestSessionCipher(t), newTestSessionCipher(t)
+	pkts := make(chan []byte, workers*per)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range per {
+				pkt, err := send.Encrypt([]byte("payload"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				pkts <- pkt
+			}
+		}()
+	}
+	wg.Wait()
+	close(pkts)
+	var opened atomic.Uint64
+	all := make([][]byte, 0, workers*per)
+	for pkt := range pkts {
+		all = append(all, pkt)
+	}
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, pkt := range all {
+				if !recv.Authentic(pkt) {
+					t.Error("packet not authentic")
+					return
+				}
+				if _, _, err := recv.Decrypt(pkt); err == nil {
+					opened.Add(1)
+				} else if !errors.Is(err, ErrReplay) {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if sent, _ := send.Counters(); sent != workers*per {
+		t.Fatalf("sent %d, want %d", sent, workers*per)
+	}
+	if opened.Load() > workers*per {
+		t.Fatalf("opened %d of %d packets", opened.Load(), workers*per)
+	}
+}
+
+// benchPayload is a full-size tunnel packet.
+var benchPayload = make([]byte, 1400)
+
+// BenchmarkEncryptParallel seals from every P at once, as the forward
+// workers do; run with -cpu 1,2,4,8 to see it scale.
+func BenchmarkEncryptParallel(b *testing.B) {
+	c := newTestSessionCipher(b)
+	b.SetBytes(int64(len(benchPayload)))
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 0, len(benchPayload)+c.Overhead())
+		for pb.Next() {
+			if _, err := c.EncryptAppend(buf[:0], benchPayload); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkDecryptParallel opens from every P at once. Packets come from a
+// ring of a window's worth, so after the first pass most are refused as
+// replays, but only once they authenticated, which is the cost measured.
+func BenchmarkDecryptParallel(b *testing.B) {
+	send, recv := newTestSessionCipher(b), newTestSessionCipher(b)
+	ring := make([][]byte, ReplayWindowSize)
+	for i := range ring {
+		var err error
+		if ring[i], err = send.Encrypt(benchPayload); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var next atomic.Uint64
+	b.SetBytes(int64(len(benchPayload)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 0, len(benchPayload))
+		for pb.Next() {
+			pkt := ring[next.Add(1)%uint64(len(ring))]
+			if _, _, err := recv.DecryptAppend(buf[:0], pkt); err != nil && !errors.Is(err, ErrReplay) {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestResumeAbove(t *testing.T) {
+	for _, floor := range []uint64{0, 1, 100, 127, 128, 5000} {
+		c := newTestSessionCipher(t)
+		c.ResumeAbove(7, floor)
+		if sent, received := c.Counters(); sent != 7 || received != floor {
+			t.Fatalf("floor %d: counters %d, %d", floor, sent, received)
+		}
+		for _, seq := range []uint64{floor, floor / 2, floor - min(floor, 63), floor - min(floor, 64)} {
+			if c.replay.Accept(seq) {
+				t.Errorf("floor %d: accepted %d", floor, seq)
+			}
+		}
+		for _, seq := range []uint64{floor + 1, floor + 63, floor + 64, floor + 2} {
+			if !c.replay.Accept(seq) {
+				t.Errorf("floor %d: rejected %d", floor, seq)
+			}
+		}
+	}
+}
@@ -0,0 +1,482 @@
+// Package dnstun carries datagrams through DNS, for emergency connectivity
+// on networks, such as captive portals, that only let name lookups out.
+//
+// The server is the authoritative name server for a zone delegated to it.
+// The client encodes data in the names of TXT queries under that zone and
+// sends them through an ordinary resolver. The server decodes them and
+// answers with data queued for the client. Only the client can start an
+// exchange, so it keeps polling while the tunnel is up. Datagrams larger
+// than one query or answer are split into fragments.
+//
+// A query name holds about 140 bytes of data and an answer at most about
+// 900, and the query rate is capped to stay friendly to resolvers, so the
+// link is slow: tens of kilobytes per second at best.
+package dnstun
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// QueryRate is the most queries per second a client sends.
+	QueryRate = 50
+	// workers is how many queries a client keeps in flight.
+	workers = 4
+	// queryTimeout bounds one lookup through the resolver.
+	queryTimeout = 5 * time.Second
+	// pollMin and pollMax bound the idle poll interval, which doubles
+	// while nothing moves.
+	pollMin = 50 * time.Millisecond
+	pollMax = time.Second
+
+	maxName = 253
+	// upHeader is the client ID and a nonce that keeps resolvers from
+	// answering from cache. fragHeader is a datagram ID and the fragment
+	// index, with the top bit marking the last fragment.
+	upHeader   = 4
+	fragHeader = 2
+	maxFrags   = 128
+
+	queueLen   = 256
+	maxPartial = 8
+	peerIdle   = 2 * time.Minute
+)
+
+var (
+	b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+	b64 = base64.RawStdEncoding
+)
+
+// Addr identifies a client by the random ID it puts in every query.
+type Addr struct {
+	ID uint16
+}
+
+// Network returns "dns".
+func (a Addr) Network() string { return "dns" }
+
+// String returns "dns#id".
+func (a Addr) String() string { return fmt.Sprintf("dns#%d", a.ID) }
+
+// fragment splits pkt into frames of at most size data bytes.
+func fragment(pkt []byte, id uint8, size int) ([][]byte, error) {
+	n := max((len(pkt)+size-1)/size, 1)
+	if n > maxFrags {
+		return nil, fmt.Errorf("dns: %d-byte datagram needs too many fragments", len(pkt))
+	}
+	frames := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		chunk := pkt[i*size : min((i+1)*size, len(pkt))]
+		idx := byte(i)
+		if i == n-1 {
+			idx |= 0x80
+		}
+		frames = append(frames, append([]byte{id, idx}, chunk...))
+	}
+	return frames, nil
+}
+
+// reassembler rebuilds datagrams from frames that may arrive out of order.
+// Incomplete datagrams are dropped when newer ones push them out.
+type reassembler struct {
+	parts map[uint8]*partial
+}
+
+type partial struct {
+	frags [][]byte
+	last  int // index of the last fragment, or -1 until it arrives
+	got   int
+	seen  time.Time
+}
+
+// add takes one frame and returns a datagram once all its fragments are in.
+func (r *reassembler) add(frame []byte) []byte {
+	if len(frame) < fragHeader {
+		return nil
+	}
+	id, idx, last := frame[0], int(frame[1]&0x7f), frame[1]&0x80 != 0
+	if r.parts == nil {
+		r.parts = make(map[uint8]*partial)
+	}
+	p := r.parts[id]
+	if p == nil {
+		if len(r.parts) >= maxPartial {
+			var oldest *partial
+			var oldestID uint8
+			for k, v := range r.parts {
+				if oldest == nil || v.seen.Before(oldest.seen) {
+					oldest, oldestID = v, k
+				}
+			}
+			delete(r.parts, oldestID)
+		}
+		p = &partial{frags: make([][]byte, maxFrags), last: -1}
+		r.parts[id] = p
+	}
+	p.seen = time.Now()
+	if p.frags[idx] == nil {
+		p.frags[idx] = append([]byte{}, frame[fragHeader:]...)
+		p.got++
+	}
+	if last {
+		p.last = idx
+	}
+	if p.last < 0 || p.got < p.last+1 {
+		return nil
+	}
+	delete(r.parts, id)
+	var pkt []byte
+	for _, f := range p.frags[:p.last+1] {
+		if f == nil {
+			return nil
+		}
+		pkt = append(pkt, f...)
+	}
+	return pkt
+}
+
+// Client is the polling end of a DNS tunnel.
+type Client struct {
+	res   *net.Resolver
+	zone  string
+	id    uint16
+	chunk int // data bytes per query
+
+	nonce atomic.Uint32
+	msgID atomic.Uint32
+	up    chan []byte
+	down  chan []byte
+	tick  *time.Ticker
+
+	mu    sync.Mutex
+	reasm reassembler
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Dial starts a client for zone. Queries go to resolver, a host:port, or
+// to the system resolver when it is empty. The returned address is the
+// server's, which is the only peer.
+func Dial(ctx context.Context, zone, resolver string) (*Client, Addr, error) {
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	// Each label holds 63 characters plus a dot.
+	avail := maxName - len(zone)
+	chars := avail/64*63 + max(avail%64-1, 0)
+	chunk := chars*5/8 - upHeader - fragHeader
+	if zone == "" || chunk < 16 {
+		return nil, Addr{}, fmt.Errorf("dns: zone %q leaves no room for data", zone)
+	}
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, Addr{}, err
+	}
+	res := net.DefaultResolver
+	if resolver != "" {
+		res = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "udp", resolver)
+			},
+		}
+	}
+	c := &Client{
+		res:   res,
+		zone:  zone,
+		id:    binary.BigEndian.Uint16(b[:]),
+		chunk: chunk,
+		up:    make(chan []byte, queueLen),
+		down:  make(chan []byte, queueLen),
+		tick:  time.NewTicker(time.Second / QueryRate),
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go c.loop()
+	}
+	return c, Addr{ID: c.id}, nil
+}
+
+// loop sends queries, with data when there is some and as empty polls
+// otherwise, backing off while the tunnel is idle.
+func (c *Client) loop() {
+	defer c.wg.Done()
+	wait := time.Duration(0)
+	for {
+		var frame []byte
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.ctx.Done():
+			timer.Stop()
+			return
+		case frame = <-c.up:
+		case <-timer.C:
+		}
+		timer.Stop()
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.tick.C:
+		}
+		if c.query(frame) || frame != nil {
+			wait = 0
+		} else {
+			wait = min(max(2*wait, pollMin), pollMax)
+		}
+	}
+}
+
+// query sends frame and hands on any data in the answer. It reports
+// whether the answer carried data.
+func (c *Client) query(frame []byte) bool {
+	data := make([]byte, upHeader, upHeader+len(frame))
+	binary.BigEndian.PutUint16(data[0:2], c.id)
+	binary.BigEndian.PutUint16(data[2:4], uint16(c.nonce.Add(1)))
+	data = append(data, frame...)
+	enc := strings.ToLower(b32.EncodeToString(data))
+	var name strings.Builder
+	for len(enc) > 63 {
+		name.WriteString(enc[:63])
+		name.WriteByte('.')
+		enc = enc[63:]
+	}
+	name.WriteString(enc)
+	name.WriteString("." + c.zone + ".")
+
+	ctx, cancel := context.WithTimeout(c.ctx, queryTimeout)
+	defer cancel()
+	txts, err := c.res.LookupTXT(ctx, name.String())
+	if err != nil || len(txts) == 0 || txts[0] == "" {
+		return false
+	}
+	down, err := b64.DecodeString(txts[0])
+	if err != nil {
+		return false
+	}
+	c.mu.Lock()
+	pkt := c.reasm.add(down)
+	c.mu.Unlock()
+	if pkt != nil {
+		select {
+		case c.down <- pkt:
+		default:
+		}
+	}
+	return true
+}
+
+// ReadFrom returns the next datagram from the server.
+func (c *Client) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-c.ctx.Done():
+		return 0, nil, net.ErrClosed
+	case pkt := <-c.down:
+		return copy(b, pkt), Addr{ID: c.id}, nil
+	}
+}
+
+// WriteTo queues b for the server. Datagrams that do not fit in the queue
+// are dropped, as a congested link would.
+func (c *Client) WriteTo(b []byte, _ net.Addr) (int, error) {
+	frames, err := fragment(b, uint8(c.msgID.Add(1)), c.chunk)
+	if err != nil {
+		return 0, err
+	}
+	if len(c.up)+len(frames) > cap(c.up) {
+		return len(b), nil
+	}
+	for _, f := range frames {
+		select {
+		case c.up <- f:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+// LocalAddr returns the client's own address.
+func (c *Client) LocalAddr() net.Addr { return Addr{ID: c.id} }
+
+// Close stops polling.
+func (c *Client) Close() error {
+	c.cancel()
+	c.tick.Stop()
+	c.wg.Wait()
+	return nil
+}
+
+// Server is the authoritative end of a DNS tunnel.
+type Server struct {
+	conn net.PacketConn
+	zone string
+
+	mu        sync.Mutex
+	peers     map[uint16]*peer
+	lastPrune time.Time
+}
+
+type peer struct {
+	up   reassembler
+	down [][]byte // queued datagrams
+	cur  []byte   // datagram being sent
+	off  int
+	idx  int
+	id   uint8
+	seen time.Time
+}
+
+// Listen answers queries for zone on the UDP address.
+func Listen(zone, address string) (*Server, error) {
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	if zone == "" {
+		return nil, errors.New("dns: zone is required")
+	}
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{conn: conn, zone: zone, peers: make(map[uint16]*peer)}, nil
+}
+
+// ReadFrom answers queries until one completes a datagram, which it
+// returns with the sending client's address.
+func (s *Server) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, ednsSize)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		q, err := parseQuery(buf[:n])
+		if err != nil {
+			continue
+		}
+		data, ok := s.decode(q)
+		if !ok {
+			s.conn.WriteTo(q.response(rcodeRefused, nil), from)
+			continue
+		}
+		if len(data) < upHeader {
+			s.conn.WriteTo(q.response(rcodeFormErr, nil), from)
+			continue
+		}
+		id := binary.BigEndian.Uint16(data[0:2])
+
+		s.mu.Lock()
+		s.pruneLocked()
+		p := s.peers[id]
+		if p == nil {
+			p = &peer{}
+			s.peers[id] = p
+		}
+		p.seen = time.Now()
+		var pkt []byte
+		if frame := data[upHeader:]; len(frame) > 0 {
+			pkt = p.up.add(frame)
+		}
+		down := p.next(q.capacity() - fragHeader)
+		s.mu.Unlock()
+
+		s.conn.WriteTo(q.response(rcodeSuccess, []byte(b64.EncodeToString(down))), from)
+		if pkt != nil {
+			return copy(b, pkt), Addr{ID: id}, nil
+		}
+	}
+}
+
+// decode returns the data in a TXT query for the zone.
+func (s *Server) decode(q query) ([]byte, bool) {
+	if q.qtype != typeTXT {
+		return nil, false
+	}
+	labels, ok := strings.CutSuffix(q.name, "."+s.zone)
+	if !ok {
+		return nil, false
+	}
+	data, err := b32.DecodeString(strings.ToUpper(strings.ReplaceAll(labels, ".", "")))
+	return data, err == nil
+}
+
+// next returns the next frame for the peer of at most size data bytes, or
+// nil when nothing is queued.
+func (p *peer) next(size int) []byte {
+	if size <= 0 {
+		return nil
+	}
+	if p.cur == nil {
+		if len(p.down) == 0 {
+			return nil
+		}
+		p.cur, p.down = p.down[0], p.down[1:]
+		p.off, p.idx = 0, 0
+		p.id++
+	}
+	end := min(p.off+size, len(p.cur))
+	if end < len(p.cur) && p.idx == maxFrags-1 {
+		// Answers this small cannot carry the datagram; drop it.
+		p.cur = nil
+		return nil
+	}
+	idx := byte(p.idx)
+	if end == len(p.cur) {
+		idx |= 0x80
+	}
+	frame := append([]byte{p.id, idx}, p.cur[p.off:end]...)
+	p.off, p.idx = end, p.idx+1
+	if idx&0x80 != 0 {
+		p.cur = nil
+	}
+	return frame
+}
+
+// pruneLocked forgets clients that have stopped polling.
+func (s *Server) pruneLocked() {
+	now := time.Now()
+	if now.Sub(s.lastPrune) < peerIdle {
+		return
+	}
+	s.lastPrune = now
+	for id, p := range s.peers {
+		if now.Sub(p.seen) > peerIdle {
+			delete(s.peers, id)
+		}
+	}
+}
+
+// WriteTo queues b for the client at addr, to go out in answers to its
+// next queries.
+func (s *Server) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a, ok := addr.(Addr)
+	if !ok {
+		return 0, fmt.Errorf("dns: unsupported address %T", addr)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.peers[a.ID]
+	if p == nil {
+		return 0, fmt.Errorf("dns: no client %s", a)
+	}
+	if len(p.down) < queueLen {
+		p.down = append(p.down, append([]byte{}, b...))
+	}
+	return len(b), nil
+}
+
+// LocalAddr returns the listening address.
+func (s *Server) LocalAddr() net.Addr { return s.conn.LocalAddr() }
+
+// Close closes the listening socket.
+func (s *Server) Close() error { return s.conn.Close() }
@@ -0,0 +1,160 @@
+package dnstun
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// DNS wire constants (RFC 1035, RFC 6891).
+const (
+	headerSize = 12
+
+	typeTXT = 16
+	typeOPT = 41
+	classIN = 1
+
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagRD = 1 << 8
+
+	rcodeSuccess = 0
+	rcodeFormErr = 1
+	rcodeRefused = 5
+
+	// plainSize is the response limit without EDNS; ednsSize is the most
+	// the server offers with it, the size that avoids IP fragmentation.
+	plainSize = 512
+	ednsSize  = 1232
+
+	// answerOverhead is a TXT answer's fixed part: a pointer to the
+	// question name, type, class, TTL and length. optSize is an empty OPT
+	// record.
+	answerOverhead = 12
+	optSize        = 11
+)
+
+var errMalformed = errors.New("malformed DNS message")
+
+// query is a parsed single-question DNS query.
+type query struct {
+	id       uint16
+	flags    uint16
+	name     string // lower case, without the trailing dot
+	qtype    uint16
+	question []byte // the question section as received
+	edns     bool
+	udpSize  int
+}
+
+func parseQuery(b []byte) (query, error) {
+	if len(b) < headerSize {
+		return query{}, errMalformed
+	}
+	q := query{
+		id:      binary.BigEndian.Uint16(b[0:2]),
+		flags:   binary.BigEndian.Uint16(b[2:4]),
+		udpSize: plainSize,
+	}
+	if q.flags&flagQR != 0 || binary.BigEndian.Uint16(b[4:6]) != 1 {
+		return query{}, errMalformed
+	}
+	arcount := int(binary.BigEndian.Uint16(b[10:12]))
+
+	off := headerSize
+	var labels []string
+	for {
+		if off >= len(b) {
+			return query{}, errMalformed
+		}
+		n := int(b[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n > 63 || off+n > len(b) {
+			return query{}, errMalformed
+		}
+		labels = append(labels, strings.ToLower(string(b[off:off+n])))
+		off += n
+	}
+	if off+4 > len(b) {
+		return query{}, errMalformed
+	}
+	q.qtype = binary.BigEndian.Uint16(b[off : off+2])
+	off += 4
+	q.name = strings.Join(labels, ".")
+	q.question = b[headerSize:off]
+
+	// Only an OPT record is expected after the question.
+	for i := 0; i < arcount; i++ {
+		if off+11 > len(b) || b[off] != 0 {
+			break
+		}
+		typ := binary.BigEndian.Uint16(b[off+1 : off+3])
+		class := binary.BigEndian.Uint16(b[off+3 : off+5])
+		rdlen := int(binary.BigEndian.Uint16(b[off+9 : off+11]))
+		if typ == typeOPT {
+			q.edns = true
+			q.udpSize = min(max(int(class), plainSize), ednsSize)
+		}
+		off += 11 + rdlen
+	}
+	return q, nil
+}
+
+// capacity is the number of payload bytes a TXT answer to q can carry
+// after base64 encoding, without exceeding the requester's size limit.
+func (q query) capacity() int {
+	room := q.udpSize - headerSize - len(q.question) - answerOverhead
+	if q.edns {
+		room -= optSize
+	}
+	// Every 255 bytes of text take one length byte.
+	room -= (room + 255) / 256
+	if room <= 0 {
+		return 0
+	}
+	return room / 4 * 3
+}
+
+// response answers q with rcode and, if txt is not nil, one TXT record
+// holding it. The TTL is zero so resolvers do not cache it.
+func (q query) response(rcode uint16, txt []byte) []byte {
+	b := make([]byte, headerSize, ednsSize)
+	binary.BigEndian.PutUint16(b[0:2], q.id)
+	binary.BigEndian.PutUint16(b[2:4], flagQR|flagAA|q.flags&flagRD|rcode)
+	binary.BigEndian.PutUint16(b[4:6], 1)
+	if txt != nil {
+		binary.BigEndian.PutUint16(b[6:8], 1)
+	}
+	if q.edns {
+		binary.BigEndian.PutUint16(b[10:12], 1)
+	}
+	b = append(b, q.question...)
+	if txt != nil {
+		var rdata []byte
+		for len(txt) > 255 {
+			rdata = append(rdata, 255)
+			rdata = append(rdata, txt[:255]...)
+			txt = txt[255:]
+		}
+		rdata = append(rdata, byte(len(txt)))
+		rdata = append(rdata, txt...)
+
+		b = append(b, 0xc0, headerSize) // pointer to the question name
+		b = binary.BigEndian.AppendUint16(b, typeTXT)
+		b = binary.BigEndian.AppendUint16(b, classIN)
+		b = binary.BigEndian.AppendUint32(b, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+		b = append(b, rdata...)
+	}
+	if q.edns {
+		b = append(b, 0)
+		b = binary.BigEndian.AppendUint16(b, typeOPT)
+		b = binary.BigEndian.AppendUint16(b, ednsSize)
+		b = binary.BigEndian.AppendUint32(b, 0)
+		b = binary.BigEndian.AppendUint16(b, 0)
+	}
+	return b
+}
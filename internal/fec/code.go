@@ -0,0 +1,151 @@
+package fec
+
+import "errors"
+
+// GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1 (0x11d).
+var gfExp, gfLog = func() (exp [512]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// coefficient is entry (j, i) of the Cauchy matrix that produces parity
+// shard j from data shard i: 1/(x_j + y_i) with y_i = i and x_j =
+// MaxData+j. The x and y values never collide, so every square submatrix
+// of the systematic generator is invertible, whatever the group size.
+func coefficient(j, i int) byte {
+	return gfInv(byte(MaxData+j) ^ byte(i))
+}
+
+// mulAdd sets dst[k] += c*src[k].
+func mulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	lc := int(gfLog[c])
+	for k, s := range src {
+		if s != 0 {
+			dst[k] ^= gfExp[lc+int(gfLog[s])]
+		}
+	}
+}
+
+// encodeParity returns parity shard j of the equal-length data shards.
+func encodeParity(data [][]byte, j int) []byte {
+	p := make([]byte, len(data[0]))
+	for i, d := range data {
+		mulAdd(p, d, coefficient(j, i))
+	}
+	return p
+}
+
+var errSingular = errors.New("fec: singular matrix")
+
+// reconstruct fills in the nil entries of data, n shards of length size,
+// from the present ones and the parity shards, of which there must be at
+// least as many as are missing.
+func reconstruct(data [][]byte, parity map[int][]byte, size int) error {
+	n := len(data)
+	// Rows of the generator for the shards in hand: unit rows for data,
+	// Cauchy rows for parity.
+	rows := make([][]byte, 0, n)
+	shards := make([][]byte, 0, n)
+	for i, d := range data {
+		if d != nil {
+			row := make([]byte, n)
+			row[i] = 1
+			rows = append(rows, row)
+			shards = append(shards, d)
+		}
+	}
+	for j, p := range parity {
+		if len(rows) == n {
+			break
+		}
+		row := make([]byte, n)
+		for i := range row {
+			row[i] = coefficient(j, i)
+		}
+		rows = append(rows, row)
+		shards = append(shards, p)
+	}
+	if len(rows) < n {
+		return errors.New("fec: not enough shards")
+	}
+	inv, err := invert(rows)
+	if err != nil {
+		return err
+	}
+	for i := range data {
+		if data[i] != nil {
+			continue
+		}
+		d := make([]byte, size)
+		for r, s := range shards {
+			mulAdd(d, s, inv[i][r])
+		}
+		data[i] = d
+	}
+	return nil
+}
+
+// invert returns the inverse of the square matrix m by Gauss-Jordan
+// elimination. m is modified.
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if m[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errSingular
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		if c := gfInv(m[col][col]); c != 1 {
+			for k := 0; k < n; k++ {
+				m[col][k] = gfMul(m[col][k], c)
+				inv[col][k] = gfMul(inv[col][k], c)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			c := m[r][col]
+			mulAdd(m[r], m[col], c)
+			mulAdd(inv[r], inv[col], c)
+		}
+	}
+	return inv, nil
+}
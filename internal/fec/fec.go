@@ -0,0 +1,272 @@
+// Package fec adds forward error correction to a packet stream. Packets
+// are sent unchanged in groups of up to Data, each group followed by Parity
+// repair packets from a systematic Reed-Solomon erasure code over GF(256).
+// A receiver that gets any Data of the group's packets can rebuild the
+// missing ones without waiting for a retransmission.
+//
+// Every frame starts with a header: the group number (4 bytes), the
+// shard index (1 byte), and on repair frames the number of packets in the
+// group (1 byte, zero on data frames). A data frame carries its packet; a
+// repair frame carries a parity shard computed over the group's packets,
+// each prefixed with its 2-byte length and zero-padded to the longest.
+package fec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxData and MaxParity bound the group shape.
+	MaxData   = 32
+	MaxParity = 16
+
+	// HeaderSize is the length of the frame header.
+	HeaderSize = 6
+
+	// window is how many groups behind the newest the decoder keeps.
+	window = 64
+)
+
+// Params is a group shape: Data packets protected by Parity repair packets.
+// Up to Parity losses per group can be repaired.
+type Params struct {
+	Data   int
+	Parity int
+}
+
+// Validate checks p is within bounds.
+func (p Params) Validate() error {
+	if p.Data < 1 || p.Data > MaxData || p.Parity < 1 || p.Parity > MaxParity {
+		return fmt.Errorf("fec: need 1-%d data and 1-%d parity packets, got %d+%d", MaxData, MaxParity, p.Data, p.Parity)
+	}
+	return nil
+}
+
+func (p Params) String() string {
+	return fmt.Sprintf("%d+%d", p.Data, p.Parity)
+}
+
+// Encoder groups outgoing packets and emits repair frames. A group that has
+// not filled up within the flush delay is closed early, so light traffic is
+// still protected and repair frames are not held back. It is safe for
+// concurrent use.
+type Encoder struct {
+	params Params
+	delay  time.Duration
+	emit   func(frame []byte)
+
+	mu     sync.Mutex
+	group  uint32
+	shards [][]byte
+	timer  *time.Timer
+	closed bool
+}
+
+// NewEncoder returns an encoder that hands every frame to emit.
+func NewEncoder(p Params, delay time.Duration, emit func(frame []byte)) *Encoder {
+	return &Encoder{params: p, delay: delay, emit: emit}
+}
+
+// Add sends pkt as a data frame, followed by the group's repair frames if
+// it completes the group.
+func (e *Encoder) Add(pkt []byte) {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	idx := len(e.shards)
+	frames := [][]byte{append(header(e.group, idx, 0), pkt...)}
+	e.shards = append(e.shards, pkt)
+	if len(e.shards) == e.params.Data {
+		frames = append(frames, e.closeLocked()...)
+	} else if idx == 0 {
+		group := e.group
+		e.timer = time.AfterFunc(e.delay, func() { e.flush(group) })
+	}
+	e.mu.Unlock()
+	for _, f := range frames {
+		e.emit(f)
+	}
+}
+
+// flush closes group if it is still open.
+func (e *Encoder) flush(group uint32) {
+	e.mu.Lock()
+	var frames [][]byte
+	if !e.closed && e.group == group && len(e.shards) > 0 {
+		frames = e.closeLocked()
+	}
+	e.mu.Unlock()
+	for _, f := range frames {
+		e.emit(f)
+	}
+}
+
+// closeLocked returns the repair frames for the current group and starts
+// the next one.
+func (e *Encoder) closeLocked() [][]byte {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	n := len(e.shards)
+	size := 0
+	for _, s := range e.shards {
+		size = max(size, len(s))
+	}
+	data := make([][]byte, n)
+	for i, s := range e.shards {
+		data[i] = make([]byte, 2+size)
+		binary.BigEndian.PutUint16(data[i], uint16(len(s)))
+		copy(data[i][2:], s)
+	}
+	frames := make([][]byte, 0, e.params.Parity)
+	for j := 0; j < e.params.Parity; j++ {
+		frames = append(frames, append(header(e.group, n+j, n), encodeParity(data, j)...))
+	}
+	e.group++
+	e.shards = e.shards[:0:0]
+	return frames
+}
+
+// Close stops the flush timer. Later packets are dropped.
+func (e *Encoder) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+}
+
+func header(group uint32, idx, count int) []byte {
+	h := make([]byte, HeaderSize, HeaderSize+1500)
+	binary.BigEndian.PutUint32(h, group)
+	h[4] = byte(idx)
+	h[5] = byte(count)
+	return h
+}
+
+// Decoder passes data frames through and rebuilds lost packets from repair
+// frames. It is safe for concurrent use.
+type Decoder struct {
+	params Params
+
+	mu     sync.Mutex
+	groups map[uint32]*group
+	newest uint32
+}
+
+type group struct {
+	data   map[int][]byte
+	parity map[int][]byte
+	count  int // packets in the group, once a repair frame says
+	done   bool
+}
+
+// NewDecoder returns a decoder for groups shaped by p.
+func NewDecoder(p Params) *Decoder {
+	return &Decoder{params: p, groups: make(map[uint32]*group)}
+}
+
+// Add takes one frame and returns the packets it makes available: the
+// packet itself for a data frame, and any rebuilt ones. recovered counts
+// the rebuilt packets.
+func (d *Decoder) Add(frame []byte) (pkts [][]byte, recovered int, err error) {
+	if len(frame) < HeaderSize {
+		return nil, 0, fmt.Errorf("fec: short frame")
+	}
+	id := binary.BigEndian.Uint32(frame)
+	idx, count := int(frame[4]), int(frame[5])
+	body := frame[HeaderSize:]
+	if idx >= MaxData+MaxParity || count > d.params.Data || (count > 0 && idx < count) {
+		return nil, 0, fmt.Errorf("fec: bad frame header")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if int32(id-d.newest) > 0 {
+		d.newest = id
+		for gid := range d.groups {
+			if d.newest-gid >= window {
+				delete(d.groups, gid)
+			}
+		}
+	} else if d.newest-id >= window {
+		return nil, 0, nil
+	}
+	g := d.groups[id]
+	if g == nil {
+		g = &group{data: make(map[int][]byte), parity: make(map[int][]byte)}
+		d.groups[id] = g
+	}
+
+	if count == 0 {
+		if _, dup := g.data[idx]; dup || g.done {
+			return nil, 0, nil
+		}
+		g.data[idx] = append([]byte{}, body...)
+		pkts = append(pkts, g.data[idx])
+	} else {
+		if g.done {
+			return nil, 0, nil
+		}
+		g.count = count
+		g.parity[idx-count] = append([]byte{}, body...)
+	}
+	rebuilt := d.repair(g)
+	return append(pkts, rebuilt...), len(rebuilt), nil
+}
+
+// repair rebuilds the missing packets of g once enough shards are in. A
+// group whose repair frames disagree on the shard size, or are too short to
+// hold a length, is given up on.
+func (d *Decoder) repair(g *group) [][]byte {
+	if g.count == 0 || len(g.data) == g.count {
+		if g.count > 0 {
+			g.done = true
+		}
+		return nil
+	}
+	if len(g.data)+len(g.parity) < g.count {
+		return nil
+	}
+	g.done = true
+	size := -1
+	for _, p := range g.parity {
+		if size >= 0 && len(p) != size {
+			return nil
+		}
+		size = len(p)
+	}
+	if size < 2 {
+		return nil
+	}
+	data := make([][]byte, g.count)
+	for i, pkt := range g.data {
+		if i >= g.count || 2+len(pkt) > size {
+			return nil
+		}
+		data[i] = make([]byte, size)
+		binary.BigEndian.PutUint16(data[i], uint16(len(pkt)))
+		copy(data[i][2:], pkt)
+	}
+	if reconstruct(data, g.parity, size) != nil {
+		return nil
+	}
+	var out [][]byte
+	for i, shard := range data {
+		if _, ok := g.data[i]; ok {
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(shard))
+		if n > size-2 {
+			continue
+		}
+		out = append(out, shard[2:2+n])
+	}
+	return out
+}
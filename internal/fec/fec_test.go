@@ -0,0 +1,97 @@
+package fec
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// encode returns the frames an encoder of p emits for pkts, one full group.
+func encode(p Params, pkts [][]byte) [][]byte {
+	var frames [][]byte
+	e := NewEncoder(p, time.Hour, func(f []byte) { frames = append(frames, f) })
+	defer e.Close()
+	for _, pkt := range pkts {
+		e.Add(pkt)
+	}
+	return frames
+}
+
+func TestDecoderRepairs(t *testing.T) {
+	p := Params{Data: 4, Parity: 2}
+	pkts := [][]byte{[]byte("one"), []byte("second"), []byte("3"), []byte("fourth packet")}
+	frames := encode(p, pkts)
+	if len(frames) != 6 {
+		t.Fatalf("got %d frames, want 6", len(frames))
+	}
+	d := NewDecoder(p)
+	var got [][]byte
+	recovered := 0
+	// Lose the second and fourth packets.
+	for _, i := range []int{0, 2, 4, 5} {
+		out, n, err := d.Add(frames[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, out...)
+		recovered += n
+	}
+	if recovered != 2 || len(got) != 4 {
+		t.Fatalf("got %d packets, %d recovered; want 4, 2", len(got), recovered)
+	}
+	for _, want := range pkts {
+		found := false
+		for _, pkt := range got {
+			found = found || bytes.Equal(pkt, want)
+		}
+		if !found {
+			t.Errorf("packet %q not delivered", want)
+		}
+	}
+}
+
+func TestDecoderRejectsBadShards(t *testing.T) {
+	p := Params{Data: 4, Parity: 2}
+	frames := encode(p, [][]byte{[]byte("one"), []byte("two"), []byte("three"), []byte("four")})
+	for name, repair := range map[string][][]byte{
+		"empty":       {append(header(0, 4, 4), nil...), append(header(0, 5, 4), nil...)},
+		"short":       {append(header(0, 4, 4), 1), append(header(0, 5, 4), 1)},
+		"mismatched":  {frames[4], frames[5][:len(frames[5])-1]},
+		"data larger": {append(header(0, 4, 4), 0, 1), append(header(0, 5, 4), 0, 1)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d := NewDecoder(p)
+			if _, _, err := d.Add(frames[0]); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := d.Add(frames[1]); err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range repair {
+				out, n, err := d.Add(f)
+				if err != nil || n != 0 || len(out) != 0 {
+					t.Fatalf("repair frame: got %d packets, %d recovered, %v", len(out), n, err)
+				}
+			}
+		})
+	}
+	// The fuzzer's crasher: a lone repair frame of one byte.
+	if _, _, err := NewDecoder(p).Add([]byte("0000 \x01")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func FuzzDecoder(f *testing.F) {
+	f.Add([]byte("0000 \x01"))
+	for _, frame := range encode(Params{Data: 4, Parity: 2}, [][]byte{[]byte("a"), []byte("bc")}) {
+		f.Add(frame)
+	}
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		d := NewDecoder(Params{Data: 4, Parity: 2})
+		for len(frame) > 0 {
+			n := min(len(frame), HeaderSize+int(frame[0])%32)
+			d.Add(frame[:n])
+			frame = frame[n:]
+		}
+	})
+}
@@ -0,0 +1,114 @@
+// Package greudp frames tunnel datagrams as GRE-in-UDP (RFC 8086), for
+// stateful firewalls and carrier-grade NATs that treat flows they recognise
+// better than opaque UDP.
+//
+// Each datagram starts with an 8-byte GRE header: flags with only the key
+// bit set, version 0, protocol type 0x88B5 (local experimental), and a key
+// holding a fixed 16-bit magic and the payload length. Datagrams without
+// the header, or whose length disagrees, are discarded.
+package greudp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	// HeaderSize is the length of the GRE header.
+	HeaderSize = 8
+
+	flagsKey = 0x2000
+	protocol = 0x88b5
+	magic    = 0x4756 // "GV"
+)
+
+var errFrame = errors.New("greudp: not a tunnel frame")
+
+// Append appends the header and payload to dst.
+func Append(dst, payload []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, flagsKey)
+	dst = binary.BigEndian.AppendUint16(dst, protocol)
+	dst = binary.BigEndian.AppendUint16(dst, magic)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(payload)))
+	return append(dst, payload...)
+}
+
+// Parse returns the payload of frame.
+func Parse(frame []byte) ([]byte, error) {
+	if len(frame) < HeaderSize ||
+		binary.BigEndian.Uint16(frame) != flagsKey ||
+		binary.BigEndian.Uint16(frame[2:]) != protocol ||
+		binary.BigEndian.Uint16(frame[4:]) != magic ||
+		int(binary.BigEndian.Uint16(frame[6:])) != len(frame)-HeaderSize {
+		return nil, errFrame
+	}
+	return frame[HeaderSize:], nil
+}
+
+var bufs = sync.Pool{New: func() any { return new([]byte) }}
+
+// unwrap moves the payload of the n-byte frame in b to the front of b.
+func unwrap(b []byte, n int) (int, error) {
+	payload, err := Parse(b[:n])
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, payload), nil
+}
+
+// Conn frames a connected socket. Reads skip datagrams that are not frames.
+type Conn struct {
+	net.Conn
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		if err != nil {
+			return n, err
+		}
+		if n, err = unwrap(b, n); err == nil {
+			return n, nil
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	buf := bufs.Get().(*[]byte)
+	defer bufs.Put(buf)
+	*buf = Append((*buf)[:0], b)
+	if _, err := c.Conn.Write(*buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// PacketConn frames an unconnected socket. Reads skip datagrams that are not
+// frames.
+type PacketConn struct {
+	net.PacketConn
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if n, err = unwrap(b, n); err == nil {
+			return n, addr, nil
+		}
+	}
+}
+
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	buf := bufs.Get().(*[]byte)
+	defer bufs.Put(buf)
+	*buf = Append((*buf)[:0], b)
+	if _, err := c.PacketConn.WriteTo(*buf, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
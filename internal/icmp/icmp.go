@@ -0,0 +1,193 @@
+// Package icmp carries datagrams in the payload of ICMP echo messages, for
+// networks that let ping through but block UDP and TCP to arbitrary ports.
+//
+// The client sends echo requests and the server answers with echo replies
+// carrying the same identifier and the latest sequence number seen from
+// that client, so NATs and stateful firewalls pass them as ping traffic. A
+// tag at the start of the payload tells tunnel messages apart from ordinary
+// pings and from the replies the operating system sends on its own.
+//
+// Both ends use raw sockets, which need administrator rights or
+// CAP_NET_RAW. Only IPv4 is supported.
+package icmp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	typeEchoReply   = 0
+	typeEchoRequest = 8
+
+	headerSize = 8
+	tagSize    = 4
+)
+
+// Tags mark the direction of a tunnel message. The server answers only
+// requests tagged tagRequest; the client accepts only replies tagged
+// tagReply, so the kernel's own echo of a request is ignored.
+var (
+	tagRequest = [tagSize]byte{'G', 'V', 'P', 'q'}
+	tagReply   = [tagSize]byte{'G', 'V', 'P', 'r'}
+)
+
+// ErrIPv6 is returned for IPv6 addresses.
+var ErrIPv6 = errors.New("icmp transport supports IPv4 only")
+
+// Addr is a tunnel peer: a host and the echo identifier it sends with.
+type Addr struct {
+	IP netip.Addr
+	ID uint16
+}
+
+// Network returns "icmp".
+func (a Addr) Network() string { return "icmp" }
+
+// String returns the host and identifier as "ip#id".
+func (a Addr) String() string { return fmt.Sprintf("%s#%d", a.IP, a.ID) }
+
+// Conn is one end of an ICMP tunnel.
+type Conn struct {
+	pc     net.PacketConn
+	server bool
+
+	// Client side: the identifier and next sequence number.
+	id  uint16
+	seq atomic.Uint32
+
+	// Server side: the latest sequence number each client used.
+	mu   sync.Mutex
+	seqs map[Addr]uint16
+}
+
+// Listen opens the server side on host, which may be empty for all local
+// addresses. Windows only delivers ICMP to raw sockets bound to a specific
+// address.
+func Listen(host string) (*Conn, error) {
+	if ip, err := netip.ParseAddr(host); err == nil && !ip.Unmap().Is4() {
+		return nil, ErrIPv6
+	}
+	pc, err := net.ListenPacket("ip4:icmp", host)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{pc: pc, server: true, seqs: make(map[Addr]uint16)}, nil
+}
+
+// Dial resolves host and opens the client side, with a random echo
+// identifier. It returns the server's address to write to.
+func Dial(host string) (*Conn, Addr, error) {
+	ipa, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return nil, Addr{}, err
+	}
+	ip, ok := netip.AddrFromSlice(ipa.IP.To4())
+	if !ok {
+		return nil, Addr{}, ErrIPv6
+	}
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, Addr{}, err
+	}
+	pc, err := net.ListenPacket("ip4:icmp", "")
+	if err != nil {
+		return nil, Addr{}, err
+	}
+	id := binary.BigEndian.Uint16(b[:])
+	return &Conn{pc: pc, id: id}, Addr{IP: ip, ID: id}, nil
+}
+
+// ReadFrom reads the next tunnel message into b, skipping other ICMP
+// traffic.
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, headerSize+tagSize+len(b))
+	for {
+		n, from, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		msg := buf[:n]
+		if len(msg) < headerSize+tagSize {
+			continue
+		}
+		ipa, ok := from.(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipa.IP.To4())
+		if !ok {
+			continue
+		}
+		id := binary.BigEndian.Uint16(msg[4:6])
+		seq := binary.BigEndian.Uint16(msg[6:8])
+		tag := [tagSize]byte(msg[headerSize : headerSize+tagSize])
+		peer := Addr{IP: ip, ID: id}
+		switch {
+		case c.server && msg[0] == typeEchoRequest && tag == tagRequest:
+			c.mu.Lock()
+			c.seqs[peer] = seq
+			c.mu.Unlock()
+		case !c.server && msg[0] == typeEchoReply && tag == tagReply && id == c.id:
+		default:
+			continue
+		}
+		return copy(b, msg[headerSize+tagSize:]), peer, nil
+	}
+}
+
+// WriteTo sends b to addr, as an echo request from the client or an echo
+// reply from the server.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	peer, ok := addr.(Addr)
+	if !ok {
+		return 0, fmt.Errorf("icmp: unsupported address %T", addr)
+	}
+	msg := make([]byte, headerSize+tagSize+len(b))
+	if c.server {
+		c.mu.Lock()
+		seq := c.seqs[peer]
+		c.mu.Unlock()
+		msg[0] = typeEchoReply
+		binary.BigEndian.PutUint16(msg[6:8], seq)
+		copy(msg[headerSize:], tagReply[:])
+	} else {
+		msg[0] = typeEchoRequest
+		binary.BigEndian.PutUint16(msg[6:8], uint16(c.seq.Add(1)))
+		copy(msg[headerSize:], tagRequest[:])
+	}
+	binary.BigEndian.PutUint16(msg[4:6], peer.ID)
+	copy(msg[headerSize+tagSize:], b)
+	binary.BigEndian.PutUint16(msg[2:4], checksum(msg))
+	if _, err := c.pc.WriteTo(msg, &net.IPAddr{IP: peer.IP.AsSlice()}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// LocalAddr returns the raw socket's address.
+func (c *Conn) LocalAddr() net.Addr { return c.pc.LocalAddr() }
+
+// Close closes the socket.
+func (c *Conn) Close() error { return c.pc.Close() }
+
+// checksum is the Internet checksum (RFC 1071) of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
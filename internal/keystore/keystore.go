@@ -0,0 +1,41 @@
+// Package keystore seals secrets to the local machine with the platform's
+// key store, so a copy of the config file is useless elsewhere.
+//
+// On Windows the store is DPAPI in machine scope. The secret is encrypted
+// at rest, but it is neither hardware-backed nor non-exportable: any code
+// running on the machine can unseal it, and Unprotect hands it back in
+// memory. It is not a TPM or CNG key with delegated signing. The protocol
+// authenticates with a shared key rather than a private key, so there is no
+// signing operation the platform could do on its behalf.
+package keystore
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// entropy is mixed into every seal so blobs made for other programs on the
+// same machine do not open as ours.
+var entropy = []byte("govpn keystore v1")
+
+// Protect seals secret to this machine and returns it base64-encoded.
+func Protect(secret []byte) (string, error) {
+	blob, err := protect(secret)
+	if err != nil {
+		return "", fmt.Errorf("keystore: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(blob), nil
+}
+
+// Unprotect opens a secret sealed by Protect on this machine.
+func Unprotect(sealed string) ([]byte, error) {
+	blob, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: %w", err)
+	}
+	secret, err := unprotect(blob)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: %w", err)
+	}
+	return secret, nil
+}
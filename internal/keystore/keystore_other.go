@@ -0,0 +1,16 @@
+//go:build !windows
+
+package keystore
+
+import (
+	"errors"
+	"fmt"
+)
+
+func protect([]byte) ([]byte, error) {
+	return nil, fmt.Errorf("no platform key store: %w", errors.ErrUnsupported)
+}
+
+func unprotect([]byte) ([]byte, error) {
+	return nil, fmt.Errorf("no platform key store: %w", errors.ErrUnsupported)
+}
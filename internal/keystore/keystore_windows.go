@@ -0,0 +1,42 @@
+package keystore
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// flags seal to the machine rather than the user, since the client usually
+// runs as a service under another account than the one that sealed the key.
+const flags = windows.CRYPTPROTECT_UI_FORBIDDEN | windows.CRYPTPROTECT_LOCAL_MACHINE
+
+// protect seals data with DPAPI, whose master keys are held by LSA. The
+// sealed data itself is opened in this process, not in hardware.
+func protect(data []byte) ([]byte, error) {
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(blob(data), nil, blob(entropy), 0, nil, flags, &out); err != nil {
+		return nil, err
+	}
+	return take(&out), nil
+}
+
+func unprotect(data []byte) ([]byte, error) {
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(blob(data), nil, blob(entropy), 0, nil, flags, &out); err != nil {
+		return nil, err
+	}
+	return take(&out), nil
+}
+
+func blob(b []byte) *windows.DataBlob {
+	if len(b) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(b)), Data: &b[0]}
+}
+
+// take copies out's data into Go memory and frees it.
+func take(out *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	return append([]byte(nil), unsafe.Slice(out.Data, out.Size)...)
+}
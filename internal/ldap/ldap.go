@@ -0,0 +1,449 @@
+// Package ldap is a small LDAPv3 client, as described in RFC 4511: enough
+// to check a password with a simple bind and read a user's groups.
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Result codes.
+const (
+	ResultSuccess            = 0
+	ResultInvalidCredentials = 49
+)
+
+// Search scopes.
+const (
+	ScopeBase    = 0
+	ScopeSubtree = 2
+)
+
+// maxMessage bounds a message read from the server; a user in thousands of
+// groups still fits.
+const maxMessage = 8 << 20
+
+// startTLSOID names the StartTLS extended operation.
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// Error is a result other than success.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ldap: result %d", e.Code)
+	}
+	return fmt.Sprintf("ldap: result %d: %s", e.Code, e.Message)
+}
+
+// IsInvalidCredentials reports whether err is a bind refused for a wrong
+// name or password.
+func IsInvalidCredentials(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == ResultInvalidCredentials
+}
+
+// Entry is one search result.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the values of attr, whose name is matched without regard to
+// case.
+func (e *Entry) Get(attr string) []string {
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, attr) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Filter is an encoded search filter.
+type Filter []byte
+
+// Equal matches entries whose attr has value. The value is sent as is, so
+// it needs no escaping.
+func Equal(attr, value string) Filter {
+	return Filter(element(0xa3, octets(attr), octets(value)))
+}
+
+// Present matches entries that have attr.
+func Present(attr string) Filter {
+	return Filter(element(0x87, []byte(attr)))
+}
+
+// Conn is a connection to a server. It is not safe for concurrent use.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	id   int32
+}
+
+// Dial connects to rawURL, ldap://host[:389] or ldaps://host[:636]. cfg
+// configures TLS for ldaps; its ServerName defaults to the URL's host. The
+// connection gives up when ctx's deadline passes.
+func Dial(ctx context.Context, rawURL string, cfg *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	port := ""
+	switch u.Scheme {
+	case "ldap":
+		port = "389"
+	case "ldaps":
+		port = "636"
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	c := &Conn{conn: conn, r: bufio.NewReader(conn)}
+	if u.Scheme == "ldaps" {
+		if err := c.upgrade(ctx, u.Hostname(), cfg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// StartTLS switches an ldap:// connection to TLS. host is checked against
+// the server's certificate unless cfg sets ServerName.
+func (c *Conn) StartTLS(ctx context.Context, host string, cfg *tls.Config) error {
+	id, err := c.send(element(0x77, element(0x80, []byte(startTLSOID))))
+	if err != nil {
+		return err
+	}
+	op, err := c.response(id, 0x78)
+	if err != nil {
+		return err
+	}
+	if err := result(op); err != nil {
+		return err
+	}
+	return c.upgrade(ctx, host, cfg)
+}
+
+func (c *Conn) upgrade(ctx context.Context, host string, cfg *tls.Config) error {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	tc := tls.Client(c.conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("ldap: %w", err)
+	}
+	c.conn, c.r = tc, bufio.NewReader(tc)
+	return nil
+}
+
+// Bind authenticates as dn with password. An empty password is refused
+// here, since servers take it as an anonymous bind that always succeeds.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return &Error{Code: ResultInvalidCredentials, Message: "empty password"}
+	}
+	id, err := c.send(element(0x60, integer(3), octets(dn), element(0x80, []byte(password))))
+	if err != nil {
+		return err
+	}
+	op, err := c.response(id, 0x61)
+	if err != nil {
+		return err
+	}
+	return result(op)
+}
+
+// Search returns the entries under base, within scope, that match filter,
+// with the attributes attrs.
+func (c *Conn) Search(base string, scope int, filter Filter, attrs []string) ([]Entry, error) {
+	var list []byte
+	for _, a := range attrs {
+		list = append(list, octets(a)...)
+	}
+	id, err := c.send(element(0x63,
+		octets(base),
+		enumerated(scope),
+		enumerated(0), // never dereference aliases
+		integer(0),    // no size limit
+		integer(0),    // no time limit
+		[]byte{0x01, 0x01, 0x00},
+		filter,
+		element(0x30, list),
+	))
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for {
+		msgID, op, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if msgID != id {
+			continue
+		}
+		switch op.tag {
+		case 0x64:
+			e, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case 0x65:
+			if err := result(op); err != nil {
+				return nil, err
+			}
+			return entries, nil
+		}
+		// Referrals (0x73) are not followed.
+	}
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	c.send([]byte{0x42, 0x00})
+	return c.conn.Close()
+}
+
+func (c *Conn) send(op []byte) (int32, error) {
+	c.id++
+	if _, err := c.conn.Write(element(0x30, integer(int(c.id)), op)); err != nil {
+		return 0, fmt.Errorf("ldap: %w", err)
+	}
+	return c.id, nil
+}
+
+// response reads until the answer to request id, which must have tag.
+func (c *Conn) response(id int32, tag byte) (tlv, error) {
+	for {
+		msgID, op, err := c.read()
+		if err != nil {
+			return tlv{}, err
+		}
+		if msgID != id {
+			continue
+		}
+		if op.tag != tag {
+			return tlv{}, fmt.Errorf("ldap: unexpected response 0x%02x", op.tag)
+		}
+		return op, nil
+	}
+}
+
+// read returns the next message's ID and operation.
+func (c *Conn) read() (int32, tlv, error) {
+	msg, err := readTLV(c.r)
+	if err != nil {
+		return 0, tlv{}, fmt.Errorf("ldap: %w", err)
+	}
+	parts, err := msg.children()
+	if err != nil || msg.tag != 0x30 || len(parts) < 2 || parts[0].tag != 0x02 {
+		return 0, tlv{}, errors.New("ldap: malformed message")
+	}
+	id := int32(parseInt(parts[0].data))
+	if id == 0 {
+		// An unsolicited notice, such as the server disconnecting.
+		if err := result(parts[1]); err != nil {
+			return 0, tlv{}, err
+		}
+		return 0, tlv{}, errors.New("ldap: server disconnected")
+	}
+	return id, parts[1], nil
+}
+
+// result turns an LDAPResult into an error.
+func result(op tlv) error {
+	parts, err := op.children()
+	if err != nil || len(parts) < 3 {
+		return errors.New("ldap: malformed result")
+	}
+	code := int(parseInt(parts[0].data))
+	if code == ResultSuccess {
+		return nil
+	}
+	return &Error{Code: code, Message: string(parts[2].data)}
+}
+
+func parseEntry(op tlv) (Entry, error) {
+	parts, err := op.children()
+	if err != nil || len(parts) < 2 {
+		return Entry{}, errors.New("ldap: malformed entry")
+	}
+	e := Entry{DN: string(parts[0].data), Attributes: make(map[string][]string)}
+	attrs, err := parts[1].children()
+	if err != nil {
+		return Entry{}, errors.New("ldap: malformed entry")
+	}
+	for _, a := range attrs {
+		kv, err := a.children()
+		if err != nil || len(kv) < 2 {
+			return Entry{}, errors.New("ldap: malformed attribute")
+		}
+		vals, err := kv[1].children()
+		if err != nil {
+			return Entry{}, errors.New("ldap: malformed attribute")
+		}
+		name := string(kv[0].data)
+		for _, v := range vals {
+			e.Attributes[name] = append(e.Attributes[name], string(v.data))
+		}
+	}
+	return e, nil
+}
+
+// EscapeDN escapes s for use as an attribute value in a DN, as in RFC 4514.
+func EscapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == 0:
+			b.WriteString(`\00`)
+			continue
+		case strings.IndexByte(`,+"\<>;=`, ch) >= 0,
+			i == 0 && (ch == ' ' || ch == '#'),
+			i == len(s)-1 && ch == ' ':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(ch)
+	}
+	return b.String()
+}
+
+// tlv is one BER element. LDAP uses only single-byte tags.
+type tlv struct {
+	tag  byte
+	data []byte
+}
+
+func (t tlv) children() ([]tlv, error) {
+	var out []tlv
+	r := bufio.NewReader(bytes.NewReader(t.data))
+	for {
+		c, err := readTLV(r)
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+}
+
+func readTLV(r *bufio.Reader) (tlv, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return tlv{}, err
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return tlv{}, io.ErrUnexpectedEOF
+	}
+	n := int(b)
+	if b&0x80 != 0 {
+		size := int(b & 0x7f)
+		if size == 0 || size > 4 {
+			return tlv{}, errors.New("unsupported length")
+		}
+		n = 0
+		for range size {
+			b, err := r.ReadByte()
+			if err != nil {
+				return tlv{}, io.ErrUnexpectedEOF
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > maxMessage {
+		return tlv{}, errors.New("message too large")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return tlv{}, io.ErrUnexpectedEOF
+	}
+	return tlv{tag: tag, data: data}, nil
+}
+
+func parseInt(b []byte) int64 {
+	var v int64
+	for i, x := range b {
+		if i == 0 && x&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(x)
+	}
+	return v
+}
+
+func lengthOf(n int, data []byte) []byte {
+	var out []byte
+	switch {
+	case n < 0x80:
+		out = []byte{byte(n)}
+	case n < 0x100:
+		out = []byte{0x81, byte(n)}
+	case n < 0x10000:
+		out = []byte{0x82, byte(n >> 8), byte(n)}
+	default:
+		out = []byte{0x84, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	return append(out, data...)
+}
+
+func element(tag byte, parts ...[]byte) []byte {
+	var body []byte
+	for _, p := range parts {
+		body = append(body, p...)
+	}
+	return append([]byte{tag}, lengthOf(len(body), body)...)
+}
+
+func octets(s string) []byte {
+	return append([]byte{0x04}, lengthOf(len(s), []byte(s))...)
+}
+
+// integer encodes a non-negative v in as few bytes as it takes.
+func integer(v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return append([]byte{0x02}, lengthOf(len(b), b)...)
+}
+
+func enumerated(v int) []byte {
+	b := integer(v)
+	b[0] = 0x0a
+	return b
+}
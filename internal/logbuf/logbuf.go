@@ -0,0 +1,89 @@
+// Package logbuf keeps the most recent log lines in memory, so they can be
+// served over the management API without knowing where the log file is.
+package logbuf
+
+import (
+	"strings"
+	"sync"
+)
+
+// DefaultSize is how many lines a Buffer keeps by default.
+const DefaultSize = 1000
+
+// Entry is one log line. Seq numbers lines from 1 in the order written.
+type Entry struct {
+	Seq  uint64 `json:"seq"`
+	Text string `json:"text"`
+}
+
+// Buffer is an io.Writer keeping the last lines written to it, safe for
+// concurrent use.
+type Buffer struct {
+	mu      sync.Mutex
+	buf     []Entry
+	next    int
+	full    bool
+	seq     uint64
+	changed chan struct{} // closed and replaced on every write
+}
+
+// NewBuffer returns a Buffer holding at most size lines.
+func NewBuffer(size int) *Buffer {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	return &Buffer{buf: make([]Entry, size), changed: make(chan struct{})}
+}
+
+// Write adds each line of p, as written by the log package.
+func (b *Buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		b.seq++
+		b.buf[b.next] = Entry{Seq: b.seq, Text: line}
+		b.next = (b.next + 1) % len(b.buf)
+		if b.next == 0 {
+			b.full = true
+		}
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+	return len(p), nil
+}
+
+// Since returns the lines after seq still held, oldest first, the Seq of
+// the newest line to pass to the next call, and a channel closed at the
+// next write.
+func (b *Buffer) Since(seq uint64) ([]Entry, uint64, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sinceLocked(seq), b.seq, b.changed
+}
+
+// Last is Since for the newest n lines.
+func (b *Buffer) Last(n int) ([]Entry, uint64, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var seq uint64
+	if uint64(n) < b.seq {
+		seq = b.seq - uint64(n)
+	}
+	return b.sinceLocked(seq), b.seq, b.changed
+}
+
+func (b *Buffer) sinceLocked(seq uint64) []Entry {
+	var ordered []Entry
+	if b.full {
+		ordered = append(ordered, b.buf[b.next:]...)
+	}
+	ordered = append(ordered, b.buf[:b.next]...)
+
+	out := make([]Entry, 0, len(ordered))
+	for _, e := range ordered {
+		if e.Seq > seq {
+			out = append(out, e)
+		}
+	}
+	return out
+}
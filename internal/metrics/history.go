@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultResolution is the interval between history samples.
+	DefaultResolution = time.Minute
+	// DefaultSize keeps 24 hours of samples at DefaultResolution.
+	DefaultSize = 24 * 60
+)
+
+// Sample is one point of history. Byte and packet counts are totals for the
+// interval ending at Time; Clients is the count at that instant.
+type Sample struct {
+	Time       time.Time `json:"time"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+	PacketsIn  uint64    `json:"packets_in"`
+	PacketsOut uint64    `json:"packets_out"`
+	Clients    int       `json:"clients"`
+	Recovered  uint64    `json:"fec_recovered,omitempty"`
+}
+
+// Snapshot is a reading of cumulative counters.
+type Snapshot struct {
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
+	Clients    int
+	Recovered  uint64 // packets rebuilt by forward error correction
+}
+
+// History is a fixed-size ring buffer of samples, safe for concurrent use.
+type History struct {
+	mu   sync.RWMutex
+	buf  []Sample
+	next int
+	full bool
+}
+
+// NewHistory returns a History holding at most size samples.
+func NewHistory(size int) *History {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	return &History{buf: make([]Sample, size)}
+}
+
+// Add appends s, overwriting the oldest sample once the buffer is full.
+func (h *History) Add(s Sample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf[h.next] = s
+	h.next = (h.next + 1) % len(h.buf)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Samples returns the samples taken after since, oldest first. A zero since
+// returns everything.
+func (h *History) Samples(since time.Time) []Sample {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var ordered []Sample
+	if h.full {
+		ordered = append(ordered, h.buf[h.next:]...)
+	}
+	ordered = append(ordered, h.buf[:h.next]...)
+
+	out := make([]Sample, 0, len(ordered))
+	for _, s := range ordered {
+		if s.Time.After(since) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Sampler turns periodic readings of cumulative counters into History
+// samples.
+type Sampler struct {
+	History    *History
+	Resolution time.Duration
+	Read       func() Snapshot
+}
+
+// Run samples every Resolution until ctx is cancelled.
+func (s *Sampler) Run(ctx context.Context) {
+	res := s.Resolution
+	if res <= 0 {
+		res = DefaultResolution
+	}
+	ticker := time.NewTicker(res)
+	defer ticker.Stop()
+
+	last := s.Read()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			cur := s.Read()
+			s.History.Add(Sample{
+				Time:       now,
+				BytesIn:    delta(cur.BytesIn, last.BytesIn),
+				BytesOut:   delta(cur.BytesOut, last.BytesOut),
+				PacketsIn:  delta(cur.PacketsIn, last.PacketsIn),
+				PacketsOut: delta(cur.PacketsOut, last.PacketsOut),
+				Clients:    cur.Clients,
+				Recovered:  delta(cur.Recovered, last.Recovered),
+			})
+			last = cur
+		}
+	}
+}
+
+func delta(cur, last uint64) uint64 {
+	if cur < last {
+		return cur
+	}
+	return cur - last
+}
@@ -0,0 +1,320 @@
+// Package mmdb reads MaxMind DB files, the format of the GeoLite2 and
+// GeoIP2 country, city, and ASN databases, as described at
+// https://maxmind.github.io/MaxMind-DB/. Records are decoded into maps,
+// slices, strings, numbers, and booleans.
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// metadataMarker starts the metadata at the end of the file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	// metadataSearch is how far from the end the marker may be.
+	metadataSearch = 128 << 10
+	// dataSeparator is the zeros between the search tree and the data.
+	dataSeparator = 16
+	// maxDepth bounds nesting and pointer chains in corrupt files.
+	maxDepth = 64
+)
+
+// Data types.
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEnd       = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+var errCorrupt = errors.New("mmdb: corrupt database")
+
+// Metadata describes a database.
+type Metadata struct {
+	DatabaseType string    // such as GeoLite2-Country or GeoLite2-ASN
+	IPVersion    int       // 4 or 6
+	Built        time.Time // when the database was built
+	NodeCount    uint
+	RecordSize   uint
+}
+
+// Reader looks addresses up in a database held in memory. It is safe for
+// concurrent use.
+type Reader struct {
+	Metadata Metadata
+
+	tree      []byte
+	data      decoder
+	ipv4Start uint
+}
+
+// Open reads the database at path.
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := New(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// New reads a database from buf, which it keeps.
+func New(buf []byte) (*Reader, error) {
+	search := buf[max(0, len(buf)-metadataSearch):]
+	i := bytes.LastIndex(search, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("mmdb: not a MaxMind DB file")
+	}
+	metaStart := len(buf) - len(search) + i
+	meta := decoder{buf[metaStart+len(metadataMarker):]}
+	v, _, err := meta.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: metadata: %w", err)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("mmdb: metadata: %w", errCorrupt)
+	}
+	if major, _ := m["binary_format_major_version"].(uint64); major != 2 {
+		return nil, fmt.Errorf("mmdb: unsupported format version %d", major)
+	}
+	r := &Reader{}
+	nodes, _ := m["node_count"].(uint64)
+	size, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+	epoch, _ := m["build_epoch"].(uint64)
+	r.Metadata.DatabaseType, _ = m["database_type"].(string)
+	r.Metadata.NodeCount = uint(nodes)
+	r.Metadata.RecordSize = uint(size)
+	r.Metadata.IPVersion = int(ipVersion)
+	r.Metadata.Built = time.Unix(int64(epoch), 0).UTC()
+	if size != 24 && size != 28 && size != 32 {
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", size)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("mmdb: unsupported IP version %d", ipVersion)
+	}
+	treeSize := nodes * size / 4
+	if treeSize+dataSeparator > uint64(metaStart) {
+		return nil, errCorrupt
+	}
+	r.tree = buf[:treeSize]
+	r.data = decoder{buf[treeSize+dataSeparator : metaStart]}
+	if ipVersion == 6 {
+		for i := 0; i < 96 && r.ipv4Start < r.Metadata.NodeCount; i++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// Lookup returns the record for addr, or nil if the database has none.
+func (r *Reader) Lookup(addr netip.Addr) (any, error) {
+	addr = addr.Unmap()
+	node, bits := uint(0), 128
+	switch {
+	case addr.Is4() && r.Metadata.IPVersion == 6:
+		node, bits = r.ipv4Start, 32
+	case addr.Is4():
+		bits = 32
+	case r.Metadata.IPVersion == 4:
+		return nil, nil
+	}
+	ip := addr.AsSlice()
+	nodes := r.Metadata.NodeCount
+	for i := 0; i < bits && node < nodes; i++ {
+		node = r.record(node, uint(ip[i>>3]>>(7-i&7))&1)
+	}
+	switch {
+	case node == nodes:
+		return nil, nil
+	case node < nodes:
+		return nil, errCorrupt
+	}
+	off := node - nodes - dataSeparator
+	v, _, err := r.data.decode(off, 0)
+	return v, err
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *Reader) record(node, bit uint) uint {
+	switch r.Metadata.RecordSize {
+	case 24:
+		o := node*6 + bit*3
+		return uint(r.tree[o])<<16 | uint(r.tree[o+1])<<8 | uint(r.tree[o+2])
+	case 28:
+		o := node * 7
+		if bit == 0 {
+			return uint(r.tree[o+3]&0xf0)<<20 | uint(r.tree[o])<<16 | uint(r.tree[o+1])<<8 | uint(r.tree[o+2])
+		}
+		return uint(r.tree[o+3]&0x0f)<<24 | uint(r.tree[o+4])<<16 | uint(r.tree[o+5])<<8 | uint(r.tree[o+6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+bit*4:]))
+	}
+}
+
+// decoder reads values from a data section, which pointers are relative
+// to.
+type decoder struct {
+	buf []byte
+}
+
+// decode returns the value at off and the offset after it.
+func (d decoder) decode(off uint, depth int) (any, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errCorrupt
+	}
+	b, off, err := d.bytes(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	typ := uint(ctrl >> 5)
+	if typ == typePointer {
+		ptr, next, err := d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, next, err
+	}
+	if typ == typeExtended {
+		if b, off, err = d.bytes(off, 1); err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if b, off, err = d.bytes(off, n); err != nil {
+			return nil, 0, err
+		}
+		size = [...]uint{29, 285, 65821}[n-1] + uint(beUint(b))
+	}
+	switch typ {
+	case typeMap:
+		m := make(map[string]any, min(size, 64))
+		for range size {
+			k, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errCorrupt
+			}
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], off = v, next
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]any, 0, min(size, 64))
+		for range size {
+			v, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, off = append(a, v), next
+		}
+		return a, off, nil
+	case typeBool:
+		if size > 1 {
+			return nil, 0, errCorrupt
+		}
+		return size == 1, off, nil
+	}
+	if b, off, err = d.bytes(off, size); err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case typeString:
+		return string(b), off, nil
+	case typeBytes:
+		return append([]byte(nil), b...), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > [...]uint{typeUint16: 2, typeUint32: 4, typeUint64: 8}[typ] {
+			return nil, 0, errCorrupt
+		}
+		return beUint(b), off, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errCorrupt
+		}
+		return int64(int32(beUint(b)<<(32-8*size))) >> (32 - 8*size), off, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, errCorrupt
+		}
+		return new(big.Int).SetBytes(b), off, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unexpected data type %d: %w", typ, errCorrupt)
+}
+
+// pointer decodes the pointer whose control byte was ctrl and whose
+// remaining bytes start at off.
+func (d decoder) pointer(ctrl byte, off uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&0x03 + 1
+	b, next, err := d.bytes(off, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	v := uint(beUint(b))
+	if n < 4 {
+		v |= uint(ctrl&0x07) << (8 * n)
+	}
+	return v + [...]uint{0, 2048, 526336, 0}[n-1], next, nil
+}
+
+// bytes returns the n bytes at off and the offset after them.
+func (d decoder) bytes(off, n uint) ([]byte, uint, error) {
+	if off > uint(len(d.buf)) || n > uint(len(d.buf))-off {
+		return nil, 0, errCorrupt
+	}
+	return d.buf[off : off+n], off + n, nil
+}
+
+func beUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
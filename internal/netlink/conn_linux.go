@@ -0,0 +1,209 @@
+package netlink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Conn is a netlink socket.
+type Conn struct {
+	fd  int
+	seq uint32
+}
+
+// message is a netlink request before its header is filled in.
+type message struct {
+	typ   uint16
+	flags uint16
+	data  []byte
+}
+
+// NamespacePath is where ip netns keeps the named network namespace.
+func NamespacePath(netns string) string {
+	return filepath.Join("/run/netns", netns)
+}
+
+func dial(proto int) (*Conn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("netlink bind: %w", err)
+	}
+	return &Conn{fd: fd}, nil
+}
+
+// Open opens an rtnetlink connection inside the named network namespace,
+// or in the current one when netns is empty. The socket stays in that
+// namespace for its lifetime.
+func Open(netns string) (*Conn, error) {
+	if netns == "" {
+		return dial(unix.NETLINK_ROUTE)
+	}
+	var c *Conn
+	err := inNamespace(netns, func() error {
+		var err error
+		c, err = dial(unix.NETLINK_ROUTE)
+		return err
+	})
+	return c, err
+}
+
+// inNamespace runs f on a thread switched into netns.
+func inNamespace(netns string, f func() error) error {
+	runtime.LockOSThread()
+	orig, err := unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("netns: %w", err)
+	}
+	defer unix.Close(orig)
+	target, err := unix.Open(NamespacePath(netns), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("netns %s: %w", netns, err)
+	}
+	defer unix.Close(target)
+	if err := unix.Setns(target, unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("netns %s: %w", netns, err)
+	}
+	ferr := f()
+	if err := unix.Setns(orig, unix.CLONE_NEWNET); err != nil {
+		// The thread stays locked, so it exits with this goroutine
+		// instead of running others in the wrong namespace.
+		return fmt.Errorf("netns %s: switch back: %w", netns, err)
+	}
+	runtime.UnlockOSThread()
+	return ferr
+}
+
+// Close closes the socket.
+func (c *Conn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// execute sends msgs in one datagram and waits for every ack requested, or
+// for the end of a dump. It returns the payloads of the other replies.
+func (c *Conn) execute(msgs ...message) ([][]byte, error) {
+	var buf []byte
+	first := c.seq + 1
+	acks, dump := 0, false
+	for _, m := range msgs {
+		c.seq++
+		var h [unix.NLMSG_HDRLEN]byte
+		binary.NativeEndian.PutUint32(h[0:], uint32(unix.NLMSG_HDRLEN+len(m.data)))
+		binary.NativeEndian.PutUint16(h[4:], m.typ)
+		binary.NativeEndian.PutUint16(h[6:], m.flags)
+		binary.NativeEndian.PutUint32(h[8:], c.seq)
+		buf = append(buf, h[:]...)
+		buf = pad(append(buf, m.data...))
+		if m.flags&unix.NLM_F_ACK != 0 {
+			acks++
+		}
+		if m.flags&unix.NLM_F_DUMP == unix.NLM_F_DUMP {
+			dump = true
+		}
+	}
+	if err := unix.Sendto(c.fd, buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("netlink send: %w", err)
+	}
+
+	var replies [][]byte
+	rb := make([]byte, 1<<16)
+	for acks > 0 || dump {
+		n, _, err := unix.Recvfrom(c.fd, rb, 0)
+		if err != nil {
+			return nil, fmt.Errorf("netlink receive: %w", err)
+		}
+		parsed, err := syscall.ParseNetlinkMessage(rb[:n])
+		if err != nil {
+			return nil, fmt.Errorf("netlink receive: %w", err)
+		}
+		for _, m := range parsed {
+			if m.Header.Seq < first || m.Header.Seq > c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				dump = false
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, fmt.Errorf("netlink: short error message")
+				}
+				if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				acks--
+			default:
+				// The next read reuses rb.
+				replies = append(replies, bytes.Clone(m.Data))
+			}
+		}
+	}
+	return replies, nil
+}
+
+// attrs builds netlink attributes.
+type attrs []byte
+
+func (a *attrs) add(typ uint16, data []byte) {
+	var h [4]byte
+	binary.NativeEndian.PutUint16(h[0:], uint16(4+len(data)))
+	binary.NativeEndian.PutUint16(h[2:], typ)
+	*a = pad(append(append(*a, h[:]...), data...))
+}
+
+func (a *attrs) str(typ uint16, s string) {
+	a.add(typ, append([]byte(s), 0))
+}
+
+func (a *attrs) u32(typ uint16, v uint32) {
+	a.add(typ, binary.NativeEndian.AppendUint32(nil, v))
+}
+
+// be32 adds a value in network byte order, as nf_tables expects.
+func (a *attrs) be32(typ uint16, v uint32) {
+	a.add(typ, binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (a *attrs) nest(typ uint16, f func(*attrs)) {
+	var n attrs
+	f(&n)
+	a.add(typ|unix.NLA_F_NESTED, n)
+}
+
+// parseAttrs indexes the attributes in b by type.
+func parseAttrs(b []byte) map[uint16][]byte {
+	m := make(map[uint16][]byte)
+	for len(b) >= 4 {
+		l := int(binary.NativeEndian.Uint16(b[0:]))
+		typ := binary.NativeEndian.Uint16(b[2:]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		if l < 4 || l > len(b) {
+			break
+		}
+		m[typ] = b[4:l]
+		l = (l + 3) &^ 3
+		if l > len(b) {
+			break
+		}
+		b = b[l:]
+	}
+	return m
+}
+
+// pad aligns b to the 4 bytes netlink messages and attributes keep to.
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,4 @@
+// Package netlink speaks just enough rtnetlink and nf_tables to address
+// and route interfaces, and to add NAT and firewall rules, on Linux,
+// without running ip or nft.
+package netlink
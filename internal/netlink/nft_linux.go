@@ -0,0 +1,231 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Verdicts and comparisons nf_tables takes that x/sys does not name.
+const (
+	nfAccept  = 1
+	nftCmpNeq = 1
+)
+
+// nftMessage is an nf_tables request for a table of family.
+func nftMessage(typ uint16, flags uint16, family uint8, a attrs) message {
+	gen := []byte{family, unix.NFNETLINK_V0, 0, 0}
+	return message{typ: unix.NFNL_SUBSYS_NFTABLES<<8 | typ, flags: flags, data: append(gen, a...)}
+}
+
+// nftBatch applies msgs as one nf_tables transaction, all or nothing.
+func nftBatch(msgs ...message) error {
+	c, err := dial(unix.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	gen := []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, unix.NFNL_SUBSYS_NFTABLES}
+	batch := []message{{typ: unix.NFNL_MSG_BATCH_BEGIN, flags: unix.NLM_F_REQUEST, data: gen}}
+	batch = append(batch, msgs...)
+	batch = append(batch, message{typ: unix.NFNL_MSG_BATCH_END, flags: unix.NLM_F_REQUEST, data: gen})
+	_, err = c.execute(batch...)
+	return err
+}
+
+const create = unix.NLM_F_REQUEST | unix.NLM_F_ACK | unix.NLM_F_CREATE
+
+// newTable, newChain and newRule build the messages of an nf_tables
+// transaction.
+func newTable(family uint8, table string) message {
+	var a attrs
+	a.str(unix.NFTA_TABLE_NAME, table)
+	a.be32(unix.NFTA_TABLE_FLAGS, 0)
+	return nftMessage(unix.NFT_MSG_NEWTABLE, create, family, a)
+}
+
+func newChain(family uint8, table, chain, kind string, hook uint32, priority int32) message {
+	var a attrs
+	a.str(unix.NFTA_CHAIN_TABLE, table)
+	a.str(unix.NFTA_CHAIN_NAME, chain)
+	a.nest(unix.NFTA_CHAIN_HOOK, func(h *attrs) {
+		h.be32(unix.NFTA_HOOK_HOOKNUM, hook)
+		h.be32(unix.NFTA_HOOK_PRIORITY, uint32(priority))
+	})
+	a.be32(unix.NFTA_CHAIN_POLICY, nfAccept)
+	a.str(unix.NFTA_CHAIN_TYPE, kind)
+	return nftMessage(unix.NFT_MSG_NEWCHAIN, create, family, a)
+}
+
+func newRule(family uint8, table, chain string, exprs ...attrs) message {
+	var a attrs
+	a.str(unix.NFTA_RULE_TABLE, table)
+	a.str(unix.NFTA_RULE_CHAIN, chain)
+	a.nest(unix.NFTA_RULE_EXPRESSIONS, func(l *attrs) {
+		for _, e := range exprs {
+			l.add(unix.NFTA_LIST_ELEM|unix.NLA_F_NESTED, e)
+		}
+	})
+	return nftMessage(unix.NFT_MSG_NEWRULE, create|unix.NLM_F_APPEND, family, a)
+}
+
+// expr builds an nf_tables expression called name.
+func expr(name string, data func(*attrs)) attrs {
+	var a attrs
+	a.str(unix.NFTA_EXPR_NAME, name)
+	if data != nil {
+		a.nest(unix.NFTA_EXPR_DATA, data)
+	}
+	return a
+}
+
+// loadPayload loads n bytes at offset of the header base into register 1.
+func loadPayload(base, offset, n uint32) attrs {
+	return expr("payload", func(a *attrs) {
+		a.be32(unix.NFTA_PAYLOAD_DREG, unix.NFT_REG_1)
+		a.be32(unix.NFTA_PAYLOAD_BASE, base)
+		a.be32(unix.NFTA_PAYLOAD_OFFSET, offset)
+		a.be32(unix.NFTA_PAYLOAD_LEN, n)
+	})
+}
+
+// loadMeta loads the packet's meta key into register 1.
+func loadMeta(key uint32) attrs {
+	return expr("meta", func(a *attrs) {
+		a.be32(unix.NFTA_META_DREG, unix.NFT_REG_1)
+		a.be32(unix.NFTA_META_KEY, key)
+	})
+}
+
+// mask ands register 1 with m.
+func mask(m []byte) attrs {
+	return expr("bitwise", func(a *attrs) {
+		a.be32(unix.NFTA_BITWISE_SREG, unix.NFT_REG_1)
+		a.be32(unix.NFTA_BITWISE_DREG, unix.NFT_REG_1)
+		a.be32(unix.NFTA_BITWISE_LEN, uint32(len(m)))
+		a.nest(unix.NFTA_BITWISE_MASK, func(d *attrs) { d.add(unix.NFTA_DATA_VALUE, m) })
+		a.nest(unix.NFTA_BITWISE_XOR, func(d *attrs) { d.add(unix.NFTA_DATA_VALUE, make([]byte, len(m))) })
+	})
+}
+
+// compare ends the rule unless register 1 compares to v with op.
+func compare(op uint32, v []byte) attrs {
+	return expr("cmp", func(a *attrs) {
+		a.be32(unix.NFTA_CMP_SREG, unix.NFT_REG_1)
+		a.be32(unix.NFTA_CMP_OP, op)
+		a.nest(unix.NFTA_CMP_DATA, func(d *attrs) { d.add(unix.NFTA_DATA_VALUE, v) })
+	})
+}
+
+// accept accepts the packet.
+func accept() attrs {
+	return expr("immediate", func(a *attrs) {
+		a.be32(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_VERDICT)
+		a.nest(unix.NFTA_IMMEDIATE_DATA, func(d *attrs) {
+			d.nest(unix.NFTA_DATA_VERDICT, func(v *attrs) { v.be32(unix.NFTA_VERDICT_CODE, nfAccept) })
+		})
+	})
+}
+
+// AddMasquerade creates the IPv4 table, holding a rule that masquerades
+// traffic from src leaving for anywhere outside it, like
+//
+//	nft add rule ip table postrouting ip saddr src ip daddr != src masquerade
+func AddMasquerade(table string, src netip.Prefix) error {
+	if !src.Addr().Is4() {
+		return fmt.Errorf("nftables: masquerade %s: only IPv4 is supported", src)
+	}
+	net := src.Masked().Addr().AsSlice()
+	bits := binary.BigEndian.AppendUint32(nil, uint32(uint64(^uint32(0))<<(32-src.Bits())))
+	err := nftBatch(
+		newTable(unix.NFPROTO_IPV4, table),
+		newChain(unix.NFPROTO_IPV4, table, "postrouting", "nat", unix.NF_INET_POST_ROUTING, 100),
+		newRule(unix.NFPROTO_IPV4, table, "postrouting",
+			loadPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 12, 4), mask(bits), compare(unix.NFT_CMP_EQ, net),
+			loadPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 16, 4), mask(bits), compare(nftCmpNeq, net),
+			expr("masq", nil),
+		),
+	)
+	if err != nil {
+		return fmt.Errorf("nftables: masquerade %s: %w", src, err)
+	}
+	return nil
+}
+
+// AllowUDPPort creates the table, holding a rule that accepts UDP to port
+// on input, for IPv4 and IPv6, like
+//
+//	nft add rule inet table input udp dport port accept
+func AllowUDPPort(table string, port uint16) error {
+	err := nftBatch(
+		newTable(unix.NFPROTO_INET, table),
+		newChain(unix.NFPROTO_INET, table, "input", "filter", unix.NF_INET_LOCAL_IN, 0),
+		newRule(unix.NFPROTO_INET, table, "input",
+			loadMeta(unix.NFT_META_L4PROTO), compare(unix.NFT_CMP_EQ, []byte{unix.IPPROTO_UDP}),
+			loadPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, 2, 2), compare(unix.NFT_CMP_EQ, binary.BigEndian.AppendUint16(nil, port)),
+			accept(),
+		),
+	)
+	if err != nil {
+		return fmt.Errorf("nftables: allow udp port %d: %w", port, err)
+	}
+	return nil
+}
+
+// DeleteTable removes the table, of any family, with everything in it. A
+// table that is already gone is not an error.
+func DeleteTable(table string) error {
+	tables, err := Tables(table)
+	if err != nil {
+		return err
+	}
+	var msgs []message
+	for _, t := range tables {
+		if t.Name != table {
+			continue
+		}
+		var a attrs
+		a.str(unix.NFTA_TABLE_NAME, t.Name)
+		msgs = append(msgs, nftMessage(unix.NFT_MSG_DELTABLE, unix.NLM_F_REQUEST|unix.NLM_F_ACK, t.Family, a))
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	if err := nftBatch(msgs...); err != nil {
+		return fmt.Errorf("nftables: delete table %s: %w", table, err)
+	}
+	return nil
+}
+
+// Table is an nf_tables table.
+type Table struct {
+	Family uint8
+	Name   string
+}
+
+// Tables lists the tables whose names start with prefix.
+func Tables(prefix string) ([]Table, error) {
+	c, err := dial(unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	replies, err := c.execute(nftMessage(unix.NFT_MSG_GETTABLE, unix.NLM_F_REQUEST|unix.NLM_F_DUMP, unix.NFPROTO_UNSPEC, nil))
+	if err != nil {
+		return nil, fmt.Errorf("nftables: list tables: %w", err)
+	}
+	var out []Table
+	for _, r := range replies {
+		if len(r) < 4 {
+			continue
+		}
+		name := strings.TrimRight(string(parseAttrs(r[4:])[unix.NFTA_TABLE_NAME]), "\x00")
+		if strings.HasPrefix(name, prefix) {
+			out = append(out, Table{Family: r[0], Name: name})
+		}
+	}
+	return out, nil
+}
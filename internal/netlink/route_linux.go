@@ -0,0 +1,197 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Route is a route in the main table: to Dst, through Gateway when it is
+// set, out of the interface with index Index.
+type Route struct {
+	Dst     netip.Prefix
+	Gateway netip.Addr
+	Index   int
+}
+
+func family(a netip.Addr) uint8 {
+	if a.Is4() {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+// ifInfo is a struct ifinfomsg.
+func ifInfo(index int, flags, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	binary.NativeEndian.PutUint32(b[4:], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:], flags)
+	binary.NativeEndian.PutUint32(b[12:], change)
+	return b
+}
+
+// LinkIndex returns the index of the interface called name.
+func (c *Conn) LinkIndex(name string) (int, error) {
+	var a attrs
+	a.str(unix.IFLA_IFNAME, name)
+	replies, err := c.execute(message{
+		typ:   unix.RTM_GETLINK,
+		flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK,
+		data:  append(ifInfo(0, 0, 0), a...),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("link %s: %w", name, err)
+	}
+	for _, r := range replies {
+		if len(r) >= unix.SizeofIfInfomsg {
+			return int(int32(binary.NativeEndian.Uint32(r[4:]))), nil
+		}
+	}
+	return 0, fmt.Errorf("link %s: not found", name)
+}
+
+// SetLinkUp brings the interface up.
+func (c *Conn) SetLinkUp(index int) error {
+	return c.setLink(index, unix.IFF_UP, nil)
+}
+
+// SetMTU sets the interface's MTU.
+func (c *Conn) SetMTU(index, mtu int) error {
+	var a attrs
+	a.u32(unix.IFLA_MTU, uint32(mtu))
+	return c.setLink(index, 0, a)
+}
+
+// SetLinkNamespace moves the interface into the named network namespace.
+func (c *Conn) SetLinkNamespace(index int, netns string) error {
+	f, err := os.Open(NamespacePath(netns))
+	if err != nil {
+		return fmt.Errorf("netns %s: %w", netns, err)
+	}
+	defer f.Close()
+	var a attrs
+	a.u32(unix.IFLA_NET_NS_FD, uint32(f.Fd()))
+	return c.setLink(index, 0, a)
+}
+
+func (c *Conn) setLink(index int, up uint32, a attrs) error {
+	_, err := c.execute(message{
+		typ:   unix.RTM_NEWLINK,
+		flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK,
+		data:  append(ifInfo(index, up, up), a...),
+	})
+	if err != nil {
+		return fmt.Errorf("link %d: %w", index, err)
+	}
+	return nil
+}
+
+// AddAddress adds prefix's address, with its length, to the interface.
+func (c *Conn) AddAddress(index int, prefix netip.Prefix) error {
+	msg := make([]byte, unix.SizeofIfAddrmsg)
+	msg[0] = family(prefix.Addr())
+	msg[1] = uint8(prefix.Bits())
+	binary.NativeEndian.PutUint32(msg[4:], uint32(index))
+	var a attrs
+	a.add(unix.IFA_LOCAL, prefix.Addr().AsSlice())
+	a.add(unix.IFA_ADDRESS, prefix.Addr().AsSlice())
+	_, err := c.execute(message{
+		typ:   unix.RTM_NEWADDR,
+		flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK | unix.NLM_F_CREATE | unix.NLM_F_EXCL,
+		data:  append(msg, a...),
+	})
+	if err != nil {
+		return fmt.Errorf("address %s: %w", prefix, err)
+	}
+	return nil
+}
+
+// rtMsg is a struct rtmsg for r in the main table.
+func (r Route) rtMsg() []byte {
+	msg := make([]byte, unix.SizeofRtMsg)
+	msg[0] = family(r.Dst.Addr())
+	msg[1] = uint8(r.Dst.Bits())
+	msg[4] = unix.RT_TABLE_MAIN
+	msg[5] = unix.RTPROT_BOOT
+	msg[6] = unix.RT_SCOPE_UNIVERSE
+	if !r.Gateway.IsValid() {
+		msg[6] = unix.RT_SCOPE_LINK
+	}
+	msg[7] = unix.RTN_UNICAST
+	return msg
+}
+
+func (r Route) attrs() attrs {
+	var a attrs
+	if r.Dst.Bits() > 0 {
+		a.add(unix.RTA_DST, r.Dst.Masked().Addr().AsSlice())
+	}
+	if r.Gateway.IsValid() {
+		a.add(unix.RTA_GATEWAY, r.Gateway.AsSlice())
+	}
+	if r.Index != 0 {
+		a.u32(unix.RTA_OIF, uint32(r.Index))
+	}
+	return a
+}
+
+// ReplaceRoute adds r, replacing a route to the same destination.
+func (c *Conn) ReplaceRoute(r Route) error {
+	_, err := c.execute(message{
+		typ:   unix.RTM_NEWROUTE,
+		flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK | unix.NLM_F_CREATE | unix.NLM_F_REPLACE,
+		data:  append(r.rtMsg(), r.attrs()...),
+	})
+	if err != nil {
+		return fmt.Errorf("route %s: %w", r.Dst, err)
+	}
+	return nil
+}
+
+// DeleteRoute removes r.
+func (c *Conn) DeleteRoute(r Route) error {
+	_, err := c.execute(message{
+		typ:   unix.RTM_DELROUTE,
+		flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK,
+		data:  append(r.rtMsg(), r.attrs()...),
+	})
+	if err != nil {
+		return fmt.Errorf("delete route %s: %w", r.Dst, err)
+	}
+	return nil
+}
+
+// RouteTo returns the route the kernel picks for addr now, as a host
+// route.
+func (c *Conn) RouteTo(addr netip.Addr) (Route, error) {
+	q := Route{Dst: netip.PrefixFrom(addr, addr.BitLen())}
+	msg := q.rtMsg()
+	msg[4], msg[5], msg[6], msg[7] = 0, 0, 0, 0
+	var a attrs
+	a.add(unix.RTA_DST, addr.AsSlice())
+	replies, err := c.execute(message{
+		typ:   unix.RTM_GETROUTE,
+		flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK,
+		data:  append(msg, a...),
+	})
+	if err != nil {
+		return Route{}, fmt.Errorf("route to %s: %w", addr, err)
+	}
+	for _, r := range replies {
+		if len(r) < unix.SizeofRtMsg {
+			continue
+		}
+		m := parseAttrs(r[unix.SizeofRtMsg:])
+		if oif, ok := m[unix.RTA_OIF]; ok && len(oif) == 4 {
+			q.Index = int(binary.NativeEndian.Uint32(oif))
+		}
+		if gw, ok := netip.AddrFromSlice(m[unix.RTA_GATEWAY]); ok {
+			q.Gateway = gw
+		}
+		return q, nil
+	}
+	return Route{}, fmt.Errorf("route to %s: no reply", addr)
+}
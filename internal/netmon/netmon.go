@@ -0,0 +1,50 @@
+// Package netmon reports changes to the host's network configuration, such
+// as an interface going down or a new address from another Wi-Fi network,
+// so a client can move its socket at once rather than wait for timeouts.
+package netmon
+
+import (
+	"context"
+	"time"
+)
+
+// debounce coalesces the burst of notifications one change produces.
+const debounce = 500 * time.Millisecond
+
+// Watch calls fn after the network configuration changes, until ctx is
+// done. Notifications arriving close together produce one call. It returns
+// once the platform subscription is in place, or an error wrapping
+// errors.ErrUnsupported where there is none.
+func Watch(ctx context.Context, fn func()) error {
+	events := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+	}
+	if err := subscribe(ctx, notify); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-events:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(debounce):
+			}
+			// Drop anything that arrived during the debounce.
+			select {
+			case <-events:
+			default:
+			}
+			fn()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+
+package netmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// subscribe is not implemented on this platform; the client falls back to
+// noticing a dead socket through keepalive timeouts.
+func subscribe(ctx context.Context, notify func()) error {
+	return fmt.Errorf("network change notifications on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
@@ -0,0 +1,33 @@
+package netmon
+
+import (
+	"context"
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+// subscribe registers for interface and unicast address change
+// notifications, the callbacks behind NotifyIpInterfaceChange and
+// NotifyUnicastIpAddressChange.
+func subscribe(ctx context.Context, notify func()) error {
+	ifaces, err := winipcfg.RegisterInterfaceChangeCallback(func(winipcfg.MibNotificationType, *winipcfg.MibIPInterfaceRow) {
+		notify()
+	})
+	if err != nil {
+		return fmt.Errorf("interface change notifications: %w", err)
+	}
+	addrs, err := winipcfg.RegisterUnicastAddressChangeCallback(func(winipcfg.MibNotificationType, *winipcfg.MibUnicastIPAddressRow) {
+		notify()
+	})
+	if err != nil {
+		ifaces.Unregister()
+		return fmt.Errorf("address change notifications: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		ifaces.Unregister()
+		addrs.Unregister()
+	}()
+	return nil
+}
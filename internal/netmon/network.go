@@ -0,0 +1,40 @@
+package netmon
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/portmap"
+)
+
+// Network returns an identifier for the network the host is attached to:
+// the MAC address of its default gateway, which stays the same across
+// DHCP leases and tells apart networks that hand out the same addresses.
+func Network() (string, error) {
+	gw, err := portmap.DefaultGateway()
+	if err != nil {
+		return "", err
+	}
+	mac, err := neighbor(gw)
+	if err != nil {
+		// Nothing has gone through the gateway yet. Send it a datagram,
+		// to the discard port, so the host resolves its address.
+		if conn, err := net.Dial("udp", netip.AddrPortFrom(gw, 9).String()); err == nil {
+			conn.Write([]byte{0})
+			conn.Close()
+		}
+		time.Sleep(100 * time.Millisecond)
+		if mac, err = neighbor(gw); err != nil {
+			return "", err
+		}
+	}
+	return mac.String(), nil
+}
+
+// errNoNeighbor is returned when the host has no link-layer address for a
+// next hop.
+func errNoNeighbor(addr netip.Addr) error {
+	return fmt.Errorf("no link-layer address for %s", addr)
+}
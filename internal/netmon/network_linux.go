@@ -0,0 +1,31 @@
+package netmon
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// neighbor looks addr up in the kernel's ARP table.
+func neighbor(addr netip.Addr) (net.HardwareAddr, error) {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || fields[0] != addr.String() || fields[2] == "0x0" {
+			continue
+		}
+		if mac, err := net.ParseMAC(fields[3]); err == nil {
+			return mac, nil
+		}
+	}
+	return nil, errNoNeighbor(addr)
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !windows
+
+package netmon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+)
+
+// neighbor is not implemented on this platform, where the host's network
+// goes unidentified.
+func neighbor(addr netip.Addr) (net.HardwareAddr, error) {
+	return nil, fmt.Errorf("neighbor table on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
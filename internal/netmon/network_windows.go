@@ -0,0 +1,42 @@
+package netmon
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procGetIpNetTable = windows.NewLazySystemDLL("iphlpapi.dll").NewProc("GetIpNetTable")
+
+// ipNetRowSize is the size of a MIB_IPNETROW: index, address length, an
+// 8-byte physical address, IPv4 address and type.
+const ipNetRowSize = 24
+
+// neighbor looks addr up in the IPv4 neighbor table, through GetIpNetTable.
+func neighbor(addr netip.Addr) (net.HardwareAddr, error) {
+	var size uint32
+	procGetIpNetTable.Call(0, uintptr(unsafe.Pointer(&size)), 0)
+	if size == 0 {
+		return nil, errNoNeighbor(addr)
+	}
+	buf := make([]byte, size)
+	if r, _, _ := procGetIpNetTable.Call(uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0); r != 0 {
+		return nil, windows.Errno(r)
+	}
+	n := int(binary.LittleEndian.Uint32(buf))
+	want := addr.As4()
+	for i := 0; i < n && 4+(i+1)*ipNetRowSize <= len(buf); i++ {
+		row := buf[4+i*ipNetRowSize:]
+		length := binary.LittleEndian.Uint32(row[4:])
+		kind := binary.LittleEndian.Uint32(row[20:])
+		// Types 3 and 4 are dynamic and static entries.
+		if [4]byte(row[16:20]) != want || length == 0 || length > 8 || kind < 3 {
+			continue
+		}
+		return net.HardwareAddr(append([]byte(nil), row[8:8+length]...)), nil
+	}
+	return nil, errNoNeighbor(addr)
+}
@@ -0,0 +1,60 @@
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// DialContext connects to address through the tunnel, with the signature
+// of net.Dialer.DialContext. network is tcp or udp; names in address are
+// looked up with Resolver.
+func (s *Stack) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort(network, portStr)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		addrs, err := s.Resolver().LookupNetIP(ctx, "ip4", host)
+		if err != nil {
+			return nil, err
+		}
+		addr = addrs[0]
+	}
+	if addr = addr.Unmap(); !addr.Is4() {
+		return nil, fmt.Errorf("dial %s: netstack only supports IPv4", address)
+	}
+	remote := netip.AddrPortFrom(addr, uint16(port))
+	switch network {
+	case "tcp", "tcp4":
+		return s.DialTCP(ctx, remote)
+	case "udp", "udp4":
+		return s.DialUDP(remote)
+	}
+	return nil, net.UnknownNetworkError(network)
+}
+
+// Resolver looks names up with the first DNS server given to Apply,
+// through the tunnel, or with the host's resolver when there is none.
+func (s *Stack) Resolver() *net.Resolver {
+	servers := s.DNSServers()
+	if len(servers) == 0 {
+		return net.DefaultResolver
+	}
+	server := netip.AddrPortFrom(servers[0], 53)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			if network == "tcp" {
+				return s.DialTCP(ctx, server)
+			}
+			return s.DialUDP(server)
+		},
+	}
+}
@@ -0,0 +1,237 @@
+// Package netstack is a small userspace IPv4 network stack: just enough TCP
+// and UDP for a VPN client to open connections across the tunnel without a
+// kernel adapter, and so without root or CAP_NET_ADMIN.
+//
+// It favours simplicity over throughput. There is no window scaling or
+// SACK, so a connection carries at most 64 KiB per round trip, and only the
+// first unacknowledged segment is retransmitted.
+package netstack
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// DefaultMTU is the packet size used until SetMTU says otherwise.
+const DefaultMTU = 1280
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	// outQueue bounds the packets waiting for the tunnel to read them.
+	outQueue = 512
+
+	firstEphemeral = 49152
+)
+
+var errNoAddress = errors.New("netstack: no address yet")
+
+// Stack is a userspace network stack and a tun.Device: packets it sends are
+// read with ReadPacket, and packets from the tunnel are handed to it with
+// WritePacket.
+type Stack struct {
+	out       chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	ipID      atomic.Uint32
+
+	mu       sync.Mutex
+	addr     netip.Addr
+	dns      []netip.Addr
+	mtu      int
+	tcp      map[connKey]*TCPConn
+	udp      map[uint16]*UDPConn
+	nextPort uint16
+}
+
+// connKey identifies a connection by its local port and remote end.
+type connKey struct {
+	local  uint16
+	remote netip.AddrPort
+}
+
+// New returns a Stack using addr as its own address. addr may be invalid
+// for a client still waiting for a leased one; see SetAddress.
+func New(addr netip.Addr) *Stack {
+	return &Stack{
+		out:      make(chan []byte, outQueue),
+		closed:   make(chan struct{}),
+		addr:     addr,
+		mtu:      DefaultMTU,
+		tcp:      make(map[connKey]*TCPConn),
+		udp:      make(map[uint16]*UDPConn),
+		nextPort: firstEphemeral,
+	}
+}
+
+// ReadPacket returns the next packet the stack wants sent to the tunnel.
+func (s *Stack) ReadPacket() ([]byte, error) {
+	select {
+	case pkt := <-s.out:
+		return pkt, nil
+	case <-s.closed:
+		return nil, tun.ErrClosed
+	}
+}
+
+// WritePacket hands the stack a packet that came out of the tunnel.
+func (s *Stack) WritePacket(pkt []byte) error {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return nil
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if ihl < 20 || total < ihl || total > len(pkt) || checksum(pkt[:ihl], 0) != 0 {
+		return nil
+	}
+	if binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0 {
+		return nil // fragments are not reassembled
+	}
+	src := netip.AddrFrom4([4]byte(pkt[12:16]))
+	dst := netip.AddrFrom4([4]byte(pkt[16:20]))
+	s.mu.Lock()
+	ours := dst == s.addr
+	s.mu.Unlock()
+	if !ours {
+		return nil
+	}
+	payload := pkt[ihl:total]
+	switch pkt[9] {
+	case protoTCP:
+		s.handleTCP(src, dst, payload)
+	case protoUDP:
+		s.handleUDP(src, dst, payload)
+	}
+	return nil
+}
+
+// Close shuts the stack down; open connections fail from then on.
+func (s *Stack) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.mu.Lock()
+		tcp := make([]*TCPConn, 0, len(s.tcp))
+		for _, c := range s.tcp {
+			tcp = append(tcp, c)
+		}
+		udp := make([]*UDPConn, 0, len(s.udp))
+		for _, c := range s.udp {
+			udp = append(udp, c)
+		}
+		s.mu.Unlock()
+		for _, c := range tcp {
+			c.fail(errStackClosed)
+		}
+		for _, c := range udp {
+			c.Close()
+		}
+	})
+}
+
+// SetAddress changes the stack's own address, as when a server leases a
+// new one. Open connections keep the old one and will stall.
+func (s *Stack) SetAddress(prefix netip.Prefix) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addr = prefix.Addr()
+	return nil
+}
+
+// Apply records the DNS servers the server pushed, for DNSServers. Search
+// domains are ignored; names are resolved by the caller.
+func (s *Stack) Apply(servers []netip.Addr, domains []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dns = servers
+	return nil
+}
+
+// Restore forgets the DNS servers.
+func (s *Stack) Restore() error {
+	return s.Apply(nil, nil)
+}
+
+// DNSServers returns the servers given to Apply.
+func (s *Stack) DNSServers() []netip.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dns
+}
+
+// SetMTU sets the largest packet the stack sends on new connections.
+func (s *Stack) SetMTU(mtu int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mtu = max(mtu, 576)
+	return nil
+}
+
+// AddRoute is accepted and ignored; the stack sends everything through the
+// tunnel.
+func (s *Stack) AddRoute(netip.Prefix) error { return nil }
+
+// send queues an IPv4 packet carrying payload from the stack to dst.
+func (s *Stack) send(src, dst netip.Addr, proto byte, payload []byte) {
+	pkt := make([]byte, 20+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[4:], uint16(s.ipID.Add(1)))
+	pkt[6] = 0x40 // don't fragment
+	pkt[8] = 64
+	pkt[9] = proto
+	s4, d4 := src.As4(), dst.As4()
+	copy(pkt[12:16], s4[:])
+	copy(pkt[16:20], d4[:])
+	binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:20], 0))
+	copy(pkt[20:], payload)
+	select {
+	case s.out <- pkt:
+	case <-s.closed:
+	}
+}
+
+// localPortLocked picks a free ephemeral port. Callers hold s.mu.
+func (s *Stack) localPortLocked(inUse func(uint16) bool) (uint16, error) {
+	for range 65536 - firstEphemeral {
+		p := s.nextPort
+		s.nextPort++
+		if s.nextPort == 0 {
+			s.nextPort = firstEphemeral
+		}
+		if !inUse(p) {
+			return p, nil
+		}
+	}
+	return 0, errors.New("netstack: out of ports")
+}
+
+// checksum is the Internet checksum of b, starting from sum.
+func checksum(b []byte, sum uint32) uint16 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// pseudoHeader is the checksum contribution of the IPv4 pseudo-header.
+func pseudoHeader(src, dst netip.Addr, proto byte, length int) uint32 {
+	s4, d4 := src.As4(), dst.As4()
+	var sum uint32
+	sum += uint32(binary.BigEndian.Uint16(s4[0:2])) + uint32(binary.BigEndian.Uint16(s4[2:4]))
+	sum += uint32(binary.BigEndian.Uint16(d4[0:2])) + uint32(binary.BigEndian.Uint16(d4[2:4]))
+	sum += uint32(proto) + uint32(length)
+	return sum
+}
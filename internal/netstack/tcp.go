@@ -0,0 +1,622 @@
+package netstack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	// rcvWindow is both the receive buffer and the most a connection keeps
+	// unacknowledged in flight.
+	rcvWindow = 65535
+
+	// maxOutOfOrder bounds the segments held for reassembly.
+	maxOutOfOrder = 64
+
+	initialRTO = time.Second
+	maxRTO     = time.Minute
+	synRetries = 5
+	maxRetries = 8
+
+	// linger is how long a closed connection waits for the peer to finish.
+	linger = 30 * time.Second
+)
+
+var errStackClosed = errors.New("netstack: stack closed")
+
+// TCPConn is a TCP connection made with DialTCP. It is a net.Conn.
+type TCPConn struct {
+	s      *Stack
+	local  netip.AddrPort
+	remote netip.AddrPort
+
+	mu          sync.Mutex
+	changed     chan struct{} // closed and replaced on every state change
+	err         error
+	established bool
+	mss         int
+	iss         uint32
+	sndUna      uint32
+	sndNxt      uint32
+	sndWnd      uint32
+	unacked     []byte // sent data from sndUna, not yet acknowledged
+	finQueued   bool   // CloseWrite called; the FIN follows unacked data
+	finSent     bool
+	finAcked    bool
+	rcvNxt      uint32
+	rcvBuf      []byte
+	ooo         map[uint32][]byte // segments ahead of rcvNxt, by sequence number
+	rcvFIN      bool
+	readClosed  bool
+	dupAcks     int
+	rto         time.Duration
+	retries     int
+	timer       *time.Timer
+	readDL      time.Time
+	writeDL     time.Time
+}
+
+// DialTCP opens a TCP connection to remote through the tunnel.
+func (s *Stack) DialTCP(ctx context.Context, remote netip.AddrPort) (*TCPConn, error) {
+	s.mu.Lock()
+	if !s.addr.IsValid() {
+		s.mu.Unlock()
+		return nil, errNoAddress
+	}
+	port, err := s.localPortLocked(func(p uint16) bool {
+		_, ok := s.tcp[connKey{p, remote}]
+		return ok
+	})
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	c := &TCPConn{
+		s:       s,
+		local:   netip.AddrPortFrom(s.addr, port),
+		remote:  remote,
+		changed: make(chan struct{}),
+		mss:     s.mtu - 40,
+		iss:     initialSeq(),
+		rto:     initialRTO,
+	}
+	c.sndUna, c.sndNxt = c.iss, c.iss+1
+	s.tcp[connKey{port, remote}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.sendLocked(c.iss, tcpSYN, nil)
+	c.armLocked()
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		est, err, ch := c.established, c.err, c.changed
+		c.mu.Unlock()
+		switch {
+		case est:
+			return c, nil
+		case err != nil:
+			return nil, fmt.Errorf("dial %s: %w", remote, err)
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			c.fail(ctx.Err())
+			return nil, fmt.Errorf("dial %s: %w", remote, ctx.Err())
+		}
+	}
+}
+
+// Read reads data the peer sent, returning io.EOF once it has closed its
+// side.
+func (c *TCPConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.rcvBuf) > 0 {
+			before := c.windowLocked()
+			n := copy(b, c.rcvBuf)
+			c.rcvBuf = c.rcvBuf[n:]
+			if len(c.rcvBuf) == 0 {
+				c.rcvBuf = nil
+			}
+			if before < c.mss && c.windowLocked() >= c.mss && c.err == nil {
+				c.sendLocked(c.sndNxt, tcpACK, nil) // window update
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		switch {
+		case c.rcvFIN:
+			c.mu.Unlock()
+			return 0, io.EOF
+		case c.readClosed:
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		case c.err != nil:
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		ch, dl := c.changed, c.readDL
+		c.mu.Unlock()
+		if err := c.wait(ch, dl); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends b, blocking while the peer's window is full.
+func (c *TCPConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		c.mu.Lock()
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+		if c.finQueued {
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if room := int(min(c.sndWnd, rcvWindow)) - len(c.unacked); room > 0 {
+			chunk := b[written : written+min(room, c.mss, len(b)-written)]
+			idle := c.sndUna == c.sndNxt
+			c.unacked = append(c.unacked, chunk...)
+			c.sendLocked(c.sndNxt, tcpACK|tcpPSH, chunk)
+			c.sndNxt += uint32(len(chunk))
+			if idle {
+				c.armLocked()
+			}
+			written += len(chunk)
+			c.mu.Unlock()
+			continue
+		}
+		ch, dl := c.changed, c.writeDL
+		c.mu.Unlock()
+		if err := c.wait(ch, dl); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// CloseWrite sends a FIN once the data already written is acknowledged.
+func (c *TCPConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.finQueued {
+		return nil
+	}
+	if !c.established {
+		c.failLocked(net.ErrClosed)
+		return nil
+	}
+	c.finQueued = true
+	if len(c.unacked) == 0 {
+		c.sendFINLocked()
+	}
+	return nil
+}
+
+// Close closes both directions. The connection stays in the stack until
+// the peer closes too, or for at most linger.
+func (c *TCPConn) Close() error {
+	c.CloseWrite()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readClosed {
+		return nil
+	}
+	c.readClosed = true
+	c.rcvBuf = nil
+	c.notifyLocked()
+	if c.err == nil {
+		time.AfterFunc(linger, c.abort)
+	}
+	return nil
+}
+
+func (c *TCPConn) LocalAddr() net.Addr  { return net.TCPAddrFromAddrPort(c.local) }
+func (c *TCPConn) RemoteAddr() net.Addr { return net.TCPAddrFromAddrPort(c.remote) }
+
+func (c *TCPConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *TCPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDL = t
+	c.notifyLocked()
+	return nil
+}
+
+func (c *TCPConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDL = t
+	c.notifyLocked()
+	return nil
+}
+
+// wait blocks until ch is closed, the deadline passes or the stack closes.
+func (c *TCPConn) wait(ch <-chan struct{}, deadline time.Time) error {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case <-c.s.closed:
+		return errStackClosed
+	}
+}
+
+// handleTCP passes an inbound segment to its connection.
+func (s *Stack) handleTCP(src, dst netip.Addr, seg []byte) {
+	if len(seg) < 20 || checksum(seg, pseudoHeader(src, dst, protoTCP, len(seg))) != 0 {
+		return
+	}
+	off := int(seg[12]>>4) * 4
+	if off < 20 || off > len(seg) {
+		return
+	}
+	remote := netip.AddrPortFrom(src, binary.BigEndian.Uint16(seg[0:2]))
+	local := netip.AddrPortFrom(dst, binary.BigEndian.Uint16(seg[2:4]))
+	seq := binary.BigEndian.Uint32(seg[4:8])
+	ack := binary.BigEndian.Uint32(seg[8:12])
+	flags := seg[13]
+	wnd := uint32(binary.BigEndian.Uint16(seg[14:16]))
+
+	s.mu.Lock()
+	c := s.tcp[connKey{local.Port(), remote}]
+	s.mu.Unlock()
+	if c == nil {
+		if flags&tcpRST == 0 {
+			s.reset(local, remote, seq, ack, flags, len(seg)-off)
+		}
+		return
+	}
+	c.segment(seq, ack, flags, wnd, seg[20:off], seg[off:])
+}
+
+// reset answers a segment for no connection with a RST, as RFC 793 asks.
+func (s *Stack) reset(local, remote netip.AddrPort, seq, ack uint32, flags byte, n int) {
+	if flags&tcpACK != 0 {
+		s.send(local.Addr(), remote.Addr(), protoTCP, tcpSegment(local, remote, ack, 0, tcpRST, 0, nil, nil))
+		return
+	}
+	n += int(flags&tcpSYN>>1) + int(flags&tcpFIN)
+	s.send(local.Addr(), remote.Addr(), protoTCP, tcpSegment(local, remote, 0, seq+uint32(n), tcpRST|tcpACK, 0, nil, nil))
+}
+
+func (c *TCPConn) segment(seq, ack uint32, flags byte, wnd uint32, opts, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	if flags&tcpRST != 0 {
+		switch {
+		case !c.established && flags&tcpACK != 0 && ack == c.iss+1:
+			c.failLocked(syscall.ECONNREFUSED)
+		case c.established && seq-c.rcvNxt <= rcvWindow:
+			c.failLocked(syscall.ECONNRESET)
+		}
+		return
+	}
+
+	if !c.established {
+		if flags&tcpACK != 0 && ack != c.iss+1 {
+			// An old connection's leftovers, such as a TIME_WAIT socket
+			// at the peer: reset it so the next SYN gets through.
+			c.s.send(c.local.Addr(), c.remote.Addr(), protoTCP, tcpSegment(c.local, c.remote, ack, 0, tcpRST, 0, nil, nil))
+			return
+		}
+		if flags&(tcpSYN|tcpACK) != tcpSYN|tcpACK {
+			return
+		}
+		c.established = true
+		c.rcvNxt = seq + 1
+		c.sndUna = ack
+		c.sndWnd = wnd
+		if mss := peerMSS(opts); mss > 0 {
+			c.mss = min(c.mss, mss)
+		}
+		c.retries, c.rto = 0, initialRTO
+		c.stopTimerLocked()
+		c.sendLocked(c.sndNxt, tcpACK, nil)
+		c.notifyLocked()
+		return
+	}
+	if flags&tcpSYN != 0 {
+		// Our ACK of the SYN-ACK was lost; say it again.
+		c.sendLocked(c.sndNxt, tcpACK, nil)
+		return
+	}
+
+	if flags&tcpACK != 0 {
+		c.ackLocked(ack, wnd, len(data) == 0 && flags&tcpFIN == 0)
+	}
+	if len(data) == 0 && flags&tcpFIN == 0 {
+		return
+	}
+	if seq != c.rcvNxt || c.rcvFIN {
+		// Out of order or a repeat: keep what fits in the window for
+		// later, and the duplicate ACK asks for what is missing.
+		if ahead := seq - c.rcvNxt; !c.rcvFIN && len(data) > 0 && len(c.ooo) < maxOutOfOrder &&
+			int32(ahead) > 0 && int(ahead)+len(data) <= c.windowLocked() {
+			if c.ooo == nil {
+				c.ooo = make(map[uint32][]byte)
+			}
+			c.ooo[seq] = append([]byte(nil), data...)
+		}
+		c.sendLocked(c.sndNxt, tcpACK, nil)
+		return
+	}
+	n := c.receiveLocked(data)
+	if n == len(data) && flags&tcpFIN != 0 {
+		c.rcvNxt++
+		c.rcvFIN = true
+		c.ooo = nil
+	}
+	for n == len(data) && len(c.ooo) > 0 {
+		next, ok := c.ooo[c.rcvNxt]
+		if !ok {
+			break
+		}
+		delete(c.ooo, c.rcvNxt)
+		data = next
+		n = c.receiveLocked(data)
+	}
+	c.sendLocked(c.sndNxt, tcpACK, nil)
+	c.notifyLocked()
+	c.maybeDoneLocked()
+}
+
+// receiveLocked takes in-order data into the receive buffer, as much as
+// the window allows, and returns how much it took.
+func (c *TCPConn) receiveLocked(data []byte) int {
+	n := len(data)
+	if !c.readClosed {
+		n = min(n, c.windowLocked())
+		c.rcvBuf = append(c.rcvBuf, data[:n]...)
+	}
+	c.rcvNxt += uint32(n)
+	for seq := range c.ooo {
+		if int32(seq-c.rcvNxt) < 0 {
+			delete(c.ooo, seq) // overtaken
+		}
+	}
+	return n
+}
+
+// ackLocked handles the acknowledgement and window in a segment. pure is
+// set for a segment carrying nothing else, which may be a duplicate ACK.
+func (c *TCPConn) ackLocked(ack, wnd uint32, pure bool) {
+	acked := ack - c.sndUna
+	if int32(acked) < 0 || int32(ack-c.sndNxt) > 0 {
+		return
+	}
+	c.sndWnd = wnd
+	if acked == 0 {
+		if pure && c.sndUna != c.sndNxt {
+			if c.dupAcks++; c.dupAcks == 3 {
+				c.resendLocked() // fast retransmit
+			}
+		}
+		c.notifyLocked()
+		return
+	}
+	c.dupAcks = 0
+	c.unacked = c.unacked[min(int(acked), len(c.unacked)):]
+	c.sndUna = ack
+	if c.finSent && ack == c.sndNxt {
+		c.finAcked = true
+	}
+	c.retries, c.rto = 0, initialRTO
+	if c.sndUna == c.sndNxt {
+		c.stopTimerLocked()
+	} else {
+		c.armLocked()
+	}
+	if c.finQueued && !c.finSent && len(c.unacked) == 0 {
+		c.sendFINLocked()
+	}
+	c.notifyLocked()
+	c.maybeDoneLocked()
+}
+
+func (c *TCPConn) sendFINLocked() {
+	idle := c.sndUna == c.sndNxt
+	c.finSent = true
+	c.sendLocked(c.sndNxt, tcpFIN|tcpACK, nil)
+	c.sndNxt++
+	if idle {
+		c.armLocked()
+	}
+}
+
+// retransmit runs when the retransmission timer fires.
+func (c *TCPConn) retransmit() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.sndUna == c.sndNxt {
+		return
+	}
+	c.retries++
+	if c.retries > maxRetries || !c.established && c.retries > synRetries {
+		if c.established {
+			c.sendLocked(c.sndNxt, tcpRST|tcpACK, nil)
+		}
+		c.failLocked(syscall.ETIMEDOUT)
+		return
+	}
+	c.rto = min(c.rto*2, maxRTO)
+	c.resendLocked()
+	c.armLocked()
+}
+
+// resendLocked sends the oldest unacknowledged segment again.
+func (c *TCPConn) resendLocked() {
+	switch {
+	case !c.established:
+		c.sendLocked(c.iss, tcpSYN, nil)
+	case len(c.unacked) > 0:
+		n := min(len(c.unacked), c.mss)
+		flags := byte(tcpACK | tcpPSH)
+		if c.finSent && n == len(c.unacked) {
+			flags |= tcpFIN
+		}
+		c.sendLocked(c.sndUna, flags, c.unacked[:n])
+	case c.finSent:
+		c.sendLocked(c.sndUna, tcpFIN|tcpACK, nil)
+	}
+}
+
+func (c *TCPConn) armLocked() {
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.rto, c.retransmit)
+		return
+	}
+	c.timer.Reset(c.rto)
+}
+
+func (c *TCPConn) stopTimerLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// maybeDoneLocked drops the connection from the stack once both sides have
+// closed.
+func (c *TCPConn) maybeDoneLocked() {
+	if c.finAcked && c.rcvFIN {
+		c.failLocked(net.ErrClosed)
+	}
+}
+
+// abort resets a connection the peer has not finished closing.
+func (c *TCPConn) abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.sendLocked(c.sndNxt, tcpRST|tcpACK, nil)
+		c.failLocked(net.ErrClosed)
+	}
+}
+
+func (c *TCPConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failLocked(err)
+}
+
+func (c *TCPConn) failLocked(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.stopTimerLocked()
+	c.s.mu.Lock()
+	if c.s.tcp[connKey{c.local.Port(), c.remote}] == c {
+		delete(c.s.tcp, connKey{c.local.Port(), c.remote})
+	}
+	c.s.mu.Unlock()
+	c.notifyLocked()
+}
+
+func (c *TCPConn) notifyLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *TCPConn) windowLocked() int {
+	return max(rcvWindow-len(c.rcvBuf), 0)
+}
+
+func (c *TCPConn) sendLocked(seq uint32, flags byte, data []byte) {
+	var opts []byte
+	if flags&tcpSYN != 0 {
+		opts = []byte{2, 4, byte(c.mss >> 8), byte(c.mss)}
+	} else {
+		flags |= tcpACK
+	}
+	seg := tcpSegment(c.local, c.remote, seq, c.rcvNxt, flags, uint16(c.windowLocked()), opts, data)
+	c.s.send(c.local.Addr(), c.remote.Addr(), protoTCP, seg)
+}
+
+// initialSeq picks an initial sequence number that grows with the clock,
+// as RFC 793 suggests, so a new connection reusing a port is not mistaken
+// for an old one; the random part keeps it hard to guess.
+func initialSeq() uint32 {
+	return uint32(time.Now().UnixNano()>>12) + rand.Uint32N(1<<16)
+}
+
+// tcpSegment builds a TCP segment with its checksum.
+func tcpSegment(src, dst netip.AddrPort, seq, ack uint32, flags byte, wnd uint16, opts, data []byte) []byte {
+	hl := 20 + len(opts)
+	seg := make([]byte, hl+len(data))
+	binary.BigEndian.PutUint16(seg[0:], src.Port())
+	binary.BigEndian.PutUint16(seg[2:], dst.Port())
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(seg[8:], ack)
+	}
+	seg[12] = byte(hl/4) << 4
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:], wnd)
+	copy(seg[20:], opts)
+	copy(seg[hl:], data)
+	binary.BigEndian.PutUint16(seg[16:], checksum(seg, pseudoHeader(src.Addr(), dst.Addr(), protoTCP, len(seg))))
+	return seg
+}
+
+// peerMSS returns the MSS option in opts, or 0.
+func peerMSS(opts []byte) int {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0:
+			return 0
+		case 1:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return 0
+		}
+		if opts[0] == 2 && opts[1] == 4 {
+			return int(binary.BigEndian.Uint16(opts[2:4]))
+		}
+		opts = opts[opts[1]:]
+	}
+	return 0
+}
@@ -0,0 +1,159 @@
+package netstack
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// udpQueue is how many datagrams a UDPConn holds for Read before dropping.
+const udpQueue = 64
+
+// UDPConn is a UDP socket connected to one remote address, made with
+// DialUDP. It is a net.Conn and a net.PacketConn.
+type UDPConn struct {
+	s      *Stack
+	local  netip.AddrPort
+	remote netip.AddrPort
+	in     chan []byte
+	closed chan struct{}
+	once   sync.Once
+
+	mu     sync.Mutex
+	readDL time.Time
+}
+
+// DialUDP opens a UDP socket to remote through the tunnel.
+func (s *Stack) DialUDP(remote netip.AddrPort) (*UDPConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.addr.IsValid() {
+		return nil, errNoAddress
+	}
+	port, err := s.localPortLocked(func(p uint16) bool { return s.udp[p] != nil })
+	if err != nil {
+		return nil, err
+	}
+	c := &UDPConn{
+		s:      s,
+		local:  netip.AddrPortFrom(s.addr, port),
+		remote: remote,
+		in:     make(chan []byte, udpQueue),
+		closed: make(chan struct{}),
+	}
+	s.udp[port] = c
+	return c, nil
+}
+
+// handleUDP queues an inbound datagram on its socket.
+func (s *Stack) handleUDP(src, dst netip.Addr, dgram []byte) {
+	if len(dgram) < 8 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(dgram[4:6]))
+	if n < 8 || n > len(dgram) {
+		return
+	}
+	dgram = dgram[:n]
+	if binary.BigEndian.Uint16(dgram[6:8]) != 0 && checksum(dgram, pseudoHeader(src, dst, protoUDP, n)) != 0 {
+		return
+	}
+	s.mu.Lock()
+	c := s.udp[binary.BigEndian.Uint16(dgram[2:4])]
+	s.mu.Unlock()
+	if c == nil || netip.AddrPortFrom(src, binary.BigEndian.Uint16(dgram[0:2])) != c.remote {
+		return
+	}
+	select {
+	case c.in <- append([]byte(nil), dgram[8:]...):
+	default:
+	}
+}
+
+func (c *UDPConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	dl := c.readDL
+	c.mu.Unlock()
+	var expired <-chan time.Time
+	if !dl.IsZero() {
+		t := time.NewTimer(time.Until(dl))
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case p := <-c.in:
+		return copy(b, p), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-expired:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *UDPConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.s.mu.Lock()
+	mtu := c.s.mtu
+	c.s.mu.Unlock()
+	if 28+len(b) > mtu {
+		return 0, errors.New("netstack: datagram larger than the MTU")
+	}
+	dgram := make([]byte, 8+len(b))
+	binary.BigEndian.PutUint16(dgram[0:], c.local.Port())
+	binary.BigEndian.PutUint16(dgram[2:], c.remote.Port())
+	binary.BigEndian.PutUint16(dgram[4:], uint16(len(dgram)))
+	copy(dgram[8:], b)
+	sum := checksum(dgram, pseudoHeader(c.local.Addr(), c.remote.Addr(), protoUDP, len(dgram)))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(dgram[6:], sum)
+	c.s.send(c.local.Addr(), c.remote.Addr(), protoUDP, dgram)
+	return len(b), nil
+}
+
+// ReadFrom is Read; datagrams only ever come from the remote address.
+func (c *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+// WriteTo is Write; the socket is connected, so addr is ignored.
+func (c *UDPConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c *UDPConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.s.mu.Lock()
+		if c.s.udp[c.local.Port()] == c {
+			delete(c.s.udp, c.local.Port())
+		}
+		c.s.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *UDPConn) LocalAddr() net.Addr  { return net.UDPAddrFromAddrPort(c.local) }
+func (c *UDPConn) RemoteAddr() net.Addr { return net.UDPAddrFromAddrPort(c.remote) }
+
+func (c *UDPConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDL = t
+	return nil
+}
+
+// SetWriteDeadline is accepted and ignored; writes never block.
+func (c *UDPConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,280 @@
+// Package ovpn reads what a VPN client needs to know about its server from
+// OpenVPN client profiles (.ovpn files): where the server is, what to
+// route, and which resolvers to use. Keys, certificates, and the many
+// other directives are skipped.
+package ovpn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is OpenVPN's port when a profile names none.
+const DefaultPort = 1194
+
+// Profile is what was read from a profile.
+type Profile struct {
+	Remotes []Remote // in the order OpenVPN tries them
+	Routes  []netip.Prefix
+	// RedirectGateway sends all IPv4 traffic, and with RedirectIPv6 all
+	// IPv6 traffic, through the tunnel.
+	RedirectGateway bool
+	RedirectIPv6    bool
+	// Address is the client's own address from an ifconfig directive, as
+	// in profiles for static setups; it is invalid when the server
+	// assigns one.
+	Address netip.Prefix
+	DNS     []netip.Addr
+	Domains []string
+	// RouteNoPull is set when the profile ignores routes the server
+	// pushes.
+	RouteNoPull bool
+	// Skipped lists the directives read that are not reflected above,
+	// each once, in the order first seen, and routes that could not be
+	// read, whole.
+	Skipped []string
+}
+
+// Remote is one server a profile connects to.
+type Remote struct {
+	Host  string
+	Port  int
+	Proto string // udp or tcp, without a trailing 4, 6, or -client
+}
+
+// Parse reads an OpenVPN profile.
+func Parse(r io.Reader) (*Profile, error) {
+	p := &Profile{}
+	port, proto := DefaultPort, "udp"
+	var remotes []remoteLine
+	skipped := make(map[string]bool)
+	inline := ""
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if inline != "" {
+			if strings.EqualFold(line, "</"+inline+">") {
+				inline = ""
+			}
+			continue
+		}
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "<") && strings.HasSuffix(line, ">") && !strings.HasPrefix(line, "</") {
+			inline = line[1 : len(line)-1]
+			p.skip(skipped, inline)
+			continue
+		}
+		args := fields(line)
+		var err error
+		switch name := strings.ToLower(args[0]); name {
+		case "remote":
+			if len(args) < 2 {
+				return nil, fmt.Errorf("line %d: remote needs a host", n)
+			}
+			remotes = append(remotes, remoteLine{args: args[1:], line: n})
+		case "port", "rport":
+			port, err = parsePort(args)
+		case "proto":
+			if len(args) < 2 {
+				return nil, fmt.Errorf("line %d: proto needs a protocol", n)
+			}
+			proto = baseProto(args[1])
+		case "route", "route-ipv6":
+			add := p.addRoute
+			if name == "route-ipv6" {
+				add = p.addRoute6
+			}
+			// Routes to names such as vpn_gateway or a hostname are
+			// resolved by OpenVPN as it connects; they are skipped.
+			if add(args) != nil {
+				p.Skipped = append(p.Skipped, line)
+			}
+		case "redirect-gateway":
+			p.RedirectGateway = true
+			for _, flag := range args[1:] {
+				switch strings.ToLower(flag) {
+				case "ipv6":
+					p.RedirectIPv6 = true
+				case "!ipv4":
+					p.RedirectGateway = false
+				}
+			}
+		case "route-nopull":
+			p.RouteNoPull = true
+		case "ifconfig":
+			err = p.setAddress(args)
+		case "dhcp-option":
+			err = p.addOption(args)
+		default:
+			p.skip(skipped, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, args[0], err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for _, rl := range remotes {
+		rem := Remote{Host: rl.args[0], Port: port, Proto: proto}
+		if len(rl.args) > 1 {
+			port, err := strconv.Atoi(rl.args[1])
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("line %d: remote: invalid port %q", rl.line, rl.args[1])
+			}
+			rem.Port = port
+		}
+		if len(rl.args) > 2 {
+			rem.Proto = baseProto(rl.args[2])
+		}
+		p.Remotes = append(p.Remotes, rem)
+	}
+	return p, nil
+}
+
+// remoteLine is a remote directive, resolved once the port and proto
+// directives, which may follow it, are known.
+type remoteLine struct {
+	args []string
+	line int
+}
+
+func (p *Profile) skip(seen map[string]bool, name string) {
+	if !seen[name] {
+		seen[name] = true
+		p.Skipped = append(p.Skipped, name)
+	}
+}
+
+func (p *Profile) addRoute(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("needs a network")
+	}
+	addr, err := netip.ParseAddr(args[1])
+	if err != nil || !addr.Is4() {
+		return fmt.Errorf("network %q is not an IPv4 address", args[1])
+	}
+	bits := 32
+	if len(args) > 2 && args[2] != "default" {
+		if bits, err = maskBits(args[2]); err != nil {
+			return err
+		}
+	}
+	p.Routes = append(p.Routes, netip.PrefixFrom(addr, bits).Masked())
+	return nil
+}
+
+// maskBits returns the prefix length of an IPv4 netmask such as
+// 255.255.0.0.
+func maskBits(s string) (int, error) {
+	mask, err := netip.ParseAddr(s)
+	if err != nil || !mask.Is4() {
+		return 0, fmt.Errorf("invalid netmask %q", s)
+	}
+	m := mask.As4()
+	v := uint32(m[0])<<24 | uint32(m[1])<<16 | uint32(m[2])<<8 | uint32(m[3])
+	bits := 0
+	for v&0x80000000 != 0 {
+		bits++
+		v <<= 1
+	}
+	if v != 0 {
+		return 0, fmt.Errorf("netmask %q is not contiguous", s)
+	}
+	return bits, nil
+}
+
+func (p *Profile) addRoute6(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("needs a network")
+	}
+	prefix, err := netip.ParsePrefix(args[1])
+	if err != nil {
+		return err
+	}
+	p.Routes = append(p.Routes, prefix.Masked())
+	return nil
+}
+
+func (p *Profile) setAddress(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("needs an address and a netmask or peer")
+	}
+	addr, err := netip.ParseAddr(args[1])
+	if err != nil || !addr.Is4() {
+		return fmt.Errorf("invalid address %q", args[1])
+	}
+	// The second argument is a netmask on a subnet, and the other end's
+	// address on a point-to-point link.
+	bits, err := maskBits(args[2])
+	if err != nil || bits == 0 {
+		bits = 32
+	}
+	p.Address = netip.PrefixFrom(addr, bits)
+	return nil
+}
+
+func (p *Profile) addOption(args []string) error {
+	if len(args) < 3 {
+		return nil
+	}
+	switch strings.ToUpper(args[1]) {
+	case "DNS", "DNS6":
+		addr, err := netip.ParseAddr(args[2])
+		if err != nil {
+			return err
+		}
+		p.DNS = append(p.DNS, addr)
+	case "DOMAIN", "DOMAIN-SEARCH":
+		p.Domains = append(p.Domains, args[2])
+	}
+	return nil
+}
+
+func parsePort(args []string) (int, error) {
+	if len(args) < 2 {
+		return 0, fmt.Errorf("needs a port")
+	}
+	port, err := strconv.Atoi(args[1])
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", args[1])
+	}
+	return port, nil
+}
+
+// baseProto turns udp4, tcp6, tcp-client and the like into udp or tcp.
+func baseProto(s string) string {
+	s = strings.ToLower(s)
+	if strings.HasPrefix(s, "tcp") {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// fields splits a directive into its arguments, keeping double-quoted
+// ones whole.
+func fields(line string) []string {
+	var out []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] == '"' {
+			if end := strings.IndexByte(line[1:], '"'); end >= 0 {
+				out = append(out, line[1:end+1])
+				line = line[end+2:]
+				continue
+			}
+		}
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		out = append(out, line[:end])
+		line = line[end:]
+	}
+	return out
+}
@@ -0,0 +1,165 @@
+// Package pcap streams packets in the libpcap file format, as raw IP, to
+// readers connected to a socket, for tools such as tcpdump, Wireshark, and
+// Suricata that read a capture from a pipe.
+package pcap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SnapLen is the longest packet a record holds in full.
+	SnapLen = 65535
+
+	// linkTypeRaw marks records as bare IPv4 or IPv6 packets.
+	linkTypeRaw = 101
+
+	// readerQueue is how many records a slow reader may fall behind by
+	// before records are dropped for it.
+	readerQueue = 1024
+)
+
+// Header returns the global header that starts every capture.
+func Header() []byte {
+	h := make([]byte, 24)
+	binary.LittleEndian.PutUint32(h[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], SnapLen)
+	binary.LittleEndian.PutUint32(h[20:], linkTypeRaw)
+	return h
+}
+
+// AppendRecord appends the record of pkt, captured at t, to b.
+func AppendRecord(b []byte, t time.Time, pkt []byte) []byte {
+	n := min(len(pkt), SnapLen)
+	b = binary.LittleEndian.AppendUint32(b, uint32(t.Unix()))
+	b = binary.LittleEndian.AppendUint32(b, uint32(t.Nanosecond()/1000))
+	b = binary.LittleEndian.AppendUint32(b, uint32(n))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt)))
+	return append(b, pkt[:n]...)
+}
+
+// Server sends every packet given to Write to each connected reader, as a
+// capture that starts when the reader connects.
+type Server struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	readers map[*reader]bool
+}
+
+type reader struct {
+	name    string
+	conn    net.Conn
+	records chan []byte
+	dropped int
+}
+
+// Listen serves captures on address, a host:port or unix:/path/to.sock,
+// until ctx is done. A stale socket file left by a crash is replaced.
+func Listen(ctx context.Context, address string) (*Server, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", path
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+			os.Remove(path)
+		}
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{ln: ln, readers: make(map[*reader]bool)}
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the address readers connect to.
+func (s *Server) Addr() net.Addr { return s.ln.Addr() }
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Mirror capture accept error: %v", err)
+			}
+			return
+		}
+		// Unix socket peers are nameless, so go by the socket instead.
+		name := conn.RemoteAddr().String()
+		if _, ok := conn.RemoteAddr().(*net.UnixAddr); ok {
+			name = "on " + conn.LocalAddr().String()
+		}
+		r := &reader{name: name, conn: conn, records: make(chan []byte, readerQueue)}
+		s.mu.Lock()
+		s.readers[r] = true
+		s.mu.Unlock()
+		log.Printf("Mirror capture reader %s connected", name)
+		go s.serve(r)
+	}
+}
+
+// serve writes r's records until it goes away or falls over.
+func (s *Server) serve(r *reader) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.readers, r)
+		dropped := r.dropped
+		s.mu.Unlock()
+		r.conn.Close()
+		log.Printf("Mirror capture reader %s disconnected; %d packets dropped for it", r.name, dropped)
+	}()
+	if _, err := r.conn.Write(Header()); err != nil {
+		return
+	}
+	for rec := range r.records {
+		if _, err := r.conn.Write(rec); err != nil {
+			return
+		}
+	}
+}
+
+// Write queues pkt, captured at t, for every reader, never blocking: a
+// reader too far behind misses it.
+func (s *Server) Write(t time.Time, pkt []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.readers) == 0 {
+		return
+	}
+	rec := AppendRecord(make([]byte, 0, 16+len(pkt)), t, pkt)
+	for r := range s.readers {
+		select {
+		case r.records <- rec:
+		default:
+			r.dropped++
+		}
+	}
+}
+
+// Close stops listening and disconnects every reader.
+func (s *Server) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for r := range s.readers {
+		delete(s.readers, r)
+		close(r.records)
+		r.conn.Close()
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package portmap
+
+import "net/netip"
+
+// DefaultGateway is not implemented on this platform; MapUDP falls back to
+// UPnP discovery, which does not need it.
+func DefaultGateway() (netip.Addr, error) {
+	return netip.Addr{}, ErrNoGateway
+}
@@ -0,0 +1,37 @@
+//go:build windows
+
+package portmap
+
+import (
+	"net/netip"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+// DefaultGateway returns the IPv4 next hop of the lowest-metric default
+// route.
+func DefaultGateway() (netip.Addr, error) {
+	routes, err := winipcfg.GetIPForwardTable2(windows.AF_INET)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	var best netip.Addr
+	var metric uint32
+	for _, r := range routes {
+		if r.DestinationPrefix.Prefix().Bits() != 0 {
+			continue
+		}
+		gw := r.NextHop.Addr()
+		if !gw.IsValid() || gw.IsUnspecified() {
+			continue
+		}
+		if !best.IsValid() || r.Metric < metric {
+			best, metric = gw, r.Metric
+		}
+	}
+	if !best.IsValid() {
+		return netip.Addr{}, ErrNoGateway
+	}
+	return best, nil
+}
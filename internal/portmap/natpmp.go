@@ -0,0 +1,104 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	natpmpPort = 5351
+
+	natpmpOpExternal = 0
+	natpmpOpMapUDP   = 1
+
+	// natpmpRetries bounds the RFC's 250ms-doubling retransmissions, which
+	// would otherwise run for over a minute when nothing answers.
+	natpmpRetries = 4
+)
+
+func natpmpMap(ctx context.Context, gw netip.Addr, port uint16, lifetime time.Duration) (*Mapping, error) {
+	conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(gw, natpmpPort)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := natpmpCall(ctx, conn, []byte{0, natpmpOpExternal}, 12)
+	if err != nil {
+		return nil, err
+	}
+	var ip [4]byte
+	copy(ip[:], resp[8:12])
+
+	req := natpmpMapRequest(port, port, lifetime)
+	resp, err = natpmpCall(ctx, conn, req, 16)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mapping{
+		Protocol: "nat-pmp",
+		External: netip.AddrPortFrom(netip.AddrFrom4(ip), binary.BigEndian.Uint16(resp[10:])),
+		Internal: port,
+		Lifetime: time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second,
+	}
+	m.unmap = func(ctx context.Context) error {
+		conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(gw, natpmpPort)))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// A zero lifetime and external port delete the mapping.
+		_, err = natpmpCall(ctx, conn, natpmpMapRequest(port, 0, 0), 16)
+		return err
+	}
+	return m, nil
+}
+
+func natpmpMapRequest(internal, external uint16, lifetime time.Duration) []byte {
+	req := make([]byte, 12)
+	req[1] = natpmpOpMapUDP
+	binary.BigEndian.PutUint16(req[4:], internal)
+	binary.BigEndian.PutUint16(req[6:], external)
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	return req
+}
+
+// natpmpCall sends req until a response of at least size bytes for the same
+// opcode arrives, and checks its result code.
+func natpmpCall(ctx context.Context, conn *net.UDPConn, req []byte, size int) ([]byte, error) {
+	buf := make([]byte, 16)
+	rto := 250 * time.Millisecond
+	for try := 0; try < natpmpRetries; try++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(rto)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if n < size || buf[0] != 0 || buf[1] != req[1]|0x80 {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(buf[2:]); code != 0 {
+				return nil, fmt.Errorf("result code %d", code)
+			}
+			return buf[:n], nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		rto *= 2
+	}
+	return nil, errors.New("gateway did not answer")
+}
@@ -0,0 +1,57 @@
+// Package portmap asks the local gateway to forward a UDP port, using
+// NAT-PMP (RFC 6886) where the router speaks it and UPnP IGD otherwise.
+package portmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// DefaultLifetime is the lease requested for a mapping. Callers should renew
+// at half the granted lifetime.
+const DefaultLifetime = time.Hour
+
+// ErrNoGateway is returned when the default gateway cannot be determined.
+var ErrNoGateway = errors.New("portmap: no default gateway")
+
+// Mapping is a port forward granted by the gateway.
+type Mapping struct {
+	Protocol string         // "nat-pmp" or "upnp"
+	External netip.AddrPort // public address peers should use
+	Internal uint16
+	Lifetime time.Duration // zero for a permanent UPnP mapping
+
+	unmap func(context.Context) error
+}
+
+// Delete asks the gateway to remove the mapping.
+func (m *Mapping) Delete(ctx context.Context) error {
+	if m.unmap == nil {
+		return nil
+	}
+	return m.unmap(ctx)
+}
+
+// MapUDP forwards external UDP port to the same port on this host. It tries
+// NAT-PMP first because it is a single datagram, then UPnP.
+func MapUDP(ctx context.Context, port uint16, lifetime time.Duration) (*Mapping, error) {
+	var errs []error
+	if gw, err := DefaultGateway(); err == nil {
+		m, err := natpmpMap(ctx, gw, port, lifetime)
+		if err == nil {
+			return m, nil
+		}
+		errs = append(errs, fmt.Errorf("nat-pmp: %w", err))
+	} else {
+		errs = append(errs, err)
+	}
+	m, err := upnpMap(ctx, port, lifetime)
+	if err == nil {
+		return m, nil
+	}
+	errs = append(errs, fmt.Errorf("upnp: %w", err))
+	return nil, errors.Join(errs...)
+}
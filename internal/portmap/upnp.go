@@ -0,0 +1,261 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpAddr    = "239.255.255.250:1900"
+	ssdpTimeout = 2 * time.Second
+
+	upnpDescription = "GoVPN"
+)
+
+// upnpServices are the IGD services that can add port mappings, newest
+// first.
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// igd is a discovered Internet Gateway Device service.
+type igd struct {
+	service string
+	control string
+	local   netip.Addr // our address on the gateway's network
+}
+
+func upnpMap(ctx context.Context, port uint16, lifetime time.Duration) (*Mapping, error) {
+	dev, err := discoverIGD(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lease := uint32(lifetime / time.Second)
+	args := func(lease uint32) [][2]string {
+		return [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(int(port))},
+			{"NewProtocol", "UDP"},
+			{"NewInternalPort", strconv.Itoa(int(port))},
+			{"NewInternalClient", dev.local.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", upnpDescription},
+			{"NewLeaseDuration", strconv.FormatUint(uint64(lease), 10)},
+		}
+	}
+	_, err = dev.call(ctx, "AddPortMapping", args(lease))
+	var fault *soapFault
+	if errors.As(err, &fault) && fault.Code == "725" {
+		// OnlyPermanentLeasesSupported: some routers refuse timed leases.
+		lease = 0
+		_, err = dev.call(ctx, "AddPortMapping", args(lease))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mapping{
+		Protocol: "upnp",
+		Internal: port,
+		Lifetime: time.Duration(lease) * time.Second,
+	}
+	if body, err := dev.call(ctx, "GetExternalIPAddress", nil); err == nil {
+		if ip, err := netip.ParseAddr(xmlValue(body, "NewExternalIPAddress")); err == nil {
+			m.External = netip.AddrPortFrom(ip, port)
+		}
+	}
+	m.unmap = func(ctx context.Context) error {
+		_, err := dev.call(ctx, "DeletePortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(int(port))},
+			{"NewProtocol", "UDP"},
+		})
+		return err
+	}
+	return m, nil
+}
+
+// discoverIGD finds a gateway over SSDP and reads its device description.
+func discoverIGD(ctx context.Context) (*igd, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	dst, _ := net.ResolveUDPAddr("udp4", ssdpAddr)
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), dst); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(ssdpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, errors.New("no UPnP gateway found")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		loc := resp.Header.Get("Location")
+		resp.Body.Close()
+		if loc == "" {
+			continue
+		}
+		if dev, err := describeIGD(ctx, loc); err == nil {
+			return dev, nil
+		}
+	}
+}
+
+type upnpDevice struct {
+	Services []struct {
+		Type    string `xml:"serviceType"`
+		Control string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// describeIGD fetches the description at location and picks the first
+// service that can map ports.
+func describeIGD(ctx context.Context, location string) (*igd, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var root struct {
+		Device upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, err
+	}
+
+	// Our address as seen on the route to the gateway.
+	c, err := net.Dial("udp4", base.Host)
+	if err != nil {
+		return nil, err
+	}
+	local := c.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+	c.Close()
+
+	for _, want := range upnpServices {
+		if ctl := findService(root.Device, want); ctl != "" {
+			ref, err := url.Parse(ctl)
+			if err != nil {
+				return nil, err
+			}
+			return &igd{service: want, control: base.ResolveReference(ref).String(), local: local.Unmap()}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no WAN connection service", location)
+}
+
+func findService(d upnpDevice, service string) string {
+	for _, s := range d.Services {
+		if s.Type == service {
+			return s.Control
+		}
+	}
+	for _, sub := range d.Devices {
+		if ctl := findService(sub, service); ctl != "" {
+			return ctl
+		}
+	}
+	return ""
+}
+
+// call invokes a SOAP action on the gateway and returns the response body.
+func (d *igd) call(ctx context.Context, action string, args [][2]string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, d.service)
+	for _, a := range args {
+		fmt.Fprintf(&body, "<%s>", a[0])
+		xml.EscapeText(&body, []byte(a[1]))
+		fmt.Fprintf(&body, "</%s>", a[0])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.control, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, d.service, action))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &soapFault{Action: action, Status: resp.Status, Code: xmlValue(out, "errorCode")}
+	}
+	return out, nil
+}
+
+// soapFault is an error response from the gateway. Code is the UPnP error
+// code, such as 718 for a conflicting mapping.
+type soapFault struct {
+	Action string
+	Status string
+	Code   string
+}
+
+func (e *soapFault) Error() string {
+	return fmt.Sprintf("%s: %s (error %s)", e.Action, e.Status, e.Code)
+}
+
+// xmlValue returns the text of the first element named name in doc.
+func xmlValue(doc []byte, name string) string {
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == name {
+			var v string
+			if dec.DecodeElement(&v, &se) == nil {
+				return strings.TrimSpace(v)
+			}
+			return ""
+		}
+	}
+}
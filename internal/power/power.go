@@ -0,0 +1,17 @@
+// Package power reports when the system resumes from sleep, after which
+// NAT mappings and server sessions have usually expired although the
+// client's sockets still look healthy.
+package power
+
+import (
+	"context"
+	"time"
+)
+
+// WatchResume calls fn each time the system resumes from sleep, until ctx
+// is done. fn is called on its own goroutine. Where the system does not
+// announce resumes, every is how often it looks for one, zero for a
+// default.
+func WatchResume(ctx context.Context, every time.Duration, fn func()) error {
+	return subscribe(ctx, every, func() { go fn() })
+}
@@ -0,0 +1,41 @@
+//go:build !windows
+
+package power
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// checkInterval is how often the clocks are compared by default; a
+	// sleep shorter than threshold goes unnoticed, which the keepalive covers.
+	checkInterval = 5 * time.Second
+	threshold     = 10 * time.Second
+)
+
+// subscribe notices a resume by the wall clock having run ahead of the
+// monotonic clock, which stops while the system sleeps.
+func subscribe(ctx context.Context, every time.Duration, notify func()) error {
+	if every <= 0 {
+		every = checkInterval
+	}
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			now := time.Now()
+			if now.Round(0).Sub(last.Round(0))-now.Sub(last) > threshold {
+				notify()
+			}
+			last = now
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,57 @@
+package power
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	powrprof       = windows.NewLazySystemDLL("powrprof.dll")
+	procRegister   = powrprof.NewProc("PowerRegisterSuspendResumeNotification")
+	procUnregister = powrprof.NewProc("PowerUnregisterSuspendResumeNotification")
+)
+
+const (
+	deviceNotifyCallback  = 2    // DEVICE_NOTIFY_CALLBACK
+	pbtAPMResumeAutomatic = 0x12 // PBT_APMRESUMEAUTOMATIC
+)
+
+// deviceNotifySubscribeParameters is DEVICE_NOTIFY_SUBSCRIBE_PARAMETERS.
+type deviceNotifySubscribeParameters struct {
+	callback uintptr
+	context  uintptr
+}
+
+// subscribe registers for power broadcasts with
+// PowerRegisterSuspendResumeNotification, which needs no window.
+// PBT_APMRESUMEAUTOMATIC is sent on every resume, whether or not a user is
+// present.
+func subscribe(ctx context.Context, _ time.Duration, notify func()) error {
+	if err := procRegister.Find(); err != nil {
+		return fmt.Errorf("power notifications: %w", err)
+	}
+	params := &deviceNotifySubscribeParameters{
+		callback: windows.NewCallback(func(_, typ, _ uintptr) uintptr {
+			if typ == pbtAPMResumeAutomatic {
+				notify()
+			}
+			return 0
+		}),
+	}
+	var handle uintptr
+	r, _, _ := procRegister.Call(deviceNotifyCallback, uintptr(unsafe.Pointer(params)), uintptr(unsafe.Pointer(&handle)))
+	if r != 0 {
+		return fmt.Errorf("power notifications: %w", windows.Errno(r))
+	}
+	go func() {
+		<-ctx.Done()
+		procUnregister.Call(handle)
+		runtime.KeepAlive(params)
+	}()
+	return nil
+}
@@ -0,0 +1,21 @@
+// Package powershell quotes values for the PowerShell scripts the Windows
+// setup runs, so names and paths from configs cannot break out of them.
+package powershell
+
+import "strings"
+
+// Quote returns s as a single-quoted PowerShell string. Only quotes are
+// special there, written twice; PowerShell takes the typographic ones too.
+func Quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range s {
+		switch r {
+		case '\'', '\u2018', '\u2019', '\u201a', '\u201b':
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
@@ -0,0 +1,19 @@
+package powershell
+
+import "testing"
+
+func TestQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                           "''",
+		"GoVPN":                      "'GoVPN'",
+		`C:\Program Files\GoVPN`:     `'C:\Program Files\GoVPN'`,
+		"it's":                       "'it''s'",
+		"x'; Remove-Item C:\\ -r; '": "'x''; Remove-Item C:\\ -r; '''",
+		"a\u2019b":                   "'a\u2019\u2019b'",
+		"$env:TEMP `n":               "'$env:TEMP `n'",
+	} {
+		if got := Quote(in); got != want {
+			t.Errorf("Quote(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"io"
+	"text/template"
+)
+
+var docTemplate = template.Must(template.New("doc").Parse(`# GoVPN wire protocol (version {{.Set.Version}})
+
+This file is generated by ` + "`gocli vectors -markdown`" + `. Do not edit it by hand.
+
+## Framing
+
+Every UDP datagram starts with a {{.HeaderSize}}-byte cleartext header:
+
+| Offset | Size | Field |
+|--------|------|-------|
+| 0 | 1 | message type |
+| 1 | 4 | receiver's session ID, big endian (0 before a session exists) |
+
+| Type | Name |
+|------|------|
+{{range .Types}}| {{printf "%d" .Value}} | {{.Name}} |
+{{end}}
+## Handshake
+
+The handshake key is HKDF-SHA256(PSK, salt = none, info = "{{.HandshakeInfo}}"), 32 bytes.
+Handshake bodies are JSON objects sealed with AES-256-GCM under that key. The
+payload after the header is a random 12-byte GCM nonce followed by the
+ciphertext and tag. There is no additional data.
+
+1. The client sends ` + "`handshake_init`" + ` carrying ` + "`version`, `min_version`" + `, a {{.NonceSize}}-byte
+   ` + "`nonce`" + ` (base64 in JSON) and a Unix ` + "`timestamp`" + `. Servers drop Hellos more than
+   {{.MaxClockSkew}} away from their clock, and Hellos whose nonce they took already,
+   except a retransmission from the address whose session it opened, which gets
+   the same answer again.
+2. The server answers with ` + "`handshake_resp`" + ` carrying the chosen ` + "`version`" + `, its own
+   ` + "`min_version`/`max_version`" + `, the new ` + "`session`" + ` ID and its ` + "`nonce`" + `. If there is no common
+   version it sets ` + "`error`" + ` and a zero session instead.
+
+A server short of capacity refuses new clients the same way, adding
+` + "`retry_after`" + `, the seconds to wait before trying again, and optionally
+` + "`alternate`" + `, the host:port of another server to try meanwhile. Both are
+sealed like the rest of the Welcome, so only a holder of the PSK can send a
+client elsewhere.
+
+## Session keys
+
+With salt = client nonce || server nonce:
+
+- client to server: HKDF-SHA256(PSK, salt, "{{.C2SInfo}}")
+- server to client: HKDF-SHA256(PSK, salt, "{{.S2CInfo}}")
+
+## Data and keepalive packets
+
+After the header comes an 8-byte big-endian sequence number, then the AES-256-GCM
+ciphertext and tag. The GCM nonce is four zero bytes followed by the sequence
+number. Sequence numbers start at 1 in each direction and receivers reject
+replays with a sliding window.
+
+Data packets carry one inner IP packet. Keepalives carry the sender's clock as
+8 bytes of big-endian Unix nanoseconds, and the server echoes them back in a
+keepalive ack. A client probing its NAT adds 2 bytes, a big-endian delay in
+seconds: the server then sends the ack that much later, to the address the
+keepalive came from, and replaces any delayed ack still waiting. Servers that
+do not know the delay ack at once, which the client takes as a refusal.
+
+## Path MTU
+
+A client that sets ` + "`mtu_probes`" + ` in its Hello answers probes of the path to it.
+A server sends an ` + "`mtu_probe`" + ` whose plaintext is as long as the tunnel MTU being
+tried: a 2-byte big-endian MTU followed by zeros. The client echoes the first 2
+bytes back in an ` + "`mtu_probe`" + ` of its own. An ` + "`mtu`" + ` packet carries a 2-byte big-endian
+tunnel MTU the client should use from then on, in place of the one in the
+Welcome. A Hello's ` + "`mtu`" + ` is the tunnel MTU that worked on the client's network
+last time. A server that probes may give the client that MTU in the Welcome,
+until its own search settles.
+
+## Transport migration
+
+A session is not tied to the transport it was handshaken on. A client checks
+another transport by sending a ` + "`path_probe`" + ` over it, whose plaintext is 8 random
+bytes. The server echoes them in a ` + "`path_probe`" + ` to where the probe came from.
+Probes do not move the session. Any other packet of the session that arrives
+through another listener does, if its sequence number is above that of the
+packet that last moved it, and the server answers that way from then on.
+
+## Relays
+
+Two p2p peers that cannot reach each other go through a relay. Each sends the
+relay a ` + "`relay`" + ` packet in session 0 whose payload is the link ID,
+HKDF-SHA256(PSK, salt = none, info = "{{.RelayInfo}}"), 32 bytes. The relay then
+forwards every other packet from one bound address to the other address bound
+to the same ID, unchanged.
+
+## Test vectors
+
+Produced from fixed inputs. The handshake GCM nonces are taken from the
+sequence 80 81 82 ... so the output is reproducible.
+
+| Input | Value |
+|-------|-------|
+| PSK | ` + "`{{.Set.PSK}}`" + ` |
+| client nonce | ` + "`{{.Set.ClientNonce}}`" + ` |
+| server nonce | ` + "`{{.Set.ServerNonce}}`" + ` |
+| session | ` + "`{{printf \"%08x\" .Set.Session}}`" + ` |
+| timestamp | ` + "`{{.Set.Timestamp}}`" + ` |
+| handshake key | ` + "`{{.Set.HandshakeKey}}`" + ` |
+| client to server key | ` + "`{{.Set.ClientToServerKey}}`" + ` |
+| server to client key | ` + "`{{.Set.ServerToClientKey}}`" + ` |
+{{range .Set.Vectors}}
+### {{.Name}} ({{.Direction}})
+
+Plaintext:
+
+` + "```" + `
+{{.Plaintext}}
+` + "```" + `
+
+Packet:
+
+` + "```" + `
+{{.Packet}}
+` + "```" + `
+{{end}}`))
+
+// WriteMarkdown renders a protocol description followed by the vectors in
+// set.
+func (set *VectorSet) WriteMarkdown(w io.Writer) error {
+	type msgType struct {
+		Value MessageType
+		Name  string
+	}
+	return docTemplate.Execute(w, map[string]any{
+		"Set":           set,
+		"HeaderSize":    HeaderSize,
+		"NonceSize":     NonceSize,
+		"MaxClockSkew":  MaxClockSkew,
+		"HandshakeInfo": HandshakeKeyInfo,
+		"C2SInfo":       ClientToServerKeyInfo,
+		"S2CInfo":       ServerToClientKeyInfo,
+		"RelayInfo":     RelayLinkInfo,
+		"Types": []msgType{
+			{MsgHandshakeInit, "handshake_init"},
+			{MsgHandshakeResp, "handshake_resp"},
+			{MsgData, "data"},
+			{MsgKeepalive, "keepalive"},
+			{MsgKeepaliveAck, "keepalive_ack"},
+			{MsgFEC, "fec"},
+			{MsgRelay, "relay"},
+			{MsgMTUProbe, "mtu_probe"},
+			{MsgMTU, "mtu"},
+			{MsgPathProbe, "path_probe"},
+		},
+	})
+}
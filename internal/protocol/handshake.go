@@ -0,0 +1,207 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"time"
+)
+
+// NonceSize is the length of the random nonces exchanged in the handshake.
+const NonceSize = 16
+
+// HKDF info labels of the key schedule. The handshake key is derived from
+// the PSK alone; the session keys from the PSK salted with the client nonce
+// followed by the server nonce. A p2p link's relay ID is derived from the
+// PSK alone too, and is no key: relays see it.
+const (
+	HandshakeKeyInfo      = "govpn handshake"
+	ClientToServerKeyInfo = "govpn client to server"
+	ServerToClientKeyInfo = "govpn server to client"
+	RelayLinkInfo         = "govpn relay link"
+)
+
+// MaxClockSkew bounds how old a Hello may be before the server drops it.
+const MaxClockSkew = 2 * time.Minute
+
+// Hello is the client's handshake initiation, sealed with the PSK-derived
+// handshake key so only holders of the PSK can produce or read it.
+type Hello struct {
+	Version    uint16 `json:"version"`
+	MinVersion uint16 `json:"min_version"`
+	Nonce      []byte `json:"nonce"`
+	Timestamp  int64  `json:"timestamp"`
+
+	// Lease asks the server for an address from its pool. Address is the
+	// lease held before a reconnect, which the server renews if it is free.
+	Lease   bool   `json:"lease,omitempty"`
+	Address string `json:"address,omitempty"`
+
+	// Static is the address, in CIDR form, a client without a lease moved
+	// to because its configured one collided with a subnet on its host, or
+	// the adapter address of a p2p peer.
+	Static string `json:"static,omitempty"`
+
+	// Lease6 asks for an IPv6 address as well, and Delegate for an IPv6
+	// prefix to route to a network behind the client. Address6 and Prefix
+	// are the ones held before a reconnect.
+	Lease6   bool   `json:"lease6,omitempty"`
+	Address6 string `json:"address6,omitempty"`
+	Delegate bool   `json:"delegate,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+
+	// Probe asks only whether the server would accept the client. It
+	// answers with a Welcome without a session and keeps no state.
+	Probe bool `json:"probe,omitempty"`
+
+	// FEC asks for forward error correction in both directions.
+	FEC *FEC `json:"fec,omitempty"`
+
+	// Name is a label for the client, such as its hostname, shown in the
+	// server's logs and client list. It is not an identity.
+	Name string `json:"name,omitempty"`
+
+	// Forwards asks the server to open ports and forward them to the
+	// client, like ssh -R.
+	Forwards []Forward `json:"forwards,omitempty"`
+
+	// FIPS says the client runs in fips_mode.
+	FIPS bool `json:"fips,omitempty"`
+
+	// MTUProbes says the client answers mtu_probe packets and takes the
+	// MTU from mtu packets, so a server may probe the path to it.
+	MTUProbes bool `json:"mtu_probes,omitempty"`
+
+	// MTU is the tunnel MTU that worked for the client on the network it
+	// is on, last time, for a server probing the path to start from.
+	MTU int `json:"mtu,omitempty"`
+
+	// Software is the client's release version, for the server's
+	// min_client_version and client list.
+	Software string `json:"software,omitempty"`
+
+	// User and Password log in to a server that checks logins with a
+	// service such as RADIUS. They travel sealed under the PSK.
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Forward is a server port forwarded to a port on the client's tunnel
+// address. In a Welcome, Error says why the server refused it.
+type Forward struct {
+	Protocol string `json:"protocol,omitempty"` // tcp or udp; tcp if empty
+	Port     uint16 `json:"port"`
+	To       uint16 `json:"to,omitempty"` // Port if zero
+	Error    string `json:"error,omitempty"`
+}
+
+// FEC is a forward error correction group shape: Data packets followed by
+// Parity repair packets.
+type FEC struct {
+	Data   int `json:"data"`
+	Parity int `json:"parity"`
+}
+
+// Range returns the versions advertised by the client.
+func (h *Hello) Range() VersionRange {
+	return VersionRange{Min: h.MinVersion, Max: h.Version}
+}
+
+// Welcome is the server's handshake response. On failure Error is set and
+// Session is zero; the version fields still carry the server's range so the
+// client can report what it needs to upgrade to.
+type Welcome struct {
+	Version    uint16 `json:"version"`
+	MinVersion uint16 `json:"min_version"`
+	MaxVersion uint16 `json:"max_version"`
+	Session    uint32 `json:"session"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	// Transcript is the Transcript of the Hello being answered. It ties
+	// the chosen version, and everything else here, to what the client
+	// offered, so a Welcome captured from another handshake cannot be
+	// replayed to steer the client onto an older version.
+	Transcript []byte `json:"transcript,omitempty"`
+
+	// Address is the leased tunnel address in CIDR form, set when the
+	// Hello asked for a lease. DNS lists resolvers the client should use.
+	Address string   `json:"address,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+
+	// Gateway is the server's own tunnel address, which answers pings.
+	Gateway string `json:"gateway,omitempty"`
+
+	// Domains are DNS search domains, MTU the tunnel MTU, and NTP time
+	// servers, pushed so clients need no configuration of their own.
+	Domains []string `json:"domains,omitempty"`
+	MTU     int      `json:"mtu,omitempty"`
+	NTP     []string `json:"ntp,omitempty"`
+
+	// Routes are prefixes the client should route into the tunnel on top
+	// of its own, from its profiles on the server.
+	Routes []string `json:"routes,omitempty"`
+
+	// Address6 is the IPv6 address given for a Lease6 request, in CIDR
+	// form, and Prefix the prefix delegated for a Delegate request.
+	Address6 string `json:"address6,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+
+	// FEC echoes the Hello's FEC request when the server accepted it.
+	FEC *FEC `json:"fec,omitempty"`
+
+	// Forwards answers the Hello's Forwards, one for one.
+	Forwards []Forward `json:"forwards,omitempty"`
+
+	// FIPS says the server runs in fips_mode.
+	FIPS bool `json:"fips,omitempty"`
+
+	// Software is the server's release version.
+	Software string `json:"software,omitempty"`
+
+	// MaxSession is the longest, in seconds, the server keeps a session
+	// before the client must handshake again.
+	MaxSession int64 `json:"max_session,omitempty"`
+
+	// RetryAfter, on a refusal from a server short of capacity, is how
+	// many seconds the client should wait before trying again. Alternate
+	// is another server, sharing the PSK, to try meanwhile.
+	RetryAfter int64  `json:"retry_after,omitempty"`
+	Alternate  string `json:"alternate,omitempty"`
+}
+
+// Range returns the versions supported by the server.
+func (w *Welcome) Range() VersionRange {
+	return VersionRange{Min: w.MinVersion, Max: w.MaxVersion}
+}
+
+// NewHello builds a Hello for this build's supported versions.
+func NewHello(nonce []byte, now time.Time) *Hello {
+	return &Hello{
+		Version:    Supported.Max,
+		MinVersion: Supported.Min,
+		Nonce:      nonce,
+		Timestamp:  now.Unix(),
+	}
+}
+
+// Transcript hashes a sealed Hello, as sent after the packet header.
+func Transcript(sealedHello []byte) []byte {
+	sum := sha256.Sum256(sealedHello)
+	return sum[:]
+}
+
+// Fresh reports whether the Hello was created within MaxClockSkew of now.
+func (h *Hello) Fresh(now time.Time) bool {
+	d := now.Sub(time.Unix(h.Timestamp, 0))
+	return d < MaxClockSkew && d > -MaxClockSkew
+}
+
+// Marshal encodes a handshake message body.
+func Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes a handshake message body.
+func Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,154 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Protocol versions spoken on the wire. Each peer advertises the range it
+// supports in the handshake and both sides settle on the highest common one.
+const (
+	Version1 uint16 = 1
+
+	// CurrentVersion is the newest version this build speaks.
+	CurrentVersion = Version1
+	// MinVersion is the oldest version this build still accepts.
+	MinVersion = Version1
+)
+
+// MessageType identifies the kind of packet carried in a datagram.
+type MessageType byte
+
+const (
+	MsgHandshakeInit MessageType = 1
+	MsgHandshakeResp MessageType = 2
+	MsgData          MessageType = 3
+	MsgKeepalive     MessageType = 4
+	MsgKeepaliveAck  MessageType = 5
+	// MsgFEC carries a forward error correction frame, data or repair, on
+	// sessions that negotiated FEC.
+	MsgFEC MessageType = 6
+	// MsgRelay binds its sender to a relay for the p2p link whose ID it
+	// carries. It goes between a peer and a relay only, in session 0.
+	MsgRelay MessageType = 7
+	// MsgMTUProbe is a server's padded probe of the path to a client, and
+	// the client's answer. MsgMTU tells the client the tunnel MTU the path
+	// allows.
+	MsgMTUProbe MessageType = 8
+	MsgMTU      MessageType = 9
+	// MsgPathProbe is a client's probe of another transport to the
+	// server, under the session's keys, and the server's echo of it.
+	MsgPathProbe MessageType = 10
+)
+
+// String names t for logs and debug transcripts.
+func (t MessageType) String() string {
+	switch t {
+	case MsgHandshakeInit:
+		return "handshake_init"
+	case MsgHandshakeResp:
+		return "handshake_resp"
+	case MsgData:
+		return "data"
+	case MsgKeepalive:
+		return "keepalive"
+	case MsgKeepaliveAck:
+		return "keepalive_ack"
+	case MsgFEC:
+		return "fec"
+	case MsgRelay:
+		return "relay"
+	case MsgMTUProbe:
+		return "mtu_probe"
+	case MsgMTU:
+		return "mtu"
+	case MsgPathProbe:
+		return "path_probe"
+	}
+	return fmt.Sprintf("type_%d", byte(t))
+}
+
+// Known reports whether t is a message type of this protocol.
+func (t MessageType) Known() bool {
+	return t >= MsgHandshakeInit && t <= MsgPathProbe
+}
+
+// HeaderSize is the length of the cleartext header in front of every packet.
+const HeaderSize = 5
+
+// ErrShortPacket is returned when a datagram is too small to hold a header.
+var ErrShortPacket = errors.New("protocol: packet too short")
+
+// ErrUpgradeRequired is matched by errors.Is for any version mismatch.
+var ErrUpgradeRequired = errors.New("upgrade required")
+
+// Header precedes every datagram: message type and the receiver's session ID.
+type Header struct {
+	Type    MessageType
+	Session uint32
+}
+
+// Append encodes h onto b.
+func (h Header) Append(b []byte) []byte {
+	b = append(b, byte(h.Type))
+	return binary.BigEndian.AppendUint32(b, h.Session)
+}
+
+// ParseHeader splits a datagram into its header and payload.
+func ParseHeader(b []byte) (Header, []byte, error) {
+	if len(b) < HeaderSize {
+		return Header{}, nil, ErrShortPacket
+	}
+	h := Header{
+		Type:    MessageType(b[0]),
+		Session: binary.BigEndian.Uint32(b[1:HeaderSize]),
+	}
+	return h, b[HeaderSize:], nil
+}
+
+// VersionRange is an inclusive range of protocol versions.
+type VersionRange struct {
+	Min uint16
+	Max uint16
+}
+
+// Supported is the range spoken by this build.
+var Supported = VersionRange{Min: MinVersion, Max: CurrentVersion}
+
+func (r VersionRange) String() string {
+	if r.Min == r.Max {
+		return fmt.Sprintf("v%d", r.Max)
+	}
+	return fmt.Sprintf("v%d-v%d", r.Min, r.Max)
+}
+
+// Contains reports whether v falls inside r.
+func (r VersionRange) Contains(v uint16) bool {
+	return v >= r.Min && v <= r.Max
+}
+
+// VersionError describes a handshake between peers with no common version.
+type VersionError struct {
+	Local VersionRange
+	Peer  VersionRange
+}
+
+func (e *VersionError) Error() string {
+	if e.Peer.Max < e.Local.Min {
+		return fmt.Sprintf("upgrade required: peer speaks %s, need at least v%d", e.Peer, e.Local.Min)
+	}
+	return fmt.Sprintf("upgrade required: peer requires v%d or newer, this build speaks %s", e.Peer.Min, e.Local)
+}
+
+func (e *VersionError) Is(target error) bool {
+	return target == ErrUpgradeRequired
+}
+
+// Negotiate picks the highest version supported by both ranges.
+func Negotiate(local, peer VersionRange) (uint16, error) {
+	if peer.Min > peer.Max || peer.Max < local.Min || peer.Min > local.Max {
+		return 0, &VersionError{Local: local, Peer: peer}
+	}
+	return min(local.Max, peer.Max), nil
+}
@@ -0,0 +1,323 @@
+package protocol
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+)
+
+// Directions a vector travels in.
+const (
+	ClientToServer = "client_to_server"
+	ServerToClient = "server_to_client"
+)
+
+// Vector is one known-good datagram together with the body that was sealed
+// into it. All byte strings are hex encoded.
+type Vector struct {
+	Name      string `json:"name"`
+	Direction string `json:"direction"`
+	Packet    string `json:"packet"`
+	Plaintext string `json:"plaintext"`
+}
+
+// VectorSet is a complete exchange produced from fixed inputs: a handshake
+// followed by data and keepalive packets in both directions. The derived keys
+// are included so implementations can check their key schedule first.
+type VectorSet struct {
+	Version           uint16   `json:"version"`
+	PSK               string   `json:"psk"`
+	ClientNonce       string   `json:"client_nonce"`
+	ServerNonce       string   `json:"server_nonce"`
+	Session           uint32   `json:"session"`
+	Timestamp         int64    `json:"timestamp"`
+	HandshakeKey      string   `json:"handshake_key"`
+	ClientToServerKey string   `json:"client_to_server_key"`
+	ServerToClientKey string   `json:"server_to_client_key"`
+	Vectors           []Vector `json:"vectors"`
+}
+
+// Fixed inputs for GenerateVectors.
+const (
+	vectorPSK       = "govpn-test-vector-psk"
+	vectorSession   = 0x0a0b0c0d
+	vectorTimestamp = 1700000000
+)
+
+// knownVectors is the output of GenerateVectors for the current wire format,
+// checked in so refactors that change a single byte are caught.
+//
+//go:embed testdata/vectors.json
+var knownVectors []byte
+
+// GenerateVectors builds the reference VectorSet. The output depends only on
+// the wire format and key schedule, never on the clock or the CSPRNG.
+func GenerateVectors() (*VectorSet, error) {
+	clientNonce := sequence(0x00, NonceSize)
+	serverNonce := sequence(0x10, NonceSize)
+	keys, err := vectorKeys(vectorPSK, clientNonce, serverNonce)
+	if err != nil {
+		return nil, err
+	}
+	// Handshake AEAD nonces are normally random; here they come from a
+	// fixed stream, one 12-byte nonce per sealed message.
+	hs, err := crypto.NewCipherWithRand(keys.handshake, bytes.NewReader(sequence(0x80, 3*12)))
+	if err != nil {
+		return nil, err
+	}
+	c2s, err := crypto.NewSessionCipher(keys.c2s)
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := crypto.NewSessionCipher(keys.s2c)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &VectorSet{
+		Version:           CurrentVersion,
+		PSK:               vectorPSK,
+		ClientNonce:       hex.EncodeToString(clientNonce),
+		ServerNonce:       hex.EncodeToString(serverNonce),
+		Session:           vectorSession,
+		Timestamp:         vectorTimestamp,
+		HandshakeKey:      hex.EncodeToString(keys.handshake),
+		ClientToServerKey: hex.EncodeToString(keys.c2s),
+		ServerToClientKey: hex.EncodeToString(keys.s2c),
+	}
+	add := func(name, dir string, pkt, plain []byte) {
+		set.Vectors = append(set.Vectors, Vector{
+			Name:      name,
+			Direction: dir,
+			Packet:    hex.EncodeToString(pkt),
+			Plaintext: hex.EncodeToString(plain),
+		})
+	}
+
+	hello := &Hello{Version: Supported.Max, MinVersion: Supported.Min, Nonce: clientNonce, Timestamp: vectorTimestamp}
+	welcome := &Welcome{
+		Version:    CurrentVersion,
+		MinVersion: Supported.Min,
+		MaxVersion: Supported.Max,
+		Session:    vectorSession,
+		Nonce:      serverNonce,
+	}
+	reject := &Welcome{
+		Version:    CurrentVersion,
+		MinVersion: Supported.Min,
+		MaxVersion: Supported.Max,
+		Error:      (&VersionError{Local: Supported, Peer: VersionRange{Min: 0xfffe, Max: 0xffff}}).Error(),
+	}
+	for _, m := range []struct {
+		name    string
+		dir     string
+		t       MessageType
+		session uint32
+		msg     any
+	}{
+		{"handshake_init", ClientToServer, MsgHandshakeInit, 0, hello},
+		{"handshake_resp", ServerToClient, MsgHandshakeResp, vectorSession, welcome},
+		{"handshake_resp_error", ServerToClient, MsgHandshakeResp, 0, reject},
+	} {
+		body, err := Marshal(m.msg)
+		if err != nil {
+			return nil, err
+		}
+		hdr := Header{Type: m.t, Session: m.session}
+		pkt, err := hs.EncryptAppend(hdr.Append(nil), body)
+		if err != nil {
+			return nil, err
+		}
+		add(m.name, m.dir, pkt, body)
+	}
+
+	ping := binary.BigEndian.AppendUint64(nil, uint64(vectorTimestamp)*1e9)
+	for _, m := range []struct {
+		name string
+		dir  string
+		t    MessageType
+		c    *crypto.SessionCipher
+		body []byte
+	}{
+		{"data_client_to_server", ClientToServer, MsgData, c2s, vectorIPv4(1)},
+		{"data_server_to_client", ServerToClient, MsgData, s2c, vectorIPv4(2)},
+		{"keepalive", ClientToServer, MsgKeepalive, c2s, ping},
+		{"keepalive_ack", ServerToClient, MsgKeepaliveAck, s2c, ping},
+	} {
+		hdr := Header{Type: m.t, Session: vectorSession}
+		pkt, err := m.c.EncryptAppend(hdr.Append(nil), m.body)
+		if err != nil {
+			return nil, err
+		}
+		add(m.name, m.dir, pkt, m.body)
+	}
+	return set, nil
+}
+
+// KnownVectors returns the checked-in reference vectors.
+func KnownVectors() (*VectorSet, error) {
+	var set VectorSet
+	if err := json.Unmarshal(knownVectors, &set); err != nil {
+		return nil, fmt.Errorf("known vectors: %w", err)
+	}
+	return &set, nil
+}
+
+// VerifyVectors checks that this build still produces the checked-in
+// vectors and can open every one of them.
+func VerifyVectors() error {
+	known, err := KnownVectors()
+	if err != nil {
+		return err
+	}
+	if err := CheckVectors(known); err != nil {
+		return err
+	}
+	got, err := GenerateVectors()
+	if err != nil {
+		return err
+	}
+	a, _ := json.Marshal(got)
+	b, _ := json.Marshal(known)
+	if !bytes.Equal(a, b) {
+		return fmt.Errorf("generated vectors differ from testdata/vectors.json; the wire format has changed")
+	}
+	return nil
+}
+
+// CheckVectors validates set the way a receiver would: it re-derives the keys
+// from the PSK and nonces, parses each header, and opens each packet to the
+// recorded plaintext. Packets must appear in send order per direction.
+func CheckVectors(set *VectorSet) error {
+	clientNonce, err := hex.DecodeString(set.ClientNonce)
+	if err != nil {
+		return fmt.Errorf("client nonce: %w", err)
+	}
+	serverNonce, err := hex.DecodeString(set.ServerNonce)
+	if err != nil {
+		return fmt.Errorf("server nonce: %w", err)
+	}
+	keys, err := vectorKeys(set.PSK, clientNonce, serverNonce)
+	if err != nil {
+		return err
+	}
+	for name, k := range map[string]struct {
+		got  []byte
+		want string
+	}{
+		"handshake":        {keys.handshake, set.HandshakeKey},
+		"client to server": {keys.c2s, set.ClientToServerKey},
+		"server to client": {keys.s2c, set.ServerToClientKey},
+	} {
+		if hex.EncodeToString(k.got) != k.want {
+			return fmt.Errorf("%s key mismatch", name)
+		}
+	}
+
+	hs, err := crypto.NewCipher(keys.handshake)
+	if err != nil {
+		return err
+	}
+	recv := map[string]*crypto.SessionCipher{}
+	if recv[ClientToServer], err = crypto.NewSessionCipher(keys.c2s); err != nil {
+		return err
+	}
+	if recv[ServerToClient], err = crypto.NewSessionCipher(keys.s2c); err != nil {
+		return err
+	}
+
+	for _, v := range set.Vectors {
+		pkt, err := hex.DecodeString(v.Packet)
+		if err != nil {
+			return fmt.Errorf("%s: %w", v.Name, err)
+		}
+		h, payload, err := ParseHeader(pkt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", v.Name, err)
+		}
+		var plain []byte
+		switch h.Type {
+		case MsgHandshakeInit, MsgHandshakeResp:
+			plain, err = hs.Decrypt(payload)
+		case MsgData, MsgKeepalive, MsgKeepaliveAck:
+			c := recv[v.Direction]
+			if c == nil {
+				return fmt.Errorf("%s: unknown direction %q", v.Name, v.Direction)
+			}
+			if h.Session != set.Session {
+				return fmt.Errorf("%s: session %08x, want %08x", v.Name, h.Session, set.Session)
+			}
+			plain, _, err = c.Decrypt(payload)
+		default:
+			return fmt.Errorf("%s: unknown message type %d", v.Name, h.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", v.Name, err)
+		}
+		if hex.EncodeToString(plain) != v.Plaintext {
+			return fmt.Errorf("%s: plaintext mismatch", v.Name)
+		}
+	}
+	return nil
+}
+
+type vectorKeySchedule struct {
+	handshake, c2s, s2c []byte
+}
+
+func vectorKeys(psk string, clientNonce, serverNonce []byte) (vectorKeySchedule, error) {
+	var k vectorKeySchedule
+	var err error
+	if k.handshake, err = crypto.DeriveKey([]byte(psk), nil, HandshakeKeyInfo); err != nil {
+		return k, err
+	}
+	salt := append(append([]byte{}, clientNonce...), serverNonce...)
+	if k.c2s, err = crypto.DeriveKey([]byte(psk), salt, ClientToServerKeyInfo); err != nil {
+		return k, err
+	}
+	if k.s2c, err = crypto.DeriveKey([]byte(psk), salt, ServerToClientKeyInfo); err != nil {
+		return k, err
+	}
+	return k, nil
+}
+
+// vectorIPv4 is a minimal IPv4/ICMP echo packet between 10.99.0.2 and
+// 10.99.0.1; id distinguishes the two directions.
+func vectorIPv4(id byte) []byte {
+	pkt := []byte{
+		0x45, 0x00, 0x00, 0x1c, 0x00, id, 0x00, 0x00, 0x40, 0x01, 0x00, 0x00,
+		10, 99, 0, 2, 10, 99, 0, 1,
+		0x08, 0x00, 0x00, 0x00, 0x00, id, 0x00, 0x01,
+	}
+	if id == 2 {
+		pkt[15], pkt[19] = 1, 2
+		pkt[20] = 0x00 // echo reply
+	}
+	binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:20]))
+	binary.BigEndian.PutUint16(pkt[22:], checksum(pkt[20:]))
+	return pkt
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func sequence(start byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+	return b
+}
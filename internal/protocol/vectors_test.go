@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestVectors checks that GenerateVectors still reproduces the checked-in
+// vectors byte for byte, and that they open the way a receiver would.
+func TestVectors(t *testing.T) {
+	data, err := os.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want VectorSet
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckVectors(&want); err != nil {
+		t.Fatalf("testdata/vectors.json: %v", err)
+	}
+
+	got, err := GenerateVectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Vectors) != len(want.Vectors) {
+		t.Fatalf("generated %d vectors, testdata has %d", len(got.Vectors), len(want.Vectors))
+	}
+	for i, v := range got.Vectors {
+		if v != want.Vectors[i] {
+			t.Errorf("vector %s:\n got %+v\nwant %+v", v.Name, v, want.Vectors[i])
+		}
+	}
+	got.Vectors, want.Vectors = nil, nil
+	if !reflect.DeepEqual(got, &want) {
+		t.Errorf("inputs or keys:\n got %+v\nwant %+v", got, &want)
+	}
+}
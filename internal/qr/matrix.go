@@ -0,0 +1,254 @@
+package qr
+
+// builder is a Code under construction; function marks modules reserved
+// for patterns, which data and masks leave alone.
+type builder struct {
+	*Code
+	function [][]bool
+}
+
+func newCode(ver int) *builder {
+	size := 4*ver + 17
+	b := &builder{Code: &Code{Version: ver, Size: size}}
+	b.modules = make([][]bool, size)
+	b.function = make([][]bool, size)
+	for i := range b.modules {
+		b.modules[i] = make([]bool, size)
+		b.function[i] = make([]bool, size)
+	}
+
+	// Timing patterns.
+	for i := 0; i < size; i++ {
+		b.set(6, i, i%2 == 0)
+		b.set(i, 6, i%2 == 0)
+	}
+	// Finder patterns and their separators.
+	for _, p := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := p[0]+dx, p[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					d := max(abs(dx), abs(dy))
+					b.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	// Alignment patterns, except where they would overlap a finder.
+	pos := alignmentPositions(ver)
+	n := len(pos)
+	for i := range pos {
+		for j := range pos {
+			if i == 0 && j == 0 || i == 0 && j == n-1 || i == n-1 && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					b.set(pos[i]+dx, pos[j]+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	b.drawFormat(0) // reserve the area; the real bits come after masking
+	b.drawVersion()
+	return b
+}
+
+func (b *builder) set(x, y int, dark bool) {
+	b.modules[y][x] = dark
+	b.function[y][x] = true
+}
+
+func alignmentPositions(ver int) []int {
+	if ver == 1 {
+		return nil
+	}
+	n := ver/7 + 2
+	step := (ver*8 + n*3 + 5) / (n*4 - 4) * 2
+	pos := make([]int, n)
+	pos[0] = 6
+	for i, p := n-1, 4*ver+17-7; i >= 1; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+// drawFormat writes both copies of the format information for mask.
+func (b *builder) drawFormat(mask int) {
+	data := formatLevelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		b.set(8, i, bit(i))
+	}
+	b.set(8, 7, bit(6))
+	b.set(8, 8, bit(7))
+	b.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		b.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		b.set(b.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		b.set(8, b.Size-15+i, bit(i))
+	}
+	b.set(8, b.Size-8, true) // always dark
+}
+
+// drawVersion writes both copies of the version information from version 7.
+func (b *builder) drawVersion() {
+	if b.Version < 7 {
+		return
+	}
+	rem := b.Version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1f25
+	}
+	bits := b.Version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>i&1 != 0
+		x, y := b.Size-11+i%3, i/3
+		b.set(x, y, dark)
+		b.set(y, x, dark)
+	}
+}
+
+// drawCodewords places data in the zigzag order, two columns at a time
+// from the bottom right, skipping the vertical timing pattern.
+func (b *builder) drawCodewords(data []byte) {
+	i := 0
+	for right := b.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < b.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = b.Size - 1 - vert
+				}
+				if !b.function[y][x] && i < len(data)*8 {
+					b.modules[y][x] = data[i>>3]>>(7-i&7)&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask XORs mask pattern m over the data modules; applying it twice
+// restores them.
+func (b *builder) applyMask(m int) {
+	for y := 0; y < b.Size; y++ {
+		for x := 0; x < b.Size; x++ {
+			var invert bool
+			switch m {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !b.function[y][x] {
+				b.modules[y][x] = !b.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol by the four rules of the standard: long runs,
+// 2x2 blocks, finder-like patterns, and dark/light imbalance.
+func (b *builder) penalty() int {
+	size := b.Size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return b.modules[x][y]
+		}
+		return b.modules[y][x]
+	}
+	score := 0
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < size; y++ {
+			run := 0
+			for x := 0; x < size; x++ {
+				if x > 0 && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					score += 3
+				} else if run > 5 {
+					score++
+				}
+			}
+			// 1:1:3:1:1 dark-light pattern with four light modules on
+			// either side; outside the symbol counts as light.
+			light := func(x int) bool { return x < 0 || x >= size || !at(x, y, transpose) }
+			for x := -4; x+10 < size; x++ {
+				core := [7]bool{true, false, true, true, true, false, true}
+				match := true
+				for k, dark := range core {
+					if light(x+4+k) == dark {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				before, after := true, true
+				for k := 0; k < 4; k++ {
+					before = before && light(x+k)
+					after = after && light(x+11+k)
+				}
+				if before || after {
+					score += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if b.modules[y][x] {
+				dark++
+			}
+			if x+1 < size && y+1 < size {
+				c := b.modules[y][x]
+				if c == b.modules[y][x+1] && c == b.modules[y+1][x] && c == b.modules[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+	total := size * size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return score + max(k, 0)*10
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,249 @@
+// Package radius is a RADIUS client for PAP logins, as described in RFC
+// 2865, with the Message-Authenticator of RFC 3579.
+package radius
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Packet codes.
+const (
+	CodeAccessRequest   = 1
+	CodeAccessAccept    = 2
+	CodeAccessReject    = 3
+	CodeAccessChallenge = 11
+)
+
+// Attribute types.
+const (
+	AttrUserName             = 1
+	AttrUserPassword         = 2
+	AttrFramedIPAddress      = 8
+	AttrFilterID             = 11
+	AttrReplyMessage         = 18
+	AttrClass                = 25
+	AttrSessionTimeout       = 27
+	AttrCallingStationID     = 31
+	AttrNASIdentifier        = 32
+	AttrNASPortType          = 61
+	AttrMessageAuthenticator = 80
+)
+
+// nasPortVirtual is the NAS-Port-Type of a VPN.
+const nasPortVirtual = 5
+
+const (
+	headerLen = 20
+	maxLen    = 4096
+	// maxPassword is the longest User-Password RFC 2865 allows.
+	maxPassword = 128
+)
+
+// ErrTimeout is returned when no server answered.
+var ErrTimeout = errors.New("radius: no server answered")
+
+// Client sends Access-Requests to a list of servers, moving to the next
+// when one does not answer.
+type Client struct {
+	Servers       []string // host:port, usually port 1812
+	Secret        string
+	NASIdentifier string
+	Timeout       time.Duration // per attempt
+	Retries       int           // attempts per server
+}
+
+// Attribute is one attribute of a packet.
+type Attribute struct {
+	Type  byte
+	Value []byte
+}
+
+// Response is a server's answer.
+type Response struct {
+	Code       byte
+	Attributes []Attribute
+}
+
+// Get returns the values of the attributes of type t.
+func (r *Response) Get(t byte) [][]byte {
+	var out [][]byte
+	for _, a := range r.Attributes {
+		if a.Type == t {
+			out = append(out, a.Value)
+		}
+	}
+	return out
+}
+
+// Authenticate asks the servers whether user may log in with password.
+// caller, if set, is sent as the Calling-Station-Id.
+func (c *Client) Authenticate(ctx context.Context, user, password, caller string) (*Response, error) {
+	if len(password) > maxPassword {
+		return nil, fmt.Errorf("radius: password longer than %d bytes", maxPassword)
+	}
+	var lastErr error = ErrTimeout
+	for _, server := range c.Servers {
+		for range max(c.Retries, 1) {
+			resp, err := c.exchange(ctx, server, user, password, caller)
+			if err == nil {
+				return resp, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ErrTimeout
+			}
+			var nerr net.Error
+			if !errors.As(err, &nerr) || !nerr.Timeout() {
+				lastErr = err
+				break
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+// exchange sends one Access-Request to server and reads its answer. A
+// fresh request authenticator and identifier are used each time.
+func (c *Client) exchange(ctx context.Context, server, user, password, caller string) (*Response, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("radius: %w", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(c.Timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	conn.SetDeadline(deadline)
+
+	var auth [16]byte
+	var id [1]byte
+	rand.Read(auth[:])
+	rand.Read(id[:])
+	req := c.request(id[0], auth, user, password, caller)
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("radius: %w", err)
+	}
+	buf := make([]byte, maxLen)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if resp, err := c.parse(buf[:n], id[0], auth); err == nil {
+			return resp, nil
+		}
+		// Anything else is a stray or forged answer; keep waiting.
+	}
+}
+
+// request builds an Access-Request.
+func (c *Client) request(id byte, auth [16]byte, user, password, caller string) []byte {
+	pkt := []byte{CodeAccessRequest, id, 0, 0}
+	pkt = append(pkt, auth[:]...)
+	// The Message-Authenticator goes first, so a server cannot be tricked
+	// into accepting a packet that lacks it.
+	msgAuthAt := len(pkt) + 2
+	pkt = appendAttr(pkt, AttrMessageAuthenticator, make([]byte, 16))
+	pkt = appendAttr(pkt, AttrUserName, []byte(user))
+	pkt = appendAttr(pkt, AttrUserPassword, hidePassword(password, c.Secret, auth))
+	if c.NASIdentifier != "" {
+		pkt = appendAttr(pkt, AttrNASIdentifier, []byte(c.NASIdentifier))
+	}
+	if caller != "" {
+		pkt = appendAttr(pkt, AttrCallingStationID, []byte(caller))
+	}
+	pkt = appendAttr(pkt, AttrNASPortType, binary.BigEndian.AppendUint32(nil, nasPortVirtual))
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	mac := hmac.New(md5.New, []byte(c.Secret))
+	mac.Write(pkt)
+	copy(pkt[msgAuthAt:], mac.Sum(nil))
+	return pkt
+}
+
+// parse checks an answer to the request with id and authenticator auth.
+func (c *Client) parse(pkt []byte, id byte, auth [16]byte) (*Response, error) {
+	if len(pkt) < headerLen || pkt[1] != id {
+		return nil, errors.New("radius: not an answer to this request")
+	}
+	length := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if length < headerLen || length > len(pkt) {
+		return nil, errors.New("radius: bad length")
+	}
+	pkt = pkt[:length]
+
+	// Response Authenticator: MD5(Code+ID+Length+RequestAuth+Attributes+Secret).
+	h := md5.New()
+	h.Write(pkt[:4])
+	h.Write(auth[:])
+	h.Write(pkt[headerLen:])
+	h.Write([]byte(c.Secret))
+	if !hmac.Equal(h.Sum(nil), pkt[4:headerLen]) {
+		return nil, errors.New("radius: bad response authenticator")
+	}
+
+	resp := &Response{Code: pkt[0]}
+	for rest := pkt[headerLen:]; len(rest) > 0; {
+		if len(rest) < 2 || rest[1] < 2 || int(rest[1]) > len(rest) {
+			return nil, errors.New("radius: malformed attribute")
+		}
+		a := Attribute{Type: rest[0], Value: rest[2:rest[1]]}
+		if a.Type == AttrMessageAuthenticator {
+			if !c.checkMessageAuthenticator(pkt, auth, len(pkt)-len(rest)+2) {
+				return nil, errors.New("radius: bad message authenticator")
+			}
+		}
+		resp.Attributes = append(resp.Attributes, a)
+		rest = rest[rest[1]:]
+	}
+	return resp, nil
+}
+
+// checkMessageAuthenticator verifies the Message-Authenticator whose value
+// starts at off in pkt, an answer to the request with authenticator auth.
+func (c *Client) checkMessageAuthenticator(pkt []byte, auth [16]byte, off int) bool {
+	if off+16 > len(pkt) {
+		return false
+	}
+	tmp := bytes.Clone(pkt)
+	copy(tmp[4:headerLen], auth[:])
+	clear(tmp[off : off+16])
+	mac := hmac.New(md5.New, []byte(c.Secret))
+	mac.Write(tmp)
+	return hmac.Equal(mac.Sum(nil), pkt[off:off+16])
+}
+
+func appendAttr(pkt []byte, t byte, v []byte) []byte {
+	if len(v) > 253 {
+		v = v[:253] // an attribute holds no more; nothing sent here is that long
+	}
+	pkt = append(pkt, t, byte(len(v)+2))
+	return append(pkt, v...)
+}
+
+// hidePassword encodes a User-Password as in RFC 2865 section 5.2.
+func hidePassword(password, secret string, auth [16]byte) []byte {
+	p := []byte(password)
+	p = append(p, make([]byte, max(16, (len(p)+15)/16*16)-len(p))...)
+	prev := auth[:]
+	for i := 0; i < len(p); i += 16 {
+		h := md5.New()
+		h.Write([]byte(secret))
+		h.Write(prev)
+		b := h.Sum(nil)
+		for j := range 16 {
+			p[i+j] ^= b[j]
+		}
+		prev = p[i : i+16]
+	}
+	return p
+}
@@ -0,0 +1,77 @@
+// Package ratelog collapses repeated log lines, so a broken or hostile peer
+// that triggers the same error thousands of times a second produces one
+// line and a periodic count instead of filling the disk.
+package ratelog
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultWindow is how long repeats of a line are counted before they are
+// reported.
+const DefaultWindow = 10 * time.Second
+
+// maxLines bounds the distinct lines tracked in a window. Lines beyond it,
+// as from a flood with spoofed sources, are counted together.
+const maxLines = 1024
+
+// overflow is the key lines beyond maxLines are counted under.
+const overflow = "\x00overflow"
+
+// Limiter logs each distinct line once per window, then a summary of how
+// often it repeated.
+type Limiter struct {
+	window time.Duration
+	mu     sync.Mutex
+	lines  map[string]int // repeats suppressed in the current window
+}
+
+// New returns a Limiter with the given window.
+func New(window time.Duration) *Limiter {
+	return &Limiter{window: window, lines: make(map[string]int)}
+}
+
+// Printf formats like log.Printf. The first occurrence of a line is logged
+// at once; repeats within the window are counted and reported in one line
+// when it closes.
+func (l *Limiter) Printf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	key := msg
+	l.mu.Lock()
+	if _, seen := l.lines[key]; !seen && len(l.lines) >= maxLines {
+		key = overflow
+	}
+	n, seen := l.lines[key]
+	switch {
+	case seen:
+		l.lines[key] = n + 1
+	case key == overflow:
+		l.lines[key] = 1
+	default:
+		l.lines[key] = 0
+	}
+	if !seen {
+		time.AfterFunc(l.window, func() { l.flush(key) })
+	}
+	l.mu.Unlock()
+	if !seen && key != overflow {
+		log.Print(msg)
+	}
+}
+
+// flush reports the repeats counted under key and starts a new window.
+func (l *Limiter) flush(key string) {
+	l.mu.Lock()
+	n := l.lines[key]
+	delete(l.lines, key)
+	l.mu.Unlock()
+	switch {
+	case key == overflow:
+		log.Printf("%d more log lines suppressed in last %s", n, l.window)
+	case n > 0:
+		log.Printf("%s (×%d more in last %s)", key, n, l.window)
+	}
+}
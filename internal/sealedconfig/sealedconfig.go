@@ -0,0 +1,148 @@
+// Package sealedconfig encrypts whole config files at rest, under a
+// passphrase or with the platform key store, for machines other people can
+// read files on.
+package sealedconfig
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/gedons/go_VPN/internal/keystore"
+	"gopkg.in/yaml.v2"
+)
+
+// Methods a config can be sealed with.
+const (
+	Passphrase = "passphrase" // AES-256-GCM under a PBKDF2-SHA256 key
+	KeyStore   = "keystore"   // the platform key store, as for protected_psk
+)
+
+// iterations is the PBKDF2 work factor for new seals; OWASP's 2023
+// recommendation for SHA-256.
+const iterations = 600000
+
+// ErrNoPassphrase is returned by Open for a passphrase-sealed config when no
+// passphrase was given.
+var ErrNoPassphrase = errors.New("config is encrypted with a passphrase")
+
+// ErrWrongPassphrase is returned by Open when the passphrase does not open
+// the config, or the file was altered.
+var ErrWrongPassphrase = errors.New("wrong passphrase or damaged config")
+
+// envelope is the YAML a sealed config is stored as, so a glance at the
+// file says what it is.
+type envelope struct {
+	Encrypted *sealed `yaml:"encrypted_config"`
+}
+
+type sealed struct {
+	Method     string `yaml:"method"`
+	Iterations int    `yaml:"iterations,omitempty"`
+	Salt       string `yaml:"salt,omitempty"`
+	Data       string `yaml:"data"`
+}
+
+// IsSealed reports whether data is a config sealed by Seal.
+func IsSealed(data []byte) bool {
+	var env envelope
+	return yaml.Unmarshal(data, &env) == nil && env.Encrypted != nil
+}
+
+// Seal encrypts the config plain with method. passphrase is only used by
+// the Passphrase method and must not be empty for it.
+func Seal(plain []byte, method, passphrase string) ([]byte, error) {
+	s := &sealed{Method: method}
+	switch method {
+	case Passphrase:
+		if passphrase == "" {
+			return nil, ErrNoPassphrase
+		}
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		aead, err := passphraseAEAD(passphrase, salt, iterations)
+		if err != nil {
+			return nil, err
+		}
+		s.Iterations = iterations
+		s.Salt = base64.StdEncoding.EncodeToString(salt)
+		s.Data = base64.StdEncoding.EncodeToString(aead.Seal(nil, nil, plain, []byte(method)))
+	case KeyStore:
+		data, err := keystore.Protect(plain)
+		if err != nil {
+			return nil, err
+		}
+		s.Data = data
+	default:
+		return nil, fmt.Errorf("unknown method %q", method)
+	}
+	return yaml.Marshal(envelope{Encrypted: s})
+}
+
+// Open decrypts a config sealed by Seal. passphrase is only used for the
+// Passphrase method.
+func Open(data []byte, passphrase string) ([]byte, error) {
+	var env envelope
+	if err := yaml.Unmarshal(data, &env); err != nil || env.Encrypted == nil {
+		return nil, errors.New("not an encrypted config")
+	}
+	s := env.Encrypted
+	switch s.Method {
+	case Passphrase:
+		if passphrase == "" {
+			return nil, ErrNoPassphrase
+		}
+		salt, err := base64.StdEncoding.DecodeString(s.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("salt: %w", err)
+		}
+		ct, err := base64.StdEncoding.DecodeString(s.Data)
+		if err != nil {
+			return nil, fmt.Errorf("data: %w", err)
+		}
+		if s.Iterations <= 0 {
+			return nil, fmt.Errorf("invalid iterations %d", s.Iterations)
+		}
+		aead, err := passphraseAEAD(passphrase, salt, s.Iterations)
+		if err != nil {
+			return nil, err
+		}
+		plain, err := aead.Open(nil, nil, ct, []byte(s.Method))
+		if err != nil {
+			return nil, ErrWrongPassphrase
+		}
+		return plain, nil
+	case KeyStore:
+		return keystore.Unprotect(s.Data)
+	default:
+		return nil, fmt.Errorf("unknown method %q", s.Method)
+	}
+}
+
+// Method returns the method a sealed config was sealed with.
+func Method(data []byte) string {
+	var env envelope
+	if yaml.Unmarshal(data, &env) != nil || env.Encrypted == nil {
+		return ""
+	}
+	return env.Encrypted.Method
+}
+
+func passphraseAEAD(passphrase string, salt []byte, iter int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iter, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithRandomNonce(block)
+}
@@ -0,0 +1,174 @@
+// Package socks is a small SOCKS5 server (RFC 1928) supporting CONNECT
+// without authentication, for handing local applications connections made
+// some other way than through the host's network.
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DialFunc opens a connection, as net.Dialer.DialContext does.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// handshakeTimeout bounds the negotiation and the dial it asks for.
+const handshakeTimeout = 30 * time.Second
+
+// Reply codes.
+const (
+	replyOK              = 0
+	replyFailure         = 1
+	replyNetUnreachable  = 3
+	replyHostUnreachable = 4
+	replyRefused         = 5
+	replyNotSupported    = 7
+	replyAddrUnsupported = 8
+)
+
+// Serve accepts SOCKS5 clients on ln until ctx is done, connecting each to
+// the destination it asks for with dial.
+func Serve(ctx context.Context, ln net.Listener, dial DialFunc) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("SOCKS accept error: %v", err)
+			}
+			return
+		}
+		go handle(ctx, conn, dial)
+	}
+}
+
+func handle(ctx context.Context, conn net.Conn, dial DialFunc) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	// Greeting: version, then the authentication methods offered.
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil || hdr[0] != 5 {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == 0
+	}
+	if !noAuth {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	// Request: version, command, reserved, then the destination.
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil || req[0] != 5 {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1, 4:
+		b := make([]byte, 4+int(req[3]>>2)*12)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		a, _ := netip.AddrFromSlice(b)
+		host = a.String()
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		host = string(b)
+	default:
+		reply(conn, replyAddrUnsupported, nil)
+		return
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return
+	}
+	if req[1] != 1 {
+		reply(conn, replyNotSupported, nil)
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+
+	dctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	upstream, err := dial(dctx, "tcp", target)
+	cancel()
+	if err != nil {
+		log.Printf("SOCKS connect to %s: %v", target, err)
+		reply(conn, replyCode(err), nil)
+		return
+	}
+	defer upstream.Close()
+	if err := reply(conn, replyOK, upstream.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}
+	go pipe(upstream, conn)
+	go pipe(conn, upstream)
+	wg.Wait()
+}
+
+// reply sends a reply with the bound address, or 0.0.0.0:0.
+func reply(conn net.Conn, code byte, bound net.Addr) error {
+	ap := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	if a, ok := bound.(interface{ AddrPort() netip.AddrPort }); ok {
+		ap = a.AddrPort()
+	}
+	b := []byte{5, code, 0, 1}
+	if ap.Addr().Is6() && !ap.Addr().Is4In6() {
+		b[3] = 4
+	}
+	b = append(b, ap.Addr().Unmap().AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, ap.Port())
+	_, err := conn.Write(b)
+	return err
+}
+
+func replyCode(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return replyRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return replyNetUnreachable
+	case errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return replyHostUnreachable
+	}
+	return replyFailure
+}
@@ -0,0 +1,165 @@
+// Package ssdp lets GoVPN servers on a local network be found without
+// configuration. A server answers SSDP searches (the discovery half of
+// UPnP) for its own service type with its port, name, and transport; a
+// client multicasts a search and collects the answers.
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ServiceType is the search target GoVPN servers answer to.
+	ServiceType = "urn:gedons-govpn:service:server:1"
+
+	// Port is the UDP port searches are multicast to.
+	Port = 1900
+
+	groupAddr = "239.255.255.250:1900" // must match Port
+	maxAge    = 1800
+)
+
+// Service describes the server being announced.
+type Service struct {
+	Name          string
+	Port          uint16
+	Transport     string
+	Encapsulation string // empty for none
+}
+
+// Server is a GoVPN server found on the network.
+type Server struct {
+	Name          string
+	Endpoint      netip.AddrPort // source address of the answer, with the server's port
+	Transport     string
+	Encapsulation string
+}
+
+// Serve answers searches for ServiceType, and for ssdp:all, until ctx is
+// done.
+func Serve(ctx context.Context, svc Service) error {
+	group, _ := net.ResolveUDPAddr("udp4", groupAddr)
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return fmt.Errorf("ssdp: join %s: %w", groupAddr, err)
+	}
+	defer conn.Close()
+	// Answers go out from a unicast socket so they carry the host's own
+	// address, which is the endpoint the searcher connects to.
+	reply, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return fmt.Errorf("ssdp: %w", err)
+	}
+	defer reply.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	answer := []byte("HTTP/1.1 200 OK\r\n" +
+		"CACHE-CONTROL: max-age=" + strconv.Itoa(maxAge) + "\r\n" +
+		"EXT:\r\n" +
+		"ST: " + ServiceType + "\r\n" +
+		"USN: govpn::" + svc.Name + ":" + strconv.Itoa(int(svc.Port)) + "::" + ServiceType + "\r\n" +
+		"X-GOVPN-NAME: " + svc.Name + "\r\n" +
+		"X-GOVPN-PORT: " + strconv.Itoa(int(svc.Port)) + "\r\n" +
+		"X-GOVPN-TRANSPORT: " + svc.Transport + "\r\n" +
+		"X-GOVPN-ENCAPSULATION: " + svc.Encapsulation + "\r\n\r\n")
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("ssdp: %w", err)
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+			continue
+		}
+		if st := req.Header.Get("St"); st != ServiceType && st != "ssdp:all" {
+			continue
+		}
+		reply.WriteToUDP(answer, from)
+	}
+}
+
+// Discover multicasts a search and returns the servers that answer within
+// timeout, in the order they answered.
+func Discover(ctx context.Context, timeout time.Duration) ([]Server, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	dst, _ := net.ResolveUDPAddr("udp4", groupAddr)
+	mx := max(1, int(timeout/time.Second))
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + groupAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: " + strconv.Itoa(mx) + "\r\n" +
+		"ST: " + ServiceType + "\r\n\r\n"
+	// Searches go out twice, since multicast is easily lost on Wi-Fi.
+	for i := 0; i < 2; i++ {
+		if _, err := conn.WriteTo([]byte(search), dst); err != nil {
+			return nil, err
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	var found []Server
+	seen := make(map[netip.AddrPort]bool)
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return found, nil
+			}
+			return found, err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("St") != ServiceType {
+			continue
+		}
+		port, err := strconv.ParseUint(resp.Header.Get("X-Govpn-Port"), 10, 16)
+		if err != nil || port == 0 {
+			continue
+		}
+		ep := netip.AddrPortFrom(from.Addr().Unmap(), uint16(port))
+		if seen[ep] {
+			continue
+		}
+		seen[ep] = true
+		transport := strings.TrimSpace(resp.Header.Get("X-Govpn-Transport"))
+		if transport == "" {
+			transport = "udp"
+		}
+		found = append(found, Server{
+			Name:          strings.TrimSpace(resp.Header.Get("X-Govpn-Name")),
+			Endpoint:      ep,
+			Transport:     transport,
+			Encapsulation: strings.TrimSpace(resp.Header.Get("X-Govpn-Encapsulation")),
+		})
+	}
+}
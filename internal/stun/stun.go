@@ -0,0 +1,210 @@
+// Package stun discovers a host's public UDP address with STUN binding
+// requests (RFC 5389) and classifies the NAT in front of it.
+package stun
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	magicCookie = 0x2112a442
+
+	typeBindingRequest  = 0x0001
+	typeBindingResponse = 0x0101
+
+	attrMappedAddress    = 0x0001
+	attrXORMappedAddress = 0x0020
+
+	headerSize = 20
+
+	// retransmit is the initial retransmission timeout; it doubles per try.
+	retransmit = 250 * time.Millisecond
+)
+
+// NATType classifies how a NAT maps outgoing UDP flows.
+type NATType string
+
+const (
+	// NATNone means the public address is on a local interface.
+	NATNone NATType = "none"
+	// NATCone means every destination sees the same public address, so
+	// peers can reach a mapping learned from any server.
+	NATCone NATType = "cone"
+	// NATSymmetric means each destination gets its own mapping, which
+	// defeats most hole punching.
+	NATSymmetric NATType = "symmetric"
+	// NATUnknown means only one server answered, so the mapping behaviour
+	// could not be compared.
+	NATUnknown NATType = "unknown"
+)
+
+// ErrNoResponse is returned when a server does not answer in time.
+var ErrNoResponse = errors.New("stun: no response")
+
+// Result is the outcome of Probe.
+type Result struct {
+	Public netip.AddrPort
+	NAT    NATType
+}
+
+// Binding sends a binding request to server from conn and returns the
+// address the server saw.
+func Binding(conn net.PacketConn, server string, timeout time.Duration) (netip.AddrPort, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("stun: resolve %s: %w", server, err)
+	}
+	var txid [12]byte
+	if _, err := rand.Read(txid[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	req := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(req[0:], typeBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], magicCookie)
+	copy(req[8:], txid[:])
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for rto := retransmit; time.Now().Before(deadline); rto *= 2 {
+		if _, err := conn.WriteTo(req, raddr); err != nil {
+			return netip.AddrPort{}, fmt.Errorf("stun: send: %w", err)
+		}
+		wait := time.Now().Add(rto)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		conn.SetReadDeadline(wait)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break // retransmit or give up
+			}
+			if addr, err := parseResponse(buf[:n], txid[:]); err == nil {
+				return addr, nil
+			}
+		}
+	}
+	return netip.AddrPort{}, fmt.Errorf("%w from %s", ErrNoResponse, server)
+}
+
+func parseResponse(b, txid []byte) (netip.AddrPort, error) {
+	if len(b) < headerSize ||
+		binary.BigEndian.Uint16(b[0:]) != typeBindingResponse ||
+		binary.BigEndian.Uint32(b[4:]) != magicCookie ||
+		!bytes.Equal(b[8:20], txid) {
+		return netip.AddrPort{}, errors.New("stun: not our response")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if headerSize+length > len(b) {
+		return netip.AddrPort{}, errors.New("stun: truncated response")
+	}
+	attrs := b[headerSize : headerSize+length]
+
+	var mapped netip.AddrPort
+	for len(attrs) >= 4 {
+		t := binary.BigEndian.Uint16(attrs[0:])
+		l := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+l > len(attrs) {
+			break
+		}
+		v := attrs[4 : 4+l]
+		switch t {
+		case attrXORMappedAddress:
+			if addr, ok := parseAddress(v, true); ok {
+				return addr, nil
+			}
+		case attrMappedAddress:
+			if addr, ok := parseAddress(v, false); ok {
+				mapped = addr
+			}
+		}
+		// Attributes are padded to four bytes.
+		next := 4 + (l+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if mapped.IsValid() {
+		return mapped, nil
+	}
+	return netip.AddrPort{}, errors.New("stun: no mapped address in response")
+}
+
+// parseAddress decodes an IPv4 (XOR-)MAPPED-ADDRESS value.
+func parseAddress(v []byte, xor bool) (netip.AddrPort, bool) {
+	if len(v) < 8 || v[1] != 0x01 {
+		return netip.AddrPort{}, false
+	}
+	port := binary.BigEndian.Uint16(v[2:])
+	ip := binary.BigEndian.Uint32(v[4:])
+	if xor {
+		port ^= magicCookie >> 16
+		ip ^= magicCookie
+	}
+	var a [4]byte
+	binary.BigEndian.PutUint32(a[:], ip)
+	return netip.AddrPortFrom(netip.AddrFrom4(a), port), true
+}
+
+// Probe asks up to two servers for this host's public address from one
+// socket and compares the answers to classify the NAT.
+func Probe(servers []string, timeout time.Duration) (Result, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return Result{}, fmt.Errorf("stun: %w", err)
+	}
+	defer conn.Close()
+
+	var seen []netip.AddrPort
+	var lastErr error
+	for _, server := range servers {
+		addr, err := Binding(conn, server, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		seen = append(seen, addr)
+		if len(seen) == 2 {
+			break
+		}
+	}
+	if len(seen) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("stun: no servers configured")
+		}
+		return Result{}, lastErr
+	}
+
+	res := Result{Public: seen[0], NAT: NATUnknown}
+	switch {
+	case isLocal(seen[0].Addr()):
+		res.NAT = NATNone
+	case len(seen) == 2 && seen[0] == seen[1]:
+		res.NAT = NATCone
+	case len(seen) == 2:
+		res.NAT = NATSymmetric
+	}
+	return res, nil
+}
+
+// isLocal reports whether ip is assigned to one of this host's interfaces.
+func isLocal(ip netip.Addr) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if p, err := netip.ParsePrefix(a.String()); err == nil && p.Addr() == ip {
+			return true
+		}
+	}
+	return false
+}
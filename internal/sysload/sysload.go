@@ -0,0 +1,28 @@
+// Package sysload measures how busy the host is, for a server deciding
+// whether it can take on more clients.
+package sysload
+
+import "sync"
+
+// CPU measures host-wide CPU use between samples.
+type CPU struct {
+	mu          sync.Mutex
+	idle, total uint64
+}
+
+// Sample returns the share of CPU time, 0 to 100 across all CPUs, spent
+// busy since the previous Sample. The first returns the average since boot.
+func (c *CPU) Sample() (float64, error) {
+	idle, total, err := cpuTimes()
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	di, dt := idle-c.idle, total-c.total
+	c.idle, c.total = idle, total
+	if dt == 0 || di > dt {
+		return 0, nil
+	}
+	return 100 * float64(dt-di) / float64(dt), nil
+}
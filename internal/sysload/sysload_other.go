@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+
+package sysload
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// cpuTimes is not implemented on this platform.
+func cpuTimes() (idle, total uint64, err error) {
+	return 0, 0, fmt.Errorf("CPU use on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
@@ -0,0 +1,20 @@
+package sysload
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procGetSystemTimes = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetSystemTimes")
+
+// cpuTimes reads the idle and total CPU time of all CPUs through
+// GetSystemTimes, in 100ns units. Kernel time includes idle time.
+func cpuTimes() (idle, total uint64, err error) {
+	var i, k, u windows.Filetime
+	if r, _, err := procGetSystemTimes.Call(uintptr(unsafe.Pointer(&i)), uintptr(unsafe.Pointer(&k)), uintptr(unsafe.Pointer(&u))); r == 0 {
+		return 0, 0, err
+	}
+	ticks := func(t windows.Filetime) uint64 { return uint64(t.HighDateTime)<<32 | uint64(t.LowDateTime) }
+	return ticks(i), ticks(k) + ticks(u), nil
+}
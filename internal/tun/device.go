@@ -0,0 +1,41 @@
+package tun
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// ErrClosed is returned by ReadPacket once the device has been closed.
+var ErrClosed = errors.New("tun: device closed")
+
+// Device is a source and sink of raw IP packets. ReadPacket must be safe to
+// call from multiple goroutines.
+type Device interface {
+	ReadPacket() ([]byte, error)
+	WritePacket(data []byte) error
+	Close()
+}
+
+// Configurer is implemented by devices whose address can be changed while
+// open.
+type Configurer interface {
+	SetAddress(prefix netip.Prefix) error
+}
+
+// AddressAdder is implemented by devices that can take an address besides
+// the one they were opened with, such as an IPv6 one.
+type AddressAdder interface {
+	AddAddress(prefix netip.Prefix) error
+}
+
+// Router is implemented by devices that can route a prefix into
+// themselves.
+type Router interface {
+	AddRoute(prefix netip.Prefix) error
+}
+
+// OptionSetter is implemented by devices that can take the MTU a server
+// pushes.
+type OptionSetter interface {
+	SetMTU(mtu int) error
+}
@@ -0,0 +1,54 @@
+package tun
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// DNSConfigurator points a resolver at the DNS servers and search domains
+// a server pushes. Apply replaces whatever the last Apply set; Restore
+// takes it all back, leaving the host's own settings. The platform devices
+// implement it for the system resolver.
+type DNSConfigurator interface {
+	Apply(servers []netip.Addr, domains []string) error
+	Restore() error
+}
+
+// DNSFor returns dev's DNS configurator, or a NopDNS when dev has none,
+// such as a device supplied by an embedder.
+func DNSFor(dev Device) DNSConfigurator {
+	if d, ok := dev.(DNSConfigurator); ok {
+		return d
+	}
+	return &NopDNS{}
+}
+
+// NopDNS changes nothing. It keeps what it was last given, so tests can
+// check what would have been applied.
+type NopDNS struct {
+	mu      sync.Mutex
+	servers []netip.Addr
+	domains []string
+}
+
+// Apply records servers and domains.
+func (n *NopDNS) Apply(servers []netip.Addr, domains []string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.servers, n.domains = slices.Clone(servers), slices.Clone(domains)
+	return nil
+}
+
+// Restore forgets what Apply recorded.
+func (n *NopDNS) Restore() error {
+	return n.Apply(nil, nil)
+}
+
+// Applied returns the servers and domains of the last Apply, or none after
+// Restore.
+func (n *NopDNS) Applied() ([]netip.Addr, []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return slices.Clone(n.servers), slices.Clone(n.domains)
+}
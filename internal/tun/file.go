@@ -0,0 +1,61 @@
+//go:build unix
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// FileDevice is a Device over a TUN file descriptor created elsewhere, such
+// as by Android's VpnService, an iOS packet tunnel, or a container runtime.
+// Each read returns exactly one packet.
+type FileDevice struct {
+	f         *os.File
+	closeOnce sync.Once
+}
+
+// NewFileDevice takes ownership of fd. The descriptor is switched to
+// non-blocking mode so Close can interrupt a pending read.
+func NewFileDevice(fd int) (*FileDevice, error) {
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		return nil, fmt.Errorf("tun fd %d: %w", fd, err)
+	}
+	return &FileDevice{f: os.NewFile(uintptr(fd), "tun")}, nil
+}
+
+// ReadPacket returns the next packet from the descriptor.
+func (d *FileDevice) ReadPacket() ([]byte, error) {
+	buf := make([]byte, packetHeaderLen+65535)
+	n, err := d.f.Read(buf)
+	if errors.Is(err, os.ErrClosed) {
+		return nil, ErrClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n <= packetHeaderLen {
+		return nil, fmt.Errorf("tun: short read of %d bytes", n)
+	}
+	return buf[packetHeaderLen:n], nil
+}
+
+// WritePacket writes one packet to the descriptor.
+func (d *FileDevice) WritePacket(pkt []byte) error {
+	if packetHeaderLen > 0 {
+		pkt = append(packetHeader(pkt), pkt...)
+	}
+	_, err := d.f.Write(pkt)
+	if errors.Is(err, os.ErrClosed) {
+		return ErrClosed
+	}
+	return err
+}
+
+// Close closes the descriptor; it is safe to call more than once.
+func (d *FileDevice) Close() {
+	d.closeOnce.Do(func() { d.f.Close() })
+}
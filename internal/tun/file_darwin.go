@@ -0,0 +1,14 @@
+package tun
+
+import "syscall"
+
+// utun descriptors on Darwin prefix every packet with its address family.
+const packetHeaderLen = 4
+
+func packetHeader(pkt []byte) []byte {
+	family := byte(syscall.AF_INET)
+	if len(pkt) > 0 && pkt[0]>>4 == 6 {
+		family = syscall.AF_INET6
+	}
+	return []byte{0, 0, 0, family}
+}
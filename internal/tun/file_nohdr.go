@@ -0,0 +1,8 @@
+//go:build unix && !darwin
+
+package tun
+
+// Linux and Android TUN descriptors opened with IFF_NO_PI carry bare packets.
+const packetHeaderLen = 0
+
+func packetHeader([]byte) []byte { return nil }
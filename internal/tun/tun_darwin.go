@@ -0,0 +1,311 @@
+//go:build darwin
+
+package tun
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// The utun kernel control, and its socket option naming the interface.
+const (
+	utunControl     = "com.apple.net.utun_control"
+	sysprotoControl = 2
+	utunOptIfname   = 2
+)
+
+// utunName matches the names macOS gives utun interfaces.
+var utunName = regexp.MustCompile(`^utun([0-9]+)$`)
+
+// DarwinDevice is a utun interface. macOS names utun interfaces itself, so
+// the adapter name from the config only picks the unit when it is of the
+// form utunN; otherwise it names the interface's DNS settings.
+type DarwinDevice struct {
+	*FileDevice
+	name    string // utunN
+	adapter string
+
+	mu      sync.Mutex
+	prefix  netip.Prefix
+	dns     []netip.Addr
+	domains []string
+}
+
+// Open creates a utun interface with address cidr.
+func Open(ctx context.Context, adapterName, cidr string) (Device, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("tun: %w", err)
+	}
+	fd, err := unix.Socket(unix.AF_SYSTEM, unix.SOCK_DGRAM, sysprotoControl)
+	if err != nil {
+		return nil, fmt.Errorf("tun: utun socket: %w", err)
+	}
+	unix.CloseOnExec(fd)
+	info := &unix.CtlInfo{}
+	copy(info.Name[:], utunControl)
+	if err := unix.IoctlCtlInfo(fd, info); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("tun: utun control: %w", err)
+	}
+	// Unit 0 lets the kernel pick the first free utun; unit n+1 asks for
+	// utunN.
+	var unit uint32
+	if m := utunName.FindStringSubmatch(adapterName); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		unit = uint32(n) + 1
+	}
+	if err := unix.Connect(fd, &unix.SockaddrCtl{ID: info.Id, Unit: unit}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("tun: create utun for %s: %w", adapterName, err)
+	}
+	name, err := unix.GetsockoptString(fd, sysprotoControl, utunOptIfname)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("tun: utun name: %w", err)
+	}
+	f, err := NewFileDevice(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	d := &DarwinDevice{FileDevice: f, name: name, adapter: adapterName}
+	if name != adapterName {
+		log.Printf("Adapter %s is %s", adapterName, name)
+	}
+	if err := d.SetAddress(prefix); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Name returns the interface's name, utunN.
+func (d *DarwinDevice) Name() string {
+	return d.name
+}
+
+// SetAddress replaces the interface's address and routes its subnet into
+// it. utun is point to point, so the address is also the destination.
+func (d *DarwinDevice) SetAddress(prefix netip.Prefix) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.prefix.IsValid() {
+		if err := run("ifconfig", d.name, family(d.prefix.Addr()), d.prefix.Addr().String(), "delete"); err != nil {
+			log.Printf("Remove address %s from %s: %v", d.prefix, d.name, err)
+		}
+	}
+	if err := d.addAddress(prefix, false); err != nil {
+		return err
+	}
+	d.prefix = prefix
+	return d.publishLocked()
+}
+
+// AddAddress gives the interface prefix besides its other addresses.
+func (d *DarwinDevice) AddAddress(prefix netip.Prefix) error {
+	return d.addAddress(prefix, true)
+}
+
+func (d *DarwinDevice) addAddress(prefix netip.Prefix, alias bool) error {
+	a := prefix.Addr().String()
+	var args []string
+	if prefix.Addr().Is4() {
+		mask := net.IP(net.CIDRMask(prefix.Bits(), 32)).String()
+		args = []string{d.name, "inet", a, a, "netmask", mask}
+	} else {
+		args = []string{d.name, "inet6", a, "prefixlen", strconv.Itoa(prefix.Bits())}
+	}
+	if alias {
+		args = append(args, "alias")
+	}
+	if err := run("ifconfig", append(args, "up")...); err != nil {
+		return err
+	}
+	if prefix.Bits() == prefix.Addr().BitLen() {
+		return nil
+	}
+	return d.AddRoute(prefix)
+}
+
+// AddRoute routes prefix into the interface. A default route is added as
+// its two halves, which win over the host's own default route without
+// replacing it.
+func (d *DarwinDevice) AddRoute(prefix netip.Prefix) error {
+	prefix = prefix.Masked()
+	if prefix.Bits() == 0 {
+		lo := netip.PrefixFrom(prefix.Addr(), 1)
+		if prefix.Addr().Is4() {
+			return d.addRoutes(lo, netip.MustParsePrefix("128.0.0.0/1"))
+		}
+		return d.addRoutes(lo, netip.MustParsePrefix("8000::/1"))
+	}
+	return d.addRoutes(prefix)
+}
+
+func (d *DarwinDevice) addRoutes(prefixes ...netip.Prefix) error {
+	for _, p := range prefixes {
+		args := []string{"-q", "-n", "add", inet(p.Addr()), p.String(), "-interface", d.name}
+		if err := run("route", args...); err != nil {
+			args[2] = "change"
+			if err := run("route", args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetMTU sets the interface's MTU.
+func (d *DarwinDevice) SetMTU(mtu int) error {
+	return run("ifconfig", d.name, "mtu", strconv.Itoa(mtu))
+}
+
+// Apply points the system resolver at servers, with domains as the DNS
+// suffixes tried for short names.
+func (d *DarwinDevice) Apply(servers []netip.Addr, domains []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dns, d.domains = servers, domains
+	if len(servers) == 0 && len(domains) == 0 {
+		return RemoveAdapter(d.adapter)
+	}
+	return d.publishLocked()
+}
+
+// Restore removes the DNS settings Apply published.
+func (d *DarwinDevice) Restore() error {
+	return d.Apply(nil, nil)
+}
+
+// publishLocked publishes the interface and its DNS settings to configd as
+// a network service of their own, which scutil --dns then lists.
+func (d *DarwinDevice) publishLocked() error {
+	if len(d.dns) == 0 && len(d.domains) == 0 {
+		return nil
+	}
+	key := serviceKey(d.adapter)
+	var script strings.Builder
+	script.WriteString("d.init\n")
+	fmt.Fprintf(&script, "d.add Addresses * %s\n", d.prefix.Addr())
+	fmt.Fprintf(&script, "d.add InterfaceName %s\n", d.name)
+	fmt.Fprintf(&script, "set %s/IPv4\n", key)
+	script.WriteString("d.init\n")
+	if len(d.dns) > 0 {
+		addrs := make([]string, len(d.dns))
+		for i, a := range d.dns {
+			addrs[i] = a.String()
+		}
+		fmt.Fprintf(&script, "d.add ServerAddresses * %s\n", strings.Join(addrs, " "))
+	}
+	if len(d.domains) > 0 {
+		fmt.Fprintf(&script, "d.add SearchDomains * %s\n", strings.Join(d.domains, " "))
+	}
+	fmt.Fprintf(&script, "d.add InterfaceName %s\n", d.name)
+	fmt.Fprintf(&script, "set %s/DNS\n", key)
+	return scutil(script.String())
+}
+
+// Close removes the DNS settings and closes the interface, which takes its
+// addresses and routes with it.
+func (d *DarwinDevice) Close() {
+	d.mu.Lock()
+	set := len(d.dns) > 0 || len(d.domains) > 0
+	d.mu.Unlock()
+	if set {
+		if err := RemoveAdapter(d.adapter); err != nil {
+			log.Printf("Remove DNS settings of %s: %v", d.name, err)
+		}
+	}
+	d.FileDevice.Close()
+}
+
+// RemoveAdapter removes the DNS settings an adapter published, such as
+// after a crash. The utun interface itself went with the process.
+func RemoveAdapter(adapterName string) error {
+	key := serviceKey(adapterName)
+	return scutil(fmt.Sprintf("remove %s/DNS\nremove %s/IPv4\n", key, key))
+}
+
+// PinHostRoute routes addr along the path it takes now, through the
+// gateway or interface the routing table picks for it, so routes added
+// later, such as a default route into a tunnel, do not capture it.
+func PinHostRoute(addr netip.Addr) error {
+	out, err := exec.Command("route", "-n", "get", inet(addr), addr.String()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("route get %s: %w: %s", addr, err, strings.TrimSpace(string(out)))
+	}
+	var gateway, iface string
+	for _, line := range strings.Split(string(out), "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), ":")
+		switch {
+		case !ok:
+		case k == "gateway":
+			gateway = strings.TrimSpace(v)
+		case k == "interface":
+			iface = strings.TrimSpace(v)
+		}
+	}
+	args := []string{"-q", "-n", "add", inet(addr), "-host", addr.String()}
+	switch {
+	case gateway != "":
+		args = append(args, gateway)
+	case iface != "":
+		args = append(args, "-interface", iface)
+	default:
+		return fmt.Errorf("route get %s: no gateway or interface", addr)
+	}
+	if err := run("route", args...); err != nil {
+		args[2] = "change"
+		return run("route", args...)
+	}
+	return nil
+}
+
+// serviceKey is the configd key under which an adapter's settings live.
+func serviceKey(adapterName string) string {
+	return "State:/Network/Service/GoVPN-" + adapterName
+}
+
+// family is the ifconfig address family of a.
+func family(a netip.Addr) string {
+	if a.Is4() {
+		return "inet"
+	}
+	return "inet6"
+}
+
+// inet is the route address family flag for a.
+func inet(a netip.Addr) string {
+	return "-" + family(a)
+}
+
+// scutil runs script through scutil.
+func scutil(script string) error {
+	cmd := exec.Command("scutil")
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("scutil: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// run runs a network configuration command.
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
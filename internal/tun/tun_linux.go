@@ -0,0 +1,252 @@
+//go:build linux
+
+package tun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gedons/go_VPN/internal/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// LinuxDevice is a kernel TUN interface, optionally living in a named
+// network namespace.
+type LinuxDevice struct {
+	*FileDevice
+	name  string
+	netns string
+}
+
+// Open creates a TUN interface named adapterName with address cidr.
+func Open(ctx context.Context, adapterName, cidr string) (Device, error) {
+	return OpenInNamespace(ctx, adapterName, cidr, "")
+}
+
+// OpenInNamespace creates a TUN interface and, when netns is set, moves it
+// into that named network namespace (as made by ip netns add, created here
+// if missing) before addressing it, so only processes in the namespace can
+// route through it. The descriptor stays with the caller, whose own
+// sockets keep using the host's network.
+func OpenInNamespace(ctx context.Context, adapterName, cidr, netns string) (*LinuxDevice, error) {
+	if _, err := netip.ParsePrefix(cidr); err != nil {
+		return nil, fmt.Errorf("tun: %w", err)
+	}
+	f, err := create(adapterName)
+	if err != nil {
+		return nil, err
+	}
+	d := &LinuxDevice{FileDevice: f, name: adapterName, netns: netns}
+	if err := d.setup(cidr); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// OpenMirror creates a TUN interface that only receives copies of traffic
+// for packet capture and IDS tools to sniff. It has no address, and
+// forwarding, IPv6, and reverse-path checks are set so the kernel drops
+// whatever is written to it instead of routing or delivering it.
+func OpenMirror(name string) (Device, error) {
+	f, err := create(name)
+	if err != nil {
+		return nil, err
+	}
+	d := &LinuxDevice{FileDevice: f, name: name}
+	for _, s := range []struct{ path, value string }{
+		{"ipv4/conf/" + name + "/forwarding", "0"},
+		{"ipv4/conf/" + name + "/rp_filter", "1"},
+		{"ipv6/conf/" + name + "/disable_ipv6", "1"},
+	} {
+		if err := os.WriteFile(filepath.Join("/proc/sys/net", s.path), []byte(s.value), 0o644); err != nil {
+			d.Close()
+			return nil, fmt.Errorf("tun: mirror %s: %w", name, err)
+		}
+	}
+	if err := d.link(func(c *netlink.Conn, index int) error { return c.SetLinkUp(index) }); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// create opens /dev/net/tun as a new TUN interface called name.
+func create(name string) (*FileDevice, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("tun: open /dev/net/tun: %w", err)
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("tun: %w", err)
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("tun: create %s: %w", name, err)
+	}
+	f, err := NewFileDevice(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *LinuxDevice) setup(cidr string) error {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return fmt.Errorf("tun: %w", err)
+	}
+	if d.netns != "" {
+		if _, err := os.Stat(netlink.NamespacePath(d.netns)); errors.Is(err, os.ErrNotExist) {
+			if err := ip("netns", "add", d.netns); err != nil {
+				return err
+			}
+			log.Printf("Created network namespace %s", d.netns)
+		}
+		c, err := netlink.Open("")
+		if err != nil {
+			return fmt.Errorf("tun: %w", err)
+		}
+		defer c.Close()
+		index, err := c.LinkIndex(d.name)
+		if err == nil {
+			err = c.SetLinkNamespace(index, d.netns)
+		}
+		if err != nil {
+			return fmt.Errorf("tun: %w", err)
+		}
+	}
+	return d.link(func(c *netlink.Conn, index int) error {
+		if err := c.AddAddress(index, prefix); err != nil {
+			return err
+		}
+		return c.SetLinkUp(index)
+	})
+}
+
+// link runs f with an rtnetlink connection in the interface's namespace
+// and the interface's index there.
+func (d *LinuxDevice) link(f func(c *netlink.Conn, index int) error) error {
+	c, err := netlink.Open(d.netns)
+	if err != nil {
+		return fmt.Errorf("tun: %w", err)
+	}
+	defer c.Close()
+	index, err := c.LinkIndex(d.name)
+	if err == nil {
+		err = f(c, index)
+	}
+	if err != nil {
+		return fmt.Errorf("tun: %s: %w", d.name, err)
+	}
+	return nil
+}
+
+// AddAddress adds another address, such as an IPv6 one, to the interface.
+func (d *LinuxDevice) AddAddress(prefix netip.Prefix) error {
+	return d.link(func(c *netlink.Conn, index int) error { return c.AddAddress(index, prefix) })
+}
+
+// AddRoute routes prefix into the interface, in its namespace.
+func (d *LinuxDevice) AddRoute(prefix netip.Prefix) error {
+	return d.link(func(c *netlink.Conn, index int) error {
+		return c.ReplaceRoute(netlink.Route{Dst: prefix.Masked(), Index: index})
+	})
+}
+
+// SetMTU sets the interface's MTU.
+func (d *LinuxDevice) SetMTU(mtu int) error {
+	return d.link(func(c *netlink.Conn, index int) error { return c.SetMTU(index, mtu) })
+}
+
+// Apply gives the interface's link servers and domains in
+// systemd-resolved, which then sends queries for those domains, and all
+// others when servers is set, to the servers over the tunnel. In a
+// namespace DNS is left to the namespace's own resolv.conf.
+func (d *LinuxDevice) Apply(servers []netip.Addr, domains []string) error {
+	if d.netns != "" {
+		return fmt.Errorf("DNS in network namespace %s: %w", d.netns, errors.ErrUnsupported)
+	}
+	if len(servers) == 0 && len(domains) == 0 {
+		return d.Restore()
+	}
+	args := []string{"dns", d.name}
+	for _, a := range servers {
+		args = append(args, a.String())
+	}
+	if err := resolvectl(args...); err != nil {
+		return err
+	}
+	args = []string{"domain", d.name}
+	if len(servers) > 0 {
+		args = append(args, "~.")
+	}
+	if err := resolvectl(append(args, domains...)...); err != nil {
+		return err
+	}
+	return resolvectl("default-route", d.name, strconv.FormatBool(len(servers) > 0))
+}
+
+// Restore drops the interface's link settings from systemd-resolved.
+func (d *LinuxDevice) Restore() error {
+	if d.netns != "" {
+		return nil
+	}
+	return resolvectl("revert", d.name)
+}
+
+// resolvectl runs a systemd-resolved command.
+func resolvectl(args ...string) error {
+	out, err := exec.Command("resolvectl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resolvectl %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// PinHostRoute routes addr along the path it takes now, through the
+// gateway and interface the main table picks for it, so routes added
+// later, such as a default route into a tunnel, do not capture it.
+func PinHostRoute(addr netip.Addr) error {
+	c, err := netlink.Open("")
+	if err != nil {
+		return fmt.Errorf("tun: %w", err)
+	}
+	defer c.Close()
+	r, err := c.RouteTo(addr)
+	if err != nil {
+		return fmt.Errorf("tun: %w", err)
+	}
+	if err := c.ReplaceRoute(r); err != nil {
+		return fmt.Errorf("tun: %w", err)
+	}
+	return nil
+}
+
+// RemoveAdapter has nothing to remove on Linux: the interface goes away
+// with the process that opened it.
+func RemoveAdapter(adapterName string) error {
+	return fmt.Errorf("adapter removal on linux: %w", errors.ErrUnsupported)
+}
+
+// ip runs the ip command. Only namespaces are made this way; links,
+// addresses and routes go through netlink.
+func ip(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
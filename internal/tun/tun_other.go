@@ -0,0 +1,21 @@
+//go:build !windows && !linux && !darwin
+
+package tun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// Open creates the platform TUN device. There is no backend for this
+// platform yet; embedders can supply their own Device.
+func Open(ctx context.Context, adapterName, cidr string) (Device, error) {
+	return nil, fmt.Errorf("tun: no TUN backend for %s", runtime.GOOS)
+}
+
+// RemoveAdapter has nothing to remove on this platform.
+func RemoveAdapter(adapterName string) error {
+	return fmt.Errorf("adapter removal on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
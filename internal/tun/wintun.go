@@ -1,11 +1,21 @@
+//go:build windows
+
 package tun
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
 	"log"
 	"net/netip"
+	"os/exec"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/gedons/go_VPN/internal/powershell"
+	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wintun"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 )
@@ -13,24 +23,43 @@ import (
 const (
 	SessionRingBuffer = 1 << 23 // 8 MiB
 	IPStabilizeDelay  = 300 * time.Millisecond
+	TunnelType        = "GoVPN"
+	// RxQueueLen bounds how many received packets wait for a worker.
+	RxQueueLen = 1024
 )
 
-// WintunManager wraps the adapter and session.
+// WintunManager wraps the adapter and session. A single reader goroutine
+// drains the Wintun ring into a buffered queue so any number of workers can
+// call ReadPacket concurrently.
 type WintunManager struct {
 	adapter *wintun.Adapter
 	session *wintun.Session
+
+	rx         chan []byte
+	closeEvent windows.Handle
+	readerWG   sync.WaitGroup
+	closeOnce  sync.Once
+}
+
+// Open creates the platform TUN device.
+func Open(ctx context.Context, adapterName, cidr string) (Device, error) {
+	return SetupWintun(ctx, adapterName, cidr)
 }
 
 // SetupWintun creates/opens the adapter, assigns IP, and starts session.
 func SetupWintun(ctx context.Context, adapterName, cidr string) (*WintunManager, error) {
-	// 1) Create or open
-	a, err := wintun.CreateAdapter(adapterName, "GoVPN", nil)
-	if err != nil {
-		log.Printf("CreateAdapter failed: %v; trying OpenAdapter", err)
-		a, err = wintun.OpenAdapter(adapterName)
+	// 1) Reuse or create. A stable GUID keeps Windows from registering a
+	// new network profile for every run.
+	a, err := wintun.OpenAdapter(adapterName)
+	if err == nil {
+		log.Printf("Reusing existing adapter %q", adapterName)
+	} else {
+		guid := AdapterGUID(adapterName)
+		a, err = wintun.CreateAdapter(adapterName, TunnelType, &guid)
 		if err != nil {
 			return nil, err
 		}
+		log.Printf("Created adapter %q (GUID %s)", adapterName, guid)
 	}
 	log.Printf("Adapter LUID %d ready", a.LUID())
 
@@ -56,33 +85,183 @@ func SetupWintun(ctx context.Context, adapterName, cidr string) (*WintunManager,
 	}
 	log.Printf("Session started (ring=%d)", SessionRingBuffer)
 
-	return &WintunManager{adapter: a, session: &sess}, nil
+	closeEvent, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		sess.End()
+		a.Close()
+		return nil, err
+	}
+	m := &WintunManager{
+		adapter:    a,
+		session:    &sess,
+		rx:         make(chan []byte, RxQueueLen),
+		closeEvent: closeEvent,
+	}
+	m.readerWG.Add(1)
+	go m.readLoop()
+	return m, nil
 }
 
-// ReadPacket returns one packet or an error.
+// readLoop moves packets from the Wintun ring into the rx queue, sleeping on
+// the session's read event while the ring is empty.
+func (m *WintunManager) readLoop() {
+	defer m.readerWG.Done()
+	defer close(m.rx)
+	waitHandles := []windows.Handle{(*m.session).ReadWaitEvent(), m.closeEvent}
+	for {
+		pkt, err := (*m.session).ReceivePacket()
+		switch err {
+		case nil:
+			data := make([]byte, len(pkt))
+			copy(data, pkt)
+			(*m.session).ReleaseReceivePacket(pkt)
+			select {
+			case m.rx <- data:
+			default:
+				// Workers are saturated; drop rather than stall the ring.
+			}
+		case windows.ERROR_NO_MORE_ITEMS:
+			ev, _ := windows.WaitForMultipleObjects(waitHandles, false, windows.INFINITE)
+			if ev == windows.WAIT_OBJECT_0+1 {
+				return
+			}
+		default:
+			log.Printf("Wintun receive stopped: %v", err)
+			return
+		}
+	}
+}
+
+// ReadPacket returns the next received packet. It is safe to call from
+// multiple goroutines and returns ErrClosed after Close.
 func (m *WintunManager) ReadPacket() ([]byte, error) {
-	pkt, err := (*m.session).ReceivePacket()
-	if err != nil {
-		return nil, err
+	pkt, ok := <-m.rx
+	if !ok {
+		return nil, ErrClosed
 	}
-	data := make([]byte, len(pkt))
-	copy(data, pkt)
-	(*m.session).ReleaseReceivePacket(pkt)
-	return data, nil
+	return pkt, nil
 }
 
-// WritePacket sends one packet.
+// WritePacket copies one packet into the send ring. The caller keeps
+// ownership of data.
 func (m *WintunManager) WritePacket(data []byte) error {
-	(*m.session).SendPacket(data)
+	pkt, err := (*m.session).AllocateSendPacket(len(data))
+	if err != nil {
+		return err
+	}
+	copy(pkt, data)
+	(*m.session).SendPacket(pkt)
+	return nil
+}
+
+// SetAddress replaces the adapter's address.
+func (m *WintunManager) SetAddress(prefix netip.Prefix) error {
+	return winipcfg.LUID(m.adapter.LUID()).SetIPAddresses([]netip.Prefix{prefix})
+}
+
+// Apply points the adapter at servers, with domains as the DNS suffixes
+// tried for short names. Windows prefers the DNS servers of the adapter
+// with the best route, which the tunnel's routes make this one.
+func (m *WintunManager) Apply(servers []netip.Addr, domains []string) error {
+	luid := winipcfg.LUID(m.adapter.LUID())
+	if err := luid.SetDNS(windows.AF_INET, servers, domains); err != nil {
+		return err
+	}
+	// IPv6 may be disabled on the adapter, which only matters with IPv6
+	// servers.
+	if err := luid.SetDNS(windows.AF_INET6, servers, domains); err != nil && slices.ContainsFunc(servers, netip.Addr.Is6) {
+		return err
+	}
 	return nil
 }
 
-// Close tears down session and adapter.
+// Restore clears the adapter's DNS servers and suffixes.
+func (m *WintunManager) Restore() error {
+	return m.Apply(nil, nil)
+}
+
+// SetMTU sets the adapter's IPv4 and IPv6 MTU.
+func (m *WintunManager) SetMTU(mtu int) error {
+	luid := winipcfg.LUID(m.adapter.LUID())
+	for _, family := range []winipcfg.AddressFamily{windows.AF_INET, windows.AF_INET6} {
+		iface, err := luid.IPInterface(family)
+		if err != nil {
+			if family == windows.AF_INET6 {
+				continue // IPv6 may be disabled on the adapter
+			}
+			return err
+		}
+		iface.NLMTU = uint32(mtu)
+		if err := iface.Set(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddAddress gives the adapter prefix besides its other addresses.
+func (m *WintunManager) AddAddress(prefix netip.Prefix) error {
+	return winipcfg.LUID(m.adapter.LUID()).AddIPAddress(prefix)
+}
+
+// AddRoute routes prefix into the adapter.
+func (m *WintunManager) AddRoute(prefix netip.Prefix) error {
+	nextHop := netip.IPv4Unspecified()
+	if prefix.Addr().Is6() {
+		nextHop = netip.IPv6Unspecified()
+	}
+	return winipcfg.LUID(m.adapter.LUID()).AddRoute(prefix.Masked(), nextHop, 0)
+}
+
+// Close stops the reader, then tears down session and adapter.
 func (m *WintunManager) Close() {
-	if m.session != nil {
-		(*m.session).End()
+	m.closeOnce.Do(func() {
+		windows.SetEvent(m.closeEvent)
+		m.readerWG.Wait()
+		windows.CloseHandle(m.closeEvent)
+		if m.session != nil {
+			(*m.session).End()
+		}
+		if m.adapter != nil {
+			m.adapter.Close()
+		}
+	})
+}
+
+// AdapterGUID derives a deterministic GUID from the adapter name so the same
+// adapter is recreated with the same identity across restarts.
+func AdapterGUID(adapterName string) windows.GUID {
+	sum := sha256.Sum256([]byte("GoVPN adapter:" + adapterName))
+	g := windows.GUID{
+		Data1: binary.BigEndian.Uint32(sum[0:4]),
+		Data2: binary.BigEndian.Uint16(sum[4:6]),
+		Data3: binary.BigEndian.Uint16(sum[6:8]),
 	}
-	if m.adapter != nil {
-		m.adapter.Close()
+	copy(g.Data4[:], sum[8:16])
+	// RFC 4122 name-based (version 5) layout.
+	g.Data3 = g.Data3&0x0fff | 0x5000
+	g.Data4[0] = g.Data4[0]&0x3f | 0x80
+	return g
+}
+
+// RemoveAdapter deletes the named adapter and the network profiles Windows
+// recorded for it: the one named after it, and the one it is connected to.
+func RemoveAdapter(adapterName string) error {
+	if a, err := wintun.OpenAdapter(adapterName); err == nil {
+		a.Close()
 	}
+	script := fmt.Sprintf(`$names = @(%[1]s); `+
+		`$a = Get-NetAdapter -Name %[1]s -ErrorAction SilentlyContinue; `+
+		`if ($a) { $names += @(Get-NetConnectionProfile -InterfaceIndex $a.ifIndex -ErrorAction SilentlyContinue).Name; `+
+		`pnputil /remove-device $a.PnPDeviceID | Out-Null }; `+
+		`Get-ChildItem 'HKLM:\SOFTWARE\Microsoft\Windows NT\CurrentVersion\NetworkList\Profiles' | `+
+		`Where-Object { $names -contains (Get-ItemProperty $_.PSPath).ProfileName } | `+
+		`ForEach-Object { Write-Output "Removed profile $((Get-ItemProperty $_.PSPath).ProfileName)"; Remove-Item $_.PSPath -Recurse }`,
+		powershell.Quote(adapterName))
+	output, err := exec.Command("powershell", "-Command", script).CombinedOutput()
+	log.Print(string(output))
+	if err != nil {
+		return fmt.Errorf("remove adapter %q: %w", adapterName, err)
+	}
+	return nil
 }
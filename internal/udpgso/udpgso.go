@@ -0,0 +1,15 @@
+// Package udpgso sends runs of datagrams to one address with a single
+// syscall, through UDP generic segmentation offload, and splits apart the
+// datagrams UDP GRO joins on receive, on Linux. The kernel, or the NIC,
+// cuts a run into datagrams only once it reaches the device, so a busy
+// sender makes one trip through the stack per run instead of per datagram.
+package udpgso
+
+const (
+	// MaxSegments is the most datagrams a run holds.
+	MaxSegments = 64
+
+	// MaxBytes is the most bytes a run holds, leaving room for the IPv6
+	// and UDP headers in a 64 KB packet.
+	MaxBytes = 65535 - 40 - 8
+)
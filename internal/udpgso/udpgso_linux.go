@@ -0,0 +1,142 @@
+package udpgso
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Socket options from linux/udp.h, which this version of x/sys lacks.
+const (
+	solUDP     = 17
+	udpSegment = 103
+	udpGRO     = 104
+)
+
+// Conn is a UDP socket that sends runs with GSO and splits the datagrams
+// GRO joined on receive. Reads need a buffer of 64 KB, as a joined read is
+// that large.
+type Conn struct {
+	*net.UDPConn
+	gso atomic.Bool // sends may still use GSO
+
+	mu   sync.Mutex // serializes reads
+	oob  []byte
+	rest []byte       // joined datagrams not yet read
+	size int          // their size, the last possibly shorter
+	from *net.UDPAddr // their sender
+	buf  []byte       // holds rest
+}
+
+// Open turns on GSO and GRO for udp, and fails when the kernel supports
+// neither. Kernels from 4.18 support GSO and from 5.0 GRO.
+func Open(udp *net.UDPConn) (*Conn, error) {
+	rc, err := udp.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var gsoErr, groErr error
+	if err := rc.Control(func(fd uintptr) {
+		_, gsoErr = unix.GetsockoptInt(int(fd), solUDP, udpSegment)
+		groErr = unix.SetsockoptInt(int(fd), solUDP, udpGRO, 1)
+	}); err != nil {
+		return nil, err
+	}
+	if gsoErr != nil && groErr != nil {
+		return nil, fmt.Errorf("udpgso: %w", gsoErr)
+	}
+	c := &Conn{UDPConn: udp, oob: make([]byte, unix.CmsgSpace(4))}
+	c.gso.Store(gsoErr == nil)
+	return c, nil
+}
+
+// WriteBatch sends buf, datagrams of size bytes back to back with the last
+// possibly shorter, to addr, or to the connected peer when addr is nil.
+// The run must hold at most MaxSegments datagrams and MaxBytes bytes. When
+// the kernel refuses the run, the datagrams go out one by one; when it is
+// because the route's device cannot take runs, so does every run after.
+func (c *Conn) WriteBatch(buf []byte, size int, addr net.Addr) error {
+	udpAddr, _ := addr.(*net.UDPAddr)
+	if len(buf) > size && c.gso.Load() {
+		_, _, err := c.WriteMsgUDP(buf, segmentOOB(size), udpAddr)
+		switch {
+		case errors.Is(err, unix.EIO):
+			// Without checksum offload the device refuses them.
+			c.gso.Store(false)
+		case errors.Is(err, unix.EINVAL), errors.Is(err, unix.EMSGSIZE):
+			// The datagrams are larger than the path, and runs are
+			// never fragmented. Sent alone they are, or fail with
+			// EMSGSIZE under DF.
+		default:
+			return err
+		}
+	}
+	for len(buf) > 0 {
+		n := min(size, len(buf))
+		if _, _, err := c.WriteMsgUDP(buf[:n], nil, udpAddr); err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// segmentOOB returns the control message telling the kernel to cut a send
+// into datagrams of size bytes.
+func segmentOOB(size int) []byte {
+	oob := make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level, h.Type = solUDP, udpSegment
+	h.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[unix.CmsgLen(0):], uint16(size))
+	return oob
+}
+
+// ReadFrom reads the next datagram, the first of a joined read or one left
+// from the last.
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.rest) > 0 {
+		n := copy(b, c.rest[:min(c.size, len(c.rest))])
+		c.rest = c.rest[min(c.size, len(c.rest)):]
+		return n, c.from, nil
+	}
+	n, oobn, _, from, err := c.ReadMsgUDP(b, c.oob)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size := joinedSize(c.oob[:oobn]); size > 0 && size < n {
+		c.buf = append(c.buf[:0], b[size:n]...)
+		c.rest, c.size, c.from = c.buf, size, from
+		n = size
+	}
+	return n, from, nil
+}
+
+// Read reads the next datagram from the connected peer.
+func (c *Conn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// joinedSize returns the datagram size of a read GRO joined, from its
+// control messages, or zero.
+func joinedSize(oob []byte) int {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		if m.Header.Level == solUDP && m.Header.Type == udpGRO && len(m.Data) >= 4 {
+			return int(binary.NativeEndian.Uint32(m.Data))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package udpgso
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// Conn is only available on Linux.
+type Conn struct {
+	*net.UDPConn
+}
+
+// Open is only available on Linux.
+func Open(*net.UDPConn) (*Conn, error) {
+	return nil, fmt.Errorf("udpgso on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
+
+// WriteBatch is only available on Linux.
+func (*Conn) WriteBatch([]byte, int, net.Addr) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,174 @@
+// Package wgconf reads and writes the configuration files of WireGuard's
+// wg-quick, such as /etc/wireguard/wg0.conf.
+package wgconf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// File is a wg-quick configuration.
+type File struct {
+	Interface Interface
+	Peers     []Peer
+	// Ignored lists the keys read that have no field here, such as PostUp,
+	// as "Section.Key".
+	Ignored []string
+}
+
+// Interface is the [Interface] section.
+type Interface struct {
+	PrivateKey string
+	Addresses  []string // prefixes such as 10.0.0.2/24
+	DNS        []string // resolver addresses and search domains, mixed
+	MTU        int
+	ListenPort int
+}
+
+// Peer is one [Peer] section.
+type Peer struct {
+	PublicKey           string
+	PresharedKey        string
+	Endpoint            string // host:port
+	AllowedIPs          []string
+	PersistentKeepalive int // seconds; 0 is off
+}
+
+// Parse reads a wg-quick configuration.
+func Parse(r io.Reader) (*File, error) {
+	f := &File{}
+	var peer *Peer
+	section := ""
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			switch strings.ToLower(section) {
+			case "interface":
+			case "peer":
+				f.Peers = append(f.Peers, Peer{})
+				peer = &f.Peers[len(f.Peers)-1]
+			default:
+				return nil, fmt.Errorf("line %d: unknown section [%s]", n, section)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: want key = value", n)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		var err error
+		switch strings.ToLower(section) {
+		case "interface":
+			err = f.Interface.set(key, value)
+		case "peer":
+			err = peer.set(key, value)
+		default:
+			return nil, fmt.Errorf("line %d: %s outside a section", n, key)
+		}
+		if err == errUnknownKey {
+			f.Ignored = append(f.Ignored, section+"."+key)
+		} else if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, key, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+var errUnknownKey = errors.New("unknown key")
+
+func (i *Interface) set(key, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "privatekey":
+		i.PrivateKey = value
+	case "address":
+		i.Addresses = append(i.Addresses, splitList(value)...)
+	case "dns":
+		i.DNS = append(i.DNS, splitList(value)...)
+	case "mtu":
+		i.MTU, err = strconv.Atoi(value)
+	case "listenport":
+		i.ListenPort, err = strconv.Atoi(value)
+	default:
+		return errUnknownKey
+	}
+	return err
+}
+
+func (p *Peer) set(key, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "publickey":
+		p.PublicKey = value
+	case "presharedkey":
+		p.PresharedKey = value
+	case "endpoint":
+		p.Endpoint = value
+	case "allowedips":
+		p.AllowedIPs = append(p.AllowedIPs, splitList(value)...)
+	case "persistentkeepalive":
+		if value != "off" {
+			p.PersistentKeepalive, err = strconv.Atoi(value)
+		}
+	default:
+		return errUnknownKey
+	}
+	return err
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Format writes f in wg-quick's syntax. Ignored keys are not written.
+func (f *File) Format() []byte {
+	var b bytes.Buffer
+	b.WriteString("[Interface]\n")
+	writeKey(&b, "PrivateKey", f.Interface.PrivateKey)
+	writeKey(&b, "Address", strings.Join(f.Interface.Addresses, ", "))
+	writeKey(&b, "DNS", strings.Join(f.Interface.DNS, ", "))
+	if f.Interface.MTU > 0 {
+		writeKey(&b, "MTU", strconv.Itoa(f.Interface.MTU))
+	}
+	if f.Interface.ListenPort > 0 {
+		writeKey(&b, "ListenPort", strconv.Itoa(f.Interface.ListenPort))
+	}
+	for _, p := range f.Peers {
+		b.WriteString("\n[Peer]\n")
+		writeKey(&b, "PublicKey", p.PublicKey)
+		writeKey(&b, "PresharedKey", p.PresharedKey)
+		writeKey(&b, "Endpoint", p.Endpoint)
+		writeKey(&b, "AllowedIPs", strings.Join(p.AllowedIPs, ", "))
+		if p.PersistentKeepalive > 0 {
+			writeKey(&b, "PersistentKeepalive", strconv.Itoa(p.PersistentKeepalive))
+		}
+	}
+	return b.Bytes()
+}
+
+func writeKey(b *bytes.Buffer, key, value string) {
+	if value != "" {
+		fmt.Fprintf(b, "%s = %s\n", key, value)
+	}
+}
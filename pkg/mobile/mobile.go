@@ -0,0 +1,66 @@
+// Package mobile is the gomobile binding for the VPN client. Build it with
+//
+//	gomobile bind -target=android ./pkg/mobile
+//	gomobile bind -target=ios ./pkg/mobile
+//
+// The app creates the tunnel interface itself (VpnService.Builder on
+// Android, NEPacketTunnelProvider on iOS) and passes its file descriptor to
+// Start. Only types gomobile can bind appear in this API.
+package mobile
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/gedons/go_VPN/pkg/vpn"
+)
+
+// SocketProtector is implemented by the app to keep the tunnel's own UDP
+// socket out of the tunnel. On Android, forward to VpnService.protect.
+type SocketProtector interface {
+	Protect(fd int) bool
+}
+
+// Tunnel is a running client.
+type Tunnel struct {
+	client *vpn.Client
+}
+
+// Start connects using the client YAML config in configYAML and the TUN
+// descriptor tunFD, which the tunnel takes ownership of. protector may be
+// nil where no protection is needed, as on iOS.
+func Start(configYAML string, tunFD int, protector SocketProtector) (*Tunnel, error) {
+	cfg, err := vpn.ParseConfig([]byte(configYAML))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Mode != "client" {
+		return nil, errors.New("mobile: config mode must be client")
+	}
+	client, err := vpn.NewClientWithFD(cfg, tunFD)
+	if err != nil {
+		return nil, err
+	}
+	if protector != nil {
+		client.SetSocketProtector(func(fd uintptr) bool { return protector.Protect(int(fd)) })
+	}
+	if err := client.Start(); err != nil {
+		return nil, err
+	}
+	return &Tunnel{client: client}, nil
+}
+
+// Stop disconnects and closes the TUN descriptor.
+func (t *Tunnel) Stop() {
+	t.client.Stop()
+}
+
+// Status returns the client status as JSON, in the same shape as the
+// management API's GET /status.
+func (t *Tunnel) Status() string {
+	b, err := json.Marshal(t.client.Status())
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
@@ -0,0 +1,159 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	// Servers in minimal containers and on Windows often have no zone
+	// database for timezone to be looked up in.
+	_ "time/tzdata"
+)
+
+// accessCheckInterval is how often sessions are checked against their
+// client's access window, and so how late past its end one may be dropped.
+const accessCheckInterval = 30 * time.Second
+
+// accessWindow is when a provisioned client may connect, from its
+// allowed_hours, allowed_days, and timezone.
+type accessWindow struct {
+	from, to int     // minutes after midnight; to may be less, for a window over midnight
+	days     [7]bool // by time.Weekday, the days a window may start on
+	loc      *time.Location
+	text     string
+}
+
+// parseAccessWindow parses a client's schedule. It returns nil if c may
+// connect at any time.
+func parseAccessWindow(c ClientEntry) (*accessWindow, error) {
+	if c.AllowedHours == "" && len(c.AllowedDays) == 0 {
+		if c.Timezone != "" {
+			return nil, fmt.Errorf("timezone needs allowed_hours or allowed_days")
+		}
+		return nil, nil
+	}
+	w := &accessWindow{to: 24 * 60, loc: time.Local}
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("timezone: %w", err)
+		}
+		w.loc = loc
+	}
+	if c.AllowedHours != "" {
+		from, to, ok := strings.Cut(c.AllowedHours, "-")
+		var err1, err2 error
+		w.from, err1 = parseClock(from)
+		w.to, err2 = parseClock(to)
+		if !ok || err1 != nil || err2 != nil || w.from == w.to || w.from == 24*60 {
+			return nil, fmt.Errorf("allowed_hours %q: want a range like 08:00-18:00", c.AllowedHours)
+		}
+	}
+	if len(c.AllowedDays) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, d := range c.AllowedDays {
+		first, last, isRange := strings.Cut(d, "-")
+		a, err1 := parseWeekday(first)
+		b, err2 := a, error(nil)
+		if isRange {
+			b, err2 = parseWeekday(last)
+		}
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("allowed_days: %q is not a day like mon or a range like mon-fri", d)
+		}
+		for day := a; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == b {
+				break
+			}
+		}
+	}
+	w.text = w.describe(c)
+	return w, nil
+}
+
+// parseClock parses hh:mm, up to 24:00, as minutes after midnight.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// parseWeekday parses a day's name, such as mon or monday.
+func parseWeekday(s string) (time.Weekday, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if s == name || s == name[:3] {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", s)
+}
+
+func (w *accessWindow) describe(c ClientEntry) string {
+	var parts []string
+	if c.AllowedHours != "" {
+		parts = append(parts, c.AllowedHours)
+	}
+	if len(c.AllowedDays) > 0 {
+		parts = append(parts, strings.Join(c.AllowedDays, ","))
+	}
+	return strings.Join(append(parts, w.loc.String()), " ")
+}
+
+// allows reports whether t falls inside the window. The part of a window
+// over midnight that falls on the next day belongs to the day it started.
+// w may be nil.
+func (w *accessWindow) allows(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	t = t.In(w.loc)
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case w.from < w.to:
+		return w.days[day] && m >= w.from && m < w.to
+	case m >= w.from:
+		return w.days[day]
+	case m < w.to:
+		return w.days[(day+6)%7]
+	}
+	return false
+}
+
+// loopAccess drops the sessions of clients whose access window has
+// closed. Their handshakes are refused until it opens again.
+func (s *Server) loopAccess() {
+	defer s.wg.Done()
+	defer s.journal.guard()
+	ticker := time.NewTicker(accessCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.closeAccessWindows(now)
+		}
+	}
+}
+
+func (s *Server) closeAccessWindows(now time.Time) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for id, sess := range s.sessions {
+		if w := s.access[sess.name]; sess.name != "" && !w.allows(now) {
+			log.Printf("Session %08x of client %q ended: outside its access window (%s)", id, sess.name, w.text)
+			s.removeSessionLocked(id, "access_window")
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	rtmetrics "runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+	"github.com/gedons/go_VPN/internal/sysload"
+)
+
+const (
+	// DefaultAdmissionRetryAfter is how long a refused client is asked to
+	// wait when admission.retry_after is unset.
+	DefaultAdmissionRetryAfter = 30 * time.Second
+
+	// admissionInterval is how often a server measures its load.
+	admissionInterval = 2 * time.Second
+
+	// admissionResume is the share of every limit the load must drop
+	// under before a refusing server admits clients again, so a load
+	// hovering at a limit does not flip it on every measurement.
+	admissionResume = 0.9
+)
+
+// AdmissionConfig refuses new clients, on a server, while it is short of
+// capacity, so the sessions it has keep their quality. It is off unless a
+// limit is set.
+type AdmissionConfig struct {
+	MaxCPU        float64       `yaml:"max_cpu"`         // percent of all CPUs busy, host-wide
+	MaxPacketRate float64       `yaml:"max_packet_rate"` // tunnel packets per second, both ways
+	MaxMemory     string        `yaml:"max_memory"`      // memory the server holds, such as 512mb
+	RetryAfter    time.Duration `yaml:"retry_after"`     // how long refused clients wait; DefaultAdmissionRetryAfter if unset
+	Alternate     string        `yaml:"alternate"`       // host:port of a server, sharing the PSK, refused clients try meanwhile
+}
+
+// Enabled reports whether admission control is configured.
+func (c AdmissionConfig) Enabled() bool {
+	return c.MaxCPU > 0 || c.MaxPacketRate > 0 || c.MaxMemory != ""
+}
+
+func (c AdmissionConfig) validate(mode string) error {
+	switch {
+	case !c.Enabled() && (c.RetryAfter != 0 || c.Alternate != ""):
+		return fmt.Errorf("admission: set max_cpu, max_packet_rate or max_memory")
+	case !c.Enabled():
+		return nil
+	case mode != "server":
+		return fmt.Errorf("admission is a server setting")
+	case c.MaxCPU < 0 || c.MaxCPU > 100:
+		return fmt.Errorf("admission: max_cpu is a percentage, between 0 and 100")
+	case c.MaxPacketRate < 0 || c.RetryAfter < 0:
+		return fmt.Errorf("admission: max_packet_rate and retry_after cannot be negative")
+	case c.MaxCPU > 0 && runtime.GOOS != "linux" && runtime.GOOS != "windows":
+		return fmt.Errorf("admission: max_cpu is only supported on Linux and Windows")
+	}
+	if c.MaxMemory != "" {
+		if _, err := parseBytes(c.MaxMemory); err != nil {
+			return fmt.Errorf("admission: max_memory: %w", err)
+		}
+	}
+	if c.Alternate != "" {
+		if _, _, err := net.SplitHostPort(c.Alternate); err != nil {
+			return fmt.Errorf("admission: alternate: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c AdmissionConfig) retryAfter() time.Duration {
+	if c.RetryAfter > 0 {
+		return c.RetryAfter
+	}
+	return DefaultAdmissionRetryAfter
+}
+
+// AdmissionStatus is a server's load against its admission limits, as
+// listed by GET /admission.
+type AdmissionStatus struct {
+	Refusing   bool    `json:"refusing"`
+	Reason     string  `json:"reason,omitempty"` // the limit exceeded, while refusing
+	CPU        float64 `json:"cpu"`              // percent, zero unless max_cpu is set
+	PacketRate float64 `json:"packet_rate"`      // packets per second
+	Memory     uint64  `json:"memory"`           // bytes
+	Refused    uint64  `json:"refused"`          // handshakes refused since start
+}
+
+// admission measures a server's load and decides whether it takes on new
+// clients.
+type admission struct {
+	cfg       AdmissionConfig
+	maxMemory uint64
+	cpu       sysload.CPU
+
+	mu        sync.Mutex
+	status    AdmissionStatus
+	packets   uint64 // tunnel packets at the last measurement
+	sampledAt time.Time
+}
+
+func newAdmission(cfg AdmissionConfig) *admission {
+	a := &admission{cfg: cfg, sampledAt: time.Now()}
+	if cfg.MaxMemory != "" {
+		n, _ := parseBytes(cfg.MaxMemory)
+		a.maxMemory = uint64(n)
+	}
+	if cfg.MaxCPU > 0 {
+		a.cpu.Sample()
+	}
+	return a
+}
+
+// busy reports why new clients are refused, or "" while they are
+// admitted. A nil a admits everyone.
+func (a *admission) busy() string {
+	if a == nil {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.status.Reason
+}
+
+// measure takes the server's load, given the tunnel packets it has carried
+// so far, and starts or stops refusing clients.
+func (a *admission) measure(packets uint64, now time.Time) {
+	var cpu float64
+	if a.cfg.MaxCPU > 0 {
+		var err error
+		if cpu, err = a.cpu.Sample(); err != nil {
+			errorLog.Printf("Admission: %v", err)
+		}
+	}
+	memory := heldMemory()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := &a.status
+	st.CPU, st.Memory = cpu, memory
+	if d := now.Sub(a.sampledAt).Seconds(); d > 0 {
+		st.PacketRate = float64(packets-a.packets) / d
+	}
+	a.packets, a.sampledAt = packets, now
+	over := a.overLocked(1)
+	switch {
+	case over != "" && !st.Refusing:
+		log.Printf("Admission: refusing new clients, %s", over)
+		st.Refusing, st.Reason = true, over
+	case over != "":
+		st.Reason = over
+	case st.Refusing && a.overLocked(admissionResume) == "":
+		log.Printf("Admission: admitting new clients again")
+		st.Refusing, st.Reason = false, ""
+	}
+}
+
+// overLocked names the first limit, scaled by share, the load is over, or
+// returns "". Callers must hold mu.
+func (a *admission) overLocked(share float64) string {
+	st := &a.status
+	switch {
+	case a.cfg.MaxCPU > 0 && st.CPU > share*a.cfg.MaxCPU:
+		return fmt.Sprintf("CPU at %.0f%% (max_cpu %g%%)", st.CPU, a.cfg.MaxCPU)
+	case a.cfg.MaxPacketRate > 0 && st.PacketRate > share*a.cfg.MaxPacketRate:
+		return fmt.Sprintf("%.0f packets/s (max_packet_rate %g)", st.PacketRate, a.cfg.MaxPacketRate)
+	case a.maxMemory > 0 && float64(st.Memory) > share*float64(a.maxMemory):
+		return fmt.Sprintf("%d MB of memory (max_memory %s)", st.Memory>>20, a.cfg.MaxMemory)
+	}
+	return ""
+}
+
+// heldMemory returns the memory the Go runtime holds from the system, less
+// what it has handed back.
+func heldMemory() uint64 {
+	samples := []rtmetrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	rtmetrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// loopAdmission measures the server's load every admissionInterval.
+func (s *Server) loopAdmission() {
+	defer s.wg.Done()
+	defer s.journal.guard()
+	ticker := time.NewTicker(admissionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.admission.measure(s.stats.packetsIn.Load()+s.stats.packetsOut.Load(), time.Now())
+	}
+}
+
+// refuseBusy answers a Hello with a refusal, pointing the client at the
+// alternate server, when the server is short of capacity and the client
+// has no session from addr already. It reports whether it refused.
+func (s *Server) refuseBusy(ln *listener, addr net.Addr, key pskEntry, welcome *protocol.Welcome) bool {
+	reason := s.admission.busy()
+	if reason == "" || s.sessionAt(ln, addr) {
+		return false
+	}
+	s.admission.mu.Lock()
+	s.admission.status.Refused++
+	s.admission.mu.Unlock()
+	welcome.Error = "server busy: " + reason
+	welcome.RetryAfter = int64(s.cfg.Admission.retryAfter() / time.Second)
+	welcome.Alternate = s.cfg.Admission.Alternate
+	s.sendWelcome(ln, key.hs, addr, 0, welcome)
+	return true
+}
+
+// sessionAt reports whether a session's client is reached through ln at
+// addr, so its handshake renews a session rather than adding one.
+func (s *Server) sessionAt(ln *listener, addr net.Addr) bool {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	for _, sess := range s.sessions {
+		if sess.at(ln, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Admission returns the server's load against its admission limits.
+func (s *Server) Admission() AdmissionStatus {
+	if s.admission == nil {
+		return AdmissionStatus{}
+	}
+	s.admission.mu.Lock()
+	defer s.admission.mu.Unlock()
+	return s.admission.status
+}
+
+// busyError is a refusal from a server short of capacity.
+type busyError struct {
+	reason     string
+	retryAfter time.Duration
+	alternate  string // the server it suggested instead, if any
+}
+
+func (e *busyError) Error() string {
+	return fmt.Sprintf("server rejected handshake: %s; retry after %v", e.reason, e.retryAfter)
+}
+
+// redirected takes a handshake's err. When a busy server refused the
+// client and named another, it moves there and reports true, so the
+// handshake can be tried again at once; otherwise the client leaves the
+// busy server alone until it asked to be tried again.
+func (c *Client) redirected(err error) bool {
+	var busy *busyError
+	if !errors.As(err, &busy) {
+		return false
+	}
+	server := c.serverAddress()
+	if busy.alternate == "" || busy.alternate == server {
+		c.retryAt.Store(time.Now().Add(busy.retryAfter))
+		return false
+	}
+	log.Printf("Server %s is busy; trying %s, which it suggested", server, busy.alternate)
+	if err := c.redirectTo(busy.alternate); err != nil {
+		log.Printf("Server %s: %v", busy.alternate, err)
+		c.retryAt.Store(time.Now().Add(busy.retryAfter))
+		return false
+	}
+	return true
+}
+
+// redirectTo moves the outer socket to address, a server a busy one
+// suggested, over the configured transport.
+func (c *Client) redirectTo(address string) error {
+	c.rebindMu.Lock()
+	defer c.rebindMu.Unlock()
+	conn, err := c.dialAddress(address)
+	if err != nil {
+		return err
+	}
+	old := c.conn.Swap(&clientConn{conn})
+	c.redirect.Store(&address)
+	c.transport.Store(0)
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// allowedRoute sends packets for prefix, one of a provisioned client's
+// allowed_ips, to that client's session. sess is nil while the client is
+// offline; its packets are then dropped instead of broadcast.
+type allowedRoute struct {
+	prefix netip.Prefix
+	client string
+	sess   *serverSession
+}
+
+// parseAllowedIPs parses a client's allowed_ips.
+func parseAllowedIPs(ips []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, ip := range ips {
+		p, err := netip.ParsePrefix(ip)
+		if err != nil {
+			return nil, fmt.Errorf("allowed_ips: %w", err)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// checkAllowedLocked reports an error if one of prefixes is already
+// allowed to another client. Callers must hold sessionsMu.
+func (s *Server) checkAllowedLocked(client string, prefixes []netip.Prefix) error {
+	for _, p := range prefixes {
+		for _, r := range s.allowed {
+			if r.prefix == p && r.client != client {
+				return fmt.Errorf("allowed_ips: %s already belongs to client %q", p, r.client)
+			}
+		}
+	}
+	return nil
+}
+
+// addAllowedLocked routes prefixes to client, most specific first.
+// Callers must hold sessionsMu for writing.
+func (s *Server) addAllowedLocked(client string, prefixes []netip.Prefix) {
+	for _, p := range prefixes {
+		s.allowed = append(s.allowed, allowedRoute{prefix: p, client: client})
+	}
+	slices.SortStableFunc(s.allowed, func(a, b allowedRoute) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+}
+
+// removeAllowedLocked drops client's routes. Callers must hold sessionsMu
+// for writing.
+func (s *Server) removeAllowedLocked(client string) {
+	s.allowed = slices.DeleteFunc(s.allowed, func(r allowedRoute) bool {
+		return r.client == client
+	})
+}
+
+// bindAllowedLocked points the routes of sess's client at sess and gives
+// sess the prefixes it may send from. Callers must hold sessionsMu for
+// writing.
+func (s *Server) bindAllowedLocked(sess *serverSession) {
+	if sess.name == "" {
+		return
+	}
+	sess.allowed = nil
+	for i := range s.allowed {
+		if s.allowed[i].client == sess.name {
+			s.allowed[i].sess = sess
+			sess.allowed = append(sess.allowed, s.allowed[i].prefix)
+		}
+	}
+}
+
+// unbindAllowedLocked clears the routes that point at sess. Callers must
+// hold sessionsMu for writing.
+func (s *Server) unbindAllowedLocked(sess *serverSession) {
+	for i := range s.allowed {
+		if s.allowed[i].sess == sess {
+			s.allowed[i].sess = nil
+		}
+	}
+}
+
+// allowedRouteLocked returns the most specific allowed_ips route covering
+// dst, or nil. Callers must hold sessionsMu.
+func (s *Server) allowedRouteLocked(dst netip.Addr) *allowedRoute {
+	for i := range s.allowed {
+		if s.allowed[i].prefix.Contains(dst) {
+			return &s.allowed[i]
+		}
+	}
+	return nil
+}
+
+// sourceAllowed reports whether a client with allowed_ips may send pkt:
+// its source must be the client's own address or in its allowed_ips.
+// Clients without allowed_ips are not checked here.
+func (sess *serverSession) sourceAllowed(pkt []byte) bool {
+	if len(sess.allowed) == 0 {
+		return true
+	}
+	src, ok := packetSrc(pkt)
+	if !ok {
+		return false
+	}
+	return src == sess.address || src == sess.address6 || sess.delegated.Contains(src) || containsAddr(sess.allowed, src)
+}
+
+func containsAddr(prefixes []netip.Prefix, a netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeIntoTunnel routes prefixes into the server's adapter, so the host
+// sends traffic for them into the tunnel. Devices supplied by an embedder
+// are left to the embedder.
+func (s *Server) routeIntoTunnel(prefixes []netip.Prefix) {
+	r, ok := s.tunMgr.(tun.Router)
+	if !ok {
+		return
+	}
+	for _, p := range prefixes {
+		if err := r.AddRoute(p); err != nil {
+			log.Printf("Route %s into the tunnel: %v", p, err)
+		}
+	}
+}
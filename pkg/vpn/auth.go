@@ -0,0 +1,311 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+	"github.com/gedons/go_VPN/internal/radius"
+)
+
+// authTimeout bounds a login check, so a client gets its answer before it
+// gives up on the handshake.
+const authTimeout = 8 * time.Second
+
+// Radius defaults.
+const (
+	DefaultRadiusTimeout = 3 * time.Second
+	DefaultRadiusRetries = 2
+)
+
+// AuthConfig makes a server check each client's username and password,
+// after its PSK, with a login service. It is off unless a service is set;
+// at most one may be.
+type AuthConfig struct {
+	Radius *RadiusConfig `yaml:"radius"`
+	LDAP   *LDAPConfig   `yaml:"ldap"`
+}
+
+// RadiusConfig checks logins with RADIUS servers, using PAP.
+type RadiusConfig struct {
+	Servers       []string      `yaml:"servers"` // host:port, tried in order; port 1812 if left out
+	Secret        string        `yaml:"secret"`
+	NASIdentifier string        `yaml:"nas_identifier"` // defaults to govpn
+	Timeout       time.Duration `yaml:"timeout"`        // per attempt; DefaultRadiusTimeout if unset
+	Retries       int           `yaml:"retries"`        // attempts per server; DefaultRadiusRetries if unset
+}
+
+// Enabled reports whether a login service is configured.
+func (c AuthConfig) Enabled() bool {
+	return c.Radius != nil || c.LDAP != nil
+}
+
+func (c AuthConfig) validate(mode string, fips bool) error {
+	if !c.Enabled() {
+		return nil
+	}
+	if mode != "server" {
+		return fmt.Errorf("auth is a server setting; clients set username and password")
+	}
+	if c.Radius != nil && c.LDAP != nil {
+		return fmt.Errorf("auth: set radius or ldap, not both")
+	}
+	if c.LDAP != nil {
+		return c.LDAP.validate()
+	}
+	r := c.Radius
+	switch {
+	case len(r.Servers) == 0:
+		return fmt.Errorf("auth: radius needs servers")
+	case r.Secret == "":
+		return fmt.Errorf("auth: radius needs a secret")
+	case r.Timeout < 0 || r.Retries < 0:
+		return fmt.Errorf("auth: radius timeout and retries cannot be negative")
+	case fips:
+		return fmt.Errorf("auth: radius uses MD5, which fips_mode does not allow")
+	}
+	return nil
+}
+
+// AuthMeta describes the client whose login is being checked.
+type AuthMeta struct {
+	Endpoint string // the client's public address and port
+	Client   string // provisioned client name, if any
+	Label    string // name the client gave itself, such as its hostname
+	Software string // release version the client reported
+}
+
+// AuthResult is an AuthProvider's decision.
+type AuthResult struct {
+	Allow bool
+	// Reason says why a login was refused. It is logged and shown to the
+	// client, so it should not say whether the user exists.
+	Reason string
+	// Attributes are what the provider knows of the user, such as RADIUS
+	// Class and Filter-Id values, kept with the session. Values under
+	// "groups" are matched against profiles.
+	Attributes map[string][]string
+}
+
+// AuthProvider checks the username and password a client sends in its
+// handshake, after its PSK has been checked. A server that has one refuses
+// clients that send no username. Authenticate must be safe for concurrent
+// use and should return by the time ctx is done; an error refuses the
+// client.
+type AuthProvider interface {
+	Authenticate(ctx context.Context, identity, credentials string, meta AuthMeta) (AuthResult, error)
+}
+
+// AuthProviderFunc adapts a function to AuthProvider.
+type AuthProviderFunc func(ctx context.Context, identity, credentials string, meta AuthMeta) (AuthResult, error)
+
+func (f AuthProviderFunc) Authenticate(ctx context.Context, identity, credentials string, meta AuthMeta) (AuthResult, error) {
+	return f(ctx, identity, credentials, meta)
+}
+
+// SetAuthProvider makes the server check logins with p in place of the
+// auth setting. It must be called before Start.
+func (s *Server) SetAuthProvider(p AuthProvider) {
+	s.auth = &authenticator{provider: p, pending: make(map[string]bool)}
+}
+
+// authenticator runs logins off the receive loop, so a slow login service
+// holds up only the client waiting on it.
+type authenticator struct {
+	provider AuthProvider
+
+	mu      sync.Mutex
+	pending map[string]bool // Hello nonces being checked
+}
+
+// begin marks the login of a Hello with nonce as started. It reports false
+// if one already is, for a retransmitted Hello.
+func (a *authenticator) begin(nonce []byte) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pending[string(nonce)] {
+		return false
+	}
+	a.pending[string(nonce)] = true
+	return true
+}
+
+func (a *authenticator) end(nonce []byte) {
+	a.mu.Lock()
+	delete(a.pending, string(nonce))
+	a.mu.Unlock()
+}
+
+// authenticate checks the login in hello and, if it is good, goes on with
+// the handshake in admit; otherwise it refuses the client. It runs on its
+// own goroutine.
+func (s *Server) authenticate(hs *handshakeContext) {
+	defer s.wg.Done()
+	defer s.auth.end(hs.hello.Nonce)
+	meta := AuthMeta{
+		Endpoint: hs.addr.String(),
+		Client:   hs.key.client,
+		Label:    cleanLabel(hs.hello.Name),
+		Software: cleanLabel(hs.hello.Software),
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, authTimeout)
+	res, err := s.auth.provider.Authenticate(ctx, hs.hello.User, hs.hello.Password, meta)
+	cancel()
+	if s.ctx.Err() != nil {
+		return
+	}
+	user := cleanLabel(hs.hello.User)
+	if err != nil || !res.Allow {
+		reason := res.Reason
+		if err != nil {
+			log.Printf("Rejecting %s: login of %q: %v", hs.addr, user, err)
+			reason = "login failed"
+		} else {
+			if reason == "" {
+				reason = "invalid username or password"
+			}
+			log.Printf("Rejecting %s: login of %q refused: %s", hs.addr, user, reason)
+			s.lockout.failed(hs.addr)
+		}
+		ev := Event{Type: EventAuthFailed, Client: hs.key.client, User: user, Endpoint: hs.addr.String(), Reason: "login"}
+		ev.setGeo(hs.geo)
+		s.hooks.emit(ev)
+		hs.welcome.Error = reason
+		s.sendWelcome(hs.ln, hs.key.hs, hs.addr, 0, hs.welcome)
+		return
+	}
+	profiles, err := s.authorize(res.Attributes)
+	if err != nil {
+		log.Printf("Rejecting %s: login of %q: %v", hs.addr, user, err)
+		ev := Event{Type: EventAuthFailed, Client: hs.key.client, User: user, Endpoint: hs.addr.String(), Reason: "profile"}
+		ev.setGeo(hs.geo)
+		s.hooks.emit(ev)
+		hs.welcome.Error = err.Error()
+		s.sendWelcome(hs.ln, hs.key.hs, hs.addr, 0, hs.welcome)
+		return
+	}
+	hs.user, hs.attrs, hs.profiles = user, res.Attributes, profiles
+	s.admit(hs)
+}
+
+// radiusProvider checks logins with RADIUS servers.
+type radiusProvider struct {
+	client *radius.Client
+}
+
+func newRadiusProvider(cfg RadiusConfig) *radiusProvider {
+	c := &radius.Client{
+		Secret:        cfg.Secret,
+		NASIdentifier: cfg.NASIdentifier,
+		Timeout:       cfg.Timeout,
+		Retries:       cfg.Retries,
+	}
+	if c.NASIdentifier == "" {
+		c.NASIdentifier = "govpn"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultRadiusTimeout
+	}
+	if c.Retries == 0 {
+		c.Retries = DefaultRadiusRetries
+	}
+	for _, server := range cfg.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "1812")
+		}
+		c.Servers = append(c.Servers, server)
+	}
+	return &radiusProvider{client: c}
+}
+
+// radiusAttributes are the reply attributes kept with a session, by name.
+var radiusAttributes = map[byte]string{
+	radius.AttrClass:           "Class",
+	radius.AttrFilterID:        "Filter-Id",
+	radius.AttrFramedIPAddress: "Framed-IP-Address",
+	radius.AttrSessionTimeout:  "Session-Timeout",
+	radius.AttrReplyMessage:    "Reply-Message",
+}
+
+func (p *radiusProvider) Authenticate(ctx context.Context, identity, credentials string, meta AuthMeta) (AuthResult, error) {
+	caller, _, _ := net.SplitHostPort(meta.Endpoint)
+	resp, err := p.client.Authenticate(ctx, identity, credentials, caller)
+	if err != nil {
+		return AuthResult{}, err
+	}
+	res := AuthResult{Attributes: make(map[string][]string)}
+	for _, a := range resp.Attributes {
+		name, ok := radiusAttributes[a.Type]
+		if !ok {
+			continue
+		}
+		var v string
+		switch a.Type {
+		case radius.AttrFramedIPAddress:
+			if len(a.Value) == 4 {
+				v = net.IP(a.Value).String()
+			}
+		case radius.AttrSessionTimeout:
+			if len(a.Value) == 4 {
+				v = strconv.FormatUint(uint64(a.Value[0])<<24|uint64(a.Value[1])<<16|uint64(a.Value[2])<<8|uint64(a.Value[3]), 10)
+			}
+		default:
+			v = string(a.Value)
+		}
+		if v != "" {
+			res.Attributes[name] = append(res.Attributes[name], v)
+		}
+	}
+	switch resp.Code {
+	case radius.CodeAccessAccept:
+		res.Allow = true
+	case radius.CodeAccessReject:
+		if msgs := res.Attributes["Reply-Message"]; len(msgs) > 0 {
+			res.Reason = cleanLabel(msgs[0])
+		}
+	case radius.CodeAccessChallenge:
+		res.Reason = "login needs a second step, which is not supported"
+	default:
+		return res, fmt.Errorf("radius: unexpected answer code %d", resp.Code)
+	}
+	return res, nil
+}
+
+// errNoCredentials refuses clients that send no username to a server that
+// checks logins.
+var errNoCredentials = errors.New("server requires a username and password")
+
+// checkCredentials reports whether hello carries a login the server can
+// check.
+func checkCredentials(hello *protocol.Hello) error {
+	if hello.User == "" || hello.Password == "" {
+		return errNoCredentials
+	}
+	return nil
+}
+
+// attributesString joins attrs for a log line, in a stable order.
+func attributesString(attrs map[string][]string) string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	out := ""
+	for _, k := range keys {
+		for _, v := range attrs[k] {
+			if out != "" {
+				out += ", "
+			}
+			out += k + "=" + v
+		}
+	}
+	return out
+}
@@ -0,0 +1,120 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// AutoTransport makes a client pick its transport: udp at server_address or
+// one of migrate, whichever answers first, starting with the one that
+// worked last on the network.
+const AutoTransport = "auto"
+
+// autoStagger is how much later each candidate starts than the one before
+// it, so a preferred transport that answers promptly wins the race.
+const autoStagger = 300 * time.Millisecond
+
+// validateAutoTransport checks transport auto, which picks among udp and
+// the migrate entries.
+func (cfg Config) validateAutoTransport() error {
+	switch {
+	case cfg.Transport != AutoTransport:
+		return nil
+	case cfg.Mode != "client":
+		return fmt.Errorf("transport auto is a client setting")
+	case len(cfg.Migrate) == 0:
+		return fmt.Errorf("transport auto needs migrate, the transports to try besides udp")
+	}
+	return nil
+}
+
+// transportOrder returns the ways to the server in the order to try them:
+// the one that worked last on the network the host is on, then udp and the
+// migrate entries as listed.
+func (c *Client) transportOrder() []int {
+	n := len(c.cfg.Migrate) + 1
+	order := make([]int, 0, n)
+	if p, ok := c.networks.lookup(); ok {
+		if i, _, ok := c.pathIndex(p.Transport, p.Endpoint); ok {
+			order = append(order, i)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if len(order) == 0 || order[0] != i {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// pickTransport races a probe handshake over each way to the server, each
+// starting autoStagger after the one before it in transportOrder, and
+// returns the first to answer with its socket.
+func (c *Client) pickTransport() (int, outerConn, error) {
+	type result struct {
+		i    int
+		conn outerConn
+		err  error
+	}
+	order := c.transportOrder()
+	results := make(chan result, len(order))
+	for k, i := range order {
+		go func() {
+			select {
+			case <-c.ctx.Done():
+				results <- result{i, nil, c.ctx.Err()}
+				return
+			case <-time.After(time.Duration(k) * autoStagger):
+			}
+			name, address := c.transportPath(i)
+			conn, err := c.dialTransport(name, address)
+			if err == nil {
+				if _, err = c.checkServer(conn); err != nil {
+					conn.Close()
+				}
+			}
+			results <- result{i, conn, err}
+		}()
+	}
+	for n := 0; n < len(order); n++ {
+		r := <-results
+		if r.err != nil {
+			name, address := c.transportPath(r.i)
+			log.Printf("Transport %s at %s: %v", name, address, r.err)
+			continue
+		}
+		// The losers still running are closed as they finish.
+		go func(left int) {
+			for ; left > 0; left-- {
+				if r := <-results; r.err == nil {
+					r.conn.Close()
+				}
+			}
+		}(len(order) - n - 1)
+		return r.i, r.conn, nil
+	}
+	return 0, nil, fmt.Errorf("no transport answered")
+}
+
+// dialAuto picks the transport for a client with transport auto and moves
+// the session there. It reports whether one answered.
+func (c *Client) dialAuto() bool {
+	i, conn, err := c.pickTransport()
+	if err != nil {
+		log.Printf("Transport auto: %v", err)
+		return false
+	}
+	if c.conn.Load() == nil {
+		c.conn.Store(&clientConn{conn})
+		c.transport.Store(int32(i))
+	} else {
+		c.useTransport(i, conn)
+	}
+	name, _ := c.currentTransport()
+	log.Printf("Transport auto: using %s", name)
+	if lowBandwidth(name) {
+		log.Printf("Transport %s is low bandwidth; expect a slow tunnel", name)
+	}
+	return true
+}
@@ -0,0 +1,4 @@
+package vpn
+
+// platformBackends are the host integrations this build uses.
+var platformBackends = []string{"utun", "route", "scutil"}
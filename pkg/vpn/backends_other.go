@@ -0,0 +1,7 @@
+//go:build !windows && !linux && !darwin
+
+package vpn
+
+// platformBackends are the host integrations this build uses. Here the
+// tunnel runs on a TUN file descriptor from the embedder.
+var platformBackends = []string{"tun-fd"}
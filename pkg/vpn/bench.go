@@ -0,0 +1,148 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+const (
+	// benchTick is how often the generator wakes to send its quota.
+	benchTick = time.Millisecond
+	// benchDrainGrace is how long the receiver waits for stragglers after
+	// the generator stops.
+	benchDrainGrace = time.Second
+)
+
+// BenchOptions configures a soak test.
+type BenchOptions struct {
+	Duration   time.Duration // how long to generate traffic
+	PPS        int           // target packets per second
+	Size       int           // inner packet size in bytes, including the IPv4 header
+	FastPath   string        // the server's fast_path, such as af_packet
+	UDPOffload bool          // udp_offload on both ends
+}
+
+// BenchResult summarises a soak test.
+type BenchResult struct {
+	Duration    time.Duration
+	Sent        uint64 // packets accepted by the client's TUN queue
+	Received    uint64 // packets the server wrote to its TUN device
+	QueueDrops  uint64 // packets the generator could not queue
+	AchievedPPS float64
+	Mbps        float64 // inner payload throughput at the server
+	P50         time.Duration
+	P90         time.Duration
+	P99         time.Duration
+	Max         time.Duration
+}
+
+// DropRate is the fraction of generated packets that never arrived.
+func (r BenchResult) DropRate() float64 {
+	total := r.Sent + r.QueueDrops
+	if total == 0 {
+		return 0
+	}
+	return float64(total-r.Received) / float64(total)
+}
+
+// Bench pushes synthetic traffic from a client to a server over loopback at
+// a fixed rate and measures what comes out the other side. Each packet
+// carries its send time, so latency covers the whole client and server data
+// path including encryption.
+func Bench(opts BenchOptions) (BenchResult, error) {
+	if opts.Duration <= 0 || opts.PPS <= 0 {
+		return BenchResult{}, errors.New("bench: duration and pps must be positive")
+	}
+	if opts.Size == 0 {
+		opts.Size = 1400
+	}
+	if opts.Size < syntheticHeaderLen+syntheticPayloadLen || opts.Size > 65535 {
+		return BenchResult{}, fmt.Errorf("bench: size must be between %d and 65535", syntheticHeaderLen+syntheticPayloadLen)
+	}
+
+	h, err := newHarness(1, ImpairmentConfig{}, func(cfg *Config) {
+		cfg.FastPath = opts.FastPath
+		cfg.UDPOffload = opts.UDPOffload
+	})
+	if err != nil {
+		return BenchResult{}, err
+	}
+	defer h.Close()
+
+	var (
+		res       BenchResult
+		bytes     uint64
+		latencies []time.Duration
+		wg        sync.WaitGroup
+	)
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case pkt := <-h.ServerDelivered():
+				_, _, sentAt, err := parseSyntheticTime(pkt)
+				if err != nil {
+					continue
+				}
+				res.Received++
+				bytes += uint64(len(pkt))
+				latencies = append(latencies, time.Since(sentAt))
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	src, dst := harnessClientIP(0), harnessServerIP()
+	ticker := time.NewTicker(benchTick)
+	start := time.Now()
+	var seq uint32
+	for now := start; now.Sub(start) < opts.Duration; now = <-ticker.C {
+		// Send whatever the schedule says is due, so a late tick catches up.
+		due := uint64(now.Sub(start).Seconds() * float64(opts.PPS))
+		for res.Sent+res.QueueDrops < due {
+			pkt := syntheticPacket(src, dst, 0, seq, time.Now(), opts.Size)
+			seq++
+			switch err := h.InjectFromClient(0, pkt); {
+			case err == nil:
+				res.Sent++
+			case errors.Is(err, tun.ErrQueueFull):
+				res.QueueDrops++
+			default:
+				ticker.Stop()
+				return BenchResult{}, fmt.Errorf("bench: inject: %w", err)
+			}
+		}
+	}
+	ticker.Stop()
+	res.Duration = time.Since(start)
+
+	time.Sleep(benchDrainGrace)
+	close(stop)
+	wg.Wait()
+
+	secs := res.Duration.Seconds()
+	res.AchievedPPS = float64(res.Received) / secs
+	res.Mbps = float64(bytes) * 8 / secs / 1e6
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		res.P50 = percentile(latencies, 0.50)
+		res.P90 = percentile(latencies, 0.90)
+		res.P99 = percentile(latencies, 0.99)
+		res.Max = latencies[len(latencies)-1]
+	}
+	return res, nil
+}
+
+// percentile returns the p-th quantile of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p * float64(len(sorted)-1))
+	return sorted[i]
+}
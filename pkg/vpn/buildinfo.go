@@ -0,0 +1,91 @@
+package vpn
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/gedons/go_VPN/internal/buildinfo"
+	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// ciphers are the algorithms the tunnel uses; there is one suite.
+var ciphers = []string{"AES-256-GCM", "HKDF-SHA256", "HMAC-SHA256"}
+
+// BuildInfo describes the running binary, so operators can audit which
+// versions and features a fleet runs. The management API serves it at
+// GET /version.
+type BuildInfo struct {
+	Version    string   `json:"version"`
+	Commit     string   `json:"commit,omitempty"`
+	Date       string   `json:"date,omitempty"`
+	Modified   bool     `json:"modified,omitempty"` // built from a tree with uncommitted changes
+	Go         string   `json:"go"`
+	Platform   string   `json:"platform"` // GOOS/GOARCH
+	Protocol   string   `json:"protocol"` // protocol versions spoken
+	Transports []string `json:"transports"`
+	Ciphers    []string `json:"ciphers"`
+	Backends   []string `json:"backends"` // host integrations compiled in
+	FIPS       bool     `json:"fips"`     // Go's FIPS 140-3 module is enabled
+}
+
+// Build reports the running binary.
+func Build() BuildInfo {
+	info := buildinfo.Read()
+	return BuildInfo{
+		Version:    info.Version,
+		Commit:     info.Commit,
+		Date:       info.Date,
+		Modified:   info.Modified,
+		Go:         runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+		Protocol:   protocol.Supported.String(),
+		Transports: Transports(),
+		Ciphers:    ciphers,
+		Backends:   platformBackends,
+		FIPS:       crypto.FIPSEnabled(),
+	}
+}
+
+// software is the release version sent in handshakes.
+var software = sync.OnceValue(func() string {
+	return buildinfo.Read().Version
+})
+
+// String is the one-line form logged at start.
+func (b BuildInfo) String() string {
+	var src []string
+	if b.Commit != "" {
+		commit := b.Commit
+		if b.Modified {
+			commit += "+dirty"
+		}
+		src = append(src, commit)
+	}
+	if b.Date != "" {
+		src = append(src, b.Date)
+	}
+	s := "GoVPN " + b.Version
+	if len(src) > 0 {
+		s += " (" + strings.Join(src, ", ") + ")"
+	}
+	return fmt.Sprintf("%s %s, %s, protocol %s", s, b.Platform, b.Go, b.Protocol)
+}
+
+// checkClientVersion enforces min_client_version against the version a
+// client reported in its Hello. Clients too old to report one, and
+// development builds, do not meet any minimum.
+func (c Config) checkClientVersion(software string) error {
+	if c.MinClientVersion == "" {
+		return nil
+	}
+	if cmp, ok := buildinfo.Compare(software, c.MinClientVersion); !ok || cmp < 0 {
+		if software == "" {
+			software = "unknown"
+		}
+		return fmt.Errorf("client version %s is older than the server's minimum %s; upgrade the client", software, c.MinClientVersion)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package vpn
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// CaptivePortalProbeURL answers 204 No Content on an open network.
+	// Captive portals intercept it with a redirect or a login page.
+	CaptivePortalProbeURL = "http://connectivitycheck.gstatic.com/generate_204"
+
+	captiveProbeTimeout = 5 * time.Second
+	captiveRecheck      = 5 * time.Second
+)
+
+// probeCaptivePortal fetches the probe URL outside the tunnel. It returns
+// the portal's address, or "" if the network is open or the probe failed.
+func (c *Client) probeCaptivePortal() string {
+	ctx, cancel := context.WithTimeout(c.ctx, captiveProbeTimeout)
+	defer cancel()
+	d := c.dialer()
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.DialContext(ctx, network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, CaptivePortalProbeURL, nil)
+	if err != nil {
+		return ""
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return ""
+	case resp.StatusCode >= 300 && resp.StatusCode < 400 && resp.Header.Get("Location") != "":
+		return resp.Header.Get("Location")
+	default:
+		return CaptivePortalProbeURL
+	}
+}
+
+// awaitCaptivePortal checks for a captive portal after a failed handshake.
+// If there is one, it is shown in the client status until the user has
+// signed in, and awaitCaptivePortal reports true once the network is open
+// again so the caller can retry at once. It reports false if there was no
+// portal or the client stopped.
+func (c *Client) awaitCaptivePortal() bool {
+	portal := c.probeCaptivePortal()
+	if portal == "" {
+		return false
+	}
+	log.Printf("Captive portal detected, sign in to the network at %s", portal)
+	c.portal.Store(&portal)
+	defer c.portal.Store(nil)
+	for portal != "" {
+		select {
+		case <-c.ctx.Done():
+			return false
+		case <-time.After(captiveRecheck):
+		}
+		portal = c.probeCaptivePortal()
+	}
+	log.Printf("Captive portal cleared, connecting")
+	return true
+}
@@ -1,115 +1,1234 @@
 package vpn
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/netip"
+	"os"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/greudp"
+	"github.com/gedons/go_VPN/internal/netmon"
+	"github.com/gedons/go_VPN/internal/netstack"
+	"github.com/gedons/go_VPN/internal/power"
+	"github.com/gedons/go_VPN/internal/protocol"
+	"github.com/gedons/go_VPN/internal/stun"
 	"github.com/gedons/go_VPN/internal/tun"
 )
 
+var errHandshakeTimeout = errors.New("handshake timed out")
+
+// stunTimeout bounds each STUN server query at start.
+const stunTimeout = 2 * time.Second
+
 // Client implements the VPN client.
 type Client struct {
-	cfg     Config
-	cipher  *crypto.Cipher
-	tunMgr  *tun.WintunManager
-	udpConn net.Conn
-	ctx     context.Context
-	cancel  context.CancelFunc
-	wg      sync.WaitGroup
+	cfg    Config
+	tunMgr tun.Device
+	mgmt   *http.Server
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// statusPage serves status_page; stopOnce lets its disconnect button
+	// and the owner both call Stop.
+	statusPage *http.Server
+	stopOnce   sync.Once
+
+	// health serves health_address; draining fails readiness once the
+	// client has been asked to shut down.
+	health   *http.Server
+	draining atomic.Bool
+
+	// stack is the userspace network stack standing in for the adapter;
+	// nil unless userspace is set.
+	stack *netstack.Stack
+
+	// forwards is nil unless port_forwards are configured.
+	forwards *portForwards
+
+	// conn is replaced when the server address resolves somewhere else.
+	conn atomic.Pointer[clientConn]
+
+	// session is swapped on re-handshake while the workers keep running.
+	session  atomic.Pointer[clientSession]
+	welcomes chan []byte
+
+	// stale is signalled when the session is probably dead, after the
+	// socket moved to a new network or the system woke from sleep, so the
+	// keepalive loop handshakes at once.
+	stale chan struct{}
+
+	// rebindMu serialises socket moves after network changes and resumes.
+	rebindMu sync.Mutex
+
+	// endpoint indexes the server in use: 0 is server_address, higher
+	// values are fallback_addresses.
+	endpoint atomic.Int32
+
+	// redirect is the server a busy one pointed the client at, in place
+	// of the endpoint, or nil. retryAt is when a busy server asked to be
+	// tried again.
+	redirect atomic.Pointer[string]
+	retryAt  atomicTime
+
+	// transport indexes the transport in use: 0 is transport, higher
+	// values are migrate entries. migratedAt is when it last changed.
+	transport  atomic.Int32
+	migratedAt atomicTime
+
+	// networks remembers what worked on each network the host was on.
+	networks *networkCache
+
+	stats         trafficStats
+	lastHandshake atomicTime
+	lastRecv      atomicTime
+	maxSession    atomic.Int64 // the server's max_session_duration, if any
+	rtt           atomic.Int64
+	natProbe      natProbe
+	batch         *packetBatch // adapter reads held back, in low_power
+	nat           atomic.Pointer[stun.Result]
+	fecRecovered  atomic.Uint64
+	dropped       dropCounters
+
+	// lease is the address leased by the server when adapter_ip_cidr is
+	// auto; dns is the resolvers and search domains last applied, through
+	// dnsConf. They are only written during a handshake.
+	lease      atomic.Pointer[netip.Prefix]
+	dns        string
+	dnsConf    tun.DNSConfigurator
+	dnsApplied bool
+	// lease6 and prefix are the IPv6 address and delegated prefix the
+	// server gave, if any. They too are only written during a handshake.
+	lease6 atomic.Pointer[netip.Prefix]
+	prefix atomic.Pointer[netip.Prefix]
+	// gateway is the server's tunnel address, from the last Welcome.
+	gateway atomic.Pointer[netip.Addr]
+	// remoteForwards is the server's answer to request_forwards, and
+	// options the other settings it pushed.
+	remoteForwards atomic.Pointer[[]protocol.Forward]
+	options        atomic.Pointer[pushedOptions]
+
+	// protect, when set, is handed each outer socket before it connects so
+	// an embedding app can exclude it from the tunnel.
+	protect func(fd uintptr) bool
+
+	// portal is the captive portal the user has to sign in to, while the
+	// client waits for it.
+	portal atomic.Pointer[string]
+
+	// tap sees every tunnelled packet when an embedder installs one.
+	tap packetTap
+
+	// check tests the tunnel after each handshake.
+	check *connectCheck
+
+	// lanRoutes are the local subnets routed around the tunnel for
+	// allow_lan, removed again on Stop.
+	lanRoutes []lanRoute
+
+	// hostRoutes is set when the client's adapter and routes are the
+	// host's, so they are checked against its subnets; conflicts are the
+	// overlaps found.
+	hostRoutes bool
+	conflicts  atomic.Pointer[[]string]
+
+	// fallbackCIDR is the adapter_fallbacks entry taken in place of
+	// adapter_ip_cidr, reported to the server in each Hello.
+	fallbackCIDR string
+
+	// journal records the adapter and routes this client added, so they
+	// are undone after a crash; nil for a device supplied by an embedder.
+	journal *journal
+
+	transcript *debugTranscript // nil unless debug_transcript is set
+}
+
+// clientConn boxes the outer socket so it can be swapped atomically.
+type clientConn struct {
+	outerConn
+}
+
+// outerConn is the client's socket to the server: a connected UDP socket,
+// or a transport's PacketConn bound to the server address.
+type outerConn interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// clientSession is the state negotiated by one handshake.
+type clientSession struct {
+	id       uint32
+	version  uint16
+	software string // release version the server reported
+	keys     sessionKeys
+	fec      *sessionFEC    // nil unless negotiated
+	reorder  *reorderBuffer // nil unless configured
 }
 
 // NewClient constructs a Client.
 func NewClient(cfg Config) *Client {
+	return newClient(cfg, nil)
+}
+
+// NewClientWithTun constructs a Client that uses dev instead of creating a
+// platform adapter, for embedders such as containers, mobile apps, and test
+// harnesses. The client closes dev on Stop.
+func NewClientWithTun(cfg Config, dev TunDevice) *Client {
+	return newClient(cfg, dev)
+}
+
+// newClient constructs a Client around dev, or around the platform TUN
+// device created at Start when dev is nil.
+func newClient(cfg Config, dev tun.Device) *Client {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Client{cfg: cfg, ctx: ctx, cancel: cancel}
+	return &Client{
+		cfg:      cfg,
+		tunMgr:   dev,
+		ctx:      ctx,
+		cancel:   cancel,
+		welcomes: make(chan []byte, 1),
+		stale:    make(chan struct{}, 1),
+		check:    newConnectCheck(),
+	}
 }
 
 // Start brings up the tunnel, crypto, and forwards packets.
 func (c *Client) Start() error {
-	
-	if runtime.GOOS == "windows" {
-	if err := SetupWindowsClient(c.cfg.AdapterName, "10.0.0.1"); err != nil {
-		log.Printf("Client setup warning: %v", err)
+	if err := c.cfg.checkFIPS(); err != nil {
+		return err
+	}
+	if err := c.cfg.validateUserspace(); err != nil {
+		return err
+	}
+	if err := c.cfg.validateSidecar(); err != nil {
+		return err
+	}
+	if c.cfg.ManagementAddress != "" {
+		captureLogs()
+	}
+	log.Print(Build())
+	if c.tunMgr == nil && c.cfg.Userspace {
+		st, err := newUserspaceStack(c.cfg)
+		if err != nil {
+			return err
+		}
+		c.stack = st
+		c.tunMgr = st
+	}
+	if c.tunMgr == nil {
+		c.journal = openJournal(c.cfg)
+		c.hostRoutes = c.cfg.Netns == ""
+	}
+	if c.cfg.DebugTranscript != "" {
+		t, err := openDebugTranscript(c.cfg.DebugTranscript)
+		if err != nil {
+			return err
 		}
+		c.transcript = t
 	}
+	// With an auto address the adapter is created once the handshake has
+	// leased one.
+	if c.tunMgr == nil && c.cfg.AdapterIPCIDR != AutoAddress {
+		c.pickAdapterCIDR()
+		if err := c.checkRoutes(c.cfg.AdapterIPCIDR, c.cfg.routes()); err != nil {
+			return err
+		}
+		if runtime.GOOS == "windows" {
+			if err := SetupWindowsClient(c.cfg.AdapterName, "10.0.0.1", c.cfg.routes()); err != nil {
+				log.Printf("Client setup warning: %v", err)
+			}
+		}
 
-	// Crypto
-	ci, err := crypto.NewCipher([]byte(c.cfg.PSK))
-	if err != nil {
-		return fmt.Errorf("crypto init: %w", err)
+		// TUN
+		tm, err := openTun(c.ctx, c.cfg, c.cfg.AdapterIPCIDR)
+		if err != nil {
+			return fmt.Errorf("tunnel setup: %w", err)
+		}
+		c.tunMgr = tm
+		c.journal.add(journalEntry{Kind: journalAdapter, Name: c.cfg.AdapterName})
 	}
-	c.cipher = ci
 
-	// TUN
-	tm, err := tun.SetupWintun(c.ctx, c.cfg.AdapterName, c.cfg.AdapterIPCIDR)
-	if err != nil {
-		return fmt.Errorf("tunnel setup: %w", err)
+	// NAT discovery
+	if len(c.cfg.StunServers) > 0 {
+		c.probeNAT()
 	}
-	c.tunMgr = tm
 
 	// UDP
-	conn, err := net.Dial("udp", c.cfg.ServerAddress)
+	if c.cfg.DebugImpairment.Enabled() {
+		log.Printf("Warning: debug impairment enabled: %+v", c.cfg.DebugImpairment)
+	}
+	if lowBandwidth(c.cfg.Transport) {
+		log.Printf("Transport %s is low bandwidth; expect a slow tunnel", c.cfg.Transport)
+	}
+	c.networks = openNetworkCache(c.cfg.networkCacheFile())
+	if c.cfg.Transport != AutoTransport || !c.dialAuto() {
+		conn, err := c.dial()
+		if err != nil {
+			if c.tunMgr != nil {
+				c.tunMgr.Close()
+			}
+			return err
+		}
+		c.conn.Store(&clientConn{conn})
+	}
+	c.applyNetworkProfile()
+
+	// Handshake. The receive loop hands Welcomes to handshake, so it has to
+	// be running first.
+	c.wg.Add(1)
+	go c.loopUDPToTun()
+
+	// Port forwards only carry traffic once the tunnel is up, but are
+	// opened now so the management API can list them.
+	if len(c.cfg.PortForwards) > 0 {
+		var dial dialFunc
+		if c.stack != nil {
+			dial = c.stack.DialContext
+		}
+		c.forwards = newPortForwards(c.ctx, c.cfg.PortForwards, nil, dial)
+	}
+	if c.stack != nil {
+		if err := c.startSocks(); err != nil {
+			c.Stop()
+			return err
+		}
+	}
+
+	// Management comes up before the handshake so a captive portal can be
+	// reported while the client waits for it.
+	if c.cfg.ManagementAddress != "" {
+		mgmt, err := startManagement(c.ctx, c.cfg.ManagementAddress, c.managementMux())
+		if err != nil {
+			c.Stop()
+			return err
+		}
+		c.mgmt = mgmt
+	}
+	if c.cfg.StatusPage != "" {
+		page, err := serveLocal(c.ctx, "Status page", c.cfg.StatusPage, c.statusPageHandler())
+		if err != nil {
+			c.Stop()
+			return err
+		}
+		c.statusPage = page
+	}
+	if c.cfg.HealthAddress != "" {
+		if err := c.startHealth(); err != nil {
+			c.Stop()
+			return err
+		}
+	}
+
+	err := c.handshake()
+	if err != nil && c.redirected(err) {
+		err = c.handshake()
+	}
+	if err != nil && c.cfg.CaptivePortal && c.awaitCaptivePortal() {
+		err = c.handshake()
+	}
+	if err != nil && len(c.cfg.FallbackAddresses) > 0 {
+		log.Printf("Server %s: %v", c.serverAddress(), err)
+		err = c.failover()
+	}
 	if err != nil {
-		c.tunMgr.Close()
-		return fmt.Errorf("udp dial: %w", err)
+		c.Stop()
+		return fmt.Errorf("handshake: %w", err)
+	}
+	if c.cfg.AllowLAN && runtime.GOOS == "windows" {
+		c.bypassLAN()
+	}
+	// On macOS the client routes its own adapter.
+	if c.cfg.OneShotRoute || (runtime.GOOS == "darwin" && c.hostRoutes) {
+		if err := c.routeOnce(); err != nil {
+			c.Stop()
+			return err
+		}
+	}
+
+	if err := netmon.Watch(c.ctx, c.networkChanged); err != nil {
+		log.Printf("Network change detection unavailable: %v", err)
+	}
+	if err := power.WatchResume(c.ctx, c.cfg.resumeCheck(), c.resumed); err != nil {
+		log.Printf("Resume detection unavailable: %v", err)
 	}
-	c.udpConn = conn
 
 	// Forward loops
-	c.wg.Add(2)
-	go c.loopTunToUDP()
-	go c.loopUDPToTun()
+	if c.cfg.LowPower {
+		c.batch = newPacketBatch(c.forwardBatch)
+	}
+	workers := c.cfg.Workers()
+	c.wg.Add(workers + 1)
+	for i := 0; i < workers; i++ {
+		go c.loopTunToUDP()
+	}
+	go c.loopKeepalive()
+	if len(c.cfg.FallbackAddresses) > 0 {
+		c.wg.Add(1)
+		go c.loopFailback()
+	}
+	if len(c.cfg.Migrate) > 0 {
+		c.wg.Add(1)
+		go c.loopMigrate()
+	}
 	return nil
 }
 
-// Stop tears everything down.
+// Stop tears everything down. Later calls wait for the first to finish.
 func (c *Client) Stop() {
+	c.stopOnce.Do(c.stop)
+}
+
+// Done is closed once the client starts stopping, as when the status
+// page's disconnect button is pressed.
+func (c *Client) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+func (c *Client) stop() {
 	c.cancel()
-	if c.udpConn != nil {
-		c.udpConn.Close()
+	stopManagement(c.mgmt)
+	stopManagement(c.statusPage)
+	stopManagement(c.health)
+	if c.forwards != nil {
+		c.forwards.close()
 	}
+	if conn := c.conn.Load(); conn != nil {
+		conn.Close()
+	}
+	if sess := c.session.Load(); sess != nil {
+		sess.fec.close()
+		sess.reorder.stop()
+	}
+	c.restoreLAN()
+	c.restoreDNS()
 	if c.tunMgr != nil {
 		c.tunMgr.Close()
 	}
 	c.wg.Wait()
+	c.journal.clear()
+	c.transcript.close()
 }
 
 func (c *Client) loopTunToUDP() {
 	defer c.wg.Done()
+	defer c.journal.guard()
+	r := newTunReader(c.tunMgr, c.cfg.UDPOffload)
+	if r.ch != nil {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			defer c.journal.guard()
+			r.feed(c.ctx)
+		}()
+	}
+	tx := &txBatch{}
+	var pkts [][]byte
 	for {
 		select {
 		case <-c.ctx.Done():
 			return
 		default:
 		}
-		pkt, err := c.tunMgr.ReadPacket()
+		var err error
+		pkts, err = r.read(pkts[:0])
+		if errors.Is(err, tun.ErrClosed) {
+			return
+		}
 		if err != nil {
 			continue
 		}
-		enc, _ := c.cipher.Encrypt(pkt)
-		c.udpConn.Write(enc)
+		for _, pkt := range pkts {
+			if c.batch != nil {
+				c.batch.add(pkt)
+				continue
+			}
+			c.forward(pkt, tx)
+		}
+		c.flush(tx)
+		clear(pkts)
+	}
+}
+
+// forward encrypts pkt and sends it to the server or, when the socket
+// takes runs, adds it to tx's run. tx may be nil.
+func (c *Client) forward(pkt []byte, tx *txBatch) error {
+	sess := c.session.Load()
+	if sess == nil {
+		c.dropped.add(dropNoRoute)
+		return ErrNotConnected
+	}
+	c.tap.observe(Outbound, pkt)
+	if sess.fec != nil {
+		sess.fec.enc.Add(pkt)
+		c.stats.addOut(len(pkt))
+		return nil
+	}
+	out, err := appendPacket(tx.scratch()[:0], sess.keys.send, protocol.MsgData, sess.id, pkt)
+	if err != nil {
+		c.dropped.add(dropSend)
+		return err
+	}
+	conn := c.udp()
+	if tx != nil {
+		tx.out = out
+		if w, ok := conn.(batchWriter); ok {
+			if !tx.fits(w, nil, len(out)) {
+				c.flush(tx)
+			}
+			tx.add(w, nil, nil, out, len(pkt))
+			return nil
+		}
+	}
+	if _, err := conn.Write(out); err != nil {
+		c.dropped.add(dropSend)
+		return err
+	}
+	c.stats.addOut(len(pkt))
+	return nil
+}
+
+// flush sends tx's run, if any.
+func (c *Client) flush(tx *txBatch) {
+	inner, err := tx.send()
+	for _, n := range inner {
+		if err != nil {
+			c.dropped.add(dropSend)
+		} else {
+			c.stats.addOut(n)
+		}
 	}
 }
 
 func (c *Client) loopUDPToTun() {
 	defer c.wg.Done()
+	defer c.journal.guard()
 	buf := make([]byte, 65536)
+	plain := make([]byte, 0, 65536)
 	for {
 		select {
 		case <-c.ctx.Done():
 			return
 		default:
 		}
-		n, err := c.udpConn.Read(buf)
+		n, err := c.udp().Read(buf)
+		if err != nil {
+			continue
+		}
+		h, payload, err := protocol.ParseHeader(buf[:n])
+		if err != nil {
+			c.dropped.add(dropMalformed)
+			continue
+		}
+		if h.Type == protocol.MsgHandshakeResp {
+			select {
+			case c.welcomes <- append([]byte(nil), payload...):
+			default:
+			}
+			continue
+		}
+		sess := c.session.Load()
+		if sess == nil || h.Session != sess.id {
+			c.dropped.add(dropUnknownSession)
+			c.transcript.drop(c.udp().RemoteAddr(), h, errUnknownSession)
+			errorLog.Printf("Packet from %s for unknown session", c.udp().RemoteAddr())
+			continue
+		}
+		switch h.Type {
+		case protocol.MsgData, protocol.MsgFEC, protocol.MsgKeepaliveAck, protocol.MsgMTUProbe, protocol.MsgMTU:
+		default:
+			continue
+		}
+		dec, seq, err := sess.keys.recv.DecryptAppend(plain[:0], payload)
+		if err != nil {
+			c.dropped.add(decryptReason(err))
+			c.transcript.drop(c.udp().RemoteAddr(), h, err)
+			errorLog.Printf("Decrypt error from %s: %v", c.udp().RemoteAddr(), err)
+			continue
+		}
+		now := time.Now()
+		c.lastRecv.Store(now)
+		if h.Type == protocol.MsgKeepaliveAck && len(dec) == 8 {
+			sent := int64(binary.BigEndian.Uint64(dec))
+			c.rtt.Store(now.UnixNano() - sent)
+		} else if h.Type == protocol.MsgKeepaliveAck && len(dec) == 10 {
+			c.natProbeAck(dec, now)
+		}
+		switch h.Type {
+		case protocol.MsgMTUProbe:
+			c.answerPMTUProbe(sess, dec)
+			continue
+		case protocol.MsgMTU:
+			c.applyPathMTU(dec)
+			continue
+		}
+		if sess.reorder != nil {
+			sess.reorder.add(seq, h.Type, dec)
+		} else {
+			c.deliver(sess, h.Type, dec)
+		}
+	}
+}
+
+// deliver writes the inner packets of a decrypted message to the tunnel.
+func (c *Client) deliver(sess *clientSession, t protocol.MessageType, dec []byte) {
+	switch t {
+	case protocol.MsgData:
+		c.toTun(dec)
+	case protocol.MsgFEC:
+		if sess.fec == nil {
+			c.dropped.add(dropFEC)
+			return
+		}
+		pkts, recovered, err := sess.fec.dec.Add(dec)
+		if err != nil {
+			c.dropped.add(dropFEC)
+			return
+		}
+		c.fecRecovered.Add(uint64(recovered))
+		for _, pkt := range pkts {
+			c.toTun(pkt)
+		}
+	}
+}
+
+// toTun writes one packet from the server to the tunnel.
+func (c *Client) toTun(pkt []byte) {
+	c.tap.observe(Inbound, pkt)
+	if c.checkReply(pkt) {
+		c.stats.addIn(len(pkt))
+		return
+	}
+	if o := c.options.Load(); o != nil && o.mtu > 0 && len(pkt) > o.mtu {
+		c.dropped.add(dropMTU)
+		return
+	}
+	if err := c.tunMgr.WritePacket(pkt); err != nil {
+		c.dropped.add(dropTunWrite)
+		return
+	}
+	c.stats.addIn(len(pkt))
+}
+
+// loopKeepalive pings the server so NAT mappings stay open and the round-trip
+// time is measured. When the server stops answering it re-handshakes, which
+// also recovers from a server restart.
+func (c *Client) loopKeepalive() {
+	defer c.wg.Done()
+	defer c.journal.guard()
+	ticker := time.NewTicker(c.cfg.keepaliveInterval())
+	defer ticker.Stop()
+	for {
+		if c.natProbing() {
+			// A NAT probe needs the path idle until its ack is due.
+		} else if silent := time.Since(c.lastRecv.Load()); silent > c.keepaliveTimeout() {
+			if time.Now().After(c.retryAt.Load()) {
+				log.Printf("No response from server for %s, reconnecting", silent.Round(time.Second))
+				c.reconnect()
+			}
+		} else if silent > 2*c.keepaliveInterval() && c.migrateAway() {
+			// The session carries on over another transport.
+		} else if c.sessionDue(c.lastHandshake.Load()) {
+			log.Printf("Session is nearly as old as the server allows, handshaking again")
+			if err := c.handshake(); err != nil && c.ctx.Err() == nil {
+				log.Printf("Re-handshake failed: %v", err)
+			}
+		} else if !c.startNATProbe() {
+			c.sendKeepalive()
+		}
+		ticker.Reset(c.keepaliveInterval())
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.stale:
+			if err := c.handshake(); err != nil && c.ctx.Err() == nil {
+				log.Printf("Re-handshake failed: %v", err)
+			}
+		}
+	}
+}
+
+// networkChanged moves the outer socket when a change to the host's network
+// means datagrams to the server now leave from a different address, as when
+// a laptop switches from Wi-Fi to Ethernet. The keepalive loop then
+// handshakes over it instead of waiting for the old path to time out. Only
+// UDP sockets are moved; other transports own their sockets, and a session
+// that migrated is left to the migration probes.
+func (c *Client) networkChanged() {
+	if c.networks.identify() && c.applyNetworkProfile() {
+		c.resetNATProbe()
+		c.markStale()
+		return
+	}
+	if t, _ := lookupTransport(c.cfg.Transport); t != nil || c.transport.Load() != 0 {
+		return
+	}
+	c.rebindMu.Lock()
+	defer c.rebindMu.Unlock()
+	old := c.conn.Load()
+	conn, err := c.dial()
+	if err != nil {
+		log.Printf("Network changed: %v", err)
+		return
+	}
+	if hostOf(conn.LocalAddr()) == hostOf(old.LocalAddr()) {
+		conn.Close()
+		return
+	}
+	c.conn.Store(&clientConn{conn})
+	old.Close()
+	log.Printf("Network changed, now sending from %s", conn.LocalAddr())
+	c.resetNATProbe()
+	c.markStale()
+}
+
+// resumed handles the system waking from sleep. The server has usually
+// dropped the session and the NAT its mapping by then, though nothing on
+// the client has failed yet, so the session is marked stale and replaced
+// rather than left to time out.
+func (c *Client) resumed() {
+	log.Printf("System resumed from sleep, reconnecting")
+	c.networkChanged()
+	c.resetNATProbe()
+	c.markStale()
+}
+
+// markStale reports the session as disconnected and has the keepalive loop
+// handshake again.
+func (c *Client) markStale() {
+	c.lastRecv.Store(time.Time{})
+	select {
+	case c.stale <- struct{}{}:
+	default:
+	}
+}
+
+// hostOf returns the host part of a socket address.
+func hostOf(a net.Addr) string {
+	host, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return a.String()
+	}
+	return host
+}
+
+func (c *Client) sendKeepalive() {
+	sess := c.session.Load()
+	if sess == nil {
+		return
+	}
+	ts := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	pkt, err := sealPacket(sess.keys.send, protocol.MsgKeepalive, sess.id, ts)
+	if err != nil {
+		return
+	}
+	c.udp().Write(pkt)
+}
+
+// probeNAT learns the public address and NAT type over STUN and, unless
+// keepalive_interval is set, relaxes the keepalive when there is no NAT.
+func (c *Client) probeNAT() {
+	res, err := stun.Probe(c.cfg.StunServers, stunTimeout)
+	if err != nil {
+		log.Printf("STUN probe failed: %v", err)
+		return
+	}
+	c.nat.Store(&res)
+	log.Printf("Public address %s, NAT type %s", res.Public, res.NAT)
+	if c.cfg.KeepaliveInterval == 0 && res.NAT == stun.NATNone {
+		c.cfg.KeepaliveInterval = OpenKeepaliveInterval
+		log.Printf("No NAT detected, keepalive interval %s", OpenKeepaliveInterval)
+	}
+	if res.NAT == stun.NATNone {
+		// No mapping to find the timeout of.
+		c.natProbe.mu.Lock()
+		c.natProbe.done = true
+		c.natProbe.mu.Unlock()
+	}
+}
+
+// udp returns the current outer socket.
+func (c *Client) udp() outerConn {
+	return c.conn.Load().outerConn
+}
+
+// SetSocketProtector installs fn to be called with the descriptor of every
+// outer socket before it connects. On Android, pass VpnService.protect so
+// tunnel traffic does not loop back into the tunnel. Call before Start.
+// Only UDP sockets are passed to it; a registered transport has to protect
+// its own.
+func (c *Client) SetSocketProtector(fn func(fd uintptr) bool) {
+	c.protect = fn
+}
+
+// dial connects to the server address in use over the configured
+// transport, resolving it afresh.
+func (c *Client) dial() (outerConn, error) {
+	return c.dialAddress(c.serverAddress())
+}
+
+// dialAddress connects to address over the configured transport, UDP for
+// transport auto.
+func (c *Client) dialAddress(address string) (outerConn, error) {
+	return c.dialTransport(transportName(c.cfg.Transport), address)
+}
+
+// dialTransport connects to address over transport.
+func (c *Client) dialTransport(transport, address string) (outerConn, error) {
+	t, err := lookupTransport(transport)
+	if err != nil {
+		return nil, err
+	}
+	var conn outerConn
+	if t != nil {
+		pc, peer, err := t.Dial(c.ctx, address)
 		if err != nil {
+			return nil, fmt.Errorf("%s dial: %w", transport, err)
+		}
+		conn = &peerConn{PacketConn: pc, peer: peer}
+	} else if conn, err = c.dialUDP(address); err != nil {
+		return nil, err
+	}
+	if c.transcript != nil {
+		conn = &transcriptConn{outerConn: conn, t: c.transcript}
+	}
+	if c.cfg.DebugImpairment.Enabled() {
+		return &impairedConn{outerConn: conn, im: newImpairer(c.cfg.DebugImpairment)}, nil
+	}
+	return conn, nil
+}
+
+// dialer returns a dialer for sockets that must bypass the tunnel, which
+// hands them to the socket protector if there is one and marks them with
+// fwmark if set.
+func (c *Client) dialer() *net.Dialer {
+	d := &net.Dialer{}
+	if c.protect == nil && c.cfg.FwMark == 0 {
+		return d
+	}
+	d.Control = func(_, _ string, rc syscall.RawConn) error {
+		if c.cfg.FwMark != 0 {
+			if err := markSocket(rc, c.cfg.FwMark); err != nil {
+				return fmt.Errorf("fwmark: %w", err)
+			}
+		}
+		if c.protect == nil {
+			return nil
+		}
+		ok := false
+		if err := rc.Control(func(fd uintptr) { ok = c.protect(fd) }); err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("socket protector refused the socket")
+		}
+		return nil
+	}
+	return d
+}
+
+// dialUDP opens a UDP socket connected to address, handing it to the
+// socket protector first if there is one.
+func (c *Client) dialUDP(address string) (net.Conn, error) {
+	d := c.dialer()
+	conn, err := d.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("udp dial: %w", err)
+	}
+	if c.cfg.Encapsulation == GREEncapsulation {
+		return &greudp.Conn{Conn: conn}, nil
+	}
+	if c.cfg.UDPOffload {
+		if oc := openOffload(conn.(*net.UDPConn)); oc != nil {
+			return oc, nil
+		}
+	}
+	return conn, nil
+}
+
+// reconnect recovers from a silent server. If the server address now
+// resolves elsewhere, as after DNS failover to another cluster node, the
+// socket is moved there and the current session is offered to the new node
+// before falling back to a full handshake.
+func (c *Client) reconnect() {
+	if c.session.Load() != nil && c.redial() && c.resume() {
+		log.Printf("Session resumed with %s", c.udp().RemoteAddr())
+		return
+	}
+	err := c.handshake()
+	if err != nil && c.cfg.Transport == AutoTransport && c.ctx.Err() == nil && c.dialAuto() {
+		err = c.handshake()
+	}
+	if err != nil && c.redirected(err) {
+		err = c.handshake()
+	}
+	if err != nil && c.cfg.CaptivePortal && c.awaitCaptivePortal() {
+		err = c.handshake()
+	}
+	if err != nil && len(c.cfg.FallbackAddresses) > 0 && c.ctx.Err() == nil {
+		log.Printf("Server %s: %v", c.serverAddress(), err)
+		err = c.failover()
+	}
+	if err != nil && c.ctx.Err() == nil {
+		log.Printf("Re-handshake failed: %v", err)
+	}
+}
+
+// redial re-resolves the server address and switches sockets if it points
+// somewhere new. It reports whether it switched. Only UDP addresses are
+// re-resolved; other transports resolve inside Dial, and a session that
+// migrated stays on its transport.
+func (c *Client) redial() bool {
+	if t, _ := lookupTransport(c.cfg.Transport); t != nil || c.transport.Load() != 0 {
+		return false
+	}
+	server := c.serverAddress()
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		log.Printf("Resolve %s: %v", server, err)
+		return false
+	}
+	old := c.conn.Load()
+	if addr.String() == old.RemoteAddr().String() {
+		return false
+	}
+	conn, err := c.dial()
+	if err != nil {
+		log.Printf("Reconnect: %v", err)
+		return false
+	}
+	c.conn.Store(&clientConn{conn})
+	old.Close()
+	log.Printf("Server address %s now resolves to %s", server, conn.RemoteAddr())
+	return true
+}
+
+// resume sends a keepalive on the current session and waits briefly for any
+// answer, which only a node holding the session's keys can give.
+func (c *Client) resume() bool {
+	before := c.lastRecv.Load()
+	c.sendKeepalive()
+	deadline := time.Now().Add(min(c.cfg.keepaliveInterval(), HandshakeTimeout))
+	for time.Now().Before(deadline) {
+		select {
+		case <-c.ctx.Done():
+			return false
+		case <-time.After(20 * time.Millisecond):
+		}
+		if c.lastRecv.Load().After(before) {
+			return true
+		}
+	}
+	return false
+}
+
+// Status reports the client's connection state and traffic counters.
+func (c *Client) Status() ClientStatus {
+	transport, _ := c.currentTransport()
+	st := ClientStatus{
+		Endpoint:      c.serverAddress(),
+		Fallback:      c.endpoint.Load() > 0 || c.redirect.Load() != nil,
+		TunnelIP:      strings.Split(c.cfg.AdapterIPCIDR, "/")[0],
+		BytesIn:       c.stats.bytesIn.Load(),
+		BytesOut:      c.stats.bytesOut.Load(),
+		PacketsIn:     c.stats.packetsIn.Load(),
+		PacketsOut:    c.stats.packetsOut.Load(),
+		LastHandshake: c.lastHandshake.Load(),
+		RTTMillis:     float64(c.rtt.Load()) / float64(time.Millisecond),
+		Transport:     transport,
+		Migrated:      c.cfg.Transport != AutoTransport && c.transport.Load() > 0,
+		LowBandwidth:  lowBandwidth(transport),
+		FECRecovered:  c.fecRecovered.Load(),
+		Drops:         c.dropped.counts(),
+	}
+	if portal := c.portal.Load(); portal != nil {
+		st.CaptivePortal = *portal
+	}
+	st.ConnectCheck = c.check.result.Load()
+	if conflicts := c.conflicts.Load(); conflicts != nil {
+		st.RouteConflicts = *conflicts
+	}
+	if f := c.remoteForwards.Load(); f != nil {
+		st.Forwards = *f
+	}
+	if o := c.options.Load(); o != nil {
+		st.SearchDomains, st.MTU, st.NTPServers, st.Routes = o.domains, o.mtu, o.ntp, o.routes
+	}
+	if conn := c.conn.Load(); conn != nil {
+		st.Endpoint = conn.RemoteAddr().String()
+	}
+	if c.cfg.AdapterIPCIDR == AutoAddress {
+		st.TunnelIP = ""
+		if lease := c.lease.Load(); lease != nil {
+			st.TunnelIP = lease.Addr().String()
+		}
+	}
+	if lease6 := c.lease6.Load(); lease6 != nil {
+		st.TunnelIP6 = lease6.Addr().String()
+	}
+	if prefix := c.prefix.Load(); prefix != nil {
+		st.Prefix = prefix.String()
+	}
+	if c.cfg.AdaptiveKeepalive {
+		st.Keepalive = int(c.keepaliveInterval() / time.Second)
+		c.natProbe.mu.Lock()
+		st.KeepaliveProbing = !c.natProbe.done
+		c.natProbe.mu.Unlock()
+	}
+	if nat := c.nat.Load(); nat != nil {
+		st.PublicAddress = nat.Public.String()
+		st.NATType = string(nat.NAT)
+	}
+	if sess := c.session.Load(); sess != nil {
+		st.ProtocolVersion = sess.version
+		st.ServerVersion = sess.software
+		st.FIPS = c.cfg.FIPSMode
+		if sess.fec != nil {
+			st.FEC = sess.fec.params.String()
+		}
+		st.Connected = time.Since(c.lastRecv.Load()) < c.keepaliveTimeout()
+	}
+	return st
+}
+
+func (c *Client) managementMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.Status())
+	})
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Build())
+	})
+	mux.HandleFunc("GET /metrics/drops", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, DropsResponse{Drops: c.dropped.counts()})
+	})
+	mux.HandleFunc("POST /speedtest", c.handleSpeedtest)
+	handleForwards(mux, c.forwards)
+	handleLogs(mux)
+	c.handleHealth(mux)
+	return mux
+}
+
+// handshake authenticates with the server, negotiates the protocol version,
+// and installs a freshly keyed session.
+func (c *Client) handshake() error {
+	hs, err := handshakeCipher(c.cfg.PSK)
+	if err != nil {
+		return err
+	}
+	nonce, err := crypto.RandomBytes(protocol.NonceSize)
+	if err != nil {
+		return err
+	}
+	hello := protocol.NewHello(nonce, time.Now())
+	if c.cfg.MinProtocolVersion != 0 {
+		hello.MinVersion = c.cfg.MinProtocolVersion
+	}
+	hello.Name = c.cfg.ClientName
+	if hello.Name == "" {
+		hello.Name, _ = os.Hostname()
+	}
+	hello.Forwards = c.cfg.forwardRequests()
+	hello.FIPS = c.cfg.FIPSMode
+	hello.MTUProbes = true
+	hello.MTU = c.mtuHint()
+	hello.Software = software()
+	hello.User, hello.Password = c.cfg.Username, c.cfg.Password
+	if c.cfg.FEC != nil {
+		hello.FEC = &protocol.FEC{Data: c.cfg.FEC.Data, Parity: c.cfg.FEC.Parity}
+	}
+	if c.cfg.AdapterIPCIDR == AutoAddress {
+		hello.Lease = true
+		if p := c.lease.Load(); p != nil {
+			hello.Address = p.Addr().String()
+		}
+	}
+	hello.Static = c.fallbackCIDR
+	hello.Lease6 = true
+	if p := c.lease6.Load(); p != nil {
+		hello.Address6 = p.Addr().String()
+	}
+	if c.cfg.RequestPrefix {
+		hello.Delegate = true
+		if p := c.prefix.Load(); p != nil {
+			hello.Prefix = p.String()
+		}
+	}
+	pkt, err := sealHandshake(hs, protocol.MsgHandshakeInit, 0, hello)
+	if err != nil {
+		return err
+	}
+	transcript := protocol.Transcript(pkt[protocol.HeaderSize:])
+	c.transcript.hello("out", c.udp().RemoteAddr(), hello)
+
+	for attempt := 1; attempt <= HandshakeRetries; attempt++ {
+		if _, err := c.udp().Write(pkt); err != nil {
+			return fmt.Errorf("send hello: %w", err)
+		}
+		w, err := c.awaitWelcome(hs, transcript)
+		if errors.Is(err, errHandshakeTimeout) {
+			log.Printf("Handshake attempt %d/%d timed out", attempt, HandshakeRetries)
 			continue
 		}
-		dec, _ := c.cipher.Decrypt(buf[:n])
-		c.tunMgr.WritePacket(dec)
+		if err != nil {
+			return err
+		}
+		if w.Transcript == nil && c.cfg.RequireTranscript {
+			return fmt.Errorf("server did not bind its answer to this handshake; upgrade it or unset require_transcript")
+		}
+		if w.Error != "" {
+			if _, err := protocol.Negotiate(hello.Range(), w.Range()); err != nil {
+				return err
+			}
+			if w.RetryAfter > 0 {
+				return &busyError{reason: w.Error, retryAfter: time.Duration(w.RetryAfter) * time.Second, alternate: w.Alternate}
+			}
+			return fmt.Errorf("server rejected handshake: %s", w.Error)
+		}
+		if c.cfg.FIPSMode && !w.FIPS {
+			return fmt.Errorf("server is not in fips_mode")
+		}
+		if offered := hello.Range(); !offered.Contains(w.Version) {
+			return &protocol.VersionError{Local: offered, Peer: w.Range()}
+		}
+		keys, err := deriveSessionKeys(c.cfg.PSK, nonce, w.Nonce, false)
+		if err != nil {
+			return err
+		}
+		if err := c.applyWelcome(w); err != nil {
+			return err
+		}
+		c.reportForwards(w.Forwards)
+		sess := &clientSession{id: w.Session, version: w.Version, software: cleanLabel(w.Software), keys: keys}
+		if w.FEC != nil {
+			sess.fec, err = newSessionFEC(*w.FEC, keys.send,
+				func() uint32 { return sess.id },
+				func(pkt []byte) { c.udp().Write(pkt) })
+			if err != nil {
+				return fmt.Errorf("server sent %w", err)
+			}
+		} else if c.cfg.FEC != nil {
+			log.Printf("Server does not support FEC; continuing without it")
+		}
+		if c.cfg.Reorder.Enabled() {
+			sess.reorder = newReorderBuffer(c.cfg.Reorder, func(t protocol.MessageType, pkt []byte) {
+				c.deliver(sess, t, pkt)
+			})
+		}
+		if old := c.session.Swap(sess); old != nil {
+			old.fec.close()
+			old.reorder.stop()
+		}
+		now := time.Now()
+		c.lastHandshake.Store(now)
+		c.lastRecv.Store(now)
+		c.maxSession.Store(int64(time.Duration(w.MaxSession) * time.Second))
+		if sess.fec != nil {
+			log.Printf("Handshake complete: session %08x, protocol v%d, FEC %s", w.Session, w.Version, sess.fec.params)
+		} else {
+			log.Printf("Handshake complete: session %08x, protocol v%d", w.Session, w.Version)
+		}
+		if gw, err := netip.ParseAddr(w.Gateway); err == nil {
+			c.gateway.Store(&gw)
+		}
+		c.rememberNetwork()
+		c.startConnectCheck(w.Gateway)
+		return nil
+	}
+	return fmt.Errorf("no response from %s after %d attempts", c.serverAddress(), HandshakeRetries)
+}
+
+// applyWelcome configures the adapter from the settings the server pushed:
+// the leased address, creating the adapter on the first lease, the IPv6
+// address, and the DNS servers.
+func (c *Client) applyWelcome(w *protocol.Welcome) error {
+	readdressed := false
+	if c.cfg.AdapterIPCIDR == AutoAddress {
+		lease, err := netip.ParsePrefix(w.Address)
+		if err != nil {
+			return fmt.Errorf("server did not lease a valid address: %q", w.Address)
+		}
+		prev := c.lease.Load()
+		switch {
+		case c.tunMgr == nil:
+			if err := c.checkRoutes(lease.String(), c.cfg.routes()); err != nil {
+				return err
+			}
+			tm, err := openTun(c.ctx, c.cfg, lease.String())
+			if err != nil {
+				return fmt.Errorf("tunnel setup: %w", err)
+			}
+			c.tunMgr = tm
+			c.journal.add(journalEntry{Kind: journalAdapter, Name: c.cfg.AdapterName})
+			log.Printf("Leased address %s", lease)
+		case prev == nil:
+			// A device supplied by an embedder is addressed by its owner;
+			// the userspace stack is addressed here.
+			if c.stack != nil {
+				c.stack.SetAddress(lease)
+			}
+			log.Printf("Leased address %s", lease)
+		case *prev != lease:
+			cfg, ok := c.tunMgr.(tun.Configurer)
+			if !ok {
+				return fmt.Errorf("leased address changed to %s but the adapter cannot be readdressed", lease)
+			}
+			if err := cfg.SetAddress(lease); err != nil {
+				return fmt.Errorf("set leased address %s: %w", lease, err)
+			}
+			readdressed = true
+			log.Printf("Leased address changed to %s", lease)
+		}
+		c.lease.Store(&lease)
+	}
+	if err := c.applyDualStack(w, readdressed); err != nil {
+		return err
+	}
+
+	c.applyDNS(w.DNS, w.Domains)
+	c.applyOptions(w)
+	return nil
+}
+
+// awaitWelcome waits up to HandshakeTimeout for a Welcome that authenticates
+// under hs and, if the server binds it, answers the Hello with transcript.
+func (c *Client) awaitWelcome(hs *crypto.Cipher, transcript []byte) (*protocol.Welcome, error) {
+	timer := time.NewTimer(HandshakeTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return nil, c.ctx.Err()
+		case <-timer.C:
+			return nil, errHandshakeTimeout
+		case payload := <-c.welcomes:
+			var w protocol.Welcome
+			if err := openHandshake(hs, payload, &w); err != nil {
+				c.transcript.drop(c.udp().RemoteAddr(), protocol.Header{Type: protocol.MsgHandshakeResp}, err)
+				continue
+			}
+			if w.Transcript != nil && !bytes.Equal(w.Transcript, transcript) {
+				c.transcript.welcome("in", c.udp().RemoteAddr(), &w, "answers another hello")
+				continue // answers another Hello: late, or replayed
+			}
+			c.transcript.welcome("in", c.udp().RemoteAddr(), &w, "")
+			return &w, nil
+		}
 	}
 }
@@ -0,0 +1,373 @@
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+)
+
+const (
+	// DefaultClusterSyncInterval is how often a node pushes its state to
+	// its peers.
+	DefaultClusterSyncInterval = 2 * time.Second
+
+	// clusterMaxSkew bounds the age of an accepted sync message.
+	clusterMaxSkew = 30 * time.Second
+
+	clusterSignatureHeader = "X-GoVPN-Signature"
+	clusterMaxBody         = 4 << 20
+)
+
+// ClusterConfig lets several servers share client state. Each node owns the
+// sessions it handshook and periodically pushes them to every peer, so any
+// node can report the cluster-wide client list. Clients can then be spread
+// across nodes with DNS round-robin on server_address.
+type ClusterConfig struct {
+	NodeID       uint8         `yaml:"node_id"`       // 1-255, unique within the cluster
+	Listen       string        `yaml:"listen"`        // address peers sync with
+	Peers        []string      `yaml:"peers"`         // listen addresses of the other nodes
+	Secret       string        `yaml:"secret"`        // shared secret authenticating sync messages
+	SyncInterval time.Duration `yaml:"sync_interval"` // defaults to DefaultClusterSyncInterval
+}
+
+// Enabled reports whether clustering is configured.
+func (c ClusterConfig) Enabled() bool {
+	return c.Listen != ""
+}
+
+func (c ClusterConfig) validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.NodeID == 0 {
+		return fmt.Errorf("cluster.node_id must be between 1 and 255")
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("cluster.secret is required")
+	}
+	if c.SyncInterval < 0 {
+		return fmt.Errorf("cluster.sync_interval cannot be negative")
+	}
+	return nil
+}
+
+func (c ClusterConfig) syncInterval() time.Duration {
+	if c.SyncInterval > 0 {
+		return c.SyncInterval
+	}
+	return DefaultClusterSyncInterval
+}
+
+// ClusterClient is one session in the shared client directory.
+type ClusterClient struct {
+	Session     string    `json:"session"`
+	Node        uint8     `json:"node"`
+	Endpoint    string    `json:"endpoint"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// ClusterNode describes a peer as seen from this node.
+type ClusterNode struct {
+	Node     uint8     `json:"node"`
+	Address  string    `json:"address"`
+	LastSync time.Time `json:"last_sync"`
+	Up       bool      `json:"up"`
+	Clients  int       `json:"clients"`
+}
+
+// ClusterStatus is the body of GET /cluster.
+type ClusterStatus struct {
+	Node    uint8           `json:"node"`
+	Nodes   []ClusterNode   `json:"nodes"`
+	Clients []ClusterClient `json:"clients"`
+}
+
+// clusterState is what a node pushes to its peers. Handoff carries the
+// node's sessions, keys included, sealed under the cluster secret.
+type clusterState struct {
+	Node    uint8           `json:"node"`
+	Address string          `json:"address"`
+	Sent    time.Time       `json:"sent"`
+	Clients []ClusterClient `json:"clients"`
+	Handoff []byte          `json:"handoff,omitempty"`
+
+	handoffs []sessionHandoff
+}
+
+// cluster replicates the local client directory to peers and keeps the
+// latest state received from each of them.
+type cluster struct {
+	cfg    ClusterConfig
+	key    []byte
+	sealer *crypto.Cipher
+	local  func() clusterState
+	moved  func([]sessionHandoff)
+	http   *http.Client
+	srv    *http.Server
+
+	mu    sync.Mutex
+	nodes map[uint8]*remoteNode
+}
+
+type remoteNode struct {
+	state    clusterState
+	received time.Time
+}
+
+// newCluster returns a cluster that publishes local() and reports sessions
+// that peers hold to moved.
+func newCluster(cfg ClusterConfig, local func() clusterState, moved func([]sessionHandoff)) (*cluster, error) {
+	key, err := crypto.DeriveKey([]byte(cfg.Secret), nil, "govpn cluster")
+	if err != nil {
+		return nil, err
+	}
+	sealKey, err := crypto.DeriveKey([]byte(cfg.Secret), nil, "govpn cluster handoff")
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := crypto.NewCipher(sealKey)
+	if err != nil {
+		return nil, err
+	}
+	return &cluster{
+		cfg:    cfg,
+		key:    key,
+		sealer: sealer,
+		local:  local,
+		moved:  moved,
+		http:   &http.Client{Timeout: cfg.syncInterval()},
+		nodes:  make(map[uint8]*remoteNode),
+	}, nil
+}
+
+// start listens for peers and pushes local state until ctx is cancelled.
+func (c *cluster) start(ctx context.Context, wg *sync.WaitGroup) error {
+	ln, err := net.Listen("tcp", c.cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("cluster listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /cluster/sync", c.handleSync)
+	c.srv = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		if err := c.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("Cluster listener error: %v", err)
+		}
+	}()
+	log.Printf("Cluster node %d listening on %s with %d peers", c.cfg.NodeID, ln.Addr(), len(c.cfg.Peers))
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(c.cfg.syncInterval())
+		defer ticker.Stop()
+		for {
+			c.push(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *cluster) stop() {
+	stopManagement(c.srv)
+}
+
+// push sends the local state to every peer. Unreachable peers are skipped
+// quietly; they show up as down in the cluster status.
+func (c *cluster) push(ctx context.Context) {
+	st := c.local()
+	handoff, err := json.Marshal(st.handoffs)
+	if err == nil {
+		st.Handoff, err = c.sealer.Encrypt(handoff)
+	}
+	if err != nil {
+		log.Printf("Cluster sync: %v", err)
+		return
+	}
+	body, err := json.Marshal(st)
+	if err != nil {
+		log.Printf("Cluster sync: %v", err)
+		return
+	}
+	sig := c.sign(body)
+	for _, peer := range c.cfg.Peers {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+peer+"/cluster/sync", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(clusterSignatureHeader, sig)
+		resp, err := c.http.Do(req)
+		if err != nil {
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			log.Printf("Cluster sync to %s: %s", peer, resp.Status)
+		}
+	}
+}
+
+func (c *cluster) handleSync(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, clusterMaxBody))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !c.verify(body, r.Header.Get(clusterSignatureHeader)) {
+		writeError(w, http.StatusUnauthorized, errors.New("bad cluster signature"))
+		return
+	}
+	var st clusterState
+	if err := json.Unmarshal(body, &st); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	now := time.Now()
+	if d := now.Sub(st.Sent); d > clusterMaxSkew || d < -clusterMaxSkew {
+		writeError(w, http.StatusBadRequest, errors.New("stale cluster state"))
+		return
+	}
+	if st.Node == c.cfg.NodeID {
+		writeError(w, http.StatusConflict, fmt.Errorf("node id %d is also used by %s", st.Node, r.RemoteAddr))
+		return
+	}
+	if len(st.Handoff) > 0 {
+		plain, err := c.sealer.Decrypt(st.Handoff)
+		if err == nil {
+			err = json.Unmarshal(plain, &st.handoffs)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("handoff: %w", err))
+			return
+		}
+		st.Handoff = nil
+	}
+
+	c.mu.Lock()
+	prev := c.nodes[st.Node]
+	// Ignore reordered pushes so an old state cannot overwrite a newer one.
+	accepted := prev == nil || st.Sent.After(prev.state.Sent)
+	if accepted {
+		var last []sessionHandoff
+		if prev != nil {
+			last = prev.state.handoffs
+		}
+		countRecent(st.handoffs, last)
+		c.nodes[st.Node] = &remoteNode{state: st, received: now}
+	}
+	c.mu.Unlock()
+	if prev == nil || !c.up(prev, now) {
+		log.Printf("Cluster node %d at %s is up", st.Node, st.Address)
+	}
+	if accepted && c.moved != nil && len(st.handoffs) > 0 {
+		c.moved(st.handoffs)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// countRecent sets how many packets each session in handoffs accepted since
+// the same node's previous push, prev. Sessions new to this push count
+// everything they accepted.
+func countRecent(handoffs, prev []sessionHandoff) {
+	last := make(map[uint32]uint64, len(prev))
+	for _, h := range prev {
+		last[h.ID] = h.Received
+	}
+	for i := range handoffs {
+		h := &handoffs[i]
+		h.recent = h.Received
+		if r, ok := last[h.ID]; ok && r <= h.Received {
+			h.recent = h.Received - r
+		}
+	}
+}
+
+// up reports whether n has synced recently enough to trust its state.
+func (c *cluster) up(n *remoteNode, now time.Time) bool {
+	return now.Sub(n.received) < 3*c.cfg.syncInterval()
+}
+
+func (c *cluster) sign(body []byte) string {
+	m := hmac.New(sha256.New, c.key)
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func (c *cluster) verify(body []byte, sig string) bool {
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	m := hmac.New(sha256.New, c.key)
+	m.Write(body)
+	return hmac.Equal(got, m.Sum(nil))
+}
+
+// lookup returns the most recently adopted copy of session id held by any
+// peer. Peers that stopped syncing are included: taking over from a dead node
+// is the point.
+func (c *cluster) lookup(id uint32) (sessionHandoff, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var best sessionHandoff
+	found := false
+	for _, n := range c.nodes {
+		for _, h := range n.state.handoffs {
+			if h.ID == id && (!found || h.Adopted.After(best.Adopted)) {
+				best, found = h, true
+			}
+		}
+	}
+	return best, found
+}
+
+// status merges the local directory with the state of every live peer.
+// Sessions of nodes that stopped syncing are left out.
+func (c *cluster) status() ClusterStatus {
+	local := c.local()
+	st := ClusterStatus{Node: c.cfg.NodeID, Clients: local.Clients}
+	now := time.Now()
+	c.mu.Lock()
+	for id, n := range c.nodes {
+		up := c.up(n, now)
+		st.Nodes = append(st.Nodes, ClusterNode{
+			Node:     id,
+			Address:  n.state.Address,
+			LastSync: n.received,
+			Up:       up,
+			Clients:  len(n.state.Clients),
+		})
+		if up {
+			st.Clients = append(st.Clients, n.state.Clients...)
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(st.Nodes, func(i, j int) bool { return st.Nodes[i].Node < st.Nodes[j].Node })
+	return st
+}
@@ -1,52 +1,685 @@
 package vpn
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
+	"runtime"
+	"slices"
 	"strconv"
+	"time"
 
+	"github.com/gedons/go_VPN/internal/buildinfo"
+	"github.com/gedons/go_VPN/internal/keystore"
+	"github.com/gedons/go_VPN/internal/sealedconfig"
 	"gopkg.in/yaml.v2"
 )
 
 // Config holds settings for both client and server modes.
 type Config struct {
-	Mode          string `yaml:"mode"`           
-	ServerAddress string `yaml:"server_address"` 
-	PSK           string `yaml:"psk"`
-	AdapterName   string `yaml:"adapter_name"`   
-	AdapterIPCIDR string `yaml:"adapter_ip_cidr"`
+	Mode          string   `yaml:"mode"`
+	ServerAddress string   `yaml:"server_address"`
+	PSK           string   `yaml:"psk"`
+	PreviousPSKs  []string `yaml:"previous_psks"`
+	AdapterName   string   `yaml:"adapter_name"`
+	AdapterIPCIDR string   `yaml:"adapter_ip_cidr"`
+
+	// Netns creates the adapter inside this named network namespace on
+	// Linux, so only processes there use the tunnel.
+	Netns string `yaml:"netns"`
+
+	// FwMark sets SO_MARK on the tunnel's UDP socket on Linux, so ip rules
+	// can route the outer packets apart from what goes into the tunnel.
+	FwMark uint32 `yaml:"fwmark"`
+
+	// Userspace runs the client without an adapter, and so without admin
+	// rights, reaching the tunnel through a SOCKS5 proxy on SocksAddress
+	// (default 127.0.0.1:1080) and the port forwards.
+	Userspace    bool   `yaml:"userspace"`
+	SocksAddress string `yaml:"socks_address"`
+
+	// OneShotRoute routes the client's routes into the adapter once the
+	// tunnel is up, on Linux, for a sidecar giving its pod egress.
+	OneShotRoute bool `yaml:"one_shot_route"`
+
+	// HealthAddress serves GET /healthz and /readyz for liveness and
+	// readiness probes when set.
+	HealthAddress string `yaml:"health_address"`
+
+	// ShutdownDelay keeps the tunnel up this long after SIGTERM, with
+	// readiness failing, so the pod's other containers can finish.
+	ShutdownDelay time.Duration `yaml:"shutdown_delay"`
+
+	// ProtectedPSK is the psk sealed to this machine by gocli protect-psk,
+	// used in place of psk.
+	ProtectedPSK string `yaml:"protected_psk"`
+
+	// Username and Password log a client in, after its psk, to a server
+	// whose auth checks them with a login service such as RADIUS.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// ManagementAddress enables the local management API when set.
+	ManagementAddress string `yaml:"management_address"`
+
+	// StatusPage serves a status page with a disconnect button on a
+	// loopback address, such as 127.0.0.1:8686, when set.
+	StatusPage string `yaml:"status_page"`
+
+	// Tunnels runs several client tunnels in one process. Each entry is
+	// named by its key and overrides settings above it for that tunnel;
+	// tunnels holds the resulting configs.
+	Tunnels map[string]yaml.MapSlice `yaml:"tunnels"`
+	tunnels map[string]Config
+
+	// KeepaliveInterval is how often the client pings the server. The
+	// session is considered dead after three missed intervals.
+	KeepaliveInterval time.Duration `yaml:"keepalive_interval"`
+
+	// AdaptiveKeepalive makes the client find how long the NAT in front
+	// of it keeps an idle mapping, and send keepalives just often enough
+	// to keep it, up to every 90s. KeepaliveInterval is where it starts.
+	AdaptiveKeepalive bool `yaml:"adaptive_keepalive"`
+
+	// LowPower trades a little latency for fewer wakeups: the client
+	// sends packets in short bursts, keeps alive every
+	// LowPowerKeepaliveInterval unless KeepaliveInterval is set, and does
+	// its background checks less often, or not at all while idle.
+	LowPower bool `yaml:"low_power"`
+
+	// SessionTimeout is how long a server keeps a session it has not
+	// heard from; DefaultSessionTimeout if unset.
+	SessionTimeout time.Duration `yaml:"session_timeout"`
+
+	// MaxSessionDuration, on a server, makes clients handshake again
+	// once their session is this old, so access is re-checked.
+	MaxSessionDuration time.Duration `yaml:"max_session_duration"`
+
+	// DebugImpairment injects loss, duplication, reordering, and latency on
+	// the outer socket for resilience testing.
+	DebugImpairment ImpairmentConfig `yaml:"debug_impairment"`
+
+	// DebugTranscript is a file that handshakes, with nonces and keys
+	// left out, and per-packet metadata are appended to as JSON lines,
+	// for attaching to bug reports.
+	DebugTranscript string `yaml:"debug_transcript"`
+
+	// TunWorkers is the number of goroutines encrypting packets read from
+	// the tunnel. Defaults to the number of CPUs.
+	TunWorkers int `yaml:"tun_workers"`
+
+	// UPnP makes the server ask the local gateway to forward its UDP port
+	// over NAT-PMP or UPnP IGD.
+	UPnP bool `yaml:"upnp"`
+
+	// Discovery makes the server answer SSDP searches on the local network,
+	// so gocli discover can find it.
+	Discovery bool `yaml:"discovery"`
+
+	// Speedtest makes the server run a throughput sink on its tunnel
+	// address, port SpeedtestPort, for gocli speedtest.
+	Speedtest bool `yaml:"speedtest"`
+
+	// Pool is a CIDR from which the server leases addresses to clients
+	// whose adapter_ip_cidr is "auto". Packets for a leased address go only
+	// to that client.
+	Pool string `yaml:"pool"`
+
+	// Pool6 is an IPv6 prefix from which the server gives every client an
+	// address alongside its IPv4 one. The server takes the first address.
+	Pool6 string `yaml:"pool6"`
+
+	// DelegatePool is an IPv6 prefix from which clients that set
+	// request_prefix are delegated a prefix of DelegateLength (default 64)
+	// for a network behind them.
+	DelegatePool   string `yaml:"delegate_pool"`
+	DelegateLength int    `yaml:"delegate_length"`
+
+	// DNS lists resolvers the server pushes to clients in the handshake.
+	DNS []string `yaml:"dns"`
+
+	// SearchDomains, MTU, and NTPServers are pushed along with DNS. MTU
+	// is the tunnel adapter's MTU; zero leaves clients at their default.
+	SearchDomains []string `yaml:"search_domains"`
+	MTU           int      `yaml:"mtu"`
+	NTPServers    []string `yaml:"ntp_servers"`
+
+	// DynamicMTU makes the server probe the path to each client and watch
+	// for ICMP saying it is too small, and give a client whose path cannot
+	// carry MTU a smaller one.
+	DynamicMTU bool `yaml:"dynamic_mtu"`
+
+	// FastPath, on a Linux server, is an experimental way of receiving
+	// the tunnel's UDP datagrams: "af_packet" reads them from a memory
+	// mapped AF_PACKET ring, many per wakeup, falling back to the socket
+	// when the ring cannot be set up.
+	FastPath string `yaml:"fast_path"`
+
+	// UDPOffload, on Linux, sends the tunnel's UDP datagrams in runs of
+	// up to 64 per syscall with GSO, and reads the runs GRO joins on
+	// receive, for throughput on a busy client or server.
+	UDPOffload bool `yaml:"udp_offload"`
+
+	// NAT makes the server masquerade traffic from the tunnel subnet so
+	// clients can reach the internet through it.
+	NAT bool `yaml:"nat"`
+
+	// PersistForwarding leaves IP forwarding on after the server stops on
+	// Windows or Linux. Otherwise the server restores the setting it found.
+	PersistForwarding bool `yaml:"persist_forwarding"`
+
+	// ClientsFile is where the server keeps clients provisioned with
+	// gocli export-client, each with its own PSK and address.
+	ClientsFile string `yaml:"clients_file"`
+
+	// DropSpoofed makes the server drop packets from a client whose source
+	// is not the client's own tunnel address, leased or provisioned.
+	DropSpoofed bool `yaml:"drop_spoofed"`
+
+	// StateFile is where the server saves its sessions on a graceful
+	// shutdown, sealed under the PSK, and restores them from at start, so
+	// a quick restart does not make every client handshake again.
+	StateFile string `yaml:"state_file"`
+
+	// JournalFile records the adapter, routes and NAT added at start, so
+	// they are undone after a crash. It defaults to a file named after
+	// the adapter in the temp directory.
+	JournalFile string `yaml:"journal_file"`
+
+	// NetworkCache is where a client remembers, for each network it was
+	// on, the transport, server address and MTU that worked, to start with
+	// them when it is back. It defaults to a file named after the adapter
+	// in the user's cache directory; "off" turns it off.
+	NetworkCache string `yaml:"network_cache"`
+
+	// Routes are the prefixes a client sends through the tunnel. Defaults
+	// to everything (0.0.0.0/0).
+	Routes []string `yaml:"routes"`
+
+	// PeerAddress is where a p2p peer reaches the other peer. A peer
+	// without it waits to be contacted. AllowedIPs are the networks behind
+	// the other peer, routed into the adapter and the only sources taken
+	// from it besides its adapter address.
+	PeerAddress string   `yaml:"peer_address"`
+	AllowedIPs  []string `yaml:"allowed_ips"`
+
+	// Relay is a GoVPN instance in mode relay that both peers of a p2p
+	// link bind to. A peer falls back to it when peer_address does not
+	// answer, and one without peer_address is reached through it.
+	Relay string `yaml:"relay"`
+
+	// StrictRoutes makes a client refuse to start, or to take a pushed
+	// route, when its subnet or a route overlaps a subnet already on the
+	// host. Without it the overlap is only logged.
+	StrictRoutes bool `yaml:"strict_routes"`
+
+	// AdapterFallbacks are subnets, in CIDR form with the client's address,
+	// a client takes in order when adapter_ip_cidr overlaps a subnet already
+	// on the host. The server is told which one it took.
+	AdapterFallbacks []string `yaml:"adapter_fallbacks"`
+
+	// FallbackAddresses are servers a client tries in order when
+	// server_address stops answering. While on one, the client probes
+	// server_address every FailbackInterval (default 10s) and moves back
+	// once FailbackProbes (default 3) probes in a row succeed.
+	FallbackAddresses []string      `yaml:"fallback_addresses"`
+	FailbackInterval  time.Duration `yaml:"failback_interval"`
+	FailbackProbes    int           `yaml:"failback_probes"`
+
+	// ApplyNTP lets a client set the system's time servers to the ones the
+	// server pushes. It only works on Windows and outlives the tunnel.
+	ApplyNTP bool `yaml:"apply_ntp"`
+
+	// ClientName labels the client in the server's logs and client list.
+	// Defaults to the hostname.
+	ClientName string `yaml:"client_name"`
+
+	// RequestPrefix asks the server for an IPv6 prefix from its
+	// delegate_pool to route to a network behind the client.
+	RequestPrefix bool `yaml:"request_prefix"`
+
+	// AllowLAN keeps the client's local subnets off the tunnel when routes
+	// would otherwise cover them, so printers and file shares stay
+	// reachable in full-tunnel mode. Windows only.
+	AllowLAN bool `yaml:"allow_lan"`
+
+	// CaptivePortal makes a client whose handshake fails check for a
+	// captive portal and, if it finds one, wait for the user to sign in
+	// before trying again.
+	CaptivePortal bool `yaml:"captive_portal"`
+
+	// ConnectCheck tests a client's tunnel each time it comes up.
+	ConnectCheck ConnectCheckConfig `yaml:"connect_check"`
+
+	// StunServers are queried at client start to learn the public address
+	// and NAT type. Nothing is sent when the list is empty.
+	StunServers []string `yaml:"stun_servers"`
+
+	// FEC, on a client, asks for forward error correction in both
+	// directions, for lossy links.
+	FEC *FECConfig `yaml:"fec"`
+
+	// Reorder puts packets that arrive out of order back in sequence
+	// before they reach the tunnel.
+	Reorder ReorderConfig `yaml:"reorder"`
+
+	// Mirror copies decrypted client traffic to an IDS, on a server.
+	Mirror MirrorConfig `yaml:"mirror"`
+
+	// GeoIP limits where clients may connect from, on a server.
+	GeoIP GeoIPConfig `yaml:"geoip"`
+
+	// Decoy flags addresses that send probes, and may answer them, on a
+	// server.
+	Decoy DecoyConfig `yaml:"decoy"`
+
+	// Lockout refuses handshakes, on a server, from addresses that keep
+	// failing to authenticate.
+	Lockout LockoutConfig `yaml:"lockout"`
+
+	// Admission refuses new clients, on a server, while its CPU, packet
+	// rate or memory is over a limit, so the sessions it has keep their
+	// quality.
+	Admission AdmissionConfig `yaml:"admission"`
+
+	// Auth checks each client's username and password with a login
+	// service, on a server.
+	Auth AuthConfig `yaml:"auth"`
+
+	// Profiles are named views of the network, on a server, given to
+	// clients by the groups of their login. DefaultProfile goes to logins
+	// in none of the groups; without it they are refused.
+	Profiles       map[string]Profile `yaml:"profiles"`
+	DefaultProfile string             `yaml:"default_profile"`
+
+	// Listen, on a server, lists every address to listen on, such as
+	// 0.0.0.0:51820, 0.0.0.0:443 and [::]:51820, in place of
+	// server_address. All of them share one session table.
+	Listen []string `yaml:"listen"`
+
+	// MinProtocolVersion is the oldest protocol version the server offers
+	// on server_address. LegacyListen opens a second port for older
+	// clients, so a fleet can upgrade gradually. On a client,
+	// MinProtocolVersion is the oldest version it accepts, pinning it
+	// against a downgrade to a legacy port.
+	MinProtocolVersion uint16              `yaml:"min_protocol_version"`
+	LegacyListen       *LegacyListenConfig `yaml:"legacy_listen"`
+
+	// RequireTranscript makes a client refuse servers whose Welcome does
+	// not echo the transcript of its Hello, as servers before it did.
+	RequireTranscript bool `yaml:"require_transcript"`
+
+	// FIPSMode restricts the tunnel to FIPS 140-3 approved cryptography
+	// and refuses peers that are not in fips_mode. It needs Go's FIPS
+	// module enabled, as with GODEBUG=fips140=on.
+	FIPSMode bool `yaml:"fips_mode"`
+
+	// MinClientVersion makes a server turn away clients whose release is
+	// older, such as "v1.4.0".
+	MinClientVersion string `yaml:"min_client_version"`
+
+	// Transport carries the tunnel: "udp" (the default) or one added with
+	// RegisterTransport. Client and server must agree. A client can set
+	// "auto" to pick udp or one of migrate, whichever answers.
+	Transport string `yaml:"transport"`
+
+	// Migrate lists other transports the session can move to, without a
+	// handshake, when the one in use goes quiet. A server listens on each
+	// as well.
+	Migrate []MigrateConfig `yaml:"migrate"`
+
+	// Encapsulation adds a header to every UDP datagram for middleboxes
+	// that expect one: "gre" for GRE-in-UDP, or empty for none. Client and
+	// server must agree.
+	Encapsulation string `yaml:"encapsulation"`
+
+	// Cluster shares client state with other server instances.
+	Cluster ClusterConfig `yaml:"cluster"`
+
+	// Webhooks receive a signed JSON POST when clients connect, disconnect
+	// or fail to authenticate.
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+
+	// PortForwards proxy local ports to addresses across the tunnel, such
+	// as a public port on the server to a service on a client.
+	PortForwards []PortForwardConfig `yaml:"port_forwards"`
+
+	// RemoteForwards lets clients ask the server to open ports for them;
+	// RequestForwards are the ports a client asks for.
+	RemoteForwards  *RemoteForwardPolicy `yaml:"remote_forwards"`
+	RequestForwards []ForwardRequest     `yaml:"request_forwards"`
 }
 
+// ConfigPassphraseEnv names the environment variable holding the passphrase
+// of a config encrypted by gocli config encrypt.
+const ConfigPassphraseEnv = "GOVPN_CONFIG_PASSPHRASE"
+
 // LoadConfig reads a YAML file into Config.
 func LoadConfig(path string) (Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return Config{}, fmt.Errorf("read config %q: %w", path, err)
 	}
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return Config{}, fmt.Errorf("config %q: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig decodes and validates a YAML config held in memory, for
+// embedders that do not keep it in a file.
+func ParseConfig(data []byte) (Config, error) {
+	if sealedconfig.IsSealed(data) {
+		plain, err := sealedconfig.Open(data, os.Getenv(ConfigPassphraseEnv))
+		if errors.Is(err, sealedconfig.ErrNoPassphrase) {
+			return Config{}, fmt.Errorf("%w: set %s", err, ConfigPassphraseEnv)
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("encrypted config: %w", err)
+		}
+		data = plain
+	}
 	var cfg Config
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return Config{}, fmt.Errorf("parse config %q: %w", path, err)
+		return Config{}, fmt.Errorf("parse: %w", err)
+	}
+	if len(cfg.Tunnels) > 0 {
+		return parseTunnels(cfg, data)
 	}
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// validate checks a decoded config and opens protected_psk.
+func (cfg *Config) validate() error {
 	// Basic validation
 	switch cfg.Mode {
-	case "client", "server":
+	case "client", "server", "p2p", "relay":
 	default:
-		return Config{}, fmt.Errorf("invalid mode %q: must be 'client' or 'server'", cfg.Mode)
+		return fmt.Errorf("invalid mode %q: must be 'client', 'server', 'p2p' or 'relay'", cfg.Mode)
+	}
+	if cfg.ServerAddress == "" && (cfg.Mode == "client" || len(cfg.Listen) == 0) {
+		return fmt.Errorf("server_address is required")
 	}
-	if cfg.ServerAddress == "" {
-		return Config{}, fmt.Errorf("server_address is required")
+	if cfg.Mode == "relay" {
+		return cfg.validateRelay()
+	}
+	if cfg.ProtectedPSK != "" {
+		if cfg.PSK != "" {
+			return fmt.Errorf("set psk or protected_psk, not both")
+		}
+		psk, err := keystore.Unprotect(cfg.ProtectedPSK)
+		if err != nil {
+			return fmt.Errorf("protected_psk: %w", err)
+		}
+		cfg.PSK = string(psk)
 	}
 	if cfg.PSK == "" {
-		return Config{}, fmt.Errorf("psk is required")
+		return fmt.Errorf("psk is required")
 	}
 	if cfg.AdapterName == "" {
-		return Config{}, fmt.Errorf("adapter_name is required")
+		return fmt.Errorf("adapter_name is required")
 	}
 	if cfg.AdapterIPCIDR == "" {
-		return Config{}, fmt.Errorf("adapter_ip_cidr is required")
+		return fmt.Errorf("adapter_ip_cidr is required")
 	}
-	return cfg, nil
+	if cfg.KeepaliveInterval < 0 {
+		return fmt.Errorf("keepalive_interval cannot be negative")
+	}
+	if cfg.SessionTimeout < 0 {
+		return fmt.Errorf("session_timeout cannot be negative")
+	}
+	if cfg.MaxSessionDuration != 0 && cfg.Mode != "server" {
+		return fmt.Errorf("max_session_duration is a server setting")
+	}
+	if cfg.MaxSessionDuration != 0 && cfg.MaxSessionDuration < minSessionDuration {
+		return fmt.Errorf("max_session_duration must be at least %s", minSessionDuration)
+	}
+	if cfg.Netns != "" && runtime.GOOS != "linux" {
+		return fmt.Errorf("netns is only supported on Linux")
+	}
+	if err := cfg.validateFwMark(); err != nil {
+		return err
+	}
+	if err := cfg.validateUDPOffload(); err != nil {
+		return err
+	}
+	if err := cfg.validateFastPath(); err != nil {
+		return err
+	}
+	if err := cfg.validateStatusPage(); err != nil {
+		return err
+	}
+	if err := cfg.validateUserspace(); err != nil {
+		return err
+	}
+	if err := cfg.validateSidecar(); err != nil {
+		return err
+	}
+	if err := cfg.DebugImpairment.validate(); err != nil {
+		return err
+	}
+	if cfg.TunWorkers < 0 {
+		return fmt.Errorf("tun_workers cannot be negative")
+	}
+	if err := cfg.Cluster.validate(); err != nil {
+		return err
+	}
+	if cfg.Pool != "" && cfg.Cluster.Enabled() {
+		return fmt.Errorf("pool cannot be combined with cluster")
+	}
+	if err := cfg.validateDualStack(); err != nil {
+		return err
+	}
+	if cfg.FailbackInterval < 0 || cfg.FailbackProbes < 0 {
+		return fmt.Errorf("failback_interval and failback_probes cannot be negative")
+	}
+	for _, r := range cfg.Routes {
+		if _, err := netip.ParsePrefix(r); err != nil {
+			return fmt.Errorf("routes: %w", err)
+		}
+	}
+	if cfg.AdaptiveKeepalive && cfg.Mode != "client" {
+		return fmt.Errorf("adaptive_keepalive is a client setting")
+	}
+	if cfg.LowPower && cfg.Mode != "client" {
+		return fmt.Errorf("low_power is a client setting")
+	}
+	if cfg.Speedtest && cfg.Mode != "server" {
+		return fmt.Errorf("speedtest is a server setting")
+	}
+	if err := cfg.validateDynamicMTU(); err != nil {
+		return err
+	}
+	if cfg.PersistForwarding && cfg.Mode != "server" {
+		return fmt.Errorf("persist_forwarding is a server setting")
+	}
+	if cfg.StrictRoutes && cfg.Mode != "client" {
+		return fmt.Errorf("strict_routes is a client setting")
+	}
+	if len(cfg.AdapterFallbacks) > 0 {
+		if cfg.Mode != "client" {
+			return fmt.Errorf("adapter_fallbacks is a client setting")
+		}
+		if cfg.AdapterIPCIDR == AutoAddress {
+			return fmt.Errorf("adapter_fallbacks cannot be combined with adapter_ip_cidr: auto")
+		}
+	}
+	for _, f := range cfg.AdapterFallbacks {
+		if _, err := netip.ParsePrefix(f); err != nil {
+			return fmt.Errorf("adapter_fallbacks: %w", err)
+		}
+	}
+	for _, d := range cfg.DNS {
+		if _, err := netip.ParseAddr(d); err != nil {
+			return fmt.Errorf("dns: %w", err)
+		}
+	}
+	if err := cfg.validateOptions(); err != nil {
+		return err
+	}
+	if err := cfg.validateP2P(); err != nil {
+		return err
+	}
+	if err := cfg.Reorder.validate(); err != nil {
+		return err
+	}
+	if err := cfg.ConnectCheck.validate(cfg.Mode); err != nil {
+		return err
+	}
+	if err := cfg.Mirror.validate(cfg.Mode); err != nil {
+		return err
+	}
+	if err := cfg.GeoIP.validate(cfg.Mode); err != nil {
+		return err
+	}
+	if err := cfg.Decoy.validate(cfg.Mode); err != nil {
+		return err
+	}
+	if err := cfg.Lockout.validate(cfg.Mode); err != nil {
+		return err
+	}
+	if err := cfg.Admission.validate(cfg.Mode); err != nil {
+		return err
+	}
+	if err := cfg.Auth.validate(cfg.Mode, cfg.FIPSMode); err != nil {
+		return err
+	}
+	if len(cfg.Profiles) > 0 && cfg.Mode != "server" {
+		return fmt.Errorf("profiles is a server setting")
+	}
+	if _, err := parseProfiles(cfg.Profiles); err != nil {
+		return err
+	}
+	if _, ok := cfg.Profiles[cfg.DefaultProfile]; cfg.DefaultProfile != "" && !ok {
+		return fmt.Errorf("default_profile %q is not in profiles", cfg.DefaultProfile)
+	}
+	if (cfg.Username == "") != (cfg.Password == "") {
+		return fmt.Errorf("username and password must be set together")
+	}
+	if err := cfg.FEC.validate(); err != nil {
+		return err
+	}
+	if _, err := lookupTransport(cfg.Transport); err != nil && cfg.Transport != AutoTransport {
+		return err
+	}
+	if err := cfg.validateAutoTransport(); err != nil {
+		return err
+	}
+	if err := cfg.validateNetworkCache(); err != nil {
+		return err
+	}
+	if err := cfg.validateMigrate(); err != nil {
+		return err
+	}
+	for _, l := range cfg.Listen {
+		if _, _, err := net.SplitHostPort(l); err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+	}
+	if _, err := versionRange(cfg.MinProtocolVersion, 0); err != nil {
+		return fmt.Errorf("min_protocol_version: %w", err)
+	}
+	if err := cfg.LegacyListen.validate(); err != nil {
+		return err
+	}
+	switch cfg.Encapsulation {
+	case "":
+	case GREEncapsulation:
+		if cfg.Transport != "" && cfg.Transport != UDPTransport {
+			return fmt.Errorf("encapsulation only applies to the udp transport")
+		}
+	default:
+		return fmt.Errorf("unknown encapsulation %q", cfg.Encapsulation)
+	}
+	if cfg.StateFile != "" && cfg.Transport != "" && cfg.Transport != UDPTransport {
+		return fmt.Errorf("state_file only works with the udp transport")
+	}
+	for _, w := range cfg.Webhooks {
+		if err := w.validate(); err != nil {
+			return err
+		}
+	}
+	forwards := make(map[string]bool)
+	for _, f := range cfg.PortForwards {
+		if err := f.validate(); err != nil {
+			return err
+		}
+		if forwards[f.Name] {
+			return fmt.Errorf("port_forwards: duplicate name %q", f.Name)
+		}
+		forwards[f.Name] = true
+	}
+	if err := cfg.RemoteForwards.validate(); err != nil {
+		return err
+	}
+	for _, r := range cfg.RequestForwards {
+		if (r.Protocol != "" && r.Protocol != "tcp" && r.Protocol != "udp") || r.Port == 0 {
+			return fmt.Errorf("request_forwards: need a port, and protocol tcp or udp")
+		}
+	}
+	if _, ok := buildinfo.Compare(cfg.MinClientVersion, cfg.MinClientVersion); cfg.MinClientVersion != "" && !ok {
+		return fmt.Errorf("min_client_version: %q is not a release version", cfg.MinClientVersion)
+	}
+	if err := cfg.validateFIPS(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AcceptedPSKs returns the current PSK followed by any previous PSKs the
+// server still accepts for new handshakes.
+func (c Config) AcceptedPSKs() []string {
+	psks := []string{c.PSK}
+	for _, p := range c.PreviousPSKs {
+		if p != "" && !slices.Contains(psks, p) {
+			psks = append(psks, p)
+		}
+	}
+	return psks
+}
+
+func (c Config) keepaliveInterval() time.Duration {
+	if c.KeepaliveInterval > 0 {
+		return c.KeepaliveInterval
+	}
+	if c.LowPower {
+		return LowPowerKeepaliveInterval
+	}
+	return KeepaliveInterval
+}
+
+func (c Config) keepaliveTimeout() time.Duration {
+	return 3 * c.keepaliveInterval()
+}
+
+func (c Config) routes() []string {
+	if len(c.Routes) > 0 {
+		return c.Routes
+	}
+	return []string{"0.0.0.0/0"}
+}
+
+// Workers returns the effective TunWorkers setting.
+func (c Config) Workers() int {
+	if c.TunWorkers > 0 {
+		return c.TunWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// listenAddresses returns the addresses a server listens on for current
+// clients: listen, or else server_address.
+func (c Config) listenAddresses() []string {
+	if len(c.Listen) > 0 {
+		return c.Listen
+	}
+	return []string{c.ServerAddress}
 }
 
 func (c Config) ExtractPort() (int, error) {
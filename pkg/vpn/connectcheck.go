@@ -0,0 +1,315 @@
+package vpn
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+)
+
+// DefaultConnectCheckTimeout bounds each part of the connect check when
+// connect_check's timeout is unset.
+const DefaultConnectCheckTimeout = 5 * time.Second
+
+// connectCheckEchoes is how many echo requests the check sends, a second
+// apart, before it gives up.
+const connectCheckEchoes = 3
+
+// ConnectCheckConfig tests a client's tunnel each time it comes up: an echo
+// to the server's tunnel address and, with URL set, an HTTP request through
+// the tunnel. Results are logged and shown in the status. It is on unless
+// Disabled is set.
+type ConnectCheckConfig struct {
+	Disabled bool          `yaml:"disabled"`
+	URL      string        `yaml:"url"`     // http:// or https:// URL the tunnel routes, fetched once the echo passes
+	Timeout  time.Duration `yaml:"timeout"` // per part; DefaultConnectCheckTimeout if unset
+}
+
+func (c ConnectCheckConfig) validate(mode string) error {
+	if c == (ConnectCheckConfig{}) {
+		return nil
+	}
+	if mode != "client" {
+		return fmt.Errorf("connect_check is a client setting")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("connect_check: timeout cannot be negative")
+	}
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("connect_check: url %q must be an http:// or https:// URL", c.URL)
+		}
+	}
+	return nil
+}
+
+func (c ConnectCheckConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return DefaultConnectCheckTimeout
+}
+
+// Connect check results.
+const (
+	CheckPass    = "pass"
+	CheckFail    = "fail"
+	CheckSkipped = "skipped"
+	CheckRunning = "running"
+)
+
+// ConnectCheckStatus is the result of the last connect check.
+type ConnectCheckStatus struct {
+	Time       time.Time `json:"time"`
+	Echo       string    `json:"echo"` // one of the Check results
+	EchoMillis float64   `json:"echo_ms,omitempty"`
+	HTTP       string    `json:"http,omitempty"` // set when connect_check has a url
+	Error      string    `json:"error,omitempty"`
+}
+
+// Passed reports whether every part of the check that ran passed.
+func (s ConnectCheckStatus) Passed() bool {
+	return s.Echo != CheckFail && s.Echo != CheckRunning && s.HTTP != CheckFail && s.HTTP != CheckRunning
+}
+
+// connectCheck runs the client's connect checks, one at a time.
+type connectCheck struct {
+	running atomic.Bool
+	ident   atomic.Uint32 // ICMP identifier of the echoes in flight, plus one
+	replies chan uint16   // sequence numbers of their replies
+	result  atomic.Pointer[ConnectCheckStatus]
+}
+
+func newConnectCheck() *connectCheck {
+	return &connectCheck{replies: make(chan uint16, connectCheckEchoes)}
+}
+
+// startConnectCheck tests the tunnel to the server at gateway, its tunnel
+// address, unless a check is running already.
+func (c *Client) startConnectCheck(gateway string) {
+	if c.cfg.ConnectCheck.Disabled || !c.check.running.CompareAndSwap(false, true) {
+		return
+	}
+	c.check.result.Store(&ConnectCheckStatus{Time: time.Now(), Echo: CheckRunning})
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer c.journal.guard()
+		defer c.check.running.Store(false)
+		c.runConnectCheck(gateway)
+	}()
+}
+
+func (c *Client) runConnectCheck(gateway string) {
+	st := &ConnectCheckStatus{Time: time.Now()}
+	rtt, err := c.echoGateway(gateway)
+	switch {
+	case err == errNoGateway:
+		st.Echo = CheckSkipped
+		log.Printf("Connect check: echo SKIPPED: %v", err)
+	case err != nil:
+		st.Echo, st.Error = CheckFail, err.Error()
+		log.Printf("Connect check: echo to %s FAIL: %v", gateway, err)
+	default:
+		st.Echo, st.EchoMillis = CheckPass, float64(rtt)/float64(time.Millisecond)
+		log.Printf("Connect check: echo to %s PASS in %v", gateway, rtt.Round(time.Microsecond))
+	}
+	if c.ctx.Err() != nil {
+		return
+	}
+	if u := c.cfg.ConnectCheck.URL; u != "" && st.Echo != CheckFail {
+		if code, err := c.fetchThroughTunnel(u); err != nil {
+			st.HTTP, st.Error = CheckFail, err.Error()
+			log.Printf("Connect check: %s FAIL: %v", u, err)
+		} else {
+			st.HTTP = CheckPass
+			log.Printf("Connect check: %s PASS (HTTP %d)", u, code)
+		}
+	}
+	if c.ctx.Err() == nil {
+		c.check.result.Store(st)
+	}
+}
+
+// errNoGateway skips the echo for servers that do not report their tunnel
+// address, from before it was sent.
+var errNoGateway = errors.New("server did not report its tunnel address")
+
+// echoGateway sends ICMP echo requests to gateway through the tunnel and
+// returns the round-trip time of the first reply.
+func (c *Client) echoGateway(gateway string) (time.Duration, error) {
+	dst, err := netip.ParseAddr(gateway)
+	if err != nil || !dst.Is4() {
+		return 0, errNoGateway
+	}
+	src, ok := c.tunnelAddr()
+	if !ok {
+		return 0, fmt.Errorf("no tunnel address")
+	}
+	b, err := crypto.RandomBytes(2)
+	if err != nil {
+		return 0, err
+	}
+	ident := binary.BigEndian.Uint16(b)
+	for len(c.check.replies) > 0 {
+		<-c.check.replies
+	}
+	c.check.ident.Store(uint32(ident) + 1)
+	defer c.check.ident.Store(0)
+
+	deadline := time.NewTimer(c.cfg.ConnectCheck.timeout())
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var sent [connectCheckEchoes]time.Time
+	for seq := 0; ; {
+		if seq < connectCheckEchoes {
+			sent[seq] = time.Now()
+			if err := c.InjectPacket(echoRequest(src, dst, ident, uint16(seq))); err != nil {
+				return 0, err
+			}
+			seq++
+		}
+		select {
+		case <-c.ctx.Done():
+			return 0, c.ctx.Err()
+		case <-deadline.C:
+			return 0, fmt.Errorf("no reply within %v", c.cfg.ConnectCheck.timeout())
+		case n := <-c.check.replies:
+			if int(n) < seq {
+				return time.Since(sent[n]), nil
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// tunnelAddr returns the client's IPv4 tunnel address.
+func (c *Client) tunnelAddr() (netip.Addr, bool) {
+	if lease := c.lease.Load(); lease != nil {
+		return lease.Addr(), true
+	}
+	p, err := netip.ParsePrefix(c.cfg.AdapterIPCIDR)
+	if err != nil || !p.Addr().Is4() {
+		return netip.Addr{}, false
+	}
+	return p.Addr(), true
+}
+
+// tunnelDial returns a dialer whose connections go through the tunnel: the
+// userspace stack's, or the host's bound to the tunnel address, so a
+// destination the tunnel does not route fails rather than passing outside
+// it.
+func (c *Client) tunnelDial() dialFunc {
+	if c.stack != nil {
+		return c.stack.DialContext
+	}
+	d := &net.Dialer{}
+	if src, ok := c.tunnelAddr(); ok {
+		d.LocalAddr = &net.TCPAddr{IP: src.AsSlice()}
+	}
+	return d.DialContext
+}
+
+// checkReply takes pkt if it answers one of the connect check's echoes,
+// which are not passed on to the adapter.
+func (c *Client) checkReply(pkt []byte) bool {
+	id := c.check.ident.Load()
+	if id == 0 || len(pkt) < 28 || pkt[0] != 0x45 || pkt[9] != 1 || pkt[20] != 0 {
+		return false
+	}
+	if uint32(binary.BigEndian.Uint16(pkt[24:]))+1 != id {
+		return false
+	}
+	select {
+	case c.check.replies <- binary.BigEndian.Uint16(pkt[26:]):
+	default:
+	}
+	return true
+}
+
+// fetchThroughTunnel gets rawURL through the tunnel and returns the HTTP
+// status, which must not be an error.
+func (c *Client) fetchThroughTunnel(rawURL string) (int, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.cfg.ConnectCheck.timeout())
+	defer cancel()
+	hc := &http.Client{Transport: &http.Transport{DialContext: c.tunnelDial(), DisableKeepAlives: true}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 400 {
+		return resp.StatusCode, fmt.Errorf("HTTP %s", strings.TrimSpace(resp.Status))
+	}
+	return resp.StatusCode, nil
+}
+
+// echoRequest builds an ICMP echo request from src to dst.
+func echoRequest(src, dst netip.Addr, ident, seq uint16) []byte {
+	pkt := make([]byte, 20+8+32)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = 64 // TTL
+	pkt[9] = 1  // ICMP
+	s4, d4 := src.As4(), dst.As4()
+	copy(pkt[12:16], s4[:])
+	copy(pkt[16:20], d4[:])
+	binary.BigEndian.PutUint16(pkt[10:], ipv4Checksum(pkt[:20]))
+	icmp := pkt[20:]
+	icmp[0] = 8 // echo request
+	binary.BigEndian.PutUint16(icmp[4:], ident)
+	binary.BigEndian.PutUint16(icmp[6:], seq)
+	copy(icmp[8:], "govpn connect check")
+	binary.BigEndian.PutUint16(icmp[2:], ipv4Checksum(icmp))
+	return pkt
+}
+
+// echoReply answers pkt, if it is an ICMP echo request to gateway, from
+// gateway. The server answers these itself, so a client's connect check
+// does not depend on the host's firewall allowing pings.
+func echoReply(gateway netip.Addr, pkt []byte) []byte {
+	if !gateway.Is4() || len(pkt) < 28 || pkt[0] != 0x45 || pkt[9] != 1 || pkt[20] != 8 {
+		return nil
+	}
+	if dst, _ := packetDst(pkt); dst != gateway {
+		return nil
+	}
+	total := int(binary.BigEndian.Uint16(pkt[2:]))
+	if total < 28 || total > len(pkt) {
+		return nil
+	}
+	out := make([]byte, total)
+	copy(out, pkt[:total])
+	copy(out[12:16], pkt[16:20])
+	copy(out[16:20], pkt[12:16])
+	out[8] = 64
+	out[10], out[11] = 0, 0
+	binary.BigEndian.PutUint16(out[10:], ipv4Checksum(out[:20]))
+	icmp := out[20:]
+	icmp[0] = 0 // echo reply
+	icmp[2], icmp[3] = 0, 0
+	binary.BigEndian.PutUint16(icmp[2:], ipv4Checksum(icmp))
+	return out
+}
@@ -0,0 +1,188 @@
+package vpn
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+var errUnknownSession = errors.New("unknown session")
+
+// maxTranscriptPackets bounds the per-packet records in a debug transcript
+// so a busy tunnel cannot fill the disk. Handshakes and drops are still
+// recorded past it.
+const maxTranscriptPackets = 100000
+
+// transcriptRecord is one line of a debug transcript. Keys, the PSK, and
+// packet contents are never recorded, and nonces only as fingerprints.
+type transcriptRecord struct {
+	Time    time.Time         `json:"time"`
+	Dir     string            `json:"dir"` // "in" or "out"
+	Peer    string            `json:"peer,omitempty"`
+	Type    string            `json:"type"`
+	Session string            `json:"session,omitempty"`
+	Size    int               `json:"size,omitempty"`
+	Seq     uint64            `json:"seq,omitempty"`
+	Nonce   string            `json:"nonce,omitempty"` // fingerprint of the handshake nonce
+	Hello   *protocol.Hello   `json:"hello,omitempty"`
+	Welcome *protocol.Welcome `json:"welcome,omitempty"`
+	Drop    string            `json:"drop,omitempty"` // why the receiver discarded it
+}
+
+// debugTranscript writes debug_transcript as JSON lines. A nil
+// debugTranscript records nothing.
+type debugTranscript struct {
+	mu      sync.Mutex
+	f       *os.File
+	enc     *json.Encoder
+	packets int
+}
+
+func openDebugTranscript(path string) (*debugTranscript, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("debug_transcript: %w", err)
+	}
+	log.Printf("Warning: recording a debug transcript to %s", path)
+	return &debugTranscript{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (t *debugTranscript) close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.f.Close()
+}
+
+func (t *debugTranscript) write(r transcriptRecord) {
+	r.Time = time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enc.Encode(r)
+}
+
+// packet records the header of a datagram as it crosses the socket.
+func (t *debugTranscript) packet(dir string, peer net.Addr, b []byte) {
+	if t == nil {
+		return
+	}
+	h, payload, err := protocol.ParseHeader(b)
+	if err != nil {
+		return
+	}
+	r := transcriptRecord{Dir: dir, Peer: addrOf(peer), Type: h.Type.String(), Session: fmt.Sprintf("%08x", h.Session), Size: len(b)}
+	switch h.Type {
+	case protocol.MsgHandshakeInit, protocol.MsgHandshakeResp:
+	default:
+		t.mu.Lock()
+		t.packets++
+		n := t.packets
+		t.mu.Unlock()
+		if n > maxTranscriptPackets {
+			if n == maxTranscriptPackets+1 {
+				t.write(transcriptRecord{Dir: dir, Type: "limit", Drop: "packet records stop here; handshakes and drops continue"})
+			}
+			return
+		}
+		if len(payload) >= crypto.SeqSize {
+			r.Seq = binary.BigEndian.Uint64(payload)
+		}
+	}
+	t.write(r)
+}
+
+// hello records a decoded Hello.
+func (t *debugTranscript) hello(dir string, peer net.Addr, h *protocol.Hello) {
+	if t == nil {
+		return
+	}
+	redacted := *h
+	redacted.Nonce = nil
+	redacted.Password = ""
+	t.write(transcriptRecord{Dir: dir, Peer: addrOf(peer), Type: "hello", Nonce: fingerprint(h.Nonce), Hello: &redacted})
+}
+
+// welcome records a decoded Welcome, and why it was ignored if it was.
+func (t *debugTranscript) welcome(dir string, peer net.Addr, w *protocol.Welcome, drop string) {
+	if t == nil {
+		return
+	}
+	redacted := *w
+	redacted.Nonce = nil
+	t.write(transcriptRecord{Dir: dir, Peer: addrOf(peer), Type: "welcome", Session: fmt.Sprintf("%08x", w.Session), Nonce: fingerprint(w.Nonce), Welcome: &redacted, Drop: drop})
+}
+
+// drop records a datagram the receiver discarded and why.
+func (t *debugTranscript) drop(peer net.Addr, h protocol.Header, reason error) {
+	if t == nil {
+		return
+	}
+	t.write(transcriptRecord{Dir: "in", Peer: addrOf(peer), Type: h.Type.String(), Session: fmt.Sprintf("%08x", h.Session), Drop: reason.Error()})
+}
+
+func fingerprint(nonce []byte) string {
+	if len(nonce) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(nonce)
+	return hex.EncodeToString(sum[:4])
+}
+
+func addrOf(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+// transcriptConn records the client's datagrams in its debug transcript.
+type transcriptConn struct {
+	outerConn
+	t *debugTranscript
+}
+
+func (c *transcriptConn) Read(b []byte) (int, error) {
+	n, err := c.outerConn.Read(b)
+	if err == nil {
+		c.t.packet("in", c.RemoteAddr(), b[:n])
+	}
+	return n, err
+}
+
+func (c *transcriptConn) Write(b []byte) (int, error) {
+	c.t.packet("out", c.RemoteAddr(), b)
+	return c.outerConn.Write(b)
+}
+
+// transcriptPacketConn records the server's datagrams in its debug
+// transcript.
+type transcriptPacketConn struct {
+	PacketConn
+	t *debugTranscript
+}
+
+func (c *transcriptPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		c.t.packet("in", addr, b[:n])
+	}
+	return n, addr, err
+}
+
+func (c *transcriptPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.t.packet("out", addr, b)
+	return c.PacketConn.WriteTo(b, addr)
+}
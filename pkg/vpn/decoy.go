@@ -0,0 +1,234 @@
+package vpn
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	mrand "math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// Decoy modes.
+const (
+	DecoySilent  = "silent"  // drop probes without a word, as without decoy
+	DecoyGarbage = "garbage" // answer them with what looks like a handshake response
+)
+
+const (
+	// DefaultFlagAfter is how many probes from one address flag it when
+	// decoy.flag_after is unset.
+	DefaultFlagAfter = 10
+
+	// probeWindow is how long an address's probes are counted together.
+	probeWindow = 10 * time.Minute
+	// maxProbeSources bounds the addresses tracked at once; the least
+	// recently seen is forgotten first.
+	maxProbeSources = 4096
+	// decoyRate and decoyBurst limit garbage replies across all sources,
+	// per second, so a flood with spoofed sources cannot be reflected.
+	decoyRate  = 50
+	decoyBurst = 50
+	// minDecoyReply is the smallest probe that is answered.
+	minDecoyReply = protocol.HeaderSize + 16
+)
+
+// DecoyConfig sets how a server treats probes: packets that fail to
+// authenticate as a handshake, and packets too malformed to be from a
+// client. It is off unless Mode is set.
+type DecoyConfig struct {
+	Mode      string `yaml:"mode"`       // silent or garbage
+	FlagAfter int    `yaml:"flag_after"` // probes from one address in 10 minutes that flag it; DefaultFlagAfter if unset
+}
+
+// Enabled reports whether decoy is configured.
+func (c DecoyConfig) Enabled() bool {
+	return c.Mode != ""
+}
+
+func (c DecoyConfig) validate(mode string) error {
+	switch {
+	case !c.Enabled() && c.FlagAfter == 0:
+		return nil
+	case c.Mode != DecoySilent && c.Mode != DecoyGarbage:
+		return fmt.Errorf("decoy: mode must be %s or %s", DecoySilent, DecoyGarbage)
+	case mode != "server":
+		return fmt.Errorf("decoy is a server setting")
+	case c.FlagAfter < 0:
+		return fmt.Errorf("decoy: flag_after cannot be negative")
+	}
+	return nil
+}
+
+func (c DecoyConfig) flagAfter() int {
+	if c.FlagAfter > 0 {
+		return c.FlagAfter
+	}
+	return DefaultFlagAfter
+}
+
+// ProbeSource is an address that sent probes, as listed by GET /probes.
+type ProbeSource struct {
+	Address string    `json:"address"`
+	Probes  int       `json:"probes"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+	Flagged bool      `json:"flagged"`
+	Reason  string    `json:"reason"` // the last probe's
+	Country string    `json:"country,omitempty"`
+	ASN     uint32    `json:"asn,omitempty"`
+}
+
+// ProbeList is the body of GET /probes, most recent first.
+type ProbeList struct {
+	Probes []ProbeSource `json:"probes"`
+}
+
+// decoy counts probes by source address and answers them as configured.
+type decoy struct {
+	cfg DecoyConfig
+
+	mu      sync.Mutex
+	sources map[netip.Addr]*ProbeSource
+	replies tokenBucket
+}
+
+func newDecoy(cfg DecoyConfig) *decoy {
+	return &decoy{cfg: cfg, sources: make(map[netip.Addr]*ProbeSource)}
+}
+
+// probe records a probe of n bytes from addr for reason, answers it in
+// garbage mode, and flags addr once it has sent flag_after of them. s.decoy
+// may be nil.
+func (s *Server) probe(ln *listener, addr net.Addr, n int, reason string) {
+	d := s.decoy
+	if d == nil {
+		return
+	}
+	ip, err := netip.ParseAddr(hostOf(addr))
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	d.mu.Lock()
+	src := d.sources[ip]
+	if src != nil && now.Sub(src.Last) > probeWindow {
+		src = nil
+	}
+	if src == nil {
+		if len(d.sources) >= maxProbeSources {
+			d.forgetOldestLocked()
+		}
+		src = &ProbeSource{Address: ip.String(), First: now}
+		d.sources[ip] = src
+	}
+	src.Probes++
+	src.Last = now
+	src.Reason = reason
+	flag := !src.Flagged && src.Probes >= d.cfg.flagAfter()
+	src.Flagged = src.Flagged || flag
+	count, since := src.Probes, now.Sub(src.First)
+	d.mu.Unlock()
+
+	if flag {
+		geo := s.geo.lookup(addr)
+		d.mu.Lock()
+		src.Country, src.ASN = geo.Country, geo.ASN
+		d.mu.Unlock()
+		where := ""
+		if geo.known() {
+			where = " in " + geo.String()
+		}
+		log.Printf("Flagged %s%s as a probe source: %d unauthenticated packets in %s, last %s",
+			ip, where, count, since.Round(time.Second), reason)
+		ev := Event{Type: EventProbeFlagged, Endpoint: addr.String(), Reason: reason}
+		ev.setGeo(geo)
+		s.hooks.emit(ev)
+	}
+	s.answer(ln, addr, n)
+}
+
+// answer replies to an unauthenticated packet of n bytes from addr in
+// garbage mode, without counting it as a probe. Every packet the server
+// cannot authenticate, whatever the cause, gets this same answer, so a
+// sender cannot tell a wrong key from an unknown session or a malformed
+// packet.
+func (s *Server) answer(ln *listener, addr net.Addr, n int) {
+	d := s.decoy
+	if d == nil || d.cfg.Mode != DecoyGarbage || n < minDecoyReply {
+		return
+	}
+	d.mu.Lock()
+	reply := d.replies.take(decoyRate, decoyBurst, 1, time.Now())
+	d.mu.Unlock()
+	if reply {
+		ln.conn.WriteTo(decoyReply(n), addr)
+	}
+}
+
+// chaff is a session cipher under a random key that packets for unknown
+// sessions are checked against, so they take as long to refuse as packets
+// that fail to decrypt under a real session.
+var chaff = sync.OnceValue(func() *crypto.SessionCipher {
+	key, err := crypto.RandomBytes(32)
+	if err != nil {
+		panic(err)
+	}
+	c, err := crypto.NewSessionCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	return c
+})
+
+// forgetOldestLocked drops the least recently seen source. Callers hold
+// d.mu.
+func (d *decoy) forgetOldestLocked() {
+	var oldest netip.Addr
+	var last time.Time
+	for ip, src := range d.sources {
+		if !oldest.IsValid() || src.Last.Before(last) {
+			oldest, last = ip, src.Last
+		}
+	}
+	delete(d.sources, oldest)
+}
+
+// decoyReply builds random bytes behind a handshake response header, no
+// longer than the n-byte probe it answers so it amplifies nothing. Like a
+// real rejection, it is addressed to session 0.
+func decoyReply(n int) []byte {
+	size := n - mrand.IntN(min(16, n-minDecoyReply)+1)
+	pkt := protocol.Header{Type: protocol.MsgHandshakeResp}.Append(make([]byte, 0, size))
+	pkt = pkt[:size]
+	rand.Read(pkt[protocol.HeaderSize:])
+	return pkt
+}
+
+// Probes lists the addresses seen sending probes in the last 10 minutes,
+// most recent first. It is empty unless decoy is configured.
+func (s *Server) Probes() ProbeList {
+	list := ProbeList{Probes: []ProbeSource{}}
+	d := s.decoy
+	if d == nil {
+		return list
+	}
+	cutoff := time.Now().Add(-probeWindow)
+	d.mu.Lock()
+	for ip, src := range d.sources {
+		if src.Last.Before(cutoff) {
+			delete(d.sources, ip)
+			continue
+		}
+		list.Probes = append(list.Probes, *src)
+	}
+	d.mu.Unlock()
+	slices.SortFunc(list.Probes, func(a, b ProbeSource) int { return b.Last.Compare(a.Last) })
+	return list
+}
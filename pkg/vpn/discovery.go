@@ -0,0 +1,37 @@
+package vpn
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/gedons/go_VPN/internal/ssdp"
+)
+
+// announce answers discovery searches on the local network with the
+// primary listener's port until the server stops.
+func (s *Server) announce() {
+	defer s.wg.Done()
+	defer s.journal.guard()
+	_, portStr, err := net.SplitHostPort(s.Addr().String())
+	port, perr := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || perr != nil {
+		log.Printf("Discovery needs a listener with a port, not %s", s.Addr())
+		return
+	}
+	name, _ := os.Hostname()
+	transport := s.cfg.Transport
+	if transport == "" {
+		transport = UDPTransport
+	}
+	err = ssdp.Serve(s.ctx, ssdp.Service{
+		Name:          name,
+		Port:          uint16(port),
+		Transport:     transport,
+		Encapsulation: s.cfg.Encapsulation,
+	})
+	if err != nil {
+		log.Printf("Discovery stopped: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package vpn
+
+import (
+	"log"
+	"net/netip"
+	"strings"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// DNSConfigurator applies the DNS servers and search domains a server
+// pushes. The platform adapters bring their own; embedders and tests can
+// supply another with SetDNSConfigurator.
+type DNSConfigurator = tun.DNSConfigurator
+
+// NopDNS is a DNSConfigurator that changes nothing and keeps what it was
+// last given, for tests.
+type NopDNS = tun.NopDNS
+
+// SetDNSConfigurator makes the client apply pushed DNS settings through d
+// instead of through the adapter. Call before Start.
+func (c *Client) SetDNSConfigurator(d DNSConfigurator) {
+	c.dnsConf = d
+}
+
+// applyDNS hands the DNS servers and search domains the server pushed to
+// the DNS configurator, when they changed.
+func (c *Client) applyDNS(servers, domains []string) {
+	key := strings.Join(servers, ",") + ";" + strings.Join(domains, ",")
+	if key == c.dns || key == ";" && !c.dnsApplied {
+		// Unchanged, or nothing pushed and nothing to take back.
+		return
+	}
+	c.dns = key
+	if c.dnsConf == nil {
+		c.dnsConf = tun.DNSFor(c.tunMgr)
+	}
+	var addrs []netip.Addr
+	for _, s := range servers {
+		if a, err := netip.ParseAddr(s); err == nil {
+			addrs = append(addrs, a)
+		}
+	}
+	if err := c.dnsConf.Apply(addrs, domains); err != nil {
+		log.Printf("Set DNS servers %s and search domains %s: %v", strings.Join(servers, ","), strings.Join(domains, ","), err)
+		return
+	}
+	c.dnsApplied = true
+	if len(servers) > 0 {
+		log.Printf("Using DNS servers %s", strings.Join(servers, ","))
+	}
+	if len(domains) > 0 {
+		log.Printf("Using search domains %s", strings.Join(domains, ","))
+	}
+}
+
+// restoreDNS takes back the DNS settings applyDNS made, on Stop.
+func (c *Client) restoreDNS() {
+	if !c.dnsApplied {
+		return
+	}
+	if err := c.dnsConf.Restore(); err != nil {
+		log.Printf("Restore DNS settings: %v", err)
+	}
+}
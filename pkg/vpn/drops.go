@@ -0,0 +1,73 @@
+package vpn
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+)
+
+// dropReason says why a packet was discarded.
+type dropReason int
+
+const (
+	dropMalformed      dropReason = iota // outer packet too short to parse
+	dropUnknownSession                   // no session with the packet's ID
+	dropDecrypt                          // failed authentication
+	dropReplay                           // replayed or outside the replay window
+	dropFilter                           // refused by anti-spoofing or a packet filter
+	dropMTU                              // larger than the tunnel MTU
+	dropNoRoute                          // no session to send the packet over
+	dropFEC                              // FEC message that could not be decoded
+	dropSend                             // sealing or sending to the peer failed
+	dropTunWrite                         // writing to the tunnel adapter failed
+	dropPoliced                          // over the rate of the client's qos rule
+	dropLockedOut                        // handshake from an address locked out after failing
+	dropProfile                          // destination outside the client's profiles
+	numDropReasons
+)
+
+// dropReasonNames are the keys drops are reported under.
+var dropReasonNames = [numDropReasons]string{
+	dropMalformed:      "malformed",
+	dropUnknownSession: "unknown_session",
+	dropDecrypt:        "decrypt",
+	dropReplay:         "replay",
+	dropFilter:         "filter",
+	dropMTU:            "mtu",
+	dropNoRoute:        "no_route",
+	dropFEC:            "fec",
+	dropSend:           "send",
+	dropTunWrite:       "tun_write",
+	dropPoliced:        "policed",
+	dropLockedOut:      "locked_out",
+	dropProfile:        "profile",
+}
+
+// dropCounters counts dropped packets by reason.
+type dropCounters [numDropReasons]atomic.Uint64
+
+func (d *dropCounters) add(r dropReason) { d[r].Add(1) }
+
+// counts returns the non-zero counters keyed by reason, or nil if nothing
+// was dropped.
+func (d *dropCounters) counts() map[string]uint64 {
+	var m map[string]uint64
+	for r := range d {
+		if n := d[r].Load(); n > 0 {
+			if m == nil {
+				m = make(map[string]uint64)
+			}
+			m[dropReasonNames[r]] = n
+		}
+	}
+	return m
+}
+
+// decryptReason tells replays apart from other decryption failures.
+func decryptReason(err error) dropReason {
+	if errors.Is(err, crypto.ErrReplay) {
+		return dropReplay
+	}
+	return dropDecrypt
+}
@@ -0,0 +1,256 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/netip"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+const (
+	// DefaultDelegateLength is the length of the prefixes delegated from
+	// delegate_pool when delegate_length is unset.
+	DefaultDelegateLength = 64
+
+	// maxDelegations bounds how many prefixes one delegate_pool holds, so
+	// looking for a free one stays cheap.
+	maxDelegations = 1 << 16
+)
+
+// validateDualStack checks pool6, delegate_pool, and delegate_length.
+func (c Config) validateDualStack() error {
+	if c.Pool6 != "" {
+		p, err := netip.ParsePrefix(c.Pool6)
+		if err != nil {
+			return fmt.Errorf("pool6: %w", err)
+		}
+		if !p.Addr().Is6() || p.Addr().Is4In6() || p.Bits() > 120 {
+			return fmt.Errorf("pool6 %s: must be an IPv6 prefix of /120 or larger", c.Pool6)
+		}
+	}
+	if c.DelegatePool != "" {
+		p, err := netip.ParsePrefix(c.DelegatePool)
+		if err != nil {
+			return fmt.Errorf("delegate_pool: %w", err)
+		}
+		n := c.delegateLength()
+		if !p.Addr().Is6() || p.Addr().Is4In6() || n < p.Bits() || n > 128 || n-p.Bits() > 16 {
+			return fmt.Errorf("delegate_pool %s: must be an IPv6 prefix holding 1 to %d prefixes of /%d", c.DelegatePool, maxDelegations, n)
+		}
+	}
+	if (c.Pool6 != "" || c.DelegatePool != "") && c.Cluster.Enabled() {
+		return fmt.Errorf("pool6 and delegate_pool cannot be combined with cluster")
+	}
+	return nil
+}
+
+func (c Config) delegateLength() int {
+	if c.DelegateLength > 0 {
+		return c.DelegateLength
+	}
+	return DefaultDelegateLength
+}
+
+// newPool6 builds the IPv6 address pool. The server takes its first
+// address, and clients are given the pool's prefix length so they are
+// on-link with the server and each other.
+func newPool6(cidr string) (*addressPool, error) {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("pool6: %w", err)
+	}
+	p = p.Masked()
+	return &addressPool{
+		prefix: p,
+		bits:   p.Bits(),
+		server: p.Addr().Next(),
+		used:   make(map[netip.Addr]bool),
+	}, nil
+}
+
+// prefixPool delegates IPv6 prefixes of one length from a larger one, for
+// clients routing a network behind them. It is guarded by the server's
+// sessionsMu.
+type prefixPool struct {
+	prefix netip.Prefix
+	bits   int // length of the delegated prefixes
+	used   map[netip.Prefix]bool
+}
+
+func newPrefixPool(cidr string, bits int) (*prefixPool, error) {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("delegate_pool: %w", err)
+	}
+	return &prefixPool{prefix: p.Masked(), bits: bits, used: make(map[netip.Prefix]bool)}, nil
+}
+
+// leaseLocked takes a free prefix, preferring want. It reports false when
+// every prefix is delegated.
+func (p *prefixPool) leaseLocked(want netip.Prefix) (netip.Prefix, bool) {
+	if want.Bits() == p.bits && p.prefix.Contains(want.Addr()) && want == want.Masked() && !p.used[want] {
+		p.used[want] = true
+		return want, true
+	}
+	n := 1 << (p.bits - p.prefix.Bits())
+	for i := 0; i < n; i++ {
+		d := p.nth(i)
+		if !p.used[d] {
+			p.used[d] = true
+			return d, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// nth returns the i'th delegated prefix.
+func (p *prefixPool) nth(i int) netip.Prefix {
+	a := p.prefix.Addr().As16()
+	hi := binary.BigEndian.Uint64(a[:8])
+	lo := binary.BigEndian.Uint64(a[8:])
+	var hiAdd, loAdd uint64
+	if shift := 128 - p.bits; shift >= 64 {
+		hiAdd = uint64(i) << (shift - 64)
+	} else {
+		hiAdd, loAdd = uint64(i)>>(64-shift), uint64(i)<<shift
+	}
+	lo, carry := bits.Add64(lo, loAdd, 0)
+	hi += hiAdd + carry
+	binary.BigEndian.PutUint64(a[:8], hi)
+	binary.BigEndian.PutUint64(a[8:], lo)
+	return netip.PrefixFrom(netip.AddrFrom16(a), p.bits)
+}
+
+func (p *prefixPool) reserveLocked(d netip.Prefix) {
+	if d.Bits() == p.bits && p.prefix.Contains(d.Addr()) {
+		p.used[d] = true
+	}
+}
+
+func (p *prefixPool) releaseLocked(d netip.Prefix) {
+	delete(p.used, d)
+}
+
+// reclaimLocked drops leased sessions that have been silent past the
+// keepalive timeout, freeing their addresses and prefixes. Callers must
+// hold sessionsMu for writing.
+func (s *Server) reclaimLocked() {
+	cutoff := time.Now().Add(-s.cfg.keepaliveTimeout())
+	for id, old := range s.sessions {
+		if (old.leased || old.address6.IsValid() || old.delegated.IsValid()) && old.lastSeen.Load().Before(cutoff) {
+			s.removeSessionLocked(id, "idle")
+		}
+	}
+}
+
+// lease6Locked gives sess an IPv6 address from pool6, preferring want.
+// Callers must hold sessionsMu for writing.
+func (s *Server) lease6Locked(sess *serverSession, want string) bool {
+	prev, _ := netip.ParseAddr(want)
+	a, ok := s.pool6.leaseLocked(prev)
+	if !ok {
+		s.reclaimLocked()
+		a, ok = s.pool6.leaseLocked(prev)
+	}
+	if ok {
+		sess.address6 = a
+		s.routes[a] = sess
+	}
+	return ok
+}
+
+// delegateLocked gives sess a prefix from delegate_pool, preferring want.
+// Callers must hold sessionsMu for writing.
+func (s *Server) delegateLocked(sess *serverSession, want string) bool {
+	prev, _ := netip.ParsePrefix(want)
+	d, ok := s.delegates.leaseLocked(prev)
+	if !ok {
+		s.reclaimLocked()
+		d, ok = s.delegates.leaseLocked(prev)
+	}
+	if ok {
+		sess.delegated = d
+		s.delegated[d] = sess
+	}
+	return ok
+}
+
+// releaseDualStackLocked returns sess's IPv6 address and delegated prefix.
+// Callers must hold sessionsMu for writing.
+func (s *Server) releaseDualStackLocked(sess *serverSession) {
+	if sess.address6.IsValid() {
+		if s.routes[sess.address6] == sess {
+			delete(s.routes, sess.address6)
+		}
+		s.pool6.releaseLocked(sess.address6)
+	}
+	if sess.delegated.IsValid() {
+		if s.delegated[sess.delegated] == sess {
+			delete(s.delegated, sess.delegated)
+		}
+		s.delegates.releaseLocked(sess.delegated)
+	}
+}
+
+// delegatedRouteLocked returns the session delegated the prefix holding
+// dst. It reports false when dst is outside delegate_pool; a nil session
+// with true means the prefix is not delegated to anyone. Callers must hold
+// sessionsMu.
+func (s *Server) delegatedRouteLocked(dst netip.Addr) (*serverSession, bool) {
+	if s.delegates == nil || !s.delegates.prefix.Contains(dst) {
+		return nil, false
+	}
+	d, _ := dst.Prefix(s.delegates.bits)
+	return s.delegated[d], true
+}
+
+// addTunnelAddress gives the server's adapter prefix, such as its address
+// in pool6. Devices supplied by an embedder are left to the embedder.
+func (s *Server) addTunnelAddress(prefix netip.Prefix) {
+	a, ok := s.tunMgr.(tun.AddressAdder)
+	if !ok {
+		return
+	}
+	if err := a.AddAddress(prefix); err != nil {
+		log.Printf("Add tunnel address %s: %v", prefix, err)
+	}
+}
+
+// applyDualStack adds the IPv6 address the server gave to the adapter and
+// records the delegated prefix. readdressed reports that the adapter's
+// addresses were just replaced, so the IPv6 one must be added again.
+func (c *Client) applyDualStack(w *protocol.Welcome, readdressed bool) error {
+	if w.Address6 != "" {
+		a6, err := netip.ParsePrefix(w.Address6)
+		if err != nil || !a6.Addr().Is6() {
+			return fmt.Errorf("server gave an invalid IPv6 address: %q", w.Address6)
+		}
+		if prev := c.lease6.Load(); prev == nil || *prev != a6 || readdressed {
+			if adder, ok := c.tunMgr.(tun.AddressAdder); ok {
+				if err := adder.AddAddress(a6); err != nil {
+					log.Printf("Add IPv6 address %s: %v", a6, err)
+				}
+			}
+			log.Printf("Leased address %s", a6)
+		}
+		c.lease6.Store(&a6)
+	}
+	if w.Prefix != "" {
+		p, err := netip.ParsePrefix(w.Prefix)
+		if err != nil || !p.Addr().Is6() {
+			return fmt.Errorf("server delegated an invalid prefix: %q", w.Prefix)
+		}
+		if prev := c.prefix.Load(); prev == nil || *prev != p {
+			log.Printf("Delegated prefix %s; route it to the network behind this client", p)
+		}
+		c.prefix.Store(&p)
+	} else if c.cfg.RequestPrefix {
+		log.Printf("Server delegated no prefix")
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package vpn
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix starts the names of the environment variables ConfigFromEnv
+// reads.
+const EnvPrefix = "GOVPN_"
+
+// ConfigFromEnv builds a config from environment variables, one per
+// setting, for containers that are configured without a file:
+// GOVPN_SERVER_ADDRESS sets server_address, and so on. String settings are
+// taken as they are; the rest are read as YAML, so GOVPN_ROUTES could be
+// [0.0.0.0/0]. environ is in the form of os.Environ.
+func ConfigFromEnv(environ []string) (Config, error) {
+	keys := configKeys()
+	var doc yaml.MapSlice
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, EnvPrefix) || name == ConfigPassphraseEnv {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, EnvPrefix))
+		isString, known := keys[key]
+		if !known {
+			return Config{}, fmt.Errorf("%s: no setting named %s", name, key)
+		}
+		var v any = value
+		if !isString {
+			if err := yaml.Unmarshal([]byte(value), &v); err != nil {
+				return Config{}, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		doc = append(doc, yaml.MapItem{Key: key, Value: v})
+	}
+	if len(doc) == 0 {
+		return Config{}, fmt.Errorf("no %s environment variables set", EnvPrefix+"*")
+	}
+	sort.Slice(doc, func(i, j int) bool { return doc[i].Key.(string) < doc[j].Key.(string) })
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return Config{}, fmt.Errorf("environment: %w", err)
+	}
+	return cfg, nil
+}
+
+// configKeys maps each top-level config key to whether it holds a string.
+func configKeys() map[string]bool {
+	t := reflect.TypeFor[Config]()
+	keys := make(map[string]bool, t.NumField())
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" || !f.IsExported() {
+			continue
+		}
+		keys[name] = f.Type.Kind() == reflect.String
+	}
+	return keys
+}
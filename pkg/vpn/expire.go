@@ -0,0 +1,74 @@
+package vpn
+
+import (
+	"log"
+	"time"
+)
+
+// minSessionDuration is the shortest max_session_duration, so clients are
+// not kept handshaking.
+const minSessionDuration = time.Minute
+
+// DefaultSessionTimeout is how long the server keeps a session it has not
+// heard from when session_timeout is unset. Clients re-handshake long
+// before, after three missed keepalives.
+const DefaultSessionTimeout = 3 * time.Minute
+
+func (c Config) sessionTimeout() time.Duration {
+	if c.SessionTimeout > 0 {
+		return c.SessionTimeout
+	}
+	return max(DefaultSessionTimeout, 2*c.keepaliveTimeout())
+}
+
+// loopExpire removes sessions silent for longer than the session timeout,
+// releasing their addresses and forwards, so the session table does not
+// grow without bound and broadcasts stop going to clients that are gone.
+// It also ends sessions older than max_session_duration.
+func (s *Server) loopExpire() {
+	defer s.wg.Done()
+	defer s.journal.guard()
+	timeout := s.cfg.sessionTimeout()
+	interval := timeout / 4
+	if s.cfg.MaxSessionDuration > 0 {
+		interval = min(interval, s.cfg.MaxSessionDuration/8)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.expireSessions(timeout)
+	}
+}
+
+func (s *Server) expireSessions(timeout time.Duration) {
+	now := time.Now()
+	cutoff := now.Add(-timeout)
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for id, sess := range s.sessions {
+		if last := sess.lastSeen.Load(); last.Before(cutoff) {
+			log.Printf("Session %08x from %s expired after %s without traffic", id, sess.remote(), now.Sub(last).Round(time.Second))
+			s.removeSessionLocked(id, "timeout")
+		} else if limit := s.cfg.MaxSessionDuration; limit > 0 && now.Sub(sess.connectedAt) >= limit {
+			log.Printf("Session %08x from %s ended after max_session_duration %s", id, sess.remote(), limit)
+			s.removeSessionLocked(id, "max_duration")
+		}
+	}
+}
+
+// sessionDue reports whether the session, last handshaken at since, should
+// be replaced before the server's max_session limit ends it. The margin
+// leaves two keepalive intervals to notice and handshake in.
+func (c *Client) sessionDue(since time.Time) bool {
+	limit := time.Duration(c.maxSession.Load())
+	if limit <= 0 || since.IsZero() {
+		return false
+	}
+	margin := min(limit/4, 2*c.keepaliveInterval())
+	return time.Since(since) >= limit-margin
+}
@@ -0,0 +1,117 @@
+package vpn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// startLeasedSession starts a server with a pool, configured further by
+// configure, and one client leasing from it. It returns the server and the
+// session once the client is connected.
+func startLeasedSession(t *testing.T, configure func(*Config)) (*Server, *serverSession) {
+	t.Helper()
+	cfg := Config{
+		Mode:              "server",
+		ServerAddress:     "127.0.0.1:0",
+		PSK:               harnessPSK,
+		AdapterName:       "expire-server",
+		AdapterIPCIDR:     "10.99.0.1/24",
+		Pool:              "10.99.0.0/24",
+		KeepaliveInterval: time.Minute,
+		TunWorkers:        1,
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	srv := newServer(cfg, tun.NewMemDevice(harnessQueueLen))
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Stop)
+	client := newClient(Config{
+		Mode:              "client",
+		ServerAddress:     srv.Addr().String(),
+		PSK:               harnessPSK,
+		AdapterName:       "expire-client",
+		AdapterIPCIDR:     AutoAddress,
+		KeepaliveInterval: time.Minute,
+		TunWorkers:        1,
+	}, tun.NewMemDevice(harnessQueueLen))
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.sessionsMu.RLock()
+		for _, sess := range srv.sessions {
+			if sess.leased {
+				srv.sessionsMu.RUnlock()
+				return srv, sess
+			}
+		}
+		srv.sessionsMu.RUnlock()
+		if time.Now().After(deadline) {
+			t.Fatal("client did not lease an address")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// active reports whether sess is still installed.
+func active(srv *Server, sess *serverSession) bool {
+	srv.sessionsMu.RLock()
+	defer srv.sessionsMu.RUnlock()
+	return srv.sessions[sess.id] == sess
+}
+
+func TestExpireSilentSession(t *testing.T) {
+	srv, sess := startLeasedSession(t, nil)
+	timeout := srv.cfg.sessionTimeout()
+	sess.lastSeen.Store(time.Now().Add(-timeout - time.Second))
+
+	srv.expireSessions(timeout)
+	if active(srv, sess) {
+		t.Fatal("silent session survived")
+	}
+	srv.sessionsMu.Lock()
+	defer srv.sessionsMu.Unlock()
+	if srv.pool.used[sess.address] {
+		t.Fatalf("lease of %s not released", sess.address)
+	}
+	if srv.routes[sess.address] != nil {
+		t.Fatalf("route to %s left behind", sess.address)
+	}
+}
+
+func TestExpireMaxSessionDuration(t *testing.T) {
+	srv, sess := startLeasedSession(t, func(cfg *Config) { cfg.MaxSessionDuration = time.Minute })
+	srv.sessionsMu.Lock()
+	sess.connectedAt = time.Now().Add(-time.Minute)
+	srv.sessionsMu.Unlock()
+	sess.lastSeen.Store(time.Now())
+
+	srv.expireSessions(srv.cfg.sessionTimeout())
+	if active(srv, sess) {
+		t.Fatal("session outlived max_session_duration")
+	}
+}
+
+func TestExpireKeepsActiveSession(t *testing.T) {
+	srv, sess := startLeasedSession(t, func(cfg *Config) { cfg.MaxSessionDuration = time.Hour })
+	timeout := srv.cfg.sessionTimeout()
+	sess.lastSeen.Store(time.Now().Add(-timeout / 2))
+
+	srv.expireSessions(timeout)
+	if !active(srv, sess) {
+		t.Fatal("session with recent traffic expired")
+	}
+	srv.sessionsMu.RLock()
+	defer srv.sessionsMu.RUnlock()
+	if !srv.pool.used[sess.address] {
+		t.Fatalf("lease of %s released", sess.address)
+	}
+}
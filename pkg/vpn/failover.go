@@ -0,0 +1,210 @@
+package vpn
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+const (
+	// DefaultFailbackInterval is how often a client on a fallback server
+	// probes server_address when failback_interval is unset.
+	DefaultFailbackInterval = 10 * time.Second
+
+	// DefaultFailbackProbes is how many probes in a row must succeed
+	// before the client moves back when failback_probes is unset.
+	DefaultFailbackProbes = 3
+)
+
+// endpoints returns server_address followed by fallback_addresses.
+func (c Config) endpoints() []string {
+	return append([]string{c.ServerAddress}, c.FallbackAddresses...)
+}
+
+func (c Config) failbackInterval() time.Duration {
+	if c.FailbackInterval > 0 {
+		return c.FailbackInterval
+	}
+	return DefaultFailbackInterval
+}
+
+func (c Config) failbackProbes() int {
+	if c.FailbackProbes > 0 {
+		return c.FailbackProbes
+	}
+	return DefaultFailbackProbes
+}
+
+// serverAddress returns the address of the server in use.
+func (c *Client) serverAddress() string {
+	if r := c.redirect.Load(); r != nil {
+		return *r
+	}
+	return c.cfg.endpoints()[c.endpoint.Load()]
+}
+
+// switchEndpoint moves the outer socket to the i'th endpoint.
+func (c *Client) switchEndpoint(i int) error {
+	c.rebindMu.Lock()
+	defer c.rebindMu.Unlock()
+	conn, err := c.dialAddress(c.cfg.endpoints()[i])
+	if err != nil {
+		return err
+	}
+	old := c.conn.Swap(&clientConn{conn})
+	c.endpoint.Store(int32(i))
+	c.redirect.Store(nil)
+	c.transport.Store(0)
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// failover handshakes with each of the other endpoints in turn, starting
+// after the one in use, and stays on the first that answers.
+func (c *Client) failover() error {
+	eps := c.cfg.endpoints()
+	cur := int(c.endpoint.Load())
+	err := fmt.Errorf("no server to fail over to")
+	for n := 1; n < len(eps) && c.ctx.Err() == nil; n++ {
+		i := (cur + n) % len(eps)
+		if err = c.switchEndpoint(i); err != nil {
+			log.Printf("Server %s: %v", eps[i], err)
+			continue
+		}
+		if err = c.handshake(); err != nil {
+			log.Printf("Server %s: %v", eps[i], err)
+			continue
+		}
+		log.Printf("Failed over to %s", eps[i])
+		return nil
+	}
+	return err
+}
+
+// loopFailback probes server_address while the client is on a fallback
+// server, or one a busy server pointed it at, and moves back once enough probes in a row succeed, so a server
+// that flaps does not drag clients back and forth. A low_power client does
+// not probe while the tunnel is idle.
+func (c *Client) loopFailback() {
+	defer c.wg.Done()
+	defer c.journal.guard()
+	ticker := time.NewTicker(c.cfg.failbackInterval())
+	defer ticker.Stop()
+	ok := 0
+	var seen uint64
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if c.endpoint.Load() == 0 && c.redirect.Load() == nil {
+			ok = 0
+			continue
+		}
+		if c.cfg.LowPower {
+			// An idle tunnel loses nothing by staying on the fallback.
+			n := c.stats.packetsIn.Load() + c.stats.packetsOut.Load()
+			if n == seen {
+				continue
+			}
+			seen = n
+		}
+		if !c.probe(c.cfg.ServerAddress) {
+			ok = 0
+			continue
+		}
+		if ok++; ok < c.cfg.failbackProbes() {
+			continue
+		}
+		ok = 0
+		log.Printf("Primary server %s is back, failing back", c.cfg.ServerAddress)
+		if err := c.switchEndpoint(0); err != nil {
+			log.Printf("Fail back to %s: %v", c.cfg.ServerAddress, err)
+			continue
+		}
+		c.markStale()
+	}
+}
+
+// probe reports whether the server at address would accept a handshake,
+// without opening a session there.
+func (c *Client) probe(address string) bool {
+	_, err := c.CheckServer(address)
+	return err == nil
+}
+
+// CheckServer asks the server at address whether it would accept a
+// handshake, without opening a session there, and returns how long it took
+// to answer. A server silently drops a Hello sealed with the wrong PSK, so
+// that looks the same as no server at all.
+func (c *Client) CheckServer(address string) (time.Duration, error) {
+	conn, err := c.dialAddress(address)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return c.checkServer(conn)
+}
+
+// checkServer asks the server at the other end of conn whether it would
+// accept a handshake. conn is closed if the server does not answer in
+// time.
+func (c *Client) checkServer(conn outerConn) (time.Duration, error) {
+	hs, err := handshakeCipher(c.cfg.PSK)
+	if err != nil {
+		return 0, err
+	}
+	nonce, err := crypto.RandomBytes(protocol.NonceSize)
+	if err != nil {
+		return 0, err
+	}
+	hello := protocol.NewHello(nonce, time.Now())
+	hello.Probe = true
+	hello.FIPS = c.cfg.FIPSMode
+	pkt, err := sealHandshake(hs, protocol.MsgHandshakeInit, 0, hello)
+	if err != nil {
+		return 0, err
+	}
+	timer := time.AfterFunc(HandshakeTimeout, func() { conn.Close() })
+	defer timer.Stop()
+	start := time.Now()
+	if _, err := conn.Write(pkt); err != nil {
+		return 0, err
+	}
+	transcript := protocol.Transcript(pkt[protocol.HeaderSize:])
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, fmt.Errorf("no answer within %v; the server is down, unreachable, or has another PSK", HandshakeTimeout)
+		}
+		h, payload, err := protocol.ParseHeader(buf[:n])
+		if err != nil || h.Type != protocol.MsgHandshakeResp {
+			continue
+		}
+		var w protocol.Welcome
+		if openHandshake(hs, payload, &w) != nil {
+			continue
+		}
+		if w.Transcript != nil && !bytes.Equal(w.Transcript, transcript) {
+			continue
+		}
+		switch {
+		case w.Error != "":
+			return 0, fmt.Errorf("refused: %s", w.Error)
+		case w.FIPS != c.cfg.FIPSMode:
+			return 0, fmt.Errorf("server fips_mode is %v, ours is %v", w.FIPS, c.cfg.FIPSMode)
+		case !timer.Stop():
+			// conn was closed as the answer came in.
+			return 0, fmt.Errorf("no answer within %v", HandshakeTimeout)
+		}
+		return time.Since(start), nil
+	}
+}
@@ -0,0 +1,74 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+
+	"github.com/gedons/go_VPN/internal/afpacket"
+)
+
+// FastPathAFPacket receives a server's UDP datagrams through an AF_PACKET
+// ring instead of its socket.
+const FastPathAFPacket = "af_packet"
+
+// validateFastPath checks fast_path, an experimental receive path for a
+// server's plain UDP sockets on Linux.
+func (cfg Config) validateFastPath() error {
+	switch {
+	case cfg.FastPath == "":
+		return nil
+	case cfg.FastPath != FastPathAFPacket:
+		return fmt.Errorf("unknown fast_path %q; use %s", cfg.FastPath, FastPathAFPacket)
+	case cfg.Mode != "server":
+		return fmt.Errorf("fast_path is a server setting")
+	case runtime.GOOS != "linux":
+		return fmt.Errorf("fast_path is only supported on Linux")
+	case cfg.Transport != "" && cfg.Transport != UDPTransport || cfg.Encapsulation != "" || len(cfg.Migrate) > 0:
+		return fmt.Errorf("fast_path needs plain UDP; unset transport, encapsulation and migrate")
+	}
+	return nil
+}
+
+// fastPathConn is a UDP socket whose datagrams are read from an AF_PACKET
+// ring. Replies still go out through the socket.
+type fastPathConn struct {
+	*net.UDPConn
+	rx *afpacket.Conn
+}
+
+func (c *fastPathConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := c.rx.ReadFrom(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, net.UDPAddrFromAddrPort(from), nil
+}
+
+func (c *fastPathConn) Close() error {
+	c.rx.Close()
+	return c.UDPConn.Close()
+}
+
+// openFastPath moves the receiving of udp onto the fast path, or leaves
+// udp as it is when the fast path cannot be set up.
+func openFastPath(udp *net.UDPConn) PacketConn {
+	addr := udp.LocalAddr().(*net.UDPAddr).AddrPort()
+	rx, err := afpacket.Listen(addr)
+	if err != nil {
+		log.Printf("Fast path on %s unavailable, using the socket: %v", addr, err)
+		return udp
+	}
+	rc, err := udp.SyscallConn()
+	if err == nil {
+		err = afpacket.DropAll(rc)
+	}
+	if err != nil {
+		rx.Close()
+		log.Printf("Fast path on %s unavailable, using the socket: %v", addr, err)
+		return udp
+	}
+	log.Printf("Fast path on %s: receiving through an AF_PACKET ring (experimental)", addr)
+	return &fastPathConn{UDPConn: udp, rx: rx}
+}
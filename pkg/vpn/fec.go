@@ -0,0 +1,71 @@
+package vpn
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/fec"
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// fecFlushDelay is the longest a packet's FEC group stays open waiting for
+// more packets before its repair frames go out.
+const fecFlushDelay = 5 * time.Millisecond
+
+// FECConfig asks for forward error correction: every Data packets are
+// followed by Parity repair packets, so up to Parity losses in a group are
+// repaired without retransmission, at Parity/Data extra bandwidth.
+type FECConfig struct {
+	Data   int `yaml:"data"`
+	Parity int `yaml:"parity"`
+}
+
+func (c *FECConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if err := c.params().Validate(); err != nil {
+		return fmt.Errorf("fec: %w", err)
+	}
+	return nil
+}
+
+func (c *FECConfig) params() fec.Params {
+	return fec.Params{Data: c.Data, Parity: c.Parity}
+}
+
+// sessionFEC is the forward error correction state of one session. The
+// encoder is shared by the sending goroutines, and the decoder by every
+// receive loop the session's packets arrive on.
+type sessionFEC struct {
+	params fec.Params
+	enc    *fec.Encoder
+	dec    *fec.Decoder
+}
+
+// newSessionFEC starts FEC for a session that negotiated p. Frames are
+// sealed under send and handed to write.
+func newSessionFEC(p protocol.FEC, send *crypto.SessionCipher, session func() uint32, write func([]byte)) (*sessionFEC, error) {
+	params := fec.Params{Data: p.Data, Parity: p.Parity}
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	emit := func(frame []byte) {
+		if pkt, err := sealPacket(send, protocol.MsgFEC, session(), frame); err == nil {
+			write(pkt)
+		}
+	}
+	return &sessionFEC{
+		params: params,
+		enc:    fec.NewEncoder(params, fecFlushDelay, emit),
+		dec:    fec.NewDecoder(params),
+	}, nil
+}
+
+// close stops the encoder's flush timer.
+func (f *sessionFEC) close() {
+	if f != nil {
+		f.enc.Close()
+	}
+}
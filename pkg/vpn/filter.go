@@ -0,0 +1,130 @@
+package vpn
+
+import "net/netip"
+
+// Verdict is a PacketFilter's decision on a packet.
+type Verdict int
+
+const (
+	// Accept passes the packet on to the next filter and then the tunnel.
+	Accept Verdict = iota
+	// Drop discards the packet silently.
+	Drop
+	// Reject discards the packet and tells the sender with an ICMP
+	// "administratively prohibited" error, so its connection fails at once.
+	Reject
+)
+
+// FilterSource identifies the client a filtered packet came from.
+type FilterSource struct {
+	Session uint32
+	Name    string     // provisioned client name, if any
+	Address netip.Addr // tunnel address, if known
+
+	// Address6 and Prefix are the client's IPv6 address and delegated
+	// prefix, if it has them.
+	Address6 netip.Addr
+	Prefix   netip.Prefix
+
+	// AllowedIPs are the prefixes behind a provisioned client that it may
+	// also send from.
+	AllowedIPs []netip.Prefix
+}
+
+// PacketFilter inspects each decrypted packet a client sends before it
+// reaches the server's tunnel, as an inline intrusion detection hook.
+// Filters run on the data path in the order they were added; the first
+// verdict other than Accept stops the packet. Filter must be safe for
+// concurrent use and must not keep pkt.
+type PacketFilter interface {
+	Filter(src FilterSource, pkt []byte) Verdict
+}
+
+// PacketFilterFunc adapts a function to PacketFilter.
+type PacketFilterFunc func(src FilterSource, pkt []byte) Verdict
+
+func (f PacketFilterFunc) Filter(src FilterSource, pkt []byte) Verdict {
+	return f(src, pkt)
+}
+
+// AddPacketFilter appends f to the server's filters. It may be called while
+// the server runs.
+func (s *Server) AddPacketFilter(f PacketFilter) {
+	for {
+		old := s.filters.Load()
+		var next []PacketFilter
+		if old != nil {
+			next = append(next, *old...)
+		}
+		next = append(next, f)
+		if s.filters.CompareAndSwap(old, &next) {
+			return
+		}
+	}
+}
+
+// prependPacketFilter puts f ahead of the filters added so far.
+func (s *Server) prependPacketFilter(f PacketFilter) {
+	for {
+		old := s.filters.Load()
+		next := []PacketFilter{f}
+		if old != nil {
+			next = append(next, *old...)
+		}
+		if s.filters.CompareAndSwap(old, &next) {
+			return
+		}
+	}
+}
+
+// filter runs pkt from sess through the filters.
+func (s *Server) filter(sess *serverSession, pkt []byte) Verdict {
+	filters := s.filters.Load()
+	if filters == nil {
+		return Accept
+	}
+	src := FilterSource{
+		Session:    sess.id,
+		Name:       sess.name,
+		Address:    sess.address,
+		Address6:   sess.address6,
+		Prefix:     sess.delegated,
+		AllowedIPs: sess.allowed,
+	}
+	for _, f := range *filters {
+		if v := f.Filter(src, pkt); v != Accept {
+			return v
+		}
+	}
+	return Accept
+}
+
+// antiSpoof drops packets whose source is not the sending client's tunnel
+// address of that family, its delegated prefix, or one of its allowed_ips.
+// Clients without a known address of the family, with neither a lease nor
+// a provisioned one, are not checked.
+var antiSpoof = PacketFilterFunc(func(src FilterSource, pkt []byte) Verdict {
+	a, ok := packetSrc(pkt)
+	own := src.Address
+	if ok && a.Is6() {
+		own = src.Address6
+	}
+	if !own.IsValid() {
+		return Accept
+	}
+	if !ok || a != own && !src.Prefix.Contains(a) && !containsAddr(src.AllowedIPs, a) {
+		return Drop
+	}
+	return Accept
+})
+
+// packetSrc returns the source of an IPv4 or IPv6 packet.
+func packetSrc(pkt []byte) (netip.Addr, bool) {
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		return netip.AddrFrom4([4]byte(pkt[12:16])), true
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		return netip.AddrFrom16([16]byte(pkt[8:24])), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,51 @@
+package vpn
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+)
+
+const (
+	// minFIPSPSK is the shortest psk fips_mode accepts, so the HKDF input
+	// carries as much strength as the AES-256 keys drawn from it.
+	minFIPSPSK = 32
+
+	// minFIPSSecret is the shortest HMAC key fips_mode accepts: 112 bits,
+	// the floor set by SP 800-131A.
+	minFIPSSecret = 14
+)
+
+// validateFIPS refuses settings that fips_mode cannot vouch for.
+func (c Config) validateFIPS() error {
+	if !c.FIPSMode {
+		return nil
+	}
+	for _, psk := range c.AcceptedPSKs() {
+		if len(psk) < minFIPSPSK {
+			return fmt.Errorf("fips_mode: psk and previous_psks must be at least %d bytes", minFIPSPSK)
+		}
+	}
+	if c.Cluster.Enabled() && len(c.Cluster.Secret) < minFIPSSecret {
+		return fmt.Errorf("fips_mode: cluster.secret must be at least %d bytes", minFIPSSecret)
+	}
+	for _, w := range c.Webhooks {
+		if len(w.Secret) < minFIPSSecret {
+			return fmt.Errorf("fips_mode: webhook %s needs a secret of at least %d bytes", w.URL, minFIPSSecret)
+		}
+		if u, _ := url.Parse(w.URL); u.Scheme != "https" {
+			return fmt.Errorf("fips_mode: webhook %s must use https", w.URL)
+		}
+	}
+	return nil
+}
+
+// checkFIPS fails when fips_mode is set but Go's FIPS 140-3 module is not
+// enabled, since only then are the primitives the validated ones.
+func (c Config) checkFIPS() error {
+	if c.FIPSMode && !crypto.FIPSEnabled() {
+		return fmt.Errorf("fips_mode needs Go's FIPS 140-3 module: run with GODEBUG=fips140=on")
+	}
+	return nil
+}
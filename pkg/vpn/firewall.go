@@ -0,0 +1,107 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"slices"
+	"strconv"
+
+	"github.com/gedons/go_VPN/internal/ssdp"
+)
+
+// FirewallGroup is the Windows Firewall group of the rules GoVPN adds, so
+// they can be told apart from the user's own and removed together.
+const FirewallGroup = "GoVPN"
+
+// firewallRulePrefix starts the name of every firewall rule GoVPN adds.
+const firewallRulePrefix = "GoVPN UDP "
+
+// firewallRuleName is the display name of the rule for UDP port.
+func firewallRuleName(port int) string {
+	return fmt.Sprintf("%s%d", firewallRulePrefix, port)
+}
+
+// managesHost reports whether a server opens its ports and turns on
+// forwarding itself: on Windows, and on Linux unless its adapter is in a
+// namespace of its own.
+func (cfg Config) managesHost() bool {
+	return runtime.GOOS == "windows" || runtime.GOOS == "linux" && cfg.Netns == ""
+}
+
+// openFirewall lets the server's ports through the host's firewall. Each
+// rule is journaled and removed again on Stop.
+func (s *Server) openFirewall() {
+	addresses := s.cfg.listenAddresses()
+	if s.cfg.LegacyListen != nil {
+		addresses = append(slices.Clip(addresses), s.cfg.LegacyListen.Address)
+	}
+	var ports []int
+	for _, address := range addresses {
+		_, portStr, err := net.SplitHostPort(address)
+		port, perr := strconv.Atoi(portStr)
+		if err != nil || perr != nil {
+			log.Printf("Failed to extract port from listen address %q", address)
+			continue
+		}
+		ports = append(ports, port)
+	}
+	if s.cfg.Discovery {
+		ports = append(ports, ssdp.Port)
+	}
+	for _, port := range ports {
+		if slices.Contains(s.firewallRules, firewallRuleName(port)) {
+			continue
+		}
+		name, err := AllowFirewallPort(port)
+		if err != nil {
+			log.Printf("Server setup warning: %v", err)
+			continue
+		}
+		s.firewallRules = append(s.firewallRules, name)
+		s.journal.add(journalEntry{Kind: journalFirewall, Name: name})
+	}
+}
+
+// closeFirewall removes the rules openFirewall added.
+func (s *Server) closeFirewall() {
+	for _, name := range s.firewallRules {
+		if err := RemoveFirewallRule(name); err != nil {
+			log.Printf("Firewall cleanup warning: %v", err)
+		}
+	}
+	s.firewallRules = nil
+}
+
+// startForwarding turns on IP forwarding, once the adapter is up so it is
+// turned on there too. Unless persist_forwarding is set, the changes are
+// journaled and undone on Stop.
+func (s *Server) startForwarding() {
+	changes, err := enableForwarding()
+	if err != nil {
+		log.Printf("Server setup warning: %v", err)
+	}
+	if len(changes) == 0 {
+		return
+	}
+	if s.cfg.PersistForwarding {
+		log.Printf("IP forwarding enabled; persist_forwarding leaves it on")
+		return
+	}
+	log.Printf("IP forwarding enabled until the server stops")
+	s.forwarding = changes
+	for _, e := range changes {
+		s.journal.add(e)
+	}
+}
+
+// stopForwarding restores IP forwarding to how startForwarding found it.
+func (s *Server) stopForwarding() {
+	for _, e := range s.forwarding {
+		if err := disableForwarding(e); err != nil {
+			log.Printf("Forwarding cleanup warning: %v", err)
+		}
+	}
+	s.forwarding = nil
+}
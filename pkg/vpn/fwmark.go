@@ -0,0 +1,33 @@
+package vpn
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// validateFwMark checks fwmark, which marks the tunnel's UDP sockets on
+// Linux.
+func (cfg Config) validateFwMark() error {
+	switch {
+	case cfg.FwMark == 0:
+		return nil
+	case runtime.GOOS != "linux":
+		return fmt.Errorf("fwmark is only supported on Linux")
+	case cfg.Transport != "" && cfg.Transport != UDPTransport || len(cfg.Migrate) > 0:
+		return fmt.Errorf("fwmark marks UDP sockets; unset transport and migrate")
+	}
+	return nil
+}
+
+// markConn sets mark on conn's socket.
+func markConn(conn syscall.Conn, mark uint32) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err := markSocket(rc, mark); err != nil {
+		return fmt.Errorf("fwmark: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package vpn
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// markSocket sets SO_MARK on the socket behind rc, so ip rules matching
+// fwmark route what it sends. It needs CAP_NET_ADMIN.
+func markSocket(rc syscall.RawConn, mark uint32) error {
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+	}); err != nil {
+		return err
+	}
+	return serr
+}
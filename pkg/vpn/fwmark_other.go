@@ -0,0 +1,13 @@
+//go:build !linux
+
+package vpn
+
+import (
+	"errors"
+	"syscall"
+)
+
+// markSocket is only available on Linux.
+func markSocket(syscall.RawConn, uint32) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,186 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/gedons/go_VPN/internal/mmdb"
+)
+
+// GeoIPConfig limits, on a server, where clients may connect from, by the
+// country or network (ASN) of their source address in MaxMind databases.
+type GeoIPConfig struct {
+	// Databases are MaxMind DB files, such as GeoLite2-Country.mmdb and
+	// GeoLite2-ASN.mmdb. City databases work for countries too.
+	Databases []string `yaml:"databases"`
+
+	AllowCountries []string `yaml:"allow_countries"` // ISO codes such as DE
+	DenyCountries  []string `yaml:"deny_countries"`
+	AllowASNs      []uint32 `yaml:"allow_asns"`
+	DenyASNs       []uint32 `yaml:"deny_asns"`
+
+	// AllowUnknown lets addresses the databases have no record of, such
+	// as private ones, past the allow lists.
+	AllowUnknown bool `yaml:"allow_unknown"`
+}
+
+// Enabled reports whether lookups are configured.
+func (c GeoIPConfig) Enabled() bool {
+	return len(c.Databases) > 0
+}
+
+func (c GeoIPConfig) hasRules() bool {
+	return len(c.AllowCountries)+len(c.DenyCountries)+len(c.AllowASNs)+len(c.DenyASNs) > 0
+}
+
+func (c GeoIPConfig) validate(mode string) error {
+	if !c.Enabled() {
+		if c.hasRules() || c.AllowUnknown {
+			return fmt.Errorf("geoip: set databases")
+		}
+		return nil
+	}
+	if mode != "server" {
+		return fmt.Errorf("geoip is a server setting")
+	}
+	for _, cc := range append(c.AllowCountries, c.DenyCountries...) {
+		if len(cc) != 2 {
+			return fmt.Errorf("geoip: %q is not a two-letter country code", cc)
+		}
+	}
+	return nil
+}
+
+// geoInfo is where an address is, as far as the databases know.
+type geoInfo struct {
+	Country string // ISO code
+	ASN     uint32
+	Org     string // owner of the ASN
+}
+
+func (g geoInfo) known() bool {
+	return g.Country != "" || g.ASN != 0
+}
+
+func (g geoInfo) String() string {
+	var parts []string
+	if g.Country != "" {
+		parts = append(parts, g.Country)
+	}
+	if g.ASN != 0 {
+		as := fmt.Sprintf("AS%d", g.ASN)
+		if g.Org != "" {
+			as += " (" + g.Org + ")"
+		}
+		parts = append(parts, as)
+	}
+	if len(parts) == 0 {
+		return "an unknown location"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// geoIP looks client addresses up and applies the allow and deny lists.
+type geoIP struct {
+	cfg        GeoIPConfig
+	readers    []*mmdb.Reader
+	allowCC    map[string]bool
+	denyCC     map[string]bool
+	allowASN   map[uint32]bool
+	denyASN    map[uint32]bool
+	allowLists bool
+}
+
+// openGeoIP loads the databases cfg names.
+func openGeoIP(cfg GeoIPConfig) (*geoIP, error) {
+	g := &geoIP{
+		cfg:        cfg,
+		allowCC:    countrySet(cfg.AllowCountries),
+		denyCC:     countrySet(cfg.DenyCountries),
+		allowASN:   asnSet(cfg.AllowASNs),
+		denyASN:    asnSet(cfg.DenyASNs),
+		allowLists: len(cfg.AllowCountries)+len(cfg.AllowASNs) > 0,
+	}
+	for _, path := range cfg.Databases {
+		r, err := mmdb.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("geoip: %w", err)
+		}
+		log.Printf("GeoIP database %s: %s, built %s", path, r.Metadata.DatabaseType, r.Metadata.Built.Format("2006-01-02"))
+		g.readers = append(g.readers, r)
+	}
+	return g, nil
+}
+
+func countrySet(codes []string) map[string]bool {
+	m := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		m[strings.ToUpper(c)] = true
+	}
+	return m
+}
+
+func asnSet(asns []uint32) map[uint32]bool {
+	m := make(map[uint32]bool, len(asns))
+	for _, a := range asns {
+		m[a] = true
+	}
+	return m
+}
+
+// lookup finds addr in every database; later ones fill in what earlier
+// ones lacked. g may be nil.
+func (g *geoIP) lookup(addr net.Addr) geoInfo {
+	var info geoInfo
+	if g == nil {
+		return info
+	}
+	ip, err := netip.ParseAddr(hostOf(addr))
+	if err != nil {
+		return info
+	}
+	for _, r := range g.readers {
+		v, err := r.Lookup(ip)
+		if err != nil {
+			log.Printf("GeoIP lookup %s: %v", ip, err)
+			continue
+		}
+		rec, _ := v.(map[string]any)
+		if info.Country == "" {
+			info.Country = isoCode(rec, "country")
+		}
+		if info.Country == "" {
+			info.Country = isoCode(rec, "registered_country")
+		}
+		if n, ok := rec["autonomous_system_number"].(uint64); ok && info.ASN == 0 {
+			info.ASN = uint32(n)
+			info.Org, _ = rec["autonomous_system_organization"].(string)
+		}
+	}
+	return info
+}
+
+func isoCode(rec map[string]any, key string) string {
+	c, _ := rec[key].(map[string]any)
+	code, _ := c["iso_code"].(string)
+	return code
+}
+
+// check returns why a client at info may not connect, or nil. g may be
+// nil.
+func (g *geoIP) check(info geoInfo) error {
+	switch {
+	case g == nil:
+		return nil
+	case g.denyCC[info.Country] || g.denyASN[info.ASN]:
+		return fmt.Errorf("connections from %s are not allowed", info)
+	case !g.allowLists || g.allowCC[info.Country] || g.allowASN[info.ASN]:
+		return nil
+	case !info.known() && g.cfg.AllowUnknown:
+		return nil
+	}
+	return fmt.Errorf("connections from %s are not allowed", info)
+}
@@ -0,0 +1,259 @@
+package vpn
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// handoffSeqGap spaces out the send counters of nodes that adopt the same
+// session. A node resumes sending at the last replicated counter plus its
+// node ID times this gap, so neither the previous owner, which may still be
+// alive, nor another adopter can reuse a nonce.
+const handoffSeqGap = 1 << 40
+
+// handoffReplaySlack is how many packets past the owner's recent rate an
+// adopter skips, for a client that sped up since the owner's last push.
+const handoffReplaySlack = 64
+
+// sessionHandoff is everything a cluster peer needs to continue a session
+// without a new handshake. Keys are from the owning server's point of view.
+type sessionHandoff struct {
+	ID          uint32        `json:"id"`
+	Version     uint16        `json:"version"`
+	Endpoint    string        `json:"endpoint"`
+	ConnectedAt time.Time     `json:"connected_at"`
+	Adopted     time.Time     `json:"adopted"`
+	SendKey     []byte        `json:"send_key"`
+	RecvKey     []byte        `json:"recv_key"`
+	Sent        uint64        `json:"sent"`
+	Received    uint64        `json:"received"`
+	FEC         *protocol.FEC `json:"fec,omitempty"`
+	Name        string        `json:"name,omitempty"`
+	KeyID       string        `json:"key_id,omitempty"`
+	Address     string        `json:"address,omitempty"`
+	Leased      bool          `json:"leased,omitempty"`
+	Address6    string        `json:"address6,omitempty"`
+	Prefix      string        `json:"prefix,omitempty"`
+	Label       string        `json:"label,omitempty"`
+	Software    string        `json:"software,omitempty"`
+	User        string        `json:"user,omitempty"`
+	// Attributes are what the AuthProvider said of User.
+	Attributes map[string][]string `json:"attributes,omitempty"`
+	Profiles   []string            `json:"profiles,omitempty"`
+
+	// recent is how many packets the owner accepted since its previous
+	// push, counted by the node that received it.
+	recent uint64
+}
+
+// handoffLocked exports sess. Callers must hold sessionsMu.
+func (sess *serverSession) handoffLocked() sessionHandoff {
+	_, received := sess.keys.recv.Counters()
+	sent, _ := sess.keys.send.Counters()
+	h := sessionHandoff{
+		ID:          sess.id,
+		Version:     sess.version,
+		Endpoint:    sess.remote().String(),
+		ConnectedAt: sess.connectedAt,
+		Adopted:     sess.adopted,
+		SendKey:     sess.keys.sendKey,
+		RecvKey:     sess.keys.recvKey,
+		Sent:        sent,
+		Received:    received,
+		Name:        sess.name,
+		KeyID:       sess.keyID,
+		Address:     addrString(sess.address),
+		Leased:      sess.leased,
+		Address6:    addrString(sess.address6),
+		Prefix:      prefixString(sess.delegated),
+		Label:       sess.label,
+		Software:    sess.software,
+		User:        sess.user,
+		Attributes:  sess.attrs,
+		Profiles:    sess.profiles.profileNames(),
+	}
+	if sess.fec != nil {
+		h.FEC = &protocol.FEC{Data: sess.fec.params.Data, Parity: sess.fec.params.Parity}
+	}
+	return h
+}
+
+// adoptSession takes over session id from a cluster peer when a client that
+// followed DNS failover sends payload to this node. The session is only
+// installed once payload authenticates under its keys, so a forged packet
+// cannot steal a session from the node that holds it. It gets the tunnel
+// addresses, routes and client settings the owner gave it, or is refused
+// when they are no longer available here.
+func (s *Server) adoptSession(ln *listener, id uint32, addr net.Addr, payload []byte) *serverSession {
+	h, ok := s.cluster.lookup(id)
+	if !ok {
+		return nil
+	}
+	keys, err := newSessionKeys(h.SendKey, h.RecvKey)
+	if err != nil || !keys.recv.Authentic(payload) {
+		return nil
+	}
+	keys.send.Resume(h.Sent+uint64(s.cfg.Cluster.NodeID)*handoffSeqGap, 0)
+	// The owner may have delivered packets after its last push. Skip
+	// twice as many as it took between its last two, so they cannot be
+	// replayed here; the client's own packets below that are lost.
+	keys.recv.ResumeAbove(0, h.Received+2*h.recent+handoffReplaySlack)
+	geo := s.geo.lookup(addr)
+	if err := s.geo.check(geo); err != nil {
+		return nil
+	}
+
+	now := time.Now()
+	sess := &serverSession{
+		id:          id,
+		name:        h.Name,
+		keyID:       h.KeyID,
+		label:       h.Label,
+		software:    h.Software,
+		user:        h.User,
+		attrs:       h.Attributes,
+		profiles:    s.profilesFor(h.Profiles),
+		geo:         geo,
+		version:     h.Version,
+		keys:        keys,
+		connectedAt: h.ConnectedAt,
+		adopted:     now,
+	}
+	sess.path.Store(&sessionPath{ln: ln, addr: addr})
+	sess.lastSeen.Store(now)
+
+	s.psksMu.RLock()
+	defer s.psksMu.RUnlock()
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if cur := s.sessions[id]; cur != nil {
+		return cur
+	}
+	if err := s.admitsHandoffLocked(h); err != nil {
+		errorLog.Printf("Adopt session %08x from %s: %v", id, addr, err)
+		return nil
+	}
+	if err := s.installSessionLocked(sess, h); err != nil {
+		errorLog.Printf("Adopt session %08x from %s: %v", id, addr, err)
+		return nil
+	}
+	log.Printf("Client %s resumed session %08x handed over from another node", addr, id)
+	return sess
+}
+
+// pskKeyID names psk in saved and handed over sessions without giving it
+// away.
+func pskKeyID(psk string) string {
+	id, err := crypto.DeriveKey([]byte(psk), nil, "govpn key id")
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id[:8])
+}
+
+// admitsHandoffLocked reports why a session handed over or saved as h may
+// not continue here: its client was revoked or is no longer configured, or
+// the key it handshook under is no longer accepted. Callers hold psksMu and
+// sessionsMu.
+func (s *Server) admitsHandoffLocked(h sessionHandoff) error {
+	if s.revoked[h.Name] {
+		return fmt.Errorf("client %q is revoked", h.Name)
+	}
+	client := h.Name
+	if client == p2pPeer {
+		client = ""
+	}
+	for _, keys := range [][]pskEntry{s.psks, s.clientKeys} {
+		for _, key := range keys {
+			if key.client == client && key.id != "" && key.id == h.KeyID {
+				return nil
+			}
+		}
+	}
+	if client != "" {
+		return fmt.Errorf("client %q is no longer configured with the key it used", client)
+	}
+	return fmt.Errorf("its psk is no longer accepted")
+}
+
+// installSessionLocked gives sess, rebuilt from h, the tunnel addresses h
+// holds, leasing them from the pools again, binds its routes, allowed_ips
+// and QoS, and registers it. Callers must hold sessionsMu for writing.
+func (s *Server) installSessionLocked(sess *serverSession, h sessionHandoff) error {
+	var err error
+	if h.Address != "" {
+		if sess.address, err = netip.ParseAddr(h.Address); err != nil {
+			return fmt.Errorf("address: %w", err)
+		}
+	}
+	if h.Leased {
+		if s.pool == nil {
+			return fmt.Errorf("leased %s but no pool is configured", sess.address)
+		}
+		if a, ok := s.pool.leaseLocked(sess.address); !ok || a != sess.address {
+			if ok {
+				s.pool.releaseLocked(a)
+			}
+			return fmt.Errorf("address %s is no longer available", sess.address)
+		}
+		sess.leased = true
+	}
+	if sess.address.IsValid() && s.routes[sess.address] != nil {
+		if sess.leased {
+			s.pool.releaseLocked(sess.address)
+		}
+		return fmt.Errorf("address %s is in use", sess.address)
+	}
+	// Losing an IPv6 lease leaves the session working over IPv4.
+	if h.Address6 != "" {
+		a, err := netip.ParseAddr(h.Address6)
+		if err == nil && s.pool6 != nil && s.pool6.usable(a) && !s.pool6.used[a] {
+			s.pool6.used[a] = true
+			sess.address6 = a
+			s.routes[a] = sess
+		} else {
+			log.Printf("Session %08x: IPv6 address %s is no longer available", sess.id, h.Address6)
+		}
+	}
+	if h.Prefix != "" {
+		d, err := netip.ParsePrefix(h.Prefix)
+		if err == nil && s.delegates != nil && s.delegates.prefix.Contains(d.Addr()) && d.Bits() == s.delegates.bits && !s.delegates.used[d] {
+			s.delegates.used[d] = true
+			sess.delegated = d
+			s.delegated[d] = sess
+		} else {
+			log.Printf("Session %08x: prefix %s is no longer available", sess.id, h.Prefix)
+		}
+	}
+	s.startReorder(sess)
+	if h.FEC != nil {
+		sess.fec, _ = s.newSessionFEC(sess, *h.FEC)
+	}
+	s.sessions[sess.id] = sess
+	if sess.address.IsValid() {
+		s.routes[sess.address] = sess
+	}
+	s.bindAllowedLocked(sess)
+	s.bindQoSLocked(sess)
+	return nil
+}
+
+// dropMovedSessions forgets local sessions that a peer adopted after this
+// node did, so traffic for them stops going out from two places.
+func (s *Server) dropMovedSessions(remote []sessionHandoff) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for _, h := range remote {
+		if sess := s.sessions[h.ID]; sess != nil && h.Adopted.After(sess.adopted) {
+			s.removeSessionLocked(h.ID, "moved")
+			log.Printf("Session %08x moved to another node", h.ID)
+		}
+	}
+}
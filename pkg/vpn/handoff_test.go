@@ -0,0 +1,149 @@
+package vpn
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// relay forwards a client's datagrams to whichever server target names, so
+// a test can fail the client over without it noticing.
+type relay struct {
+	conn   *net.UDPConn
+	target atomic.Pointer[net.UDPConn]
+	client atomic.Pointer[net.UDPAddr]
+}
+
+func newRelay(t *testing.T) *relay {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &relay{conn: conn}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			r.client.Store(from)
+			if up := r.target.Load(); up != nil {
+				up.Write(buf[:n])
+			}
+		}
+	}()
+	return r
+}
+
+// point sends the client's datagrams to addr from now on.
+func (r *relay) point(t *testing.T, addr net.Addr) {
+	up, err := net.DialUDP("udp", nil, addr.(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { up.Close() })
+	r.target.Store(up)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := up.Read(buf)
+			if err != nil {
+				return
+			}
+			if c := r.client.Load(); c != nil {
+				r.conn.WriteToUDP(buf[:n], c)
+			}
+		}
+	}()
+}
+
+func freeTCPAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// TestHandoffRoutes fails a client over from one cluster node to another
+// and checks the node that adopts its session routes the client's tunnel
+// address to it.
+func TestHandoffRoutes(t *testing.T) {
+	listen := []string{freeTCPAddr(t), freeTCPAddr(t)}
+	var servers [2]*Server
+	var devs [2]*tun.MemDevice
+	for i := range servers {
+		cfg := Config{
+			Mode:              "server",
+			ServerAddress:     "127.0.0.1:0",
+			PSK:               harnessPSK,
+			AdapterName:       "handoff-server",
+			AdapterIPCIDR:     "10.99.0.1/24",
+			KeepaliveInterval: 100 * time.Millisecond,
+			TunWorkers:        1,
+			Cluster: ClusterConfig{
+				NodeID:       uint8(i + 1),
+				Listen:       listen[i],
+				Peers:        []string{listen[1-i]},
+				Secret:       "handoff-test-secret",
+				SyncInterval: 50 * time.Millisecond,
+			},
+		}
+		devs[i] = tun.NewMemDevice(harnessQueueLen)
+		servers[i] = newServer(cfg, devs[i])
+		if err := servers[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer servers[i].Stop()
+	}
+
+	r := newRelay(t)
+	r.point(t, servers[0].Addr())
+	cfg := Config{
+		Mode:              "client",
+		ServerAddress:     r.conn.LocalAddr().String(),
+		PSK:               harnessPSK,
+		AdapterName:       "handoff-client",
+		AdapterIPCIDR:     harnessClientIP(0).String() + "/24",
+		KeepaliveInterval: 100 * time.Millisecond,
+		TunWorkers:        1,
+	}
+	dev := tun.NewMemDevice(harnessQueueLen)
+	client := newClient(cfg, dev)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	// Let node 2 learn the session, then fail over to it.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if client.Status().Connected && len(servers[1].cluster.status().Clients) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("node 2 never learned the session")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	r.point(t, servers[1].Addr())
+	servers[0].Stop()
+
+	for seq := uint32(0); ; seq++ {
+		if time.Now().After(deadline) {
+			t.Fatal("node 2 did not route to the adopted session")
+		}
+		devs[1].Inject(SyntheticPacket(harnessServerIP(), harnessClientIP(0), 0, seq))
+		select {
+		case <-dev.Delivered():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
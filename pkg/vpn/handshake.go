@@ -0,0 +1,105 @@
+package vpn
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+const (
+	HandshakeTimeout  = 3 * time.Second
+	HandshakeRetries  = 3
+	KeepaliveInterval = 10 * time.Second
+
+	// OpenKeepaliveInterval is used instead of KeepaliveInterval when STUN
+	// finds no NAT, since there is no mapping to keep alive.
+	OpenKeepaliveInterval = 25 * time.Second
+)
+
+// sessionKeys holds the per-direction ciphers of an established session and
+// the raw keys behind them, which a cluster needs to hand the session over.
+type sessionKeys struct {
+	send    *crypto.SessionCipher
+	recv    *crypto.SessionCipher
+	sendKey []byte
+	recvKey []byte
+}
+
+// handshakeCipher returns the AEAD that seals handshake messages under psk.
+func handshakeCipher(psk string) (*crypto.Cipher, error) {
+	key, err := crypto.DeriveKey([]byte(psk), nil, protocol.HandshakeKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.NewCipher(key)
+}
+
+// deriveSessionKeys derives fresh directional keys from the PSK and both
+// handshake nonces, so every session is keyed independently.
+func deriveSessionKeys(psk string, clientNonce, serverNonce []byte, isServer bool) (sessionKeys, error) {
+	salt := append(append([]byte{}, clientNonce...), serverNonce...)
+	c2s, err := crypto.DeriveKey([]byte(psk), salt, protocol.ClientToServerKeyInfo)
+	if err != nil {
+		return sessionKeys{}, err
+	}
+	s2c, err := crypto.DeriveKey([]byte(psk), salt, protocol.ServerToClientKeyInfo)
+	if err != nil {
+		return sessionKeys{}, err
+	}
+	if isServer {
+		return newSessionKeys(s2c, c2s)
+	}
+	return newSessionKeys(c2s, s2c)
+}
+
+// newSessionKeys builds the ciphers for a pair of directional keys.
+func newSessionKeys(sendKey, recvKey []byte) (sessionKeys, error) {
+	send, err := crypto.NewSessionCipher(sendKey)
+	if err != nil {
+		return sessionKeys{}, err
+	}
+	recv, err := crypto.NewSessionCipher(recvKey)
+	if err != nil {
+		return sessionKeys{}, err
+	}
+	return sessionKeys{send: send, recv: recv, sendKey: sendKey, recvKey: recvKey}, nil
+}
+
+// sealHandshake encodes msg and seals it behind a handshake header.
+func sealHandshake(c *crypto.Cipher, t protocol.MessageType, session uint32, msg any) ([]byte, error) {
+	body, err := protocol.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := c.Encrypt(body)
+	if err != nil {
+		return nil, err
+	}
+	hdr := protocol.Header{Type: t, Session: session}
+	return append(hdr.Append(nil), enc...), nil
+}
+
+// openHandshake authenticates and decodes a handshake payload into msg.
+func openHandshake(c *crypto.Cipher, payload []byte, msg any) error {
+	body, err := c.Decrypt(payload)
+	if err != nil {
+		return fmt.Errorf("handshake authentication failed: %w", err)
+	}
+	return protocol.Unmarshal(body, msg)
+}
+
+// sealPacket encrypts a data or keepalive payload for the given session.
+func sealPacket(c *crypto.SessionCipher, t protocol.MessageType, session uint32, payload []byte) ([]byte, error) {
+	return appendPacket(nil, c, t, session, payload)
+}
+
+// appendPacket is sealPacket writing into dst, so hot loops can reuse one
+// buffer per goroutine.
+func appendPacket(dst []byte, c *crypto.SessionCipher, t protocol.MessageType, session uint32, payload []byte) ([]byte, error) {
+	hdr := protocol.Header{Type: t, Session: session}
+	dst = slices.Grow(dst, protocol.HeaderSize+c.Overhead()+len(payload))
+	return c.EncryptAppend(hdr.Append(dst), payload)
+}
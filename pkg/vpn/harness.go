@@ -0,0 +1,350 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+const (
+	harnessPSK      = "govpn-harness-preshared-key"
+	harnessQueueLen = 4096
+	harnessWindow   = 16
+)
+
+// Harness runs a server and N clients over 127.0.0.1 with in-memory TUN
+// devices, so the data path can be exercised end to end without adapters or
+// privileges. Synthetic IPv4 packets are injected on one side and checked for
+// delivery and ordering on the other.
+type Harness struct {
+	Server  *Server
+	Clients []*Client
+
+	serverCfg  Config
+	serverDev  *tun.MemDevice
+	clientDevs []*tun.MemDevice
+}
+
+// NewHarness starts a server and n connected clients.
+func NewHarness(n int) (*Harness, error) {
+	return NewImpairedHarness(n, ImpairmentConfig{})
+}
+
+// NewImpairedHarness is NewHarness with imp applied to the server's and
+// every client's outer socket. Loss and reordering will make CheckDelivery
+// fail by design; CheckReconnect and duplicate rejection remain meaningful.
+func NewImpairedHarness(n int, imp ImpairmentConfig) (*Harness, error) {
+	return newHarness(n, imp, nil)
+}
+
+// newHarness starts a server and n clients, all with imp applied. When
+// configure is set it adjusts the server's config, which the clients'
+// copy, fast_path aside.
+func newHarness(n int, imp ImpairmentConfig, configure func(*Config)) (*Harness, error) {
+	h := &Harness{
+		serverCfg: Config{
+			Mode:              "server",
+			ServerAddress:     "127.0.0.1:0",
+			PSK:               harnessPSK,
+			AdapterName:       "harness-server",
+			AdapterIPCIDR:     "10.99.0.1/24",
+			KeepaliveInterval: 100 * time.Millisecond,
+			TunWorkers:        1,
+			DebugImpairment:   imp,
+		},
+	}
+	if configure != nil {
+		configure(&h.serverCfg)
+	}
+	if err := h.startServer(); err != nil {
+		return nil, err
+	}
+	// Restarts must come back on the same port.
+	h.serverCfg.ServerAddress = h.Server.Addr().String()
+
+	for i := 0; i < n; i++ {
+		cfg := h.serverCfg
+		cfg.Mode = "client"
+		cfg.FastPath = ""
+		cfg.AdapterName = fmt.Sprintf("harness-client-%d", i)
+		cfg.AdapterIPCIDR = harnessClientIP(i).String() + "/24"
+		dev := tun.NewMemDevice(harnessQueueLen)
+		client := newClient(cfg, dev)
+		if err := client.Start(); err != nil {
+			h.Close()
+			return nil, fmt.Errorf("client %d: %w", i, err)
+		}
+		h.Clients = append(h.Clients, client)
+		h.clientDevs = append(h.clientDevs, dev)
+	}
+	return h, nil
+}
+
+func (h *Harness) startServer() error {
+	h.serverDev = tun.NewMemDevice(harnessQueueLen)
+	h.Server = newServer(h.serverCfg, h.serverDev)
+	if err := h.Server.Start(); err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+	return nil
+}
+
+// Close stops every client and the server.
+func (h *Harness) Close() {
+	for _, c := range h.Clients {
+		c.Stop()
+	}
+	if h.Server != nil {
+		h.Server.Stop()
+	}
+}
+
+// RestartServer stops the server and starts a fresh one on the same address,
+// discarding all sessions.
+func (h *Harness) RestartServer() error {
+	h.Server.Stop()
+	return h.startServer()
+}
+
+// InjectFromClient queues pkt on client i's TUN device.
+func (h *Harness) InjectFromClient(i int, pkt []byte) error {
+	return h.clientDevs[i].Inject(pkt)
+}
+
+// InjectFromServer queues pkt on the server's TUN device.
+func (h *Harness) InjectFromServer(pkt []byte) error {
+	return h.serverDev.Inject(pkt)
+}
+
+// ServerDelivered returns packets the server wrote to its TUN device.
+func (h *Harness) ServerDelivered() <-chan []byte {
+	return h.serverDev.Delivered()
+}
+
+// ClientDelivered returns packets client i wrote to its TUN device.
+func (h *Harness) ClientDelivered(i int) <-chan []byte {
+	return h.clientDevs[i].Delivered()
+}
+
+// Run performs the standard checks: delivery and ordering in both
+// directions, then a server restart followed by the same checks.
+func (h *Harness) Run(perClient int, timeout time.Duration) error {
+	if err := h.CheckDelivery(perClient, timeout); err != nil {
+		return fmt.Errorf("before restart: %w", err)
+	}
+	if err := h.CheckReconnect(timeout); err != nil {
+		return err
+	}
+	if err := h.CheckDelivery(perClient, timeout); err != nil {
+		return fmt.Errorf("after restart: %w", err)
+	}
+	return nil
+}
+
+// CheckDelivery sends perClient packets from every client to the server and
+// perClient packets from the server back to the clients, and verifies each
+// arrives exactly once and in order. Packets are injected in windows of
+// harnessWindow rounds so loopback socket buffers are not overrun.
+func (h *Harness) CheckDelivery(perClient int, timeout time.Duration) error {
+	serverIP := harnessServerIP()
+	deadline := time.After(timeout)
+
+	// Clients to server.
+	next := make([]uint32, len(h.Clients))
+	received := 0
+	for seq := 0; seq < perClient; seq++ {
+		for i := range h.Clients {
+			pkt := SyntheticPacket(harnessClientIP(i), serverIP, uint32(i), uint32(seq))
+			if err := h.InjectFromClient(i, pkt); err != nil {
+				return fmt.Errorf("inject client %d: %w", i, err)
+			}
+		}
+		if (seq+1)%harnessWindow != 0 && seq != perClient-1 {
+			continue
+		}
+		for sent := (seq + 1) * len(h.Clients); received < sent; received++ {
+			select {
+			case pkt := <-h.ServerDelivered():
+				stream, got, err := parseSynthetic(pkt)
+				if err != nil {
+					return fmt.Errorf("server received: %w", err)
+				}
+				if int(stream) >= len(next) {
+					return fmt.Errorf("server received packet for unknown client %d", stream)
+				}
+				if got != next[stream] {
+					return fmt.Errorf("client %d to server: got seq %d, want %d", stream, got, next[stream])
+				}
+				next[stream]++
+			case <-deadline:
+				return fmt.Errorf("server received %d of %d packets", received, perClient*len(h.Clients))
+			}
+		}
+	}
+
+	// Server to clients. The server forwards each packet to the client that
+	// owns the destination, or to every client when it cannot tell, so
+	// clients skip streams that are not theirs.
+	want := make([]uint32, len(h.Clients))
+	for seq := 0; seq < perClient; seq++ {
+		for i := range h.Clients {
+			pkt := SyntheticPacket(serverIP, harnessClientIP(i), uint32(i), uint32(seq))
+			if err := h.InjectFromServer(pkt); err != nil {
+				return fmt.Errorf("inject server: %w", err)
+			}
+		}
+		if (seq+1)%harnessWindow != 0 && seq != perClient-1 {
+			continue
+		}
+		for i := range h.Clients {
+			for want[i] <= uint32(seq) {
+				select {
+				case pkt := <-h.ClientDelivered(i):
+					stream, got, err := parseSynthetic(pkt)
+					if err != nil {
+						return fmt.Errorf("client %d received: %w", i, err)
+					}
+					if int(stream) != i {
+						continue
+					}
+					if got != want[i] {
+						return fmt.Errorf("server to client %d: got seq %d, want %d", i, got, want[i])
+					}
+					want[i]++
+				case <-deadline:
+					return fmt.Errorf("client %d received %d of %d packets", i, want[i], perClient)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckReconnect restarts the server and waits for every client to
+// re-handshake.
+func (h *Harness) CheckReconnect(timeout time.Duration) error {
+	before := make([]time.Time, len(h.Clients))
+	for i, c := range h.Clients {
+		before[i] = c.Status().LastHandshake
+	}
+	if err := h.RestartServer(); err != nil {
+		return fmt.Errorf("restart: %w", err)
+	}
+	deadline := time.Now().Add(timeout)
+	for i, c := range h.Clients {
+		for {
+			st := c.Status()
+			if st.Connected && st.LastHandshake.After(before[i]) {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("client %d did not reconnect within %s", i, timeout)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	// Drain anything delivered while the sessions were being replaced.
+	drain(h.serverDev.Delivered())
+	for _, dev := range h.clientDevs {
+		drain(dev.Delivered())
+	}
+	return nil
+}
+
+func drain(ch <-chan []byte) {
+	for {
+		select {
+		case <-ch:
+		default:
+			return
+		}
+	}
+}
+
+func harnessServerIP() netip.Addr {
+	return netip.AddrFrom4([4]byte{10, 99, 0, 1})
+}
+
+func harnessClientIP(i int) netip.Addr {
+	return netip.AddrFrom4([4]byte{10, 99, byte((i + 2) >> 8), byte(i + 2)})
+}
+
+const (
+	syntheticHeaderLen  = 20
+	syntheticPayloadLen = 20
+	syntheticMagic      = 0x474f5650 // "GOVP"
+)
+
+// SyntheticPacket builds an IPv4 packet from src to dst whose payload
+// carries a stream ID and sequence number. Even sequence numbers use ICMP
+// and odd ones a TCP protocol number, so both kinds cross the tunnel.
+func SyntheticPacket(src, dst netip.Addr, stream, seq uint32) []byte {
+	return syntheticPacket(src, dst, stream, seq, time.Time{}, 0)
+}
+
+// syntheticPacket is SyntheticPacket with a send timestamp and the total
+// length padded up to size.
+func syntheticPacket(src, dst netip.Addr, stream, seq uint32, sentAt time.Time, size int) []byte {
+	total := max(size, syntheticHeaderLen+syntheticPayloadLen)
+	pkt := make([]byte, total)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(total))
+	pkt[8] = 64
+	pkt[9] = 1 // ICMP
+	if seq%2 == 1 {
+		pkt[9] = 6 // TCP
+	}
+	s4, d4 := src.As4(), dst.As4()
+	copy(pkt[12:16], s4[:])
+	copy(pkt[16:20], d4[:])
+	binary.BigEndian.PutUint16(pkt[10:], ipv4Checksum(pkt[:syntheticHeaderLen]))
+
+	payload := pkt[syntheticHeaderLen:]
+	binary.BigEndian.PutUint32(payload[0:], syntheticMagic)
+	binary.BigEndian.PutUint32(payload[4:], stream)
+	binary.BigEndian.PutUint32(payload[8:], seq)
+	if !sentAt.IsZero() {
+		binary.BigEndian.PutUint64(payload[12:], uint64(sentAt.UnixNano()))
+	}
+	return pkt
+}
+
+func parseSynthetic(pkt []byte) (stream, seq uint32, err error) {
+	stream, seq, _, err = parseSyntheticTime(pkt)
+	return stream, seq, err
+}
+
+func parseSyntheticTime(pkt []byte) (stream, seq uint32, sentAt time.Time, err error) {
+	if len(pkt) < syntheticHeaderLen+syntheticPayloadLen || pkt[0]>>4 != 4 {
+		return 0, 0, time.Time{}, errors.New("not a synthetic packet")
+	}
+	if ipv4Checksum(pkt[:syntheticHeaderLen]) != 0 {
+		return 0, 0, time.Time{}, errors.New("bad IPv4 header checksum")
+	}
+	payload := pkt[syntheticHeaderLen:]
+	if binary.BigEndian.Uint32(payload) != syntheticMagic {
+		return 0, 0, time.Time{}, errors.New("bad synthetic payload")
+	}
+	if ns := binary.BigEndian.Uint64(payload[12:]); ns != 0 {
+		sentAt = time.Unix(0, int64(ns))
+	}
+	return binary.BigEndian.Uint32(payload[4:]), binary.BigEndian.Uint32(payload[8:]), sentAt, nil
+}
+
+func ipv4Checksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	if len(hdr)%2 == 1 {
+		sum += uint32(hdr[len(hdr)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
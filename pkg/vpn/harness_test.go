@@ -0,0 +1,31 @@
+package vpn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHarness(t *testing.T) {
+	h, err := NewHarness(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Run(200, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestImpairedHarness runs the harness over links that duplicate packets,
+// which the replay window must drop so each is delivered exactly once. Loss
+// and reordering, latency included, would fail CheckDelivery by design.
+func TestImpairedHarness(t *testing.T) {
+	h, err := NewImpairedHarness(3, ImpairmentConfig{Duplicate: 0.3, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Run(200, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,86 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// validateSidecar checks the settings for running as a Kubernetes sidecar.
+func (c Config) validateSidecar() error {
+	switch {
+	case c.HealthAddress != "" && c.Mode != "client":
+		return fmt.Errorf("health_address is a client setting")
+	case c.ShutdownDelay < 0:
+		return fmt.Errorf("shutdown_delay cannot be negative")
+	case !c.OneShotRoute:
+		return nil
+	case c.Mode != "client":
+		return fmt.Errorf("one_shot_route is a client setting")
+	case runtime.GOOS != "linux":
+		return fmt.Errorf("one_shot_route is only supported on Linux")
+	case c.Userspace || c.Netns != "":
+		return fmt.Errorf("one_shot_route needs an adapter of its own, not userspace or netns")
+	}
+	return nil
+}
+
+// handleHealth registers the probes an orchestrator such as Kubernetes
+// polls: GET /healthz answers while the client runs, GET /readyz only
+// while the tunnel is up and the client is not shutting down.
+func (c *Client) handleHealth(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if c.ctx.Err() != nil {
+			http.Error(w, "stopped", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case c.draining.Load() || c.ctx.Err() != nil:
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		case !c.Status().Connected:
+			http.Error(w, "not connected", http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	})
+}
+
+// startHealth serves the probes alone on health_address. Unlike the
+// management API this is meant to be reached from the network, by the
+// kubelet, and tells it nothing but up or down.
+func (c *Client) startHealth() error {
+	ln, err := net.Listen("tcp", c.cfg.HealthAddress)
+	if err != nil {
+		return fmt.Errorf("health listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	c.handleHealth(mux)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return c.ctx },
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("Health probes error: %v", err)
+		}
+	}()
+	log.Printf("Health probes listening on %s", ln.Addr())
+	c.health = srv
+	return nil
+}
+
+// Drain marks the client as shutting down, failing GET /readyz, while the
+// tunnel keeps carrying traffic until Stop.
+func (c *Client) Drain() {
+	if !c.draining.Swap(true) {
+		log.Printf("Shutting down: no longer ready")
+	}
+}
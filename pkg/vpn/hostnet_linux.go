@@ -0,0 +1,101 @@
+package vpn
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/gedons/go_VPN/internal/netlink"
+)
+
+// platformBackends are the host integrations this build uses.
+var platformBackends = []string{"tun", "netlink", "nftables"}
+
+// ipForward turns IPv4 forwarding on for every interface.
+const ipForward = "/proc/sys/net/ipv4/ip_forward"
+
+// enableForwarding turns on IPv4 forwarding if it is off, and returns the
+// change for disableForwarding to undo.
+func enableForwarding() ([]journalEntry, error) {
+	cur, err := os.ReadFile(ipForward)
+	if err != nil {
+		return nil, fmt.Errorf("enable IP forwarding: %w", err)
+	}
+	if string(bytes.TrimSpace(cur)) == "1" {
+		return nil, nil
+	}
+	if err := os.WriteFile(ipForward, []byte("1"), 0o644); err != nil {
+		return nil, fmt.Errorf("enable IP forwarding: %w", err)
+	}
+	return []journalEntry{{Kind: journalForwarding, Name: "ip_forward"}}, nil
+}
+
+// disableForwarding turns IPv4 forwarding off again.
+func disableForwarding(e journalEntry) error {
+	if err := os.WriteFile(ipForward, []byte("0"), 0o644); err != nil {
+		return fmt.Errorf("restore IP forwarding: %w", err)
+	}
+	return nil
+}
+
+// nftTable is the nftables table holding the rule or NAT called name. Each
+// gets a table of its own, so removing one cannot touch the others or the
+// host's own rules.
+func nftTable(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, " ", "-"))
+}
+
+// AllowFirewallPort adds an nftables table accepting UDP to port on input,
+// and returns the rule's name. A table of that name left by an earlier run
+// is replaced. Tables of other firewalls still see the packet, so a drop
+// there wins.
+func AllowFirewallPort(port int) (string, error) {
+	name := firewallRuleName(port)
+	if err := netlink.DeleteTable(nftTable(name)); err != nil {
+		return "", err
+	}
+	if err := netlink.AllowUDPPort(nftTable(name), uint16(port)); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// RemoveFirewallRule deletes a rule added by AllowFirewallPort.
+func RemoveFirewallRule(name string) error {
+	return netlink.DeleteTable(nftTable(name))
+}
+
+// RemoveFirewallRules deletes every rule AllowFirewallPort added, and
+// reports how many there were.
+func RemoveFirewallRules() (int, error) {
+	tables, err := netlink.Tables(nftTable(firewallRulePrefix))
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range tables {
+		if err := netlink.DeleteTable(t.Name); err != nil {
+			return 0, err
+		}
+	}
+	return len(tables), nil
+}
+
+// EnableNAT adds an nftables table masquerading traffic from prefix, the
+// tunnel subnet, behind the host's address.
+func EnableNAT(name, prefix string) error {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return err
+	}
+	if err := netlink.DeleteTable(nftTable(name)); err != nil {
+		return err
+	}
+	return netlink.AddMasquerade(nftTable(name), p)
+}
+
+// DisableNAT removes the table added by EnableNAT.
+func DisableNAT(name string) error {
+	return netlink.DeleteTable(nftTable(name))
+}
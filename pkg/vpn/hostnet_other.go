@@ -0,0 +1,44 @@
+//go:build !windows && !linux
+
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// enableForwarding is only available on Windows and Linux.
+func enableForwarding() ([]journalEntry, error) {
+	return nil, fmt.Errorf("IP forwarding on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
+
+// disableForwarding is only available on Windows and Linux.
+func disableForwarding(e journalEntry) error {
+	return fmt.Errorf("IP forwarding on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
+
+// AllowFirewallPort is only available on Windows and Linux.
+func AllowFirewallPort(port int) (string, error) {
+	return "", fmt.Errorf("firewall rules on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
+
+// RemoveFirewallRule is only available on Windows and Linux.
+func RemoveFirewallRule(name string) error {
+	return fmt.Errorf("firewall rules on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
+
+// RemoveFirewallRules is only available on Windows and Linux.
+func RemoveFirewallRules() (int, error) {
+	return 0, fmt.Errorf("firewall rules on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
+
+// EnableNAT is only available on Windows and Linux.
+func EnableNAT(name, prefix string) error {
+	return fmt.Errorf("NAT on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
+
+// DisableNAT is only available on Windows and Linux.
+func DisableNAT(name string) error {
+	return fmt.Errorf("NAT on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
@@ -0,0 +1,180 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// icmpError is an ICMP error by type and code, for IPv4 and for IPv6.
+type icmpError struct {
+	type4, code4 byte
+	type6, code6 byte
+}
+
+var (
+	// icmpProhibited is "communication administratively prohibited".
+	icmpProhibited = icmpError{3, 13, 1, 1}
+	// icmpNoRoute is "network unreachable", or "no route to destination".
+	icmpNoRoute = icmpError{3, 0, 1, 0}
+	// icmpTooBig is "fragmentation needed", or "packet too big", carrying
+	// the MTU.
+	icmpTooBig = icmpError{3, 4, 2, 0}
+)
+
+const (
+	// icmpErrorRate bounds the ICMP errors a server sends per second, with
+	// bursts of icmpErrorBurst, so a flood of bad packets does not become a
+	// flood of errors.
+	icmpErrorRate  = 100
+	icmpErrorBurst = 50
+
+	// minIPv6MTU bounds how much of a packet an ICMPv6 error quotes.
+	minIPv6MTU = 1280
+)
+
+// icmpLimiter rate-limits ICMP errors.
+type icmpLimiter struct {
+	mu     sync.Mutex
+	bucket tokenBucket
+}
+
+func (l *icmpLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bucket.take(icmpErrorRate, icmpErrorBurst, 1, time.Now())
+}
+
+// buildICMPError builds the ICMP error e from from, answering pkt; mtu goes
+// into icmpTooBig. It returns nil when pkt must not be answered: when from
+// is not of pkt's IP version, when pkt is itself an ICMP error, a fragment
+// after the first, or to or from a multicast or unspecified address, and
+// for icmpTooBig when an IPv4 packet may be fragmented.
+func buildICMPError(e icmpError, from netip.Addr, pkt []byte, mtu int) []byte {
+	src, ok := packetSrc(pkt)
+	dst, _ := packetDst(pkt)
+	if !ok || src.IsUnspecified() || src.IsMulticast() || dst.IsMulticast() || dst == netip.AddrFrom4([4]byte{255, 255, 255, 255}) {
+		return nil
+	}
+	if src.Is4() {
+		return buildICMP4Error(e, from, src, pkt, mtu)
+	}
+	return buildICMP6Error(e, from, src, pkt, mtu)
+}
+
+func buildICMP4Error(e icmpError, from, src netip.Addr, pkt []byte, mtu int) []byte {
+	ihl := int(pkt[0]&0x0f) * 4
+	if !from.Is4() || ihl < 20 || len(pkt) < ihl {
+		return nil
+	}
+	if binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+		return nil
+	}
+	if pkt[9] == 1 && len(pkt) > ihl && pkt[ihl] != 0 && pkt[ihl] != 8 {
+		return nil
+	}
+	if e == icmpTooBig && pkt[6]&0x40 == 0 {
+		return nil
+	}
+	quoted := pkt[:min(len(pkt), ihl+8)]
+	out := make([]byte, 20+8+len(quoted))
+	out[0] = 0x45
+	binary.BigEndian.PutUint16(out[2:], uint16(len(out)))
+	out[8] = 64 // TTL
+	out[9] = 1  // ICMP
+	f4, s4 := from.As4(), src.As4()
+	copy(out[12:16], f4[:])
+	copy(out[16:20], s4[:])
+	binary.BigEndian.PutUint16(out[10:], ipv4Checksum(out[:20]))
+	icmp := out[20:]
+	icmp[0], icmp[1] = e.type4, e.code4
+	if e == icmpTooBig {
+		binary.BigEndian.PutUint16(icmp[6:], uint16(mtu))
+	}
+	copy(icmp[8:], quoted)
+	binary.BigEndian.PutUint16(icmp[2:], ipv4Checksum(icmp))
+	return out
+}
+
+func buildICMP6Error(e icmpError, from, src netip.Addr, pkt []byte, mtu int) []byte {
+	if !from.Is6() || from.Is4In6() {
+		return nil
+	}
+	if pkt[6] == 58 && len(pkt) > 40 && pkt[40] < 128 {
+		return nil
+	}
+	if pkt[6] == 44 && len(pkt) >= 44 && binary.BigEndian.Uint16(pkt[42:44])&0xfff8 != 0 {
+		return nil
+	}
+	quoted := pkt[:min(len(pkt), minIPv6MTU-40-8)]
+	out := make([]byte, 40+8+len(quoted))
+	out[0] = 0x60
+	binary.BigEndian.PutUint16(out[4:], uint16(8+len(quoted)))
+	out[6] = 58 // ICMPv6
+	out[7] = 64 // hop limit
+	f16, s16 := from.As16(), src.As16()
+	copy(out[8:24], f16[:])
+	copy(out[24:40], s16[:])
+	icmp := out[40:]
+	icmp[0], icmp[1] = e.type6, e.code6
+	if e == icmpTooBig {
+		binary.BigEndian.PutUint32(icmp[4:], uint32(mtu))
+	}
+	copy(icmp[8:], quoted)
+	// The checksum covers a pseudo-header of both addresses, the length,
+	// and the next header.
+	pseudo := make([]byte, 0, 40+len(icmp))
+	pseudo = append(pseudo, out[8:40]...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(icmp)))
+	pseudo = append(pseudo, 0, 0, 0, 58)
+	pseudo = append(pseudo, icmp...)
+	binary.BigEndian.PutUint16(icmp[2:], ipv4Checksum(pseudo))
+	return out
+}
+
+// tunnelAddrFor returns the server's own tunnel address of pkt's IP
+// version, the source of the ICMP errors it sends clients.
+func (s *Server) tunnelAddrFor(pkt []byte) netip.Addr {
+	if len(pkt) > 0 && pkt[0]>>4 == 6 {
+		if s.pool6 == nil {
+			return netip.Addr{}
+		}
+		return s.pool6.server
+	}
+	return s.gateway
+}
+
+// reject answers pkt, which the server dropped on its way from sess, with
+// the ICMP error e, so the sender's stack gives up or adapts at once.
+func (s *Server) reject(sess *serverSession, e icmpError, pkt []byte, mtu int) {
+	reply := buildICMPError(e, s.tunnelAddrFor(pkt), pkt, mtu)
+	if reply == nil || !s.icmpErrors.allow() {
+		return
+	}
+	s.tap.observe(Outbound, reply)
+	s.send(sess, reply, nil)
+}
+
+// rejectTooBig answers pkt, read from the adapter for a client whose MTU it
+// exceeds, with icmpTooBig for the sender behind the adapter. The error
+// comes from the client's address, as the adapter would drop one from the
+// server's own.
+func (s *Server) rejectTooBig(pkt []byte, mtu int) {
+	dst, _ := packetDst(pkt)
+	reply := buildICMPError(icmpTooBig, dst, pkt, mtu)
+	if reply == nil || !s.icmpErrors.allow() {
+		return
+	}
+	s.tap.observe(Inbound, reply)
+	s.tunMgr.WritePacket(reply)
+}
+
+// unroutable reports whether pkt is for a tunnel address no session holds:
+// a free address of pool or pool6, or a delegated prefix not given out.
+func (s *Server) unroutable(pkt []byte) bool {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	sess, routed := s.routeLocked(pkt)
+	return routed && sess == nil
+}
@@ -0,0 +1,138 @@
+package vpn
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ImpairmentConfig injects network faults on the outer socket's send path.
+// It is meant for resilience testing and should never be set in production.
+type ImpairmentConfig struct {
+	Loss      float64       `yaml:"loss"`      // probability a packet is dropped
+	Duplicate float64       `yaml:"duplicate"` // probability a packet is sent twice
+	Reorder   float64       `yaml:"reorder"`   // probability a packet is held back behind the next one
+	Latency   time.Duration `yaml:"latency"`   // fixed delay added to every packet
+	Jitter    time.Duration `yaml:"jitter"`    // random extra delay up to this much
+	Seed      int64         `yaml:"seed"`      // RNG seed; 0 picks one from the clock
+}
+
+// Enabled reports whether any impairment is configured.
+func (c ImpairmentConfig) Enabled() bool {
+	return c.Loss > 0 || c.Duplicate > 0 || c.Reorder > 0 || c.Latency > 0 || c.Jitter > 0
+}
+
+func (c ImpairmentConfig) validate() error {
+	for name, p := range map[string]float64{"loss": c.Loss, "duplicate": c.Duplicate, "reorder": c.Reorder} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("debug_impairment.%s must be between 0 and 1", name)
+		}
+	}
+	if c.Latency < 0 || c.Jitter < 0 {
+		return fmt.Errorf("debug_impairment latency and jitter cannot be negative")
+	}
+	return nil
+}
+
+// reorderFlush bounds how long a held-back packet waits for a successor.
+const reorderFlush = 20 * time.Millisecond
+
+// impairer applies an ImpairmentConfig to a stream of sends.
+type impairer struct {
+	cfg ImpairmentConfig
+
+	mu   sync.Mutex
+	rng  *rand.Rand
+	held *heldPacket
+}
+
+// heldPacket is a packet waiting to be sent after its successor.
+type heldPacket struct {
+	once    sync.Once
+	deliver func()
+}
+
+func (h *heldPacket) release() { h.once.Do(h.deliver) }
+
+func newImpairer(cfg ImpairmentConfig) *impairer {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &impairer{cfg: cfg, rng: rand.New(rand.NewSource(seed))}
+}
+
+// send hands pkt to out zero, one, or two times, possibly delayed or swapped
+// with the following packet. pkt is copied, so callers may reuse it.
+func (im *impairer) send(pkt []byte, out func([]byte)) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	if im.rng.Float64() < im.cfg.Loss {
+		return
+	}
+	copies := 1
+	if im.rng.Float64() < im.cfg.Duplicate {
+		copies = 2
+	}
+	delay := im.cfg.Latency
+	if im.cfg.Jitter > 0 {
+		delay += time.Duration(im.rng.Int63n(int64(im.cfg.Jitter)))
+	}
+	data := append([]byte(nil), pkt...)
+	deliver := func() {
+		for i := 0; i < copies; i++ {
+			if delay > 0 {
+				time.AfterFunc(delay, func() { out(data) })
+			} else {
+				out(data)
+			}
+		}
+	}
+
+	// Release a previously held packet after this one.
+	if held := im.held; held != nil {
+		im.held = nil
+		deliver()
+		held.release()
+		return
+	}
+	if im.rng.Float64() < im.cfg.Reorder {
+		hp := &heldPacket{deliver: deliver}
+		im.held = hp
+		time.AfterFunc(reorderFlush, func() {
+			im.mu.Lock()
+			if im.held == hp {
+				im.held = nil
+			}
+			im.mu.Unlock()
+			hp.release()
+		})
+		return
+	}
+	deliver()
+}
+
+// impairedConn applies impairment to a connected client socket.
+type impairedConn struct {
+	outerConn
+	im *impairer
+}
+
+func (c *impairedConn) Write(b []byte) (int, error) {
+	c.im.send(b, func(p []byte) { c.outerConn.Write(p) })
+	return len(b), nil
+}
+
+// impairedPacketConn applies impairment to the server's listening socket.
+type impairedPacketConn struct {
+	PacketConn
+	im *impairer
+}
+
+func (c *impairedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.im.send(b, func(p []byte) { c.PacketConn.WriteTo(p, addr) })
+	return len(b), nil
+}
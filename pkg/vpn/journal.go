@@ -0,0 +1,275 @@
+package vpn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+// Kinds of journalEntry.
+const (
+	journalAdapter  = "adapter"   // a Wintun adapter, with its routes and DNS
+	journalNAT      = "nat"       // a NetNat instance
+	journalLANRoute = "lan_route" // a route added by allow_lan
+	journalFirewall = "firewall"  // a Windows Firewall rule
+
+	// journalForwarding is IPv4 forwarding turned on for interface IfIndex,
+	// or in the registry when IfIndex is zero.
+	journalForwarding = "forwarding"
+)
+
+// journalEntry is one change to the host's network configuration.
+type journalEntry struct {
+	Kind    string `json:"kind"`
+	Name    string `json:"name,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+	IfIndex int    `json:"if_index,omitempty"`
+}
+
+func (e journalEntry) undo() error {
+	var err error
+	switch e.Kind {
+	case journalAdapter:
+		err = RemoveAdapter(e.Name)
+	case journalNAT:
+		err = DisableNAT(e.Name)
+	case journalFirewall:
+		err = RemoveFirewallRule(e.Name)
+	case journalForwarding:
+		err = disableForwarding(e)
+	case journalLANRoute:
+		var p netip.Prefix
+		if p, err = netip.ParsePrefix(e.Prefix); err == nil {
+			err = deleteLANRoute(lanRoute{prefix: p, ifIndex: e.IfIndex})
+		}
+	default:
+		err = fmt.Errorf("unknown change %q", e.Kind)
+	}
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	return err
+}
+
+// journalState is the journal file.
+type journalState struct {
+	PID     int            `json:"pid"`
+	Changes []journalEntry `json:"changes"`
+}
+
+// journal keeps the host changes a client or server has made in a file, so
+// they can be undone after a crash: by guard when a tunnel goroutine
+// panics, or by RollbackHostChanges at the next start after a hard kill.
+// A nil journal records nothing.
+type journal struct {
+	path    string
+	mu      sync.Mutex
+	entries []journalEntry
+}
+
+// journalFile returns where the host change journal is kept.
+func (c Config) journalFile() string {
+	if c.JournalFile != "" {
+		return c.JournalFile
+	}
+	return filepath.Join(os.TempDir(), "govpn-"+c.AdapterName+".journal")
+}
+
+// openJournal undoes whatever a previous run left in cfg's journal and
+// returns an empty one.
+func openJournal(cfg Config) *journal {
+	if n, err := RollbackHostChanges(cfg); err != nil {
+		log.Printf("Undo changes left by a previous run: %v", err)
+	} else if n > 0 {
+		log.Printf("Undid %d network changes left by a previous run", n)
+	}
+	return &journal{path: cfg.journalFile()}
+}
+
+// add records e before the caller relies on it being undone.
+func (j *journal) add(e journalEntry) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = append(j.entries, e)
+	j.saveLocked()
+}
+
+// remove forgets e once the caller has undone it.
+func (j *journal) remove(e journalEntry) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if i := slices.Index(j.entries, e); i >= 0 {
+		j.entries = slices.Delete(j.entries, i, i+1)
+		j.saveLocked()
+	}
+}
+
+// clear forgets everything after a clean Stop.
+func (j *journal) clear() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = nil
+	j.saveLocked()
+}
+
+func (j *journal) saveLocked() {
+	if len(j.entries) == 0 {
+		if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Journal %s: %v", j.path, err)
+		}
+		return
+	}
+	data, _ := json.Marshal(journalState{PID: os.Getpid(), Changes: j.entries})
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Printf("Journal %s: %v", j.path, err)
+		return
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		log.Printf("Journal %s: %v", j.path, err)
+	}
+}
+
+// guard is deferred by the tunnel's goroutines. On a panic it undoes the
+// host changes, so the machine is not left routing into a dead adapter,
+// and panics again so the crash is still reported.
+func (j *journal) guard() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if j != nil {
+		log.Printf("Panic: %v; undoing network changes", r)
+		j.mu.Lock()
+		undo(j.entries)
+		j.entries = nil
+		j.saveLocked()
+		j.mu.Unlock()
+	}
+	panic(r)
+}
+
+// undo reverts entries newest first and returns the first error.
+func undo(entries []journalEntry) error {
+	var first error
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := entries[i].undo(); err != nil {
+			log.Printf("Undo %s %s%s: %v", entries[i].Kind, entries[i].Name, entries[i].Prefix, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// RollbackHostChanges undoes the network changes recorded in cfg's journal
+// by a client or server that did not stop cleanly, and reports how many
+// there were. With tunnels set it does so for every tunnel. Start does this
+// itself; it is exported for gocli cleanup and for embedders' own crash
+// handlers.
+func RollbackHostChanges(cfg Config) (int, error) {
+	if len(cfg.tunnels) > 0 {
+		var total int
+		var errs []error
+		for _, t := range cfg.tunnels {
+			n, err := RollbackHostChanges(t)
+			total += n
+			errs = append(errs, err)
+		}
+		return total, errors.Join(errs...)
+	}
+	path := cfg.journalFile()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var st journalState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return 0, fmt.Errorf("journal %s: %w", path, err)
+	}
+	if st.PID != os.Getpid() && processAlive(st.PID) {
+		return 0, fmt.Errorf("journal %s belongs to running process %d", path, st.PID)
+	}
+	if err := undo(st.Changes); err != nil {
+		return len(st.Changes), err
+	}
+	return len(st.Changes), os.Remove(path)
+}
+
+// HostChanges describes the network changes recorded in cfg's journal, one
+// per line, such as those of a running client, for gocli diag.
+func HostChanges(cfg Config) ([]string, error) {
+	if len(cfg.tunnels) > 0 {
+		var out []string
+		for _, t := range cfg.tunnels {
+			lines, err := HostChanges(t)
+			if err != nil {
+				return out, err
+			}
+			out = append(out, lines...)
+		}
+		return out, nil
+	}
+	path := cfg.journalFile()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st journalState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("journal %s: %w", path, err)
+	}
+	var out []string
+	for _, e := range st.Changes {
+		line := fmt.Sprintf("%s: %s", path, e.Kind)
+		if e.Name != "" {
+			line += " " + e.Name
+		}
+		switch {
+		case e.Prefix != "":
+			line += fmt.Sprintf(" %s (interface %d)", e.Prefix, e.IfIndex)
+		case e.IfIndex != 0:
+			line += fmt.Sprintf(" on interface %d", e.IfIndex)
+		}
+		out = append(out, line+fmt.Sprintf(", by process %d", st.PID))
+	}
+	return out, nil
+}
+
+// processAlive reports whether pid is running. On Windows a process that
+// has exited can no longer be opened; elsewhere signal 0 probes it.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	defer p.Release()
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
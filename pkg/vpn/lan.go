@@ -0,0 +1,99 @@
+package vpn
+
+import (
+	"log"
+	"net"
+	"net/netip"
+)
+
+// lanRoute is a local subnet kept off the tunnel by allow_lan.
+type lanRoute struct {
+	prefix  netip.Prefix
+	ifIndex int
+	ifName  string
+}
+
+func (r lanRoute) journalEntry() journalEntry {
+	return journalEntry{Kind: journalLANRoute, Prefix: r.prefix.String(), IfIndex: r.ifIndex}
+}
+
+// lanSubnets returns the private and link-local IPv4 subnets attached to
+// the host's interfaces, other than the tunnel adapter, that one of routes
+// would otherwise send through the tunnel. Subnets overlapping tunnel are
+// left out, since the tunnel's own on-link route must win there.
+func lanSubnets(adapter string, tunnel netip.Prefix, routes []string) []lanRoute {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("allow_lan: list interfaces: %v", err)
+		return nil
+	}
+	var out []lanRoute
+	for _, ifi := range ifaces {
+		if ifi.Name == adapter || ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipnet.IP.To4())
+			if !ok || !(ip.IsPrivate() || ip.IsLinkLocalUnicast()) {
+				continue
+			}
+			bits, _ := ipnet.Mask.Size()
+			p := netip.PrefixFrom(ip, bits).Masked()
+			if tunnel.IsValid() && p.Overlaps(tunnel) || !tunneled(p, routes) {
+				continue
+			}
+			out = append(out, lanRoute{prefix: p, ifIndex: ifi.Index, ifName: ifi.Name})
+		}
+	}
+	return out
+}
+
+// tunneled reports whether any of routes covers part of p.
+func tunneled(p netip.Prefix, routes []string) bool {
+	for _, r := range routes {
+		if rp, err := netip.ParsePrefix(r); err == nil && rp.Overlaps(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// bypassLAN installs a route for each local subnet on its own interface,
+// more specific than the tunnel's, so printers and file shares stay
+// reachable in full-tunnel mode.
+func (c *Client) bypassLAN() {
+	var tunnel netip.Prefix
+	if lease := c.lease.Load(); lease != nil {
+		tunnel = lease.Masked()
+	} else if p, err := netip.ParsePrefix(c.cfg.AdapterIPCIDR); err == nil {
+		tunnel = p.Masked()
+	}
+	for _, r := range lanSubnets(c.cfg.AdapterName, tunnel, c.cfg.routes()) {
+		if err := addLANRoute(r); err != nil {
+			log.Printf("allow_lan: route %s via %s: %v", r.prefix, r.ifName, err)
+			continue
+		}
+		log.Printf("Local subnet %s on %s bypasses the tunnel", r.prefix, r.ifName)
+		c.journal.add(r.journalEntry())
+		c.lanRoutes = append(c.lanRoutes, r)
+	}
+}
+
+// restoreLAN removes the routes added by bypassLAN.
+func (c *Client) restoreLAN() {
+	for _, r := range c.lanRoutes {
+		if err := deleteLANRoute(r); err != nil {
+			log.Printf("allow_lan: remove route %s via %s: %v", r.prefix, r.ifName, err)
+		}
+		c.journal.remove(r.journalEntry())
+	}
+	c.lanRoutes = nil
+}
@@ -0,0 +1,151 @@
+package vpn
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/ldap"
+)
+
+// DefaultLDAPTimeout bounds a login against the directory.
+const DefaultLDAPTimeout = 5 * time.Second
+
+// LDAPConfig checks logins by binding to an LDAP directory as the user, and
+// reads the user's groups for profiles.
+type LDAPConfig struct {
+	URL      string `yaml:"url"`       // ldaps://host[:636], or ldap://host[:389]
+	StartTLS bool   `yaml:"start_tls"` // upgrade an ldap:// connection to TLS
+	CAFile   string `yaml:"ca_file"`   // PEM certificates to trust in place of the system's
+
+	// UserDN is the user's DN with %s for the username, such as
+	// uid=%s,ou=people,dc=example,dc=com. Without it, the user is found
+	// under BaseDN by UserAttribute, binding as BindDN to search.
+	UserDN        string `yaml:"user_dn"`
+	BaseDN        string `yaml:"base_dn"`
+	UserAttribute string `yaml:"user_attribute"` // defaults to uid; sAMAccountName on Active Directory
+	BindDN        string `yaml:"bind_dn"`        // anonymous if unset
+	BindPassword  string `yaml:"bind_password"`
+
+	GroupAttribute string        `yaml:"group_attribute"` // defaults to memberOf
+	Timeout        time.Duration `yaml:"timeout"`         // DefaultLDAPTimeout if unset
+}
+
+func (c *LDAPConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	switch {
+	case err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "":
+		return fmt.Errorf("auth: ldap url %q must be ldaps://host or ldap://host", c.URL)
+	case c.StartTLS && u.Scheme == "ldaps":
+		return fmt.Errorf("auth: ldap start_tls is for ldap:// urls")
+	case c.UserDN == "" && c.BaseDN == "":
+		return fmt.Errorf("auth: ldap needs user_dn or base_dn")
+	case c.UserDN != "" && strings.Count(c.UserDN, "%s") != 1:
+		return fmt.Errorf("auth: ldap user_dn must hold %%s once, for the username")
+	case c.UserDN != "" && c.BaseDN != "":
+		return fmt.Errorf("auth: set ldap user_dn or base_dn, not both")
+	case c.Timeout < 0:
+		return fmt.Errorf("auth: ldap timeout cannot be negative")
+	}
+	return nil
+}
+
+// ldapProvider checks logins against an LDAP directory.
+type ldapProvider struct {
+	cfg LDAPConfig
+	tls *tls.Config
+}
+
+func newLDAPProvider(cfg LDAPConfig) (*ldapProvider, error) {
+	if cfg.UserAttribute == "" {
+		cfg.UserAttribute = "uid"
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = "memberOf"
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultLDAPTimeout
+	}
+	p := &ldapProvider{cfg: cfg, tls: &tls.Config{MinVersion: tls.VersionTLS12}}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("auth: ldap ca_file: %w", err)
+		}
+		p.tls.RootCAs = x509.NewCertPool()
+		if !p.tls.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("auth: ldap ca_file %s holds no certificates", cfg.CAFile)
+		}
+	}
+	if strings.HasPrefix(cfg.URL, "ldap://") && !cfg.StartTLS {
+		log.Printf("Warning: auth sends passwords to %s unencrypted; use ldaps:// or start_tls", cfg.URL)
+	}
+	return p, nil
+}
+
+func (p *ldapProvider) Authenticate(ctx context.Context, identity, credentials string, meta AuthMeta) (AuthResult, error) {
+	if identity == "" || credentials == "" {
+		return AuthResult{}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	conn, err := ldap.Dial(ctx, p.cfg.URL, p.tls)
+	if err != nil {
+		return AuthResult{}, err
+	}
+	defer conn.Close()
+	if p.cfg.StartTLS {
+		u, _ := url.Parse(p.cfg.URL)
+		if err := conn.StartTLS(ctx, u.Hostname(), p.tls); err != nil {
+			return AuthResult{}, err
+		}
+	}
+
+	var entry *ldap.Entry
+	dn := strings.Replace(p.cfg.UserDN, "%s", ldap.EscapeDN(identity), 1)
+	if p.cfg.UserDN == "" {
+		if p.cfg.BindDN != "" {
+			if err := conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+				return AuthResult{}, fmt.Errorf("bind_dn: %w", err)
+			}
+		}
+		found, err := conn.Search(p.cfg.BaseDN, ldap.ScopeSubtree, ldap.Equal(p.cfg.UserAttribute, identity), []string{p.cfg.GroupAttribute})
+		if err != nil {
+			return AuthResult{}, err
+		}
+		if len(found) != 1 {
+			// No such user, or an ambiguous one; refused like a wrong
+			// password, so guessers cannot tell.
+			return AuthResult{}, nil
+		}
+		entry, dn = &found[0], found[0].DN
+	}
+	if err := conn.Bind(dn, credentials); err != nil {
+		if ldap.IsInvalidCredentials(err) {
+			return AuthResult{}, nil
+		}
+		return AuthResult{}, err
+	}
+	if entry == nil {
+		found, err := conn.Search(dn, ldap.ScopeBase, ldap.Present("objectClass"), []string{p.cfg.GroupAttribute})
+		if err != nil {
+			return AuthResult{}, err
+		}
+		if len(found) == 1 {
+			entry = &found[0]
+		}
+	}
+	res := AuthResult{Allow: true, Attributes: map[string][]string{"dn": {dn}}}
+	if entry != nil {
+		if groups := entry.Get(p.cfg.GroupAttribute); len(groups) > 0 {
+			res.Attributes["groups"] = groups
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,90 @@
+package vpn
+
+import (
+	"fmt"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// LegacyListenConfig opens a second port during a rolling protocol upgrade.
+// Clients not yet upgraded keep using it with the older versions it offers,
+// while upgraded ones move to server_address, which min_protocol_version can
+// then close to the old versions.
+type LegacyListenConfig struct {
+	Address    string `yaml:"address"`
+	MinVersion uint16 `yaml:"min_version"` // default: oldest supported
+	MaxVersion uint16 `yaml:"max_version"` // default: newest supported
+}
+
+func (c *LegacyListenConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Address == "" {
+		return fmt.Errorf("legacy_listen: address is required")
+	}
+	if _, err := versionRange(c.MinVersion, c.MaxVersion); err != nil {
+		return fmt.Errorf("legacy_listen: %w", err)
+	}
+	return nil
+}
+
+// versionRange returns the versions from min to max, either of which may be
+// zero for the build's limit. The range must lie within what this build
+// supports.
+func versionRange(min, max uint16) (protocol.VersionRange, error) {
+	r := protocol.Supported
+	if min != 0 {
+		r.Min = min
+	}
+	if max != 0 {
+		r.Max = max
+	}
+	if r.Min > r.Max || !protocol.Supported.Contains(r.Min) || !protocol.Supported.Contains(r.Max) {
+		return r, fmt.Errorf("protocol versions %s are outside the supported %s", r, protocol.Supported)
+	}
+	return r, nil
+}
+
+// listener is one of the server's outer sockets, its transport, and the
+// protocol versions offered on it. A session answers through the listener
+// its client uses.
+type listener struct {
+	conn      PacketConn
+	address   string
+	transport string
+	versions  protocol.VersionRange
+}
+
+// openListener listens on address over transport and offers versions
+// there.
+func (s *Server) openListener(transport, address string, versions protocol.VersionRange) (*listener, error) {
+	conn, err := s.listen(transport, address)
+	if err != nil {
+		return nil, err
+	}
+	if s.transcript != nil {
+		conn = &transcriptPacketConn{PacketConn: conn, t: s.transcript}
+	}
+	if s.cfg.DebugImpairment.Enabled() {
+		conn = &impairedPacketConn{PacketConn: conn, im: newImpairer(s.cfg.DebugImpairment)}
+	}
+	return &listener{conn: conn, address: address, transport: transportName(transport), versions: versions}, nil
+}
+
+// closeListeners closes every outer socket.
+func (s *Server) closeListeners() {
+	for _, ln := range s.listeners {
+		ln.conn.Close()
+	}
+}
+
+// listenerFor returns the listener opened on address, or the primary one.
+func (s *Server) listenerFor(address string) *listener {
+	for _, ln := range s.listeners {
+		if ln.address == address {
+			return ln
+		}
+	}
+	return s.listeners[0]
+}
@@ -0,0 +1,256 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Lockout defaults.
+const (
+	DefaultLockoutDuration = time.Minute
+	DefaultLockoutMax      = time.Hour
+
+	// lockoutWindow is how long failures from one address are counted
+	// together.
+	lockoutWindow = 10 * time.Minute
+	// lockoutForget is how long after its last failure, and the end of
+	// its last lockout, an address starts over from the first lockout.
+	lockoutForget = 24 * time.Hour
+	// maxLockoutSources bounds the addresses tracked at once; the least
+	// recently seen that is not locked out is forgotten first, and none
+	// are added while all are.
+	maxLockoutSources = 4096
+)
+
+// LockoutConfig locks addresses out, on a server, after repeated handshakes
+// with no known key. Each lockout of an address is twice as long as the
+// one before. It is off unless After is set.
+type LockoutConfig struct {
+	After    int           `yaml:"after"`    // failures within 10 minutes that lock an address out
+	Duration time.Duration `yaml:"duration"` // first lockout; DefaultLockoutDuration if unset
+	Max      time.Duration `yaml:"max"`      // longest lockout; DefaultLockoutMax if unset
+}
+
+// Enabled reports whether lockout is configured.
+func (c LockoutConfig) Enabled() bool {
+	return c.After > 0
+}
+
+func (c LockoutConfig) validate(mode string) error {
+	switch {
+	case !c.Enabled() && (c.Duration != 0 || c.Max != 0):
+		return fmt.Errorf("lockout: set after")
+	case !c.Enabled():
+		return nil
+	case mode != "server":
+		return fmt.Errorf("lockout is a server setting")
+	case c.Duration < 0 || c.Max < 0:
+		return fmt.Errorf("lockout: durations cannot be negative")
+	case c.Max != 0 && c.Max < c.duration():
+		return fmt.Errorf("lockout: max must be at least duration")
+	}
+	return nil
+}
+
+func (c LockoutConfig) duration() time.Duration {
+	if c.Duration > 0 {
+		return c.Duration
+	}
+	return DefaultLockoutDuration
+}
+
+func (c LockoutConfig) max() time.Duration {
+	if c.Max > 0 {
+		return c.Max
+	}
+	return max(DefaultLockoutMax, c.duration())
+}
+
+// Ban is an address with recent authentication failures, as listed by
+// GET /bans.
+type Ban struct {
+	Address     string    `json:"address"`
+	Failures    int       `json:"failures"` // since the last lockout
+	Lockouts    int       `json:"lockouts"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until,omitzero"`
+}
+
+// BanList is the body of GET /bans, locked out addresses first.
+type BanList struct {
+	Bans    []Ban  `json:"bans"`
+	Refused uint64 `json:"refused"` // handshakes refused from locked out addresses
+}
+
+// UnbanRequest is the body of POST /unban.
+type UnbanRequest struct {
+	Address string `json:"address"`
+}
+
+var errNotBanned = errors.New("address has no failures on record")
+
+// lockout counts handshake failures by source address.
+type lockout struct {
+	cfg LockoutConfig
+
+	mu      sync.Mutex
+	sources map[netip.Addr]*Ban
+}
+
+func newLockout(cfg LockoutConfig) *lockout {
+	return &lockout{cfg: cfg, sources: make(map[netip.Addr]*Ban)}
+}
+
+// locked reports whether addr is locked out. l may be nil.
+func (l *lockout) locked(addr net.Addr) bool {
+	if l == nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(hostOf(addr))
+	if err != nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.sources[ip]
+	return b != nil && time.Now().Before(b.LockedUntil)
+}
+
+// failed records a failed handshake from addr, locking it out once it has
+// failed After times. l may be nil.
+func (l *lockout) failed(addr net.Addr) {
+	if l == nil {
+		return
+	}
+	ip, err := netip.ParseAddr(hostOf(addr))
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.sources[ip]
+	if b != nil && now.Sub(b.LastFailure) > lockoutForget && now.Sub(b.LockedUntil) > lockoutForget {
+		b = nil
+	}
+	if b == nil {
+		if len(l.sources) >= maxLockoutSources && !l.forgetOldestLocked(now) {
+			errorLog.Printf("Lockout: %d addresses locked out, not tracking failures from %s", len(l.sources), ip)
+			return
+		}
+		b = &Ban{Address: ip.String()}
+		l.sources[ip] = b
+	}
+	if now.Sub(b.LastFailure) > lockoutWindow {
+		b.Failures = 0
+	}
+	b.Failures++
+	b.LastFailure = now
+	if b.Failures < l.cfg.After {
+		return
+	}
+	d := l.cfg.duration() << min(b.Lockouts, 30)
+	if d <= 0 || d > l.cfg.max() {
+		d = l.cfg.max()
+	}
+	b.Failures = 0
+	b.Lockouts++
+	b.LockedUntil = now.Add(d)
+	log.Printf("Locked out %s for %s after %d failed handshakes (lockout %d)", ip, d, l.cfg.After, b.Lockouts)
+}
+
+// succeeded clears the failures of addr, which authenticated. Its lockouts
+// still count towards the length of the next. l may be nil.
+func (l *lockout) succeeded(addr net.Addr) {
+	if l == nil {
+		return
+	}
+	ip, err := netip.ParseAddr(hostOf(addr))
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	if b := l.sources[ip]; b != nil {
+		b.Failures = 0
+	}
+	l.mu.Unlock()
+}
+
+// forgetOldestLocked drops the source with the oldest failure that is not
+// locked out at now, and reports false when every source is. Callers hold
+// l.mu.
+func (l *lockout) forgetOldestLocked(now time.Time) bool {
+	var oldest netip.Addr
+	var last time.Time
+	for ip, b := range l.sources {
+		if now.Before(b.LockedUntil) {
+			continue
+		}
+		if !oldest.IsValid() || b.LastFailure.Before(last) {
+			oldest, last = ip, b.LastFailure
+		}
+	}
+	if !oldest.IsValid() {
+		return false
+	}
+	delete(l.sources, oldest)
+	return true
+}
+
+// Bans lists the addresses with failures or lockouts on record. It is
+// empty unless lockout is configured.
+func (s *Server) Bans() BanList {
+	list := BanList{Bans: []Ban{}, Refused: s.dropped[dropLockedOut].Load()}
+	l := s.lockout
+	if l == nil {
+		return list
+	}
+	now := time.Now()
+	l.mu.Lock()
+	for ip, b := range l.sources {
+		if now.Sub(b.LastFailure) > lockoutForget && now.Sub(b.LockedUntil) > lockoutForget {
+			delete(l.sources, ip)
+			continue
+		}
+		ban := *b
+		if !now.Before(ban.LockedUntil) {
+			ban.LockedUntil = time.Time{}
+		}
+		list.Bans = append(list.Bans, ban)
+	}
+	l.mu.Unlock()
+	slices.SortFunc(list.Bans, func(a, b Ban) int {
+		if c := b.LockedUntil.Compare(a.LockedUntil); c != 0 {
+			return c
+		}
+		return b.LastFailure.Compare(a.LastFailure)
+	})
+	return list
+}
+
+// Unban lifts the lockout of address, a bare IP, and forgets its failures.
+func (s *Server) Unban(address string) error {
+	if s.lockout == nil {
+		return errors.New("lockout is not enabled")
+	}
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q", address)
+	}
+	l := s.lockout
+	l.mu.Lock()
+	_, ok := l.sources[ip.Unmap()]
+	delete(l.sources, ip.Unmap())
+	l.mu.Unlock()
+	if !ok {
+		return errNotBanned
+	}
+	log.Printf("Unbanned %s", ip.Unmap())
+	return nil
+}
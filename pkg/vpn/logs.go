@@ -0,0 +1,72 @@
+package vpn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gedons/go_VPN/internal/logbuf"
+)
+
+// DefaultLogLines is how many recent log lines GET /logs returns unless ?n=
+// says otherwise.
+const DefaultLogLines = 100
+
+// recentLogs holds the process's latest log lines once captureLogs has run.
+var recentLogs = logbuf.NewBuffer(logbuf.DefaultSize)
+
+// captureLogs copies the standard logger's output into recentLogs. A client
+// or server with a management API calls it at Start.
+var captureLogs = sync.OnceFunc(func() {
+	log.SetOutput(io.MultiWriter(log.Writer(), recentLogs))
+})
+
+// LogsResponse is the body of GET /logs.
+type LogsResponse struct {
+	Lines []logbuf.Entry `json:"lines"`
+}
+
+// handleLogs serves GET /logs on mux. ?n= limits the reply to the newest
+// lines; with ?follow=true the reply is a stream of JSON lines, one per log
+// line, that lasts until the caller hangs up.
+func handleLogs(mux *http.ServeMux) {
+	mux.HandleFunc("GET /logs", func(w http.ResponseWriter, r *http.Request) {
+		n := DefaultLogLines
+		if v := r.URL.Query().Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid n %q", v))
+				return
+			}
+		}
+		lines, seq, changed := recentLogs.Last(n)
+		if follow, _ := strconv.ParseBool(r.URL.Query().Get("follow")); !follow {
+			writeJSON(w, http.StatusOK, LogsResponse{Lines: lines})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		for {
+			for _, l := range lines {
+				if err := enc.Encode(l); err != nil {
+					return
+				}
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-changed:
+			}
+			lines, seq, changed = recentLogs.Since(seq)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package vpn
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// LowPowerKeepaliveInterval is the keepalive of a low_power client
+	// without keepalive_interval: about as long as most NATs keep an idle
+	// UDP mapping.
+	LowPowerKeepaliveInterval = 25 * time.Second
+
+	// lowPowerBatchDelay is the longest a low_power client holds a packet
+	// read from the adapter, and lowPowerBatchSize the most it holds before
+	// sending them all at once.
+	lowPowerBatchDelay = 20 * time.Millisecond
+	lowPowerBatchSize  = 64
+
+	// lowPowerResumeCheck is how often a low_power client looks for a
+	// resume from sleep where the system does not announce one.
+	lowPowerResumeCheck = 30 * time.Second
+)
+
+// packetBatch holds packets read from the adapter so a low_power client
+// sends them in bursts, and the radio and CPU can sleep between them.
+type packetBatch struct {
+	mu    sync.Mutex
+	pkts  [][]byte
+	timer *time.Timer
+	flush func(pkts [][]byte)
+}
+
+func newPacketBatch(flush func(pkts [][]byte)) *packetBatch {
+	return &packetBatch{flush: flush}
+}
+
+// add holds pkt, which the batch now owns, until lowPowerBatchDelay after
+// the first packet of the batch, or until the batch is full. Batches are
+// sent under mu, so they go out in order.
+func (b *packetBatch) add(pkt []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pkts = append(b.pkts, pkt)
+	switch len(b.pkts) {
+	case 1:
+		b.timer = time.AfterFunc(lowPowerBatchDelay, b.send)
+	case lowPowerBatchSize:
+		b.timer.Stop()
+		b.sendLocked()
+	}
+}
+
+// send sends whatever the batch holds.
+func (b *packetBatch) send() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sendLocked()
+}
+
+func (b *packetBatch) sendLocked() {
+	if len(b.pkts) > 0 {
+		b.flush(b.pkts)
+		clear(b.pkts)
+		b.pkts = b.pkts[:0]
+	}
+}
+
+// forwardBatch sends a batch of packets read from the adapter, in runs
+// under udp_offload.
+func (c *Client) forwardBatch(pkts [][]byte) {
+	tx := &txBatch{}
+	for _, pkt := range pkts {
+		c.forward(pkt, tx)
+	}
+	c.flush(tx)
+}
+
+// resumeCheck is how often the client looks for a resume from sleep where
+// the system does not announce one; zero for the default.
+func (c Config) resumeCheck() time.Duration {
+	if c.LowPower {
+		return lowPowerResumeCheck
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/metrics"
+)
+
+// DefaultManagementAddress is where gocli looks for the management API when
+// no address is given.
+const DefaultManagementAddress = "127.0.0.1:7505"
+
+// RotateKeyRequest is the body of POST /rotate-key.
+type RotateKeyRequest struct {
+	PSK string `json:"psk"`
+}
+
+// ErrorResponse is returned by the management API on failure.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// HistoryResponse is the body of GET /metrics/history.
+type HistoryResponse struct {
+	ResolutionSeconds int              `json:"resolution_seconds"`
+	Samples           []metrics.Sample `json:"samples"`
+}
+
+// DropsResponse is the body of GET /metrics/drops. Drops counts dropped
+// packets by reason; reasons with no drops are left out.
+type DropsResponse struct {
+	Drops map[string]uint64 `json:"drops"`
+}
+
+// serveHistory writes the samples in h, optionally limited by a ?since=
+// query parameter holding an RFC 3339 time or a duration such as 1h.
+func serveHistory(w http.ResponseWriter, r *http.Request, h *metrics.History, res time.Duration) {
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+			since = t
+		} else {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid since %q", v))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, HistoryResponse{
+		ResolutionSeconds: int(res / time.Second),
+		Samples:           h.Samples(since),
+	})
+}
+
+// startManagement serves mux on addr until ctx is cancelled.
+func startManagement(ctx context.Context, addr string, mux *http.ServeMux) (*http.Server, error) {
+	return serveLocal(ctx, "Management API", addr, guardManagement(mux))
+}
+
+// guardManagement keeps web pages the operator visits away from h. It
+// refuses host names other than localhost and the address the request
+// came in on, so a page that rebinds its own name to the API cannot read
+// its answers. It also refuses requests that change state unless they are
+// JSON. Browsers only send that cross-origin after a CORS preflight,
+// which the API never grants, so other sites cannot post to it.
+func guardManagement(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if !loopbackHost(host) && !localHost(r, host) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("host %q not allowed", r.Host))
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("Content-Type must be application/json"))
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// localHost reports whether host is the IP address r was received on, as
+// when the API listens on a network address and is called by it.
+func localHost(r *http.Request, host string) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	local, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(net.ParseIP(local))
+}
+
+// serveLocal serves h on addr until ctx is cancelled, warning when addr is
+// reachable from the network. what names the service in logs and errors.
+func serveLocal(ctx context.Context, what, addr string, h http.Handler) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s listen: %w", strings.ToLower(what), err)
+	}
+	if host, _, err := net.SplitHostPort(ln.Addr().String()); err == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			log.Printf("Warning: %s on %s is reachable from the network", what, ln.Addr())
+		}
+	}
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 5 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("%s error: %v", what, err)
+		}
+	}()
+	log.Printf("%s listening on %s", what, ln.Addr())
+	return srv, nil
+}
+
+// stopManagement shuts srv down, giving in-flight requests a moment to finish.
+func stopManagement(srv *http.Server) {
+	if srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorResponse{Error: err.Error()})
+}
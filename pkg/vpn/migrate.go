@@ -0,0 +1,287 @@
+package vpn
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+const (
+	// migrateHold is the least time a client stays on a transport it moved
+	// to. After it, the client probes the transport it left every
+	// migrateProbeInterval and moves back once migrateProbes probes in a
+	// row are answered, so a transport that keeps failing does not pull
+	// the session back and forth.
+	migrateHold          = time.Minute
+	migrateProbeInterval = 10 * time.Second
+	migrateProbes        = 3
+
+	// pathProbeSize is the length of a path probe's random payload.
+	pathProbeSize = 8
+)
+
+// MigrateConfig is another transport a session can move to: its name, and
+// the address a server listens on for it, or a client reaches it at.
+type MigrateConfig struct {
+	Transport string `yaml:"transport"`
+	Address   string `yaml:"address"`
+}
+
+// validateMigrate checks migrate, whose transports must be distinct from
+// each other and from transport.
+func (cfg Config) validateMigrate() error {
+	switch {
+	case len(cfg.Migrate) == 0:
+		return nil
+	case cfg.Mode != "client" && cfg.Mode != "server":
+		return fmt.Errorf("migrate is a client and server setting")
+	case cfg.StateFile != "":
+		return fmt.Errorf("migrate does not work with state_file")
+	}
+	seen := map[string]bool{transportName(cfg.Transport): true}
+	for _, m := range cfg.Migrate {
+		if m.Transport == "" || m.Address == "" {
+			return fmt.Errorf("migrate: transport and address are required")
+		}
+		if _, err := lookupTransport(m.Transport); err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+		if seen[transportName(m.Transport)] {
+			return fmt.Errorf("migrate: transport %s is already in use", m.Transport)
+		}
+		seen[transportName(m.Transport)] = true
+	}
+	return nil
+}
+
+// transportName returns the name of a configured transport, "udp" when
+// unset or auto.
+func transportName(name string) string {
+	if name == "" || name == AutoTransport {
+		return UDPTransport
+	}
+	return name
+}
+
+// sessionPath is where a session's client is reached: the listener and
+// address it was last heard from, and the sequence number of the packet
+// that moved it there.
+type sessionPath struct {
+	ln   *listener
+	addr net.Addr
+	seq  uint64
+}
+
+// listener returns the listener sess's client is reached through.
+func (sess *serverSession) listener() *listener {
+	return sess.path.Load().ln
+}
+
+// remote returns the address sess's client is reached at.
+func (sess *serverSession) remote() net.Addr {
+	return sess.path.Load().addr
+}
+
+// at reports whether sess's client is reached through ln at addr.
+func (sess *serverSession) at(ln *listener, addr net.Addr) bool {
+	p := sess.path.Load()
+	return p.ln == ln && p.addr.String() == addr.String()
+}
+
+// write sends an outer packet to sess's client.
+func (sess *serverSession) write(pkt []byte) error {
+	p := sess.path.Load()
+	_, err := p.ln.conn.WriteTo(pkt, p.addr)
+	return err
+}
+
+// follow moves sess to ln and addr, where its packet with sequence number
+// seq came from, when its client migrated there from another transport. A
+// packet sent before the move that arrives late the old way does not move
+// it back.
+func (s *Server) follow(sess *serverSession, ln *listener, addr net.Addr, seq uint64) {
+	if len(s.cfg.Migrate) == 0 {
+		return
+	}
+	for {
+		p := sess.path.Load()
+		if ln == p.ln || seq <= p.seq {
+			return
+		}
+		if sess.path.CompareAndSwap(p, &sessionPath{ln: ln, addr: addr, seq: seq}) {
+			log.Printf("Session %08x moved from %s over %s to %s over %s", sess.id, p.addr, p.ln.transport, addr, ln.transport)
+			return
+		}
+	}
+}
+
+// answerPathProbe echoes a client's probe of another transport back the
+// way it came. A server without migrate does not answer, so the client
+// does not move there.
+func (s *Server) answerPathProbe(sess *serverSession, ln *listener, addr net.Addr, dec []byte) {
+	if len(s.cfg.Migrate) == 0 {
+		return
+	}
+	if pkt, err := sealPacket(sess.keys.send, protocol.MsgPathProbe, sess.id, dec); err == nil {
+		ln.conn.WriteTo(pkt, addr)
+	}
+}
+
+// transportPath returns the transport and address of the i'th way to the
+// server: 0 is transport at the server in use, higher values are migrate
+// entries.
+func (c *Client) transportPath(i int) (transport, address string) {
+	if i == 0 {
+		return transportName(c.cfg.Transport), c.serverAddress()
+	}
+	m := c.cfg.Migrate[i-1]
+	return transportName(m.Transport), m.Address
+}
+
+// currentTransport returns the transport in use and the server address it
+// reaches.
+func (c *Client) currentTransport() (transport, address string) {
+	return c.transportPath(int(c.transport.Load()))
+}
+
+// migrateAway moves the session to the next transport that answers a
+// probe, after the one in use went quiet, and reports whether it moved.
+// It stays put within migrateHold of the last move.
+func (c *Client) migrateAway() bool {
+	n := len(c.cfg.Migrate) + 1
+	if n == 1 || c.session.Load() == nil || time.Since(c.migratedAt.Load()) < migrateHold {
+		return false
+	}
+	cur := int(c.transport.Load())
+	from, _ := c.currentTransport()
+	for k := 1; k < n && c.ctx.Err() == nil; k++ {
+		i := (cur + k) % n
+		conn, err := c.probePath(i)
+		if err != nil {
+			name, address := c.transportPath(i)
+			log.Printf("Transport %s at %s: %v", name, address, err)
+			continue
+		}
+		c.useTransport(i, conn)
+		to, _ := c.currentTransport()
+		log.Printf("Transport %s went quiet; moved the session to %s", from, to)
+		if lowBandwidth(to) {
+			log.Printf("Transport %s is low bandwidth; expect a slow tunnel", to)
+		}
+		return true
+	}
+	return false
+}
+
+// loopMigrate probes the transport a client migrated away from and moves
+// back once enough probes in a row are answered. A low_power client does
+// not probe while the tunnel is idle.
+func (c *Client) loopMigrate() {
+	defer c.wg.Done()
+	defer c.journal.guard()
+	ticker := time.NewTicker(migrateProbeInterval)
+	defer ticker.Stop()
+	ok := 0
+	var seen uint64
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if c.transport.Load() == 0 || time.Since(c.migratedAt.Load()) < migrateHold {
+			ok = 0
+			continue
+		}
+		if c.cfg.LowPower {
+			n := c.stats.packetsIn.Load() + c.stats.packetsOut.Load()
+			if n == seen {
+				continue
+			}
+			seen = n
+		}
+		conn, err := c.probePath(0)
+		if err != nil {
+			ok = 0
+			continue
+		}
+		if ok++; ok < migrateProbes {
+			conn.Close()
+			continue
+		}
+		ok = 0
+		from, _ := c.currentTransport()
+		c.useTransport(0, conn)
+		to, _ := c.currentTransport()
+		log.Printf("Transport %s answers again; moved the session back from %s", to, from)
+	}
+}
+
+// useTransport moves the session to the i'th transport, over conn, and
+// sends a keepalive there so the server follows at once.
+func (c *Client) useTransport(i int, conn outerConn) {
+	c.rebindMu.Lock()
+	old := c.conn.Swap(&clientConn{conn})
+	c.transport.Store(int32(i))
+	c.migratedAt.Store(time.Now())
+	c.lastRecv.Store(time.Now())
+	c.rebindMu.Unlock()
+	old.Close()
+	c.resetNATProbe()
+	c.sendKeepalive()
+	c.rememberNetwork()
+}
+
+// probePath sends a path probe over the i'th transport, under the current
+// session's keys, and returns the socket once the server echoes it: the
+// session can carry on there without a handshake.
+func (c *Client) probePath(i int) (outerConn, error) {
+	sess := c.session.Load()
+	if sess == nil {
+		return nil, fmt.Errorf("no session")
+	}
+	nonce, err := crypto.RandomBytes(pathProbeSize)
+	if err != nil {
+		return nil, err
+	}
+	pkt, err := sealPacket(sess.keys.send, protocol.MsgPathProbe, sess.id, nonce)
+	if err != nil {
+		return nil, err
+	}
+	name, address := c.transportPath(i)
+	conn, err := c.dialTransport(name, address)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.AfterFunc(HandshakeTimeout, func() { conn.Close() })
+	if _, err := conn.Write(pkt); err != nil {
+		timer.Stop()
+		conn.Close()
+		return nil, err
+	}
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("no answer within %v", HandshakeTimeout)
+		}
+		h, payload, err := protocol.ParseHeader(buf[:n])
+		if err != nil || h.Type != protocol.MsgPathProbe || h.Session != sess.id {
+			continue
+		}
+		dec, _, err := sess.keys.recv.DecryptAppend(nil, payload)
+		if err != nil || !bytes.Equal(dec, nonce) {
+			continue
+		}
+		if !timer.Stop() {
+			return nil, fmt.Errorf("no answer within %v", HandshakeTimeout)
+		}
+		return conn, nil
+	}
+}
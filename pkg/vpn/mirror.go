@@ -0,0 +1,157 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/pcap"
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// mirrorQueue is how many copies may wait for the mirror's writer before
+// more are dropped, so a slow IDS never holds up the tunnel.
+const mirrorQueue = 4096
+
+// MirrorConfig copies decrypted client traffic, on a server, to an
+// out-of-band IDS such as Suricata.
+type MirrorConfig struct {
+	// Interface is a TUN interface, created on Linux, that copies are
+	// written to for tools that sniff an interface.
+	Interface string `yaml:"interface"`
+	// Pcap serves copies as a pcap stream to readers connecting to this
+	// address: host:port, or unix:/path/to.sock.
+	Pcap string `yaml:"pcap"`
+	// Sample is the share of packets copied, such as 0.1; 0 copies all.
+	Sample float64 `yaml:"sample"`
+	// Clients limits mirroring to these provisioned names or client
+	// labels; empty mirrors every client.
+	Clients []string `yaml:"clients"`
+}
+
+// Enabled reports whether anywhere to mirror to is configured.
+func (c MirrorConfig) Enabled() bool {
+	return c.Interface != "" || c.Pcap != ""
+}
+
+func (c MirrorConfig) validate(mode string) error {
+	if !c.Enabled() {
+		if c.Sample != 0 || len(c.Clients) > 0 {
+			return fmt.Errorf("mirror: set interface or pcap")
+		}
+		return nil
+	}
+	if mode != "server" {
+		return fmt.Errorf("mirror is a server setting")
+	}
+	if c.Interface != "" && runtime.GOOS != "linux" {
+		return fmt.Errorf("mirror: interface is only supported on Linux; use pcap")
+	}
+	if c.Sample < 0 || c.Sample > 1 {
+		return fmt.Errorf("mirror: sample must be between 0 and 1")
+	}
+	if c.Pcap != "" && !strings.HasPrefix(c.Pcap, "unix:") {
+		if _, _, err := net.SplitHostPort(c.Pcap); err != nil {
+			return fmt.Errorf("mirror: pcap: %w", err)
+		}
+	}
+	return nil
+}
+
+// mirror copies the traffic of the sessions it selects to the interface
+// and pcap readers, from a queue of its own.
+type mirror struct {
+	cfg     MirrorConfig
+	clients map[string]bool
+	dev     tun.Device   // nil unless interface is set
+	pcap    *pcap.Server // nil unless pcap is set
+	queue   chan mirrored
+	dropped atomic.Uint64
+}
+
+type mirrored struct {
+	at  time.Time
+	pkt []byte
+}
+
+// startMirror opens what cfg mirrors to and starts copying until ctx is
+// done.
+func startMirror(ctx context.Context, cfg MirrorConfig) (*mirror, error) {
+	m := &mirror{cfg: cfg, queue: make(chan mirrored, mirrorQueue)}
+	if len(cfg.Clients) > 0 {
+		m.clients = make(map[string]bool, len(cfg.Clients))
+		for _, c := range cfg.Clients {
+			m.clients[c] = true
+		}
+	}
+	if cfg.Interface != "" {
+		dev, err := openMirrorInterface(cfg.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("mirror: %w", err)
+		}
+		m.dev = dev
+		log.Printf("Mirroring client traffic to interface %s", cfg.Interface)
+	}
+	if cfg.Pcap != "" {
+		srv, err := pcap.Listen(ctx, cfg.Pcap)
+		if err != nil {
+			if m.dev != nil {
+				m.dev.Close()
+			}
+			return nil, fmt.Errorf("mirror: %w", err)
+		}
+		m.pcap = srv
+		log.Printf("Mirroring client traffic as pcap on %s", cfg.Pcap)
+	}
+	go m.run(ctx)
+	return m, nil
+}
+
+// copy queues pkt, one of sess's packets in either direction, if sess is
+// mirrored and the sample picks it. m may be nil.
+func (m *mirror) copy(sess *serverSession, pkt []byte) {
+	if m == nil {
+		return
+	}
+	if m.clients != nil && !m.clients[sess.name] && !m.clients[sess.label] {
+		return
+	}
+	if m.cfg.Sample > 0 && rand.Float64() >= m.cfg.Sample {
+		return
+	}
+	select {
+	case m.queue <- mirrored{time.Now(), append([]byte(nil), pkt...)}:
+	default:
+		m.dropped.Add(1)
+	}
+}
+
+func (m *mirror) run(ctx context.Context) {
+	defer func() {
+		if m.dev != nil {
+			m.dev.Close()
+		}
+		if n := m.dropped.Load(); n > 0 {
+			log.Printf("Mirror dropped %d packets it could not keep up with", n)
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-m.queue:
+			if m.dev != nil {
+				m.dev.WritePacket(c.pkt)
+			}
+			if m.pcap != nil {
+				m.pcap.Write(c.at, c.pkt)
+			}
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package vpn
+
+import "github.com/gedons/go_VPN/internal/tun"
+
+// openMirrorInterface creates the TUN interface mirror.interface names.
+func openMirrorInterface(name string) (tun.Device, error) {
+	return tun.OpenMirror(name)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// openMirrorInterface is only available on Linux.
+func openMirrorInterface(name string) (tun.Device, error) {
+	return nil, fmt.Errorf("mirror interface on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
@@ -0,0 +1,199 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+const (
+	// maxAdaptiveKeepalive bounds the interval adaptive_keepalive settles
+	// on, at half DefaultSessionTimeout, so a server still keeps the
+	// session across a lost keepalive.
+	maxAdaptiveKeepalive = 90 * time.Second
+
+	// maxAckDelay bounds how long a server holds a delayed keepalive ack.
+	maxAckDelay = 5 * time.Minute
+)
+
+// natProbe finds how long the NAT in front of a client keeps an idle UDP
+// mapping. A probe is a keepalive asking the server to delay its ack; the
+// client sends nothing until the ack arrives or is given up on, so the ack
+// only gets through if the mapping outlived the delay. Each probe that gets
+// through lengthens the next, and the interval settles just below the
+// longest that did.
+type natProbe struct {
+	mu       sync.Mutex
+	interval time.Duration // keepalive in use; the configured one if zero
+	survived time.Duration // longest idle time the mapping outlived
+	delay    time.Duration // of the probe awaiting its ack, zero if none
+	sentAt   time.Time
+	sentOut  uint64 // packets sent through the tunnel when it went out
+	done     bool   // settled, or given up on
+}
+
+// keepaliveInterval is how often the client sends keepalives: the one
+// adaptive_keepalive settled on, or the configured one.
+func (c *Client) keepaliveInterval() time.Duration {
+	c.natProbe.mu.Lock()
+	defer c.natProbe.mu.Unlock()
+	if c.natProbe.interval > 0 {
+		return c.natProbe.interval
+	}
+	return c.cfg.keepaliveInterval()
+}
+
+// keepaliveTimeout is how long the server may stay silent before the
+// session is considered dead, stretched while a probe waits for its ack.
+func (c *Client) keepaliveTimeout() time.Duration {
+	timeout := 3 * c.keepaliveInterval()
+	c.natProbe.mu.Lock()
+	defer c.natProbe.mu.Unlock()
+	if p := &c.natProbe; p.delay > 0 {
+		timeout = max(timeout, c.cfg.keepaliveInterval()+p.delay+HandshakeTimeout)
+	}
+	return timeout
+}
+
+// startNATProbe sends the next probe when adaptive_keepalive is still
+// looking for the NAT's timeout, and reports whether it did.
+func (c *Client) startNATProbe() bool {
+	sess := c.session.Load()
+	if !c.cfg.AdaptiveKeepalive || sess == nil {
+		return false
+	}
+	p := &c.natProbe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done || p.delay > 0 {
+		return false
+	}
+	delay := 2 * c.cfg.keepaliveInterval()
+	if p.survived > 0 {
+		delay = p.survived * 3 / 2
+	}
+	delay = min(delay, maxAdaptiveKeepalive).Round(time.Second)
+	now := time.Now()
+	payload := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(delay/time.Second))
+	pkt, err := sealPacket(sess.keys.send, protocol.MsgKeepalive, sess.id, payload)
+	if err != nil {
+		return false
+	}
+	p.delay, p.sentAt, p.sentOut = delay, now, c.stats.packetsOut.Load()
+	c.udp().Write(pkt)
+	return true
+}
+
+// natProbing reports whether a probe is out, during which nothing may be
+// sent, or just ended. A probe cut short is followed by a plain keepalive,
+// whose ack shows the server is still there. A probe whose ack is overdue
+// ends the search: the mapping is gone, so the session is handshaken again
+// from a fresh one.
+func (c *Client) natProbing() bool {
+	p := &c.natProbe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.delay == 0 {
+		return false
+	}
+	switch {
+	case c.stats.packetsOut.Load() != p.sentOut || c.lastHandshake.Load().After(p.sentAt):
+		// Traffic kept the mapping alive, or the ack would come under
+		// old keys: try again later.
+		p.delay = 0
+		c.sendKeepalive()
+		return true
+	case time.Since(p.sentAt) < p.delay+HandshakeTimeout:
+		return true
+	}
+	lost := p.delay
+	p.settleLocked(c.cfg.keepaliveInterval())
+	p.delay = 0
+	if p.survived > 0 {
+		log.Printf("Keepalive interval %s: the NAT drops idle mappings after %s to %s", p.interval, p.survived, lost)
+	} else {
+		log.Printf("Keepalive interval %s: the NAT drops idle mappings within %s", c.cfg.keepaliveInterval(), lost)
+	}
+	c.markStale()
+	return true
+}
+
+// natProbeAck takes the ack of a probe, dec being its payload, received at
+// now.
+func (c *Client) natProbeAck(dec []byte, now time.Time) {
+	p := &c.natProbe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Only the ack of the probe out now counts, not a late one of a
+	// probe cut short.
+	delay := time.Duration(binary.BigEndian.Uint16(dec[8:])) * time.Second
+	if p.delay == 0 || int64(binary.BigEndian.Uint64(dec)) != p.sentAt.UnixNano() {
+		return
+	}
+	p.delay = 0
+	switch {
+	case now.Sub(p.sentAt) < delay-time.Second:
+		// A server from an older release acks at once.
+		p.done = true
+		log.Printf("Server does not delay keepalive acks; keepalive interval stays %s", c.cfg.keepaliveInterval())
+	case c.stats.packetsOut.Load() != p.sentOut:
+	default:
+		p.survived = delay
+		if delay >= maxAdaptiveKeepalive {
+			p.settleLocked(c.cfg.keepaliveInterval())
+			log.Printf("Keepalive interval %s: the NAT keeps idle mappings at least %s", p.interval, delay)
+		}
+	}
+}
+
+// settleLocked ends the search on the longest idle time the mapping
+// outlived, or on base when it outlived none. Callers must hold mu.
+func (p *natProbe) settleLocked(base time.Duration) {
+	p.done = true
+	p.interval = max(p.survived*9/10, base).Round(time.Second)
+}
+
+// resetNATProbe starts the search over, after the client moved to another
+// network and so, probably, behind another NAT.
+func (c *Client) resetNATProbe() {
+	p := &c.natProbe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interval, p.survived, p.delay, p.done = 0, 0, 0, false
+}
+
+// ackKeepalive echoes a keepalive so the client can measure the round
+// trip. A keepalive carrying a delay is acked that much later, to the
+// address it came from; a session has one such ack waiting at most, the
+// latest.
+func (s *Server) ackKeepalive(sess *serverSession, ln *listener, addr net.Addr, dec []byte) {
+	send := func(dec []byte) {
+		if ack, err := sealPacket(sess.keys.send, protocol.MsgKeepaliveAck, sess.id, dec); err == nil {
+			ln.conn.WriteTo(ack, addr)
+		}
+	}
+	if len(dec) < 10 {
+		send(dec)
+		return
+	}
+	delay := time.Duration(binary.BigEndian.Uint16(dec[8:])) * time.Second
+	if delay > maxAckDelay {
+		return
+	}
+	// Sealed when sent, so its sequence number is current then.
+	dec = slices.Clone(dec)
+	t := time.AfterFunc(delay, func() {
+		if s.ctx.Err() == nil {
+			send(dec)
+		}
+	})
+	if old := sess.delayedAck.Swap(t); old != nil {
+		old.Stop()
+	}
+}
@@ -0,0 +1,31 @@
+package vpn
+
+import (
+	"context"
+	"net/netip"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// openTunInNamespace opens the adapter inside cfg.Netns. A client also
+// routes its routes into it there, since the namespace has no other way
+// out.
+func openTunInNamespace(ctx context.Context, cfg Config, cidr string) (tun.Device, error) {
+	dev, err := tun.OpenInNamespace(ctx, cfg.AdapterName, cidr, cfg.Netns)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Mode == "client" {
+		for _, r := range cfg.routes() {
+			p, err := netip.ParsePrefix(r)
+			if err == nil {
+				err = dev.AddRoute(p)
+			}
+			if err != nil {
+				dev.Close()
+				return nil, err
+			}
+		}
+	}
+	return dev, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// openTunInNamespace is only available on Linux.
+func openTunInNamespace(ctx context.Context, cfg Config, cidr string) (tun.Device, error) {
+	return nil, fmt.Errorf("netns on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
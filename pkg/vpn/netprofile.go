@@ -0,0 +1,211 @@
+package vpn
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/netmon"
+)
+
+// maxNetworkProfiles bounds the networks a client remembers; the one seen
+// longest ago is forgotten first.
+const maxNetworkProfiles = 64
+
+// networkProfile is what worked on one network: the transport, the server
+// address it reached, and the tunnel MTU.
+type networkProfile struct {
+	Transport string    `json:"transport"`
+	Endpoint  string    `json:"endpoint"`
+	MTU       int       `json:"mtu,omitempty"`
+	Seen      time.Time `json:"seen"`
+}
+
+// networkCache holds a client's network profiles, keyed by netmon.Network,
+// or by "" where the network cannot be told.
+type networkCache struct {
+	mu       sync.Mutex
+	path     string // empty when network_cache is off
+	network  string // the network the host is on
+	profiles map[string]networkProfile
+}
+
+// networkCacheFile is where the client keeps its network profiles, empty
+// when network_cache is off.
+func (cfg Config) networkCacheFile() string {
+	switch cfg.NetworkCache {
+	case "off":
+		return ""
+	case "":
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			dir = os.TempDir()
+		}
+		return filepath.Join(dir, "govpn", cfg.AdapterName+".networks.json")
+	}
+	return cfg.NetworkCache
+}
+
+// openNetworkCache reads the profiles at path, if any, and identifies the
+// network the host is on.
+func openNetworkCache(path string) *networkCache {
+	nc := &networkCache{path: path, profiles: make(map[string]networkProfile)}
+	if path == "" {
+		return nc
+	}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &nc.profiles); err != nil {
+			log.Printf("Network cache %s: %v", path, err)
+		}
+	}
+	nc.identify()
+	return nc
+}
+
+// identify looks up the network the host is on, and reports whether it
+// is another than before.
+func (nc *networkCache) identify() bool {
+	if nc.path == "" {
+		return false
+	}
+	network, _ := netmon.Network()
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	changed := network != nc.network
+	nc.network = network
+	return changed
+}
+
+// lookup returns the profile of the network the host is on.
+func (nc *networkCache) lookup() (networkProfile, bool) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	p, ok := nc.profiles[nc.network]
+	return p, ok && nc.path != ""
+}
+
+// remember records p as what worked on the network the host is on, and
+// saves the profiles when that is news.
+func (nc *networkCache) remember(p networkProfile) {
+	if nc.path == "" {
+		return
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	prev, ok := nc.profiles[nc.network]
+	p.Seen = time.Now()
+	nc.profiles[nc.network] = p
+	if ok && prev.Transport == p.Transport && prev.Endpoint == p.Endpoint && prev.MTU == p.MTU && p.Seen.Sub(prev.Seen) < time.Hour {
+		return
+	}
+	for len(nc.profiles) > maxNetworkProfiles {
+		oldest := slices.MinFunc(slices.Collect(maps.Keys(nc.profiles)), func(a, b string) int {
+			return nc.profiles[a].Seen.Compare(nc.profiles[b].Seen)
+		})
+		delete(nc.profiles, oldest)
+	}
+	if err := nc.saveLocked(); err != nil {
+		log.Printf("Network cache %s: %v", nc.path, err)
+	}
+}
+
+func (nc *networkCache) saveLocked() error {
+	b, err := json.MarshalIndent(nc.profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(nc.path), 0o700); err != nil {
+		return err
+	}
+	tmp := nc.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, nc.path)
+}
+
+// rememberNetwork records the transport, server address and MTU in use as
+// what works on the network the host is on.
+func (c *Client) rememberNetwork() {
+	if c.session.Load() == nil {
+		return
+	}
+	p := networkProfile{}
+	p.Transport, p.Endpoint = c.currentTransport()
+	if o := c.options.Load(); o != nil {
+		p.MTU = o.mtu
+	}
+	c.networks.remember(p)
+}
+
+// pathIndex returns the index of the way to the server over transport at
+// address, as transportPath numbers them, with the endpoint it uses; ok is
+// false when the config no longer has it.
+func (c *Client) pathIndex(transport, address string) (i, endpoint int, ok bool) {
+	if transport == transportName(c.cfg.Transport) {
+		endpoint = slices.Index(c.cfg.endpoints(), address)
+		return 0, endpoint, endpoint >= 0
+	}
+	for j, m := range c.cfg.Migrate {
+		if transportName(m.Transport) == transport && m.Address == address {
+			return j + 1, int(c.endpoint.Load()), true
+		}
+	}
+	return 0, 0, false
+}
+
+// applyNetworkProfile moves the outer socket to the transport and server
+// address that worked on the network the host is on, when they are not in
+// use already, so the next handshake goes straight there. It reports
+// whether it moved.
+func (c *Client) applyNetworkProfile() bool {
+	p, ok := c.networks.lookup()
+	if !ok {
+		return false
+	}
+	i, endpoint, ok := c.pathIndex(p.Transport, p.Endpoint)
+	if !ok || i == int(c.transport.Load()) && endpoint == int(c.endpoint.Load()) {
+		return false
+	}
+	conn, err := c.dialTransport(p.Transport, p.Endpoint)
+	if err != nil {
+		log.Printf("Network profile: %v", err)
+		return false
+	}
+	c.rebindMu.Lock()
+	old := c.conn.Swap(&clientConn{conn})
+	c.endpoint.Store(int32(endpoint))
+	c.transport.Store(int32(i))
+	if i > 0 {
+		c.migratedAt.Store(time.Now())
+	}
+	c.rebindMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	log.Printf("Using %s at %s, which worked on this network before", p.Transport, p.Endpoint)
+	return true
+}
+
+// mtuHint returns the tunnel MTU that worked on the network the host is
+// on, for the Hello.
+func (c *Client) mtuHint() int {
+	if p, ok := c.networks.lookup(); ok {
+		return p.MTU
+	}
+	return 0
+}
+
+// validateNetworkCache checks network_cache, a client setting.
+func (cfg Config) validateNetworkCache() error {
+	if cfg.NetworkCache != "" && cfg.Mode != "client" {
+		return fmt.Errorf("network_cache is a client setting")
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+
+	"github.com/gedons/go_VPN/internal/tun"
+	"github.com/gedons/go_VPN/internal/udpgso"
+)
+
+// validateUDPOffload checks udp_offload, which batches the sends and
+// receives of plain UDP sockets on Linux.
+func (cfg Config) validateUDPOffload() error {
+	switch {
+	case !cfg.UDPOffload:
+		return nil
+	case cfg.Mode != "client" && cfg.Mode != "server":
+		return fmt.Errorf("udp_offload is a client and server setting")
+	case runtime.GOOS != "linux":
+		return fmt.Errorf("udp_offload is only supported on Linux")
+	case cfg.Transport != "" && cfg.Transport != UDPTransport || cfg.Encapsulation != "" || len(cfg.Migrate) > 0:
+		return fmt.Errorf("udp_offload needs plain UDP; unset transport, encapsulation and migrate")
+	case cfg.FastPath != "":
+		return fmt.Errorf("udp_offload does not work with fast_path")
+	}
+	return nil
+}
+
+// batchWriter is an outer socket that sends a run of datagrams, all of
+// size bytes but the last, to one address with a single syscall.
+type batchWriter interface {
+	WriteBatch(buf []byte, size int, addr net.Addr) error
+}
+
+// txBatch gathers the outer packets sealed from one batch of adapter reads
+// into a run to one address, sent once the batch is done or the next
+// packet cannot join it. Its out is scratch space for sealing, used with
+// or without offload.
+type txBatch struct {
+	out   []byte
+	w     batchWriter // the socket the run goes out of
+	addr  net.Addr    // nil for a connected socket
+	sess  *serverSession
+	run   []byte
+	size  int   // of the run's datagrams, the last possibly shorter
+	inner []int // lengths of the inner packets the run carries
+}
+
+// scratch returns tx's scratch space, nil for a nil tx.
+func (tx *txBatch) scratch() []byte {
+	if tx == nil {
+		return nil
+	}
+	return tx.out
+}
+
+// fits reports whether an outer packet of n bytes, to addr through w, can
+// join the run.
+func (tx *txBatch) fits(w batchWriter, addr net.Addr, n int) bool {
+	switch {
+	case len(tx.inner) == 0:
+		return true
+	case w != tx.w || addr != tx.addr:
+		return false
+	case len(tx.inner) == udpgso.MaxSegments || len(tx.run)+n > udpgso.MaxBytes:
+		return false
+	}
+	// Only the last datagram may be shorter than the rest.
+	return n <= tx.size && len(tx.run) == len(tx.inner)*tx.size
+}
+
+// add appends pkt, an outer packet carrying inner bytes, to the run. The
+// caller checks it fits first.
+func (tx *txBatch) add(w batchWriter, addr net.Addr, sess *serverSession, pkt []byte, inner int) {
+	if len(tx.inner) == 0 {
+		tx.w, tx.addr, tx.sess, tx.size = w, addr, sess, len(pkt)
+	}
+	tx.run = append(tx.run, pkt...)
+	tx.inner = append(tx.inner, inner)
+}
+
+// send sends the run, if any, and returns the inner packet lengths it
+// carried and the error.
+func (tx *txBatch) send() ([]int, error) {
+	if len(tx.inner) == 0 {
+		return nil, nil
+	}
+	inner := tx.inner
+	err := tx.w.WriteBatch(tx.run, tx.size, tx.addr)
+	tx.run, tx.inner = tx.run[:0], tx.inner[:0]
+	tx.w, tx.addr, tx.sess = nil, nil, nil
+	return inner, err
+}
+
+// tunReader reads packets from an adapter one at a time or, with ch set,
+// in batches of all those waiting, which a goroutine running feed reads
+// ahead.
+type tunReader struct {
+	dev tun.Device
+	ch  chan []byte
+}
+
+// newTunReader returns a reader of dev that batches when batch is set; the
+// caller then runs feed.
+func newTunReader(dev tun.Device, batch bool) *tunReader {
+	r := &tunReader{dev: dev}
+	if batch {
+		r.ch = make(chan []byte, udpgso.MaxSegments)
+	}
+	return r
+}
+
+// feed reads packets from the adapter ahead of read until the adapter is
+// closed or ctx is done.
+func (r *tunReader) feed(ctx context.Context) {
+	defer close(r.ch)
+	for {
+		pkt, err := r.dev.ReadPacket()
+		if errors.Is(err, tun.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		select {
+		case r.ch <- pkt:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// read waits for a packet and appends it to pkts, followed, when
+// batching, by every packet already waiting, up to a run's worth.
+func (r *tunReader) read(pkts [][]byte) ([][]byte, error) {
+	if r.ch == nil {
+		pkt, err := r.dev.ReadPacket()
+		if err != nil {
+			return pkts, err
+		}
+		return append(pkts, pkt), nil
+	}
+	pkt, ok := <-r.ch
+	if !ok {
+		return pkts, tun.ErrClosed
+	}
+	pkts = append(pkts, pkt)
+	for len(pkts) < udpgso.MaxSegments {
+		select {
+		case pkt, ok := <-r.ch:
+			if !ok {
+				return pkts, nil
+			}
+			pkts = append(pkts, pkt)
+		default:
+			return pkts, nil
+		}
+	}
+	return pkts, nil
+}
+
+// openOffload turns on UDP GSO and GRO for udp, which it returns wrapped,
+// or returns nil and logs why not.
+func openOffload(udp *net.UDPConn) *udpgso.Conn {
+	conn, err := udpgso.Open(udp)
+	if err != nil {
+		log.Printf("UDP offload on %s unavailable, sending one datagram at a time: %v", udp.LocalAddr(), err)
+		return nil
+	}
+	return conn
+}
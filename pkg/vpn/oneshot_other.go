@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// routeOnce is only available on Linux and macOS.
+func (c *Client) routeOnce() error {
+	return fmt.Errorf("routes on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
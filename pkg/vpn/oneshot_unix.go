@@ -0,0 +1,39 @@
+//go:build linux || darwin
+
+package vpn
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// routeOnce routes the client's routes into the adapter, once: for a
+// sidecar giving its pod egress through the tunnel, and on macOS, where
+// the client installs its routes itself. The server's address is pinned
+// to the path it takes now first, so the tunnel does not carry itself.
+// Nothing is undone on Stop: the routes go with the adapter.
+func (c *Client) routeOnce() error {
+	r, ok := c.tunMgr.(tun.Router)
+	if !ok {
+		return fmt.Errorf("routes: the adapter cannot take routes")
+	}
+	if conn := c.conn.Load(); conn != nil {
+		if ap, err := netip.ParseAddrPort(conn.RemoteAddr().String()); err == nil {
+			if err := tun.PinHostRoute(ap.Addr().Unmap()); err != nil {
+				return fmt.Errorf("routes: pin the server's route: %w", err)
+			}
+		}
+	}
+	for _, s := range c.cfg.routes() {
+		p, err := netip.ParsePrefix(s)
+		if err == nil {
+			err = r.AddRoute(p)
+		}
+		if err != nil {
+			return fmt.Errorf("routes: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// minPushedMTU is the smallest mtu a server may push; IPv4 requires hosts
+// to handle 576-byte packets.
+const minPushedMTU = 576
+
+// pushedOptions are the settings beyond addresses and DNS servers that a
+// server pushed in its Welcome.
+type pushedOptions struct {
+	domains []string
+	mtu     int
+	ntp     []string
+	routes  []string
+}
+
+// validateOptions checks search_domains, mtu, and ntp_servers.
+func (c Config) validateOptions() error {
+	if c.MTU != 0 && (c.MTU < minPushedMTU || c.MTU > 65535) {
+		return fmt.Errorf("mtu must be between %d and 65535", minPushedMTU)
+	}
+	for _, d := range c.SearchDomains {
+		if d == "" || strings.ContainsAny(d, " \t,") {
+			return fmt.Errorf("search_domains: invalid domain %q", d)
+		}
+	}
+	for _, n := range c.NTPServers {
+		if n == "" || strings.ContainsAny(n, " \t,") {
+			return fmt.Errorf("ntp_servers: invalid server %q", n)
+		}
+	}
+	return nil
+}
+
+// applyOptions applies the MTU and routes the server pushed and, with
+// apply_ntp, its time servers; search domains go with the DNS servers.
+// Settings the adapter cannot take are still recorded for the status,
+// where an embedding app can pick them up.
+func (c *Client) applyOptions(w *protocol.Welcome) {
+	prev := c.options.Load()
+	if prev == nil {
+		prev = &pushedOptions{}
+	}
+	opts := &pushedOptions{domains: w.Domains, mtu: w.MTU, ntp: w.NTP, routes: w.Routes}
+	setter, _ := c.tunMgr.(tun.OptionSetter)
+	if opts.mtu != prev.mtu && opts.mtu != 0 {
+		if setter != nil {
+			if err := setter.SetMTU(opts.mtu); err != nil {
+				log.Printf("Set MTU %d: %v", opts.mtu, err)
+			}
+		}
+		log.Printf("Using MTU %d", opts.mtu)
+	}
+	if !slices.Equal(opts.ntp, prev.ntp) && len(opts.ntp) > 0 {
+		if c.cfg.ApplyNTP {
+			if err := setNTPServers(opts.ntp); err != nil {
+				log.Printf("Set NTP servers %s: %v", strings.Join(opts.ntp, ","), err)
+			} else {
+				log.Printf("Using NTP servers %s", strings.Join(opts.ntp, ","))
+			}
+		} else {
+			log.Printf("Server offers NTP servers %s; set apply_ntp to use them", strings.Join(opts.ntp, ","))
+		}
+	}
+	if !slices.Equal(opts.routes, prev.routes) {
+		c.applyRoutes(opts.routes, prev.routes)
+	}
+	c.options.Store(opts)
+}
+
+// applyRoutes routes the pushed routes not routed before into the adapter.
+// Routes the server stops pushing stay until the adapter goes away.
+func (c *Client) applyRoutes(routes, prev []string) {
+	r, ok := c.tunMgr.(tun.Router)
+	for _, s := range routes {
+		if slices.Contains(prev, s) {
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			log.Printf("Server pushed an invalid route %q", s)
+			continue
+		}
+		if !c.routeAllowed(p) {
+			continue
+		}
+		if !ok {
+			log.Printf("Server pushes route %s, which this adapter cannot take", p)
+			continue
+		}
+		if err := r.AddRoute(p); err != nil {
+			log.Printf("Add route %s: %v", p, err)
+			continue
+		}
+		log.Printf("Routing %s into the tunnel", p)
+	}
+}
@@ -0,0 +1,290 @@
+package vpn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// p2pPeer names the other end of a p2p link, in logs, events and the
+// client list, and owns its allowed_ips.
+const p2pPeer = "peer"
+
+// validateP2P checks the settings of mode p2p: both ends run the same
+// config shape, with the other's networks in allowed_ips.
+func (cfg Config) validateP2P() error {
+	if cfg.Mode != "p2p" {
+		switch {
+		case cfg.PeerAddress != "":
+			return fmt.Errorf("peer_address is a p2p setting")
+		case len(cfg.AllowedIPs) > 0:
+			return fmt.Errorf("allowed_ips is a p2p setting")
+		case cfg.Relay != "":
+			return fmt.Errorf("relay is a p2p setting")
+		}
+		return nil
+	}
+	switch {
+	case cfg.AdapterIPCIDR == AutoAddress:
+		return fmt.Errorf("p2p peers need a fixed adapter_ip_cidr")
+	case cfg.Pool != "" || cfg.Pool6 != "" || cfg.DelegatePool != "":
+		return fmt.Errorf("p2p peers do not lease addresses; unset the pools")
+	case cfg.ClientsFile != "":
+		return fmt.Errorf("clients_file cannot be combined with mode p2p")
+	case cfg.Auth.Enabled():
+		return fmt.Errorf("auth cannot be combined with mode p2p")
+	case cfg.Cluster.Enabled():
+		return fmt.Errorf("cluster cannot be combined with mode p2p")
+	}
+	if cfg.PeerAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.PeerAddress); err != nil {
+			return fmt.Errorf("peer_address: %w", err)
+		}
+	}
+	if cfg.Relay != "" {
+		if _, _, err := net.SplitHostPort(cfg.Relay); err != nil {
+			return fmt.Errorf("relay: %w", err)
+		}
+		if cfg.Transport != "" && cfg.Transport != "udp" || cfg.Encapsulation != "" {
+			return fmt.Errorf("relay needs plain UDP; unset transport and encapsulation")
+		}
+	}
+	_, err := parseAllowedIPs(cfg.AllowedIPs)
+	return err
+}
+
+// peerLink is the initiating side of a p2p peer with peer_address: it
+// handshakes with the other peer whenever there is no live session, and
+// keeps the session alive. Either peer may initiate; when both do at once,
+// the Hello with the lower nonce wins on both ends.
+type peerLink struct {
+	hs  *crypto.Cipher
+	psk string
+
+	// relayID binds this peer to the relay, nil without one.
+	relayID []byte
+
+	// nonce and transcript are those of the Hello awaiting a Welcome,
+	// nil when none is.
+	mu         sync.Mutex
+	nonce      []byte
+	transcript []byte
+	silent     bool // the last session went silent, so it was logged
+	attempts   int  // Hellos sent since the last Welcome
+}
+
+// newPeerLink sets up the link for a p2p peer with peer_address or relay.
+func (s *Server) newPeerLink() (*peerLink, error) {
+	p := &peerLink{hs: s.psks[0].hs, psk: s.psks[0].psk}
+	if s.cfg.Relay != "" {
+		id, err := relayLinkID(p.psk)
+		if err != nil {
+			return nil, fmt.Errorf("relay: %w", err)
+		}
+		p.relayID = id
+	}
+	return p, nil
+}
+
+// loopPeer handshakes with peer_address until a session is up, then keeps
+// it alive with keepalives, and handshakes again when it goes silent. With
+// a relay it also keeps this peer bound to it, so the other peer can reach
+// this one through it.
+func (s *Server) loopPeer() {
+	defer s.wg.Done()
+	defer s.journal.guard()
+	ticker := time.NewTicker(s.cfg.keepaliveInterval())
+	defer ticker.Stop()
+	s.bindRelay()
+	if s.cfg.PeerAddress != "" {
+		s.dialPeer()
+	}
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.bindRelay()
+		if s.cfg.PeerAddress == "" {
+			continue
+		}
+		sess := s.peerSession()
+		if sess == nil || time.Since(sess.lastSeen.Load()) > s.cfg.keepaliveTimeout() {
+			s.dialPeer()
+			continue
+		}
+		ts := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+		if pkt, err := sealPacket(sess.keys.send, protocol.MsgKeepalive, sess.id, ts); err == nil {
+			sess.write(pkt)
+		}
+	}
+}
+
+// peerSession returns the session with the other peer, or nil.
+func (s *Server) peerSession() *serverSession {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	for _, sess := range s.sessions {
+		return sess
+	}
+	return nil
+}
+
+// bindRelay sends the relay this link's ID from the first listener, the
+// socket the link's packets leave from.
+func (s *Server) bindRelay() {
+	if s.peer.relayID == nil {
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", s.cfg.Relay)
+	if err != nil {
+		log.Printf("Relay %s: %v", s.cfg.Relay, err)
+		return
+	}
+	pkt := protocol.Header{Type: protocol.MsgRelay}.Append(nil)
+	s.listeners[0].conn.WriteTo(append(pkt, s.peer.relayID...), addr)
+}
+
+// dialPeer sends a Hello to peer_address, resolved afresh, from the first
+// listener, carrying this peer's adapter address. After relayAfter Hellos
+// without an answer it sends them to the relay instead.
+func (s *Server) dialPeer() {
+	p := s.peer
+	p.mu.Lock()
+	viaRelay := p.relayID != nil && p.attempts >= relayAfter
+	if viaRelay && p.attempts == relayAfter {
+		log.Printf("No answer from peer %s; trying relay %s", s.cfg.PeerAddress, s.cfg.Relay)
+	}
+	p.attempts++
+	p.mu.Unlock()
+	target := s.cfg.PeerAddress
+	if viaRelay {
+		target = s.cfg.Relay
+	}
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		log.Printf("Peer %s: %v", target, err)
+		return
+	}
+	nonce, err := crypto.RandomBytes(protocol.NonceSize)
+	if err != nil {
+		return
+	}
+	hello := protocol.NewHello(nonce, time.Now())
+	if s.cfg.MinProtocolVersion != 0 {
+		hello.MinVersion = s.cfg.MinProtocolVersion
+	}
+	hello.Name, _ = os.Hostname()
+	hello.Software = software()
+	hello.FIPS = s.cfg.FIPSMode
+	hello.Static = s.cfg.AdapterIPCIDR
+	pkt, err := sealHandshake(p.hs, protocol.MsgHandshakeInit, 0, hello)
+	if err != nil {
+		log.Printf("Seal hello for %s: %v", addr, err)
+		return
+	}
+	p.mu.Lock()
+	p.nonce, p.transcript = nonce, protocol.Transcript(pkt[protocol.HeaderSize:])
+	if sess := s.peerSession(); !p.silent && sess != nil {
+		p.silent = true
+		log.Printf("Peer %s went silent; handshaking again", sess.remote())
+	}
+	p.mu.Unlock()
+	s.transcript.hello("out", addr, hello)
+	s.listeners[0].conn.WriteTo(pkt, addr)
+}
+
+// outranks reports whether this peer's pending Hello beats the other
+// peer's, whose nonce is theirs, so the other's is dropped. When it does
+// not, this peer gives up its own Hello and answers the other's.
+func (p *peerLink) outranks(theirs []byte) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.nonce == nil {
+		return false
+	}
+	if bytes.Compare(p.nonce, theirs) < 0 {
+		return true
+	}
+	p.nonce, p.transcript = nil, nil
+	return false
+}
+
+// peerWelcome completes a handshake this peer initiated: it checks the
+// Welcome against the pending Hello and sets up the session the other
+// peer chose.
+func (s *Server) peerWelcome(ln *listener, addr net.Addr, n int, payload []byte) {
+	p := s.peer
+	var w protocol.Welcome
+	err := openHandshake(p.hs, payload, &w)
+	p.mu.Lock()
+	nonce, transcript := p.nonce, p.transcript
+	if err == nil && nonce != nil && bytes.Equal(w.Transcript, transcript) {
+		p.nonce, p.transcript, p.silent, p.attempts = nil, nil, false, 0
+	} else {
+		nonce = nil
+	}
+	p.mu.Unlock()
+	if nonce == nil {
+		// Not an answer to the pending Hello: refused like any other
+		// packet that does not authenticate.
+		s.drop(nil, dropUnknownSession)
+		s.answer(ln, addr, n)
+		return
+	}
+	s.transcript.welcome("in", addr, &w, "")
+	if w.Error != "" {
+		log.Printf("Peer %s rejected the handshake: %s", addr, w.Error)
+		return
+	}
+	keys, err := deriveSessionKeys(p.psk, nonce, w.Nonce, false)
+	if err != nil {
+		log.Printf("Handshake with %s: %v", addr, err)
+		return
+	}
+	now := time.Now()
+	sess := &serverSession{id: w.Session, name: p2pPeer, keyID: pskKeyID(p.psk), software: cleanLabel(w.Software), version: w.Version, keys: keys, connectedAt: now, adopted: now}
+	sess.path.Store(&sessionPath{ln: ln, addr: addr})
+	sess.lastSeen.Store(now)
+	if a, err := netip.ParseAddr(w.Gateway); err == nil {
+		sess.address = a
+	}
+	s.startReorder(sess)
+
+	s.sessionsMu.Lock()
+	for id := range s.sessions {
+		s.removeSessionLocked(id, "replaced")
+	}
+	s.sessions[sess.id] = sess
+	if sess.address.IsValid() {
+		s.routes[sess.address] = sess
+	}
+	s.bindAllowedLocked(sess)
+	s.sessionsMu.Unlock()
+	log.Printf("Peer %s connected: session %08x, protocol v%d", addr, sess.id, sess.version)
+	s.hooks.emit(sess.event(EventConnected, ""))
+}
+
+// peerAddressLocked routes to the adapter address the other peer sent in
+// its Hello. Callers must hold sessionsMu for writing.
+func (s *Server) peerAddressLocked(sess *serverSession, cidr string) {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		log.Printf("Peer %s sent an invalid address %q", sess.remote(), cidr)
+		return
+	}
+	sess.address = p.Addr()
+}
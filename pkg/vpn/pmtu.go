@@ -0,0 +1,293 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+const (
+	// pmtuStart is how long after a handshake the first search starts, so
+	// the client has taken the Welcome before probes arrive.
+	pmtuStart = 2 * time.Second
+
+	// pmtuTick is how often searches advance. A probe gets pmtuTries sends,
+	// pmtuProbeTimeout apart, before its size counts as too large.
+	pmtuTick         = 500 * time.Millisecond
+	pmtuProbeTimeout = time.Second
+	pmtuTries        = 2
+
+	// pmtuStep is how close a search gets to the largest MTU that fits.
+	pmtuStep = 8
+
+	// pmtuInterval is how often a settled search runs again, so a path that
+	// grew gets its MTU back.
+	pmtuInterval = 10 * time.Minute
+)
+
+// validateDynamicMTU checks dynamic_mtu, which needs the mtu it may lower
+// and plain UDP sockets whose DF bit the server controls.
+func (cfg Config) validateDynamicMTU() error {
+	switch {
+	case !cfg.DynamicMTU:
+		return nil
+	case cfg.Mode != "server":
+		return fmt.Errorf("dynamic_mtu is a server setting")
+	case runtime.GOOS != "linux":
+		return fmt.Errorf("dynamic_mtu is only supported on Linux")
+	case cfg.MTU == 0:
+		return fmt.Errorf("dynamic_mtu needs mtu, the most it gives clients")
+	case cfg.Transport != "" && cfg.Transport != UDPTransport || cfg.Encapsulation != "" || len(cfg.Migrate) > 0:
+		return fmt.Errorf("dynamic_mtu needs plain UDP; unset transport, encapsulation and migrate")
+	}
+	return nil
+}
+
+// sessionPMTU searches for the largest tunnel MTU the path to a client
+// carries, between minPushedMTU and the configured mtu, by sending probes
+// that size and seeing which the client answers.
+type sessionPMTU struct {
+	mu      sync.Mutex
+	max     int          // the configured mtu
+	mtu     atomic.Int32 // the client's MTU now, read without mu
+	lo, hi  int          // largest MTU that got through, smallest that did not
+	top     bool         // the largest candidate was tried this search
+	size    int          // of the probe out, zero if none
+	sentAt  time.Time
+	tries   int       // sends of the probe out
+	next    time.Time // when the next search starts, zero while searching
+	checked time.Time // when the kernel's path MTU was last looked up
+}
+
+// newSessionPMTU starts a client on hint, the MTU that worked on its
+// network last time, or on max when hint is out of range.
+func newSessionPMTU(max, hint int, now time.Time) *sessionPMTU {
+	p := &sessionPMTU{max: max, next: now.Add(pmtuStart)}
+	if hint < minPushedMTU || hint > max {
+		hint = max
+	}
+	p.mtu.Store(int32(hint))
+	return p
+}
+
+// startLocked starts a search with top as the largest candidate. Callers
+// must hold mu.
+func (p *sessionPMTU) startLocked(top int) {
+	p.lo, p.hi, p.top = minPushedMTU, top+1, false
+	p.size, p.next = 0, time.Time{}
+}
+
+// candidateLocked returns the next MTU to probe, or zero when the search is
+// over. Callers must hold mu.
+func (p *sessionPMTU) candidateLocked() int {
+	switch {
+	case p.hi-p.lo <= pmtuStep:
+		return 0
+	case !p.top:
+		p.top = true
+		return p.hi - 1
+	}
+	return (p.lo + p.hi) / 2
+}
+
+// ack takes a client's answer to a probe, dec being its payload.
+func (p *sessionPMTU) ack(dec []byte) {
+	if len(dec) < 2 {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(dec))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.size != 0 && size == p.size {
+		p.lo, p.size = size, 0
+	}
+}
+
+// current returns the MTU the client was given, zero for a nil p.
+func (p *sessionPMTU) current() int {
+	if p == nil {
+		return 0
+	}
+	return int(p.mtu.Load())
+}
+
+// loopPMTU advances the search of every session with dynamic_mtu.
+func (s *Server) loopPMTU() {
+	defer s.wg.Done()
+	defer s.journal.guard()
+	ticker := time.NewTicker(pmtuTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var sessions []*serverSession
+		s.sessionsMu.RLock()
+		for _, sess := range s.sessions {
+			if sess.pmtu != nil {
+				sessions = append(sessions, sess)
+			}
+		}
+		s.sessionsMu.RUnlock()
+		now := time.Now()
+		for _, sess := range sessions {
+			s.stepPMTU(sess, now)
+		}
+	}
+}
+
+// stepPMTU sends sess the next probe, or settles its MTU when the search is
+// over.
+func (s *Server) stepPMTU(sess *serverSession, now time.Time) {
+	p := sess.pmtu
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.next.IsZero() {
+		if now.Before(p.next) {
+			return
+		}
+		p.startLocked(p.max)
+	}
+	if p.size > 0 {
+		if now.Sub(p.sentAt) < pmtuProbeTimeout {
+			return
+		}
+		if p.tries < pmtuTries {
+			p.tries++
+			p.sentAt = now
+			s.sendPMTUProbe(sess, p.size)
+			return
+		}
+		p.hi, p.size = p.size, 0
+	}
+	size := p.candidateLocked()
+	if size == 0 {
+		s.settlePMTULocked(sess, now)
+		return
+	}
+	p.size, p.tries, p.sentAt = size, 1, now
+	if err := s.sendPMTUProbe(sess, size); errors.Is(err, syscall.EMSGSIZE) {
+		// The kernel already knows the path is smaller.
+		p.hi, p.size = size, 0
+	}
+}
+
+// settlePMTULocked ends a search on the largest MTU that got through and
+// tells the client when it is below the configured one. Callers must hold
+// sess.pmtu.mu.
+func (s *Server) settlePMTULocked(sess *serverSession, now time.Time) {
+	p := sess.pmtu
+	p.next = now.Add(pmtuInterval)
+	changed := p.lo != p.current()
+	if changed {
+		log.Printf("Client %s: path carries MTU %d, was %d", sess.remote(), p.lo, p.current())
+		p.mtu.Store(int32(p.lo))
+	}
+	if !changed && p.lo == p.max {
+		return
+	}
+	// Sent again after every search below max, in case the last was lost.
+	payload := binary.BigEndian.AppendUint16(nil, uint16(p.lo))
+	if pkt, err := sealPacket(sess.keys.send, protocol.MsgMTU, sess.id, payload); err == nil {
+		sess.write(pkt)
+	}
+}
+
+// sendPMTUProbe sends sess a probe as large as a data packet carrying an
+// inner packet of mtu bytes.
+func (s *Server) sendPMTUProbe(sess *serverSession, mtu int) error {
+	payload := make([]byte, mtu)
+	binary.BigEndian.PutUint16(payload, uint16(mtu))
+	pkt, err := sealPacket(sess.keys.send, protocol.MsgMTUProbe, sess.id, payload)
+	if err != nil {
+		return err
+	}
+	return sess.write(pkt)
+}
+
+// pathShrank searches again for sess's MTU after a send to it failed for
+// being larger than the kernel, told by ICMP, now knows the path carries.
+func (s *Server) pathShrank(sess *serverSession) {
+	p := sess.pmtu
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.next.IsZero() || time.Since(p.checked) < time.Second {
+		p.mu.Unlock()
+		return
+	}
+	p.checked = time.Now()
+	p.mu.Unlock()
+
+	top := pathMTU(sess.remote())
+	known := top > 0
+	top -= outerOverhead(sess.remote()) + protocol.HeaderSize + sess.keys.send.Overhead()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !known {
+		top = p.max
+	}
+	if p.next.IsZero() || known && top >= p.current() {
+		// Searching already, or the packet was larger than the client's
+		// MTU allows anyway.
+		return
+	}
+	top = max(top, minPushedMTU)
+	log.Printf("Client %s: the path got smaller; probing from MTU %d", sess.remote(), top)
+	p.startLocked(top)
+}
+
+// outerOverhead is the IP and UDP headers in front of a datagram to addr.
+func outerOverhead(addr net.Addr) int {
+	if u, ok := addr.(*net.UDPAddr); ok && u.IP.To4() == nil {
+		return 40 + 8
+	}
+	return 20 + 8
+}
+
+// applyPathMTU takes the MTU a dynamic_mtu server found the path carries,
+// in place of the one in its Welcome.
+func (c *Client) applyPathMTU(dec []byte) {
+	if len(dec) != 2 {
+		return
+	}
+	mtu := int(binary.BigEndian.Uint16(dec))
+	prev := c.options.Load()
+	if mtu < minPushedMTU || prev == nil || prev.mtu == mtu {
+		return
+	}
+	opts := *prev
+	opts.mtu = mtu
+	if setter, ok := c.tunMgr.(tun.OptionSetter); ok {
+		if err := setter.SetMTU(mtu); err != nil {
+			log.Printf("Set MTU %d: %v", mtu, err)
+		}
+	}
+	log.Printf("Using MTU %d, which the server found the path carries", mtu)
+	c.options.Store(&opts)
+	c.rememberNetwork()
+}
+
+// answerPMTUProbe echoes the MTU of a server's probe, dec being its
+// payload.
+func (c *Client) answerPMTUProbe(sess *clientSession, dec []byte) {
+	if len(dec) < 2 {
+		return
+	}
+	if pkt, err := sealPacket(sess.keys.send, protocol.MsgMTUProbe, sess.id, dec[:2]); err == nil {
+		c.udp().Write(pkt)
+	}
+}
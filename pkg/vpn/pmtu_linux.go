@@ -0,0 +1,56 @@
+package vpn
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment makes conn send with DF set and never fragment, so a
+// probe larger than the path is lost rather than split, and a send larger
+// than the path MTU the kernel learned from ICMP fails with EMSGSIZE.
+func setDontFragment(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		err4 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+		err6 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+		if err4 != nil && err6 != nil {
+			serr = err4
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// pathMTU returns the path MTU to addr the kernel knows, zero if none. It
+// asks through a connected socket, which sends nothing.
+func pathMTU(addr net.Addr) int {
+	u, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0
+	}
+	conn, err := net.DialUDP("udp", nil, u)
+	if err != nil {
+		return 0
+	}
+	defer conn.Close()
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	mtu := 0
+	rc.Control(func(fd uintptr) {
+		if u.IP.To4() != nil {
+			mtu, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU)
+		} else {
+			mtu, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU)
+		}
+	})
+	return mtu
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package vpn
+
+import "net"
+
+// setDontFragment is only available on Linux.
+func setDontFragment(*net.UDPConn) error {
+	return nil
+}
+
+// pathMTU is only available on Linux.
+func pathMTU(net.Addr) int {
+	return 0
+}
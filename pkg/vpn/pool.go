@@ -0,0 +1,119 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// AutoAddress as a client's adapter_ip_cidr asks the server for an address
+// from its pool instead of using a fixed one.
+const AutoAddress = "auto"
+
+// addressPool hands out tunnel addresses: leases to clients, DHCP style,
+// and fixed addresses to provisioned clients. It is guarded by the server's
+// sessionsMu.
+type addressPool struct {
+	prefix netip.Prefix
+	bits   int        // prefix length handed to clients
+	server netip.Addr // the server's own tunnel address, never leased
+	used   map[netip.Addr]bool
+}
+
+// newAddressPool builds a pool over cidr. Clients are given the prefix
+// length of the server's adapter subnet when the pool lies inside it, so
+// they can reach the server and each other directly.
+func newAddressPool(cidr, adapterCIDR string) (*addressPool, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("pool: %w", err)
+	}
+	if !prefix.Addr().Is4() || prefix.Bits() > 30 {
+		return nil, fmt.Errorf("pool %s: must be an IPv4 prefix of /30 or larger", cidr)
+	}
+	p := &addressPool{
+		prefix: prefix.Masked(),
+		bits:   prefix.Bits(),
+		used:   make(map[netip.Addr]bool),
+	}
+	if adapter, err := netip.ParsePrefix(adapterCIDR); err == nil {
+		p.server = adapter.Addr()
+		if adapter.Bits() <= p.bits && adapter.Contains(p.prefix.Addr()) {
+			p.bits = adapter.Bits()
+		}
+	}
+	return p, nil
+}
+
+// usable reports whether a may be leased: inside the pool, not the network
+// or broadcast address, and not the server's own.
+func (p *addressPool) usable(a netip.Addr) bool {
+	if !p.prefix.Contains(a) || a == p.server {
+		return false
+	}
+	if a.Is6() {
+		return a != p.prefix.Addr()
+	}
+	v4 := a.As4()
+	host := binary.BigEndian.Uint32(v4[:]) & (^uint32(0) >> p.prefix.Bits())
+	return host != 0 && host != ^uint32(0)>>p.prefix.Bits()
+}
+
+// leaseLocked takes a free address, preferring want. It reports false when
+// the pool is exhausted.
+func (p *addressPool) leaseLocked(want netip.Addr) (netip.Addr, bool) {
+	if p.usable(want) && !p.used[want] {
+		p.used[want] = true
+		return want, true
+	}
+	for a := p.prefix.Addr(); p.prefix.Contains(a); a = a.Next() {
+		if p.usable(a) && !p.used[a] {
+			p.used[a] = true
+			return a, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// reserveLocked marks a as taken, such as by a provisioned client.
+func (p *addressPool) reserveLocked(a netip.Addr) {
+	if p.prefix.Contains(a) {
+		p.used[a] = true
+	}
+}
+
+func (p *addressPool) releaseLocked(a netip.Addr) {
+	delete(p.used, a)
+}
+
+// clientPrefix is the address in the form sent to clients.
+func (p *addressPool) clientPrefix(a netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(a, p.bits)
+}
+
+// addrString formats a, or returns "" for the zero Addr.
+func addrString(a netip.Addr) string {
+	if !a.IsValid() {
+		return ""
+	}
+	return a.String()
+}
+
+// prefixString formats p, or returns "" for the zero Prefix.
+func prefixString(p netip.Prefix) string {
+	if !p.IsValid() {
+		return ""
+	}
+	return p.String()
+}
+
+// packetDst returns the destination of an IPv4 or IPv6 packet.
+func packetDst(pkt []byte) (netip.Addr, bool) {
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		return netip.AddrFrom4([4]byte(pkt[16:20])), true
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		return netip.AddrFrom16([16]byte(pkt[24:40])), true
+	}
+	return netip.Addr{}, false
+}
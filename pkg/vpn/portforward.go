@@ -0,0 +1,448 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpForwardIdle is how long a UDP port forward keeps the socket for one
+// peer after the last datagram in either direction.
+const udpForwardIdle = 60 * time.Second
+
+// PortForwardConfig proxies connections accepted on Listen to Target. On a
+// server, Target's host may name a client instead of an address, so a
+// public port reaches a service on whichever tunnel address the client has;
+// on a client, Target is usually an address reached through the tunnel.
+type PortForwardConfig struct {
+	Name     string `yaml:"name"`
+	Protocol string `yaml:"protocol"` // tcp (default) or udp
+	Listen   string `yaml:"listen"`
+	Target   string `yaml:"target"`
+	// Disabled forwards are not opened until enabled through the
+	// management API.
+	Disabled bool `yaml:"disabled"`
+}
+
+func (c PortForwardConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("port_forwards: name is required")
+	}
+	switch c.Protocol {
+	case "", "tcp", "udp":
+	default:
+		return fmt.Errorf("port_forwards %s: protocol must be tcp or udp", c.Name)
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("port_forwards %s: listen: %w", c.Name, err)
+	}
+	if _, _, err := net.SplitHostPort(c.Target); err != nil {
+		return fmt.Errorf("port_forwards %s: target: %w", c.Name, err)
+	}
+	return nil
+}
+
+func (c PortForwardConfig) protocol() string {
+	if c.Protocol == "" {
+		return "tcp"
+	}
+	return c.Protocol
+}
+
+// PortForwardStatus is one entry of GET /forwards.
+type PortForwardStatus struct {
+	Name        string `json:"name"`
+	Protocol    string `json:"protocol"`
+	Listen      string `json:"listen"`
+	Target      string `json:"target"`
+	Client      string `json:"client,omitempty"` // who asked for a remote forward
+	Enabled     bool   `json:"enabled"`
+	Active      int    `json:"active"`      // open connections or UDP peers
+	Connections uint64 `json:"connections"` // accepted since start
+	Error       string `json:"error,omitempty"`
+}
+
+// portForward is the running state of one port_forwards entry.
+type portForward struct {
+	cfg     PortForwardConfig
+	resolve func(host string) (netip.Addr, bool)
+	dial    dialFunc
+	client  string // set for remote forwards
+
+	mu      sync.Mutex
+	enabled bool
+	closer  io.Closer          // listener while enabled
+	conns   map[io.Closer]bool // open sockets, closed on disable; true for one per connection
+	err     error              // last failure to listen
+	total   atomic.Uint64
+}
+
+// portForwards holds a Client's or Server's port forwards by name.
+type portForwards struct {
+	ctx context.Context
+
+	// mu guards byName and order, which change as remote forwards come
+	// and go.
+	mu     sync.Mutex
+	byName map[string]*portForward
+	order  []*portForward
+}
+
+// dialFunc opens a connection, as net.Dialer.DialContext does.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// newPortForwards opens the enabled entries of cfgs. resolve, when set,
+// turns a Target host that is not an IP into a tunnel address; dial, when
+// set, connects to targets in place of the host's network.
+func newPortForwards(ctx context.Context, cfgs []PortForwardConfig, resolve func(string) (netip.Addr, bool), dial dialFunc) *portForwards {
+	pf := &portForwards{ctx: ctx, byName: make(map[string]*portForward)}
+	for _, c := range cfgs {
+		f := &portForward{cfg: c, resolve: resolve, dial: dial, conns: make(map[io.Closer]bool)}
+		pf.byName[c.Name] = f
+		pf.order = append(pf.order, f)
+		if !c.Disabled {
+			if err := pf.enable(f); err != nil {
+				log.Printf("Port forward %s: %v", c.Name, err)
+			}
+		}
+	}
+	return pf
+}
+
+// SetEnabled opens or closes the named forward. Closing it also drops its
+// open connections.
+func (pf *portForwards) SetEnabled(name string, on bool) error {
+	pf.mu.Lock()
+	f := pf.byName[name]
+	pf.mu.Unlock()
+	if f == nil {
+		return fmt.Errorf("no port forward named %q", name)
+	}
+	if on {
+		return pf.enable(f)
+	}
+	f.disable()
+	log.Printf("Port forward %s disabled", name)
+	return nil
+}
+
+func (pf *portForwards) enable(f *portForward) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.enabled {
+		return nil
+	}
+	var err error
+	if f.cfg.protocol() == "udp" {
+		var pc net.PacketConn
+		if pc, err = net.ListenPacket("udp", f.cfg.Listen); err == nil {
+			f.closer = pc
+			go f.serveUDP(pf.ctx, pc)
+		}
+	} else {
+		var ln net.Listener
+		if ln, err = net.Listen("tcp", f.cfg.Listen); err == nil {
+			f.closer = ln
+			go f.serveTCP(pf.ctx, ln)
+		}
+	}
+	f.err = err
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", f.cfg.Listen, err)
+	}
+	f.enabled = true
+	log.Printf("Port forward %s: %s %s -> %s", f.cfg.Name, f.cfg.protocol(), f.cfg.Listen, f.cfg.Target)
+	return nil
+}
+
+func (f *portForward) disable() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.enabled {
+		return
+	}
+	f.enabled = false
+	f.closer.Close()
+	for c := range f.conns {
+		c.Close()
+	}
+	clear(f.conns)
+}
+
+// add opens a forward on behalf of client, for remote forwards.
+func (pf *portForwards) add(c PortForwardConfig, client string) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.byName[c.Name] != nil {
+		return fmt.Errorf("port forward %s already exists", c.Name)
+	}
+	f := &portForward{cfg: c, client: client, conns: make(map[io.Closer]bool)}
+	if err := pf.enable(f); err != nil {
+		return err
+	}
+	pf.byName[c.Name] = f
+	pf.order = append(pf.order, f)
+	return nil
+}
+
+// remove closes and forgets the named forward.
+func (pf *portForwards) remove(name string) {
+	pf.mu.Lock()
+	f := pf.byName[name]
+	delete(pf.byName, name)
+	pf.order = slices.DeleteFunc(pf.order, func(o *portForward) bool { return o == f })
+	pf.mu.Unlock()
+	if f != nil {
+		f.disable()
+	}
+}
+
+// close disables every forward, for Stop.
+func (pf *portForwards) close() {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	for _, f := range pf.order {
+		f.disable()
+	}
+}
+
+// Status lists the forwards in config order, then remote forwards in the
+// order they were opened.
+func (pf *portForwards) Status() []PortForwardStatus {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	out := make([]PortForwardStatus, 0, len(pf.order))
+	for _, f := range pf.order {
+		f.mu.Lock()
+		st := PortForwardStatus{
+			Name:        f.cfg.Name,
+			Protocol:    f.cfg.protocol(),
+			Listen:      f.cfg.Listen,
+			Target:      f.cfg.Target,
+			Client:      f.client,
+			Enabled:     f.enabled,
+			Active:      f.activeLocked(),
+			Connections: f.total.Load(),
+		}
+		if f.err != nil {
+			st.Error = f.err.Error()
+		}
+		f.mu.Unlock()
+		out = append(out, st)
+	}
+	return out
+}
+
+// clientAddress returns the tunnel address of the connected client with
+// the given provisioned name or, failing that, label, for port forward
+// targets.
+func (s *Server) clientAddress(name string) (netip.Addr, bool) {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	var byLabel netip.Addr
+	for _, sess := range s.sessions {
+		if !sess.address.IsValid() {
+			continue
+		}
+		if sess.name == name {
+			return sess.address, true
+		}
+		if sess.label == name {
+			byLabel = sess.address
+		}
+	}
+	return byLabel, byLabel.IsValid()
+}
+
+// handleForwards adds GET /forwards and POST /forwards/{name}/enable and
+// /disable to mux. pf is nil when no port forwards are configured.
+func handleForwards(mux *http.ServeMux, pf *portForwards) {
+	mux.HandleFunc("GET /forwards", func(w http.ResponseWriter, r *http.Request) {
+		list := []PortForwardStatus{}
+		if pf != nil {
+			list = pf.Status()
+		}
+		writeJSON(w, http.StatusOK, list)
+	})
+	toggle := func(on bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if pf == nil {
+				writeError(w, http.StatusNotFound, errors.New("no port forwards are configured"))
+				return
+			}
+			if err := pf.SetEnabled(r.PathValue("name"), on); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	mux.HandleFunc("POST /forwards/{name}/enable", toggle(true))
+	mux.HandleFunc("POST /forwards/{name}/disable", toggle(false))
+}
+
+// track records c as open, or reports false if the forward was disabled
+// meanwhile. counted marks the socket that stands for the connection, as
+// opposed to its upstream half.
+func (f *portForward) track(c io.Closer, counted bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.enabled {
+		return false
+	}
+	f.conns[c] = counted
+	return true
+}
+
+func (f *portForward) activeLocked() int {
+	n := 0
+	for _, counted := range f.conns {
+		if counted {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *portForward) untrack(c io.Closer) {
+	f.mu.Lock()
+	delete(f.conns, c)
+	f.mu.Unlock()
+}
+
+// target resolves the Target address, looking up client names if the host
+// is not an IP.
+func (f *portForward) target() (string, error) {
+	host, port, _ := net.SplitHostPort(f.cfg.Target)
+	if _, err := netip.ParseAddr(host); err == nil || f.resolve == nil {
+		return f.cfg.Target, nil
+	}
+	a, ok := f.resolve(host)
+	if !ok {
+		return "", fmt.Errorf("client %q is not connected", host)
+	}
+	return net.JoinHostPort(a.String(), port), nil
+}
+
+func (f *portForward) serveTCP(ctx context.Context, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.proxyTCP(ctx, conn)
+	}
+}
+
+func (f *portForward) proxyTCP(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	if !f.track(conn, true) {
+		return
+	}
+	defer f.untrack(conn)
+	f.total.Add(1)
+	target, err := f.target()
+	if err != nil {
+		log.Printf("Port forward %s: %v", f.cfg.Name, err)
+		return
+	}
+	dctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	upstream, err := f.dialContext(dctx, "tcp", target)
+	cancel()
+	if err != nil {
+		log.Printf("Port forward %s: %v", f.cfg.Name, err)
+		return
+	}
+	defer upstream.Close()
+	if !f.track(upstream, false) {
+		return
+	}
+	defer f.untrack(upstream)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, conn)
+	go pipe(conn, upstream)
+	<-done
+	<-done
+}
+
+// dialContext connects to a target with dial, or the host's network.
+func (f *portForward) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if f.dial != nil {
+		return f.dial(ctx, network, address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// serveUDP relays datagrams from each peer through a socket of its own
+// to the target, so replies can be told apart.
+func (f *portForward) serveUDP(ctx context.Context, pc net.PacketConn) {
+	var mu sync.Mutex
+	peers := make(map[string]net.Conn)
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		upstream := peers[from.String()]
+		mu.Unlock()
+		if upstream == nil {
+			target, err := f.target()
+			if err != nil {
+				log.Printf("Port forward %s: %v", f.cfg.Name, err)
+				continue
+			}
+			if upstream, err = f.dialContext(ctx, "udp", target); err != nil {
+				log.Printf("Port forward %s: %v", f.cfg.Name, err)
+				continue
+			}
+			if !f.track(upstream, true) {
+				upstream.Close()
+				return
+			}
+			f.total.Add(1)
+			mu.Lock()
+			peers[from.String()] = upstream
+			mu.Unlock()
+			go func(peer net.Addr, upstream net.Conn) {
+				defer func() {
+					mu.Lock()
+					delete(peers, peer.String())
+					mu.Unlock()
+					f.untrack(upstream)
+					upstream.Close()
+				}()
+				reply := make([]byte, 65536)
+				for {
+					n, err := upstream.Read(reply)
+					if err != nil {
+						return
+					}
+					upstream.SetReadDeadline(time.Now().Add(udpForwardIdle))
+					pc.WriteTo(reply[:n], peer)
+				}
+			}(from, upstream)
+		}
+		upstream.SetReadDeadline(time.Now().Add(udpForwardIdle))
+		upstream.Write(buf[:n])
+	}
+}
@@ -0,0 +1,68 @@
+package vpn
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/portmap"
+)
+
+const (
+	// portMapTimeout bounds one attempt to reach the gateway.
+	portMapTimeout = 10 * time.Second
+	// portMapRetry is how long to wait after a failed attempt, and how often
+	// a permanent mapping is re-checked in case the router rebooted.
+	portMapRetry = 5 * time.Minute
+)
+
+// loopPortMap asks the gateway to forward the listening port, renews the
+// mapping at half its lifetime, and removes it on shutdown.
+func (s *Server) loopPortMap() {
+	defer s.wg.Done()
+	defer s.journal.guard()
+	udp, ok := s.Addr().(*net.UDPAddr)
+	if !ok {
+		log.Printf("Port mapping needs the udp transport, not %s", s.cfg.Transport)
+		return
+	}
+	port := uint16(udp.Port)
+	var m *portmap.Mapping
+	for {
+		ctx, cancel := context.WithTimeout(s.ctx, portMapTimeout)
+		next, err := portmap.MapUDP(ctx, port, portmap.DefaultLifetime)
+		cancel()
+
+		wait := portMapRetry
+		switch {
+		case err != nil && s.ctx.Err() == nil:
+			log.Printf("Port mapping for UDP %d failed: %v", port, err)
+		case err == nil:
+			if m == nil || next.External != m.External {
+				external := "unknown address"
+				if next.External.IsValid() {
+					external = next.External.String()
+				}
+				log.Printf("Gateway forwards %s to UDP port %d (%s)", external, port, next.Protocol)
+			}
+			m = next
+			if m.Lifetime > 0 {
+				wait = m.Lifetime / 2
+			}
+		}
+
+		select {
+		case <-s.ctx.Done():
+			if m != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				if err := m.Delete(ctx); err != nil {
+					log.Printf("Remove port mapping: %v", err)
+				}
+				cancel()
+			}
+			return
+		case <-time.After(wait):
+		}
+	}
+}
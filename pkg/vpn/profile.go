@@ -0,0 +1,249 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// Profile is a named view of the network, under profiles in a server's
+// config. Clients get it when their login is in one of its groups, or when
+// their clients_file entry names it.
+type Profile struct {
+	// Groups are matched against the groups an AuthProvider reports: LDAP
+	// group DNs, or RADIUS Class and Filter-Id values. A group without an
+	// = also matches a DN whose first value it is, so engineering matches
+	// cn=engineering,ou=groups,dc=example,dc=com.
+	Groups []string `yaml:"groups"`
+	// Allow lists the prefixes clients may reach through the tunnel. A
+	// profile without it allows everything.
+	Allow []string `yaml:"allow"`
+
+	// Routes are pushed to clients, which route them into the tunnel on
+	// top of their own routes.
+	Routes []string `yaml:"routes"`
+	// DNS and SearchDomains are pushed in place of the server's dns and
+	// search_domains.
+	DNS           []string `yaml:"dns"`
+	SearchDomains []string `yaml:"search_domains"`
+	// QoS applies to clients without qos rules of their own.
+	QoS []QoSRule `yaml:"qos"`
+}
+
+// groupAttributes are the AuthResult attributes matched against profile
+// groups.
+var groupAttributes = []string{"groups", "Class", "Filter-Id"}
+
+// errNoProfile refuses logins that no profile matches when there is no
+// default_profile.
+var errNoProfile = errors.New("no access profile for this user")
+
+// profile is a Profile parsed for the data path.
+type profile struct {
+	groups  []string
+	allow   []netip.Prefix // empty allows everything
+	routes  []string
+	dns     []string
+	domains []string
+	qos     []qosRule
+}
+
+func parseProfiles(cfg map[string]Profile) (map[string]*profile, error) {
+	out := make(map[string]*profile, len(cfg))
+	for name, p := range cfg {
+		if name == "" {
+			return nil, fmt.Errorf("profiles: a profile needs a name")
+		}
+		allow, err := parsePrefixes(p.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: allow: %w", name, err)
+		}
+		routes, err := parsePrefixes(p.Routes)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: routes: %w", name, err)
+		}
+		for _, d := range p.DNS {
+			if _, err := netip.ParseAddr(d); err != nil {
+				return nil, fmt.Errorf("profile %s: dns: %w", name, err)
+			}
+		}
+		for _, d := range p.SearchDomains {
+			if d == "" || strings.ContainsAny(d, " \t,") {
+				return nil, fmt.Errorf("profile %s: search_domains: invalid domain %q", name, d)
+			}
+		}
+		qos, err := parseQoS(p.QoS)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		prof := &profile{groups: p.Groups, allow: allow, dns: p.DNS, domains: p.SearchDomains, qos: qos}
+		for _, r := range routes {
+			prof.routes = append(prof.routes, r.String())
+		}
+		out[name] = prof
+	}
+	return out, nil
+}
+
+// parsePrefixes parses prefixes such as 10.0.0.0/8, or single addresses.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range list {
+		if a, err := netip.ParseAddr(s); err == nil {
+			out = append(out, netip.PrefixFrom(a, a.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// authorize returns the profiles a login with attrs gets, sorted. It is
+// nil when no profiles are configured.
+func (s *Server) authorize(attrs map[string][]string) ([]string, error) {
+	if len(s.profiles) == 0 {
+		return nil, nil
+	}
+	var groups []string
+	for _, a := range groupAttributes {
+		groups = append(groups, attrs[a]...)
+	}
+	var names []string
+	for name, p := range s.profiles {
+		if slices.ContainsFunc(p.groups, func(want string) bool { return groupMatches(want, groups) }) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		if s.cfg.DefaultProfile == "" {
+			return nil, errNoProfile
+		}
+		return []string{s.cfg.DefaultProfile}, nil
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// groupMatches reports whether one of groups is want.
+func groupMatches(want string, groups []string) bool {
+	for _, g := range groups {
+		if strings.EqualFold(want, g) {
+			return true
+		}
+		if !strings.Contains(want, "=") {
+			first, _, _ := strings.Cut(g, ",")
+			if _, v, ok := strings.Cut(first, "="); ok && strings.EqualFold(want, strings.TrimSpace(v)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sessionProfiles are the profiles of a session, merged.
+type sessionProfiles struct {
+	names   []string
+	all     bool // one of the profiles allows everything
+	allow   []netip.Prefix
+	routes  []string
+	dns     []string
+	domains []string
+	qos     []qosRule // of the first profile that has rules
+}
+
+// profilesFor merges the named profiles, or returns nil, allowing
+// everything and pushing nothing, when there are none. Names no longer
+// configured, as after a restart, allow nothing.
+func (s *Server) profilesFor(names []string) *sessionProfiles {
+	if len(names) == 0 {
+		return nil
+	}
+	sp := &sessionProfiles{names: names}
+	for _, name := range names {
+		p, ok := s.profiles[name]
+		if !ok {
+			continue
+		}
+		if len(p.allow) == 0 {
+			sp.all = true
+		}
+		sp.allow = append(sp.allow, p.allow...)
+		sp.routes = appendNew(sp.routes, p.routes...)
+		sp.dns = appendNew(sp.dns, p.dns...)
+		sp.domains = appendNew(sp.domains, p.domains...)
+		if sp.qos == nil && len(p.qos) > 0 {
+			sp.qos = p.qos
+		}
+	}
+	return sp
+}
+
+// appendNew appends the values of add not already in list.
+func appendNew(list []string, add ...string) []string {
+	for _, v := range add {
+		if !slices.Contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// bindProfilesLocked gives sess the profiles its login was given, and the
+// one its clients_file entry names. Callers must hold sessionsMu.
+func (s *Server) bindProfilesLocked(sess *serverSession, names []string) {
+	if p := s.clientProfiles[sess.name]; sess.name != "" && p != "" && !slices.Contains(names, p) {
+		names = append(slices.Clip(names), p)
+		slices.Sort(names)
+	}
+	sess.profiles = s.profilesFor(names)
+}
+
+// allows reports whether pkt goes somewhere the session may reach. The
+// server's own tunnel address is always allowed. A nil sessionProfiles
+// allows everything.
+func (sp *sessionProfiles) allows(pkt []byte, gateway netip.Addr) bool {
+	if sp == nil || sp.all {
+		return true
+	}
+	dst, ok := packetDst(pkt)
+	return ok && (dst == gateway || containsAddr(sp.allow, dst))
+}
+
+// push sets what the session's profiles push in welcome, in place of the
+// server's own dns and search_domains.
+func (sp *sessionProfiles) push(welcome *protocol.Welcome) {
+	if sp == nil {
+		return
+	}
+	welcome.Routes = sp.routes
+	if len(sp.dns) > 0 {
+		welcome.DNS = sp.dns
+	}
+	if len(sp.domains) > 0 {
+		welcome.Domains = sp.domains
+	}
+}
+
+// qosRules returns the qos rules of the session's profiles, or nil.
+func (sp *sessionProfiles) qosRules() []qosRule {
+	if sp == nil {
+		return nil
+	}
+	return sp.qos
+}
+
+// profileNames returns the session's profiles, or nil.
+func (sp *sessionProfiles) profileNames() []string {
+	if sp == nil {
+		return nil
+	}
+	return sp.names
+}
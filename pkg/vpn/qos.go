@@ -0,0 +1,320 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QoSRule is one of a provisioned client's traffic policies, set under qos
+// in its clients_file entry. It matches the client's packets by protocol,
+// port, and direction, and remarks their DSCP, polices them to a rate, or
+// both. Each packet takes the first rule that matches it.
+type QoSRule struct {
+	Protocol  string   `yaml:"protocol,omitempty" json:"protocol,omitempty"`   // tcp, udp, icmp, or empty for any
+	Ports     []string `yaml:"ports,omitempty" json:"ports,omitempty"`         // source or destination ports, singly or as ranges
+	Direction string   `yaml:"direction,omitempty" json:"direction,omitempty"` // upload, download, or empty for both
+	DSCP      string   `yaml:"dscp,omitempty" json:"dscp,omitempty"`           // class to remark to: ef, af41, cs1, le, or 0-63
+	Rate      string   `yaml:"rate,omitempty" json:"rate,omitempty"`           // most bits per second, such as 2mbit
+	Burst     string   `yaml:"burst,omitempty" json:"burst,omitempty"`         // bytes let through at once above rate, such as 64kb
+}
+
+// minQoSBurst is the smallest default burst. Policing below a TCP window
+// or two drops most of every window, and transfers stall in recovery far
+// under the rate.
+const minQoSBurst = 128 << 10
+
+// qosRule is a QoSRule parsed for the data path.
+type qosRule struct {
+	proto int         // IP protocol number, or -1 for any
+	ports [][2]uint16 // inclusive ranges; empty for any
+	dir   Direction
+	both  bool    // matches either direction
+	dscp  int     // class to remark to, or -1
+	rate  float64 // bytes per second; 0 is unlimited
+	burst float64 // bytes
+}
+
+// parseQoS checks and parses a client's qos rules.
+func parseQoS(rules []QoSRule) ([]qosRule, error) {
+	out := make([]qosRule, 0, len(rules))
+	for i, r := range rules {
+		q, err := r.parse()
+		if err != nil {
+			return nil, fmt.Errorf("qos rule %d: %w", i+1, err)
+		}
+		out = append(out, q)
+	}
+	return out, nil
+}
+
+func (r QoSRule) parse() (qosRule, error) {
+	q := qosRule{proto: -1, dscp: -1, both: true}
+	switch strings.ToLower(r.Protocol) {
+	case "":
+	case "tcp":
+		q.proto = 6
+	case "udp":
+		q.proto = 17
+	case "icmp":
+		q.proto = 1
+	default:
+		return q, fmt.Errorf("protocol must be tcp, udp, or icmp")
+	}
+	if len(r.Ports) > 0 && q.proto != 6 && q.proto != 17 {
+		return q, fmt.Errorf("ports need protocol tcp or udp")
+	}
+	for _, p := range r.Ports {
+		lo, hi, err := parsePortRange(p)
+		if err != nil {
+			return q, err
+		}
+		q.ports = append(q.ports, [2]uint16{lo, hi})
+	}
+	switch strings.ToLower(r.Direction) {
+	case "":
+	case "upload":
+		q.dir, q.both = Inbound, false
+	case "download":
+		q.dir, q.both = Outbound, false
+	default:
+		return q, fmt.Errorf("direction must be upload or download")
+	}
+	if r.DSCP != "" {
+		d, err := parseDSCP(r.DSCP)
+		if err != nil {
+			return q, err
+		}
+		q.dscp = d
+	}
+	if r.Rate != "" {
+		bits, err := parseRate(r.Rate)
+		if err != nil {
+			return q, err
+		}
+		q.rate = bits / 8
+		q.burst = max(q.rate/10, minQoSBurst)
+	}
+	if r.Burst != "" {
+		if q.rate == 0 {
+			return q, fmt.Errorf("burst needs a rate")
+		}
+		b, err := parseBytes(r.Burst)
+		if err != nil {
+			return q, err
+		}
+		if b < 1500 {
+			return q, fmt.Errorf("burst must hold a full packet, 1500 bytes or more")
+		}
+		q.burst = b
+	}
+	if q.dscp < 0 && q.rate == 0 {
+		return q, fmt.Errorf("set dscp, rate, or both")
+	}
+	return q, nil
+}
+
+// parseDSCP reads a DSCP class name or number.
+func parseDSCP(s string) (int, error) {
+	s = strings.ToLower(s)
+	switch {
+	case s == "ef":
+		return 46, nil
+	case s == "va":
+		return 44, nil
+	case s == "le":
+		return 1, nil
+	case s == "default" || s == "be":
+		return 0, nil
+	case len(s) == 3 && s[:2] == "cs" && s[2] >= '0' && s[2] <= '7':
+		return int(s[2]-'0') * 8, nil
+	case len(s) == 4 && s[:2] == "af" && s[2] >= '1' && s[2] <= '4' && s[3] >= '1' && s[3] <= '3':
+		return int(s[2]-'0')*8 + int(s[3]-'0')*2, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 63 {
+		return 0, fmt.Errorf("invalid dscp %q", s)
+	}
+	return n, nil
+}
+
+// parseRate reads a rate such as 500kbit or 2mbit, in bits per second.
+func parseRate(s string) (float64, error) {
+	units := []struct {
+		suffix string
+		scale  float64
+	}{{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1}}
+	lower := strings.ToLower(strings.TrimSpace(s))
+	for _, u := range units {
+		if n, ok := strings.CutSuffix(lower, u.suffix); ok {
+			v, err := strconv.ParseFloat(n, 64)
+			if err != nil || v <= 0 {
+				break
+			}
+			return v * u.scale, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid rate %q; use bit, kbit, mbit, or gbit", s)
+}
+
+// parseBytes reads a size such as 1500, 64kb, 1mb, or 2gb, in bytes.
+func parseBytes(s string) (float64, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	scale := 1.0
+	switch {
+	case strings.HasSuffix(lower, "kb"):
+		lower, scale = lower[:len(lower)-2], 1<<10
+	case strings.HasSuffix(lower, "mb"):
+		lower, scale = lower[:len(lower)-2], 1<<20
+	case strings.HasSuffix(lower, "gb"):
+		lower, scale = lower[:len(lower)-2], 1<<30
+	case strings.HasSuffix(lower, "b"):
+		lower = lower[:len(lower)-1]
+	}
+	v, err := strconv.ParseFloat(lower, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid size %q; use b, kb, mb, or gb", s)
+	}
+	return v * scale, nil
+}
+
+// sessionQoS applies a client's rules to one of its sessions. Each rule
+// polices the two directions with buckets of their own.
+type sessionQoS struct {
+	rules []qosRule
+
+	mu      sync.Mutex
+	buckets [][2]tokenBucket
+}
+
+// bindQoSLocked gives sess the qos rules of its provisioned client, or else
+// those of its profiles. Callers must hold sessionsMu.
+func (s *Server) bindQoSLocked(sess *serverSession) {
+	rules := s.qos[sess.name]
+	if len(rules) == 0 {
+		rules = sess.profiles.qosRules()
+	}
+	if len(rules) > 0 {
+		sess.qos = &sessionQoS{rules: rules, buckets: make([][2]tokenBucket, len(rules))}
+	}
+}
+
+// apply runs pkt, going in direction dir, through the first rule it
+// matches, remarking it in place. It reports false if the rule's rate
+// polices pkt away. q may be nil.
+func (q *sessionQoS) apply(dir Direction, pkt []byte) bool {
+	if q == nil {
+		return true
+	}
+	proto, src, dst, ok := packetPorts(pkt)
+	if !ok {
+		return true
+	}
+	for i := range q.rules {
+		r := &q.rules[i]
+		if !r.matches(dir, proto, src, dst) {
+			continue
+		}
+		if r.rate > 0 {
+			q.mu.Lock()
+			ok := q.buckets[i][dir].take(r.rate, r.burst, len(pkt), time.Now())
+			q.mu.Unlock()
+			if !ok {
+				return false
+			}
+		}
+		if r.dscp >= 0 {
+			remarkDSCP(pkt, r.dscp)
+		}
+		return true
+	}
+	return true
+}
+
+func (r *qosRule) matches(dir Direction, proto int, src, dst uint16) bool {
+	if !r.both && r.dir != dir || r.proto >= 0 && r.proto != proto {
+		return false
+	}
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, p := range r.ports {
+		if src >= p[0] && src <= p[1] || dst >= p[0] && dst <= p[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenBucket polices a flow to rate bytes per second, letting up to burst
+// bytes through at once.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(rate, burst float64, n int, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// packetPorts returns the protocol of an IPv4 or IPv6 packet, and its TCP
+// or UDP ports if it has them. ICMPv6 is reported as ICMP. IPv6 extension
+// headers are not followed, and fragments after the first have no ports.
+func packetPorts(pkt []byte) (proto int, src, dst uint16, ok bool) {
+	var l4 []byte
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return 0, 0, 0, false
+		}
+		proto = int(pkt[9])
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff == 0 {
+			l4 = pkt[ihl:]
+		}
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		proto = int(pkt[6])
+		if proto == 58 {
+			proto = 1
+		}
+		l4 = pkt[40:]
+	default:
+		return 0, 0, 0, false
+	}
+	if (proto == 6 || proto == 17) && len(l4) >= 4 {
+		src, dst = binary.BigEndian.Uint16(l4[0:2]), binary.BigEndian.Uint16(l4[2:4])
+	}
+	return proto, src, dst, true
+}
+
+// remarkDSCP sets the DSCP of an IPv4 or IPv6 packet, keeping its ECN bits.
+func remarkDSCP(pkt []byte, dscp int) {
+	switch pkt[0] >> 4 {
+	case 4:
+		tos := byte(dscp)<<2 | pkt[1]&0x03
+		if pkt[1] == tos {
+			return
+		}
+		pkt[1] = tos
+		ihl := int(pkt[0]&0x0f) * 4
+		binary.BigEndian.PutUint16(pkt[10:12], 0)
+		binary.BigEndian.PutUint16(pkt[10:12], ipv4Checksum(pkt[:ihl]))
+	case 6:
+		tc := byte(dscp)<<2 | (pkt[1]>>4)&0x03
+		pkt[0] = pkt[0]&0xf0 | tc>>4
+		pkt[1] = pkt[1]&0x0f | tc<<4
+	}
+}
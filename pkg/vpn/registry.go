@@ -0,0 +1,156 @@
+package vpn
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+	"gopkg.in/yaml.v2"
+)
+
+// ClientEntry is a provisioned client with its own PSK and a fixed tunnel
+// address, as stored in clients_file. Revoked clients stay in the file so
+// their keys are refused by name.
+type ClientEntry struct {
+	Name    string     `yaml:"name" json:"name"`
+	PSK     string     `yaml:"psk" json:"psk"`
+	Address string     `yaml:"address" json:"address"`
+	Routes  []string   `yaml:"routes,omitempty" json:"routes,omitempty"`
+	Created time.Time  `yaml:"created" json:"created"`
+	Revoked *time.Time `yaml:"revoked,omitempty" json:"revoked,omitempty"`
+
+	// AllowedIPs are prefixes behind the client, such as its LAN. Packets
+	// for them go only to this client, and it may send from them as well
+	// as from Address.
+	AllowedIPs []string `yaml:"allowed_ips,omitempty" json:"allowed_ips,omitempty"`
+
+	// QoS remarks or polices the client's traffic by class.
+	QoS []QoSRule `yaml:"qos,omitempty" json:"qos,omitempty"`
+
+	// Profile names one of the server's profiles, whose routes, DNS, qos,
+	// and allow list the client gets.
+	Profile string `yaml:"profile,omitempty" json:"profile,omitempty"`
+
+	// AllowedHours and AllowedDays limit when the client may connect, such
+	// as 08:00-18:00 on mon-fri, in Timezone or else the server's time.
+	AllowedHours string   `yaml:"allowed_hours,omitempty" json:"allowed_hours,omitempty"`
+	AllowedDays  []string `yaml:"allowed_days,omitempty" json:"allowed_days,omitempty"`
+	Timezone     string   `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+}
+
+// ExportClientRequest is the body of POST /clients.
+type ExportClientRequest struct {
+	Name       string   `json:"name"`
+	Routes     []string `json:"routes,omitempty"`
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+}
+
+// RevokeRequest is the body of POST /revoke.
+type RevokeRequest struct {
+	Name string `json:"name"`
+}
+
+// RevokeResponse reports how many sessions a revocation disconnected.
+type RevokeResponse struct {
+	Disconnected int `json:"disconnected"`
+}
+
+// clientRegistry is the set of provisioned clients, persisted as YAML.
+type clientRegistry struct {
+	path    string
+	Clients []ClientEntry `yaml:"clients"`
+}
+
+// loadRegistry reads path; a missing file is an empty registry.
+func loadRegistry(path string) (*clientRegistry, error) {
+	r := &clientRegistry{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read clients file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("parse clients file %q: %w", path, err)
+	}
+	for _, c := range r.Clients {
+		if c.Name == "" || c.PSK == "" {
+			return nil, fmt.Errorf("clients file %q: every client needs a name and psk", path)
+		}
+		if _, err := netip.ParsePrefix(c.Address); err != nil {
+			return nil, fmt.Errorf("clients file %q: client %q: %w", path, c.Name, err)
+		}
+		if _, err := parseAllowedIPs(c.AllowedIPs); err != nil {
+			return nil, fmt.Errorf("clients file %q: client %q: %w", path, c.Name, err)
+		}
+		if _, err := parseQoS(c.QoS); err != nil {
+			return nil, fmt.Errorf("clients file %q: client %q: %w", path, c.Name, err)
+		}
+		if _, err := parseAccessWindow(c); err != nil {
+			return nil, fmt.Errorf("clients file %q: client %q: %w", path, c.Name, err)
+		}
+	}
+	return r, nil
+}
+
+// save writes the registry atomically. The file holds keys, so it is only
+// readable by the owner.
+func (r *clientRegistry) save() error {
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".clients-*")
+	if err != nil {
+		return fmt.Errorf("write clients file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write clients file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write clients file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return fmt.Errorf("write clients file: %w", err)
+	}
+	return nil
+}
+
+func (r *clientRegistry) find(name string) *ClientEntry {
+	for i := range r.Clients {
+		if r.Clients[i].Name == name {
+			return &r.Clients[i]
+		}
+	}
+	return nil
+}
+
+// clientKey builds the handshake key entry for a provisioned client.
+func clientKey(c ClientEntry) (pskEntry, error) {
+	hs, err := handshakeCipher(c.PSK)
+	if err != nil {
+		return pskEntry{}, err
+	}
+	addr, err := netip.ParsePrefix(c.Address)
+	if err != nil {
+		return pskEntry{}, err
+	}
+	return pskEntry{psk: c.PSK, id: pskKeyID(c.PSK), hs: hs, client: c.Name, address: addr}, nil
+}
+
+// randomPSK returns a new 32-character key.
+func randomPSK() (string, error) {
+	b, err := crypto.RandomBytes(24)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,236 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+const (
+	// relayAfter is how many Hellos a p2p peer sends to peer_address
+	// without an answer before it tries the relay.
+	relayAfter = 3
+
+	// relayTimeout is how long a relay keeps an end that has gone silent.
+	relayTimeout = 3 * time.Minute
+
+	// maxRelayLinks bounds the links a relay keeps, so binds with random
+	// IDs cannot grow it without end.
+	maxRelayLinks = 4096
+)
+
+// relayLinkID is the ID a p2p link binds to a relay with. Both peers derive
+// the same one from their PSK; the relay learns nothing else.
+func relayLinkID(psk string) ([]byte, error) {
+	return crypto.DeriveKey([]byte(psk), nil, protocol.RelayLinkInfo)
+}
+
+// validateRelay checks the settings of mode relay, which needs only
+// server_address.
+func (cfg Config) validateRelay() error {
+	if _, _, err := net.SplitHostPort(cfg.ServerAddress); err != nil {
+		return fmt.Errorf("server_address: %w", err)
+	}
+	if cfg.PSK != "" || cfg.ProtectedPSK != "" {
+		return fmt.Errorf("a relay holds no keys; unset psk")
+	}
+	return nil
+}
+
+// Relay forwards packets between the two peers of p2p links that cannot
+// reach each other, such as two peers behind symmetric NATs. It cannot read
+// them: it pairs the senders of each link ID and passes every other packet
+// from one to the other unchanged.
+type Relay struct {
+	cfg    Config
+	conn   net.PacketConn
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	links map[string]*relayLink
+	ends  map[string]*relayEnd
+}
+
+// relayLink is a link ID's two ends, the first bound first.
+type relayLink struct {
+	id   string
+	ends [2]*relayEnd
+}
+
+// relayEnd is a peer bound to a link, keyed by its outer address.
+type relayEnd struct {
+	addr net.Addr
+	link *relayLink
+	seen time.Time
+}
+
+// NewRelay constructs a Relay listening on cfg's server_address.
+func NewRelay(cfg Config) *Relay {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Relay{
+		cfg:    cfg,
+		ctx:    ctx,
+		cancel: cancel,
+		links:  make(map[string]*relayLink),
+		ends:   make(map[string]*relayEnd),
+	}
+}
+
+// Start opens the relay's socket and starts forwarding.
+func (r *Relay) Start() error {
+	log.Print(Build())
+	conn, err := net.ListenPacket("udp", r.cfg.ServerAddress)
+	if err != nil {
+		return fmt.Errorf("udp listen: %w", err)
+	}
+	if r.cfg.FwMark != 0 {
+		if err := markConn(conn.(*net.UDPConn), r.cfg.FwMark); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	r.conn = conn
+	log.Printf("Relaying p2p links on %s", conn.LocalAddr())
+	r.wg.Add(2)
+	go r.loop()
+	go r.loopExpire()
+	return nil
+}
+
+// Stop closes the socket and waits for the relay to finish.
+func (r *Relay) Stop() {
+	r.cancel()
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.wg.Wait()
+}
+
+// loop binds the senders of relay packets and forwards everything else.
+func (r *Relay) loop() {
+	defer r.wg.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		h, payload, err := protocol.ParseHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+		if h.Type == protocol.MsgRelay {
+			if h.Session == 0 && len(payload) == crypto.KeySize {
+				r.bind(addr, string(payload))
+			}
+			continue
+		}
+		if to := r.other(addr); to != nil {
+			r.conn.WriteTo(buf[:n], to)
+		}
+	}
+}
+
+// bind makes addr an end of link id. A third end replaces the one heard
+// from least recently, such as a peer whose NAT mapping changed.
+func (r *Relay) bind(addr net.Addr, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	key := addr.String()
+	if e := r.ends[key]; e != nil {
+		if e.link.id == id {
+			e.seen = now
+			return
+		}
+		r.removeEndLocked(e)
+	}
+	link := r.links[id]
+	if link == nil {
+		if len(r.links) >= maxRelayLinks {
+			return
+		}
+		link = &relayLink{id: id}
+		r.links[id] = link
+	}
+	slot := 0
+	switch {
+	case link.ends[0] == nil:
+	case link.ends[1] == nil:
+		slot = 1
+	case link.ends[1].seen.Before(link.ends[0].seen):
+		slot = 1
+	}
+	if old := link.ends[slot]; old != nil {
+		delete(r.ends, old.addr.String())
+	}
+	e := &relayEnd{addr: addr, link: link, seen: now}
+	link.ends[slot] = e
+	r.ends[key] = e
+	log.Printf("Relay link %x: %s joined", id[:4], addr)
+}
+
+// other returns the address paired with from, or nil when from is not
+// bound or its link has only one end.
+func (r *Relay) other(from net.Addr) net.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.ends[from.String()]
+	if e == nil {
+		return nil
+	}
+	e.seen = time.Now()
+	for _, o := range e.link.ends {
+		if o != nil && o != e {
+			return o.addr
+		}
+	}
+	return nil
+}
+
+// removeEndLocked unbinds e, and forgets its link when it was the last
+// end. Callers must hold mu.
+func (r *Relay) removeEndLocked(e *relayEnd) {
+	delete(r.ends, e.addr.String())
+	link := e.link
+	for i, o := range link.ends {
+		if o == e {
+			link.ends[i] = nil
+		}
+	}
+	if link.ends[0] == nil && link.ends[1] == nil {
+		delete(r.links, link.id)
+	}
+}
+
+// loopExpire unbinds ends silent for relayTimeout.
+func (r *Relay) loopExpire() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		for _, e := range r.ends {
+			if time.Since(e.seen) > relayTimeout {
+				r.removeEndLocked(e)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,217 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// DefaultMaxRemoteForwards bounds the ports one client may have opened when
+// remote_forwards sets no max_per_client.
+const DefaultMaxRemoteForwards = 4
+
+// RemoteForwardPolicy lets clients ask the server to open ports and forward
+// them to the client, like ssh -R.
+type RemoteForwardPolicy struct {
+	// Listen is the address the ports are opened on; 0.0.0.0 if empty.
+	Listen string `yaml:"listen"`
+	// Ports lists the ports clients may ask for, singly or as ranges
+	// such as "8000-8099".
+	Ports           []string `yaml:"ports"`
+	MaxPerClient    int      `yaml:"max_per_client"`
+	ProvisionedOnly bool     `yaml:"provisioned_only"`
+}
+
+// ForwardRequest is a server port a client asks to have forwarded to a
+// port on its tunnel address.
+type ForwardRequest struct {
+	Protocol string `yaml:"protocol"` // tcp (default) or udp
+	Port     uint16 `yaml:"port"`
+	To       uint16 `yaml:"to"` // defaults to Port
+}
+
+func (p *RemoteForwardPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	if len(p.Ports) == 0 {
+		return fmt.Errorf("remote_forwards: ports is required")
+	}
+	for _, r := range p.Ports {
+		if _, _, err := parsePortRange(r); err != nil {
+			return fmt.Errorf("remote_forwards: %w", err)
+		}
+	}
+	if p.MaxPerClient < 0 {
+		return fmt.Errorf("remote_forwards: max_per_client cannot be negative")
+	}
+	return nil
+}
+
+// parsePortRange parses "8080" or "8000-8099".
+func parsePortRange(s string) (lo, hi uint16, err error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		to = from
+	}
+	a, err1 := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	b, err2 := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err1 != nil || err2 != nil || a == 0 || b < a {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return uint16(a), uint16(b), nil
+}
+
+func (p *RemoteForwardPolicy) allows(port uint16) bool {
+	for _, r := range p.Ports {
+		if lo, hi, err := parsePortRange(r); err == nil && port >= lo && port <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RemoteForwardPolicy) maxPerClient() int {
+	if p.MaxPerClient > 0 {
+		return p.MaxPerClient
+	}
+	return DefaultMaxRemoteForwards
+}
+
+func (p *RemoteForwardPolicy) listen() string {
+	if p.Listen != "" {
+		return p.Listen
+	}
+	return "0.0.0.0"
+}
+
+// forwardRequests converts request_forwards for the Hello.
+func (c Config) forwardRequests() []protocol.Forward {
+	var out []protocol.Forward
+	for _, r := range c.RequestForwards {
+		out = append(out, protocol.Forward{Protocol: r.Protocol, Port: r.Port, To: r.To})
+	}
+	return out
+}
+
+// remoteForwardName names the port forward opened for a remote forward; a
+// server port can only be held by one client at a time.
+func remoteForwardName(f protocol.Forward) string {
+	return fmt.Sprintf("remote-%s-%d", f.Protocol, f.Port)
+}
+
+// grantForwardsLocked opens the ports sess asked for, within the
+// remote_forwards policy, and answers each request. A port held by an
+// earlier session of the same provisioned client, or by one silent past the
+// keepalive timeout, is taken over. Callers must hold sessionsMu for
+// writing.
+func (s *Server) grantForwardsLocked(sess *serverSession, reqs []protocol.Forward) []protocol.Forward {
+	out := make([]protocol.Forward, len(reqs))
+	for i, f := range reqs {
+		if f.Protocol == "" {
+			f.Protocol = "tcp"
+		}
+		if f.To == 0 {
+			f.To = f.Port
+		}
+		f.Error = ""
+		if err := s.grantForwardLocked(sess, f); err != nil {
+			f.Error = err.Error()
+			log.Printf("Refused %s port %d to session %08x: %v", f.Protocol, f.Port, sess.id, err)
+		} else {
+			sess.forwards = append(sess.forwards, f)
+			log.Printf("Forwarding %s port %d to session %08x port %d", f.Protocol, f.Port, sess.id, f.To)
+		}
+		out[i] = f
+	}
+	return out
+}
+
+func (s *Server) grantForwardLocked(sess *serverSession, f protocol.Forward) error {
+	policy := s.cfg.RemoteForwards
+	switch {
+	case policy == nil:
+		return fmt.Errorf("server does not allow remote forwards")
+	case f.Protocol != "tcp" && f.Protocol != "udp":
+		return fmt.Errorf("protocol must be tcp or udp")
+	case policy.ProvisionedOnly && sess.name == "":
+		return fmt.Errorf("only provisioned clients may ask for forwards")
+	case !policy.allows(f.Port):
+		return fmt.Errorf("port %d is not allowed", f.Port)
+	case len(sess.forwards) >= policy.maxPerClient():
+		return fmt.Errorf("at most %d forwards per client", policy.maxPerClient())
+	}
+	target := sess.address
+	if !target.IsValid() {
+		target = sess.address6
+	}
+	if !target.IsValid() {
+		return fmt.Errorf("server does not know the client's tunnel address")
+	}
+	name := remoteForwardName(f)
+	if holder := s.remote[name]; holder != nil {
+		idle := time.Since(holder.lastSeen.Load()) > s.cfg.keepaliveTimeout()
+		if !idle && (holder.name == "" || holder.name != sess.name) {
+			return fmt.Errorf("port %d is in use by another client", f.Port)
+		}
+		s.releaseForwardLocked(holder, name)
+	}
+	err := s.forwards.add(PortForwardConfig{
+		Name:     name,
+		Protocol: f.Protocol,
+		Listen:   net.JoinHostPort(policy.listen(), strconv.Itoa(int(f.Port))),
+		Target:   net.JoinHostPort(target.String(), strconv.Itoa(int(f.To))),
+	}, sess.displayName())
+	if err != nil {
+		return err
+	}
+	s.remote[name] = sess
+	return nil
+}
+
+// releaseForwardLocked closes sess's remote forward called name. Callers
+// must hold sessionsMu for writing.
+func (s *Server) releaseForwardLocked(sess *serverSession, name string) {
+	for i, f := range sess.forwards {
+		if remoteForwardName(f) == name {
+			sess.forwards = append(sess.forwards[:i:i], sess.forwards[i+1:]...)
+			break
+		}
+	}
+	if s.remote[name] == sess {
+		delete(s.remote, name)
+		s.forwards.remove(name)
+	}
+}
+
+// releaseForwardsLocked closes every remote forward of sess. Callers must
+// hold sessionsMu for writing.
+func (s *Server) releaseForwardsLocked(sess *serverSession) {
+	for len(sess.forwards) > 0 {
+		s.releaseForwardLocked(sess, remoteForwardName(sess.forwards[0]))
+	}
+}
+
+// reportForwards logs how the server answered request_forwards and keeps
+// the answer for the status.
+func (c *Client) reportForwards(granted []protocol.Forward) {
+	if len(c.cfg.RequestForwards) == 0 {
+		return
+	}
+	if len(granted) == 0 {
+		log.Printf("Server ignored request_forwards; it may be too old")
+	}
+	for _, f := range granted {
+		if f.Error != "" {
+			log.Printf("Server refused to forward %s port %d: %s", f.Protocol, f.Port, f.Error)
+		} else {
+			log.Printf("Server forwards %s port %d to port %d here", f.Protocol, f.Port, f.To)
+		}
+	}
+	c.remoteForwards.Store(&granted)
+}
@@ -0,0 +1,158 @@
+package vpn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+const (
+	// DefaultReorderDelay is how long a packet waits for a gap ahead of it
+	// to fill when reorder.max_delay is unset.
+	DefaultReorderDelay = 10 * time.Millisecond
+
+	maxReorderPackets = 1024
+)
+
+// ReorderConfig sizes the receive-side reordering buffer, which puts
+// packets that multipath or load-balanced networks delivered out of order
+// back in sequence before they reach the tunnel. It is off unless Packets
+// is set.
+type ReorderConfig struct {
+	Packets  int           `yaml:"packets"`   // most packets held behind a gap
+	MaxDelay time.Duration `yaml:"max_delay"` // longest a packet is held
+}
+
+// Enabled reports whether reordering is configured.
+func (c ReorderConfig) Enabled() bool {
+	return c.Packets > 0
+}
+
+func (c ReorderConfig) validate() error {
+	if c.Packets < 0 || c.Packets > maxReorderPackets {
+		return fmt.Errorf("reorder: packets must be between 0 and %d", maxReorderPackets)
+	}
+	if c.MaxDelay < 0 {
+		return fmt.Errorf("reorder: max_delay cannot be negative")
+	}
+	return nil
+}
+
+func (c ReorderConfig) maxDelay() time.Duration {
+	if c.MaxDelay > 0 {
+		return c.MaxDelay
+	}
+	return DefaultReorderDelay
+}
+
+// reorderBuffer releases a session's decrypted packets in sequence-number
+// order. A packet that arrives ahead of a gap is held until the gap fills,
+// the buffer is full, or it has waited too long; the gap is then taken as
+// loss. Every authenticated packet must be added, keepalives included, or
+// their sequence numbers would look like gaps. Packets are released to
+// deliver one at a time, from add or from the expiry timer.
+type reorderBuffer struct {
+	cfg     ReorderConfig
+	deliver func(t protocol.MessageType, pkt []byte)
+
+	mu    sync.Mutex
+	next  uint64 // next sequence number expected; 0 before the first packet
+	held  map[uint64]reorderedPacket
+	timer *time.Timer
+}
+
+type reorderedPacket struct {
+	typ  protocol.MessageType
+	data []byte
+	at   time.Time
+}
+
+func newReorderBuffer(cfg ReorderConfig, deliver func(t protocol.MessageType, pkt []byte)) *reorderBuffer {
+	return &reorderBuffer{cfg: cfg, deliver: deliver, held: make(map[uint64]reorderedPacket)}
+}
+
+// add takes the packet with sequence number seq. pkt is copied if held.
+func (r *reorderBuffer) add(seq uint64, t protocol.MessageType, pkt []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case r.next == 0 || seq == r.next:
+		r.next = seq + 1
+		r.deliver(t, pkt)
+		r.drainLocked()
+	case seq < r.next:
+		// Its gap was already given up on; late is better than never.
+		r.deliver(t, pkt)
+	default:
+		r.held[seq] = reorderedPacket{typ: t, data: append([]byte(nil), pkt...), at: time.Now()}
+		if len(r.held) > r.cfg.Packets {
+			r.skipLocked()
+		}
+		if len(r.held) > 0 && r.timer == nil {
+			r.timer = time.AfterFunc(r.cfg.maxDelay(), r.expire)
+		}
+	}
+}
+
+// drainLocked releases held packets that are now in sequence.
+func (r *reorderBuffer) drainLocked() {
+	for {
+		p, ok := r.held[r.next]
+		if !ok {
+			return
+		}
+		delete(r.held, r.next)
+		r.next++
+		r.deliver(p.typ, p.data)
+	}
+}
+
+// skipLocked gives up on the gap before the oldest held packet.
+func (r *reorderBuffer) skipLocked() {
+	first := uint64(0)
+	for seq := range r.held {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	if first != 0 {
+		r.next = first
+		r.drainLocked()
+	}
+}
+
+// expire skips gaps in front of packets that have waited too long.
+func (r *reorderBuffer) expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timer = nil
+	deadline := time.Now().Add(-r.cfg.maxDelay())
+	for len(r.held) > 0 {
+		oldest := time.Time{}
+		for _, p := range r.held {
+			if oldest.IsZero() || p.at.Before(oldest) {
+				oldest = p.at
+			}
+		}
+		if oldest.After(deadline) {
+			r.timer = time.AfterFunc(oldest.Sub(deadline), r.expire)
+			return
+		}
+		r.skipLocked()
+	}
+}
+
+// stop cancels the expiry timer.
+func (r *reorderBuffer) stop() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
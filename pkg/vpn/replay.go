@@ -0,0 +1,47 @@
+package vpn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// helloReplaySweep is how often the nonces of stale Hellos are forgotten.
+const helloReplaySweep = 30 * time.Second
+
+// helloNonces remembers the nonces of the Hellos a server took, for as long
+// as the Hellos stay fresh, so a captured Hello cannot be replayed to open
+// another session, or to replace its client's live one. Only Hellos that
+// authenticated are recorded, so its size is bounded by how fast holders
+// of a key handshake.
+type helloNonces struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time // nonce to when its Hello goes stale
+	swept time.Time
+}
+
+func newHelloNonces() *helloNonces {
+	return &helloNonces{seen: make(map[string]time.Time), swept: time.Now()}
+}
+
+// first records the nonce of hello and reports whether it is the first
+// time it was seen.
+func (n *helloNonces) first(hello *protocol.Hello, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if now.Sub(n.swept) > helloReplaySweep {
+		for nonce, stale := range n.seen {
+			if now.After(stale) {
+				delete(n.seen, nonce)
+			}
+		}
+		n.swept = now
+	}
+	key := string(hello.Nonce)
+	if _, ok := n.seen[key]; ok {
+		return false
+	}
+	n.seen[key] = time.Unix(hello.Timestamp, 0).Add(protocol.MaxClockSkew)
+	return true
+}
@@ -0,0 +1,196 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// vpnInterfacePrefixes and vpnInterfaceWords mark interfaces that look like
+// another VPN's adapter, by name prefix on Unix and by part of the name on
+// Windows.
+var (
+	vpnInterfacePrefixes = []string{"tun", "tap", "wg", "utun", "ppp", "ipsec", "zt"}
+	vpnInterfaceWords    = []string{"wireguard", "openvpn", "tailscale", "zerotier", "wintun", "tap-windows", "nordlynx"}
+)
+
+// hostSubnet is a subnet attached to one of the host's interfaces.
+type hostSubnet struct {
+	prefix netip.Prefix
+	ifName string
+	vpn    bool // the interface looks like another VPN's adapter
+}
+
+// routeConflict is a route into the tunnel, or the tunnel's own subnet,
+// that overlaps a subnet already on the host. Whichever route is more
+// specific wins there, so either the tunnel or the local network loses
+// that traffic.
+type routeConflict struct {
+	route  netip.Prefix
+	subnet hostSubnet
+}
+
+func (rc routeConflict) String() string {
+	where := rc.subnet.ifName
+	if rc.subnet.vpn {
+		where += ", another VPN's adapter"
+	}
+	return fmt.Sprintf("%s overlaps %s on %s", rc.route, rc.subnet.prefix, where)
+}
+
+// hostSubnets lists the subnets on the host's interfaces that are up,
+// other than adapter's and link-local ones.
+func hostSubnets(adapter string) []hostSubnet {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("Route check: list interfaces: %v", err)
+		return nil
+	}
+	var out []hostSubnet
+	for _, ifi := range ifaces {
+		if ifi.Name == adapter || ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipnet.IP)
+			if !ok || ip.Unmap().IsLinkLocalUnicast() {
+				continue
+			}
+			bits, _ := ipnet.Mask.Size()
+			out = append(out, hostSubnet{
+				prefix: netip.PrefixFrom(ip.Unmap(), bits).Masked(),
+				ifName: ifi.Name,
+				vpn:    vpnInterface(ifi),
+			})
+		}
+	}
+	return out
+}
+
+// vpnInterface reports whether ifi looks like a tunnel adapter.
+func vpnInterface(ifi net.Interface) bool {
+	if ifi.Flags&net.FlagPointToPoint != 0 {
+		return true
+	}
+	name := strings.ToLower(ifi.Name)
+	return slices.ContainsFunc(vpnInterfacePrefixes, func(p string) bool { return strings.HasPrefix(name, p) }) ||
+		slices.ContainsFunc(vpnInterfaceWords, func(w string) bool { return strings.Contains(name, w) })
+}
+
+// routeConflicts returns the overlaps of routes with subnets. Default routes
+// are left out: the host's own subnets are more specific and win over them,
+// as full-tunnel mode expects.
+func routeConflicts(subnets []hostSubnet, routes ...netip.Prefix) []routeConflict {
+	var out []routeConflict
+	for _, r := range routes {
+		if r.Bits() == 0 {
+			continue
+		}
+		for _, s := range subnets {
+			if r.Overlaps(s.prefix) {
+				out = append(out, routeConflict{route: r, subnet: s})
+			}
+		}
+	}
+	return out
+}
+
+// checkRoutes checks the tunnel's subnet, from cidr, and routes against the
+// host's subnets before they are installed. Each overlap is logged and kept
+// for the status; with strict_routes the first is returned as an error.
+func (c *Client) checkRoutes(cidr string, routes []string) error {
+	if !c.hostRoutes {
+		return nil
+	}
+	var prefixes []netip.Prefix
+	if p, err := netip.ParsePrefix(cidr); err == nil {
+		prefixes = append(prefixes, p.Masked())
+	}
+	for _, r := range routes {
+		if p, err := netip.ParsePrefix(r); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		}
+	}
+	conflicts := c.hostConflicts(prefixes...)
+	if c.cfg.StrictRoutes && len(conflicts) > 0 {
+		return fmt.Errorf("strict_routes: %s", conflicts[0])
+	}
+	return nil
+}
+
+// pickAdapterCIDR moves the adapter to the first of adapter_fallbacks that
+// overlaps none of the host's subnets when adapter_ip_cidr overlaps one.
+// Without a free fallback it keeps adapter_ip_cidr, for checkRoutes to
+// report.
+func (c *Client) pickAdapterCIDR() {
+	if !c.hostRoutes || len(c.cfg.AdapterFallbacks) == 0 {
+		return
+	}
+	free := func(cidr string) bool {
+		p, err := netip.ParsePrefix(cidr)
+		return err == nil && len(routeConflicts(hostSubnets(c.cfg.AdapterName), p.Masked())) == 0
+	}
+	if free(c.cfg.AdapterIPCIDR) {
+		return
+	}
+	for _, f := range c.cfg.AdapterFallbacks {
+		if free(f) {
+			log.Printf("Adapter subnet %s is already on this host; using %s instead", c.cfg.AdapterIPCIDR, f)
+			c.cfg.AdapterIPCIDR = f
+			c.fallbackCIDR = f
+			return
+		}
+	}
+	log.Printf("Adapter subnet %s is already on this host, and so are all of adapter_fallbacks", c.cfg.AdapterIPCIDR)
+}
+
+// routeAllowed checks a route the server pushed, and reports whether it
+// may be installed.
+func (c *Client) routeAllowed(p netip.Prefix) bool {
+	if !c.hostRoutes {
+		return true
+	}
+	if c.cfg.StrictRoutes && len(c.hostConflicts(p)) > 0 {
+		log.Printf("Not routing %s into the tunnel: strict_routes is set", p)
+		return false
+	}
+	return true
+}
+
+// hostConflicts returns the overlaps of routes with the host's subnets,
+// logging them and adding them to the status. With allow_lan, local subnets
+// inside a route are kept off the tunnel on purpose, so they are left out.
+func (c *Client) hostConflicts(routes ...netip.Prefix) []routeConflict {
+	conflicts := routeConflicts(hostSubnets(c.cfg.AdapterName), routes...)
+	if c.cfg.AllowLAN {
+		conflicts = slices.DeleteFunc(conflicts, func(rc routeConflict) bool {
+			return rc.route.Bits() < rc.subnet.prefix.Bits()
+		})
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	var list []string
+	if prev := c.conflicts.Load(); prev != nil {
+		list = slices.Clone(*prev)
+	}
+	for _, rc := range conflicts {
+		log.Printf("Warning: route conflict: %s; traffic there may miss the tunnel or the local network", rc)
+		if s := rc.String(); !slices.Contains(list, s) {
+			list = append(list, s)
+		}
+	}
+	c.conflicts.Store(&list)
+	return conflicts
+}
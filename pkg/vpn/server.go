@@ -1,140 +1,1836 @@
 package vpn
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"runtime"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/greudp"
+	"github.com/gedons/go_VPN/internal/metrics"
+	"github.com/gedons/go_VPN/internal/protocol"
+	"github.com/gedons/go_VPN/internal/ratelog"
 	"github.com/gedons/go_VPN/internal/tun"
 )
 
+// errorLog collapses errors a broken or hostile peer can trigger once per
+// packet.
+var errorLog = ratelog.New(ratelog.DefaultWindow)
+
 // Server implements the VPN server.
 type Server struct {
-	cfg     Config
-	cipher  *crypto.Cipher
-	tunMgr  *tun.WintunManager
-	udpConn *net.UDPConn
-	ctx     context.Context
-	cancel  context.CancelFunc
-	wg      sync.WaitGroup
+	cfg    Config
+	tunMgr tun.Device
+	mgmt   *http.Server
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// listeners are the outer sockets, server_address first.
+	listeners []*listener
+
+	// psks holds the accepted PSKs, current first. clientKeys holds the
+	// keys of provisioned clients from registry, which is nil unless
+	// clients_file is set. All three are guarded by psksMu.
+	psks       []pskEntry
+	clientKeys []pskEntry
+	registry   *clientRegistry
+	psksMu     sync.RWMutex
+
+	sessions   map[uint32]*serverSession
+	sessionsMu sync.RWMutex
+
+	// drops counts packets that could not be attributed to a session.
+	// dropped counts every dropped packet, attributed or not, by reason.
+	drops   atomic.Uint64
+	dropped dropCounters
+	stats   trafficStats
+	history *metrics.History
+
+	// fecRecovered counts packets rebuilt by FEC on all sessions.
+	fecRecovered atomic.Uint64
+
+	// tap sees every tunnelled packet when an embedder installs one.
+	// filters check what clients send; gateway is the server's own tunnel
+	// address, the source of the ICMP errors Reject sends.
+	tap            packetTap
+	mirror         *mirror        // nil unless mirror is configured
+	geo            *geoIP         // nil unless geoip is configured
+	decoy          *decoy         // nil unless decoy is configured
+	peer           *peerLink      // nil unless a p2p peer has peer_address or relay
+	lockout        *lockout       // nil unless lockout is configured
+	admission      *admission     // nil unless admission is configured
+	auth           *authenticator // nil unless auth is configured or SetAuthProvider was called
+	hellos         *helloNonces   // nonces of fresh Hellos already taken
+	profiles       map[string]*profile
+	clientProfiles map[string]string // the profile each provisioned client's entry names
+	filters        atomic.Pointer[[]PacketFilter]
+	gateway        netip.Addr
+	icmpErrors     icmpLimiter
+
+	// cluster is nil unless clustering is configured.
+	cluster *cluster
+	// hooks is nil unless webhooks are configured.
+	hooks *webhooks
 
-	clients   map[string]*net.UDPAddr
-	clientsMu sync.RWMutex
+	// pool is nil unless a client address pool is configured. routes maps
+	// client tunnel addresses to sessions, and allowed maps provisioned
+	// clients' allowed_ips to theirs, most specific first. qos and access
+	// hold provisioned clients' qos rules and access windows by name. All
+	// share sessionsMu.
+	pool    *addressPool
+	routes  map[netip.Addr]*serverSession
+	allowed []allowedRoute
+	qos     map[string][]qosRule
+	access  map[string]*accessWindow
+	// pool6 and delegates are nil unless pool6 and delegate_pool are
+	// configured. delegated maps delegated prefixes to sessions; IPv6
+	// addresses are in routes. They share sessionsMu too.
+	pool6     *addressPool
+	delegates *prefixPool
+	delegated map[netip.Prefix]*serverSession
+	// static hands out addresses to provisioned clients: the pool if there
+	// is one, otherwise the adapter subnet. revoked holds the names of
+	// revoked clients.
+	static  *addressPool
+	revoked map[string]bool
+	// natName is the NAT instance to remove on Stop, if one was created,
+	// and firewallRules the firewall rules.
+	natName       string
+	firewallRules []string
+	// forwarding are the IP forwarding changes to undo on Stop.
+	forwarding []journalEntry
+
+	// journal records the adapter, NAT and firewall rules this server added, so they are
+	// undone after a crash; nil for a device supplied by an embedder.
+	journal *journal
+
+	transcript *debugTranscript // nil unless debug_transcript is set
+	// forwards is nil unless port_forwards or remote_forwards are
+	// configured. remote maps the names of remote forwards to the sessions
+	// holding them, guarded by sessionsMu.
+	forwards *portForwards
+	remote   map[string]*serverSession
+}
+
+// pskEntry pairs an accepted PSK with its handshake cipher and key ID. For
+// a provisioned client it also names the client and its address.
+type pskEntry struct {
+	psk     string
+	id      string // see pskKeyID
+	hs      *crypto.Cipher
+	client  string
+	address netip.Prefix
+}
+
+// serverSession is the server's view of one handshaked client.
+type serverSession struct {
+	id       uint32
+	name     string // provisioned client name, if any
+	label    string // name the client gave itself in its Hello
+	software string // release version the client reported
+	user     string // login the AuthProvider accepted, if any
+	attrs    map[string][]string
+	keyID    string           // the key it handshook under, see pskKeyID
+	profiles *sessionProfiles // nil unless the session has profiles
+	geo      geoInfo
+	version  uint16
+	keys     sessionKeys
+
+	// helloNonce and welcome let a retransmitted Hello be answered with
+	// the same Welcome instead of replacing the session.
+	helloNonce []byte
+	welcome    []byte
+
+	connectedAt time.Time
+	adopted     time.Time      // when this node took ownership, by handshake or handoff
+	address     netip.Addr     // tunnel address, if known
+	leased      bool           // address came from the pool
+	allowed     []netip.Prefix // allowed_ips of a provisioned client
+	qos         *sessionQoS    // nil unless the provisioned client has qos rules
+	address6    netip.Addr     // IPv6 address from pool6, if any
+	delegated   netip.Prefix   // IPv6 prefix from delegate_pool, if any
+	lastSeen    atomicTime
+	stats       trafficStats
+	drops       atomic.Uint64
+
+	// forwards are the remote forwards granted to the client.
+	forwards []protocol.Forward
+
+	fec          *sessionFEC // nil unless negotiated
+	fecRecovered atomic.Uint64
+	reorder      *reorderBuffer // nil unless configured
+
+	// delayedAck sends the keepalive ack a NAT probe asked to delay.
+	delayedAck atomic.Pointer[time.Timer]
+
+	// pmtu is nil unless dynamic_mtu is on and the client answers probes.
+	pmtu *sessionPMTU
+
+	// path is where the client is reached, moved when it migrates to
+	// another transport.
+	path atomic.Pointer[sessionPath]
 }
 
 // NewServer constructs a Server.
 func NewServer(cfg Config) *Server {
+	return newServer(cfg, nil)
+}
+
+// NewServerWithTun constructs a Server that uses dev instead of creating a
+// platform adapter. The server closes dev on Stop.
+func NewServerWithTun(cfg Config, dev TunDevice) *Server {
+	return newServer(cfg, dev)
+}
+
+// newServer constructs a Server around dev, or around the platform TUN
+// device created at Start when dev is nil.
+func newServer(cfg Config, dev tun.Device) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Server{
-		cfg:     cfg,
-		ctx:     ctx,
-		cancel:  cancel,
-		clients: make(map[string]*net.UDPAddr),
+	s := &Server{
+		cfg:      cfg,
+		tunMgr:   dev,
+		ctx:      ctx,
+		cancel:   cancel,
+		sessions: make(map[uint32]*serverSession),
+		routes:   make(map[netip.Addr]*serverSession),
+		revoked:  make(map[string]bool),
+		history:  metrics.NewHistory(metrics.DefaultSize),
+		hellos:   newHelloNonces(),
+	}
+	if len(cfg.Webhooks) > 0 {
+		s.hooks = newWebhooks(cfg.Webhooks)
 	}
+	return s
 }
 
 // Start brings up the server tunnel and forwards packets.
 func (s *Server) Start() error {
-	
-if runtime.GOOS == "windows" {
-	port, err := s.cfg.ExtractPort()
+	if err := s.cfg.checkFIPS(); err != nil {
+		return err
+	}
+	profiles, err := parseProfiles(s.cfg.Profiles)
 	if err != nil {
-		log.Printf("Failed to extract port from server address: %v", err)
-	} else {
-		if err := SetupWindowsServer(s.cfg.AdapterName, port); err != nil {
-			log.Printf("Server setup warning: %v", err)
+		return err
+	}
+	s.profiles = profiles
+	if s.cfg.ManagementAddress != "" {
+		captureLogs()
+	}
+	log.Print(Build())
+	if s.cfg.FIPSMode {
+		log.Printf("FIPS mode: only clients in fips_mode are accepted")
+	}
+	if s.tunMgr == nil {
+		s.journal = openJournal(s.cfg)
+	}
+	if s.cfg.DebugTranscript != "" {
+		t, err := openDebugTranscript(s.cfg.DebugTranscript)
+		if err != nil {
+			return err
 		}
+		s.transcript = t
+	}
+	if s.tunMgr == nil && s.cfg.managesHost() {
+		s.openFirewall()
 	}
-}
 
 	// Crypto
-	ci, err := crypto.NewCipher([]byte(s.cfg.PSK))
-	if err != nil {
-		return fmt.Errorf("crypto init: %w", err)
+	for _, psk := range s.cfg.AcceptedPSKs() {
+		hs, err := handshakeCipher(psk)
+		if err != nil {
+			return fmt.Errorf("crypto init: %w", err)
+		}
+		s.psks = append(s.psks, pskEntry{psk: psk, id: pskKeyID(psk), hs: hs})
+	}
+
+	// Address pool
+	if s.cfg.Pool != "" {
+		pool, err := newAddressPool(s.cfg.Pool, s.cfg.AdapterIPCIDR)
+		if err != nil {
+			return err
+		}
+		s.pool = pool
+	}
+	if s.cfg.Pool6 != "" {
+		pool6, err := newPool6(s.cfg.Pool6)
+		if err != nil {
+			return err
+		}
+		s.pool6 = pool6
+	}
+	if s.cfg.DelegatePool != "" {
+		delegates, err := newPrefixPool(s.cfg.DelegatePool, s.cfg.delegateLength())
+		if err != nil {
+			return err
+		}
+		s.delegates = delegates
+		s.delegated = make(map[netip.Prefix]*serverSession)
+	}
+
+	// Filters
+	if p, err := netip.ParsePrefix(s.cfg.AdapterIPCIDR); err == nil {
+		s.gateway = p.Addr()
+	}
+	if s.cfg.DropSpoofed {
+		s.prependPacketFilter(antiSpoof)
+	}
+
+	// Provisioned clients, or the networks behind a p2p peer
+	if s.cfg.ClientsFile != "" {
+		if err := s.loadRegistry(); err != nil {
+			return err
+		}
+	}
+	if allowed, _ := parseAllowedIPs(s.cfg.AllowedIPs); len(allowed) > 0 {
+		s.sessionsMu.Lock()
+		s.addAllowedLocked(p2pPeer, allowed)
+		s.sessionsMu.Unlock()
 	}
-	s.cipher = ci
 
 	// TUN
-	tm, err := tun.SetupWintun(s.ctx, s.cfg.AdapterName, s.cfg.AdapterIPCIDR)
-	if err != nil {
-		return fmt.Errorf("tunnel setup: %w", err)
+	if s.tunMgr == nil {
+		tm, err := openTun(s.ctx, s.cfg, s.cfg.AdapterIPCIDR)
+		if err != nil {
+			return fmt.Errorf("tunnel setup: %w", err)
+		}
+		s.tunMgr = tm
+		s.journal.add(journalEntry{Kind: journalAdapter, Name: s.cfg.AdapterName})
+		if s.cfg.managesHost() {
+			s.startForwarding()
+		}
+	}
+
+	// IPv6
+	if s.pool6 != nil {
+		s.addTunnelAddress(netip.PrefixFrom(s.pool6.server, s.pool6.bits))
+	}
+	if s.delegates != nil {
+		s.routeIntoTunnel([]netip.Prefix{s.delegates.prefix})
 	}
-	s.tunMgr = tm
 
-	// UDP listen
-	addr, _ := net.ResolveUDPAddr("udp", s.cfg.ServerAddress)
-	udp, err := net.ListenUDP("udp", addr)
+	// Allowed IPs of provisioned clients
+	if len(s.allowed) > 0 {
+		prefixes := make([]netip.Prefix, len(s.allowed))
+		for i, r := range s.allowed {
+			prefixes[i] = r.prefix
+		}
+		s.routeIntoTunnel(prefixes)
+	}
+
+	// NAT
+	if s.cfg.NAT {
+		if err := s.enableNAT(); err != nil {
+			log.Printf("NAT setup warning: %v", err)
+		}
+	}
+
+	// Listen
+	versions, err := versionRange(s.cfg.MinProtocolVersion, 0)
 	if err != nil {
 		s.tunMgr.Close()
-		return fmt.Errorf("udp listen: %w", err)
+		return err
+	}
+	for _, address := range s.cfg.listenAddresses() {
+		ln, err := s.openListener(s.cfg.Transport, address, versions)
+		if err != nil {
+			s.closeListeners()
+			s.tunMgr.Close()
+			return err
+		}
+		s.listeners = append(s.listeners, ln)
+		if len(s.cfg.Listen) > 1 {
+			log.Printf("Listening on %s", ln.conn.LocalAddr())
+		}
+	}
+	if legacy := s.cfg.LegacyListen; legacy != nil {
+		versions, _ := versionRange(legacy.MinVersion, legacy.MaxVersion)
+		ln, err := s.openListener(s.cfg.Transport, legacy.Address, versions)
+		if err != nil {
+			s.closeListeners()
+			s.tunMgr.Close()
+			return err
+		}
+		s.listeners = append(s.listeners, ln)
+		log.Printf("Legacy listener on %s offers protocol %s", ln.conn.LocalAddr(), versions)
+	}
+	for _, m := range s.cfg.Migrate {
+		ln, err := s.openListener(m.Transport, m.Address, versions)
+		if err != nil {
+			s.closeListeners()
+			s.tunMgr.Close()
+			return err
+		}
+		s.listeners = append(s.listeners, ln)
+		log.Printf("Listening on %s over %s for sessions that migrate", ln.conn.LocalAddr(), ln.transport)
+	}
+	if s.cfg.DebugImpairment.Enabled() {
+		log.Printf("Warning: debug impairment enabled: %+v", s.cfg.DebugImpairment)
+	}
+
+	if s.cfg.GeoIP.Enabled() {
+		g, err := openGeoIP(s.cfg.GeoIP)
+		if err != nil {
+			s.closeListeners()
+			s.tunMgr.Close()
+			return err
+		}
+		s.geo = g
+	}
+	if s.cfg.Decoy.Enabled() {
+		s.decoy = newDecoy(s.cfg.Decoy)
+	}
+	if s.cfg.Lockout.Enabled() {
+		s.lockout = newLockout(s.cfg.Lockout)
+	}
+	if s.cfg.Admission.Enabled() {
+		s.admission = newAdmission(s.cfg.Admission)
+	}
+	if s.auth == nil && s.cfg.Auth.Radius != nil {
+		s.SetAuthProvider(newRadiusProvider(*s.cfg.Auth.Radius))
+	}
+	if s.auth == nil && s.cfg.Auth.LDAP != nil {
+		p, err := newLDAPProvider(*s.cfg.Auth.LDAP)
+		if err != nil {
+			s.closeListeners()
+			s.tunMgr.Close()
+			return err
+		}
+		s.SetAuthProvider(p)
+	}
+
+	if s.cfg.Mirror.Enabled() {
+		m, err := startMirror(s.ctx, s.cfg.Mirror)
+		if err != nil {
+			s.closeListeners()
+			s.tunMgr.Close()
+			return err
+		}
+		s.mirror = m
+	}
+
+	// Port forwards, before restored sessions reopen their remote forwards
+	if len(s.cfg.PortForwards) > 0 || s.cfg.RemoteForwards != nil {
+		s.forwards = newPortForwards(s.ctx, s.cfg.PortForwards, s.clientAddress, nil)
+		s.remote = make(map[string]*serverSession)
+	}
+
+	// Sessions saved by the last shutdown
+	if s.cfg.StateFile != "" {
+		if err := s.restoreState(); err != nil {
+			log.Printf("State restore warning: %v", err)
+		}
+	}
+
+	// Management
+	if s.cfg.ManagementAddress != "" {
+		mgmt, err := startManagement(s.ctx, s.cfg.ManagementAddress, s.managementMux())
+		if err != nil {
+			s.closeListeners()
+			s.tunMgr.Close()
+			return err
+		}
+		s.mgmt = mgmt
+	}
+
+	// Cluster
+	if s.cfg.Cluster.Enabled() {
+		c, err := newCluster(s.cfg.Cluster, s.clusterState, s.dropMovedSessions)
+		if err == nil {
+			err = c.start(s.ctx, &s.wg)
+		}
+		if err != nil {
+			stopManagement(s.mgmt)
+			s.closeListeners()
+			s.tunMgr.Close()
+			return err
+		}
+		s.cluster = c
+	}
+
+	// Webhooks
+	if s.hooks != nil {
+		s.hooks.start(s.ctx, &s.wg)
+	}
+
+	// Port mapping
+	if s.cfg.UPnP {
+		s.wg.Add(1)
+		go s.loopPortMap()
+	}
+
+	// LAN discovery
+	if s.cfg.Discovery {
+		s.wg.Add(1)
+		go s.announce()
+	}
+
+	// Speed test
+	if s.cfg.Speedtest {
+		if err := s.startSpeedtest(); err != nil {
+			log.Printf("Speed test unavailable: %v", err)
+		}
+	}
+
+	// Idle sessions
+	s.wg.Add(1)
+	go s.loopExpire()
+
+	// Path MTU
+	if s.cfg.DynamicMTU {
+		s.wg.Add(1)
+		go s.loopPMTU()
+	}
+
+	// Admission control
+	if s.admission != nil {
+		s.wg.Add(1)
+		go s.loopAdmission()
+	}
+
+	// Access windows
+	if len(s.access) > 0 {
+		s.wg.Add(1)
+		go s.loopAccess()
+	}
+
+	// The other end of a p2p link
+	if s.cfg.PeerAddress != "" || s.cfg.Relay != "" {
+		p, err := s.newPeerLink()
+		if err != nil {
+			stopManagement(s.mgmt)
+			s.closeListeners()
+			s.tunMgr.Close()
+			return err
+		}
+		s.peer = p
+		s.wg.Add(1)
+		go s.loopPeer()
 	}
-	s.udpConn = udp
 
 	// Forward loops
-	s.wg.Add(2)
-	go s.loopUDPToTun()
-	go s.loopTunToUDP()
+	workers := s.cfg.Workers()
+	s.wg.Add(workers + len(s.listeners) + 1)
+	for _, ln := range s.listeners {
+		go s.loopUDPToTun(ln)
+	}
+	for i := 0; i < workers; i++ {
+		go s.loopTunToUDP()
+	}
+	go func() {
+		defer s.wg.Done()
+		defer s.journal.guard()
+		sampler := &metrics.Sampler{History: s.history, Read: s.snapshot}
+		sampler.Run(s.ctx)
+	}()
 	return nil
 }
 
+// Addr returns the address the server is listening on, or nil before Start.
+func (s *Server) Addr() net.Addr {
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].conn.LocalAddr()
+}
+
 // Stop shuts down the server.
 func (s *Server) Stop() {
 	s.cancel()
-	if s.udpConn != nil {
-		s.udpConn.Close()
+	stopManagement(s.mgmt)
+	if s.forwards != nil {
+		s.forwards.close()
+	}
+	if s.cluster != nil {
+		s.cluster.stop()
 	}
+	s.closeListeners()
 	if s.tunMgr != nil {
 		s.tunMgr.Close()
 	}
+	if s.natName != "" {
+		if err := DisableNAT(s.natName); err != nil {
+			log.Printf("NAT cleanup warning: %v", err)
+		}
+	}
+	s.closeFirewall()
+	s.stopForwarding()
 	s.wg.Wait()
+	s.journal.clear()
+	s.transcript.close()
+	if s.cfg.StateFile != "" {
+		if err := s.saveState(); err != nil {
+			log.Printf("State save warning: %v", err)
+		}
+	}
+}
+
+// enableNAT masquerades traffic from the tunnel subnet behind the host.
+func (s *Server) enableNAT() error {
+	prefix, err := netip.ParsePrefix(s.cfg.AdapterIPCIDR)
+	if err != nil {
+		return err
+	}
+	name := "GoVPN-" + s.cfg.AdapterName
+	if err := EnableNAT(name, prefix.Masked().String()); err != nil {
+		return err
+	}
+	s.natName = name
+	s.journal.add(journalEntry{Kind: journalNAT, Name: name})
+	log.Printf("NAT enabled for %s", prefix.Masked())
+	return nil
 }
 
-func (s *Server) loopUDPToTun() {
+func (s *Server) loopUDPToTun(ln *listener) {
 	defer s.wg.Done()
+	defer s.journal.guard()
 	buf := make([]byte, 65536)
+	plain := make([]byte, 0, 65536)
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
 		default:
 		}
-		n, addr, err := s.udpConn.ReadFromUDP(buf)
+		n, addr, err := ln.conn.ReadFrom(buf)
 		if err != nil {
 			continue
 		}
-		// register client
-		key := addr.String()
-		s.clientsMu.Lock()
-		s.clients[key] = addr
-		s.clientsMu.Unlock()
+		h, payload, err := protocol.ParseHeader(buf[:n])
+		if err != nil {
+			s.drop(nil, dropMalformed)
+			s.probe(ln, addr, n, "malformed")
+			continue
+		}
+		if h.Type == protocol.MsgHandshakeInit {
+			s.handleHello(ln, addr, payload)
+			continue
+		}
+		if h.Type == protocol.MsgHandshakeResp && s.peer != nil {
+			s.peerWelcome(ln, addr, n, payload)
+			continue
+		}
 
-		dec, _ := s.cipher.Decrypt(buf[:n])
-		s.tunMgr.WritePacket(dec)
+		s.sessionsMu.RLock()
+		sess := s.sessions[h.Session]
+		s.sessionsMu.RUnlock()
+		if sess == nil && s.cluster != nil {
+			sess = s.adoptSession(ln, h.Session, addr, payload)
+		}
+		if sess == nil && !h.Type.Known() {
+			s.drop(nil, dropMalformed)
+			s.probe(ln, addr, n, "unknown message type")
+			continue
+		}
+		if sess == nil {
+			chaff().Authentic(payload)
+			s.drop(nil, dropUnknownSession)
+			s.transcript.drop(addr, h, errUnknownSession)
+			errorLog.Printf("Packet from %s for unknown session", addr)
+			s.answer(ln, addr, n)
+			continue
+		}
+		dec, seq, err := sess.keys.recv.DecryptAppend(plain[:0], payload)
+		if err != nil {
+			s.drop(sess, decryptReason(err))
+			s.transcript.drop(addr, h, err)
+			errorLog.Printf("Decrypt error from %s: %v", addr, err)
+			s.answer(ln, addr, n)
+			continue
+		}
+		sess.lastSeen.Store(time.Now())
+
+		if h.Type == protocol.MsgPathProbe {
+			s.answerPathProbe(sess, ln, addr, dec)
+			continue
+		}
+		s.follow(sess, ln, addr, seq)
+		if h.Type == protocol.MsgKeepalive {
+			s.ackKeepalive(sess, ln, addr, dec)
+		}
+		if h.Type == protocol.MsgMTUProbe {
+			if sess.pmtu != nil {
+				sess.pmtu.ack(dec)
+			}
+			continue
+		}
+		if sess.reorder != nil {
+			sess.reorder.add(seq, h.Type, dec)
+		} else {
+			s.deliver(sess, h.Type, dec)
+		}
 	}
 }
 
+// deliver writes the inner packets of a decrypted message to the tunnel.
+func (s *Server) deliver(sess *serverSession, t protocol.MessageType, dec []byte) {
+	switch t {
+	case protocol.MsgData:
+		s.toTun(sess, dec)
+	case protocol.MsgFEC:
+		if sess.fec == nil {
+			s.drop(sess, dropFEC)
+			return
+		}
+		pkts, recovered, err := sess.fec.dec.Add(dec)
+		if err != nil {
+			s.drop(sess, dropFEC)
+			return
+		}
+		sess.fecRecovered.Add(uint64(recovered))
+		s.fecRecovered.Add(uint64(recovered))
+		for _, pkt := range pkts {
+			s.toTun(sess, pkt)
+		}
+	}
+}
+
+// toTun writes one of sess's packets to the tunnel if the filters let it
+// through.
+func (s *Server) toTun(sess *serverSession, pkt []byte) {
+	s.tap.observe(Inbound, pkt)
+	s.mirror.copy(sess, pkt)
+	if !sess.sourceAllowed(pkt) {
+		s.drop(sess, dropFilter)
+		return
+	}
+	switch s.filter(sess, pkt) {
+	case Drop:
+		s.drop(sess, dropFilter)
+		return
+	case Reject:
+		s.drop(sess, dropFilter)
+		s.reject(sess, icmpProhibited, pkt, 0)
+		return
+	}
+	if !sess.profiles.allows(pkt, s.gateway) {
+		s.drop(sess, dropProfile)
+		s.reject(sess, icmpProhibited, pkt, 0)
+		return
+	}
+	if !sess.qos.apply(Inbound, pkt) {
+		s.drop(sess, dropPoliced)
+		return
+	}
+	if s.cfg.MTU > 0 && len(pkt) > s.cfg.MTU {
+		s.drop(sess, dropMTU)
+		s.reject(sess, icmpTooBig, pkt, s.cfg.MTU)
+		return
+	}
+	if s.unroutable(pkt) {
+		s.drop(sess, dropNoRoute)
+		s.reject(sess, icmpNoRoute, pkt, 0)
+		return
+	}
+	if reply := echoReply(s.gateway, pkt); reply != nil {
+		sess.stats.addIn(len(pkt))
+		s.stats.addIn(len(pkt))
+		s.tap.observe(Outbound, reply)
+		s.send(sess, reply, nil)
+		return
+	}
+	if err := s.tunMgr.WritePacket(pkt); err != nil {
+		s.drop(sess, dropTunWrite)
+		return
+	}
+	sess.stats.addIn(len(pkt))
+	s.stats.addIn(len(pkt))
+}
+
 func (s *Server) loopTunToUDP() {
 	defer s.wg.Done()
+	defer s.journal.guard()
+	r := newTunReader(s.tunMgr, s.cfg.UDPOffload)
+	if r.ch != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.journal.guard()
+			r.feed(s.ctx)
+		}()
+	}
+	tx := &txBatch{}
+	var pkts [][]byte
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
 		default:
 		}
-		pkt, err := s.tunMgr.ReadPacket()
+		var err error
+		pkts, err = r.read(pkts[:0])
+		if errors.Is(err, tun.ErrClosed) {
+			return
+		}
 		if err != nil {
 			continue
 		}
-		enc, _ := s.cipher.Encrypt(pkt)
-		// broadcast to all
-		s.clientsMu.RLock()
-		for _, addr := range s.clients {
-			s.udpConn.WriteToUDP(enc, addr)
+		for _, pkt := range pkts {
+			s.forward(pkt, tx)
 		}
-		s.clientsMu.RUnlock()
+		s.flush(tx)
+		clear(pkts)
+	}
+}
+
+// forward encrypts pkt for the client holding its destination address, or
+// for every client, and sends it or adds it to tx's run. tx may be nil.
+func (s *Server) forward(pkt []byte, tx *txBatch) {
+	s.tap.observe(Outbound, pkt)
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	if sess, routed := s.routeLocked(pkt); routed {
+		if sess == nil {
+			s.drop(nil, dropNoRoute)
+		} else if mtu := sess.pmtu.current(); mtu > 0 && len(pkt) > mtu {
+			// The client's adapter would drop it.
+			s.drop(sess, dropMTU)
+			s.rejectTooBig(pkt, mtu)
+		} else {
+			s.send(sess, pkt, tx)
+		}
+	} else {
+		// broadcast to all, each with a copy qos may remark
+		for _, sess := range s.sessions {
+			p := pkt
+			if sess.qos != nil {
+				p = slices.Clone(pkt)
+			}
+			s.send(sess, p, tx)
+		}
+	}
+}
+
+// send encrypts pkt for sess and sends it, or, when sess's socket takes
+// runs, adds it to tx's run. tx may be nil.
+func (s *Server) send(sess *serverSession, pkt []byte, tx *txBatch) {
+	if !sess.qos.apply(Outbound, pkt) {
+		s.drop(sess, dropPoliced)
+		return
+	}
+	s.mirror.copy(sess, pkt)
+	if sess.fec != nil {
+		sess.fec.enc.Add(pkt)
+		sess.stats.addOut(len(pkt))
+		s.stats.addOut(len(pkt))
+		return
+	}
+	out, err := appendPacket(tx.scratch()[:0], sess.keys.send, protocol.MsgData, sess.id, pkt)
+	if err != nil {
+		s.drop(sess, dropSend)
+		return
+	}
+	if tx == nil {
+		s.sent(sess, len(pkt), sess.write(out))
+		return
+	}
+	tx.out = out
+	p := sess.path.Load()
+	w, ok := p.ln.conn.(batchWriter)
+	if !ok {
+		s.sent(sess, len(pkt), sess.write(out))
+		return
 	}
+	if !tx.fits(w, p.addr, len(out)) {
+		s.flush(tx)
+	}
+	tx.add(w, p.addr, sess, out, len(pkt))
+}
+
+// sent counts an inner packet of n bytes as sent to sess, or as dropped
+// when the send failed with err.
+func (s *Server) sent(sess *serverSession, n int, err error) {
+	switch {
+	case errors.Is(err, syscall.EMSGSIZE):
+		s.drop(sess, dropMTU)
+		s.pathShrank(sess)
+	case err != nil:
+		s.drop(sess, dropSend)
+	default:
+		sess.stats.addOut(n)
+		s.stats.addOut(n)
+	}
+}
+
+// flush sends tx's run, if any.
+func (s *Server) flush(tx *txBatch) {
+	sess := tx.sess
+	inner, err := tx.send()
+	for _, n := range inner {
+		s.sent(sess, n, err)
+	}
+}
+
+// drop counts a packet discarded for reason r against sess, or against the
+// server when it cannot be attributed to a session.
+func (s *Server) drop(sess *serverSession, r dropReason) {
+	if sess != nil {
+		sess.drops.Add(1)
+	} else {
+		s.drops.Add(1)
+	}
+	s.dropped.add(r)
+}
+
+// startReorder gives sess a reordering buffer if one is configured.
+func (s *Server) startReorder(sess *serverSession) {
+	if s.cfg.Reorder.Enabled() {
+		sess.reorder = newReorderBuffer(s.cfg.Reorder, func(t protocol.MessageType, pkt []byte) {
+			s.deliver(sess, t, pkt)
+		})
+	}
+}
+
+// newSessionFEC starts FEC for sess with the shape the client asked for.
+func (s *Server) newSessionFEC(sess *serverSession, p protocol.FEC) (*sessionFEC, error) {
+	return newSessionFEC(p, sess.keys.send,
+		func() uint32 { return sess.id },
+		func(pkt []byte) {
+			if err := sess.write(pkt); err != nil {
+				s.drop(sess, dropSend)
+			}
+		})
+}
+
+// multiListen reports whether the server opens more than one socket.
+func (s *Server) multiListen() bool {
+	return len(s.cfg.listenAddresses()) > 1 || s.cfg.LegacyListen != nil
+}
+
+// listen opens an outer socket on address over transport.
+func (s *Server) listen(transport, address string) (PacketConn, error) {
+	t, err := lookupTransport(transport)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil {
+		conn, err := t.Listen(s.ctx, address)
+		if err != nil {
+			return nil, fmt.Errorf("%s listen: %w", transport, err)
+		}
+		return conn, nil
+	}
+	addr, _ := net.ResolveUDPAddr("udp", address)
+	network := "udp"
+	if s.multiListen() && addr != nil && addr.IP != nil {
+		// Pin each socket to its address family, so 0.0.0.0 and [::] on
+		// the same port do not collide as dual-stack sockets.
+		network = "udp6"
+		if addr.IP.To4() != nil {
+			network = "udp4"
+		}
+	}
+	udp, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("udp listen: %w", err)
+	}
+	if s.cfg.FwMark != 0 {
+		if err := markConn(udp, s.cfg.FwMark); err != nil {
+			udp.Close()
+			return nil, err
+		}
+	}
+	if s.cfg.DynamicMTU {
+		if err := setDontFragment(udp); err != nil {
+			udp.Close()
+			return nil, fmt.Errorf("dynamic_mtu: %w", err)
+		}
+	}
+	if s.cfg.Encapsulation == GREEncapsulation {
+		return &greudp.PacketConn{PacketConn: udp}, nil
+	}
+	if s.cfg.FastPath == FastPathAFPacket {
+		return openFastPath(udp), nil
+	}
+	if s.cfg.UDPOffload {
+		if conn := openOffload(udp); conn != nil {
+			log.Printf("UDP offload on %s: sending and receiving in runs with GSO and GRO", udp.LocalAddr())
+			return conn, nil
+		}
+	}
+	return udp, nil
+}
+
+// handleHello authenticates a handshake initiation, negotiates the protocol
+// version, and registers a new session for the sender.
+func (s *Server) handleHello(ln *listener, addr net.Addr, payload []byte) {
+	// The key is tried before the lockout is checked, so a locked out
+	// sender is refused as slowly, and as quietly, as a wrong key.
+	var hello protocol.Hello
+	key, err := s.openHello(payload, &hello)
+	if s.lockout.locked(addr) {
+		s.drop(nil, dropLockedOut)
+		s.probe(ln, addr, protocol.HeaderSize+len(payload), "locked out")
+		return
+	}
+	if err != nil {
+		s.transcript.drop(addr, protocol.Header{Type: protocol.MsgHandshakeInit}, err)
+		errorLog.Printf("Handshake from %s: %v", addr, err)
+		s.hooks.emit(Event{Type: EventAuthFailed, Endpoint: addr.String(), Reason: "unknown key"})
+		s.lockout.failed(addr)
+		s.probe(ln, addr, protocol.HeaderSize+len(payload), "unknown key")
+		return
+	}
+	s.transcript.hello("in", addr, &hello)
+	if !hello.Fresh(time.Now()) {
+		errorLog.Printf("Handshake from %s: stale timestamp", addr)
+		s.hooks.emit(Event{Type: EventAuthFailed, Client: key.client, Endpoint: addr.String(), Reason: "stale timestamp"})
+		return
+	}
+	if s.peer.outranks(hello.Nonce) {
+		return
+	}
+	if s.resendWelcome(ln, addr, hello.Nonce) {
+		return
+	}
+	// Anything else carrying a nonce already taken is a replay, wherever
+	// it seems to come from.
+	if !s.hellos.first(&hello, time.Now()) {
+		s.drop(nil, dropReplay)
+		errorLog.Printf("Handshake from %s: replayed Hello", addr)
+		return
+	}
+
+	welcome := &protocol.Welcome{
+		MinVersion: ln.versions.Min,
+		MaxVersion: ln.versions.Max,
+		Transcript: protocol.Transcript(payload),
+		FIPS:       s.cfg.FIPSMode,
+		Software:   software(),
+	}
+	version, err := protocol.Negotiate(ln.versions, hello.Range())
+	if err != nil {
+		log.Printf("Rejecting %s: %v", addr, err)
+		welcome.Error = err.Error()
+		s.sendWelcome(ln, key.hs, addr, 0, welcome)
+		return
+	}
+	if s.cfg.FIPSMode && !hello.FIPS {
+		log.Printf("Rejecting %s: client is not in fips_mode", addr)
+		welcome.Error = "server requires fips_mode"
+		s.sendWelcome(ln, key.hs, addr, 0, welcome)
+		return
+	}
+	if err := s.cfg.checkClientVersion(hello.Software); err != nil {
+		log.Printf("Rejecting %s: %v", addr, err)
+		welcome.Error = err.Error()
+		s.sendWelcome(ln, key.hs, addr, 0, welcome)
+		return
+	}
+	geo := s.geo.lookup(addr)
+	if err := s.geo.check(geo); err != nil {
+		log.Printf("Rejecting %s: %v", addr, err)
+		ev := Event{Type: EventAuthFailed, Client: key.client, Endpoint: addr.String(), Reason: "geoip"}
+		ev.setGeo(geo)
+		s.hooks.emit(ev)
+		welcome.Error = err.Error()
+		s.sendWelcome(ln, key.hs, addr, 0, welcome)
+		return
+	}
+	if s.refuseBusy(ln, addr, key, welcome) {
+		return
+	}
+	if hello.Probe {
+		welcome.Version = version
+		s.sendWelcome(ln, key.hs, addr, 0, welcome)
+		return
+	}
+	if hello.Lease && s.pool == nil && key.client == "" {
+		log.Printf("Rejecting %s: asked for an address but no pool is configured", addr)
+		welcome.Error = "server has no address pool; set adapter_ip_cidr"
+		s.sendWelcome(ln, key.hs, addr, 0, welcome)
+		return
+	}
+
+	hs := &handshakeContext{ln: ln, addr: addr, key: key, hello: &hello, welcome: welcome, version: version, geo: geo}
+	if s.auth != nil {
+		if err := checkCredentials(&hello); err != nil {
+			log.Printf("Rejecting %s: no username or password", addr)
+			ev := Event{Type: EventAuthFailed, Client: key.client, Endpoint: addr.String(), Reason: "login"}
+			ev.setGeo(geo)
+			s.hooks.emit(ev)
+			welcome.Error = err.Error()
+			s.sendWelcome(ln, key.hs, addr, 0, welcome)
+			return
+		}
+		// A retransmitted Hello whose login is still being checked is
+		// dropped; the first one gets the answer.
+		if s.auth.begin(hello.Nonce) {
+			s.wg.Add(1)
+			go s.authenticate(hs)
+		}
+		return
+	}
+	s.admit(hs)
+}
+
+// handshakeContext is a Hello that passed the server's checks, on its way
+// to becoming a session.
+type handshakeContext struct {
+	ln      *listener
+	addr    net.Addr
+	key     pskEntry
+	hello   *protocol.Hello
+	welcome *protocol.Welcome
+	version uint16
+	geo     geoInfo
+
+	user     string              // login the AuthProvider accepted, if any
+	attrs    map[string][]string // what the AuthProvider said of user
+	profiles []string            // profiles the login's groups give it
+}
+
+// admit finishes a handshake: it sets up the session and sends the Welcome.
+func (s *Server) admit(hs *handshakeContext) {
+	ln, addr, key, hello, welcome, version, geo := hs.ln, hs.addr, hs.key, hs.hello, hs.welcome, hs.version, hs.geo
+	nonce, err := crypto.RandomBytes(protocol.NonceSize)
+	if err != nil {
+		log.Printf("Handshake from %s: %v", addr, err)
+		return
+	}
+	keys, err := deriveSessionKeys(key.psk, hello.Nonce, nonce, true)
+	if err != nil {
+		log.Printf("Handshake from %s: %v", addr, err)
+		return
+	}
+	now := time.Now()
+	sess := &serverSession{name: key.client, keyID: key.id, label: cleanLabel(hello.Name), software: cleanLabel(hello.Software), user: hs.user, attrs: hs.attrs, geo: geo, version: version, keys: keys, connectedAt: now, adopted: now}
+	if s.cfg.Mode == "p2p" {
+		sess.name = p2pPeer
+	}
+	sess.path.Store(&sessionPath{ln: ln, addr: addr})
+	sess.lastSeen.Store(now)
+	s.startReorder(sess)
+	if s.cfg.DynamicMTU && hello.MTUProbes {
+		sess.pmtu = newSessionPMTU(s.cfg.MTU, hello.MTU, now)
+	}
+	if hello.FEC != nil {
+		if sess.fec, err = s.newSessionFEC(sess, *hello.FEC); err != nil {
+			log.Printf("Client %s: %v; continuing without FEC", addr, err)
+		} else {
+			welcome.FEC = hello.FEC
+		}
+	}
+
+	s.sessionsMu.Lock()
+	if s.revoked[key.client] {
+		s.sessionsMu.Unlock()
+		log.Printf("Rejecting %s: client %q is revoked", addr, key.client)
+		s.hooks.emit(Event{Type: EventAuthFailed, Client: key.client, Endpoint: addr.String(), Reason: "revoked"})
+		welcome.Error = "client revoked"
+		s.sendWelcome(ln, key.hs, addr, 0, welcome)
+		return
+	}
+	if w := s.access[key.client]; key.client != "" && !w.allows(now) {
+		s.sessionsMu.Unlock()
+		log.Printf("Rejecting %s: client %q is outside its access window (%s)", addr, key.client, w.text)
+		s.hooks.emit(Event{Type: EventAuthFailed, Client: key.client, Endpoint: addr.String(), Reason: "access_window"})
+		welcome.Error = "outside access window " + w.text
+		s.sendWelcome(ln, key.hs, addr, 0, welcome)
+		return
+	}
+	// A p2p peer has one session at a time, wherever it comes from.
+	for id, old := range s.sessions {
+		if old.at(ln, addr) || s.cfg.Mode == "p2p" {
+			s.removeSessionLocked(id, "replaced")
+		}
+	}
+	switch {
+	case s.cfg.Mode == "p2p":
+		s.peerAddressLocked(sess, hello.Static)
+	case key.client != "":
+		// Provisioned clients always get their own address.
+		sess.address = key.address.Addr()
+		if hello.Lease {
+			welcome.Address = key.address.String()
+		}
+	case hello.Lease:
+		if !s.leaseLocked(sess, hello.Address) {
+			s.sessionsMu.Unlock()
+			log.Printf("Rejecting %s: address pool %s exhausted", addr, s.pool.prefix)
+			welcome.Error = "address pool exhausted"
+			s.sendWelcome(ln, key.hs, addr, 0, welcome)
+			return
+		}
+		welcome.Address = s.pool.clientPrefix(sess.address).String()
+	case hello.Static != "":
+		s.staticLocked(sess, hello.Static)
+	}
+	if hello.Lease6 && s.pool6 != nil {
+		if s.lease6Locked(sess, hello.Address6) {
+			welcome.Address6 = s.pool6.clientPrefix(sess.address6).String()
+		} else {
+			log.Printf("IPv6 pool %s exhausted; %s gets no IPv6 address", s.pool6.prefix, addr)
+		}
+	}
+	if hello.Delegate && s.delegates != nil {
+		if s.delegateLocked(sess, hello.Prefix) {
+			welcome.Prefix = sess.delegated.String()
+		} else {
+			log.Printf("Delegate pool %s exhausted; %s gets no prefix", s.delegates.prefix, addr)
+		}
+	}
+	sess.id = s.newSessionIDLocked()
+	s.sessions[sess.id] = sess
+	if sess.address.IsValid() {
+		s.routes[sess.address] = sess
+	}
+	s.bindAllowedLocked(sess)
+	s.bindProfilesLocked(sess, hs.profiles)
+	s.bindQoSLocked(sess)
+	if len(hello.Forwards) > 0 {
+		welcome.Forwards = s.grantForwardsLocked(sess, hello.Forwards)
+	}
+	s.sessionsMu.Unlock()
+
+	welcome.Version = version
+	welcome.Session = sess.id
+	welcome.Nonce = nonce
+	welcome.DNS = s.cfg.DNS
+	if s.gateway.IsValid() {
+		welcome.Gateway = s.gateway.String()
+	}
+	welcome.Domains = s.cfg.SearchDomains
+	sess.profiles.push(welcome)
+	welcome.MTU = s.cfg.MTU
+	if sess.pmtu != nil {
+		welcome.MTU = sess.pmtu.current()
+	}
+	welcome.NTP = s.cfg.NTPServers
+	welcome.MaxSession = int64(s.cfg.MaxSessionDuration / time.Second)
+	pkt, err := sealHandshake(key.hs, protocol.MsgHandshakeResp, sess.id, welcome)
+	if err != nil {
+		log.Printf("Seal welcome for %s: %v", addr, err)
+		return
+	}
+	sess.helloNonce = hello.Nonce
+	sess.welcome = pkt
+	s.transcript.welcome("out", addr, welcome, "")
+	ln.conn.WriteTo(pkt, addr)
+	if s.cfg.Mode == "p2p" {
+		log.Printf("Peer %s connected: session %08x, protocol v%d", addr, sess.id, version)
+	} else if who := sess.displayName(); who != "" {
+		log.Printf("Client %q (%s) connected: session %08x, protocol v%d", who, addr, sess.id, version)
+	} else {
+		log.Printf("Client %s connected: session %08x, protocol v%d", addr, sess.id, version)
+	}
+	if s.geo != nil {
+		log.Printf("Session %08x comes from %s", sess.id, sess.geo)
+	}
+	if sess.user != "" {
+		if attrs := attributesString(sess.attrs); attrs != "" {
+			log.Printf("Session %08x logged in as %q (%s)", sess.id, sess.user, attrs)
+		} else {
+			log.Printf("Session %08x logged in as %q", sess.id, sess.user)
+		}
+	}
+	if names := sess.profiles.profileNames(); len(names) > 0 {
+		log.Printf("Session %08x has profiles %s", sess.id, strings.Join(names, ", "))
+	}
+	if sess.leased {
+		log.Printf("Leased %s to session %08x", sess.address, sess.id)
+	}
+	if sess.address6.IsValid() {
+		log.Printf("Leased %s to session %08x", sess.address6, sess.id)
+	}
+	if sess.delegated.IsValid() {
+		log.Printf("Delegated %s to session %08x", sess.delegated, sess.id)
+	}
+	s.lockout.succeeded(addr)
+	s.hooks.emit(sess.event(EventConnected, ""))
+}
+
+// displayName is how sess is named in logs: its provisioned name, or else
+// the label it sent, or empty if it has neither.
+func (sess *serverSession) displayName() string {
+	if sess.name != "" {
+		return sess.name
+	}
+	return sess.label
+}
+
+// maxLabelLength bounds the label a client can give itself.
+const maxLabelLength = 64
+
+// cleanLabel makes a client-supplied label safe to log and display: it
+// keeps printable characters only, up to maxLabelLength of them.
+func cleanLabel(label string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range strings.TrimSpace(label) {
+		if !unicode.IsPrint(r) {
+			continue
+		}
+		if n++; n > maxLabelLength {
+			break
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// leaseLocked gives sess an address from the pool, preferring the one the
+// client held before. When the pool is full, leases of sessions that have
+// been silent past the keepalive timeout are reclaimed. Callers must hold
+// sessionsMu for writing.
+func (s *Server) leaseLocked(sess *serverSession, want string) bool {
+	prev, _ := netip.ParseAddr(want)
+	a, ok := s.pool.leaseLocked(prev)
+	if !ok {
+		s.reclaimLocked()
+		a, ok = s.pool.leaseLocked(prev)
+	}
+	sess.address, sess.leased = a, ok
+	return ok
+}
+
+// staticLocked routes to the address a client took from its
+// adapter_fallbacks, unless it is in the pool or another session holds it.
+// Callers must hold sessionsMu for writing.
+func (s *Server) staticLocked(sess *serverSession, cidr string) {
+	p, err := netip.ParsePrefix(cidr)
+	switch {
+	case err != nil:
+		log.Printf("Session from %s reported an invalid address %q", sess.remote(), cidr)
+		return
+	case s.pool != nil && s.pool.prefix.Contains(p.Addr()):
+		log.Printf("Session from %s reported %s, which is in the pool; not routing to it", sess.remote(), p.Addr())
+		return
+	case s.routes[p.Addr()] != nil:
+		log.Printf("Session from %s reported %s, which another session holds; not routing to it", sess.remote(), p.Addr())
+		return
+	}
+	sess.address = p.Addr()
+	log.Printf("Client %s moved its adapter to %s, off a subnet that collided on its host", sess.remote(), p)
+	if subnet, err := netip.ParsePrefix(s.cfg.AdapterIPCIDR); err == nil && !subnet.Masked().Contains(p.Addr()) {
+		log.Printf("Warning: %s is outside %s; the server's host needs a route to it via %s", p.Masked(), subnet.Masked(), s.cfg.AdapterName)
+	}
+}
+
+// removeSessionLocked forgets a session, returns its address to the pool,
+// and reports the disconnect with reason. Callers must hold sessionsMu for
+// writing.
+func (s *Server) removeSessionLocked(id uint32, reason string) {
+	sess := s.sessions[id]
+	if sess == nil {
+		return
+	}
+	delete(s.sessions, id)
+	sess.fec.close()
+	sess.reorder.stop()
+	if s.routes[sess.address] == sess {
+		delete(s.routes, sess.address)
+	}
+	s.unbindAllowedLocked(sess)
+	s.releaseDualStackLocked(sess)
+	s.releaseForwardsLocked(sess)
+	if sess.leased {
+		s.pool.releaseLocked(sess.address)
+		log.Printf("Released %s from session %08x", sess.address, id)
+	}
+	s.hooks.emit(sess.event(EventDisconnected, reason))
+}
+
+// routeLocked returns the session holding the packet's destination, by
+// address, delegated prefix, or allowed_ips. It reports false when the packet should go to
+// every client; a nil session with true means the client the packet
+// belongs to is offline, or that no client holds its pool address. Callers
+// must hold sessionsMu.
+func (s *Server) routeLocked(pkt []byte) (*serverSession, bool) {
+	dst, ok := packetDst(pkt)
+	if !ok {
+		return nil, false
+	}
+	if sess := s.routes[dst]; sess != nil {
+		return sess, true
+	}
+	if sess, ok := s.delegatedRouteLocked(dst); ok {
+		return sess, true
+	}
+	if r := s.allowedRouteLocked(dst); r != nil {
+		return r.sess, true
+	}
+	if s.pool != nil && s.pool.usable(dst) || s.pool6 != nil && s.pool6.usable(dst) {
+		// A free address.
+		return nil, true
+	}
+	return nil, false
+}
+
+// resendWelcome answers a retransmitted Hello with the Welcome already sent
+// for it. It reports whether the Hello was a retransmission.
+func (s *Server) resendWelcome(ln *listener, addr net.Addr, nonce []byte) bool {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	for _, sess := range s.sessions {
+		if sess.at(ln, addr) && bytes.Equal(sess.helloNonce, nonce) {
+			ln.conn.WriteTo(sess.welcome, addr)
+			return true
+		}
+	}
+	return false
+}
+
+// openHello tries each accepted PSK, then each provisioned client's, in
+// turn and returns the one that authenticated the Hello.
+func (s *Server) openHello(payload []byte, hello *protocol.Hello) (pskEntry, error) {
+	s.psksMu.RLock()
+	defer s.psksMu.RUnlock()
+	// Every key is tried, also after one fits, so the time taken tells
+	// neither which key fit nor whether one did.
+	var found pskEntry
+	var body []byte
+	err := errors.New("no keys")
+	for _, keys := range [][]pskEntry{s.psks, s.clientKeys} {
+		for _, key := range keys {
+			b, e := key.hs.Decrypt(payload)
+			if e == nil && body == nil {
+				found, body = key, b
+			} else if e != nil {
+				err = e
+			}
+		}
+	}
+	if body == nil {
+		return pskEntry{}, fmt.Errorf("handshake authentication failed: %w", err)
+	}
+	if err := protocol.Unmarshal(body, hello); err != nil {
+		return pskEntry{}, err
+	}
+	return found, nil
+}
+
+func (s *Server) sendWelcome(ln *listener, hs *crypto.Cipher, addr net.Addr, session uint32, w *protocol.Welcome) {
+	s.transcript.welcome("out", addr, w, "")
+	pkt, err := sealHandshake(hs, protocol.MsgHandshakeResp, session, w)
+	if err != nil {
+		log.Printf("Seal welcome for %s: %v", addr, err)
+		return
+	}
+	ln.conn.WriteTo(pkt, addr)
+}
+
+// newSessionIDLocked picks an unused, non-zero session ID. In a cluster the
+// top byte is the node ID, so IDs never collide between nodes. Callers must
+// hold sessionsMu for writing.
+func (s *Server) newSessionIDLocked() uint32 {
+	for {
+		b, err := crypto.RandomBytes(4)
+		if err != nil {
+			continue
+		}
+		if s.cfg.Cluster.Enabled() {
+			b[0] = s.cfg.Cluster.NodeID
+		}
+		id := binary.BigEndian.Uint32(b)
+		if _, taken := s.sessions[id]; id != 0 && !taken {
+			return id
+		}
+	}
+}
+
+// loadRegistry reads clients_file, accepts each client's key, and reserves
+// their addresses.
+func (s *Server) loadRegistry() error {
+	reg, err := loadRegistry(s.cfg.ClientsFile)
+	if err != nil {
+		return err
+	}
+	s.static = s.pool
+	if s.static == nil {
+		subnet, err := netip.ParsePrefix(s.cfg.AdapterIPCIDR)
+		if err != nil {
+			return fmt.Errorf("adapter_ip_cidr: %w", err)
+		}
+		if s.static, err = newAddressPool(subnet.Masked().String(), s.cfg.AdapterIPCIDR); err != nil {
+			return err
+		}
+	}
+	for _, c := range reg.Clients {
+		key, err := clientKey(c)
+		if err != nil {
+			return fmt.Errorf("client %q: %w", c.Name, err)
+		}
+		s.clientKeys = append(s.clientKeys, key)
+		if c.Revoked != nil {
+			s.revoked[c.Name] = true
+			continue
+		}
+		s.static.reserveLocked(key.address.Addr())
+		allowed, _ := parseAllowedIPs(c.AllowedIPs)
+		if err := s.checkAllowedLocked(c.Name, allowed); err != nil {
+			return fmt.Errorf("client %q: %w", c.Name, err)
+		}
+		s.addAllowedLocked(c.Name, allowed)
+		if rules, _ := parseQoS(c.QoS); len(rules) > 0 {
+			if s.qos == nil {
+				s.qos = make(map[string][]qosRule)
+			}
+			s.qos[c.Name] = rules
+		}
+		if c.Profile != "" {
+			if _, ok := s.profiles[c.Profile]; !ok {
+				return fmt.Errorf("client %q: profile %q is not in profiles", c.Name, c.Profile)
+			}
+			if s.clientProfiles == nil {
+				s.clientProfiles = make(map[string]string)
+			}
+			s.clientProfiles[c.Name] = c.Profile
+		}
+		if w, _ := parseAccessWindow(c); w != nil {
+			if s.access == nil {
+				s.access = make(map[string]*accessWindow)
+			}
+			s.access[c.Name] = w
+		}
+	}
+	s.registry = reg
+	log.Printf("Loaded %d provisioned clients from %s", len(reg.Clients), s.cfg.ClientsFile)
+	return nil
+}
+
+// ExportClient provisions a client called name with a new PSK and the next
+// free address, saves it to clients_file, and accepts it immediately. routes
+// are the prefixes the client should send through the tunnel; allowedIPs
+// are the prefixes behind it, routed only to it.
+func (s *Server) ExportClient(name string, routes, allowedIPs []string) (ClientEntry, error) {
+	if name == "" {
+		return ClientEntry{}, fmt.Errorf("name is required")
+	}
+	for _, r := range routes {
+		if _, err := netip.ParsePrefix(r); err != nil {
+			return ClientEntry{}, fmt.Errorf("route: %w", err)
+		}
+	}
+	allowed, err := parseAllowedIPs(allowedIPs)
+	if err != nil {
+		return ClientEntry{}, err
+	}
+	psk, err := randomPSK()
+	if err != nil {
+		return ClientEntry{}, err
+	}
+
+	s.psksMu.Lock()
+	defer s.psksMu.Unlock()
+	if s.registry == nil {
+		return ClientEntry{}, fmt.Errorf("clients_file is not configured")
+	}
+	if c := s.registry.find(name); c != nil && c.Revoked != nil {
+		return ClientEntry{}, fmt.Errorf("client %q was revoked; pick another name", name)
+	} else if c != nil {
+		return ClientEntry{}, fmt.Errorf("client %q already exists", name)
+	}
+
+	s.sessionsMu.Lock()
+	if err := s.checkAllowedLocked(name, allowed); err != nil {
+		s.sessionsMu.Unlock()
+		return ClientEntry{}, err
+	}
+	addr, ok := s.static.leaseLocked(netip.Addr{})
+	s.sessionsMu.Unlock()
+	if !ok {
+		return ClientEntry{}, fmt.Errorf("no free address in %s", s.static.prefix)
+	}
+	entry := ClientEntry{
+		Name:       name,
+		PSK:        psk,
+		Address:    s.static.clientPrefix(addr).String(),
+		Routes:     routes,
+		AllowedIPs: allowedIPs,
+		Created:    time.Now().UTC().Truncate(time.Second),
+	}
+	key, err := clientKey(entry)
+	if err == nil {
+		s.registry.Clients = append(s.registry.Clients, entry)
+		if err = s.registry.save(); err != nil {
+			s.registry.Clients = s.registry.Clients[:len(s.registry.Clients)-1]
+		}
+	}
+	if err != nil {
+		s.sessionsMu.Lock()
+		s.static.releaseLocked(addr)
+		s.sessionsMu.Unlock()
+		return ClientEntry{}, err
+	}
+	s.clientKeys = append(s.clientKeys, key)
+	if len(allowed) > 0 {
+		s.sessionsMu.Lock()
+		s.addAllowedLocked(name, allowed)
+		s.sessionsMu.Unlock()
+		s.routeIntoTunnel(allowed)
+	}
+	log.Printf("Provisioned client %q at %s", name, entry.Address)
+	return entry, nil
+}
+
+// Revoke permanently refuses the provisioned client called name, records
+// it in clients_file, and disconnects its sessions. It returns the number
+// of sessions dropped.
+func (s *Server) Revoke(name string) (int, error) {
+	s.psksMu.Lock()
+	defer s.psksMu.Unlock()
+	if s.registry == nil {
+		return 0, fmt.Errorf("clients_file is not configured")
+	}
+	c := s.registry.find(name)
+	if c == nil {
+		return 0, fmt.Errorf("no client %q", name)
+	}
+	if c.Revoked != nil {
+		return 0, fmt.Errorf("client %q is already revoked", name)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	c.Revoked = &now
+	if err := s.registry.save(); err != nil {
+		c.Revoked = nil
+		return 0, err
+	}
+
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	s.revoked[name] = true
+	n := 0
+	for id, sess := range s.sessions {
+		if sess.name == name {
+			s.removeSessionLocked(id, "revoked")
+			n++
+		}
+	}
+	if addr, err := netip.ParsePrefix(c.Address); err == nil {
+		s.static.releaseLocked(addr.Addr())
+	}
+	s.removeAllowedLocked(name)
+	delete(s.qos, name)
+	delete(s.access, name)
+	log.Printf("Revoked client %q, disconnected %d sessions", name, n)
+	return n, nil
+}
+
+// RotateKey makes psk the current PSK for new handshakes. The previous
+// current PSK stays accepted until the next rotation, and established
+// sessions keep their derived keys.
+func (s *Server) RotateKey(psk string) error {
+	if psk == "" {
+		return fmt.Errorf("psk cannot be empty")
+	}
+	if s.cfg.FIPSMode && len(psk) < minFIPSPSK {
+		return fmt.Errorf("fips_mode needs a psk of at least %d bytes", minFIPSPSK)
+	}
+	hs, err := handshakeCipher(psk)
+	if err != nil {
+		return err
+	}
+	s.psksMu.Lock()
+	defer s.psksMu.Unlock()
+	if len(s.psks) > 0 && s.psks[0].psk == psk {
+		return fmt.Errorf("psk is already current")
+	}
+	next := []pskEntry{{psk: psk, id: pskKeyID(psk), hs: hs}}
+	if len(s.psks) > 0 {
+		next = append(next, s.psks[0])
+	}
+	s.psks = next
+	log.Printf("PSK rotated; previous key accepted until next rotation (update the config file to persist)")
+	return nil
+}
+
+// Clients reports every active session with its traffic counters.
+func (s *Server) Clients() ClientList {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	list := ClientList{
+		Clients:     make([]ClientInfo, 0, len(s.sessions)),
+		Drops:       s.drops.Load(),
+		DropReasons: s.dropped.counts(),
+		FIPS:        s.cfg.FIPSMode,
+	}
+	for _, sess := range s.sessions {
+		list.Clients = append(list.Clients, ClientInfo{
+			Session:         fmt.Sprintf("%08x", sess.id),
+			Name:            sess.name,
+			Label:           sess.label,
+			Software:        sess.software,
+			User:            sess.user,
+			Profiles:        sess.profiles.profileNames(),
+			Endpoint:        sess.remote().String(),
+			Listener:        sess.listener().conn.LocalAddr().String(),
+			Transport:       sess.listener().transport,
+			Address:         addrString(sess.address),
+			Address6:        addrString(sess.address6),
+			ProtocolVersion: sess.version,
+			ConnectedAt:     sess.connectedAt,
+			LastSeen:        sess.lastSeen.Load(),
+			BytesIn:         sess.stats.bytesIn.Load(),
+			BytesOut:        sess.stats.bytesOut.Load(),
+			PacketsIn:       sess.stats.packetsIn.Load(),
+			PacketsOut:      sess.stats.packetsOut.Load(),
+			Drops:           sess.drops.Load(),
+			FECRecovered:    sess.fecRecovered.Load(),
+			MTU:             sess.pmtu.current(),
+		})
+		if sess.fec != nil {
+			list.Clients[len(list.Clients)-1].FEC = sess.fec.params.String()
+		}
+		if sess.delegated.IsValid() {
+			list.Clients[len(list.Clients)-1].Prefix = sess.delegated.String()
+		}
+	}
+	return list
+}
+
+// clusterState is the local client directory pushed to cluster peers.
+func (s *Server) clusterState() clusterState {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	st := clusterState{
+		Node:     s.cfg.Cluster.NodeID,
+		Sent:     time.Now(),
+		Clients:  make([]ClusterClient, 0, len(s.sessions)),
+		handoffs: make([]sessionHandoff, 0, len(s.sessions)),
+	}
+	if addr := s.Addr(); addr != nil {
+		st.Address = addr.String()
+	}
+	for _, sess := range s.sessions {
+		st.Clients = append(st.Clients, ClusterClient{
+			Session:     fmt.Sprintf("%08x", sess.id),
+			Node:        s.cfg.Cluster.NodeID,
+			Endpoint:    sess.remote().String(),
+			ConnectedAt: sess.connectedAt,
+			LastSeen:    sess.lastSeen.Load(),
+		})
+		st.handoffs = append(st.handoffs, sess.handoffLocked())
+	}
+	return st
+}
+
+// snapshot reads the server-wide counters for the metrics sampler.
+func (s *Server) snapshot() metrics.Snapshot {
+	s.sessionsMu.RLock()
+	clients := len(s.sessions)
+	s.sessionsMu.RUnlock()
+	return metrics.Snapshot{
+		BytesIn:    s.stats.bytesIn.Load(),
+		BytesOut:   s.stats.bytesOut.Load(),
+		PacketsIn:  s.stats.packetsIn.Load(),
+		PacketsOut: s.stats.packetsOut.Load(),
+		Clients:    clients,
+		Recovered:  s.fecRecovered.Load(),
+	}
+}
+
+func (s *Server) managementMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /rotate-key", func(w http.ResponseWriter, r *http.Request) {
+		var req RotateKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := s.RotateKey(req.PSK); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Build())
+	})
+	mux.HandleFunc("GET /clients", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Clients())
+	})
+	mux.HandleFunc("POST /clients", func(w http.ResponseWriter, r *http.Request) {
+		var req ExportClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		entry, err := s.ExportClient(req.Name, req.Routes, req.AllowedIPs)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, entry)
+	})
+	mux.HandleFunc("POST /revoke", func(w http.ResponseWriter, r *http.Request) {
+		var req RevokeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		n, err := s.Revoke(req.Name)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, RevokeResponse{Disconnected: n})
+	})
+	mux.HandleFunc("GET /metrics/history", func(w http.ResponseWriter, r *http.Request) {
+		serveHistory(w, r, s.history, metrics.DefaultResolution)
+	})
+	mux.HandleFunc("GET /metrics/drops", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, DropsResponse{Drops: s.dropped.counts()})
+	})
+	mux.HandleFunc("GET /probes", func(w http.ResponseWriter, r *http.Request) {
+		if s.decoy == nil {
+			writeError(w, http.StatusNotFound, errors.New("decoy is not enabled"))
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Probes())
+	})
+	mux.HandleFunc("GET /bans", func(w http.ResponseWriter, r *http.Request) {
+		if s.lockout == nil {
+			writeError(w, http.StatusNotFound, errors.New("lockout is not enabled"))
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Bans())
+	})
+	mux.HandleFunc("POST /unban", func(w http.ResponseWriter, r *http.Request) {
+		if s.lockout == nil {
+			writeError(w, http.StatusNotFound, errors.New("lockout is not enabled"))
+			return
+		}
+		var req UnbanRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := s.Unban(req.Address); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /admission", func(w http.ResponseWriter, r *http.Request) {
+		if s.admission == nil {
+			writeError(w, http.StatusNotFound, errors.New("admission is not enabled"))
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Admission())
+	})
+	mux.HandleFunc("GET /cluster", func(w http.ResponseWriter, r *http.Request) {
+		if s.cluster == nil {
+			writeError(w, http.StatusNotFound, errors.New("clustering is not enabled"))
+			return
+		}
+		writeJSON(w, http.StatusOK, s.cluster.status())
+	})
+	handleForwards(mux, s.forwards)
+	handleLogs(mux)
+	return mux
 }
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// SetupWindowsClient is only available on Windows.
+func SetupWindowsClient(adapterName, nextHop string, routes []string) error {
+	return fmt.Errorf("client setup on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
+
+// RemoveAdapter removes what an adapter left on the host, where the
+// platform leaves anything: on macOS, its DNS settings.
+func RemoveAdapter(adapterName string) error {
+	return tun.RemoveAdapter(adapterName)
+}
+
+// setNTPServers is only available on Windows.
+func setNTPServers(servers []string) error {
+	return fmt.Errorf("NTP setup on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
+
+// addLANRoute is only available on Windows, where the client installs the
+// tunnel's routes.
+func addLANRoute(r lanRoute) error {
+	return fmt.Errorf("LAN bypass on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
+
+// deleteLANRoute is only available on Windows.
+func deleteLANRoute(r lanRoute) error {
+	return fmt.Errorf("LAN bypass on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
@@ -4,45 +4,211 @@ package vpn
 
 import (
 	"fmt"
+	"log"
+	"net/netip"
+	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/gedons/go_VPN/internal/powershell"
+	"github.com/gedons/go_VPN/internal/tun"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 )
 
-// SetupWindowsClient applies Windows-specific routing for VPN client.
-func SetupWindowsClient(adapterName, nextHop string) error {
+// platformBackends are the host integrations this build uses.
+var platformBackends = []string{"wintun", "winipcfg", "netnat", "dpapi", "w32tm"}
+
+// SetupWindowsClient applies Windows-specific routing for VPN client,
+// sending each of routes through the VPN interface.
+func SetupWindowsClient(adapterName, nextHop string, routes []string) error {
 	fmt.Println("[Windows Client Setup]")
 
-	// Add default route through VPN interface
+	for _, route := range routes {
+		cmd := exec.Command("powershell", "-Command",
+			fmt.Sprintf(`$iface = Get-NetAdapter -Name '%s'; if (!$iface) { Write-Error "Adapter '%s' not found"; exit 1 }; New-NetRoute -DestinationPrefix "%s" -InterfaceIndex $iface.ifIndex -NextHop "%s" -RouteMetric 1 -ErrorAction Stop`, adapterName, adapterName, route, nextHop),
+		)
+		output, err := cmd.CombinedOutput()
+		fmt.Println(string(output))
+		if err != nil {
+			return fmt.Errorf("client setup failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// ipEnableRouter is the registry key and value that turn on IPv4
+// forwarding from the next boot.
+const (
+	tcpipParameters = `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters`
+	ipEnableRouter  = "IPEnableRouter"
+)
+
+// enableForwarding turns on IPv4 forwarding at once on each interface that
+// does not forward yet, and in the registry so it survives a reboot. It
+// returns the changes made, for disableForwarding to undo.
+func enableForwarding() ([]journalEntry, error) {
+	var changes []journalEntry
+	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, tcpipParameters, registry.QUERY_VALUE|registry.SET_VALUE)
+	if err != nil {
+		return nil, fmt.Errorf("enable IP forwarding: %w", err)
+	}
+	defer key.Close()
+	if v, _, err := key.GetIntegerValue(ipEnableRouter); err != nil || v != 1 {
+		if err := key.SetDWordValue(ipEnableRouter, 1); err != nil {
+			return nil, fmt.Errorf("enable IP forwarding: %w", err)
+		}
+		changes = append(changes, journalEntry{Kind: journalForwarding, Name: ipEnableRouter})
+	}
+
+	rows, err := winipcfg.GetIPInterfaceTable(windows.AF_INET)
+	if err != nil {
+		return changes, fmt.Errorf("enable IP forwarding: %w", err)
+	}
+	for i := range rows {
+		row := &rows[i]
+		if row.ForwardingEnabled {
+			continue
+		}
+		row.ForwardingEnabled = true
+		row.SitePrefixLength = 0 // must be zero for IPv4
+		if err := row.Set(); err != nil {
+			log.Printf("Enable forwarding on interface %d: %v", row.InterfaceIndex, err)
+			continue
+		}
+		changes = append(changes, journalEntry{Kind: journalForwarding, IfIndex: int(row.InterfaceIndex)})
+	}
+	return changes, nil
+}
+
+// disableForwarding undoes one change made by enableForwarding: forwarding
+// on the interface IfIndex, or in the registry when that is zero.
+func disableForwarding(e journalEntry) error {
+	if e.IfIndex == 0 {
+		key, err := registry.OpenKey(registry.LOCAL_MACHINE, tcpipParameters, registry.SET_VALUE)
+		if err != nil {
+			return fmt.Errorf("restore IP forwarding: %w", err)
+		}
+		defer key.Close()
+		return key.SetDWordValue(ipEnableRouter, 0)
+	}
+	luid, err := winipcfg.LUIDFromIndex(uint32(e.IfIndex))
+	if err != nil {
+		// The interface is gone, and its setting with it.
+		return nil
+	}
+	row, err := luid.IPInterface(windows.AF_INET)
+	if err != nil {
+		return nil
+	}
+	row.ForwardingEnabled = false
+	row.SitePrefixLength = 0
+	return row.Set()
+}
+
+// AllowFirewallPort adds an inbound rule letting this binary receive on UDP
+// port, in the GoVPN group, and returns its name. A rule of that name left
+// by an earlier run is replaced.
+func AllowFirewallPort(port int) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("firewall rule: %w", err)
+	}
+	name := firewallRuleName(port)
 	cmd := exec.Command("powershell", "-Command",
-		fmt.Sprintf(`$iface = Get-NetAdapter -Name '%s'; if (!$iface) { Write-Error "Adapter '%s' not found"; exit 1 }; New-NetRoute -DestinationPrefix "0.0.0.0/0" -InterfaceIndex $iface.ifIndex -NextHop "%s" -RouteMetric 1 -ErrorAction Stop`, adapterName, adapterName, nextHop),
+		fmt.Sprintf(`Remove-NetFirewallRule -DisplayName '%s' -ErrorAction SilentlyContinue; New-NetFirewallRule -DisplayName '%s' -Group '%s' -Program %s -Direction Inbound -Protocol UDP -LocalPort %d -Action Allow -EdgeTraversalPolicy Allow -Profile Any -ErrorAction Stop`, name, name, FirewallGroup, powershell.Quote(exe), port),
 	)
 	output, err := cmd.CombinedOutput()
-	fmt.Println(string(output))
 	if err != nil {
-		return fmt.Errorf("client setup failed: %w", err)
+		return "", fmt.Errorf("firewall rule %s: %w: %s", name, err, output)
+	}
+	return name, nil
+}
+
+// RemoveFirewallRule deletes a rule added by AllowFirewallPort.
+func RemoveFirewallRule(name string) error {
+	cmd := exec.Command("powershell", "-Command",
+		fmt.Sprintf(`Remove-NetFirewallRule -DisplayName '%s' -ErrorAction Stop`, name),
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("remove firewall rule %s: %w: %s", name, err, output)
 	}
 	return nil
 }
 
-// SetupWindowsServer configures the firewall and enables IP forwarding.
-func SetupWindowsServer(adapterName string, port int) error {
-	fmt.Println("[Windows Server Setup]")
+// RemoveFirewallRules deletes every rule in the GoVPN group, and those
+// older releases added without a group, and reports how many there were.
+func RemoveFirewallRules() (int, error) {
+	cmd := exec.Command("powershell", "-Command",
+		fmt.Sprintf(`$r = @(Get-NetFirewallRule -Group '%s' -ErrorAction SilentlyContinue) + @(Get-NetFirewallRule -DisplayName 'GoVPN UDP *' -ErrorAction SilentlyContinue) | Sort-Object -Property Name -Unique; $r | Remove-NetFirewallRule -ErrorAction Stop; $r.Count`, FirewallGroup),
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("remove firewall rules: %w: %s", err, output)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(output)))
+	return n, nil
+}
 
-	// Enable IP forwarding
+// EnableNAT creates a NetNat instance so traffic from prefix, the
+// tunnel subnet, is translated to the host's address.
+func EnableNAT(name, prefix string) error {
 	cmd := exec.Command("powershell", "-Command",
-		`Set-ItemProperty -Path "HKLM:\SYSTEM\CurrentControlSet\Services\Tcpip\Parameters" -Name "IPEnableRouter" -Value 1`,
+		fmt.Sprintf(`if (!(Get-NetNat -Name %[1]s -ErrorAction SilentlyContinue)) { New-NetNat -Name %[1]s -InternalIPInterfaceAddressPrefix %[2]s -ErrorAction Stop }`, powershell.Quote(name), powershell.Quote(prefix)),
 	)
 	output, err := cmd.CombinedOutput()
-	fmt.Println(string(output))
 	if err != nil {
-		return fmt.Errorf("failed to enable IP forwarding: %w", err)
+		return fmt.Errorf("create NAT %s: %w: %s", name, err, output)
 	}
+	return nil
+}
 
-	// Add firewall rule for UDP port
-	cmd = exec.Command("powershell", "-Command",
-		fmt.Sprintf(`New-NetFirewallRule -DisplayName "GoVPN UDP %d" -Direction Inbound -Protocol UDP -LocalPort %d -Action Allow -EdgeTraversalPolicy Allow -Profile Any`, port, port),
+// DisableNAT removes the NetNat instance created by EnableNAT.
+func DisableNAT(name string) error {
+	cmd := exec.Command("powershell", "-Command",
+		fmt.Sprintf(`Remove-NetNat -Name %s -Confirm:$false -ErrorAction Stop`, powershell.Quote(name)),
 	)
-	output, _ = cmd.CombinedOutput()
-	fmt.Println(string(output))
-	// Ignore error if rule already exists
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("remove NAT %s: %w: %s", name, err, output)
+	}
+	return nil
+}
+
+// RemoveAdapter deletes the Wintun adapter and its stale network profiles.
+func RemoveAdapter(adapterName string) error {
+	fmt.Println("[Windows Adapter Cleanup]")
+	return tun.RemoveAdapter(adapterName)
+}
+
+// setNTPServers makes the Windows Time service sync from servers.
+func setNTPServers(servers []string) error {
+	cmd := exec.Command("w32tm", "/config", "/manualpeerlist:"+strings.Join(servers, " "), "/syncfromflags:manual", "/update")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("w32tm: %w: %s", err, output)
+	}
 	return nil
 }
+
+// addLANRoute adds an on-link route for r on its own interface, with a
+// metric below the tunnel's.
+func addLANRoute(r lanRoute) error {
+	luid, err := winipcfg.LUIDFromIndex(uint32(r.ifIndex))
+	if err != nil {
+		return err
+	}
+	return luid.AddRoute(r.prefix, netip.IPv4Unspecified(), 0)
+}
+
+// deleteLANRoute removes a route added by addLANRoute.
+func deleteLANRoute(r lanRoute) error {
+	luid, err := winipcfg.LUIDFromIndex(uint32(r.ifIndex))
+	if err != nil {
+		return err
+	}
+	return luid.DeleteRoute(r.prefix, netip.IPv4Unspecified())
+}
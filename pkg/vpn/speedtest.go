@@ -0,0 +1,261 @@
+package vpn
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SpeedtestPort is the TCP port a server with speedtest listens on, at its
+// tunnel address.
+const SpeedtestPort = 5201
+
+const (
+	// DefaultSpeedtestDuration is how long each direction of a speed test
+	// runs when the request does not say.
+	DefaultSpeedtestDuration = 5 * time.Second
+
+	// maxSpeedtestDuration bounds each direction, and maxSpeedtests the
+	// tests a server runs at once.
+	maxSpeedtestDuration = 30 * time.Second
+	maxSpeedtests        = 8
+
+	// speedtestPings is how many round trips the latency test times.
+	speedtestPings = 10
+)
+
+// A speed test connection starts with one of these, then one byte of
+// seconds for the upload and download tests.
+const (
+	speedtestEcho     = 'e' // echo everything back
+	speedtestUpload   = 'u' // discard until EOF, then send the byte count
+	speedtestDownload = 'd' // send zeros for the given seconds
+)
+
+// SpeedtestRequest is the body of POST /speedtest on a client.
+type SpeedtestRequest struct {
+	Seconds int `json:"seconds,omitempty"`
+}
+
+// SpeedtestResult is the response to POST /speedtest: throughput each way
+// and the round trip to the server's tunnel address, through the tunnel,
+// beside the round trip of the client's keepalives outside it.
+type SpeedtestResult struct {
+	Server        string  `json:"server"`
+	DownloadMbps  float64 `json:"download_mbps"`
+	UploadMbps    float64 `json:"upload_mbps"`
+	LatencyMillis float64 `json:"latency_ms"`
+	PathRTTMillis float64 `json:"path_rtt_ms"`
+}
+
+// startSpeedtest listens for speed tests on the server's tunnel address
+// until the server stops.
+func (s *Server) startSpeedtest() error {
+	if !s.gateway.IsValid() {
+		return fmt.Errorf("the server has no tunnel address")
+	}
+	addr := netip.AddrPortFrom(s.gateway, SpeedtestPort).String()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Speed test listening on %s", addr)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		<-s.ctx.Done()
+		ln.Close()
+	}()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		var running atomic.Int32
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if s.ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			if running.Add(1) > maxSpeedtests {
+				running.Add(-1)
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer running.Add(-1)
+				serveSpeedtest(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// serveSpeedtest answers one speed test connection.
+func serveSpeedtest(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(maxSpeedtestDuration + 10*time.Second))
+	var req [2]byte
+	if _, err := io.ReadFull(conn, req[:1]); err != nil {
+		return
+	}
+	if req[0] == speedtestEcho {
+		io.Copy(conn, conn)
+		return
+	}
+	if _, err := io.ReadFull(conn, req[1:]); err != nil {
+		return
+	}
+	d := min(time.Duration(req[1])*time.Second, maxSpeedtestDuration)
+	switch req[0] {
+	case speedtestUpload:
+		n, _ := io.Copy(io.Discard, conn)
+		conn.Write(binary.BigEndian.AppendUint64(nil, uint64(n)))
+	case speedtestDownload:
+		buf := make([]byte, 64<<10)
+		end := time.Now().Add(d)
+		for time.Now().Before(end) {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Speedtest measures throughput both ways and latency between the client
+// and the server's speed test sink, through the tunnel, each direction for
+// d.
+func (c *Client) Speedtest(ctx context.Context, d time.Duration) (SpeedtestResult, error) {
+	gw := c.gateway.Load()
+	if gw == nil {
+		return SpeedtestResult{}, fmt.Errorf("the server sent no tunnel address to test against")
+	}
+	d = min(d, maxSpeedtestDuration)
+	r := SpeedtestResult{
+		Server:        gw.String(),
+		PathRTTMillis: float64(c.rtt.Load()) / float64(time.Millisecond),
+	}
+	addr := netip.AddrPortFrom(*gw, SpeedtestPort).String()
+	dial := c.tunnelDial()
+	open := func(req ...byte) (net.Conn, error) {
+		dctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		conn, err := dial(dctx, "tcp", addr)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("the server does not run a speed test; set speedtest: true in its config")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(req); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	secs := byte(max(d/time.Second, 1))
+
+	// Latency: the median of a few one-byte round trips.
+	conn, err := open(speedtestEcho)
+	if err != nil {
+		return r, fmt.Errorf("latency: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	rtts := make([]time.Duration, 0, speedtestPings)
+	var b [1]byte
+	for range speedtestPings {
+		start := time.Now()
+		if _, err := conn.Write(b[:]); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			break
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	conn.Close()
+	if len(rtts) == 0 {
+		return r, fmt.Errorf("latency: no echo from %s", addr)
+	}
+	slices.Sort(rtts)
+	r.LatencyMillis = float64(rtts[len(rtts)/2]) / float64(time.Millisecond)
+
+	// Download: count what the server sends until it closes.
+	conn, err = open(speedtestDownload, secs)
+	if err != nil {
+		return r, fmt.Errorf("download: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(d + 10*time.Second))
+	start := time.Now()
+	n, err := io.Copy(io.Discard, conn)
+	conn.Close()
+	if err != nil {
+		return r, fmt.Errorf("download: %w", err)
+	}
+	r.DownloadMbps = mbps(n, time.Since(start))
+
+	// Upload: send for d, then the server says how much arrived.
+	conn, err = open(speedtestUpload, secs)
+	if err != nil {
+		return r, fmt.Errorf("upload: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(d + 10*time.Second))
+	buf := make([]byte, 64<<10)
+	start = time.Now()
+	for time.Since(start) < d {
+		if _, err := conn.Write(buf); err != nil {
+			return r, fmt.Errorf("upload: %w", err)
+		}
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	var count [8]byte
+	if _, err := io.ReadFull(conn, count[:]); err != nil {
+		return r, fmt.Errorf("upload: %w", err)
+	}
+	r.UploadMbps = mbps(int64(binary.BigEndian.Uint64(count[:])), time.Since(start))
+	return r, nil
+}
+
+// mbps is n bytes over d in megabits per second.
+func mbps(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) * 8 / d.Seconds() / 1e6
+}
+
+// handleSpeedtest serves POST /speedtest.
+func (c *Client) handleSpeedtest(w http.ResponseWriter, r *http.Request) {
+	var req SpeedtestRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	d := DefaultSpeedtestDuration
+	if req.Seconds > 0 {
+		d = time.Duration(req.Seconds) * time.Second
+	}
+	res, err := c.Speedtest(r.Context(), d)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,193 @@
+package vpn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/crypto"
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// stateKeyInfo is the HKDF info for the key that seals the state file.
+const stateKeyInfo = "govpn state file v1"
+
+// serverState is what a server saves on a graceful shutdown so clients
+// keep their sessions across a restart.
+type serverState struct {
+	Saved    time.Time      `json:"saved"`
+	Sessions []savedSession `json:"sessions"`
+}
+
+// savedSession is a session's handoff plus what only its own server keeps.
+type savedSession struct {
+	sessionHandoff
+	Listener string             `json:"listener,omitempty"`
+	Forwards []protocol.Forward `json:"forwards,omitempty"`
+	LastSeen time.Time          `json:"last_seen"`
+}
+
+// stateCipher returns the AEAD that seals the state file under psk.
+func stateCipher(psk string) (*crypto.Cipher, error) {
+	key, err := crypto.DeriveKey([]byte(psk), nil, stateKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.NewCipher(key)
+}
+
+// saveState writes the live sessions to state_file, sealed under the
+// current PSK. It runs after the forward loops have stopped, so the saved
+// send counters are final and no nonce is used twice after a restore.
+func (s *Server) saveState() error {
+	st := serverState{Saved: time.Now()}
+	s.sessionsMu.RLock()
+	for _, sess := range s.sessions {
+		st.Sessions = append(st.Sessions, savedSession{
+			sessionHandoff: sess.handoffLocked(),
+			Listener:       sess.listener().address,
+			Forwards:       sess.forwards,
+			LastSeen:       sess.lastSeen.Load(),
+		})
+	}
+	s.sessionsMu.RUnlock()
+	if len(st.Sessions) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	c, err := stateCipher(s.cfg.PSK)
+	if err != nil {
+		return err
+	}
+	data, err := c.Encrypt(body)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.cfg.StateFile), ".state-*")
+	if err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.cfg.StateFile); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	log.Printf("Saved %d sessions to %s", len(st.Sessions), s.cfg.StateFile)
+	return nil
+}
+
+// restoreState reinstalls the sessions saved by the last graceful shutdown.
+// The file is removed once read, so a crash later cannot restore the same
+// counters twice. Sessions silent past the keepalive timeout are dropped,
+// since their clients will have handshaken again anyway, and so are those
+// of clients, or under keys, the server no longer accepts.
+func (s *Server) restoreState() error {
+	data, err := os.ReadFile(s.cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read state file: %w", err)
+	}
+	if err := os.Remove(s.cfg.StateFile); err != nil {
+		return fmt.Errorf("remove state file: %w", err)
+	}
+	var body []byte
+	for _, psk := range s.cfg.AcceptedPSKs() {
+		c, err := stateCipher(psk)
+		if err != nil {
+			return err
+		}
+		if body, err = c.Decrypt(data); err == nil {
+			break
+		}
+	}
+	if body == nil {
+		return fmt.Errorf("state file %s is not sealed with an accepted psk", s.cfg.StateFile)
+	}
+	var st serverState
+	if err := json.Unmarshal(body, &st); err != nil {
+		return fmt.Errorf("parse state file: %w", err)
+	}
+
+	cutoff := time.Now().Add(-s.cfg.keepaliveTimeout())
+	restored := 0
+	s.psksMu.RLock()
+	defer s.psksMu.RUnlock()
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for _, saved := range st.Sessions {
+		if saved.LastSeen.Before(cutoff) || s.sessions[saved.ID] != nil {
+			continue
+		}
+		if err := s.admitsHandoffLocked(saved.sessionHandoff); err != nil {
+			log.Printf("Not restoring session %08x: %v", saved.ID, err)
+			continue
+		}
+		if err := s.restoreSessionLocked(saved); err != nil {
+			log.Printf("Restore session %08x: %v", saved.ID, err)
+			continue
+		}
+		restored++
+	}
+	log.Printf("Restored %d of %d sessions saved at %s", restored, len(st.Sessions), st.Saved.Format(time.RFC3339))
+	return nil
+}
+
+// restoreSessionLocked installs one saved session. Callers must hold
+// sessionsMu for writing.
+func (s *Server) restoreSessionLocked(saved savedSession) error {
+	addr, err := net.ResolveUDPAddr("udp", saved.Endpoint)
+	if err != nil {
+		return fmt.Errorf("endpoint: %w", err)
+	}
+	keys, err := newSessionKeys(saved.SendKey, saved.RecvKey)
+	if err != nil {
+		return err
+	}
+	keys.send.Resume(saved.Sent, 0)
+	keys.recv.Resume(0, saved.Received)
+	geo := s.geo.lookup(addr)
+	if err := s.geo.check(geo); err != nil {
+		return err
+	}
+	sess := &serverSession{
+		id:          saved.ID,
+		name:        saved.Name,
+		keyID:       saved.KeyID,
+		label:       saved.Label,
+		software:    saved.Software,
+		user:        saved.User,
+		attrs:       saved.Attributes,
+		profiles:    s.profilesFor(saved.Profiles),
+		geo:         geo,
+		version:     saved.Version,
+		keys:        keys,
+		connectedAt: saved.ConnectedAt,
+		adopted:     saved.Adopted,
+	}
+	sess.path.Store(&sessionPath{ln: s.listenerFor(saved.Listener), addr: addr})
+	sess.lastSeen.Store(saved.LastSeen)
+	if err := s.installSessionLocked(sess, saved.sessionHandoff); err != nil {
+		return err
+	}
+	// Forwards that cannot be reopened are logged and left out.
+	if len(saved.Forwards) > 0 {
+		s.grantForwardsLocked(sess, saved.Forwards)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package vpn
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// restartLabels starts a server with cfg and a client for each key in psks,
+// at the matching address in addrs and labelled with its index, stops the
+// server so it saves its sessions, then starts it again with next and
+// returns the labels of the sessions it restored.
+func restartLabels(t *testing.T, cfg, next Config, psks, addrs []string) []string {
+	t.Helper()
+	srv := newServer(cfg, tun.NewMemDevice(harnessQueueLen))
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i, psk := range psks {
+		c := newClient(Config{
+			Mode:              "client",
+			ClientName:        strconv.Itoa(i),
+			ServerAddress:     srv.Addr().String(),
+			PSK:               psk,
+			AdapterName:       "state-client",
+			AdapterIPCIDR:     addrs[i] + "/24",
+			KeepaliveInterval: time.Second,
+			TunWorkers:        1,
+		}, tun.NewMemDevice(harnessQueueLen))
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Stop()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.Clients().Clients) < len(psks) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d clients connected", len(srv.Clients().Clients), len(psks))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	srv.Stop()
+
+	srv = newServer(next, tun.NewMemDevice(harnessQueueLen))
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	var restored []string
+	for _, c := range srv.Clients().Clients {
+		restored = append(restored, c.Label)
+	}
+	slices.Sort(restored)
+	return restored
+}
+
+func stateServerConfig(t *testing.T) Config {
+	return Config{
+		Mode:              "server",
+		ServerAddress:     "127.0.0.1:0",
+		PSK:               harnessPSK,
+		AdapterName:       "state-server",
+		AdapterIPCIDR:     "10.99.0.1/24",
+		KeepaliveInterval: time.Second,
+		TunWorkers:        1,
+		StateFile:         filepath.Join(t.TempDir(), "state"),
+	}
+}
+
+// TestRestoreDroppedPSK checks a session keyed under a PSK that was since
+// dropped is not restored, though the state file opens under another.
+func TestRestoreDroppedPSK(t *testing.T) {
+	const old = "govpn-state-test-previous-key"
+	cfg := stateServerConfig(t)
+	cfg.PreviousPSKs = []string{old}
+	next := cfg
+	next.PreviousPSKs = nil
+
+	got := restartLabels(t, cfg, next, []string{harnessPSK, old}, []string{"10.99.0.2", "10.99.0.3"})
+	if want := []string{"0"}; !slices.Equal(got, want) {
+		t.Fatalf("restored %v, want %v", got, want)
+	}
+}
+
+// TestRestoreRemovedClient checks the sessions of provisioned clients that
+// were removed from clients_file, or given a new key, are not restored.
+func TestRestoreRemovedClient(t *testing.T) {
+	clients := filepath.Join(t.TempDir(), "clients.yaml")
+	if err := os.WriteFile(clients, []byte(`clients:
+  - {name: alice, psk: govpn-state-test-alice-key, address: 10.99.0.5/24}
+  - {name: bob, psk: govpn-state-test-bob-key-one, address: 10.99.0.6/24}
+  - {name: carol, psk: govpn-state-test-carol-key, address: 10.99.0.7/24}
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := stateServerConfig(t)
+	cfg.ClientsFile = clients
+	next := cfg
+	next.ClientsFile = filepath.Join(t.TempDir(), "next.yaml")
+	if err := os.WriteFile(next.ClientsFile, []byte(`clients:
+  - {name: alice, psk: govpn-state-test-alice-key, address: 10.99.0.5/24}
+  - {name: bob, psk: govpn-state-test-bob-key-two, address: 10.99.0.6/24}
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	got := restartLabels(t, cfg, next,
+		[]string{"govpn-state-test-alice-key", "govpn-state-test-bob-key-one", "govpn-state-test-carol-key"},
+		[]string{"10.99.0.5", "10.99.0.6", "10.99.0.7"})
+	if want := []string{"0"}; !slices.Equal(got, want) {
+		t.Fatalf("restored %v, want %v", got, want)
+	}
+}
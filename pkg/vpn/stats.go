@@ -0,0 +1,133 @@
+package vpn
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// trafficStats counts inner (tunnelled) traffic in each direction.
+type trafficStats struct {
+	bytesIn    atomic.Uint64
+	bytesOut   atomic.Uint64
+	packetsIn  atomic.Uint64
+	packetsOut atomic.Uint64
+}
+
+func (t *trafficStats) addIn(n int) {
+	t.bytesIn.Add(uint64(n))
+	t.packetsIn.Add(1)
+}
+
+func (t *trafficStats) addOut(n int) {
+	t.bytesOut.Add(uint64(n))
+	t.packetsOut.Add(1)
+}
+
+// atomicTime is a time.Time that can be read and written concurrently.
+type atomicTime struct {
+	ns atomic.Int64
+}
+
+func (a *atomicTime) Store(t time.Time) { a.ns.Store(t.UnixNano()) }
+
+func (a *atomicTime) Load() time.Time {
+	ns := a.ns.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// ClientStatus is the client's state as reported by GET /status.
+type ClientStatus struct {
+	Connected       bool      `json:"connected"`
+	Endpoint        string    `json:"endpoint"`
+	Fallback        bool      `json:"fallback,omitempty"` // Endpoint is one of fallback_addresses, or a busy server's alternate
+	TunnelIP        string    `json:"tunnel_ip"`
+	TunnelIP6       string    `json:"tunnel_ip6,omitempty"`
+	Prefix          string    `json:"prefix,omitempty"` // IPv6 prefix delegated to the client
+	ProtocolVersion uint16    `json:"protocol_version"`
+	ServerVersion   string    `json:"server_version,omitempty"` // release version the server reported
+	BytesIn         uint64    `json:"bytes_in"`
+	BytesOut        uint64    `json:"bytes_out"`
+	PacketsIn       uint64    `json:"packets_in"`
+	PacketsOut      uint64    `json:"packets_out"`
+	LastHandshake   time.Time `json:"last_handshake"`
+	RTTMillis       float64   `json:"rtt_ms"`
+	PublicAddress   string    `json:"public_address,omitempty"`
+	NATType         string    `json:"nat_type,omitempty"`
+	Transport       string    `json:"transport"`
+	Migrated        bool      `json:"migrated,omitempty"` // moved off transport by migrate
+	LowBandwidth    bool      `json:"low_bandwidth,omitempty"`
+	FEC             string    `json:"fec,omitempty"` // data+parity group shape
+	FECRecovered    uint64    `json:"fec_recovered,omitempty"`
+	CaptivePortal   string    `json:"captive_portal,omitempty"` // sign-in page the client is waiting on
+	FIPS            bool      `json:"fips,omitempty"`           // both ends run in fips_mode
+
+	// Keepalive is the keepalive interval adaptive_keepalive is using, in
+	// seconds, and KeepaliveProbing whether it is still probing the NAT.
+	Keepalive        int  `json:"keepalive_seconds,omitempty"`
+	KeepaliveProbing bool `json:"keepalive_probing,omitempty"`
+
+	// Drops counts dropped packets by reason.
+	Drops map[string]uint64 `json:"drops,omitempty"`
+
+	// RouteConflicts are routes into the tunnel, and its own subnet, that
+	// overlap subnets already on the host.
+	RouteConflicts []string `json:"route_conflicts,omitempty"`
+
+	// ConnectCheck is the result of the test run when the tunnel last
+	// came up.
+	ConnectCheck *ConnectCheckStatus `json:"connect_check,omitempty"`
+
+	// Forwards is the server's answer to request_forwards.
+	Forwards []protocol.Forward `json:"forwards,omitempty"`
+
+	// SearchDomains, MTU, NTPServers, and Routes are the options the
+	// server pushed, for apps that apply them through their own platform
+	// API.
+	SearchDomains []string `json:"search_domains,omitempty"`
+	MTU           int      `json:"mtu,omitempty"`
+	NTPServers    []string `json:"ntp_servers,omitempty"`
+	Routes        []string `json:"routes,omitempty"`
+}
+
+// ClientInfo describes one server session as reported by GET /clients.
+// Directions are from the server's point of view.
+type ClientInfo struct {
+	Session         string    `json:"session"`
+	Name            string    `json:"name,omitempty"`     // provisioned client name
+	Label           string    `json:"label,omitempty"`    // name the client gave itself, such as its hostname
+	Software        string    `json:"software,omitempty"` // release version the client reported
+	User            string    `json:"user,omitempty"`     // login the server's auth accepted
+	Profiles        []string  `json:"profiles,omitempty"` // profiles the login's groups gave it
+	Endpoint        string    `json:"endpoint"`
+	Listener        string    `json:"listener"` // local address the client reaches
+	Transport       string    `json:"transport"`
+	Address         string    `json:"address,omitempty"`
+	Address6        string    `json:"address6,omitempty"`
+	Prefix          string    `json:"prefix,omitempty"` // delegated IPv6 prefix
+	ProtocolVersion uint16    `json:"protocol_version"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	LastSeen        time.Time `json:"last_seen"`
+	BytesIn         uint64    `json:"bytes_in"`
+	BytesOut        uint64    `json:"bytes_out"`
+	PacketsIn       uint64    `json:"packets_in"`
+	PacketsOut      uint64    `json:"packets_out"`
+	Drops           uint64    `json:"drops"`
+	FEC             string    `json:"fec,omitempty"`
+	FECRecovered    uint64    `json:"fec_recovered,omitempty"`
+	MTU             int       `json:"mtu,omitempty"` // the client's MTU, with dynamic_mtu
+}
+
+// ClientList is the body of GET /clients. Drops counts packets that could
+// not be attributed to any session; DropReasons counts all dropped packets
+// by reason.
+type ClientList struct {
+	Clients     []ClientInfo      `json:"clients"`
+	Drops       uint64            `json:"drops"`
+	DropReasons map[string]uint64 `json:"drop_reasons,omitempty"`
+	FIPS        bool              `json:"fips,omitempty"` // server runs in fips_mode
+}
@@ -0,0 +1,152 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// validateStatusPage checks that status_page is a client setting on a
+// loopback address: the page can disconnect the tunnel and has no login.
+func (c Config) validateStatusPage() error {
+	if c.StatusPage == "" {
+		return nil
+	}
+	if c.Mode != "client" {
+		return fmt.Errorf("status_page is a client setting")
+	}
+	host, _, err := net.SplitHostPort(c.StatusPage)
+	if err != nil {
+		return fmt.Errorf("status_page: %w", err)
+	}
+	if !loopbackHost(host) {
+		return fmt.Errorf("status_page must be a loopback address such as 127.0.0.1:8686")
+	}
+	return nil
+}
+
+// loopbackHost reports whether host is localhost or a loopback address.
+func loopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// statusPageHandler serves the status page, the status it shows, and its
+// disconnect button.
+func (c *Client) statusPageHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		fmt.Fprint(w, statusPageHTML)
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.Status())
+	})
+	mux.HandleFunc("POST /disconnect", func(w http.ResponseWriter, r *http.Request) {
+		// Browsers only send a custom header cross-origin after a CORS
+		// preflight, which this server never grants, so other sites
+		// cannot press the button.
+		if r.Header.Get("X-Govpn-Action") != "disconnect" {
+			writeError(w, http.StatusForbidden, fmt.Errorf("missing X-Govpn-Action header"))
+			return
+		}
+		log.Printf("Disconnect requested from the status page")
+		go c.Stop()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	// Refuse other host names, so a page that rebinds its own name to
+	// 127.0.0.1 cannot read the status.
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if !loopbackHost(host) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// statusPageHTML polls /status every two seconds and works out throughput
+// from the change in byte counters.
+const statusPageHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>VPN status</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 32em; margin: 3em auto; padding: 0 1em; color: #222; }
+h1 { font-size: 1.4em; }
+#state { font-weight: bold; }
+.up { color: #1a7f37; } .down { color: #b42318; }
+table { border-collapse: collapse; width: 100%; margin: 1em 0; }
+td { padding: .35em 0; border-bottom: 1px solid #eee; }
+td:first-child { color: #666; width: 40%; }
+button { font-size: 1em; padding: .5em 1.2em; }
+</style>
+</head>
+<body>
+<h1>VPN: <span id="state">…</span></h1>
+<table>
+<tr><td>Server</td><td id="endpoint"></td></tr>
+<tr><td>Public address</td><td id="public"></td></tr>
+<tr><td>Tunnel IP</td><td id="tunnel"></td></tr>
+<tr><td>Download</td><td id="rx"></td></tr>
+<tr><td>Upload</td><td id="tx"></td></tr>
+<tr><td>Round trip</td><td id="rtt"></td></tr>
+<tr><td>Connect check</td><td id="check"></td></tr>
+</table>
+<button id="disconnect">Disconnect</button>
+<script>
+let last = null;
+const $ = id => document.getElementById(id);
+function rate(bytes, secs) {
+  let n = bytes / secs, u = 0;
+  while (n >= 1024 && u < 4) { n /= 1024; u++; }
+  return n.toFixed(u ? 1 : 0) + ' ' + ['B', 'KiB', 'MiB', 'GiB', 'TiB'][u] + '/s';
+}
+async function refresh() {
+  let st;
+  try {
+    st = await (await fetch('status')).json();
+  } catch (e) {
+    $('state').textContent = 'stopped';
+    $('state').className = 'down';
+    $('disconnect').disabled = true;
+    return;
+  }
+  const now = Date.now();
+  $('state').textContent = st.connected ? 'connected' : (st.captive_portal ? 'sign in to Wi-Fi at ' + st.captive_portal : 'disconnected');
+  $('state').className = st.connected ? 'up' : 'down';
+  $('endpoint').textContent = st.endpoint;
+  $('public').textContent = st.public_address || '-';
+  $('tunnel').textContent = [st.tunnel_ip, st.tunnel_ip6].filter(Boolean).join(', ') || '-';
+  $('rtt').textContent = st.connected ? st.rtt_ms.toFixed(1) + ' ms' : '-';
+  const cc = st.connect_check;
+  $('check').textContent = !cc ? '-' : cc.echo === 'running' ? 'running' : (cc.echo === 'fail' || cc.http === 'fail') ? 'FAIL: ' + cc.error : 'PASS';
+  if (last) {
+    const secs = (now - last.at) / 1000;
+    $('rx').textContent = rate(st.bytes_in - last.st.bytes_in, secs);
+    $('tx').textContent = rate(st.bytes_out - last.st.bytes_out, secs);
+  }
+  last = { at: now, st: st };
+}
+$('disconnect').onclick = async () => {
+  $('disconnect').disabled = true;
+  await fetch('disconnect', { method: 'POST', headers: { 'X-Govpn-Action': 'disconnect' } });
+};
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,81 @@
+package vpn
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrNotConnected is returned by Client.InjectPacket before the first
+// handshake completes.
+var ErrNotConnected = errors.New("not connected")
+
+// Direction says which way a packet crosses the tunnel.
+type Direction int
+
+const (
+	// Inbound packets arrived from the peer and were decrypted.
+	Inbound Direction = iota
+	// Outbound packets are about to be encrypted and sent to the peer.
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Inbound {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+// PacketTap is shown every inner IP packet crossing the tunnel, whether it
+// came from the TUN device or was injected. It runs on the data path, so it
+// must return quickly, and pkt must not be modified or kept after it
+// returns.
+type PacketTap func(dir Direction, pkt []byte)
+
+// packetTap holds a PacketTap that can be swapped while packets flow.
+type packetTap struct {
+	fn atomic.Pointer[PacketTap]
+}
+
+func (t *packetTap) set(fn PacketTap) {
+	if fn == nil {
+		t.fn.Store(nil)
+		return
+	}
+	t.fn.Store(&fn)
+}
+
+func (t *packetTap) observe(dir Direction, pkt []byte) {
+	if fn := t.fn.Load(); fn != nil {
+		(*fn)(dir, pkt)
+	}
+}
+
+// SetPacketTap installs fn to see every packet the client tunnels, or
+// removes the tap when fn is nil. Embedders can use it for health probes or
+// inspection without a second TUN device.
+func (c *Client) SetPacketTap(fn PacketTap) {
+	c.tap.set(fn)
+}
+
+// InjectPacket sends the raw IP packet pkt to the server as if it had been
+// read from the TUN device.
+func (c *Client) InjectPacket(pkt []byte) error {
+	if c.session.Load() == nil {
+		return ErrNotConnected
+	}
+	return c.forward(pkt, nil)
+}
+
+// SetPacketTap installs fn to see every packet the server tunnels, or
+// removes the tap when fn is nil.
+func (s *Server) SetPacketTap(fn PacketTap) {
+	s.tap.set(fn)
+}
+
+// InjectPacket sends the raw IP packet pkt to the client holding its
+// destination address, or to every client, as if it had been read from the
+// TUN device.
+func (s *Server) InjectPacket(pkt []byte) {
+	s.forward(pkt, nil)
+}
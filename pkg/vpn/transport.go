@@ -0,0 +1,121 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+)
+
+// UDPTransport is the name of the built-in transport.
+const UDPTransport = "udp"
+
+// GREEncapsulation frames UDP tunnel datagrams as GRE-in-UDP.
+const GREEncapsulation = "gre"
+
+// Transport carries tunnel datagrams between client and server. UDP is
+// built in; other transports are added with RegisterTransport and chosen
+// with the transport config setting, which must match on both ends.
+type Transport interface {
+	// Listen opens the server side on address, the server_address setting.
+	Listen(ctx context.Context, address string) (PacketConn, error)
+	// Dial opens the client side towards address and returns the server's
+	// address on the transport, which the client writes to and only
+	// accepts datagrams from.
+	Dial(ctx context.Context, address string) (PacketConn, net.Addr, error)
+}
+
+// LowBandwidthTransport is implemented by transports that only suit light
+// traffic such as messaging. Client status flags them, so a slow tunnel is
+// not mistaken for a fault.
+type LowBandwidthTransport interface {
+	Transport
+	LowBandwidth() bool
+}
+
+// PacketConn is one end of a transport. Peers are identified by the
+// addresses ReadFrom returns; their String form must be stable for a peer,
+// since the server uses it to recognise a client across datagrams. Every
+// net.PacketConn satisfies it.
+type PacketConn interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]Transport{}
+)
+
+// RegisterTransport makes t available under name. It is meant to be called
+// from an init function and panics if name is empty or already taken.
+func RegisterTransport(name string, t Transport) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if name == "" || name == UDPTransport || transports[name] != nil {
+		panic(fmt.Sprintf("vpn: transport %q registered twice", name))
+	}
+	transports[name] = t
+}
+
+// Transports returns the names of the registered transports, including
+// the built-in one, sorted.
+func Transports() []string {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	names := []string{UDPTransport}
+	for name := range transports {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// lookupTransport returns the transport registered as name, or nil for the
+// built-in UDP transport, which client and server handle themselves.
+func lookupTransport(name string) (Transport, error) {
+	if name == "" || name == UDPTransport {
+		return nil, nil
+	}
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	t := transports[name]
+	if t == nil {
+		return nil, fmt.Errorf("unknown transport %q", name)
+	}
+	return t, nil
+}
+
+// lowBandwidth reports whether the transport called name is marked slow.
+func lowBandwidth(name string) bool {
+	t, _ := lookupTransport(name)
+	lb, ok := t.(LowBandwidthTransport)
+	return ok && lb.LowBandwidth()
+}
+
+// peerConn presents a transport's PacketConn to the client as a socket
+// connected to the server, dropping datagrams from anyone else.
+type peerConn struct {
+	PacketConn
+	peer net.Addr
+}
+
+func (c *peerConn) Read(b []byte) (int, error) {
+	for {
+		n, from, err := c.ReadFrom(b)
+		if err != nil || from.String() == c.peer.String() {
+			return n, err
+		}
+	}
+}
+
+func (c *peerConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.peer)
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.peer
+}
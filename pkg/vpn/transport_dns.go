@@ -0,0 +1,49 @@
+package vpn
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/gedons/go_VPN/internal/dnstun"
+)
+
+// DNSTransport carries the tunnel in DNS queries to a zone delegated to
+// the server, for emergencies such as captive portals. It is slow.
+//
+// server_address is "zone@host:port". On the server, host:port is where
+// it answers queries and defaults to port 53 on all addresses. On the
+// client it is the resolver to query, and without it the system resolver
+// is used.
+const DNSTransport = "dns"
+
+func init() {
+	RegisterTransport(DNSTransport, dnsTransport{})
+}
+
+type dnsTransport struct{}
+
+func (dnsTransport) Listen(_ context.Context, address string) (PacketConn, error) {
+	zone, host := splitZone(address)
+	if host == "" {
+		host = ":53"
+	}
+	return dnstun.Listen(zone, host)
+}
+
+func (dnsTransport) Dial(ctx context.Context, address string) (PacketConn, net.Addr, error) {
+	zone, resolver := splitZone(address)
+	conn, server, err := dnstun.Dial(ctx, zone, resolver)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, server, nil
+}
+
+func (dnsTransport) LowBandwidth() bool { return true }
+
+// splitZone splits "zone@host:port" into its parts.
+func splitZone(address string) (zone, host string) {
+	zone, host, _ = strings.Cut(address, "@")
+	return zone, host
+}
@@ -0,0 +1,39 @@
+package vpn
+
+import (
+	"context"
+	"net"
+
+	"github.com/gedons/go_VPN/internal/icmp"
+)
+
+// ICMPTransport carries the tunnel in ping messages, as a last resort on
+// networks that block UDP. Both ends need raw socket rights.
+const ICMPTransport = "icmp"
+
+func init() {
+	RegisterTransport(ICMPTransport, icmpTransport{})
+}
+
+type icmpTransport struct{}
+
+func (icmpTransport) Listen(_ context.Context, address string) (PacketConn, error) {
+	return icmp.Listen(icmpHost(address))
+}
+
+func (icmpTransport) Dial(_ context.Context, address string) (PacketConn, net.Addr, error) {
+	conn, server, err := icmp.Dial(icmpHost(address))
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, server, nil
+}
+
+// icmpHost drops the port from address, since ping has none, so configs
+// can switch transports without other changes.
+func icmpHost(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
@@ -0,0 +1,41 @@
+package vpn
+
+import (
+	"context"
+
+	"github.com/gedons/go_VPN/internal/tun"
+)
+
+// TunDevice is a source and sink of raw IP packets that embedders can
+// supply in place of the platform adapter. ReadPacket must be safe to call
+// from multiple goroutines and must return an error once Close is called.
+type TunDevice = tun.Device
+
+// NewClientWithFD constructs a Client over an already configured TUN file
+// descriptor, which the client takes ownership of.
+func NewClientWithFD(cfg Config, fd int) (*Client, error) {
+	dev, err := openTunFD(fd)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(cfg, dev), nil
+}
+
+// NewServerWithFD constructs a Server over an already configured TUN file
+// descriptor, which the server takes ownership of.
+func NewServerWithFD(cfg Config, fd int) (*Server, error) {
+	dev, err := openTunFD(fd)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(cfg, dev), nil
+}
+
+// openTun opens the platform adapter with address cidr, inside netns when
+// that is set.
+func openTun(ctx context.Context, cfg Config, cidr string) (tun.Device, error) {
+	if cfg.Netns != "" {
+		return openTunInNamespace(ctx, cfg, cidr)
+	}
+	return tun.Open(ctx, cfg.AdapterName, cidr)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// openTunFD is only available on Unix systems, where a TUN device is a
+// file descriptor.
+func openTunFD(fd int) (TunDevice, error) {
+	return nil, fmt.Errorf("tun fd on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
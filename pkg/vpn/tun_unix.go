@@ -0,0 +1,9 @@
+//go:build unix
+
+package vpn
+
+import "github.com/gedons/go_VPN/internal/tun"
+
+func openTunFD(fd int) (TunDevice, error) {
+	return tun.NewFileDevice(fd)
+}
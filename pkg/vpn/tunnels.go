@@ -0,0 +1,276 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// tunnelName is what a tunnel may be called, so the name fits in a URL.
+var tunnelName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,31}$`)
+
+// processSettings belong to the process running the tunnels, not to any
+// one of them.
+var processSettings = []string{"mode", "tunnels", "management_address", "status_page"}
+
+// parseTunnels builds the config of each entry in cfg.Tunnels from the
+// top-level settings in data, with the entry's own settings replacing them
+// key by key.
+func parseTunnels(cfg Config, data []byte) (Config, error) {
+	if cfg.Mode != "client" {
+		return Config{}, fmt.Errorf("tunnels is a client setting")
+	}
+	if cfg.StatusPage != "" {
+		return Config{}, fmt.Errorf("status_page cannot be combined with tunnels")
+	}
+	var top yaml.MapSlice
+	if err := yaml.Unmarshal(data, &top); err != nil {
+		return Config{}, fmt.Errorf("parse: %w", err)
+	}
+	base := slices.DeleteFunc(top, func(item yaml.MapItem) bool {
+		return slices.Contains(processSettings, fmt.Sprint(item.Key))
+	})
+
+	cfg.tunnels = make(map[string]Config, len(cfg.Tunnels))
+	adapters := make(map[string]string)
+	for name, override := range cfg.Tunnels {
+		if !tunnelName.MatchString(name) {
+			return Config{}, fmt.Errorf("tunnels: invalid name %q", name)
+		}
+		merged := slices.Clone(base)
+		for _, item := range override {
+			key := fmt.Sprint(item.Key)
+			if slices.Contains(processSettings, key) {
+				return Config{}, fmt.Errorf("tunnel %q: %s cannot be set per tunnel", name, key)
+			}
+			i := slices.IndexFunc(merged, func(m yaml.MapItem) bool { return fmt.Sprint(m.Key) == key })
+			if i >= 0 {
+				merged[i] = item
+			} else {
+				merged = append(merged, item)
+			}
+		}
+		raw, err := yaml.Marshal(merged)
+		if err != nil {
+			return Config{}, fmt.Errorf("tunnel %q: %w", name, err)
+		}
+		t := Config{Mode: "client"}
+		if err := yaml.Unmarshal(raw, &t); err != nil {
+			return Config{}, fmt.Errorf("tunnel %q: %w", name, err)
+		}
+		if err := t.validate(); err != nil {
+			return Config{}, fmt.Errorf("tunnel %q: %w", name, err)
+		}
+		if other, ok := adapters[t.AdapterName]; ok {
+			return Config{}, fmt.Errorf("tunnels %q and %q both use adapter_name %q", other, name, t.AdapterName)
+		}
+		adapters[t.AdapterName] = name
+		cfg.tunnels[name] = t
+	}
+	return cfg, nil
+}
+
+// TunnelConfigs returns the config of each tunnel in tunnels by name, or
+// nil for a single-tunnel config.
+func (c Config) TunnelConfigs() map[string]Config {
+	return c.tunnels
+}
+
+// TunnelStatus is one tunnel as reported by GET /tunnels.
+type TunnelStatus struct {
+	Name   string        `json:"name"`
+	Up     bool          `json:"up"`
+	Error  string        `json:"error,omitempty"` // why it last failed to start
+	Status *ClientStatus `json:"status,omitempty"`
+}
+
+// TunnelList is the body of GET /tunnels.
+type TunnelList struct {
+	Tunnels []TunnelStatus `json:"tunnels"`
+}
+
+// Tunnels runs the tunnels of a multi-tunnel client config in one process,
+// each as its own Client, and brings them up and down on request.
+type Tunnels struct {
+	cfg    Config
+	mgmt   *http.Server
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// opMu serializes Up and Down, which can take a handshake's time; mu
+	// guards clients and errs for readers meanwhile.
+	opMu    sync.Mutex
+	mu      sync.Mutex
+	clients map[string]*Client
+	errs    map[string]string
+}
+
+// NewTunnels returns a Tunnels for cfg, which must have tunnels set.
+func NewTunnels(cfg Config) *Tunnels {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Tunnels{
+		cfg:     cfg,
+		ctx:     ctx,
+		cancel:  cancel,
+		clients: make(map[string]*Client),
+		errs:    make(map[string]string),
+	}
+}
+
+// Start serves the management API and brings every tunnel up. A tunnel
+// that fails to start is logged and left down for gocli up to retry.
+func (t *Tunnels) Start() error {
+	if len(t.cfg.tunnels) == 0 {
+		return errors.New("no tunnels configured")
+	}
+	if t.cfg.ManagementAddress != "" {
+		captureLogs()
+	}
+	log.Print(Build())
+	if t.cfg.ManagementAddress != "" {
+		mgmt, err := startManagement(t.ctx, t.cfg.ManagementAddress, t.managementMux())
+		if err != nil {
+			return err
+		}
+		t.mgmt = mgmt
+	}
+	for _, name := range t.names() {
+		if err := t.Up(name); err != nil {
+			log.Printf("Tunnel %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Stop takes every tunnel down.
+func (t *Tunnels) Stop() {
+	t.cancel()
+	stopManagement(t.mgmt)
+	for _, name := range t.names() {
+		t.Down(name)
+	}
+}
+
+// Up starts the named tunnel unless it is already up.
+func (t *Tunnels) Up(name string) error {
+	cfg, ok := t.cfg.tunnels[name]
+	if !ok {
+		return fmt.Errorf("unknown tunnel %q", name)
+	}
+	t.opMu.Lock()
+	defer t.opMu.Unlock()
+	if t.ctx.Err() != nil {
+		return errors.New("shutting down")
+	}
+	if t.up(name) {
+		return nil
+	}
+	log.Printf("Tunnel %s: starting", name)
+	c := NewClient(cfg)
+	err := c.Start()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.errs[name] = err.Error()
+		return err
+	}
+	delete(t.errs, name)
+	t.clients[name] = c
+	return nil
+}
+
+// Down stops the named tunnel if it is up.
+func (t *Tunnels) Down(name string) error {
+	if _, ok := t.cfg.tunnels[name]; !ok {
+		return fmt.Errorf("unknown tunnel %q", name)
+	}
+	t.opMu.Lock()
+	defer t.opMu.Unlock()
+	t.mu.Lock()
+	c := t.clients[name]
+	delete(t.clients, name)
+	t.mu.Unlock()
+	if c != nil {
+		log.Printf("Tunnel %s: stopping", name)
+		c.Stop()
+	}
+	return nil
+}
+
+// up reports whether the named tunnel is running. A client stopped from
+// elsewhere, such as its status page, counts as down.
+func (t *Tunnels) up(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.clients[name]
+	if c == nil {
+		return false
+	}
+	select {
+	case <-c.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// Status reports every tunnel, sorted by name.
+func (t *Tunnels) Status() TunnelList {
+	list := TunnelList{Tunnels: make([]TunnelStatus, 0, len(t.cfg.tunnels))}
+	for _, name := range t.names() {
+		ts := TunnelStatus{Name: name, Up: t.up(name)}
+		t.mu.Lock()
+		ts.Error = t.errs[name]
+		c := t.clients[name]
+		t.mu.Unlock()
+		if ts.Up {
+			st := c.Status()
+			ts.Status = &st
+		}
+		list.Tunnels = append(list.Tunnels, ts)
+	}
+	return list
+}
+
+func (t *Tunnels) names() []string {
+	names := make([]string, 0, len(t.cfg.tunnels))
+	for name := range t.cfg.tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t *Tunnels) managementMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, t.Status())
+	})
+	mux.HandleFunc("POST /tunnels/{name}/up", func(w http.ResponseWriter, r *http.Request) {
+		if err := t.Up(r.PathValue("name")); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /tunnels/{name}/down", func(w http.ResponseWriter, r *http.Request) {
+		if err := t.Down(r.PathValue("name")); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Build())
+	})
+	handleLogs(mux)
+	return mux
+}
@@ -0,0 +1,71 @@
+package vpn
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+
+	"github.com/gedons/go_VPN/internal/netstack"
+	"github.com/gedons/go_VPN/internal/socks"
+)
+
+// DefaultSocksAddress is where a userspace client's SOCKS5 proxy listens
+// when socks_address is unset.
+const DefaultSocksAddress = "127.0.0.1:1080"
+
+// validateUserspace checks that userspace is a client setting and leaves
+// out the ones that need an adapter.
+func (c Config) validateUserspace() error {
+	if !c.Userspace {
+		return nil
+	}
+	switch {
+	case c.Mode != "client":
+		return fmt.Errorf("userspace is a client setting")
+	case c.Netns != "":
+		return fmt.Errorf("userspace cannot be combined with netns")
+	case c.AllowLAN:
+		return fmt.Errorf("userspace cannot be combined with allow_lan")
+	}
+	if c.SocksAddress != "" {
+		if _, _, err := net.SplitHostPort(c.SocksAddress); err != nil {
+			return fmt.Errorf("socks_address: %w", err)
+		}
+	}
+	return nil
+}
+
+// newUserspaceStack returns the stack a userspace client uses in place of
+// an adapter. With an auto address it is addressed once the lease arrives.
+func newUserspaceStack(cfg Config) (*netstack.Stack, error) {
+	var addr netip.Addr
+	if cfg.AdapterIPCIDR != AutoAddress {
+		p, err := netip.ParsePrefix(cfg.AdapterIPCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("adapter_ip_cidr: %w", err)
+		}
+		addr = p.Addr()
+	}
+	return netstack.New(addr), nil
+}
+
+// startSocks serves the SOCKS5 proxy applications reach the tunnel
+// through, until the client stops.
+func (c *Client) startSocks() error {
+	addr := cmp.Or(c.cfg.SocksAddress, DefaultSocksAddress)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("socks listen: %w", err)
+	}
+	if host, _, err := net.SplitHostPort(ln.Addr().String()); err == nil && !loopbackHost(host) {
+		log.Printf("Warning: SOCKS proxy on %s is reachable from the network and has no login", ln.Addr())
+	}
+	log.Printf("SOCKS proxy listening on %s", ln.Addr())
+	go func() {
+		defer c.journal.guard()
+		socks.Serve(c.ctx, ln, c.stack.DialContext)
+	}()
+	return nil
+}
@@ -0,0 +1,77 @@
+package vpn
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/gedons/go_VPN/internal/protocol"
+)
+
+// CheckProtocolVectors opens the reference protocol vectors with the same
+// helpers the client and server use on live traffic, so a change to either
+// the vectors or the data path that breaks wire compatibility is caught.
+func CheckProtocolVectors() error {
+	if err := protocol.VerifyVectors(); err != nil {
+		return err
+	}
+	set, err := protocol.KnownVectors()
+	if err != nil {
+		return err
+	}
+	clientNonce, _ := hex.DecodeString(set.ClientNonce)
+	serverNonce, _ := hex.DecodeString(set.ServerNonce)
+	hs, err := handshakeCipher(set.PSK)
+	if err != nil {
+		return err
+	}
+	server, err := deriveSessionKeys(set.PSK, clientNonce, serverNonce, true)
+	if err != nil {
+		return err
+	}
+	client, err := deriveSessionKeys(set.PSK, clientNonce, serverNonce, false)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range set.Vectors {
+		pkt, err := hex.DecodeString(v.Packet)
+		if err != nil {
+			return fmt.Errorf("vector %s: %w", v.Name, err)
+		}
+		h, payload, err := protocol.ParseHeader(pkt)
+		if err != nil {
+			return fmt.Errorf("vector %s: %w", v.Name, err)
+		}
+		switch h.Type {
+		case protocol.MsgHandshakeInit:
+			var hello protocol.Hello
+			if err := openHandshake(hs, payload, &hello); err != nil {
+				return fmt.Errorf("vector %s: %w", v.Name, err)
+			}
+			if hex.EncodeToString(hello.Nonce) != set.ClientNonce {
+				return fmt.Errorf("vector %s: nonce mismatch", v.Name)
+			}
+		case protocol.MsgHandshakeResp:
+			var w protocol.Welcome
+			if err := openHandshake(hs, payload, &w); err != nil {
+				return fmt.Errorf("vector %s: %w", v.Name, err)
+			}
+			if w.Error == "" && w.Session != set.Session {
+				return fmt.Errorf("vector %s: session %08x, want %08x", v.Name, w.Session, set.Session)
+			}
+		default:
+			recv := server.recv
+			if v.Direction == protocol.ServerToClient {
+				recv = client.recv
+			}
+			plain, _, err := recv.Decrypt(payload)
+			if err != nil {
+				return fmt.Errorf("vector %s: %w", v.Name, err)
+			}
+			if hex.EncodeToString(plain) != v.Plaintext {
+				return fmt.Errorf("vector %s: plaintext mismatch", v.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+package vpn
+
+import "testing"
+
+// TestProtocolVectors checks the server and client data paths against the
+// reference vectors, as selftest does.
+func TestProtocolVectors(t *testing.T) {
+	if err := CheckProtocolVectors(); err != nil {
+		t.Fatal(err)
+	}
+}
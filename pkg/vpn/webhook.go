@@ -0,0 +1,214 @@
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Webhook event types.
+const (
+	EventConnected    = "client.connected"
+	EventDisconnected = "client.disconnected"
+	EventAuthFailed   = "client.auth_failed"
+	EventProbeFlagged = "probe.flagged"
+)
+
+const (
+	// WebhookSignatureHeader carries the hex HMAC-SHA256 of the body under
+	// the hook's secret.
+	WebhookSignatureHeader = "X-GoVPN-Signature"
+	// WebhookEventHeader carries the event type.
+	WebhookEventHeader = "X-GoVPN-Event"
+
+	webhookQueueLen = 256
+	webhookAttempts = 5
+	webhookTimeout  = 10 * time.Second
+	webhookMaxDelay = 30 * time.Second
+)
+
+// WebhookConfig is one endpoint events are POSTed to.
+type WebhookConfig struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+	// Events limits delivery to these types; empty means all.
+	Events []string `yaml:"events"`
+}
+
+func (c WebhookConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhooks: invalid url %q", c.URL)
+	}
+	for _, e := range c.Events {
+		switch e {
+		case EventConnected, EventDisconnected, EventAuthFailed, EventProbeFlagged:
+		default:
+			return fmt.Errorf("webhooks: unknown event %q", e)
+		}
+	}
+	return nil
+}
+
+// Event is the JSON body of a webhook delivery.
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Session  string    `json:"session,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	Label    string    `json:"label,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Endpoint string    `json:"endpoint"`
+	Address  string    `json:"address,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+
+	// Country and ASN locate Endpoint when geoip is configured.
+	Country string `json:"country,omitempty"`
+	ASN     uint32 `json:"asn,omitempty"`
+}
+
+func (ev *Event) setGeo(g geoInfo) {
+	ev.Country, ev.ASN = g.Country, g.ASN
+}
+
+// webhooks fans events out to the configured endpoints. Each endpoint has
+// its own queue and sender, so a slow one does not hold up the others or
+// the packet path.
+type webhooks struct {
+	hooks []*webhook
+}
+
+type webhook struct {
+	cfg   WebhookConfig
+	queue chan Event
+	http  *http.Client
+}
+
+func newWebhooks(cfgs []WebhookConfig) *webhooks {
+	w := &webhooks{}
+	for _, cfg := range cfgs {
+		w.hooks = append(w.hooks, &webhook{
+			cfg:   cfg,
+			queue: make(chan Event, webhookQueueLen),
+			http:  &http.Client{Timeout: webhookTimeout},
+		})
+	}
+	return w
+}
+
+func (w *webhooks) start(ctx context.Context, wg *sync.WaitGroup) {
+	for _, h := range w.hooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.run(ctx)
+		}()
+	}
+}
+
+// emit queues ev for every endpoint that wants it without blocking. It is
+// safe to call on a nil *webhooks.
+func (w *webhooks) emit(ev Event) {
+	if w == nil {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	for _, h := range w.hooks {
+		if len(h.cfg.Events) > 0 && !slices.Contains(h.cfg.Events, ev.Type) {
+			continue
+		}
+		select {
+		case h.queue <- ev:
+		default:
+			log.Printf("Webhook %s: queue full, dropping %s event", h.cfg.URL, ev.Type)
+		}
+	}
+}
+
+func (h *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-h.queue:
+			h.deliver(ctx, ev)
+		}
+	}
+}
+
+// deliver POSTs ev, retrying with exponential backoff until the endpoint
+// answers 2xx or the attempts run out.
+func (h *webhook) deliver(ctx context.Context, ev Event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(h.cfg.Secret))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := h.post(ctx, ev.Type, body, sig)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("Webhook %s: giving up on %s event: %v", h.cfg.URL, ev.Type, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, webhookMaxDelay)
+	}
+}
+
+func (h *webhook) post(ctx context.Context, event string, body []byte, sig string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, event)
+	req.Header.Set(WebhookSignatureHeader, sig)
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// event describes sess for a webhook.
+func (sess *serverSession) event(typ, reason string) Event {
+	ev := Event{
+		Type:     typ,
+		Session:  fmt.Sprintf("%08x", sess.id),
+		Client:   sess.name,
+		Label:    sess.label,
+		User:     sess.user,
+		Endpoint: sess.remote().String(),
+		Reason:   reason,
+	}
+	if sess.address.IsValid() {
+		ev.Address = sess.address.String()
+	}
+	ev.setGeo(sess.geo)
+	return ev
+}